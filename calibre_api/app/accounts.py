@@ -0,0 +1,858 @@
+"""
+Optional user accounts, for libraries shared by a household or a group of friends. Off unless
+SHELFSTONE_ACCOUNTS=1; without it the server stays single-user and only the admin token (see
+auth) is checked.
+
+Users sign in with a username and password and then authenticate with a token: a session token
+(set as a cookie by POST /auth/login, for the web UI) or an API token they create for scripts
+and reading apps. Only hashes of passwords (scrypt) and tokens (SHA-256) are stored, in a small
+SQLite database (SHELFSTONE_ACCOUNTS_DB, in the state directory by default; see state_store).
+
+Users have the role "user" or "admin"; admins manage the other accounts. The first account is
+created with POST /auth/setup and is always an admin. Everyone else is added by an admin,
+registers with an invitation an admin created (create_invitation), or registers themselves if
+SHELFSTONE_OPEN_REGISTRATION=1.
+
+Regular users can be restricted to some libraries and to the books with some tags (`libraries`
+and `tags`, None for all); auth enforces that.
+
+Users can give an email address (unique, case-insensitive), which is where password_reset sends
+a reset link when they forget their password; password_stamp and reset_password are its side here.
+"""
+import base64
+import hashlib
+import hmac
+import json
+import os
+import re
+import secrets
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, List, Optional, Tuple
+
+from . import state_store
+
+_lock = threading.Lock()
+
+USER = "user"
+ADMIN = "admin"
+ROLES = (USER, ADMIN)
+
+SESSION = "session"
+API = "api"
+
+# What happens to the books a deleted user added (see provenance): recorded as added by an admin, or removed.
+REASSIGN = "reassign"
+DELETE = "delete"
+UPLOAD_HANDLING = (REASSIGN, DELETE)
+
+SESSION_DAYS = 30
+INVITATION_DAYS = 7
+MAX_INVITATION_DAYS = 90
+MAX_NOTE_LENGTH = 500
+MAX_RESTRICTIONS = 100
+MIN_PASSWORD_LENGTH = 8
+MAX_PASSWORD_LENGTH = 1024
+USERNAME_PATTERN = re.compile(r"^[A-Za-z0-9][A-Za-z0-9._@-]{0,63}$")
+# Deliberately loose: a mailbox, an @ and a domain with a dot. Whether it works shows when mail is sent.
+EMAIL_PATTERN = re.compile(r"^[^@\s]+@[^@\s]+\.[^@\s.]+$")
+MAX_EMAIL_LENGTH = 254
+# last_used_at is only written when it is older than this, so busy clients don't write on every request.
+LAST_USED_RESOLUTION_SECONDS = 60
+
+# scrypt parameters for new hashes; stored hashes carry their own, so these can be raised later.
+SCRYPT_N = 2 ** 14
+SCRYPT_R = 8
+SCRYPT_P = 1
+
+
+class UserNotFound(Exception):
+    """No user with this ID or name."""
+
+
+class UserExists(Exception):
+    """Another user has this username."""
+
+
+class RegistrationClosed(Exception):
+    """Self-registration is off, or the first admin has already been set up."""
+
+
+class LastAdmin(Exception):
+    """The change would leave no enabled admin."""
+
+
+class TokenNotFound(Exception):
+    """The user has no API token with this ID."""
+
+
+class InvitationNotFound(Exception):
+    """There is no invitation with this ID."""
+
+
+class InvalidInvitation(Exception):
+    """The invitation token is unknown, already used or expired."""
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: users and their session and API tokens.
+    (
+        "CREATE TABLE users ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT NOT NULL, password_hash TEXT NOT NULL, "
+        "role TEXT NOT NULL, disabled INTEGER NOT NULL DEFAULT 0, created_at REAL NOT NULL)",
+        "CREATE UNIQUE INDEX users_username ON users (username COLLATE NOCASE)",
+        "CREATE TABLE tokens ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE, "
+        "kind TEXT NOT NULL, name TEXT, token_hash TEXT NOT NULL UNIQUE, created_at REAL NOT NULL, "
+        "last_used_at REAL, expires_at REAL)",
+        "CREATE INDEX tokens_user ON tokens (user_id)",
+    ),
+    # 2: the MD5 of API tokens, which KOReader sends instead of the password (see kosync).
+    (
+        "ALTER TABLE tokens ADD COLUMN kosync_key TEXT",
+        "CREATE INDEX tokens_kosync_key ON tokens (kosync_key)",
+    ),
+    # 3: restrictions to some libraries and tags (JSON lists, NULL for all), and invitations.
+    (
+        "ALTER TABLE users ADD COLUMN libraries TEXT",
+        "ALTER TABLE users ADD COLUMN tags TEXT",
+        "CREATE TABLE invitations ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, token_hash TEXT NOT NULL UNIQUE, role TEXT NOT NULL, "
+        "libraries TEXT, tags TEXT, note TEXT, created_by INTEGER, created_at REAL NOT NULL, "
+        "expires_at REAL NOT NULL, used_at REAL, used_by INTEGER)",
+    ),
+    # 4: email addresses, for password resets.
+    (
+        "ALTER TABLE users ADD COLUMN email TEXT",
+        "CREATE UNIQUE INDEX users_email ON users (email COLLATE NOCASE)",
+    ),
+]
+
+
+def enabled() -> bool:
+    return os.environ.get("SHELFSTONE_ACCOUNTS", "").strip().lower() in ("1", "true", "yes")
+
+
+def open_registration() -> bool:
+    return os.environ.get("SHELFSTONE_OPEN_REGISTRATION", "").strip().lower() in ("1", "true", "yes")
+
+
+def parse_upload_handling(value: Optional[str]) -> str:
+    """
+    Raises:
+        ValueError: If the value is not one of UPLOAD_HANDLING.
+    """
+    value = (value or REASSIGN).strip().lower()
+    if value not in UPLOAD_HANDLING:
+        raise ValueError(f"Unknown handling of a deleted user's uploads '{value}'; expected one of {', '.join(UPLOAD_HANDLING)}.")
+    return value
+
+
+def deleted_user_uploads() -> str:
+    """What happens to a deleted user's uploads by default (SHELFSTONE_DELETED_USER_UPLOADS)."""
+    return parse_upload_handling(os.environ.get("SHELFSTONE_DELETED_USER_UPLOADS"))
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_ACCOUNTS_DB", "accounts.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    conn = state_store.connect(path or db_path(), MIGRATIONS)
+    conn.execute("PRAGMA foreign_keys = ON")
+    return conn
+
+
+# --- Passwords and tokens ---
+
+def hash_password(password: str) -> str:
+    salt = os.urandom(16)
+    digest = hashlib.scrypt(password.encode(), salt=salt, n=SCRYPT_N, r=SCRYPT_R, p=SCRYPT_P, dklen=32)
+    return "$".join(("scrypt", str(SCRYPT_N), str(SCRYPT_R), str(SCRYPT_P),
+                     base64.b64encode(salt).decode(), base64.b64encode(digest).decode()))
+
+
+def verify_password(password: str, password_hash: str) -> bool:
+    try:
+        scheme, n, r, p, salt, digest = password_hash.split("$")
+        if scheme != "scrypt":
+            return False
+        expected = base64.b64decode(digest)
+        given = hashlib.scrypt(password.encode(), salt=base64.b64decode(salt), n=int(n), r=int(r), p=int(p),
+                               dklen=len(expected))
+    except (ValueError, TypeError):
+        return False
+    return hmac.compare_digest(given, expected)
+
+
+def token_hash(token: str) -> str:
+    return hashlib.sha256(token.encode()).hexdigest()
+
+
+def kosync_key(token: str) -> str:
+    """What KOReader sends as the key when the token is entered as the password: its MD5."""
+    return hashlib.md5(token.encode()).hexdigest()
+
+
+def validate_username(username: Optional[str]) -> str:
+    username = (username or "").strip()
+    if not USERNAME_PATTERN.match(username):
+        raise ValueError("Usernames are 1 to 64 letters, digits and . _ @ -, starting with a letter or digit.")
+    return username
+
+
+def validate_password(password: Optional[str]) -> str:
+    if not password or len(password) < MIN_PASSWORD_LENGTH:
+        raise ValueError(f"Passwords must be at least {MIN_PASSWORD_LENGTH} characters.")
+    if len(password) > MAX_PASSWORD_LENGTH:
+        raise ValueError(f"Passwords must be at most {MAX_PASSWORD_LENGTH} characters.")
+    return password
+
+
+def validate_email(email: Optional[str]) -> Optional[str]:
+    """The address, trimmed; None for no address ("" or None)."""
+    email = (email or "").strip()
+    if not email:
+        return None
+    if len(email) > MAX_EMAIL_LENGTH or not EMAIL_PATTERN.match(email):
+        raise ValueError("That doesn't look like an email address.")
+    return email
+
+
+def validate_restrictions(role: str, libraries: Optional[List[str]], tags: Optional[List[str]]) -> Tuple[Optional[str], Optional[str]]:
+    """
+    Checks restrictions to libraries (paths; "" for calibredb's default) and tags, and returns
+    them as stored: JSON lists, or None for no restriction.
+
+    Raises:
+        ValueError: For restricted admins, empty lists or too many entries.
+    """
+    stored = []
+    for name, values, normalize in (("libraries", libraries, state_store.library_key), ("tags", tags, str.strip)):
+        if values is None:
+            stored.append(None)
+            continue
+        if role == ADMIN:
+            raise ValueError("Admins can't be restricted to some libraries or tags.")
+        values = list(dict.fromkeys(normalize(v) for v in values if name == "libraries" or v.strip()))
+        if not values or len(values) > MAX_RESTRICTIONS:
+            raise ValueError(f"Restrict {name} to 1 to {MAX_RESTRICTIONS} entries, or leave them out for all.")
+        stored.append(json.dumps(values))
+    return stored[0], stored[1]
+
+
+# --- Users ---
+
+_USER_FIELDS = ("id", "username", "email", "role", "disabled", "created_at", "libraries", "tags")
+_SELECT_USER = f"SELECT {', '.join(_USER_FIELDS)} FROM users"
+
+
+def _as_user(row) -> Dict[str, Any]:
+    user = dict(zip(_USER_FIELDS, row))
+    user["disabled"] = bool(user["disabled"])
+    for field in ("libraries", "tags"):
+        user[field] = json.loads(user[field]) if user[field] else None
+    return user
+
+
+def _get_user(conn: sqlite3.Connection, user_id: int) -> Dict[str, Any]:
+    row = conn.execute(f"{_SELECT_USER} WHERE id = ?", (user_id,)).fetchone()
+    if row is None:
+        raise UserNotFound(f"User {user_id} not found.")
+    return _as_user(row)
+
+
+def _taken(e: sqlite3.IntegrityError, username: str) -> UserExists:
+    if "email" in str(e):
+        return UserExists("Another account has this email address.")
+    return UserExists(f"The username '{username}' is taken.")
+
+
+def _insert_user(conn: sqlite3.Connection, username: str, password: str, role: str,
+                 libraries: Optional[str] = None, tags: Optional[str] = None, email: Optional[str] = None) -> int:
+    try:
+        with conn:
+            return conn.execute("INSERT INTO users (username, password_hash, role, created_at, libraries, tags, email) "
+                                "VALUES (?, ?, ?, ?, ?, ?, ?)",
+                                (username, hash_password(password), role, time.time(), libraries, tags, email)).lastrowid
+    except sqlite3.IntegrityError as e:
+        raise _taken(e, username)
+
+
+def _check_role(role: str) -> str:
+    if role not in ROLES:
+        raise ValueError(f"Unknown role '{role}'; expected one of {', '.join(ROLES)}.")
+    return role
+
+
+def has_users() -> bool:
+    if not os.path.exists(db_path()):
+        return False
+    with _lock:
+        conn = connect()
+        try:
+            return conn.execute("SELECT 1 FROM users LIMIT 1").fetchone() is not None
+        finally:
+            conn.close()
+
+
+def create_user(username: str, password: str, role: str = USER, libraries: Optional[List[str]] = None,
+                tags: Optional[List[str]] = None, email: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Raises:
+        ValueError: For an invalid username, password, role, restrictions or email address.
+        UserExists: If the username or email address is taken (case-insensitive).
+    """
+    username, password, role = validate_username(username), validate_password(password), _check_role(role)
+    stored_libraries, stored_tags = validate_restrictions(role, libraries, tags)
+    email = validate_email(email)
+    with _lock:
+        conn = connect()
+        try:
+            return _get_user(conn, _insert_user(conn, username, password, role, stored_libraries, stored_tags, email))
+        finally:
+            conn.close()
+
+
+def setup_admin(username: str, password: str) -> Dict[str, Any]:
+    """
+    Creates the first account, as an admin.
+
+    Raises:
+        ValueError: For an invalid username or password.
+        RegistrationClosed: If there already are accounts.
+    """
+    username, password = validate_username(username), validate_password(password)
+    with _lock:
+        conn = connect()
+        try:
+            # Checked and inserted under the write lock, so two first-run requests can't both become admin.
+            conn.execute("BEGIN IMMEDIATE")
+            try:
+                if conn.execute("SELECT 1 FROM users LIMIT 1").fetchone() is not None:
+                    raise RegistrationClosed("The server is already set up; sign in, or ask an admin for an account.")
+                user_id = conn.execute("INSERT INTO users (username, password_hash, role, created_at) VALUES (?, ?, ?, ?)",
+                                       (username, hash_password(password), ADMIN, time.time())).lastrowid
+                conn.execute("COMMIT")
+            except BaseException:
+                conn.execute("ROLLBACK")
+                raise
+            return _get_user(conn, user_id)
+        finally:
+            conn.close()
+
+
+def register(username: str, password: str) -> Dict[str, Any]:
+    """
+    Self-registration as a regular user.
+
+    Raises:
+        RegistrationClosed: If SHELFSTONE_OPEN_REGISTRATION is off, or nobody has set up the server yet.
+        ValueError, UserExists: As for create_user.
+    """
+    if not open_registration():
+        raise RegistrationClosed("Registration is closed; ask an admin for an account.")
+    if not has_users():
+        raise RegistrationClosed("The server isn't set up yet; create the first admin with POST /auth/setup.")
+    return create_user(username, password)
+
+
+def get_user(user_id: int) -> Dict[str, Any]:
+    with _lock:
+        conn = connect()
+        try:
+            return _get_user(conn, user_id)
+        finally:
+            conn.close()
+
+
+def list_users() -> List[Dict[str, Any]]:
+    with _lock:
+        conn = connect()
+        try:
+            return [_as_user(row) for row in conn.execute(f"{_SELECT_USER} ORDER BY username COLLATE NOCASE")]
+        finally:
+            conn.close()
+
+
+def _enabled_admins(conn: sqlite3.Connection) -> List[int]:
+    return [row[0] for row in conn.execute("SELECT id FROM users WHERE role = ? AND disabled = 0 ORDER BY id", (ADMIN,))]
+
+
+def enabled_admins() -> List[int]:
+    """IDs of the enabled admins, oldest account first."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            return _enabled_admins(conn)
+        finally:
+            conn.close()
+
+
+def update_user(user_id: int, changes: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Changes the role, restrictions or email address, disables or enables the account, or sets a
+    new password; only the given fields change. Disabling an account or setting its password signs
+    it out everywhere.
+
+    Raises:
+        ValueError: For unknown fields or invalid values.
+        UserNotFound: If there is no such user.
+        UserExists: If another account has the email address.
+        LastAdmin: If the change would leave no enabled admin.
+    """
+    unknown = set(changes) - {"role", "disabled", "password", "libraries", "tags", "email"}
+    if unknown:
+        raise ValueError(f"Unknown field(s): {', '.join(sorted(unknown))}.")
+    if "role" in changes:
+        _check_role(changes["role"])
+    if "password" in changes:
+        validate_password(changes["password"])
+    email = validate_email(changes.get("email"))
+    with _lock:
+        conn = connect()
+        try:
+            user = _get_user(conn, user_id)
+            restrictions = {field: changes.get(field, user[field]) for field in ("libraries", "tags")}
+            stored_libraries, stored_tags = validate_restrictions(changes.get("role", user["role"]), **restrictions)
+            demoted = changes.get("role", user["role"]) != ADMIN or changes.get("disabled", user["disabled"])
+            if demoted and _enabled_admins(conn) == [user_id]:
+                raise LastAdmin("This is the only enabled admin; make another user an admin first.")
+            with conn:
+                if "role" in changes:
+                    conn.execute("UPDATE users SET role = ? WHERE id = ?", (changes["role"], user_id))
+                conn.execute("UPDATE users SET libraries = ?, tags = ? WHERE id = ?", (stored_libraries, stored_tags, user_id))
+                if "disabled" in changes:
+                    conn.execute("UPDATE users SET disabled = ? WHERE id = ?", (int(bool(changes["disabled"])), user_id))
+                if "password" in changes:
+                    conn.execute("UPDATE users SET password_hash = ? WHERE id = ?", (hash_password(changes["password"]), user_id))
+                if "email" in changes:
+                    _set_email(conn, user_id, email, user["username"])
+                if changes.get("disabled") or "password" in changes:
+                    conn.execute("DELETE FROM tokens WHERE user_id = ? AND kind = ?", (user_id, SESSION))
+            return _get_user(conn, user_id)
+        finally:
+            conn.close()
+
+
+def delete_user(user_id: int) -> None:
+    """
+    Deletes the account with its tokens.
+
+    Raises:
+        UserNotFound: If there is no such user.
+        LastAdmin: If it is the only enabled admin.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get_user(conn, user_id)
+            if _enabled_admins(conn) == [user_id]:
+                raise LastAdmin("This is the only enabled admin; make another user an admin first.")
+            with conn:
+                conn.execute("DELETE FROM users WHERE id = ?", (user_id,))
+        finally:
+            conn.close()
+
+
+def authenticate(username: str, password: str) -> Optional[Dict[str, Any]]:
+    """The enabled user with this username and password, or None."""
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute("SELECT id, password_hash, disabled FROM users WHERE username = ? COLLATE NOCASE",
+                               ((username or "").strip(),)).fetchone()
+        finally:
+            conn.close()
+    if row is None:
+        # Hash anyway, so response times don't tell which usernames exist.
+        hash_password(password or "")
+        return None
+    user_id, password_hash, disabled = row
+    if disabled or not verify_password(password or "", password_hash):
+        return None
+    return get_user(user_id)
+
+
+def change_password(user_id: int, current_password: str, new_password: str, keep_token: Optional[str] = None) -> None:
+    """
+    Sets a new password after checking the current one, and ends the user's other sessions.
+
+    Raises:
+        ValueError: If the current password is wrong or the new one is invalid.
+    """
+    validate_password(new_password)
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute("SELECT password_hash FROM users WHERE id = ?", (user_id,)).fetchone()
+            if row is None or not verify_password(current_password or "", row[0]):
+                raise ValueError("The current password is wrong.")
+            with conn:
+                conn.execute("UPDATE users SET password_hash = ? WHERE id = ?", (hash_password(new_password), user_id))
+                conn.execute("DELETE FROM tokens WHERE user_id = ? AND kind = ? AND token_hash != ?",
+                             (user_id, SESSION, token_hash(keep_token or "")))
+        finally:
+            conn.close()
+
+
+def _set_email(conn: sqlite3.Connection, user_id: int, email: Optional[str], username: str) -> None:
+    try:
+        conn.execute("UPDATE users SET email = ? WHERE id = ?", (email, user_id))
+    except sqlite3.IntegrityError as e:
+        raise _taken(e, username)
+
+
+def set_email(user_id: int, email: Optional[str], current_password: str) -> Dict[str, Any]:
+    """
+    Sets or (with "" or None) removes the user's email address after checking their password,
+    since it is where password resets go.
+
+    Raises:
+        ValueError: If the password is wrong or the address invalid.
+        UserExists: If another account has the address.
+    """
+    email = validate_email(email)
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute("SELECT password_hash, username FROM users WHERE id = ?", (user_id,)).fetchone()
+            if row is None or not verify_password(current_password or "", row[0]):
+                raise ValueError("The current password is wrong.")
+            with conn:
+                _set_email(conn, user_id, email, row[1])
+            return _get_user(conn, user_id)
+        finally:
+            conn.close()
+
+
+# --- Password resets (see password_reset) ---
+
+def user_for_email(email: str) -> Optional[Dict[str, Any]]:
+    """The enabled user with this email address (case-insensitive), or None."""
+    if not email or not os.path.exists(db_path()):
+        return None
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute(f"{_SELECT_USER} WHERE email = ? COLLATE NOCASE AND disabled = 0", (email.strip(),)).fetchone()
+        finally:
+            conn.close()
+    return _as_user(row) if row else None
+
+
+def password_stamp(user_id: int) -> Optional[str]:
+    """
+    A value that changes whenever the user's password does, for signing reset tokens so they stop
+    working once used; None for unknown or disabled users.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute("SELECT password_hash FROM users WHERE id = ? AND disabled = 0", (user_id,)).fetchone()
+        finally:
+            conn.close()
+    return hashlib.sha256(row[0].encode()).hexdigest() if row else None
+
+
+def reset_password(user_id: int, new_password: str, stamp: str) -> bool:
+    """
+    Sets a new password if the user's password_stamp still is `stamp`, and signs them out
+    everywhere. False if it isn't (the password changed since, e.g. by an earlier reset).
+
+    Raises:
+        ValueError: If the new password is invalid.
+    """
+    validate_password(new_password)
+    password_hash = hash_password(new_password)
+    with _lock:
+        conn = connect()
+        try:
+            # Checked and changed under the write lock, so a reset token works once.
+            conn.execute("BEGIN IMMEDIATE")
+            try:
+                row = conn.execute("SELECT password_hash FROM users WHERE id = ? AND disabled = 0", (user_id,)).fetchone()
+                if row is None or not hmac.compare_digest(hashlib.sha256(row[0].encode()).hexdigest(), stamp or ""):
+                    conn.execute("ROLLBACK")
+                    return False
+                conn.execute("UPDATE users SET password_hash = ? WHERE id = ?", (password_hash, user_id))
+                conn.execute("DELETE FROM tokens WHERE user_id = ? AND kind = ?", (user_id, SESSION))
+                conn.execute("COMMIT")
+            except BaseException:
+                conn.execute("ROLLBACK")
+                raise
+            return True
+        finally:
+            conn.close()
+
+
+# --- Sessions and API tokens ---
+
+def _insert_token(conn: sqlite3.Connection, user_id: int, kind: str, name: Optional[str],
+                  expires_at: Optional[float]) -> Tuple[int, str]:
+    token = secrets.token_urlsafe(32)
+    # Only API tokens can be entered in KOReader; sessions don't need the weaker MD5 lookup.
+    key = kosync_key(token) if kind == API else None
+    with conn:
+        token_id = conn.execute(
+            "INSERT INTO tokens (user_id, kind, name, token_hash, kosync_key, created_at, expires_at) "
+            "VALUES (?, ?, ?, ?, ?, ?, ?)",
+            (user_id, kind, name, token_hash(token), key, time.time(), expires_at)).lastrowid
+    return token_id, token
+
+
+def create_session(user_id: int) -> Dict[str, Any]:
+    """A new session token for the user: {"token", "expires_at"}."""
+    expires_at = time.time() + SESSION_DAYS * 86400
+    with _lock:
+        conn = connect()
+        try:
+            # Expired sessions are dropped here rather than by a cleanup job.
+            with conn:
+                conn.execute("DELETE FROM tokens WHERE kind = ? AND expires_at < ?", (SESSION, time.time()))
+            _, token = _insert_token(conn, user_id, SESSION, None, expires_at)
+        finally:
+            conn.close()
+    return {"token": token, "expires_at": expires_at}
+
+
+def end_session(token: str) -> None:
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM tokens WHERE token_hash = ? AND kind = ?", (token_hash(token), SESSION))
+        finally:
+            conn.close()
+
+
+_TOKEN_FIELDS = ("id", "name", "created_at", "last_used_at")
+
+
+def create_api_token(user_id: int, name: str) -> Dict[str, Any]:
+    """
+    A new API token. The token itself is only returned here; the server keeps its hash.
+
+    Raises:
+        ValueError: If the name is empty or too long.
+    """
+    name = (name or "").strip()
+    if not name or len(name) > 100:
+        raise ValueError("API token names are 1 to 100 characters.")
+    with _lock:
+        conn = connect()
+        try:
+            token_id, token = _insert_token(conn, user_id, API, name, None)
+            row = conn.execute(f"SELECT {', '.join(_TOKEN_FIELDS)} FROM tokens WHERE id = ?", (token_id,)).fetchone()
+        finally:
+            conn.close()
+    return {**dict(zip(_TOKEN_FIELDS, row)), "token": token}
+
+
+def list_api_tokens(user_id: int) -> List[Dict[str, Any]]:
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT {', '.join(_TOKEN_FIELDS)} FROM tokens WHERE user_id = ? AND kind = ? ORDER BY id",
+                                (user_id, API)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(_TOKEN_FIELDS, row)) for row in rows]
+
+
+def revoke_api_token(user_id: int, token_id: int) -> None:
+    """
+    Raises:
+        TokenNotFound: If the user has no API token with this ID.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                deleted = conn.execute("DELETE FROM tokens WHERE id = ? AND user_id = ? AND kind = ?",
+                                       (token_id, user_id, API)).rowcount
+        finally:
+            conn.close()
+    if not deleted:
+        raise TokenNotFound(f"API token {token_id} not found.")
+
+
+def _user_by_token(where: str, params: Tuple) -> Optional[Dict[str, Any]]:
+    """The enabled user of the valid token matching `where`, recording that the token was used."""
+    if not os.path.exists(db_path()):
+        return None
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute(
+                f"SELECT t.id, t.last_used_at, {', '.join('u.' + f for f in _USER_FIELDS)} "
+                "FROM tokens t JOIN users u ON u.id = t.user_id "
+                f"WHERE {where} AND u.disabled = 0 AND (t.expires_at IS NULL OR t.expires_at > ?)",
+                (*params, now)).fetchone()
+            if row is None:
+                return None
+            token_id, last_used_at = row[0], row[1]
+            if last_used_at is None or now - last_used_at > LAST_USED_RESOLUTION_SECONDS:
+                with conn:
+                    conn.execute("UPDATE tokens SET last_used_at = ? WHERE id = ?", (now, token_id))
+        finally:
+            conn.close()
+    return _as_user(row[2:])
+
+
+def user_for_token(token: str) -> Optional[Dict[str, Any]]:
+    """The enabled user a valid session or API token belongs to, or None."""
+    if not token:
+        return None
+    return _user_by_token("t.token_hash = ?", (token_hash(token),))
+
+
+def user_for_kosync_key(username: str, key: str) -> Optional[Dict[str, Any]]:
+    """The enabled user with this username whose API token has this MD5 (see kosync_key), or None."""
+    if not username or not key:
+        return None
+    return _user_by_token("t.kosync_key = ? AND t.kind = ? AND u.username = ? COLLATE NOCASE",
+                          (key.strip().lower(), API, username.strip()))
+
+
+# --- Invitations ---
+
+_INVITATION_FIELDS = ("id", "role", "libraries", "tags", "note", "created_by", "created_at", "expires_at", "used_at", "used_by")
+_SELECT_INVITATION = f"SELECT {', '.join(_INVITATION_FIELDS)} FROM invitations"
+
+
+def _as_invitation(row) -> Dict[str, Any]:
+    invitation = dict(zip(_INVITATION_FIELDS, row))
+    for field in ("libraries", "tags"):
+        invitation[field] = json.loads(invitation[field]) if invitation[field] else None
+    return invitation
+
+
+def create_invitation(role: str = USER, libraries: Optional[List[str]] = None, tags: Optional[List[str]] = None,
+                      note: Optional[str] = None, created_by: Optional[int] = None,
+                      days: float = INVITATION_DAYS) -> Dict[str, Any]:
+    """
+    A single-use invitation: whoever registers with its token (register_with_invitation) gets an
+    account with the role and restrictions given here. Returns the invitation with its token,
+    which is only known now; the server keeps a hash.
+
+    Raises:
+        ValueError: For an invalid role, restrictions, note or lifetime.
+    """
+    _check_role(role)
+    stored_libraries, stored_tags = validate_restrictions(role, libraries, tags)
+    note = (note or "").strip() or None
+    if note and len(note) > MAX_NOTE_LENGTH:
+        raise ValueError(f"The note must be at most {MAX_NOTE_LENGTH} characters.")
+    if not 0 < days <= MAX_INVITATION_DAYS:
+        raise ValueError(f"Invitations last up to {MAX_INVITATION_DAYS} days.")
+    token = secrets.token_urlsafe(32)
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                invitation_id = conn.execute(
+                    "INSERT INTO invitations (token_hash, role, libraries, tags, note, created_by, created_at, expires_at) "
+                    "VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+                    (token_hash(token), role, stored_libraries, stored_tags, note, created_by, now, now + days * 86400)).lastrowid
+            row = conn.execute(f"{_SELECT_INVITATION} WHERE id = ?", (invitation_id,)).fetchone()
+        finally:
+            conn.close()
+    return {**_as_invitation(row), "token": token}
+
+
+def list_invitations() -> List[Dict[str, Any]]:
+    """All invitations, newest first, used and expired ones included."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            return [_as_invitation(row) for row in conn.execute(f"{_SELECT_INVITATION} ORDER BY id DESC")]
+        finally:
+            conn.close()
+
+
+def revoke_invitation(invitation_id: int) -> None:
+    """
+    Deletes the invitation, so its token no longer works.
+
+    Raises:
+        InvitationNotFound: If there is no such invitation.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                deleted = conn.execute("DELETE FROM invitations WHERE id = ?", (invitation_id,)).rowcount
+        finally:
+            conn.close()
+    if not deleted:
+        raise InvitationNotFound(f"Invitation {invitation_id} not found.")
+
+
+def _open_invitation(conn: sqlite3.Connection, token: str) -> Dict[str, Any]:
+    row = conn.execute(f"{_SELECT_INVITATION} WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?",
+                       (token_hash(token or ""), time.time())).fetchone()
+    if row is None:
+        raise InvalidInvitation("This invitation is unknown, already used or expired; ask for a new one.")
+    return _as_invitation(row)
+
+
+def check_invitation(token: str) -> Dict[str, Any]:
+    """
+    The invitation with this token, if it can still be used.
+
+    Raises:
+        InvalidInvitation: If it is unknown, used or expired.
+    """
+    if not os.path.exists(db_path()):
+        raise InvalidInvitation("This invitation is unknown, already used or expired; ask for a new one.")
+    with _lock:
+        conn = connect()
+        try:
+            return _open_invitation(conn, token)
+        finally:
+            conn.close()
+
+
+def register_with_invitation(token: str, username: str, password: str) -> Dict[str, Any]:
+    """
+    Creates the account an invitation is for and uses the invitation up. Works whether or not
+    registration is open.
+
+    Raises:
+        InvalidInvitation: If the invitation is unknown, used or expired.
+        ValueError, UserExists: As for create_user.
+    """
+    username, password = validate_username(username), validate_password(password)
+    password_hash = hash_password(password)
+    with _lock:
+        conn = connect()
+        try:
+            # Under the write lock, so two registrations can't both use the invitation.
+            conn.execute("BEGIN IMMEDIATE")
+            try:
+                invitation = _open_invitation(conn, token)
+                try:
+                    user_id = conn.execute(
+                        "INSERT INTO users (username, password_hash, role, created_at, libraries, tags) VALUES (?, ?, ?, ?, ?, ?)",
+                        (username, password_hash, invitation["role"], time.time(),
+                         json.dumps(invitation["libraries"]) if invitation["libraries"] is not None else None,
+                         json.dumps(invitation["tags"]) if invitation["tags"] is not None else None)).lastrowid
+                except sqlite3.IntegrityError as e:
+                    raise _taken(e, username)
+                conn.execute("UPDATE invitations SET used_at = ?, used_by = ? WHERE id = ?", (time.time(), user_id, invitation["id"]))
+                conn.execute("COMMIT")
+            except BaseException:
+                conn.execute("ROLLBACK")
+                raise
+            return _get_user(conn, user_id)
+        finally:
+            conn.close()
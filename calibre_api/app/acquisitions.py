@@ -0,0 +1,188 @@
+"""
+Acquisition data (store, price, currency, purchase date, DRM source account) and spending
+reports, for collectors and insurance documentation. Like physical copies, the data lives
+in custom columns of the library (#store, #price, #currency, #purchase_date, #drm_source).
+"""
+import csv
+import io
+import re
+from collections import defaultdict
+from typing import Any, Dict, List, Optional
+
+from .crud import list_books, list_custom_columns
+from .custom_fields import CustomColumn, read_values, set_values
+from . import physical
+from .localeformat import DEFAULT_LOCALE, convert, format_date, format_number, get_locale
+
+ACQUISITION_COLUMNS = [
+    CustomColumn("store", "Store", "text"),
+    CustomColumn("price", "Price", "float"),
+    CustomColumn("currency", "Currency", "text"),
+    CustomColumn("purchase_date", "Purchase date", "datetime"),
+    CustomColumn("drm_source", "DRM source account", "text"),
+]
+
+_CURRENCY_RE = re.compile(r"^[A-Z]{3}$")
+
+EXPORT_FIELDS = ["id", "title", "authors", "isbn", "store", "purchase_date", "price", "currency",
+                 "drm_source", "physical", "condition", "shelf"]
+
+
+def set_acquisition(book_id: int, changes: Dict[str, Any], library_path: Optional[str] = None) -> None:
+    """
+    Updates the given acquisition fields of a book. Currencies are ISO 4217 codes (EUR, USD, ...).
+
+    Raises:
+        ValueError: For unknown fields, a negative price or an invalid currency code.
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If calibredb fails.
+    """
+    changes = dict(changes)
+    if changes.get("currency"):
+        changes["currency"] = changes["currency"].strip().upper()
+        if not _CURRENCY_RE.match(changes["currency"]):
+            raise ValueError("currency must be a three-letter ISO 4217 code, e.g. EUR or USD.")
+    if changes.get("price") is not None and changes["price"] < 0:
+        raise ValueError("price must not be negative.")
+    set_values(book_id, ACQUISITION_COLUMNS, changes, library_path=library_path)
+
+
+def read_acquisition(book: Dict[str, Any]) -> Dict[str, Any]:
+    return read_values(book, ACQUISITION_COLUMNS)
+
+
+def list_acquired_books(library_path: Optional[str] = None, search: Optional[str] = None) -> List[Dict[str, Any]]:
+    """Returns the books with any acquisition data, each with an "acquisition" dict."""
+    existing = list_custom_columns(library_path=library_path)
+    labels = [c.label for c in ACQUISITION_COLUMNS if c.label in existing and c.label != "currency"]
+    if not labels:
+        return []
+    query = " or ".join(f"#{label}:true" for label in labels)
+    if search:
+        query = f"({query}) and ({search})"
+    books = list_books(library_path=library_path, search_query=query)
+    for book in books:
+        book["acquisition"] = read_acquisition(book)
+    return books
+
+
+def convert_prices(books: List[Dict[str, Any]], target: str, rates: Dict[str, float]) -> List[Dict[str, Any]]:
+    """
+    Returns copies of the books with all prices converted to `target`.
+
+    Raises:
+        ValueError: Naming the books whose currency is missing or has no rate.
+    """
+    converted, problems = [], []
+    for book in books:
+        data = dict(book["acquisition"])
+        if data.get("price") is not None:
+            try:
+                data["price"] = convert(data["price"], data.get("currency"), target, rates)
+                data["currency"] = target
+            except ValueError as e:
+                problems.append(f"book {book['id']}: {e}")
+        converted.append({**book, "acquisition": data})
+    if problems:
+        raise ValueError("Cannot convert all prices. " + " ".join(problems))
+    return converted
+
+
+def _totals(groups: Dict[tuple, List[float]], key_name: str) -> List[Dict[str, Any]]:
+    rows = []
+    for (key, currency), prices in groups.items():
+        rows.append({key_name: key, "currency": currency, "total": round(sum(prices), 2), "books": len(prices)})
+    # Unknown keys (no purchase date or store) sort last.
+    return sorted(rows, key=lambda r: (r[key_name] is None, r[key_name] or "", r["currency"] or ""))
+
+
+def spending_report(books: List[Dict[str, Any]], year: Optional[int] = None) -> Dict[str, Any]:
+    """
+    Sums the prices of books with acquisition data per purchase year, per store and in total.
+    Amounts in different currencies are never added up; each currency gets its own row.
+    Books without a price are counted in "unpriced_books".
+    """
+    by_year, by_store, by_currency = defaultdict(list), defaultdict(list), defaultdict(list)
+    unpriced = 0
+    for book in books:
+        data = book["acquisition"]
+        purchase_year = int(data["purchase_date"][:4]) if data.get("purchase_date") else None
+        if year is not None and purchase_year != year:
+            continue
+        if data.get("price") is None:
+            unpriced += 1
+            continue
+        currency = data.get("currency")
+        by_year[(purchase_year, currency)].append(data["price"])
+        by_store[(data.get("store"), currency)].append(data["price"])
+        by_currency[currency].append(data["price"])
+    return {
+        "year": year,
+        "totals": [
+            {"currency": currency, "total": round(sum(prices), 2), "books": len(prices)}
+            for currency, prices in sorted(by_currency.items(), key=lambda item: item[0] or "")
+        ],
+        "by_year": _totals(by_year, "year"),
+        "by_store": _totals(by_store, "store"),
+        "unpriced_books": unpriced,
+    }
+
+
+def export_csv(books: List[Dict[str, Any]], locale: str = DEFAULT_LOCALE,
+               convert_to: Optional[str] = None, rates: Optional[Dict[str, float]] = None) -> str:
+    """
+    CSV of all acquisition data plus physical copy details, e.g. for insurance documentation.
+    Numbers, dates and the column separator follow `locale`. With `convert_to`, the columns
+    converted_price and converted_currency are added.
+
+    Raises:
+        ValueError: For an unknown locale, or prices that can't be converted.
+    """
+    fmt = get_locale(locale)
+    converted = {b["id"]: b["acquisition"] for b in convert_prices(books, convert_to, rates or {})} if convert_to else {}
+    fields = EXPORT_FIELDS + (["converted_price", "converted_currency"] if convert_to else [])
+    buffer = io.StringIO()
+    writer = csv.DictWriter(buffer, fieldnames=fields, delimiter=fmt.delimiter)
+    writer.writeheader()
+    for book in books:
+        copy = physical.read_physical_copy(book)
+        data = book["acquisition"]
+        row = {
+            "id": book["id"],
+            "title": book.get("title"),
+            "authors": " & ".join(book.get("authors") or []),
+            "isbn": (book.get("identifiers") or {}).get("isbn") or book.get("isbn"),
+            **data,
+            "price": format_number(data.get("price"), fmt),
+            "purchase_date": format_date(data.get("purchase_date"), fmt),
+            "physical": "yes" if copy["physical"] else "no",
+            "condition": copy["condition"],
+            "shelf": copy["shelf"],
+        }
+        if convert_to:
+            price = converted[book["id"]].get("price")
+            row["converted_price"] = format_number(price, fmt)
+            row["converted_currency"] = convert_to if price is not None else ""
+        writer.writerow(row)
+    return buffer.getvalue()
+
+
+def report_csv(report: Dict[str, Any], locale: str = DEFAULT_LOCALE) -> str:
+    """
+    The spending report as one table (group, key, currency, total, books), with numbers and
+    the column separator following `locale`.
+
+    Raises:
+        ValueError: For an unknown locale.
+    """
+    fmt = get_locale(locale)
+    buffer = io.StringIO()
+    writer = csv.writer(buffer, delimiter=fmt.delimiter)
+    writer.writerow(["group", "key", "currency", "total", "books"])
+    for group, key_name in (("total", None), ("year", "year"), ("store", "store")):
+        rows = report["totals"] if key_name is None else report[f"by_{key_name}"]
+        for row in rows:
+            key = "" if key_name is None else row[key_name]
+            writer.writerow([group, "" if key is None else key, row["currency"] or "",
+                             format_number(row["total"], fmt), row["books"]])
+    return buffer.getvalue()
@@ -0,0 +1,59 @@
+"""
+The activity feed of a shared library: what its users did lately, newest first, for a social
+timeline in clients. Needs user accounts (see accounts). Nothing is stored for it: the events are
+read from where the server keeps the data anyway, so they go when the data does (a removed book,
+a cleared review, a deleted account).
+
+  * book_added: the server added a book (see provenance), by a user or not (e.g. a news download).
+  * review_posted: a user rated a book with a review, or changed it (see ratings).
+  * shelf_created: a user made a shelf (see book_collections); only shelves the viewer may see.
+  * book_finished: a user read a book to the end (see reading).
+
+Users who turned off sharing their activity (see privacy) only show in their own feed. The other
+privacy settings apply too: books finished only show for users who share their reading status,
+reviews for those who share them, and their stars for those who share their ratings.
+"""
+from typing import Any, Dict, List, Optional
+
+from . import book_collections
+from . import privacy
+from . import provenance
+from . import ratings
+from . import reading
+
+BOOK_ADDED = "book_added"
+REVIEW_POSTED = "review_posted"
+SHELF_CREATED = "shelf_created"
+BOOK_FINISHED = "book_finished"
+KINDS = (BOOK_ADDED, REVIEW_POSTED, SHELF_CREATED, BOOK_FINISHED)
+
+MAX_LIMIT = 200
+
+
+def feed(viewer_id: int, library_path: Optional[str] = None, before: Optional[float] = None,
+         limit: int = 50) -> List[Dict[str, Any]]:
+    """
+    The library's latest events before `before` (Unix time), newest first, as the user `viewer_id`
+    may see them: each with its "kind", "at" (Unix time) and "user_id", and what it is about.
+    """
+    exclude = privacy.hidden_from(viewer_id, privacy.ACTIVITY)
+    hidden_ratings = privacy.hidden_from(viewer_id, privacy.RATINGS)
+    events: List[Dict[str, Any]] = []
+    for added in provenance.recently_added(library_path, before, limit, exclude):
+        events.append({"kind": BOOK_ADDED, "at": added["added_at"], "user_id": added["user_id"],
+                       "book_id": added["book_id"], "source": added["source"]})
+    for review in ratings.recent_reviews(library_path, before, limit,
+                                         exclude | privacy.hidden_from(viewer_id, privacy.REVIEWS)):
+        events.append({"kind": REVIEW_POSTED, "at": review["updated_at"], "user_id": review["user_id"],
+                       "book_id": review["book_id"], "rating_id": review["id"],
+                       "rating": None if review["user_id"] in hidden_ratings else review["rating"],
+                       "review": review["review"]})
+    for shelf in book_collections.recently_created(library_path, viewer_id, before, limit, exclude):
+        events.append({"kind": SHELF_CREATED, "at": shelf["created_at"], "user_id": shelf["owner_id"],
+                       "collection_id": shelf["id"], "collection_name": shelf["name"]})
+    for finished in reading.recently_finished(library_path, before, limit,
+                                              exclude | privacy.hidden_from(viewer_id, privacy.READING_STATUS)):
+        events.append({"kind": BOOK_FINISHED, "at": finished["finished_at"], "user_id": finished["user_id"],
+                       "book_id": finished["book_id"]})
+    events.sort(key=lambda event: event["at"], reverse=True)
+    return events[:limit]
@@ -0,0 +1,58 @@
+import os
+import logging
+from typing import Any, Dict, List, Optional
+
+logger = logging.getLogger(__name__)
+
+# Calibre (7+) keeps "extra data files" in this sub-folder of each book's folder.
+# They are stored with the book but never treated as readable formats.
+DATA_DIR_NAME = "data"
+
+
+def book_directory(book_dict: Dict[str, Any]) -> Optional[str]:
+    """
+    Returns the on-disk folder of a book from a `calibredb list` record.
+    calibredb does not report the folder directly, so it is derived from the
+    path of any format file or of the cover, which all live in that folder.
+    """
+    formats = book_dict.get("formats") or []
+    if isinstance(formats, str):
+        formats = [f.strip() for f in formats.split(",") if f.strip()]
+    for path in list(formats) + [book_dict.get("cover")]:
+        if path and os.path.isabs(path):
+            return os.path.dirname(path)
+    return None
+
+
+def list_attachments(book_dir: str) -> List[Dict[str, Any]]:
+    """
+    Lists the extra data files of a book, sorted by name.
+    Returns dicts with "name" (path relative to the data folder, using '/') and "size" in bytes.
+    """
+    data_dir = os.path.join(book_dir, DATA_DIR_NAME)
+    attachments = []
+    for root, _, files in os.walk(data_dir):
+        for name in files:
+            full_path = os.path.join(root, name)
+            relative = os.path.relpath(full_path, data_dir).replace(os.sep, "/")
+            attachments.append({"name": relative, "size": os.path.getsize(full_path)})
+    return sorted(attachments, key=lambda a: a["name"])
+
+
+def attachment_path(book_dir: str, name: str) -> str:
+    """
+    Resolves an attachment name to its path inside the book's data folder.
+
+    Raises:
+        ValueError: If the name is empty or points outside the data folder.
+        FileNotFoundError: If the attachment does not exist.
+    """
+    data_dir = os.path.realpath(os.path.join(book_dir, DATA_DIR_NAME))
+    if not name:
+        raise ValueError("Attachment name must not be empty.")
+    full_path = os.path.realpath(os.path.join(data_dir, name))
+    if os.path.commonpath([data_dir, full_path]) != data_dir or full_path == data_dir:
+        raise ValueError(f"Invalid attachment name: {name}")
+    if not os.path.isfile(full_path):
+        raise FileNotFoundError(f"Attachment not found: {name}")
+    return full_path
@@ -0,0 +1,223 @@
+"""
+Who may send a request.
+
+Without user accounts (the default), the only check is the optional admin token: when
+SHELFSTONE_ADMIN_TOKEN is set, the admin endpoints (/admin/*) and every request that may change
+something (any method but GET, HEAD and OPTIONS) need `Authorization: Bearer <token>`. Reading the
+library (book lists, downloads, covers, OPDS) stays open, so e-reader apps that can't send
+credentials keep working. Without the token nothing is checked, as before; then only run the
+server where everyone who can reach it may change the library, or behind a proxy that authenticates.
+
+With SHELFSTONE_ACCOUNTS=1 (see accounts), every request needs a signed-in user except the
+sign-in routes themselves (OPEN_PATHS), CORS preflights, the kosync API, which checks
+KOReader's credential headers itself, and published shelves (/public/*), which are for everyone.
+Users authenticate with `Authorization: Bearer <session or API token>`, the session cookie set by
+POST /auth/login, or HTTP Basic with their username and password or an API token, which is what
+e-reader apps can send.
+/admin/* needs the admin role. The admin token, if set, still works for everything and stands for
+no particular user. Endpoints find the user in `request.state.user` (current_user()).
+
+Users restricted to some libraries get 403 for any other `library_path`. Users restricted to some
+tags only reach RESTRICTED_PREFIXES, and may only change their own data there; calibredb searches
+made for their requests only find books with one of the tags (crud.restricted_tags).
+"""
+import asyncio
+import base64
+import binascii
+import hmac
+import json
+import os
+import re
+from http.cookies import CookieError, SimpleCookie
+from typing import Any, Dict, Optional, Tuple
+from urllib.parse import parse_qs
+
+from . import accounts
+from . import crud
+from .state_store import library_key
+
+READ_METHODS = {"GET", "HEAD", "OPTIONS"}
+ADMIN_PREFIX = "/admin"
+SESSION_COOKIE = "shelfstone_session"
+# Reachable without signing in when accounts are on: what it takes to sign in, the health probes and the API docs.
+OPEN_PATHS = {
+    "/auth/status", "/auth/setup", "/auth/login", "/auth/register", "/auth/password-reset",
+    "/healthz", "/readyz", "/docs", "/docs/oauth2-redirect", "/redoc", "/openapi.json",
+}
+# Likewise, checking an invitation before registering with it, and resetting a forgotten password.
+OPEN_PREFIXES = ("/auth/invitations/", "/auth/password-reset/")
+# Paths whose clients are e-reader apps, which ask for a password when challenged with Basic.
+BASIC_CHALLENGE_PREFIXES = ("/opds",)
+# The kosync API, which checks KOReader's own credential headers itself (see kosync).
+SELF_AUTHENTICATED_PREFIXES = ("/users/", "/syncs/")
+# Shelves published as public catalogs (see book_collections): the same for everyone, so who sends
+# the request, and any restriction of their account, doesn't matter.
+PUBLIC_CATALOG_PREFIX = "/public/"
+# What users restricted to some tags may reach: endpoints that find books through calibredb's search,
+# which applies the restriction, and their own data. Everything else reads the library in other ways.
+RESTRICTED_PREFIXES = ("/books", "/opds", "/me/", "/auth/", "/formats")
+RESTRICTED_WRITE_PATHS = re.compile(r"^/(me|auth)/|^/books/\d+/(progress|bookmarks|rating|comments|reactions)(/|$)"
+                                    r"|^/books/\d+/ratings/\d+/reactions(/|$)")
+
+
+def admin_token() -> Optional[str]:
+    return os.environ.get("SHELFSTONE_ADMIN_TOKEN") or None
+
+
+def requires_token(method: str, path: str) -> bool:
+    return method.upper() not in READ_METHODS or is_admin_path(path)
+
+
+def is_admin_path(path: str) -> bool:
+    return path == ADMIN_PREFIX or path.startswith(ADMIN_PREFIX + "/")
+
+
+def bearer_token(authorization: Optional[str]) -> Optional[str]:
+    """The token of an `Authorization: Bearer <token>` header value, or None."""
+    scheme, _, token = (authorization or "").strip().partition(" ")
+    if scheme.lower() != "bearer":
+        return None
+    return token.strip() or None
+
+
+def basic_credentials(authorization: Optional[str]) -> Optional[Tuple[str, str]]:
+    """(username, password) of an `Authorization: Basic ...` header value, or None."""
+    scheme, _, encoded = (authorization or "").strip().partition(" ")
+    if scheme.lower() != "basic":
+        return None
+    try:
+        username, sep, password = base64.b64decode(encoded.strip(), validate=True).decode("utf-8").partition(":")
+    except (binascii.Error, UnicodeDecodeError):
+        return None
+    return (username, password) if sep else None
+
+
+def session_cookie(cookie_header: Optional[str]) -> Optional[str]:
+    cookies = SimpleCookie()
+    try:
+        cookies.load(cookie_header or "")
+    except CookieError:
+        return None
+    morsel = cookies.get(SESSION_COOKIE)
+    return morsel.value if morsel is not None and morsel.value else None
+
+
+def _matches_admin_token(given: Optional[str], token: Optional[str]) -> bool:
+    return bool(token) and given is not None and hmac.compare_digest(given.encode(), token.encode())
+
+
+def is_authorized(method: str, path: str, authorization: Optional[str], token: Optional[str] = None) -> bool:
+    """Whether the request passes the admin token check (without accounts)."""
+    token = admin_token() if token is None else token
+    if not token or not requires_token(method, path):
+        return True
+    return _matches_admin_token(bearer_token(authorization), token)
+
+
+def identify(authorization: Optional[str], cookie_header: Optional[str]) -> Optional[Dict[str, Any]]:
+    """The user the request's credentials belong to, or None. Blocks on the accounts database."""
+    basic = basic_credentials(authorization)
+    if basic is not None:
+        username, password = basic
+        # Reading apps can keep an API token instead of the password; it is checked without the slow password hash.
+        user = accounts.user_for_token(password)
+        if user is not None:
+            return user if user["username"].casefold() == username.strip().casefold() else None
+        return accounts.authenticate(username, password)
+    token = bearer_token(authorization) or session_cookie(cookie_header)
+    return accounts.user_for_token(token) if token else None
+
+
+def current_user(request) -> Optional[Dict[str, Any]]:
+    """The signed-in user of the request: None without accounts or with the admin token."""
+    return getattr(request.state, "user", None)
+
+
+def has_admin_token(request) -> bool:
+    return bool(getattr(request.state, "admin_token", False))
+
+
+def is_admin(request) -> bool:
+    """Whether the request may do what admins may: the admin token, an admin user, or no accounts at all."""
+    user = current_user(request)
+    if user is not None:
+        return user["role"] == accounts.ADMIN
+    return has_admin_token(request) or not accounts.enabled()
+
+
+def restriction_denial(user: Dict[str, Any], method: str, path: str, query_string: bytes) -> Optional[str]:
+    """Why the user's restrictions (see accounts) forbid the request, or None if they don't."""
+    if user.get("libraries") is not None:
+        library_path = (parse_qs(query_string.decode("latin-1")).get("library_path") or [None])[0]
+        if library_key(library_path) not in user["libraries"]:
+            return "Your account can't use this library."
+    if user.get("tags") is not None and path not in OPEN_PATHS:
+        if not path.startswith(RESTRICTED_PREFIXES):
+            return "Your account is limited to some of the library's books; this isn't available to it."
+        if method not in READ_METHODS and not RESTRICTED_WRITE_PATHS.match(path):
+            return "Your account is limited to some of the library's books and can only change your own data."
+    return None
+
+
+async def _reject(send, status: int, detail: str, challenge: Optional[bytes] = None):
+    body = json.dumps({"detail": detail}).encode()
+    headers = [(b"content-type", b"application/json"), (b"content-length", str(len(body)).encode())]
+    if challenge:
+        headers.append((b"www-authenticate", challenge))
+    await send({"type": "http.response.start", "status": status, "headers": headers})
+    await send({"type": "http.response.body", "body": body})
+
+
+class AuthMiddleware:
+    """
+    ASGI middleware that answers requests without the credentials they need with 401 (403 for
+    users without the admin role on /admin/*) and records who sent the others in scope["state"].
+    """
+
+    def __init__(self, app):
+        self.app = app
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+        headers = dict(scope.get("headers") or [])
+        authorization = headers.get(b"authorization", b"").decode("latin-1")
+        method, path = scope["method"].upper(), scope["path"]
+        with_token = _matches_admin_token(bearer_token(authorization), admin_token())
+
+        if path.startswith(SELF_AUTHENTICATED_PREFIXES) or path.startswith(PUBLIC_CATALOG_PREFIX):
+            scope["state"] = dict(scope.get("state") or {}, user=None, admin_token=with_token)
+            await self.app(scope, receive, send)
+            return
+
+        if not accounts.enabled():
+            if is_authorized(method, path, authorization):
+                scope["state"] = dict(scope.get("state") or {}, admin_token=with_token)
+                await self.app(scope, receive, send)
+                return
+            await _reject(send, 401, "This request needs the admin token (Authorization: Bearer <SHELFSTONE_ADMIN_TOKEN>).", b"Bearer")
+            return
+
+        user = None
+        if not with_token:
+            # The accounts database is SQLite and password checks take a while; keep both off the event loop.
+            user = await asyncio.get_running_loop().run_in_executor(
+                None, identify, authorization, headers.get(b"cookie", b"").decode("latin-1"))
+        if user is None and not with_token and path not in OPEN_PATHS and not path.startswith(OPEN_PREFIXES) and method != "OPTIONS":
+            challenge = b'Basic realm="Shelfstone"' if path.startswith(BASIC_CHALLENGE_PREFIXES) else b"Bearer"
+            await _reject(send, 401, "Sign in first: POST /auth/login, or send an API token (Authorization: Bearer <token>).", challenge)
+            return
+        if user is not None and user["role"] != accounts.ADMIN and is_admin_path(path):
+            await _reject(send, 403, "This needs an admin account.")
+            return
+        denial = restriction_denial(user, method, path, scope.get("query_string") or b"") if user is not None else None
+        if denial:
+            await _reject(send, 403, denial)
+            return
+        scope["state"] = dict(scope.get("state") or {}, user=user, admin_token=with_token)
+        restriction = crud.restricted_tags.set(tuple(user["tags"]) if user is not None and user.get("tags") else None)
+        try:
+            await self.app(scope, receive, send)
+        finally:
+            crud.restricted_tags.reset(restriction)
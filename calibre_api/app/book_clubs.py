@@ -0,0 +1,662 @@
+"""
+Book clubs: a group of users reading books together. A club has members, of which organizers
+manage it; a reading schedule per book the club reads, split into milestones (chapters to read by a
+date); and a discussion thread per milestone, so members only meet comments on what they have read.
+Needs user accounts (see accounts).
+
+Each club belongs to one library, like collections; book IDs refer to that library. The user who
+starts a club is its first organizer. Comments are threaded: a comment can answer another of the
+same milestone. Deleting a comment that has answers keeps it as an empty placeholder, so the
+thread stays readable. Clubs are kept in a small SQLite database (SHELFSTONE_BOOK_CLUBS_DB, in the
+state directory by default; see state_store).
+"""
+import os
+import sqlite3
+import threading
+import time
+from datetime import date
+from typing import Any, Dict, List, Optional
+
+from . import state_store
+from .state_store import library_key as _library_key
+
+_lock = threading.Lock()
+
+MAX_NAME_LENGTH = 200
+MAX_TITLE_LENGTH = 200
+MAX_COMMENT_LENGTH = 10000
+MAX_MILESTONES = 100
+
+# Roles of members.
+ORGANIZER = "organizer"
+MEMBER = "member"
+ROLES = (ORGANIZER, MEMBER)
+
+
+class ClubNotFound(Exception):
+    """No club with this ID in the library."""
+
+
+class ClubExists(Exception):
+    """The library already has a club with this name."""
+
+
+class MemberNotFound(Exception):
+    """The user isn't a member of the club."""
+
+
+class ReadingNotFound(Exception):
+    """The club has no reading or milestone with this ID."""
+
+
+class CommentNotFound(Exception):
+    """The club has no comment with this ID."""
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: clubs and their members, readings, milestones and comments. Dates are YYYY-MM-DD.
+    (
+        "CREATE TABLE clubs ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, library TEXT NOT NULL, name TEXT NOT NULL, description TEXT, "
+        "created_at REAL NOT NULL, updated_at REAL NOT NULL)",
+        "CREATE UNIQUE INDEX clubs_name ON clubs (library, name COLLATE NOCASE)",
+        "CREATE TABLE club_members ("
+        "club_id INTEGER NOT NULL REFERENCES clubs (id) ON DELETE CASCADE, user_id INTEGER NOT NULL, "
+        "role TEXT NOT NULL, joined_at REAL NOT NULL, PRIMARY KEY (club_id, user_id))",
+        "CREATE INDEX club_members_user ON club_members (user_id)",
+        # book_id is NULL once the book is removed from the library; the schedule and its talk stay.
+        "CREATE TABLE club_readings ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, club_id INTEGER NOT NULL REFERENCES clubs (id) ON DELETE CASCADE, "
+        "book_id INTEGER, starts_on TEXT, created_at REAL NOT NULL)",
+        "CREATE INDEX club_readings_club ON club_readings (club_id)",
+        "CREATE TABLE club_milestones ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, reading_id INTEGER NOT NULL REFERENCES club_readings (id) ON DELETE CASCADE, "
+        "position INTEGER NOT NULL, title TEXT NOT NULL, due_on TEXT)",
+        "CREATE INDEX club_milestones_reading ON club_milestones (reading_id, position)",
+        # A deleted comment with answers keeps its row with body and user_id NULL.
+        "CREATE TABLE club_comments ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, milestone_id INTEGER NOT NULL REFERENCES club_milestones (id) ON DELETE CASCADE, "
+        "parent_id INTEGER REFERENCES club_comments (id) ON DELETE CASCADE, user_id INTEGER, body TEXT, "
+        "created_at REAL NOT NULL, edited_at REAL, deleted_at REAL)",
+        "CREATE INDEX club_comments_milestone ON club_comments (milestone_id, id)",
+        "CREATE INDEX club_comments_user ON club_comments (user_id)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_BOOK_CLUBS_DB", "book_clubs.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    conn = state_store.connect(path or db_path(), MIGRATIONS)
+    conn.execute("PRAGMA foreign_keys = ON")
+    return conn
+
+
+def _text(value: Optional[str], what: str, max_length: int) -> str:
+    value = (value or "").strip()
+    if not value:
+        raise ValueError(f"The {what} must not be empty.")
+    if len(value) > max_length:
+        raise ValueError(f"The {what} must be at most {max_length} characters.")
+    return value
+
+
+def _day(value: Optional[date]) -> Optional[str]:
+    return value.isoformat() if value else None
+
+
+# --- Clubs and members ---
+
+_CLUB_SELECT = ("SELECT c.id, c.name, c.description, c.created_at, c.updated_at, "
+                "(SELECT COUNT(*) FROM club_members m WHERE m.club_id = c.id), "
+                "(SELECT m.role FROM club_members m WHERE m.club_id = c.id AND m.user_id = ?) FROM clubs c")
+_CLUB_FIELDS = ("id", "name", "description", "created_at", "updated_at", "member_count", "role")
+
+
+def _get(conn: sqlite3.Connection, club_id: int, library: str, user_id: Optional[int] = None) -> Dict[str, Any]:
+    row = conn.execute(f"{_CLUB_SELECT} WHERE c.id = ? AND c.library = ?", (user_id, club_id, library)).fetchone()
+    if row is None:
+        raise ClubNotFound(f"Club {club_id} not found.")
+    return dict(zip(_CLUB_FIELDS, row))
+
+
+def list_clubs(library_path: Optional[str] = None, member_id: Optional[int] = None,
+               user_id: Optional[int] = None) -> List[Dict[str, Any]]:
+    """
+    The library's clubs by name, with their number of members and the "role" of `user_id` in
+    them (None if they aren't a member); with member_id only the clubs that user is a member of.
+    """
+    if not os.path.exists(db_path()):
+        return []
+    where, params = "c.library = ?", (_library_key(library_path),)
+    if member_id is not None:
+        where += " AND EXISTS (SELECT 1 FROM club_members m WHERE m.club_id = c.id AND m.user_id = ?)"
+        params += (member_id,)
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"{_CLUB_SELECT} WHERE {where} ORDER BY c.name COLLATE NOCASE",
+                                (user_id,) + params).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(_CLUB_FIELDS, row)) for row in rows]
+
+
+def get_club(club_id: int, library_path: Optional[str] = None, user_id: Optional[int] = None) -> Dict[str, Any]:
+    """
+    The club, with the "role" of `user_id` in it (None if they aren't a member).
+
+    Raises:
+        ClubNotFound: If the library has no such club.
+    """
+    if not os.path.exists(db_path()):
+        raise ClubNotFound(f"Club {club_id} not found.")
+    with _lock:
+        conn = connect()
+        try:
+            return _get(conn, club_id, _library_key(library_path), user_id)
+        finally:
+            conn.close()
+
+
+def create_club(name: str, description: Optional[str], organizer_id: int, library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Starts a club with the user as its organizer.
+
+    Raises:
+        ValueError: If the name is empty or too long.
+        ClubExists: If the library has a club of that name (case-insensitive).
+    """
+    name = _text(name, "club name", MAX_NAME_LENGTH)
+    library = _library_key(library_path)
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            try:
+                with conn:
+                    club_id = conn.execute(
+                        "INSERT INTO clubs (library, name, description, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+                        (library, name, description, now, now)).lastrowid
+                    conn.execute("INSERT INTO club_members (club_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)",
+                                 (club_id, organizer_id, ORGANIZER, now))
+            except sqlite3.IntegrityError:
+                raise ClubExists(f"A club named '{name}' already exists.")
+            return _get(conn, club_id, library, organizer_id)
+        finally:
+            conn.close()
+
+
+def update_club(club_id: int, changes: Dict[str, Any], library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Renames the club or changes its description; only the given fields change.
+
+    Raises:
+        ValueError: For an invalid name or unknown fields.
+        ClubNotFound: If the library has no such club.
+        ClubExists: If another club already has the new name.
+    """
+    unknown = set(changes) - {"name", "description"}
+    if unknown:
+        raise ValueError(f"Unknown field(s): {', '.join(sorted(unknown))}.")
+    if "name" in changes:
+        changes = {**changes, "name": _text(changes["name"], "club name", MAX_NAME_LENGTH)}
+    library = _library_key(library_path)
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, club_id, library)
+            if changes:
+                assignments = ", ".join(f"{field} = ?" for field in changes)
+                try:
+                    with conn:
+                        conn.execute(f"UPDATE clubs SET {assignments}, updated_at = ? WHERE id = ?",
+                                     (*changes.values(), time.time(), club_id))
+                except sqlite3.IntegrityError:
+                    raise ClubExists(f"A club named '{changes['name']}' already exists.")
+            return _get(conn, club_id, library)
+        finally:
+            conn.close()
+
+
+def delete_club(club_id: int, library_path: Optional[str] = None) -> None:
+    """
+    Deletes the club with its schedule and discussions.
+
+    Raises:
+        ClubNotFound: If the library has no such club.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, club_id, _library_key(library_path))
+            with conn:
+                conn.execute("DELETE FROM clubs WHERE id = ?", (club_id,))
+        finally:
+            conn.close()
+
+
+_MEMBER_FIELDS = ("user_id", "role", "joined_at")
+
+
+def members(club_id: int) -> List[Dict[str, Any]]:
+    """The club's members, organizers first, in the order they joined."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT {', '.join(_MEMBER_FIELDS)} FROM club_members WHERE club_id = ? "
+                                "ORDER BY role = ? DESC, joined_at, user_id", (club_id, ORGANIZER)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(_MEMBER_FIELDS, row)) for row in rows]
+
+
+def set_member(club_id: int, user_id: int, role: str = MEMBER, library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Adds the user to the club, or changes their role. A club keeps at least one organizer.
+    Returns the membership.
+
+    Raises:
+        ValueError: For an unknown role, or making the last organizer a member.
+        ClubNotFound: If the library has no such club.
+    """
+    if role not in ROLES:
+        raise ValueError(f"Unknown role '{role}'; use {' or '.join(ROLES)}.")
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, club_id, _library_key(library_path))
+            organizers = [row[0] for row in conn.execute(
+                "SELECT user_id FROM club_members WHERE club_id = ? AND role = ?", (club_id, ORGANIZER))]
+            if role != ORGANIZER and organizers == [user_id]:
+                raise ValueError("The club needs an organizer; make someone else one first.")
+            with conn:
+                conn.execute("INSERT INTO club_members (club_id, user_id, role, joined_at) VALUES (?, ?, ?, ?) "
+                             "ON CONFLICT (club_id, user_id) DO UPDATE SET role = excluded.role",
+                             (club_id, user_id, role, time.time()))
+            row = conn.execute(f"SELECT {', '.join(_MEMBER_FIELDS)} FROM club_members WHERE club_id = ? AND user_id = ?",
+                               (club_id, user_id)).fetchone()
+        finally:
+            conn.close()
+    return dict(zip(_MEMBER_FIELDS, row))
+
+
+def _leave(conn: sqlite3.Connection, club_id: int, user_id: int) -> None:
+    """Takes the user out of the club. Without organizers left the longest member becomes one; without members the club goes."""
+    conn.execute("DELETE FROM club_members WHERE club_id = ? AND user_id = ?", (club_id, user_id))
+    if conn.execute("SELECT 1 FROM club_members WHERE club_id = ? AND role = ?", (club_id, ORGANIZER)).fetchone():
+        return
+    successor = conn.execute("SELECT user_id FROM club_members WHERE club_id = ? ORDER BY joined_at, user_id LIMIT 1",
+                             (club_id,)).fetchone()
+    if successor is None:
+        conn.execute("DELETE FROM clubs WHERE id = ?", (club_id,))
+    else:
+        conn.execute("UPDATE club_members SET role = ? WHERE club_id = ? AND user_id = ?", (ORGANIZER, club_id, successor[0]))
+
+
+def remove_member(club_id: int, user_id: int, library_path: Optional[str] = None) -> None:
+    """
+    Takes the user out of the club; see _leave for the last organizer and the last member.
+
+    Raises:
+        ClubNotFound: If the library has no such club.
+        MemberNotFound: If the user isn't a member.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, club_id, _library_key(library_path))
+            if not conn.execute("SELECT 1 FROM club_members WHERE club_id = ? AND user_id = ?", (club_id, user_id)).fetchone():
+                raise MemberNotFound(f"User {user_id} isn't a member of club {club_id}.")
+            with conn:
+                _leave(conn, club_id, user_id)
+        finally:
+            conn.close()
+
+
+# --- Reading schedules ---
+
+_MILESTONE_FIELDS = ("id", "reading_id", "position", "title", "due_on", "comment_count")
+_MILESTONE_SELECT = ("SELECT s.id, s.reading_id, s.position, s.title, s.due_on, "
+                     "(SELECT COUNT(*) FROM club_comments k WHERE k.milestone_id = s.id AND k.deleted_at IS NULL) "
+                     "FROM club_milestones s")
+_READING_FIELDS = ("id", "book_id", "starts_on", "created_at")
+
+
+def _reading(conn: sqlite3.Connection, club_id: int, reading_id: int) -> Dict[str, Any]:
+    row = conn.execute(f"SELECT {', '.join(_READING_FIELDS)} FROM club_readings WHERE id = ? AND club_id = ?",
+                       (reading_id, club_id)).fetchone()
+    if row is None:
+        raise ReadingNotFound(f"Reading {reading_id} not found in club {club_id}.")
+    reading = dict(zip(_READING_FIELDS, row))
+    reading["milestones"] = [dict(zip(_MILESTONE_FIELDS, r)) for r in conn.execute(
+        f"{_MILESTONE_SELECT} WHERE s.reading_id = ? ORDER BY s.position, s.id", (reading_id,))]
+    return reading
+
+
+def _milestone(conn: sqlite3.Connection, club_id: int, milestone_id: int) -> Dict[str, Any]:
+    row = conn.execute(f"{_MILESTONE_SELECT} JOIN club_readings r ON r.id = s.reading_id WHERE s.id = ? AND r.club_id = ?",
+                       (milestone_id, club_id)).fetchone()
+    if row is None:
+        raise ReadingNotFound(f"Milestone {milestone_id} not found in club {club_id}.")
+    return dict(zip(_MILESTONE_FIELDS, row))
+
+
+def _insert_milestones(conn: sqlite3.Connection, reading_id: int, milestones: List[Dict[str, Any]]) -> None:
+    count = conn.execute("SELECT COUNT(*), IFNULL(MAX(position), 0) FROM club_milestones WHERE reading_id = ?",
+                         (reading_id,)).fetchone()
+    if count[0] + len(milestones) > MAX_MILESTONES:
+        raise ValueError(f"A reading can have at most {MAX_MILESTONES} milestones.")
+    conn.executemany("INSERT INTO club_milestones (reading_id, position, title, due_on) VALUES (?, ?, ?, ?)",
+                     [(reading_id, count[1] + i + 1, _text(m.get("title"), "milestone title", MAX_TITLE_LENGTH),
+                       _day(m.get("due_on"))) for i, m in enumerate(milestones)])
+
+
+def readings(club_id: int) -> List[Dict[str, Any]]:
+    """The club's reading schedule: the books it reads, newest first, each with its milestones in order."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            return [_reading(conn, club_id, row[0]) for row in conn.execute(
+                "SELECT id FROM club_readings WHERE club_id = ? ORDER BY IFNULL(starts_on, '') DESC, id DESC", (club_id,)).fetchall()]
+        finally:
+            conn.close()
+
+
+def add_reading(club_id: int, book_id: int, starts_on: Optional[date], milestones: List[Dict[str, Any]],
+                library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Puts a book on the club's schedule with its milestones (each a "title" such as "Chapters 1-5"
+    and an optional "due_on" date), in reading order. Returns the reading.
+
+    Raises:
+        ValueError: For a milestone without a title, or too many milestones.
+        ClubNotFound: If the library has no such club.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, club_id, _library_key(library_path))
+            with conn:
+                reading_id = conn.execute(
+                    "INSERT INTO club_readings (club_id, book_id, starts_on, created_at) VALUES (?, ?, ?, ?)",
+                    (club_id, book_id, _day(starts_on), time.time())).lastrowid
+                _insert_milestones(conn, reading_id, milestones)
+                conn.execute("UPDATE clubs SET updated_at = ? WHERE id = ?", (time.time(), club_id))
+            return _reading(conn, club_id, reading_id)
+        finally:
+            conn.close()
+
+
+def delete_reading(club_id: int, reading_id: int) -> None:
+    """
+    Takes a book off the schedule, with its milestones and their discussions.
+
+    Raises:
+        ReadingNotFound: If the club has no such reading.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _reading(conn, club_id, reading_id)
+            with conn:
+                conn.execute("DELETE FROM club_readings WHERE id = ?", (reading_id,))
+        finally:
+            conn.close()
+
+
+def add_milestone(club_id: int, reading_id: int, title: str, due_on: Optional[date] = None) -> Dict[str, Any]:
+    """
+    Adds a milestone at the end of a reading. Returns it.
+
+    Raises:
+        ValueError: Without a title, or with too many milestones.
+        ReadingNotFound: If the club has no such reading.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _reading(conn, club_id, reading_id)
+            with conn:
+                _insert_milestones(conn, reading_id, [{"title": title, "due_on": due_on}])
+            milestone_id = conn.execute("SELECT MAX(id) FROM club_milestones WHERE reading_id = ?", (reading_id,)).fetchone()[0]
+            return _milestone(conn, club_id, milestone_id)
+        finally:
+            conn.close()
+
+
+def update_milestone(club_id: int, milestone_id: int, changes: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Changes a milestone's title or due date; only the given fields change.
+
+    Raises:
+        ValueError: For an empty title or unknown fields.
+        ReadingNotFound: If the club has no such milestone.
+    """
+    unknown = set(changes) - {"title", "due_on"}
+    if unknown:
+        raise ValueError(f"Unknown field(s): {', '.join(sorted(unknown))}.")
+    values = {}
+    if "title" in changes:
+        values["title"] = _text(changes["title"], "milestone title", MAX_TITLE_LENGTH)
+    if "due_on" in changes:
+        values["due_on"] = _day(changes["due_on"])
+    with _lock:
+        conn = connect()
+        try:
+            _milestone(conn, club_id, milestone_id)
+            if values:
+                with conn:
+                    conn.execute(f"UPDATE club_milestones SET {', '.join(f'{field} = ?' for field in values)} WHERE id = ?",
+                                 (*values.values(), milestone_id))
+            return _milestone(conn, club_id, milestone_id)
+        finally:
+            conn.close()
+
+
+def delete_milestone(club_id: int, milestone_id: int) -> None:
+    """
+    Deletes a milestone with its discussion.
+
+    Raises:
+        ReadingNotFound: If the club has no such milestone.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _milestone(conn, club_id, milestone_id)
+            with conn:
+                conn.execute("DELETE FROM club_milestones WHERE id = ?", (milestone_id,))
+        finally:
+            conn.close()
+
+
+# --- Discussions ---
+
+_COMMENT_FIELDS = ("id", "milestone_id", "parent_id", "user_id", "body", "created_at", "edited_at", "deleted_at")
+_COMMENT_SELECT = f"SELECT {', '.join('k.' + f for f in _COMMENT_FIELDS)} FROM club_comments k"
+
+
+def _comment_dict(row: tuple) -> Dict[str, Any]:
+    comment = dict(zip(_COMMENT_FIELDS, row))
+    comment["deleted"] = comment.pop("deleted_at") is not None
+    return comment
+
+
+def _comment(conn: sqlite3.Connection, club_id: int, comment_id: int) -> Dict[str, Any]:
+    row = conn.execute(f"{_COMMENT_SELECT} JOIN club_milestones s ON s.id = k.milestone_id "
+                       "JOIN club_readings r ON r.id = s.reading_id WHERE k.id = ? AND r.club_id = ?",
+                       (comment_id, club_id)).fetchone()
+    if row is None:
+        raise CommentNotFound(f"Comment {comment_id} not found in club {club_id}.")
+    return _comment_dict(row)
+
+
+def comments(club_id: int, milestone_id: int) -> List[Dict[str, Any]]:
+    """
+    The milestone's discussion as threads: its comments that answer none, oldest first, each with
+    its "replies" in the same form.
+
+    Raises:
+        ReadingNotFound: If the club has no such milestone.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _milestone(conn, club_id, milestone_id)
+            rows = conn.execute(f"{_COMMENT_SELECT} WHERE k.milestone_id = ? ORDER BY k.id", (milestone_id,)).fetchall()
+        finally:
+            conn.close()
+    by_id: Dict[int, Dict[str, Any]] = {}
+    threads: List[Dict[str, Any]] = []
+    for row in rows:
+        comment = {**_comment_dict(row), "replies": []}
+        by_id[comment["id"]] = comment
+        parent = by_id.get(comment["parent_id"])
+        (parent["replies"] if parent else threads).append(comment)
+    return threads
+
+
+def get_comment(club_id: int, comment_id: int) -> Dict[str, Any]:
+    """
+    Raises:
+        CommentNotFound: If the club has no such comment.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            return _comment(conn, club_id, comment_id)
+        finally:
+            conn.close()
+
+
+def add_comment(club_id: int, milestone_id: int, user_id: int, body: str, parent_id: Optional[int] = None) -> Dict[str, Any]:
+    """
+    Comments on a milestone, or answers the comment `parent_id` of the same milestone. Returns the comment.
+
+    Raises:
+        ValueError: For an empty or too long comment, or a parent in another milestone.
+        ReadingNotFound: If the club has no such milestone.
+        CommentNotFound: If the club has no comment `parent_id`.
+    """
+    body = _text(body, "comment", MAX_COMMENT_LENGTH)
+    with _lock:
+        conn = connect()
+        try:
+            _milestone(conn, club_id, milestone_id)
+            if parent_id is not None and _comment(conn, club_id, parent_id)["milestone_id"] != milestone_id:
+                raise ValueError("A reply must be in the same milestone as the comment it answers.")
+            with conn:
+                comment_id = conn.execute(
+                    "INSERT INTO club_comments (milestone_id, parent_id, user_id, body, created_at) VALUES (?, ?, ?, ?, ?)",
+                    (milestone_id, parent_id, user_id, body, time.time())).lastrowid
+            return _comment(conn, club_id, comment_id)
+        finally:
+            conn.close()
+
+
+def edit_comment(club_id: int, comment_id: int, body: str) -> Dict[str, Any]:
+    """
+    Raises:
+        ValueError: For an empty or too long comment, or a deleted one.
+        CommentNotFound: If the club has no such comment.
+    """
+    body = _text(body, "comment", MAX_COMMENT_LENGTH)
+    with _lock:
+        conn = connect()
+        try:
+            if _comment(conn, club_id, comment_id)["deleted"]:
+                raise ValueError("This comment was deleted.")
+            with conn:
+                conn.execute("UPDATE club_comments SET body = ?, edited_at = ? WHERE id = ?", (body, time.time(), comment_id))
+            return _comment(conn, club_id, comment_id)
+        finally:
+            conn.close()
+
+
+def _delete_comment(conn: sqlite3.Connection, comment_id: int) -> None:
+    """Deletes the comment, or empties it while it has answers; placeholders left without answers go too."""
+    while comment_id is not None:
+        row = conn.execute("SELECT parent_id, deleted_at FROM club_comments WHERE id = ?", (comment_id,)).fetchone()
+        if row is None:
+            return
+        if conn.execute("SELECT 1 FROM club_comments WHERE parent_id = ?", (comment_id,)).fetchone():
+            conn.execute("UPDATE club_comments SET body = NULL, user_id = NULL, deleted_at = IFNULL(deleted_at, ?) WHERE id = ?",
+                         (time.time(), comment_id))
+            return
+        conn.execute("DELETE FROM club_comments WHERE id = ?", (comment_id,))
+        parent = conn.execute("SELECT id FROM club_comments WHERE id = ? AND deleted_at IS NOT NULL", (row[0],)).fetchone()
+        comment_id = parent[0] if parent else None
+
+
+def delete_comment(club_id: int, comment_id: int) -> None:
+    """
+    Raises:
+        CommentNotFound: If the club has no such comment.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _comment(conn, club_id, comment_id)
+            with conn:
+                _delete_comment(conn, comment_id)
+        finally:
+            conn.close()
+
+
+# --- Removed books and users ---
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Unlinks the library's club readings from deleted books; their schedules and discussions stay."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("UPDATE club_readings SET book_id = NULL WHERE book_id = ? AND club_id IN "
+                                 "(SELECT id FROM clubs WHERE library = ?)",
+                                 [(book_id, _library_key(library_path)) for book_id in book_ids])
+        finally:
+            conn.close()
+
+
+def forget_user(user_id: int) -> None:
+    """Takes a deleted user out of their clubs (see _leave) and deletes their comments."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                for (club_id,) in conn.execute("SELECT club_id FROM club_members WHERE user_id = ?", (user_id,)).fetchall():
+                    _leave(conn, club_id, user_id)
+                for (comment_id,) in conn.execute("SELECT id FROM club_comments WHERE user_id = ? ORDER BY id DESC",
+                                                  (user_id,)).fetchall():
+                    _delete_comment(conn, comment_id)
+        finally:
+            conn.close()
+
+
+def export_user(user_id: int) -> Dict[str, List[Dict[str, Any]]]:
+    """The clubs the user is in, in all libraries ("library" is "" for the default one), and their comments."""
+    if not os.path.exists(db_path()):
+        return {"memberships": [], "comments": []}
+    with _lock:
+        conn = connect()
+        try:
+            memberships = [dict(zip(("library", "club_id", "name", "role", "joined_at"), row)) for row in conn.execute(
+                "SELECT c.library, c.id, c.name, m.role, m.joined_at FROM club_members m JOIN clubs c ON c.id = m.club_id "
+                "WHERE m.user_id = ? ORDER BY m.joined_at", (user_id,))]
+            user_comments = [_comment_dict(row) for row in conn.execute(
+                f"{_COMMENT_SELECT} WHERE k.user_id = ? ORDER BY k.id", (user_id,))]
+        finally:
+            conn.close()
+    return {"memberships": memberships, "comments": user_comments}
@@ -0,0 +1,587 @@
+"""
+User-created collections of books ("Currently Reading", "Favorites", "Book club 2026"), for
+grouping that doesn't fit series or tags. A book can be in any number of collections.
+
+Collections are kept in a small SQLite database (SHELFSTONE_COLLECTIONS_DB, in the state directory
+by default; see state_store) rather than in the library, so empty collections can exist and the
+Calibre library is never written to.
+Each collection belongs to one library (its path, or the calibredb default); book IDs refer to
+that library. Collections made by a signed-in user are that user's shelves (owner_id; see
+accounts); names are unique per user.
+
+Shelves are private to their owner unless shared: the owner can share one with other users, read
+only (READ) or so they can add and remove books too (COLLABORATE). Collections without an owner
+stay library-wide, open to everyone. access() says what a user may do with a collection.
+
+A collection can also be published as a public catalog ("little free library"): readable by
+anyone at /public/{slug}, without signing in, with or without downloads of its books' files.
+"""
+import os
+import re
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, Iterable, List, Optional, Tuple
+
+from . import state_store
+from .state_store import library_key as _library_key
+
+_lock = threading.Lock()
+
+MAX_NAME_LENGTH = 200
+
+# What a user may do with a collection, from least to most.
+READ = "read"
+COLLABORATE = "collaborate"
+OWNER = "owner"
+ACCESS_LEVELS = (READ, COLLABORATE, OWNER)
+SHARE_ACCESS = (READ, COLLABORATE)
+
+
+class CollectionNotFound(Exception):
+    """No collection with this ID in the library."""
+
+
+class CollectionExists(Exception):
+    """The library already has a collection with this name."""
+
+
+class ShareNotFound(Exception):
+    """The collection isn't shared with this user."""
+
+
+class NotPublished(Exception):
+    """The collection isn't published, or no collection is published under this slug."""
+
+
+class SlugTaken(Exception):
+    """Another collection is published under this slug."""
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: the initial schema. IF NOT EXISTS because databases from before versioning already have it.
+    (
+        # AUTOINCREMENT, so IDs of deleted collections are never handed out again.
+        "CREATE TABLE IF NOT EXISTS collections ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, library TEXT NOT NULL, name TEXT NOT NULL, "
+        "description TEXT, created_at REAL NOT NULL, updated_at REAL NOT NULL)",
+        "CREATE UNIQUE INDEX IF NOT EXISTS collections_name ON collections (library, name COLLATE NOCASE)",
+        "CREATE TABLE IF NOT EXISTS collection_books ("
+        "collection_id INTEGER NOT NULL REFERENCES collections (id) ON DELETE CASCADE, "
+        "book_id INTEGER NOT NULL, added_at REAL NOT NULL, PRIMARY KEY (collection_id, book_id))",
+        "CREATE INDEX IF NOT EXISTS collection_books_book ON collection_books (book_id)",
+    ),
+    # 2: the user who made a collection (their shelf), with names unique per user instead of per library.
+    (
+        "ALTER TABLE collections ADD COLUMN owner_id INTEGER",
+        "DROP INDEX collections_name",
+        "CREATE UNIQUE INDEX collections_name ON collections (library, IFNULL(owner_id, 0), name COLLATE NOCASE)",
+    ),
+    # 3: shelves shared with other users.
+    (
+        "CREATE TABLE collection_shares ("
+        "collection_id INTEGER NOT NULL REFERENCES collections (id) ON DELETE CASCADE, user_id INTEGER NOT NULL, "
+        "access TEXT NOT NULL, created_at REAL NOT NULL, PRIMARY KEY (collection_id, user_id))",
+        "CREATE INDEX collection_shares_user ON collection_shares (user_id)",
+    ),
+    # 4: collections published as public catalogs; slugs are unique across libraries, since they make up the URL.
+    (
+        "CREATE TABLE collection_publications ("
+        "collection_id INTEGER PRIMARY KEY REFERENCES collections (id) ON DELETE CASCADE, slug TEXT NOT NULL UNIQUE, "
+        "downloads INTEGER NOT NULL, created_at REAL NOT NULL, updated_at REAL NOT NULL)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_COLLECTIONS_DB", "collections.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    conn = state_store.connect(path or db_path(), MIGRATIONS)
+    conn.execute("PRAGMA foreign_keys = ON")
+    return conn
+
+
+def _validate_name(name: Optional[str]) -> str:
+    name = (name or "").strip()
+    if not name:
+        raise ValueError("The collection name must not be empty.")
+    if len(name) > MAX_NAME_LENGTH:
+        raise ValueError(f"The collection name must be at most {MAX_NAME_LENGTH} characters.")
+    return name
+
+
+_SELECT = ("SELECT c.id, c.name, c.description, c.owner_id, c.created_at, c.updated_at, "
+           "(SELECT COUNT(*) FROM collection_books b WHERE b.collection_id = c.id) FROM collections c")
+
+
+def _as_dict(row) -> Dict[str, Any]:
+    return dict(zip(("id", "name", "description", "owner_id", "created_at", "updated_at", "book_count"), row))
+
+
+def _get(conn: sqlite3.Connection, collection_id: int, library: str) -> Dict[str, Any]:
+    row = conn.execute(f"{_SELECT} WHERE c.id = ? AND c.library = ?", (collection_id, library)).fetchone()
+    if row is None:
+        raise CollectionNotFound(f"Collection {collection_id} not found.")
+    return _as_dict(row)
+
+
+# The collections a user may see, and what they may do with them (see access()).
+_VISIBLE = ("(c.owner_id IS NULL OR c.owner_id = ? OR EXISTS "
+            "(SELECT 1 FROM collection_shares s WHERE s.collection_id = c.id AND s.user_id = ?))")
+_ACCESS = ("CASE WHEN c.owner_id IS NULL THEN 'collaborate' WHEN c.owner_id = ? THEN 'owner' ELSE "
+           "(SELECT s.access FROM collection_shares s WHERE s.collection_id = c.id AND s.user_id = ?) END")
+
+
+def _select_visible(where: str, params: Tuple, visible_to: Optional[int]) -> Tuple[str, Tuple]:
+    """_SELECT with `where`, limited to what `visible_to` may see and with their "access", if given."""
+    if visible_to is None:
+        return f"{_SELECT} WHERE {where}", params
+    select = _SELECT.replace(" FROM collections c", f", {_ACCESS} FROM collections c")
+    return f"{select} WHERE {where} AND {_VISIBLE}", (visible_to, visible_to) + params + (visible_to, visible_to)
+
+
+def _as_visible_dict(row, visible_to: Optional[int]) -> Dict[str, Any]:
+    collection = _as_dict(row[:7])
+    if visible_to is not None:
+        collection["access"] = row[7]
+    return collection
+
+
+def list_collections(library_path: Optional[str] = None, owner_id: Optional[int] = None,
+                     visible_to: Optional[int] = None) -> List[Dict[str, Any]]:
+    """
+    The library's collections by name, each with its number of books; with owner_id only that
+    user's, with visible_to only those the user may see (library-wide ones, theirs and those shared
+    with them), each with their "access".
+    """
+    where, params = "c.library = ?", (_library_key(library_path),)
+    if owner_id is not None:
+        where, params = where + " AND c.owner_id = ?", params + (owner_id,)
+    query, params = _select_visible(where, params, visible_to)
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"{query} ORDER BY c.name COLLATE NOCASE", params).fetchall()
+        finally:
+            conn.close()
+    return [_as_visible_dict(row, visible_to) for row in rows]
+
+
+def get_collection(collection_id: int, library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    The collection with "book_ids" in the order they were added.
+
+    Raises:
+        CollectionNotFound: If the library has no such collection.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            collection = _get(conn, collection_id, _library_key(library_path))
+            collection["book_ids"] = [row[0] for row in conn.execute(
+                "SELECT book_id FROM collection_books WHERE collection_id = ? ORDER BY added_at, book_id", (collection_id,))]
+        finally:
+            conn.close()
+    return collection
+
+
+def create_collection(name: str, description: Optional[str] = None, library_path: Optional[str] = None,
+                      owner_id: Optional[int] = None) -> Dict[str, Any]:
+    """
+    Creates a collection, as the shelf of the user owner_id if given.
+
+    Raises:
+        ValueError: If the name is empty or too long.
+        CollectionExists: If the owner (or, without one, the library) has a collection of that name (case-insensitive).
+    """
+    name = _validate_name(name)
+    library = _library_key(library_path)
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                cursor = conn.execute(
+                    "INSERT INTO collections (library, name, description, owner_id, created_at, updated_at) "
+                    "VALUES (?, ?, ?, ?, ?, ?)",
+                    (library, name, description, owner_id, now, now))
+            return _get(conn, cursor.lastrowid, library)
+        except sqlite3.IntegrityError:
+            raise CollectionExists(f"A collection named '{name}' already exists.")
+        finally:
+            conn.close()
+
+
+def update_collection(collection_id: int, changes: Dict[str, Any], library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Renames the collection or changes its description; only the given fields change.
+
+    Raises:
+        ValueError: For an invalid name or unknown fields.
+        CollectionNotFound: If the library has no such collection.
+        CollectionExists: If another collection already has the new name.
+    """
+    unknown = set(changes) - {"name", "description"}
+    if unknown:
+        raise ValueError(f"Unknown field(s): {', '.join(sorted(unknown))}.")
+    if "name" in changes:
+        changes = {**changes, "name": _validate_name(changes["name"])}
+    library = _library_key(library_path)
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, collection_id, library)
+            if changes:
+                assignments = ", ".join(f"{field} = ?" for field in changes)
+                with conn:
+                    conn.execute(f"UPDATE collections SET {assignments}, updated_at = ? WHERE id = ?",
+                                 (*changes.values(), time.time(), collection_id))
+            return _get(conn, collection_id, library)
+        except sqlite3.IntegrityError:
+            raise CollectionExists(f"A collection named '{changes['name']}' already exists.")
+        finally:
+            conn.close()
+
+
+def delete_collection(collection_id: int, library_path: Optional[str] = None) -> None:
+    """
+    Deletes the collection; its books stay in the library.
+
+    Raises:
+        CollectionNotFound: If the library has no such collection.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, collection_id, _library_key(library_path))
+            with conn:
+                conn.execute("DELETE FROM collections WHERE id = ?", (collection_id,))
+        finally:
+            conn.close()
+
+
+def add_books(collection_id: int, book_ids: Iterable[int], library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Adds books to the collection; books already in it keep their place. Returns the collection.
+
+    Raises:
+        CollectionNotFound: If the library has no such collection.
+    """
+    library = _library_key(library_path)
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, collection_id, library)
+            with conn:
+                conn.executemany("INSERT OR IGNORE INTO collection_books (collection_id, book_id, added_at) VALUES (?, ?, ?)",
+                                 [(collection_id, book_id, now) for book_id in book_ids])
+                conn.execute("UPDATE collections SET updated_at = ? WHERE id = ?", (now, collection_id))
+            return _get(conn, collection_id, library)
+        finally:
+            conn.close()
+
+
+def remove_books(collection_id: int, book_ids: Iterable[int], library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Removes books from the collection (not from the library). Returns the collection.
+
+    Raises:
+        CollectionNotFound: If the library has no such collection.
+    """
+    library = _library_key(library_path)
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, collection_id, library)
+            with conn:
+                conn.executemany("DELETE FROM collection_books WHERE collection_id = ? AND book_id = ?",
+                                 [(collection_id, book_id) for book_id in book_ids])
+                conn.execute("UPDATE collections SET updated_at = ? WHERE id = ?", (time.time(), collection_id))
+            return _get(conn, collection_id, library)
+        finally:
+            conn.close()
+
+
+def collections_of_book(book_id: int, library_path: Optional[str] = None,
+                        visible_to: Optional[int] = None) -> List[Dict[str, Any]]:
+    """The library's collections that contain the book, by name; with visible_to as for list_collections."""
+    query, params = _select_visible(
+        "c.library = ? AND EXISTS (SELECT 1 FROM collection_books m WHERE m.collection_id = c.id AND m.book_id = ?)",
+        (_library_key(library_path), book_id), visible_to)
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"{query} ORDER BY c.name COLLATE NOCASE", params).fetchall()
+        finally:
+            conn.close()
+    return [_as_visible_dict(row, visible_to) for row in rows]
+
+
+def recently_created(library_path: Optional[str] = None, visible_to: Optional[int] = None, before: Optional[float] = None,
+                     limit: int = 50, exclude_users: Iterable[int] = ()) -> List[Dict[str, Any]]:
+    """
+    The users' shelves created in the library before `before` (Unix time), newest first, except
+    those of exclude_users; with visible_to as for list_collections.
+    """
+    exclude_users = list(exclude_users)
+    query, params = _select_visible(
+        f"c.library = ? AND c.owner_id IS NOT NULL AND c.created_at < ? "
+        f"AND c.owner_id NOT IN ({', '.join('?' * len(exclude_users))})",
+        (_library_key(library_path), before if before is not None else float("inf"), *exclude_users), visible_to)
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"{query} ORDER BY c.created_at DESC LIMIT ?", (*params, limit)).fetchall()
+        finally:
+            conn.close()
+    return [_as_visible_dict(row, visible_to) for row in rows]
+
+
+# --- Sharing shelves ---
+
+def access(collection: Dict[str, Any], user_id: int) -> Optional[str]:
+    """
+    What the user may do with the collection: OWNER (everything), COLLABORATE (add and remove
+    books), READ or None (not even see it). Everyone may collaborate on collections without an owner.
+    """
+    if collection.get("owner_id") is None:
+        return COLLABORATE
+    if collection["owner_id"] == user_id:
+        return OWNER
+    if not os.path.exists(db_path()):
+        return None
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute("SELECT access FROM collection_shares WHERE collection_id = ? AND user_id = ?",
+                               (collection["id"], user_id)).fetchone()
+        finally:
+            conn.close()
+    return row[0] if row else None
+
+
+_SHARE_COLUMNS = ("user_id", "access", "created_at")
+
+
+def list_shares(collection_id: int) -> List[Dict[str, Any]]:
+    """The users a shelf is shared with, in the order it was shared with them."""
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT {', '.join(_SHARE_COLUMNS)} FROM collection_shares WHERE collection_id = ? "
+                                "ORDER BY created_at, user_id", (collection_id,)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(_SHARE_COLUMNS, row)) for row in rows]
+
+
+def share(collection_id: int, user_id: int, access_level: str, library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Shares a shelf with the user, or changes what they may do with it. Returns the share.
+
+    Raises:
+        ValueError: For an unknown access level, a collection without an owner, or its owner.
+        CollectionNotFound: If the library has no such collection.
+    """
+    if access_level not in SHARE_ACCESS:
+        raise ValueError(f"Unknown access '{access_level}'; use {' or '.join(SHARE_ACCESS)}.")
+    with _lock:
+        conn = connect()
+        try:
+            collection = _get(conn, collection_id, _library_key(library_path))
+            if collection["owner_id"] is None:
+                raise ValueError("Collections without an owner are open to everyone already; only shelves are shared.")
+            if collection["owner_id"] == user_id:
+                raise ValueError("This is the user's own shelf.")
+            with conn:
+                conn.execute("INSERT INTO collection_shares (collection_id, user_id, access, created_at) VALUES (?, ?, ?, ?) "
+                             "ON CONFLICT (collection_id, user_id) DO UPDATE SET access = excluded.access",
+                             (collection_id, user_id, access_level, time.time()))
+            row = conn.execute(f"SELECT {', '.join(_SHARE_COLUMNS)} FROM collection_shares WHERE collection_id = ? AND user_id = ?",
+                               (collection_id, user_id)).fetchone()
+        finally:
+            conn.close()
+    return dict(zip(_SHARE_COLUMNS, row))
+
+
+def unshare(collection_id: int, user_id: int, library_path: Optional[str] = None) -> None:
+    """
+    Stops sharing a shelf with the user.
+
+    Raises:
+        CollectionNotFound: If the library has no such collection.
+        ShareNotFound: If it isn't shared with them.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, collection_id, _library_key(library_path))
+            with conn:
+                deleted = conn.execute("DELETE FROM collection_shares WHERE collection_id = ? AND user_id = ?",
+                                       (collection_id, user_id)).rowcount
+        finally:
+            conn.close()
+    if not deleted:
+        raise ShareNotFound(f"Collection {collection_id} isn't shared with user {user_id}.")
+
+
+def members(collection: Dict[str, Any]) -> List[int]:
+    """The owner of a shelf and the users it is shared with; nobody for collections without an owner."""
+    if collection.get("owner_id") is None:
+        return []
+    return [collection["owner_id"]] + [s["user_id"] for s in list_shares(collection["id"])]
+
+
+# --- Public catalogs ---
+
+SLUG_PATTERN = re.compile(r"^[a-z0-9][a-z0-9-]{1,62}[a-z0-9]$")
+_PUBLICATION_COLUMNS = ("slug", "downloads", "created_at", "updated_at")
+
+
+def _publication(conn: sqlite3.Connection, collection_id: int) -> Optional[Dict[str, Any]]:
+    row = conn.execute(f"SELECT {', '.join(_PUBLICATION_COLUMNS)} FROM collection_publications WHERE collection_id = ?",
+                       (collection_id,)).fetchone()
+    return dict(zip(_PUBLICATION_COLUMNS, row), downloads=bool(row[1])) if row else None
+
+
+def publication(collection_id: int) -> Optional[Dict[str, Any]]:
+    """How the collection is published: its "slug" and whether it offers "downloads"; None if it isn't."""
+    if not os.path.exists(db_path()):
+        return None
+    with _lock:
+        conn = connect()
+        try:
+            return _publication(conn, collection_id)
+        finally:
+            conn.close()
+
+
+def publish(collection_id: int, slug: str, downloads: bool = False, library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Publishes the collection at /public/{slug}, or changes its slug or whether it offers downloads.
+    Returns the publication.
+
+    Raises:
+        ValueError: For a slug that isn't 3 to 64 lowercase letters, digits and hyphens.
+        CollectionNotFound: If the library has no such collection.
+        SlugTaken: If another collection is published under the slug.
+    """
+    slug = (slug or "").strip().lower()
+    if not SLUG_PATTERN.match(slug):
+        raise ValueError("The slug must be 3 to 64 lowercase letters, digits and hyphens, starting and ending with a letter or digit.")
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, collection_id, _library_key(library_path))
+            with conn:
+                conn.execute("INSERT INTO collection_publications (collection_id, slug, downloads, created_at, updated_at) "
+                             "VALUES (?, ?, ?, ?, ?) ON CONFLICT (collection_id) DO UPDATE SET "
+                             "slug = excluded.slug, downloads = excluded.downloads, updated_at = excluded.updated_at",
+                             (collection_id, slug, int(downloads), now, now))
+            return _publication(conn, collection_id)
+        except sqlite3.IntegrityError:
+            raise SlugTaken(f"Another shelf is published as '{slug}'.")
+        finally:
+            conn.close()
+
+
+def unpublish(collection_id: int, library_path: Optional[str] = None) -> None:
+    """
+    Takes the collection's public catalog down; the collection stays.
+
+    Raises:
+        CollectionNotFound: If the library has no such collection.
+        NotPublished: If it isn't published.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, collection_id, _library_key(library_path))
+            with conn:
+                deleted = conn.execute("DELETE FROM collection_publications WHERE collection_id = ?", (collection_id,)).rowcount
+        finally:
+            conn.close()
+    if not deleted:
+        raise NotPublished(f"Collection {collection_id} isn't published.")
+
+
+def published(slug: str) -> Dict[str, Any]:
+    """
+    The collection published under the slug, with its "library" ("" for the default one), "book_ids"
+    in the order they were added and its "publication".
+
+    Raises:
+        NotPublished: If no collection is published under the slug.
+    """
+    row = None
+    if os.path.exists(db_path()):
+        with _lock:
+            conn = connect()
+            try:
+                row = conn.execute("SELECT c.id, c.library FROM collection_publications p JOIN collections c "
+                                   "ON c.id = p.collection_id WHERE p.slug = ?", (slug.strip().lower(),)).fetchone()
+                if row is not None:
+                    collection = {"library": row[1], **_get(conn, row[0], row[1]), "publication": _publication(conn, row[0])}
+                    collection["book_ids"] = [r[0] for r in conn.execute(
+                        "SELECT book_id FROM collection_books WHERE collection_id = ? ORDER BY added_at, book_id", (row[0],))]
+            finally:
+                conn.close()
+    if row is None:
+        raise NotPublished(f"No shelf is published as '{slug}'.")
+    return collection
+
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Removes deleted books from all collections of the library."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany(
+                    "DELETE FROM collection_books WHERE book_id = ? AND collection_id IN "
+                    "(SELECT id FROM collections WHERE library = ?)",
+                    [(book_id, _library_key(library_path)) for book_id in book_ids])
+        finally:
+            conn.close()
+
+
+def export_user(user_id: int) -> List[Dict[str, Any]]:
+    """The user's shelves in all libraries ("library" is "" for the default one), each with its book IDs."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            shelves = [{"library": library, **_get(conn, collection_id, library)} for collection_id, library in
+                       conn.execute("SELECT id, library FROM collections WHERE owner_id = ? ORDER BY id", (user_id,)).fetchall()]
+            for shelf in shelves:
+                shelf["book_ids"] = [r[0] for r in conn.execute(
+                    "SELECT book_id FROM collection_books WHERE collection_id = ? ORDER BY added_at, book_id", (shelf["id"],))]
+                shelf["shares"] = [dict(zip(_SHARE_COLUMNS, r)) for r in conn.execute(
+                    f"SELECT {', '.join(_SHARE_COLUMNS)} FROM collection_shares WHERE collection_id = ? ORDER BY created_at, user_id",
+                    (shelf["id"],))]
+                shelf["publication"] = _publication(conn, shelf["id"])
+        finally:
+            conn.close()
+    return shelves
+
+
+def forget_user(user_id: int) -> None:
+    """Deletes a deleted user's shelves, and stops sharing other shelves with them."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM collections WHERE owner_id = ?", (user_id,))
+                conn.execute("DELETE FROM collection_shares WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
@@ -0,0 +1,288 @@
+"""
+Comment threads on books: informal discussion among the users of a shared library, separate from
+ratings and reviews (see ratings). Everyone who can see a book can read and join its thread; a
+comment can answer another of the same book. Needs user accounts (see accounts).
+
+Comments can mention users as @username. Mentions of existing accounts are stored with the
+comment, so the endpoint can notify them (see notifications). Authors edit and delete their own
+comments; admins moderate by deleting any. Deleting a comment that has answers keeps it as an
+empty placeholder, so the thread stays readable. Comments are kept in a small SQLite database
+(SHELFSTONE_BOOK_COMMENTS_DB, in the state directory by default; see state_store).
+"""
+import os
+import re
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, List, Optional
+
+from . import accounts
+from . import state_store
+from .state_store import library_key as _library_key
+
+_lock = threading.Lock()
+
+MAX_COMMENT_LENGTH = 10000
+MAX_MENTIONS = 20
+
+# @ followed by a username (see accounts.USERNAME_PATTERN), not inside a word or an email address.
+MENTION_PATTERN = re.compile(r"(?<![\w@.])@([A-Za-z0-9][A-Za-z0-9._@-]{0,63})")
+
+
+class CommentNotFound(Exception):
+    """The book has no comment with this ID."""
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: comments and the users they mention. A deleted comment with answers keeps its row with body and user_id NULL.
+    (
+        "CREATE TABLE book_comments ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, library TEXT NOT NULL, book_id INTEGER NOT NULL, "
+        "parent_id INTEGER REFERENCES book_comments (id) ON DELETE CASCADE, user_id INTEGER, body TEXT, "
+        "created_at REAL NOT NULL, edited_at REAL, deleted_at REAL)",
+        "CREATE INDEX book_comments_book ON book_comments (library, book_id, id)",
+        "CREATE INDEX book_comments_user ON book_comments (user_id)",
+        "CREATE TABLE comment_mentions ("
+        "comment_id INTEGER NOT NULL REFERENCES book_comments (id) ON DELETE CASCADE, user_id INTEGER NOT NULL, "
+        "PRIMARY KEY (comment_id, user_id))",
+        "CREATE INDEX comment_mentions_user ON comment_mentions (user_id)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_BOOK_COMMENTS_DB", "book_comments.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    conn = state_store.connect(path or db_path(), MIGRATIONS)
+    conn.execute("PRAGMA foreign_keys = ON")
+    return conn
+
+
+def _body(body: Optional[str]) -> str:
+    body = (body or "").strip()
+    if not body:
+        raise ValueError("The comment must not be empty.")
+    if len(body) > MAX_COMMENT_LENGTH:
+        raise ValueError(f"The comment must be at most {MAX_COMMENT_LENGTH} characters.")
+    return body
+
+
+def mentions(body: str) -> List[int]:
+    """
+    The users an @username in the text refers to, in order of first mention, at most MAX_MENTIONS.
+    Punctuation ending a sentence ("thanks @ana.") isn't taken as part of the name.
+    """
+    users = {user["username"].casefold(): user["id"] for user in accounts.list_users()}
+    found: List[int] = []
+    for match in MENTION_PATTERN.finditer(body or ""):
+        name = match.group(1)
+        while name and name.casefold() not in users and name[-1] in "._@-":
+            name = name[:-1]
+        user_id = users.get(name.casefold())
+        if user_id is not None and user_id not in found:
+            found.append(user_id)
+    return found[:MAX_MENTIONS]
+
+
+_FIELDS = ("id", "book_id", "parent_id", "user_id", "body", "created_at", "edited_at", "deleted_at")
+_SELECT = f"SELECT {', '.join(_FIELDS)} FROM book_comments"
+
+
+def _as_dict(conn: sqlite3.Connection, row: tuple) -> Dict[str, Any]:
+    comment = dict(zip(_FIELDS, row))
+    comment["deleted"] = comment.pop("deleted_at") is not None
+    comment["mentions"] = [r[0] for r in conn.execute(
+        "SELECT user_id FROM comment_mentions WHERE comment_id = ? ORDER BY rowid", (comment["id"],))]
+    return comment
+
+
+def _get(conn: sqlite3.Connection, book_id: int, comment_id: int, library: str) -> Dict[str, Any]:
+    row = conn.execute(f"{_SELECT} WHERE id = ? AND book_id = ? AND library = ?", (comment_id, book_id, library)).fetchone()
+    if row is None:
+        raise CommentNotFound(f"Comment {comment_id} not found on book ID {book_id}.")
+    return _as_dict(conn, row)
+
+
+def _set_mentions(conn: sqlite3.Connection, comment_id: int, body: str) -> None:
+    conn.execute("DELETE FROM comment_mentions WHERE comment_id = ?", (comment_id,))
+    conn.executemany("INSERT INTO comment_mentions (comment_id, user_id) VALUES (?, ?)",
+                     [(comment_id, user_id) for user_id in mentions(body)])
+
+
+def comments(book_id: int, library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """
+    The book's thread: its comments that answer none, oldest first, each with its "replies" in the
+    same form and the IDs of the users it "mentions".
+    """
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = [_as_dict(conn, row) for row in conn.execute(
+                f"{_SELECT} WHERE library = ? AND book_id = ? ORDER BY id", (_library_key(library_path), book_id)).fetchall()]
+        finally:
+            conn.close()
+    by_id: Dict[int, Dict[str, Any]] = {}
+    threads: List[Dict[str, Any]] = []
+    for comment in rows:
+        comment["replies"] = []
+        by_id[comment["id"]] = comment
+        parent = by_id.get(comment["parent_id"])
+        (parent["replies"] if parent else threads).append(comment)
+    return threads
+
+
+def comment_count(book_id: int, library_path: Optional[str] = None) -> int:
+    """How many comments the book has, not counting deleted ones."""
+    if not os.path.exists(db_path()):
+        return 0
+    with _lock:
+        conn = connect()
+        try:
+            return conn.execute("SELECT COUNT(*) FROM book_comments WHERE library = ? AND book_id = ? AND deleted_at IS NULL",
+                                (_library_key(library_path), book_id)).fetchone()[0]
+        finally:
+            conn.close()
+
+
+def get_comment(book_id: int, comment_id: int, library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Raises:
+        CommentNotFound: If the book has no such comment.
+    """
+    if not os.path.exists(db_path()):
+        raise CommentNotFound(f"Comment {comment_id} not found on book ID {book_id}.")
+    with _lock:
+        conn = connect()
+        try:
+            return _get(conn, book_id, comment_id, _library_key(library_path))
+        finally:
+            conn.close()
+
+
+def add_comment(book_id: int, user_id: int, body: str, parent_id: Optional[int] = None,
+                library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Comments on the book, or answers its comment `parent_id`. Returns the comment.
+
+    Raises:
+        ValueError: For an empty or too long comment, or answering a deleted one.
+        CommentNotFound: If the book has no comment `parent_id`.
+    """
+    body = _body(body)
+    library = _library_key(library_path)
+    with _lock:
+        conn = connect()
+        try:
+            if parent_id is not None and _get(conn, book_id, parent_id, library)["deleted"]:
+                raise ValueError("The comment you answer was deleted.")
+            with conn:
+                comment_id = conn.execute(
+                    "INSERT INTO book_comments (library, book_id, parent_id, user_id, body, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+                    (library, book_id, parent_id, user_id, body, time.time())).lastrowid
+                _set_mentions(conn, comment_id, body)
+            return _get(conn, book_id, comment_id, library)
+        finally:
+            conn.close()
+
+
+def edit_comment(book_id: int, comment_id: int, body: str, library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Replaces the comment's text, and its mentions with those of the new text.
+
+    Raises:
+        ValueError: For an empty or too long comment, or a deleted one.
+        CommentNotFound: If the book has no such comment.
+    """
+    body = _body(body)
+    library = _library_key(library_path)
+    with _lock:
+        conn = connect()
+        try:
+            if _get(conn, book_id, comment_id, library)["deleted"]:
+                raise ValueError("This comment was deleted.")
+            with conn:
+                conn.execute("UPDATE book_comments SET body = ?, edited_at = ? WHERE id = ?", (body, time.time(), comment_id))
+                _set_mentions(conn, comment_id, body)
+            return _get(conn, book_id, comment_id, library)
+        finally:
+            conn.close()
+
+
+def _delete(conn: sqlite3.Connection, comment_id: int) -> None:
+    """Deletes the comment, or empties it while it has answers; placeholders left without answers go too."""
+    while comment_id is not None:
+        row = conn.execute("SELECT parent_id FROM book_comments WHERE id = ?", (comment_id,)).fetchone()
+        if row is None:
+            return
+        if conn.execute("SELECT 1 FROM book_comments WHERE parent_id = ?", (comment_id,)).fetchone():
+            conn.execute("UPDATE book_comments SET body = NULL, user_id = NULL, deleted_at = IFNULL(deleted_at, ?) WHERE id = ?",
+                         (time.time(), comment_id))
+            conn.execute("DELETE FROM comment_mentions WHERE comment_id = ?", (comment_id,))
+            return
+        conn.execute("DELETE FROM book_comments WHERE id = ?", (comment_id,))
+        parent = conn.execute("SELECT id FROM book_comments WHERE id = ? AND deleted_at IS NOT NULL", (row[0],)).fetchone()
+        comment_id = parent[0] if parent else None
+
+
+def delete_comment(book_id: int, comment_id: int, library_path: Optional[str] = None) -> None:
+    """
+    Raises:
+        CommentNotFound: If the book has no such comment.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, book_id, comment_id, _library_key(library_path))
+            with conn:
+                _delete(conn, comment_id)
+        finally:
+            conn.close()
+
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Removes the threads of deleted books."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("DELETE FROM book_comments WHERE library = ? AND book_id = ?",
+                                 [(_library_key(library_path), book_id) for book_id in book_ids])
+        finally:
+            conn.close()
+
+
+def forget_user(user_id: int) -> None:
+    """Deletes a deleted user's comments, as delete_comment does, and their mentions."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                for (comment_id,) in conn.execute("SELECT id FROM book_comments WHERE user_id = ? ORDER BY id DESC",
+                                                  (user_id,)).fetchall():
+                    _delete(conn, comment_id)
+                conn.execute("DELETE FROM comment_mentions WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
+
+
+def export_user(user_id: int) -> List[Dict[str, Any]]:
+    """The user's comments in all libraries ("library" is "" for the default one)."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT library, {', '.join(_FIELDS)} FROM book_comments WHERE user_id = ? ORDER BY id",
+                                (user_id,)).fetchall()
+            return [{"library": row[0], **_as_dict(conn, row[1:])} for row in rows]
+        finally:
+            conn.close()
@@ -0,0 +1,125 @@
+"""
+Browsing the library by author and series, with book counts, read from the library's
+metadata.db (read-only) instead of listing every book with calibredb.
+
+Libraries built from many sources often have the same author twice, once as "Austen, Jane" and
+once as "Jane Austen" (or "J.R.R. Tolkien" next to "J. R. R. Tolkien"). Authors whose names
+normalize to the same key (see normalize_author) are listed as one entry; its ID is that of the
+variant with the most books, and any variant's ID finds the entry.
+"""
+import re
+import sqlite3
+import unicodedata
+from typing import Any, Dict, List, Optional
+
+from . import library_db
+
+_SPACE_RE = re.compile(r"\s+")
+
+
+def normalize_author(name: str) -> str:
+    """
+    Key under which name variants of one author match: "Last, First" becomes "First Last", and
+    case, accents, periods and extra spaces are ignored ("Tolkien, J.R.R." -> "j r r tolkien").
+    """
+    name = (name or "").strip()
+    if name.count(",") == 1:
+        last, first = name.split(",")
+        # "Jr." and the like after a comma are suffixes, not first names.
+        if first.strip().rstrip(".").lower() not in ("jr", "sr", "ii", "iii", "iv", "phd"):
+            name = f"{first} {last}"
+    name = unicodedata.normalize("NFKD", name)
+    name = "".join(c for c in name if not unicodedata.combining(c)).replace(".", " ").replace(",", " ")
+    return _SPACE_RE.sub(" ", name).strip().casefold()
+
+
+def _author_groups(conn: sqlite3.Connection) -> List[Dict[str, Any]]:
+    """Authors with at least one book, merged by normalized name, each with the set of their book IDs."""
+    books: Dict[int, set] = {}
+    for author_id, book_id in conn.execute("SELECT author, book FROM books_authors_link"):
+        books.setdefault(author_id, set()).add(book_id)
+    groups: Dict[str, Dict[str, Any]] = {}
+    for author_id, name, sort in conn.execute("SELECT id, name, sort FROM authors ORDER BY id"):
+        if author_id not in books:
+            continue
+        group = groups.setdefault(normalize_author(name), {"variants": [], "book_ids": set()})
+        group["variants"].append({"id": author_id, "name": name, "sort": sort or name, "books": len(books[author_id])})
+        group["book_ids"] |= books[author_id]
+    result = []
+    for group in groups.values():
+        # The variant with the most books names the entry; on ties one written "First Last", then the oldest.
+        main = max(group["variants"], key=lambda v: (v["books"], "," not in v["name"], -v["id"]))
+        result.append({
+            "id": main["id"],
+            "name": main["name"],
+            "sort": main["sort"],
+            "book_count": len(group["book_ids"]),
+            "variants": [{"id": v["id"], "name": v["name"]} for v in group["variants"] if v["id"] != main["id"]],
+            "book_ids": group["book_ids"],
+        })
+    return sorted(result, key=lambda a: (a["sort"].casefold(), a["id"]))
+
+
+def list_authors(library_path: str) -> List[Dict[str, Any]]:
+    """
+    Authors with books, by sort name, as {"id", "name", "sort", "book_count", "variants"}.
+    `variants` are the other spellings merged into the entry, as {"id", "name"}.
+    """
+    conn = library_db.connect_read_only(library_path)
+    try:
+        groups = _author_groups(conn)
+    finally:
+        conn.close()
+    return [{k: v for k, v in group.items() if k != "book_ids"} for group in groups]
+
+
+def find_author(author_id: int, library_path: str) -> Optional[Dict[str, Any]]:
+    """The author entry containing the author ID, with its "book_ids" (a set), or None."""
+    conn = library_db.connect_read_only(library_path)
+    try:
+        groups = _author_groups(conn)
+    finally:
+        conn.close()
+    return next((g for g in groups if g["id"] == author_id or any(v["id"] == author_id for v in g["variants"])), None)
+
+
+def list_series(library_path: str) -> List[Dict[str, Any]]:
+    """
+    Series with books, by name, as {"id", "name", "book_count", "authors"}; `authors` are the
+    names of the series' authors, most books first.
+    """
+    conn = library_db.connect_read_only(library_path)
+    try:
+        series = [
+            {"id": series_id, "name": name, "book_count": count, "authors": []}
+            for series_id, name, count in conn.execute(
+                "SELECT series.id, series.name, COUNT(DISTINCT books_series_link.book) FROM series "
+                "JOIN books_series_link ON books_series_link.series = series.id "
+                "GROUP BY series.id ORDER BY series.name COLLATE NOCASE")
+        ]
+        by_id = {s["id"]: s for s in series}
+        for series_id, author in conn.execute(
+                "SELECT books_series_link.series, authors.name FROM books_series_link "
+                "JOIN books_authors_link ON books_authors_link.book = books_series_link.book "
+                "JOIN authors ON authors.id = books_authors_link.author "
+                "GROUP BY books_series_link.series, authors.id "
+                "ORDER BY books_series_link.series, COUNT(*) DESC, authors.sort"):
+            by_id[series_id]["authors"].append(author)
+    finally:
+        conn.close()
+    return series
+
+
+def find_series(series_id: int, library_path: str) -> Optional[Dict[str, Any]]:
+    """The series as {"id", "name", "book_ids"} with its books in series order, or None."""
+    conn = library_db.connect_read_only(library_path)
+    try:
+        row = conn.execute("SELECT id, name FROM series WHERE id = ?", (series_id,)).fetchone()
+        if row is None:
+            return None
+        book_ids = [book_id for (book_id,) in conn.execute(
+            "SELECT books.id FROM books_series_link JOIN books ON books.id = books_series_link.book "
+            "WHERE books_series_link.series = ? ORDER BY books.series_index, books.sort, books.id", (series_id,))]
+    finally:
+        conn.close()
+    return {"id": row[0], "name": row[1], "book_ids": book_ids}
@@ -0,0 +1,157 @@
+"""
+Builds self-contained offline bundles of books: a ZIP with the book files, their covers,
+an `index.html` to browse them in any web browser and a `catalog.xml` OPDS feed for
+reading apps, all with relative links so the bundle works from a USB stick or file share.
+"""
+import html
+import os
+import re
+import zipfile
+import logging
+from datetime import datetime, timezone
+from typing import Any, Dict, List, Optional
+from urllib.parse import quote
+from xml.sax.saxutils import escape as xml_escape, quoteattr
+
+from . import formats as format_registry
+from .crud import as_list
+
+logger = logging.getLogger(__name__)
+
+# Largest bundle the server builds; requests can only ask for smaller limits.
+DEFAULT_MAX_BOOKS = 500
+
+
+def max_books() -> int:
+    """The server's limit on books per bundle (SHELFSTONE_BUNDLE_MAX_BOOKS)."""
+    try:
+        return max(1, int(os.environ.get("SHELFSTONE_BUNDLE_MAX_BOOKS", DEFAULT_MAX_BOOKS)))
+    except ValueError:
+        return DEFAULT_MAX_BOOKS
+
+_UNSAFE_CHARS_RE = re.compile(r'[\\/:*?"<>|\x00-\x1f]+')
+
+
+def safe_name(value: str, max_length: int = 80) -> str:
+    """Makes a string usable as a file or folder name on all common file systems."""
+    name = _UNSAFE_CHARS_RE.sub("_", value or "").strip(" .")
+    return name[:max_length].rstrip(" .") or "untitled"
+
+
+def _book_files(book: Dict[str, Any], formats: Optional[List[str]]) -> List[str]:
+    # calibredb list reports formats as full paths to the files inside the library.
+    paths = [p for p in as_list(book.get("formats")) if os.path.isabs(p) and os.path.isfile(p)]
+    if formats:
+        wanted = {f.upper() for f in formats}
+        paths = [p for p in paths if os.path.splitext(p)[1][1:].upper() in wanted]
+    return paths
+
+
+def plan_bundle(books: List[Dict[str, Any]], formats: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+    """
+    Decides where each book's files and cover go inside the bundle. Books without any
+    matching file are left out.
+
+    Returns:
+        One {"book", "folder", "files": [(source, arcname)], "cover": (source, arcname) or None} per book.
+    """
+    entries = []
+    for book in books:
+        files = _book_files(book, formats)
+        if not files:
+            continue
+        folder = f"books/{book.get('id')} - {safe_name(book.get('title') or 'untitled')}"
+        entry = {
+            "book": book,
+            "folder": folder,
+            "files": [(path, f"{folder}/{os.path.basename(path)}") for path in files],
+            "cover": None,
+        }
+        cover = book.get("cover")
+        if cover and os.path.isfile(cover):
+            entry["cover"] = (cover, f"covers/{book.get('id')}{os.path.splitext(cover)[1] or '.jpg'}")
+        entries.append(entry)
+    return entries
+
+
+def render_index_html(entries: List[Dict[str, Any]], title: str) -> str:
+    esc = html.escape
+    rows = []
+    for entry in entries:
+        book = entry["book"]
+        cover = f'<img src="{esc(quote(entry["cover"][1]))}" alt="" width="80">' if entry["cover"] else ""
+        links = " ".join(
+            f'<a href="{esc(quote(arcname))}">{esc(os.path.splitext(arcname)[1][1:].upper())}</a>'
+            for _, arcname in entry["files"]
+        )
+        rows.append(
+            f"<tr><td>{cover}</td><td><strong>{esc(book.get('title') or 'Untitled')}</strong><br>"
+            f"{esc(', '.join(as_list(book.get('authors'), 'authors')))}</td><td>{links}</td></tr>"
+        )
+    return (
+        "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n"
+        f"<title>{esc(title)}</title>\n</head>\n<body>\n<h1>{esc(title)}</h1>\n"
+        f"<p>{len(entries)} book(s). Open a format link to read or copy the book.</p>\n"
+        "<table>\n" + "\n".join(rows) + "\n</table>\n</body>\n</html>\n"
+    )
+
+
+def render_opds_catalog(entries: List[Dict[str, Any]], title: str, updated: str) -> str:
+    """Renders an OPDS 1.2 acquisition feed with links relative to the bundle root."""
+    parts = [
+        '<?xml version="1.0" encoding="utf-8"?>',
+        '<feed xmlns="http://www.w3.org/2005/Atom" xmlns:dc="http://purl.org/dc/terms/">',
+        f"<id>urn:shelfstone:bundle:{xml_escape(safe_name(title))}</id>",
+        f"<title>{xml_escape(title)}</title>",
+        f"<updated>{updated}</updated>",
+    ]
+    for entry in entries:
+        book = entry["book"]
+        parts.append("<entry>")
+        parts.append(f"<id>urn:uuid:{xml_escape(str(book.get('uuid') or book.get('id')))}</id>")
+        parts.append(f"<title>{xml_escape(book.get('title') or 'Untitled')}</title>")
+        for author in as_list(book.get("authors"), "authors"):
+            parts.append(f"<author><name>{xml_escape(author)}</name></author>")
+        parts.append(f"<updated>{xml_escape(str(book.get('last_modified') or updated))}</updated>")
+        if entry["cover"]:
+            href = quoteattr(quote(entry["cover"][1]))
+            parts.append(f'<link rel="http://opds-spec.org/image" href={href} type="image/jpeg"/>')
+            parts.append(f'<link rel="http://opds-spec.org/image/thumbnail" href={href} type="image/jpeg"/>')
+        for _, arcname in entry["files"]:
+            mime = format_registry.mime_type(os.path.splitext(arcname)[1])
+            parts.append(f'<link rel="http://opds-spec.org/acquisition" href={quoteattr(quote(arcname))} type="{mime}"/>')
+        parts.append("</entry>")
+    parts.append("</feed>")
+    return "\n".join(parts) + "\n"
+
+
+def write_bundle(books: List[Dict[str, Any]], output_path: str, title: str = "Shelfstone Library",
+                 formats: Optional[List[str]] = None) -> Dict[str, Any]:
+    """
+    Writes the bundle ZIP for a list of book dicts from `calibredb list`.
+
+    Returns:
+        {"books": number of books included, "files": number of book files}
+
+    Raises:
+        ValueError: If none of the books has a file in the requested formats.
+    """
+    entries = plan_bundle(books, formats)
+    if not entries:
+        raise ValueError("None of the selected books has a file in the requested format(s).")
+
+    updated = datetime.now(timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+    file_count = 0
+    # Book files are already compressed (EPUB, PDF, images), so they are stored as-is.
+    with zipfile.ZipFile(output_path, "w", compression=zipfile.ZIP_STORED) as bundle:
+        for entry in entries:
+            for source, arcname in entry["files"]:
+                bundle.write(source, arcname)
+                file_count += 1
+            if entry["cover"]:
+                bundle.write(*entry["cover"])
+        bundle.writestr("index.html", render_index_html(entries, title), compress_type=zipfile.ZIP_DEFLATED)
+        bundle.writestr("catalog.xml", render_opds_catalog(entries, title, updated), compress_type=zipfile.ZIP_DEFLATED)
+
+    logger.info(f"Wrote bundle {output_path} with {len(entries)} book(s), {file_count} file(s).")
+    return {"books": len(entries), "files": file_count}
@@ -0,0 +1,142 @@
+"""
+iCalendar (RFC 5545) feed of library events, for subscribing in calendar apps: books added
+to the library, due dates of lent physical copies and the current maintenance window.
+
+Calendar apps poll the feed, so every event has a UID that stays the same between requests;
+otherwise each refresh would duplicate the events.
+"""
+import os
+from datetime import date, datetime, timedelta, timezone
+from typing import Any, Dict, List, Optional
+
+from .crud import list_books
+from . import maintenance_mode
+from . import physical
+
+DEFAULT_DAYS = 90
+DEFAULT_LOAN_DAYS = 28
+PRODID = "-//Shelfstone//Library Events//EN"
+
+
+def loan_days() -> int:
+    """Loan period used for due dates (SHELFSTONE_LOAN_DAYS)."""
+    try:
+        return int(os.environ.get("SHELFSTONE_LOAN_DAYS", DEFAULT_LOAN_DAYS))
+    except ValueError:
+        return DEFAULT_LOAN_DAYS
+
+
+def escape_text(value: str) -> str:
+    return (value.replace("\\", "\\\\").replace(";", "\\;").replace(",", "\\,")
+            .replace("\r\n", "\\n").replace("\n", "\\n"))
+
+
+def fold_line(line: str) -> str:
+    """Splits a content line into chunks of at most 75 octets, as RFC 5545 requires."""
+    encoded = line.encode("utf-8")
+    if len(encoded) <= 75:
+        return line
+    parts, start = [], 0
+    while start < len(encoded):
+        end = min(start + (75 if not parts else 74), len(encoded))
+        # Don't cut a multi-byte character in half.
+        while end < len(encoded) and (encoded[end] & 0xC0) == 0x80:
+            end -= 1
+        parts.append(encoded[start:end].decode("utf-8"))
+        start = end
+    return "\r\n ".join(parts)
+
+
+def _utc(ts: float) -> str:
+    return datetime.fromtimestamp(ts, timezone.utc).strftime("%Y%m%dT%H%M%SZ")
+
+
+def _authors(book: Dict[str, Any]) -> str:
+    authors = book.get("authors") or []
+    return " & ".join(authors) if isinstance(authors, list) else str(authors)
+
+
+def book_added_events(books: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+    events = []
+    for book in books:
+        added = str(book.get("timestamp") or "")[:10]
+        if not added:
+            continue
+        by = f" by {_authors(book)}" if _authors(book) else ""
+        events.append({
+            "uid": f"book-added-{book['id']}",
+            "date": date.fromisoformat(added),
+            "summary": f"Added: {book.get('title') or 'Untitled'}{by}",
+            "categories": "Books added",
+        })
+    return events
+
+
+def loan_due_events(books: List[Dict[str, Any]], days: int) -> List[Dict[str, Any]]:
+    events = []
+    for book in books:
+        copy = book.get("physical_copy") or physical.read_physical_copy(book)
+        if not copy.get("loaned_to") or not copy.get("loaned_on"):
+            continue
+        due = date.fromisoformat(copy["loaned_on"]) + timedelta(days=days)
+        events.append({
+            # The loan date is part of the UID so a new loan of the same book is a new event.
+            "uid": f"loan-due-{book['id']}-{copy['loaned_on']}",
+            "date": due,
+            "summary": f"Due back: {book.get('title') or 'Untitled'} (lent to {copy['loaned_to']})",
+            "description": f"Lent on {copy['loaned_on']}.",
+            "categories": "Loans",
+        })
+    return events
+
+
+def maintenance_events(state: Dict[str, Any]) -> List[Dict[str, Any]]:
+    if not state.get("enabled"):
+        return []
+    return [{
+        "uid": f"maintenance-{int(state['started_at'])}",
+        "start": state["started_at"],
+        "end": state["until"],
+        "summary": "Library maintenance (read-only)",
+        "description": state.get("reason") or "",
+        "categories": "Maintenance",
+    }]
+
+
+def render_calendar(events: List[Dict[str, Any]], now: Optional[float] = None, name: str = "Library events") -> str:
+    """Renders events ({"uid", "summary", "date" or "start"/"end", ...}) as a VCALENDAR."""
+    stamp = _utc(now if now is not None else datetime.now(timezone.utc).timestamp())
+    lines = ["BEGIN:VCALENDAR", "VERSION:2.0", f"PRODID:{PRODID}", "CALSCALE:GREGORIAN",
+             f"X-WR-CALNAME:{escape_text(name)}"]
+    for event in events:
+        lines += ["BEGIN:VEVENT", f"UID:{event['uid']}@shelfstone", f"DTSTAMP:{stamp}"]
+        if "date" in event:
+            lines.append(f"DTSTART;VALUE=DATE:{event['date'].strftime('%Y%m%d')}")
+            lines.append(f"DTEND;VALUE=DATE:{(event['date'] + timedelta(days=1)).strftime('%Y%m%d')}")
+        else:
+            lines += [f"DTSTART:{_utc(event['start'])}", f"DTEND:{_utc(event['end'])}"]
+        lines.append(f"SUMMARY:{escape_text(event['summary'])}")
+        if event.get("description"):
+            lines.append(f"DESCRIPTION:{escape_text(event['description'])}")
+        if event.get("categories"):
+            lines.append(f"CATEGORIES:{escape_text(event['categories'])}")
+        lines.append("END:VEVENT")
+    lines.append("END:VCALENDAR")
+    return "\r\n".join(fold_line(line) for line in lines) + "\r\n"
+
+
+def build_feed(library_path: Optional[str] = None, days: int = DEFAULT_DAYS, today: Optional[date] = None,
+               now: Optional[float] = None) -> str:
+    """
+    The library's calendar: books added in the last `days` days, due dates of lent physical
+    copies and the maintenance window, if one is active.
+
+    Raises:
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If calibredb fails.
+    """
+    since = (today or date.today()) - timedelta(days=days)
+    added = list_books(library_path=library_path, search_query=f"date:>={since.isoformat()}")
+    lent = physical.list_physical_copies(loaned=True, library_path=library_path)
+    events = book_added_events(added) + loan_due_events(lent, loan_days()) + maintenance_events(maintenance_mode.status(now))
+    return render_calendar(events, now=now)
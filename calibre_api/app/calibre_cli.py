@@ -1,6 +1,17 @@
 import subprocess
 import logging
-from typing import Tuple
+import os
+import shutil
+import tempfile
+import threading
+import time
+from contextlib import contextmanager
+from typing import Tuple, List, Optional, Union, Dict, Any, Iterator
+
+from . import filetypes
+from . import lifecycle
+from . import metrics
+from . import processing_log
 
 # Configure basic logging
 logger = logging.getLogger(__name__)
@@ -16,76 +27,364 @@ class CalibreCLIError(Exception):
     def __str__(self):
         return f"{super().__str__()} (returncode: {self.returncode})\nStderr: {self.stderr}\nStdout: {self.stdout}"
 
+    @property
+    def error_type(self) -> str:
+        """The failure class (e.g. "drm", "corrupt_file", "timeout"), see metrics.classify_failure."""
+        return metrics.classify_failure(self.stderr, self.returncode)
+
+
+class ConversionUnavailable(CalibreCLIError):
+    """A format can only be converted with a Calibre plugin that is not installed."""
+
+
+class ConversionFailed(CalibreCLIError):
+    """ebook-convert ran but failed, or didn't produce the output file."""
+
+
+class CalibreTimeout(CalibreCLIError):
+    """A Calibre command exceeded its timeout and was killed."""
+
+
+class CommandCancelled(CalibreCLIError):
+    """A Calibre command was cancelled (e.g. on server shutdown) and killed, or never started."""
+
+
+class CalibreBinaryMissing(FileNotFoundError):
+    """
+    A Calibre executable was not found. A FileNotFoundError, so callers that map a missing
+    binary to 503 keep doing so.
+    """
+    def __init__(self, message, executable=None):
+        super().__init__(message)
+        self.executable = executable
+
+
+# Formats ebook-convert only handles with third-party plugins: {format: (input plugin, output plugin)}.
+PLUGIN_FORMATS = {"KFX": ("KFX Input", "KFX Output")}
+# Installed plugins are looked up at most this often; installing one takes effect without a restart.
+PLUGIN_CACHE_SECONDS = 300
+_plugin_cache: Dict[str, Any] = {"checked_at": None, "names": set()}
+
+
+def _command_target(command: list[str]) -> Optional[str]:
+    # The first argument that is an existing file is the book/file the command works on.
+    return next((arg for arg in command[1:] if not arg.startswith("-") and os.path.isfile(arg)), None)
+
+
+# Options whose value is a secret (e.g. calibre-smtp's SMTP password); their values are
+# replaced in logged command lines, which GET /admin/logs serves.
+SECRET_OPTIONS = ("--password",)
+REDACTED = "***"
+
+
+def command_line(command: List[str]) -> str:
+    """The command as one string for logging, with the values of SECRET_OPTIONS redacted."""
+    parts = []
+    redact_next = False
+    for arg in command:
+        if redact_next:
+            parts.append(REDACTED)
+            redact_next = False
+        elif arg in SECRET_OPTIONS:
+            parts.append(arg)
+            redact_next = True
+        elif arg.startswith(tuple(f"{option}=" for option in SECRET_OPTIONS)):
+            parts.append(arg.split("=", 1)[0] + "=" + REDACTED)
+        else:
+            parts.append(arg)
+    return " ".join(parts)
+
+
+# Retry policy for transient failures (see metrics.TRANSIENT_ERROR_TYPES): commands that found
+# the library database locked usually succeed when simply run again.
+# Overridable with SHELFSTONE_CLI_MAX_ATTEMPTS and SHELFSTONE_CLI_RETRY_BASE_DELAY (seconds).
+DEFAULT_MAX_ATTEMPTS = 3
+DEFAULT_RETRY_BASE_DELAY = 0.5
+MAX_RETRY_DELAY = 8.0
+
+
+def _retry_policy() -> Tuple[int, float]:
+    try:
+        max_attempts = max(1, int(os.environ.get("SHELFSTONE_CLI_MAX_ATTEMPTS", DEFAULT_MAX_ATTEMPTS)))
+        base_delay = max(0.0, float(os.environ.get("SHELFSTONE_CLI_RETRY_BASE_DELAY", DEFAULT_RETRY_BASE_DELAY)))
+    except ValueError:
+        logger.warning("Invalid SHELFSTONE_CLI_MAX_ATTEMPTS/SHELFSTONE_CLI_RETRY_BASE_DELAY, using defaults.")
+        return DEFAULT_MAX_ATTEMPTS, DEFAULT_RETRY_BASE_DELAY
+    return max_attempts, base_delay
+
+
+# Where Calibre's own installers put the binaries, searched when they are not on PATH.
+DEFAULT_BIN_DIRS = ["/opt/calibre", "/Applications/calibre.app/Contents/MacOS"]
+
+
+def resolve_executable(name: str) -> str:
+    """
+    The path of a Calibre binary in SHELFSTONE_CALIBRE_BIN_DIR (for installs that are not on PATH),
+    else the bare name if it is on PATH, else its path in a default install location (/opt/calibre
+    from the Linux installer, the macOS app bundle). The bare name if it is found nowhere.
+    """
+    if os.sep in name:
+        return name
+    bin_dir = os.environ.get("SHELFSTONE_CALIBRE_BIN_DIR")
+    if bin_dir:
+        candidate = os.path.join(bin_dir, name)
+        if os.path.isfile(candidate):
+            return candidate
+    if shutil.which(name):
+        return name
+    for directory in DEFAULT_BIN_DIRS:
+        candidate = os.path.join(directory, name)
+        if os.path.isfile(candidate) and os.access(candidate, os.X_OK):
+            return candidate
+    return name
+
+
+def parse_timeouts(value: Optional[str]) -> Dict[str, float]:
+    """
+    Parses SHELFSTONE_CLI_TIMEOUTS, e.g. "ebook-convert=900, calibredb=120": timeouts in
+    seconds per Calibre tool, replacing the ones the server uses for that tool.
+
+    Raises:
+        ValueError: For entries that are not tool=seconds with a positive number of seconds.
+    """
+    timeouts: Dict[str, float] = {}
+    for entry in (value or "").split(","):
+        if not entry.strip():
+            continue
+        tool, _, seconds = entry.partition("=")
+        try:
+            timeout = float(seconds)
+        except ValueError:
+            timeout = 0.0
+        if not tool.strip() or timeout <= 0:
+            raise ValueError(f"Invalid timeout '{entry.strip()}'. Use tool=seconds, e.g. ebook-convert=900.")
+        timeouts[tool.strip()] = timeout
+    return timeouts
+
+
+def command_timeout(executable_name: str, default: float) -> float:
+    """The timeout of a command: from SHELFSTONE_CLI_TIMEOUTS if set for the tool, else the caller's."""
+    try:
+        timeouts = parse_timeouts(os.environ.get("SHELFSTONE_CLI_TIMEOUTS"))
+    except ValueError as e:
+        logger.warning(f"Ignoring SHELFSTONE_CLI_TIMEOUTS: {e}")
+        return default
+    return timeouts.get(os.path.basename(executable_name), default)
+
+
+# Calibre commands running at the same time (SHELFSTONE_CLI_MAX_CONCURRENT, 0 for no limit).
+# Conversions are CPU- and memory-hungry; further commands wait for a free slot. Free slots go to
+# the waiting command of the highest priority (see lifecycle.PRIORITIES), the longest waiting
+# first among equals. So that a steady stream of requests can't hold bulk work off for good, a
+# waiting command rises one priority for every SHELFSTONE_CLI_AGING_SECONDS it waits.
+DEFAULT_MAX_CONCURRENT = 4
+DEFAULT_AGING_SECONDS = 30.0
+# How often waiting for a slot or a running command checks for cancellation, in seconds.
+POLL_INTERVAL = 0.2
+_slots_lock = threading.Condition()
+# "taken": slots in use; "waiting": {"priority", "since", "seq"} of the commands waiting for one.
+_slots: Dict[str, Any] = {"taken": 0, "waiting": [], "seq": 0}
+
+
+def max_concurrent() -> int:
+    try:
+        return max(0, int(os.environ.get("SHELFSTONE_CLI_MAX_CONCURRENT", DEFAULT_MAX_CONCURRENT)))
+    except ValueError:
+        return DEFAULT_MAX_CONCURRENT
+
+
+def aging_seconds() -> float:
+    try:
+        return max(0.0, float(os.environ.get("SHELFSTONE_CLI_AGING_SECONDS", DEFAULT_AGING_SECONDS)))
+    except ValueError:
+        return DEFAULT_AGING_SECONDS
+
+
+def _rank(waiter: Dict[str, Any], now: float, aging: float) -> Tuple[float, int]:
+    rank = lifecycle.PRIORITIES.index(waiter["priority"])
+    if aging:
+        rank += (now - waiter["since"]) / aging
+    return rank, -waiter["seq"]
 
-def run_calibre_command(command: list[str], timeout: int = 60) -> Tuple[str, str, int]:
+
+def _next_waiter() -> Dict[str, Any]:
+    now, aging = time.monotonic(), aging_seconds()
+    return max(_slots["waiting"], key=lambda waiter: _rank(waiter, now, aging))
+
+
+def _cancelled(executable_name: str) -> CommandCancelled:
+    logger.warning(f"{executable_name} command cancelled.")
+    return CommandCancelled(message=f"{executable_name} command cancelled.", returncode=-3)
+
+
+@contextmanager
+def _command_slot(executable_name: str, cancel: Optional[threading.Event],
+                  priority: Optional[str] = None) -> Iterator[None]:
+    """
+    Holds one of the SHELFSTONE_CLI_MAX_CONCURRENT slots while a command runs. Waiting blocks the
+    thread, so commands must not be run from the event loop (the API's endpoints are plain `def`).
+    `priority` defaults to that of the job running in this thread (see lifecycle.current_priority).
+    """
+    with _slots_lock:
+        _slots["seq"] += 1
+        waiter = {"priority": priority or lifecycle.current_priority(), "since": time.monotonic(), "seq": _slots["seq"]}
+        _slots["waiting"].append(waiter)
+        try:
+            limit = max_concurrent()
+            if limit and (_slots["taken"] >= limit or _next_waiter() is not waiter):
+                logger.info(f"Waiting for a free slot to run {executable_name} (SHELFSTONE_CLI_MAX_CONCURRENT={limit}).")
+                lifecycle.set_command(executable_name, lifecycle.WAITING)
+            # A changed limit (config reload) takes effect while waiting.
+            while limit and (_slots["taken"] >= limit or _next_waiter() is not waiter):
+                if cancel is not None and cancel.is_set():
+                    lifecycle.set_command(None)
+                    raise _cancelled(executable_name)
+                _slots_lock.wait(POLL_INTERVAL)
+                limit = max_concurrent()
+            _slots["taken"] += 1
+        finally:
+            _slots["waiting"].remove(waiter)
+            _slots_lock.notify_all()
+    lifecycle.set_command(executable_name)
+    try:
+        yield
+    finally:
+        lifecycle.set_command(None)
+        with _slots_lock:
+            _slots["taken"] -= 1
+            _slots_lock.notify_all()
+
+
+def _run_process(command: List[str], timeout: float, cancel: Optional[threading.Event]) -> subprocess.CompletedProcess:
+    if cancel is None:
+        return subprocess.run(command, capture_output=True, text=True, check=False, timeout=timeout)
+    if cancel.is_set():
+        raise _cancelled(os.path.basename(command[0]))
+    # Cancellable: the process is polled, and killed once the cancel event is set.
+    deadline = time.monotonic() + timeout
+    process = subprocess.Popen(command, stdout=subprocess.PIPE, stderr=subprocess.PIPE, text=True)
+    while True:
+        try:
+            stdout, stderr = process.communicate(timeout=min(POLL_INTERVAL, max(0.0, deadline - time.monotonic())))
+            return subprocess.CompletedProcess(command, process.returncode, stdout, stderr)
+        except subprocess.TimeoutExpired:
+            if cancel.is_set() or time.monotonic() >= deadline:
+                process.kill()
+                process.communicate()
+                if cancel.is_set():
+                    raise _cancelled(os.path.basename(command[0]))
+                raise subprocess.TimeoutExpired(command, timeout)
+
+
+def run_calibre_command(command: list[str], timeout: int = 60,
+                        cancel: Optional[threading.Event] = None) -> Tuple[str, str, int]:
     """
     Runs a generic Calibre CLI command using subprocess.
 
+    Transient failures (locked library database, process killed by a signal) are retried
+    with exponential backoff, up to SHELFSTONE_CLI_MAX_ATTEMPTS attempts in total.
+    Permanent failures (e.g. corrupt or DRM-protected files) and timeouts are not retried.
+    At most SHELFSTONE_CLI_MAX_CONCURRENT commands run at a time; others wait for a slot, by
+    the priority of the job running in this thread (see lifecycle.job).
+
     Args:
         command: A list of strings representing the command and its arguments
                  (e.g., ['ebook-convert', 'input.txt', 'output.epub']).
-        timeout: The timeout in seconds for the command execution.
+        timeout: The timeout in seconds for each attempt, unless SHELFSTONE_CLI_TIMEOUTS sets one for the tool.
+        cancel: Kills the command when set. Defaults to the cancel event of the background job
+                running in this thread (see lifecycle.job), so shutdown can stop it.
 
     Returns:
-        A tuple containing (stdout, stderr, returncode) of the executed command.
+        A tuple containing (stdout, stderr, returncode) of the executed command
+        (of the last attempt, if it was retried).
 
     Raises:
-        FileNotFoundError: If the first element of the command (the Calibre executable) is not found.
-        CalibreCLIError: If the command times out or returns a non-zero exit code,
-                         or if any other subprocess-related error occurs.
+        CalibreBinaryMissing: If the first element of the command (the Calibre executable) is not found.
+        CalibreTimeout: If the command times out.
+        CommandCancelled: If the command is cancelled.
+        CalibreCLIError: If any other subprocess-related error occurs.
     """
     if not command:
         raise ValueError("Command list cannot be empty.")
 
     executable_name = command[0]
-    logger.info(f"Running Calibre command: {' '.join(command)}")
+    command = [resolve_executable(executable_name)] + list(command[1:])
+    timeout = command_timeout(executable_name, timeout)
+    cancel = cancel or lifecycle.current_cancel_event()
+    max_attempts, base_delay = _retry_policy()
+    attempts: List[Dict[str, Any]] = []
 
-    try:
-        process = subprocess.run(
-            command,
-            capture_output=True,
-            text=True,
-            check=False,  # We will check the return code manually
-            timeout=timeout
-        )
+    while True:
+        logger.info(f"Running Calibre command: {command_line(command)}" + (f" (attempt {len(attempts) + 1})" if attempts else ""))
+        metrics.record_command(executable_name)
 
-        if process.returncode != 0:
-            # Log the error but let the caller decide if it's a CalibreCLIError based on context
-            logger.warning(
-                f"{executable_name} command failed with exit code {process.returncode}."
-                f"\nCommand: {' '.join(command)}"
-                f"\nStderr: {process.stderr.strip()}"
-                f"\nStdout: {process.stdout.strip()}"
+        try:
+            # The return code is checked below rather than raising.
+            with _command_slot(executable_name, cancel):
+                started = time.monotonic()
+                process = _run_process(command, timeout, cancel)
+        except CommandCancelled:
+            raise
+        except FileNotFoundError:
+            logger.error(f"{executable_name} command not found. Ensure Calibre is installed and in your PATH.")
+            metrics.record_failure(executable_name, metrics.ERROR_BINARY_MISSING)
+            raise CalibreBinaryMissing(f"{executable_name} command not found. Ensure Calibre is installed and in your PATH.",
+                                       executable=executable_name)
+        except subprocess.TimeoutExpired:
+            logger.error(f"{executable_name} command timed out after {timeout} seconds. Command: {command_line(command)}")
+            attempts.append({"returncode": -1, "error_type": metrics.ERROR_TIMEOUT})
+            processing_log.record_command(executable_name, -1, time.monotonic() - started, None, f"Timeout after {timeout} seconds.")
+            metrics.record_failure(executable_name, metrics.ERROR_TIMEOUT, returncode=-1,
+                                   target=_command_target(command), attempts=attempts)
+            raise CalibreTimeout(
+                message=f"{executable_name} command timed out.",
+                stderr=f"Timeout after {timeout} seconds.",
+                returncode=-1 # Using a custom return code for timeout
+            )
+        except Exception as e:
+            logger.error(f"An unexpected error occurred while running {executable_name}: {e}. Command: {command_line(command)}", exc_info=True)
+            metrics.record_failure(executable_name, metrics.ERROR_UNKNOWN, returncode=-2, stderr=str(e),
+                                   target=_command_target(command), attempts=attempts)
+            raise CalibreCLIError(
+                message=f"An unexpected error occurred while running {executable_name}: {str(e)}",
+                returncode=-2 # Using a custom return code for other errors
             )
-            # The decision to raise CalibreCLIError here or let the specific wrapper function
-            # interpret the non-zero exit code depends on how granular we want the error handling.
-            # For now, any non-zero return code from this generic helper will be an error.
-            # Specific wrappers can catch this and provide more context or handle expected non-zero exits.
-            # raise CalibreCLIError(
-            #     message=f"{executable_name} command failed.",
-            #     stdout=process.stdout.strip(),
-            #     stderr=process.stderr.strip(),
-            #     returncode=process.returncode
-            # )
-
-        return process.stdout.strip(), process.stderr.strip(), process.returncode
 
-    except FileNotFoundError:
-        logger.error(f"{executable_name} command not found. Ensure Calibre is installed and in your PATH.")
-        raise FileNotFoundError(f"{executable_name} command not found. Ensure Calibre is installed and in your PATH.")
-    except subprocess.TimeoutExpired:
-        logger.error(f"{executable_name} command timed out after {timeout} seconds. Command: {' '.join(command)}")
-        raise CalibreCLIError(
-            message=f"{executable_name} command timed out.",
-            stderr=f"Timeout after {timeout} seconds.",
-            returncode=-1 # Using a custom return code for timeout
+        processing_log.record_command(executable_name, process.returncode, time.monotonic() - started,
+                                      process.stdout, process.stderr)
+        if process.returncode == 0:
+            if attempts:
+                logger.info(f"{executable_name} command succeeded after {len(attempts) + 1} attempts.")
+            return process.stdout.strip(), process.stderr.strip(), process.returncode
+
+        # Log the error but let the caller decide if it's a CalibreCLIError based on context
+        logger.warning(
+            f"{executable_name} command failed with exit code {process.returncode}."
+            f"\nCommand: {command_line(command)}"
+            f"\nStderr: {process.stderr.strip()}"
+            f"\nStdout: {process.stdout.strip()}"
         )
-    except Exception as e:
-        logger.error(f"An unexpected error occurred while running {executable_name}: {e}. Command: {' '.join(command)}", exc_info=True)
-        raise CalibreCLIError(
-            message=f"An unexpected error occurred while running {executable_name}: {str(e)}",
-            returncode=-2 # Using a custom return code for other errors
+        error_type = metrics.classify_failure(process.stderr, process.returncode)
+        attempts.append({"returncode": process.returncode, "error_type": error_type})
+
+        if error_type in metrics.TRANSIENT_ERROR_TYPES and len(attempts) < max_attempts:
+            delay = min(base_delay * (2 ** (len(attempts) - 1)), MAX_RETRY_DELAY)
+            metrics.record_retry(executable_name, error_type)
+            logger.warning(f"Transient {error_type} failure of {executable_name}; retrying in {delay:.1f}s "
+                           f"(attempt {len(attempts) + 1} of {max_attempts}).")
+            if cancel is None:
+                time.sleep(delay)
+            elif cancel.wait(delay):
+                raise _cancelled(executable_name)
+            continue
+
+        metrics.record_failure(
+            executable_name, error_type, returncode=process.returncode, stderr=process.stderr.strip(),
+            target=_command_target(command), attempts=attempts
         )
+        # Non-zero exit codes are returned rather than raised: the specific wrapper functions
+        # interpret them, since some tools use non-zero exits for expected outcomes.
+        return process.stdout.strip(), process.stderr.strip(), process.returncode
 
 if __name__ == '__main__':
     # Example usage for testing run_calibre_command
@@ -210,6 +509,47 @@ def get_calibre_version() -> str:
 
     return stdout # Fallback if parsing fails
 
+def installed_plugin_names() -> set:
+    """Names of the installed Calibre plugins, or an empty set if they can't be listed."""
+    now = time.monotonic()
+    if _plugin_cache["checked_at"] is None or now - _plugin_cache["checked_at"] > PLUGIN_CACHE_SECONDS:
+        try:
+            names = set(list_calibre_plugins())
+        except (FileNotFoundError, CalibreCLIError) as e:
+            logger.warning(f"Could not list Calibre plugins: {e}")
+            names = set()
+        _plugin_cache.update(checked_at=now, names=names)
+    return _plugin_cache["names"]
+
+
+def file_format(path: str) -> str:
+    """The format of a file by its content where that differs from the extension (KFX saved as .azw), else by extension."""
+    try:
+        with open(path, "rb") as f:
+            if filetypes.sniff_ebook_format(f.read(filetypes.SNIFF_BYTES)) == "KFX":
+                return "KFX"
+    except OSError:
+        pass
+    extension = os.path.splitext(path)[1][1:].upper()
+    return "KFX" if extension == "KFX-ZIP" else extension
+
+
+def check_conversion_available(input_file: str, output_file: str) -> None:
+    """
+    Raises:
+        ConversionUnavailable: If the input or output format needs a plugin that is not installed.
+    """
+    needed = [(file_format(input_file), 0, "read"), (os.path.splitext(output_file)[1][1:].upper(), 1, "write")]
+    for fmt, side, verb in needed:
+        if fmt in PLUGIN_FORMATS:
+            plugin = PLUGIN_FORMATS[fmt][side]
+            if plugin not in installed_plugin_names():
+                raise ConversionUnavailable(
+                    f"Conversion unavailable for {fmt}: Calibre needs the '{plugin}' plugin to {verb} {fmt} files. "
+                    f"Install it in Calibre (Preferences > Plugins) or with calibre-customize."
+                )
+
+
 def ebook_convert(
     input_file: str,
     output_file: str,
@@ -227,21 +567,36 @@ def ebook_convert(
         The path to the output_file if conversion is successful.
 
     Raises:
-        CalibreCLIError: If ebook-convert fails.
+        ConversionUnavailable: If a format needs a Calibre plugin that is not installed (KFX).
+        ConversionFailed: If ebook-convert fails.
+        CalibreTimeout, CommandCancelled: If ebook-convert times out or is cancelled.
         FileNotFoundError: If 'ebook-convert' executable or input_file is not found.
     """
     if not os.path.exists(input_file):
         raise FileNotFoundError(f"Input file not found: {input_file}")
+    check_conversion_available(input_file, output_file)
+
+    link_dir = None
+    if file_format(input_file) == "KFX" and not input_file.lower().endswith((".kfx", ".kfx-zip")):
+        # ebook-convert picks the input plugin by extension; KFX saved as .azw would be read as MOBI.
+        link_dir = tempfile.mkdtemp(prefix="shelfstone_server_kfx_")
+        kfx_path = os.path.join(link_dir, os.path.splitext(os.path.basename(input_file))[0] + ".kfx")
+        os.symlink(os.path.abspath(input_file), kfx_path)
+        input_file = kfx_path
 
     command = ['ebook-convert', input_file, output_file]
     if options:
         command.extend(options)
 
-    stdout, stderr, returncode = run_calibre_command(command, timeout=300) # Conversion can take time
+    try:
+        stdout, stderr, returncode = run_calibre_command(command, timeout=300) # Conversion can take time
+    finally:
+        if link_dir:
+            shutil.rmtree(link_dir, ignore_errors=True)
 
     if returncode != 0:
         # ebook-convert might output useful error messages to stdout or stderr
-        raise CalibreCLIError(
+        raise ConversionFailed(
             message=f"ebook-convert failed for {input_file} to {output_file}.",
             stdout=stdout,
             stderr=stderr,
@@ -250,7 +605,7 @@ def ebook_convert(
 
     # Check if output file was created (ebook-convert might not error but still fail to produce file)
     if not os.path.exists(output_file):
-        raise CalibreCLIError(
+        raise ConversionFailed(
             message=f"ebook-convert completed but output file {output_file} was not created.",
             stdout=stdout,
             stderr=stderr, # stderr might contain the reason
@@ -630,6 +985,58 @@ def fetch_ebook_metadata(
             os.remove(temp_opf_for_json)
 
 
+def fetch_news_recipe(
+    recipe: str,
+    output_file: str,
+    options: Optional[List[str]] = None,
+    timeout: int = 1800
+) -> str:
+    """
+    Downloads a news issue with `ebook-convert <recipe> <output_file>`.
+
+    Args:
+        recipe: Either the path to a .recipe file, or the title of one of Calibre's
+                built-in recipes (e.g. "The Guardian"), which ebook-convert resolves by name.
+        output_file: Path for the downloaded issue; its extension selects the output format.
+        options: Additional ebook-convert options (e.g., ["--username", "user", "--password", "pass"]).
+        timeout: Downloads fetch many pages, so the default timeout is much longer than for conversions.
+
+    Returns:
+        The path to the output_file.
+
+    Raises:
+        CalibreCLIError: If the download fails or produces no file.
+        FileNotFoundError: If 'ebook-convert' is not found.
+        ValueError: If the recipe starts with "-", which ebook-convert would take for an option.
+    """
+    if recipe.startswith("-"):
+        raise ValueError(f"Invalid recipe '{recipe}'.")
+    recipe_arg = recipe if recipe.endswith(".recipe") else f"{recipe}.recipe"
+    command = ['ebook-convert', recipe_arg, output_file]
+    if options:
+        command.extend(options)
+
+    stdout, stderr, returncode = run_calibre_command(command, timeout=timeout)
+
+    if returncode != 0:
+        raise CalibreCLIError(
+            message=f"ebook-convert failed to download news recipe '{recipe}'.",
+            stdout=stdout,
+            stderr=stderr,
+            returncode=returncode
+        )
+    if not os.path.exists(output_file):
+        raise CalibreCLIError(
+            message=f"ebook-convert completed but news issue {output_file} was not created.",
+            stdout=stdout,
+            stderr=stderr,
+            returncode=returncode
+        )
+
+    logger.info(f"Downloaded news recipe '{recipe}' to {output_file}")
+    return output_file
+
+
 def web2disk(
     url: str,
     output_recipe_file: str, # .recipe file
@@ -1197,10 +1604,10 @@ def send_email_with_calibre_smtp(
     recipient_email: str,
     subject: str,
     body: str,
-    attachment_path: Optional[str] = None,
     # SMTP server configuration - these would ideally come from secure config
     smtp_server: str, # e.g., "smtp.example.com"
     smtp_port: int,   # e.g., 587
+    attachment_path: Optional[str] = None,
     smtp_username: Optional[str] = None,
     smtp_password: Optional[str] = None, # Sensitive!
     smtp_encryption: str = 'tls', # 'tls', 'ssl', or 'none'
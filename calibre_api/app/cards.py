@@ -0,0 +1,160 @@
+"""
+Renders a book as a small, self-contained HTML "card" (cover, title, authors, blurb) for
+digest e-mails, webhook payloads and link previews. The markup sticks to what e-mail
+clients render reliably: table layout, inline styles, and the cover embedded as a data URI.
+"""
+import base64
+import html
+import io
+import logging
+import mimetypes
+import os
+import re
+import unicodedata
+from typing import Any, Dict, Optional
+
+from . import covers
+from .crud import as_list
+
+logger = logging.getLogger(__name__)
+
+CARD_COVER_SIZE = (240, 360)
+BLURB_MAX_CHARS = 300
+DEFAULT_ACCENT_COLOR = "#444444"
+
+_TAG_RE = re.compile(r"<[^>]+>")
+_SPACE_RE = re.compile(r"\s+")
+# Tags are replaced by spaces so block elements don't run together; this undoes the
+# stray space that leaves before punctuation following an inline element.
+_SPACE_BEFORE_PUNCT_RE = re.compile(r" ([,.;:!?…])")
+# Trailing punctuation dropped before the ellipsis, incl. CJK and Arabic commas and full stops.
+_CUT_PUNCT = ",.;:、，。；：،؛"
+# Cutting further back than this to reach a space loses too much text; CJK text has no spaces,
+# so it is cut between characters instead.
+_MIN_WORD_CUT = 0.8
+
+
+def plain_blurb(comments: Optional[str], max_chars: int = BLURB_MAX_CHARS) -> str:
+    """
+    Turns Calibre's HTML comments into a short plain-text blurb, cut at a word boundary
+    (or between characters for text without spaces), never inside a combining sequence
+    such as an Arabic letter and its vowel marks.
+    """
+    if not comments:
+        return ""
+    text = _SPACE_RE.sub(" ", html.unescape(_TAG_RE.sub(" ", comments))).strip()
+    text = _SPACE_BEFORE_PUNCT_RE.sub(r"\1", text)
+    if len(text) <= max_chars:
+        return text
+    end = max_chars
+    while end > 0 and unicodedata.combining(text[end]):
+        end -= 1
+    cut = text[:end]
+    space = cut.rfind(" ")
+    if space >= _MIN_WORD_CUT * end:
+        cut = cut[:space]
+    return cut.rstrip(_CUT_PUNCT + " ") + "…"
+
+
+def cover_data_uri(cover_path: Optional[str], max_size=CARD_COVER_SIZE) -> Optional[str]:
+    """
+    Returns the cover as a data: URI, downscaled to `max_size` as a JPEG when Pillow is available
+    (full-size covers would bloat e-mails). Returns None if the book has no readable cover.
+    """
+    if not cover_path or not os.path.isfile(cover_path):
+        return None
+    try:
+        from PIL import Image, UnidentifiedImageError
+    except ImportError:
+        Image = None
+    if Image is not None:
+        try:
+            with Image.open(cover_path) as img:
+                img = img.convert("RGB")
+                img.thumbnail(max_size)
+                buffer = io.BytesIO()
+                img.save(buffer, format="JPEG", quality=85)
+            return "data:image/jpeg;base64," + base64.b64encode(buffer.getvalue()).decode("ascii")
+        except (UnidentifiedImageError, OSError) as e:
+            logger.warning(f"Could not decode cover image {cover_path}: {e}")
+            return None
+    mime_type = mimetypes.guess_type(cover_path)[0] or "image/jpeg"
+    with open(cover_path, "rb") as f:
+        return f"data:{mime_type};base64," + base64.b64encode(f.read()).decode("ascii")
+
+
+def render_book_card_html(book: Dict[str, Any], cover_uri: Optional[str] = None,
+                          accent_color: Optional[str] = None) -> str:
+    """
+    Renders a complete HTML document for a book dict from `calibredb list`.
+    The head carries OpenGraph/Twitter tags so the card URL itself previews nicely when shared.
+    """
+    title = book.get("title") or "Untitled"
+    authors = ", ".join(as_list(book.get("authors"), "authors")) or "Unknown author"
+    blurb = plain_blurb(book.get("comments"))
+    series = book.get("series")
+    accent = accent_color or DEFAULT_ACCENT_COLOR
+    esc = html.escape
+
+    meta = [
+        ("og:type", "book"),
+        ("og:title", title),
+        ("og:description", blurb or f"by {authors}"),
+        ("twitter:card", "summary"),
+        ("twitter:title", title),
+    ]
+    if cover_uri:
+        # Data URIs are ignored by most crawlers, but keep the tag so embedding clients can use it.
+        meta.append(("og:image", cover_uri))
+    meta_tags = "\n".join(f'<meta property="{esc(k)}" content="{esc(v)}">' for k, v in meta)
+
+    cover_cell = ""
+    if cover_uri:
+        cover_cell = (
+            f'<td width="120" valign="top" style="padding:0 16px 0 0;">'
+            f'<img src="{cover_uri}" alt="{esc(title)}" width="120" '
+            f'style="display:block;width:120px;height:auto;border:0;"></td>'
+        )
+    series_line = ""
+    if series:
+        index = book.get("series_index")
+        series_text = f"{series} #{index:g}" if isinstance(index, (int, float)) else series
+        series_line = f'<p dir="auto" style="margin:0 0 8px 0;font-size:13px;color:#777777;">{esc(series_text)}</p>'
+    # dir="auto": Arabic and Hebrew titles and blurbs run right to left, with the ellipsis on the left.
+    blurb_line = f'<p dir="auto" style="margin:0;font-size:14px;line-height:1.4;color:#333333;">{esc(blurb)}</p>' if blurb else ""
+
+    return f"""<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{esc(title)}</title>
+{meta_tags}
+</head>
+<body style="margin:0;padding:0;">
+<table role="presentation" cellpadding="0" cellspacing="0" border="0" width="100%" style="max-width:560px;font-family:Georgia,serif;border-left:4px solid {esc(accent)};">
+<tr>
+<td style="padding:16px;">
+<table role="presentation" cellpadding="0" cellspacing="0" border="0" width="100%">
+<tr>
+{cover_cell}<td valign="top">
+<h1 dir="auto" style="margin:0 0 4px 0;font-size:20px;color:#111111;">{esc(title)}</h1>
+<p dir="auto" style="margin:0 0 8px 0;font-size:15px;color:#555555;">{esc(authors)}</p>
+{series_line}{blurb_line}
+</td>
+</tr>
+</table>
+</td>
+</tr>
+</table>
+</body>
+</html>
+"""
+
+
+def render_card_for_book(book: Dict[str, Any]) -> str:
+    """
+    Renders the card for a book dict, embedding its cover and using its dominant cover color as accent.
+    """
+    cover_path = book.get("cover")
+    palette = covers.try_extract_palette(cover_path, colors=1)
+    return render_book_card_html(book, cover_uri=cover_data_uri(cover_path), accent_color=(palette or [None])[0])
@@ -0,0 +1,340 @@
+"""
+Server settings from a TOML file and environment variables.
+
+Every setting is an environment variable (see README, Configuration). A config file can set the
+same settings with the variable name in lower case and without the SHELFSTONE_ prefix:
+
+    port = 8080
+    log_level = "debug"
+    calibre_library_path = "/srv/Calibre Library"
+    calibre_bin_dir = "/opt/calibre"
+    conversion_cache_days = 14
+
+The file is SHELFSTONE_CONFIG, or else ./shelfstone.toml or ~/.shelfstone/config.toml if one
+exists. Environment variables take precedence over the file. load() copies the file's values
+into os.environ, so modules keep reading their variables when they need them (and tests can
+keep patching os.environ).
+
+SIGHUP (or POST /admin/config/reload) re-reads the file while the server runs, see reload().
+Settings that are read when they are used (most of them) take effect right away, the log level
+is adjusted, and settings only read at startup (RESTART_SETTINGS) are reported as needing a
+restart. Running conversions and indexing are not interrupted.
+"""
+import logging
+import os
+import signal
+import sys
+import threading
+from typing import Any, Callable, Dict, List, Mapping, NamedTuple, Optional
+
+if sys.version_info >= (3, 11):
+    import tomllib
+else:
+    import tomli as tomllib
+
+from . import accounts
+from . import bundles
+from . import calibre_cli
+from . import conversion_policy
+from . import delivery
+from . import features
+from . import lifecycle
+from . import limits
+from . import metadata_providers
+from . import opds_i18n
+from . import opds_throttle
+
+logger = logging.getLogger(__name__)
+
+PREFIX = "SHELFSTONE_"
+DEFAULT_PATHS = ["shelfstone.toml", os.path.join(os.path.expanduser("~"), ".shelfstone", "config.toml")]
+LOG_LEVELS = ["CRITICAL", "ERROR", "WARNING", "INFO", "DEBUG"]
+
+
+class ConfigError(Exception):
+    """The config file can't be read or settings are invalid. args[0] lists all problems."""
+
+
+def _non_negative(parse: Callable[[str], Any]) -> Callable[[str], Any]:
+    def check(value: str) -> Any:
+        number = parse(value)
+        if number < 0:
+            raise ValueError("must not be negative")
+        return number
+    return check
+
+
+def _port(value: str) -> int:
+    port = int(value)
+    if not 0 < port < 65536:
+        raise ValueError("must be between 1 and 65535")
+    return port
+
+
+def _log_level(value: str) -> str:
+    if value.upper() not in LOG_LEVELS:
+        raise ValueError(f"must be one of {', '.join(LOG_LEVELS)}")
+    return value.upper()
+
+
+def _directory(value: str) -> str:
+    if not os.path.isdir(value):
+        raise ValueError("is not a directory")
+    return value
+
+
+def _library(value: str) -> str:
+    if not os.path.isfile(os.path.join(value, "metadata.db")):
+        raise ValueError("contains no metadata.db")
+    return value
+
+
+def _text(value: str) -> str:
+    return value
+
+
+class Setting(NamedTuple):
+    variable: str
+    default: Optional[str]
+    # Raises ValueError (with a reason) for invalid values.
+    parse: Callable[[str], Any]
+
+
+SETTINGS: List[Setting] = [
+    Setting("SHELFSTONE_HOST", "0.0.0.0", _text),
+    Setting("SHELFSTONE_PORT", "6336", _port),
+    Setting("SHELFSTONE_SOCKET", None, _text),
+    Setting("SHELFSTONE_PUBLIC_HOST", "0.0.0.0", _text),
+    Setting("SHELFSTONE_PUBLIC_PORT", None, _port),
+    Setting("SHELFSTONE_PUBLIC_SOCKET", None, _text),
+    Setting("SHELFSTONE_PUBLIC_CORS_ORIGINS", None, _text),
+    Setting("SHELFSTONE_PUBLIC_CONVERSION", None, _text),
+    Setting("SHELFSTONE_LOG_LEVEL", "INFO", _log_level),
+    Setting("SHELFSTONE_SHUTDOWN_TIMEOUT", str(lifecycle.DEFAULT_SHUTDOWN_TIMEOUT), _non_negative(float)),
+    Setting("SHELFSTONE_CALIBRE_BIN_DIR", None, _directory),
+    Setting("CALIBRE_LIBRARY_PATH", None, _library),
+    Setting("SHELFSTONE_MAX_BODY_MB", "512", _non_negative(float)),
+    Setting("SHELFSTONE_BODY_LIMITS_MB", None, limits.parse_route_limits),
+    Setting("SHELFSTONE_CLI_MAX_ATTEMPTS", "3", _non_negative(int)),
+    Setting("SHELFSTONE_CLI_RETRY_BASE_DELAY", "0.5", _non_negative(float)),
+    Setting("SHELFSTONE_CLI_TIMEOUTS", None, calibre_cli.parse_timeouts),
+    Setting("SHELFSTONE_CLI_MAX_CONCURRENT", str(calibre_cli.DEFAULT_MAX_CONCURRENT), _non_negative(int)),
+    Setting("SHELFSTONE_CLI_AGING_SECONDS", str(calibre_cli.DEFAULT_AGING_SECONDS), _non_negative(float)),
+    Setting("SHELFSTONE_TEMP_RETENTION_HOURS", "24", _non_negative(float)),
+    Setting("SHELFSTONE_UPLOAD_RETENTION_HOURS", "48", _non_negative(float)),
+    Setting("SHELFSTONE_STATE_DIR", None, _text),
+    Setting("SHELFSTONE_CONVERSION_CACHE", None, _text),
+    Setting("SHELFSTONE_CONVERSION_CACHE_DAYS", "30", _non_negative(float)),
+    Setting("SHELFSTONE_CONVERT_ON_ADD", None, conversion_policy.parse_formats),
+    Setting("SHELFSTONE_THUMBNAIL_CACHE", None, _text),
+    Setting("SHELFSTONE_THUMBNAIL_CACHE_DAYS", "30", _non_negative(float)),
+    Setting("SHELFSTONE_NEWS_RETENTION_DAYS", "0", _non_negative(float)),
+    Setting("SHELFSTONE_FTS_DB", None, _text),
+    Setting("SHELFSTONE_FTS_MAX_CHARS", "2000000", _non_negative(int)),
+    Setting("SHELFSTONE_LOG_BUFFER_SIZE", "1000", _non_negative(int)),
+    Setting("SHELFSTONE_BUNDLE_MAX_BOOKS", str(bundles.DEFAULT_MAX_BOOKS), _non_negative(int)),
+    Setting("SHELFSTONE_PUBLIC_URL", None, _text),
+    Setting("SHELFSTONE_OPDS_LOCALE", None, opds_i18n.parse_locale),
+    Setting("SHELFSTONE_OPDS_CONCURRENCY", str(opds_throttle.DEFAULT_CONCURRENCY), _non_negative(int)),
+    Setting("SHELFSTONE_OPDS_RATE", str(opds_throttle.DEFAULT_RATE), _non_negative(int)),
+    Setting("SHELFSTONE_EXCHANGE_RATES", None, _text),
+    Setting("SHELFSTONE_LOAN_DAYS", "28", _non_negative(float)),
+    Setting("SHELFSTONE_ADMIN_TOKEN", None, _text),
+    Setting("SHELFSTONE_ACCOUNTS", None, _text),
+    Setting("SHELFSTONE_OPEN_REGISTRATION", None, _text),
+    Setting("SHELFSTONE_DELETED_USER_UPLOADS", accounts.REASSIGN, accounts.parse_upload_handling),
+    Setting("SHELFSTONE_ENABLE_SQL_QUERY", None, _text),
+    Setting("SHELFSTONE_ENABLE_CUSTOM_RECIPES", None, _text),
+    Setting("SHELFSTONE_ENABLE_ADMIN_LOGS", None, _text),
+    Setting("SHELFSTONE_SMTP_HOST", None, _text),
+    Setting("SHELFSTONE_SMTP_PORT", str(delivery.DEFAULT_SMTP_PORT), _port),
+    Setting("SHELFSTONE_SMTP_USERNAME", None, _text),
+    Setting("SHELFSTONE_SMTP_PASSWORD", None, _text),
+    Setting("SHELFSTONE_SMTP_ENCRYPTION", delivery.DEFAULT_ENCRYPTION, delivery.parse_encryption),
+    Setting("SHELFSTONE_SMTP_FROM", None, _text),
+    Setting("SHELFSTONE_SEND_DEVICES", None, delivery.parse_devices),
+    Setting("SHELFSTONE_METADATA_PROVIDERS", metadata_providers.DEFAULT_PROVIDERS, metadata_providers.parse_providers),
+    Setting("SHELFSTONE_METADATA_TIMEOUT", str(metadata_providers.DEFAULT_TIMEOUT), _non_negative(float)),
+    Setting("SHELFSTONE_GOOGLE_BOOKS_API_KEY", None, _text),
+    Setting("SHELFSTONE_FEATURES", None, features.parse_flags),
+    Setting("SHELFSTONE_EXPERIMENTAL", None, features.parse_experimental),
+    Setting("SHELFSTONE_SETTINGS_DB", None, _text),
+    Setting("SHELFSTONE_COLLECTIONS_DB", None, _text),
+    Setting("SHELFSTONE_PROVENANCE_DB", None, _text),
+    Setting("SHELFSTONE_PROCESSING_LOG_DB", None, _text),
+    Setting("SHELFSTONE_ACCOUNTS_DB", None, _text),
+    Setting("SHELFSTONE_READING_DB", None, _text),
+    Setting("SHELFSTONE_KOSYNC_DB", None, _text),
+    Setting("SHELFSTONE_DOWNLOAD_LOG_DB", None, _text),
+    Setting("SHELFSTONE_RATINGS_DB", None, _text),
+    Setting("SHELFSTONE_WISHLIST_DB", None, _text),
+    Setting("SHELFSTONE_PREFERENCES_DB", None, _text),
+    Setting("SHELFSTONE_PASSWORD_RESET_DB", None, _text),
+    Setting("SHELFSTONE_NOTIFICATIONS_DB", None, _text),
+    Setting("SHELFSTONE_FOLLOWS_DB", None, _text),
+    Setting("SHELFSTONE_BOOK_CLUBS_DB", None, _text),
+    Setting("SHELFSTONE_BOOK_COMMENTS_DB", None, _text),
+    Setting("SHELFSTONE_REACTIONS_DB", None, _text),
+    Setting("SHELFSTONE_PRIVACY_DB", None, _text),
+]
+_BY_VARIABLE = {s.variable: s for s in SETTINGS}
+# Settings only read when the server starts: listeners and their middleware, the log buffer,
+# limits built into the routes' parameters.
+RESTART_SETTINGS = {
+    "SHELFSTONE_HOST", "SHELFSTONE_PORT", "SHELFSTONE_SOCKET", "SHELFSTONE_PUBLIC_HOST", "SHELFSTONE_PUBLIC_PORT",
+    "SHELFSTONE_PUBLIC_SOCKET", "SHELFSTONE_PUBLIC_CORS_ORIGINS", "SHELFSTONE_LOG_BUFFER_SIZE", "SHELFSTONE_SHUTDOWN_TIMEOUT",
+    "SHELFSTONE_BUNDLE_MAX_BOOKS",
+}
+# Values load() (or the last reload()) took from the config file, so a reload can tell them
+# from variables set in the environment, which keep precedence.
+_file_values: Dict[str, str] = {}
+
+
+def file_key(variable: str) -> str:
+    """Name of a setting in the config file: SHELFSTONE_LOG_LEVEL -> log_level."""
+    return (variable[len(PREFIX):] if variable.startswith(PREFIX) else variable).lower()
+
+
+def find_config_file(environ: Optional[Mapping[str, str]] = None) -> Optional[str]:
+    environ = os.environ if environ is None else environ
+    if environ.get("SHELFSTONE_CONFIG"):
+        return environ["SHELFSTONE_CONFIG"]
+    return next((path for path in DEFAULT_PATHS if os.path.isfile(path)), None)
+
+
+def read_config_file(path: str) -> Dict[str, str]:
+    """
+    Reads a config file into {variable: value}.
+
+    Raises:
+        ConfigError: If the file can't be read or parsed, or has unknown keys.
+    """
+    try:
+        with open(path, "rb") as f:
+            data = tomllib.load(f)
+    except OSError as e:
+        raise ConfigError(f"Cannot read config file '{path}': {e}")
+    except tomllib.TOMLDecodeError as e:
+        raise ConfigError(f"Invalid TOML in config file '{path}': {e}")
+
+    keys = {file_key(s.variable): s.variable for s in SETTINGS}
+    unknown = sorted(k for k in data if k not in keys)
+    if unknown:
+        raise ConfigError(f"Unknown setting(s) in '{path}': {', '.join(unknown)}. Known: {', '.join(sorted(keys))}.")
+    values = {}
+    for key, value in data.items():
+        if isinstance(value, bool):
+            value = "1" if value else "0"
+        elif isinstance(value, (dict, list)):
+            raise ConfigError(f"Setting '{key}' in '{path}' must be a single value.")
+        values[keys[key]] = str(value)
+    return values
+
+
+def validate(environ: Optional[Mapping[str, str]] = None) -> Dict[str, str]:
+    """Returns {variable: reason} for every set but invalid setting."""
+    environ = os.environ if environ is None else environ
+    problems = {}
+    for setting in SETTINGS:
+        value = environ.get(setting.variable)
+        if value is None or value.strip() == "":
+            continue
+        try:
+            setting.parse(value)
+        except ValueError as e:
+            problems[setting.variable] = f"Invalid value {value!r}: {e}"
+    return problems
+
+
+def load(environ: Optional[Dict[str, str]] = None) -> Optional[str]:
+    """
+    Applies the config file (if any) to the environment and validates all settings.
+    Returns the path of the file used.
+
+    Raises:
+        ConfigError: If the file is invalid or any setting has an invalid value.
+    """
+    environ = os.environ if environ is None else environ
+    path = find_config_file(environ)
+    if path:
+        for variable, value in read_config_file(path).items():
+            if variable not in environ:
+                environ[variable] = value
+                _file_values[variable] = value
+    problems = validate(environ)
+    if problems:
+        raise ConfigError("Invalid configuration: " + "; ".join(f"{k}: {v}" for k, v in problems.items()))
+    return path
+
+
+def _apply_log_level(level: str) -> None:
+    for name in ("", "uvicorn", "uvicorn.error", "uvicorn.access"):
+        logging.getLogger(name).setLevel(level.upper())
+
+
+def reload(environ: Optional[Dict[str, str]] = None) -> Dict[str, Any]:
+    """
+    Re-reads the config file and applies the values that changed. Variables set in the
+    environment (rather than taken from the file) keep precedence and are never changed.
+
+    Returns:
+        {"path", "changed": [variables], "restart_required": [changed variables only read at startup]}
+
+    Raises:
+        ConfigError: If the file is invalid or a new value is invalid. Nothing is changed then.
+    """
+    environ = os.environ if environ is None else environ
+    path = find_config_file(environ)
+    new_values = read_config_file(path) if path else {}
+    # Variables whose current value came from the file; all others were set in the environment.
+    from_file = {v for v, value in _file_values.items() if environ.get(v) == value}
+    candidate = {k: v for k, v in environ.items() if k not in from_file}
+    applied = {}
+    for variable, value in new_values.items():
+        if variable not in candidate:
+            candidate[variable] = value
+            applied[variable] = value
+    problems = validate(candidate)
+    if problems:
+        raise ConfigError("Invalid configuration: " + "; ".join(f"{k}: {v}" for k, v in problems.items()))
+
+    changed = sorted(v for v in _BY_VARIABLE if environ.get(v) != candidate.get(v))
+    for variable in changed:
+        if variable in candidate:
+            environ[variable] = candidate[variable]
+        else:
+            environ.pop(variable, None)
+    _file_values.clear()
+    _file_values.update(applied)
+    if "SHELFSTONE_LOG_LEVEL" in changed:
+        _apply_log_level(get("SHELFSTONE_LOG_LEVEL", environ))
+    return {"path": path, "changed": changed, "restart_required": [v for v in changed if v in RESTART_SETTINGS]}
+
+
+def handle_reload_signal(signum: Optional[int] = None, frame: Any = None) -> None:
+    """SIGHUP handler: reloads the configuration and logs what changed. Invalid files are logged and ignored."""
+    try:
+        result = reload()
+    except ConfigError as e:
+        logger.error(f"Configuration not reloaded, keeping the current settings. {e}")
+        return
+    if not result["changed"]:
+        logger.warning(f"Configuration reloaded from {result['path'] or 'the environment'}: nothing changed.")
+        return
+    logger.warning(f"Configuration reloaded from {result['path'] or 'the environment'}. Changed: {', '.join(result['changed'])}.")
+    if result["restart_required"]:
+        logger.warning(f"Restart the server to apply: {', '.join(result['restart_required'])}.")
+
+
+def install_reload_handler() -> bool:
+    """Reloads the configuration on SIGHUP. Only possible in the main thread and where SIGHUP exists."""
+    if not hasattr(signal, "SIGHUP") or threading.current_thread() is not threading.main_thread():
+        return False
+    signal.signal(signal.SIGHUP, handle_reload_signal)
+    return True
+
+
+def get(variable: str, environ: Optional[Mapping[str, str]] = None) -> Optional[str]:
+    """The setting's value, or its default if unset."""
+    environ = os.environ if environ is None else environ
+    return environ.get(variable) or _BY_VARIABLE[variable].default
@@ -0,0 +1,110 @@
+"""
+Cache of converted book files for GET /books/{id}/download?format=..., so a reading app that
+asks for the same AZW3 or EPUB again doesn't wait for `ebook-convert` every time.
+
+Entries are keyed on the source file's path, size and modification time: editing or replacing
+the source gives a new key, and the outdated entry expires through the janitor
+(SHELFSTONE_CONVERSION_CACHE_DAYS). The cache lives outside the Calibre library.
+"""
+import hashlib
+import os
+import tempfile
+import threading
+import logging
+from typing import Any, Callable, Dict, Optional
+
+from . import calibre_cli
+from . import formats as format_registry
+from . import state_store
+
+logger = logging.getLogger(__name__)
+
+OUTPUT_FORMATS = format_registry.output_formats()
+# Best sources first: reflowable formats convert far better than PDF.
+SOURCE_PREFERENCE = ["EPUB", "AZW3", "MOBI", "KEPUB", "DOCX", "FB2", "FBZ", "HTMLZ", "ODT", "RTF", "TXT", "PDF", "DJVU"]
+
+_locks_guard = threading.Lock()
+_locks: Dict[str, threading.Lock] = {}
+
+
+def cache_dir() -> str:
+    return state_store.state_path("SHELFSTONE_CONVERSION_CACHE", "conversions")
+
+
+def book_formats(book: Dict[str, Any]) -> Dict[str, str]:
+    """{FORMAT: path} of the book's files, from the full paths `calibredb list` reports."""
+    formats = book.get("formats") or []
+    if isinstance(formats, str):
+        formats = [f.strip() for f in formats.split(",") if f.strip()]
+    return {os.path.splitext(p)[1][1:].upper(): p for p in formats if os.path.isabs(p)}
+
+
+def pick_source(formats: Dict[str, str]) -> Optional[str]:
+    for fmt in SOURCE_PREFERENCE:
+        if fmt in formats:
+            return formats[fmt]
+    return next(iter(formats.values()), None)
+
+
+def cache_path(book_id: int, source_path: str, target_format: str) -> str:
+    stat = os.stat(source_path)
+    digest = hashlib.sha256(f"{os.path.abspath(source_path)}|{stat.st_size}|{stat.st_mtime_ns}".encode("utf-8")).hexdigest()
+    return os.path.join(cache_dir(), f"{book_id}_{digest[:16]}.{target_format.lower()}")
+
+
+def remove_book_entries(book_id: int) -> int:
+    """Removes all cached conversions of a book, e.g. after it was deleted. Returns the number removed."""
+    return remove_entries(cache_dir(), f"{book_id}_")
+
+
+def remove_entries(root: str, prefix: str) -> int:
+    if not os.path.isdir(root):
+        return 0
+    removed = 0
+    for name in os.listdir(root):
+        if name.startswith(prefix):
+            try:
+                os.remove(os.path.join(root, name))
+                removed += 1
+            except OSError as e:
+                logger.warning(f"Could not remove cache entry {name}: {e}")
+    return removed
+
+
+def _lock_for(path: str) -> threading.Lock:
+    with _locks_guard:
+        return _locks.setdefault(path, threading.Lock())
+
+
+def get_or_convert(book_id: int, source_path: str, target_format: str,
+                   convert: Callable[[str, str], Any] = calibre_cli.ebook_convert) -> Dict[str, Any]:
+    """
+    Returns {"path", "cached"}: the converted file, taken from the cache or converted now.
+    Concurrent requests for the same conversion wait for the first instead of converting twice.
+
+    Raises:
+        ValueError: If the target format is not supported.
+        CalibreCLIError: If the conversion fails.
+        FileNotFoundError: If ebook-convert or the source file is not found.
+    """
+    target_format = target_format.upper()
+    if target_format not in OUTPUT_FORMATS:
+        raise ValueError(f"Cannot convert to '{target_format}'. Supported formats: {', '.join(sorted(OUTPUT_FORMATS))}.")
+    path = cache_path(book_id, source_path, target_format)
+    with _lock_for(path):
+        if os.path.isfile(path):
+            os.utime(path)  # Recently used entries are kept by the janitor.
+            return {"path": path, "cached": True}
+        os.makedirs(cache_dir(), exist_ok=True)
+        # Convert next to the final path and rename, so a failed or interrupted conversion
+        # never leaves a truncated file in the cache.
+        fd, partial = tempfile.mkstemp(prefix=".partial_", suffix=f".{target_format.lower()}", dir=cache_dir())
+        os.close(fd)
+        try:
+            logger.info(f"Converting book ID {book_id} from {source_path} to {target_format}.")
+            convert(source_path, partial)
+            os.replace(partial, path)
+        finally:
+            if os.path.exists(partial):
+                os.remove(partial)
+    return {"path": path, "cached": False}
@@ -0,0 +1,195 @@
+"""
+Automatic conversion of newly added books, so every book in the library has the formats the
+household's readers need (e.g. EPUB for Kobo and AZW3 for Kindle) without converting on demand.
+
+The policy is SHELFSTONE_CONVERT_ON_ADD, a comma-separated list of target formats ("epub,azw3").
+Books added through the server (uploads, packages, folder scans, new formats of existing books)
+are queued after ingestion and converted one job at a time by a background worker: each missing
+target format is converted from the book's best format with ebook-convert (through the conversion
+cache, see conversion_cache) and stored in the library as another format with
+`calibredb add_format`. Formats the book already has are skipped. Job status is kept in memory for
+the most recent books. The user who added the book, if known, gets a notification when its job
+finishes (see notifications).
+"""
+import logging
+import os
+import queue
+import threading
+import time
+from collections import OrderedDict
+from typing import Any, Callable, Dict, List, Optional
+
+from . import conversion_cache
+from . import features
+from . import lifecycle
+from . import notifications
+from . import processing_log
+from .calibre_cli import CalibreCLIError
+from .crud import CalibredbError, add_format, list_books
+
+logger = logging.getLogger(__name__)
+
+RECENT_JOBS_LIMIT = 500
+
+# Job status, and status of each target format within a job.
+QUEUED, RUNNING, DONE, FAILED = "queued", "running", "done", "failed"
+PENDING, CONVERTED, SKIPPED = "pending", "converted", "skipped"
+
+
+def parse_formats(value: Optional[str]) -> List[str]:
+    """
+    Parses "epub,azw3" into ["EPUB", "AZW3"].
+
+    Raises:
+        ValueError: If a format can't be converted to.
+    """
+    formats: List[str] = []
+    for entry in (value or "").split(","):
+        fmt = entry.strip().upper().lstrip(".")
+        if not fmt:
+            continue
+        if fmt not in conversion_cache.OUTPUT_FORMATS:
+            raise ValueError(f"books can't be converted to '{fmt}'")
+        if fmt not in formats:
+            formats.append(fmt)
+    return formats
+
+
+def target_formats() -> List[str]:
+    return parse_formats(os.environ.get("SHELFSTONE_CONVERT_ON_ADD"))
+
+
+# --- Job tracking ---
+
+_lock = threading.Lock()
+_jobs: "OrderedDict[int, Dict[str, Any]]" = OrderedDict()
+_queue: "queue.Queue[Dict[str, Any]]" = queue.Queue()
+_worker: Optional[threading.Thread] = None
+
+
+def _update(job: Dict[str, Any], **changes) -> None:
+    with _lock:
+        job.update(changes)
+
+
+def _copy(job: Dict[str, Any]) -> Dict[str, Any]:
+    return {**job, "formats": [dict(f) for f in job["formats"]]}
+
+
+def get_job(book_id: int) -> Optional[Dict[str, Any]]:
+    """The latest conversion job of the book, or None if none ran since the server started."""
+    with _lock:
+        job = _jobs.get(book_id)
+        return _copy(job) if job else None
+
+
+def recent_jobs() -> List[Dict[str, Any]]:
+    """The most recent jobs, newest first."""
+    with _lock:
+        return [_copy(j) for j in reversed(_jobs.values())]
+
+
+def reset() -> None:
+    """Forgets all jobs (used by tests)."""
+    with _lock:
+        _jobs.clear()
+
+
+def _notify(job: Dict[str, Any], title: Optional[str]) -> None:
+    name = f"'{title}'" if title else f"book ID {job['book_id']}"
+    converted = [entry["format"] for entry in job["formats"] if entry["status"] == CONVERTED]
+    if job["status"] == DONE:
+        if converted:
+            notifications.notify(job.get("user_id"), notifications.CONVERSION_DONE,
+                                 f"Converted {name} to {', '.join(converted)}", book_id=job["book_id"],
+                                 library_path=job["library_path"])
+        return
+    errors = [f"{entry['format']}: {entry['error']}" for entry in job["formats"] if entry["status"] == FAILED]
+    notifications.notify(job.get("user_id"), notifications.CONVERSION_FAILED, f"Converting {name} failed",
+                         "; ".join(errors) or job["error"], book_id=job["book_id"], library_path=job["library_path"])
+
+
+def run_job(job: Dict[str, Any], convert: Callable[..., Dict[str, Any]] = conversion_cache.get_or_convert,
+            add: Callable[..., None] = add_format) -> None:
+    """
+    Converts the book to the job's missing formats and adds them to the library, recording progress
+    on the job, then notifies the user who queued it.
+    """
+    _update(job, status=RUNNING, started_at=time.time())
+    book = None
+    try:
+        books = list_books(library_path=job["library_path"], search_query=f"id:{job['book_id']}")
+        book = next((b for b in books if b.get("id") == job["book_id"]), None)
+        if book is None:
+            raise ValueError(f"Book ID {job['book_id']} not found.")
+        formats = {fmt: path for fmt, path in conversion_cache.book_formats(book).items() if os.path.isfile(path)}
+        if not formats:
+            raise ValueError(f"Book ID {job['book_id']} has no files.")
+        source = conversion_cache.pick_source(formats)
+        for entry in job["formats"]:
+            if entry["format"] in formats:
+                _update(entry, status=SKIPPED)
+                continue
+            try:
+                with processing_log.step(f"convert to {entry['format']} on add", [job["book_id"]], job["library_path"]):
+                    converted = convert(job["book_id"], source, entry["format"])["path"]
+                    add(job["book_id"], converted, library_path=job["library_path"])
+                _update(entry, status=CONVERTED)
+                logger.info(f"Converted book ID {job['book_id']} to {entry['format']} and added it to the library.")
+            except (CalibreCLIError, CalibredbError, ValueError, OSError) as e:
+                logger.warning(f"Converting book ID {job['book_id']} to {entry['format']} failed: {e}")
+                _update(entry, status=FAILED, error=e.args[0] if e.args else str(e))
+        failed = any(entry["status"] == FAILED for entry in job["formats"])
+        _update(job, status=FAILED if failed else DONE, finished_at=time.time())
+    except Exception as e:
+        logger.error(f"Conversion job of book ID {job['book_id']} failed: {e}", exc_info=True)
+        _update(job, status=FAILED, error=e.args[0] if e.args else str(e), finished_at=time.time())
+    _notify(job, book.get("title") if book else None)
+
+
+def _work() -> None:
+    while True:
+        job = _queue.get()
+        if lifecycle.shutting_down():
+            _update(job, status=FAILED, error="The server shut down before the conversion started.", finished_at=time.time())
+        else:
+            with lifecycle.job(f"conversion of book ID {job['book_id']}", lifecycle.BULK, job["user_id"]):
+                run_job(job)
+        _queue.task_done()
+
+
+def enqueue(book_ids: List[int], library_path: Optional[str] = None, user_id: Optional[int] = None) -> List[Dict[str, Any]]:
+    """
+    Queues conversion of the books to the policy's formats and returns the new jobs. Nothing is
+    queued without a policy, while the conversion feature is off, or for books already queued.
+    `user_id` is who added the books, to be notified when their jobs finish.
+    """
+    formats = target_formats()
+    if not formats or not book_ids:
+        return []
+    if not features.is_enabled("conversion"):
+        logger.info(f"Not converting book(s) {book_ids} to {formats}: the conversion feature is disabled.")
+        return []
+    global _worker
+    jobs = []
+    with _lock:
+        for book_id in book_ids:
+            existing = _jobs.get(book_id)
+            if existing and existing["status"] == QUEUED:
+                continue
+            job = {"book_id": book_id, "library_path": library_path, "user_id": user_id, "status": QUEUED, "error": None,
+                   "formats": [{"format": fmt, "status": PENDING, "error": None} for fmt in formats],
+                   "created_at": time.time(), "started_at": None, "finished_at": None}
+            _jobs.pop(book_id, None)
+            _jobs[book_id] = job
+            while len(_jobs) > RECENT_JOBS_LIMIT:
+                _jobs.popitem(last=False)
+            jobs.append(job)
+        if jobs and (_worker is None or not _worker.is_alive()):
+            _worker = threading.Thread(target=_work, name="convert-on-add", daemon=True)
+            _worker.start()
+    for job in jobs:
+        _queue.put(job)
+    if jobs:
+        logger.info(f"Queued conversion of book(s) {[j['book_id'] for j in jobs]} to {', '.join(formats)}.")
+    return [_copy(j) for j in jobs]
@@ -0,0 +1,91 @@
+import os
+import logging
+import threading
+from collections import OrderedDict
+from typing import List, Optional, Tuple
+
+logger = logging.getLogger(__name__)
+
+# Covers are downscaled before quantizing; the palette of a 64x64 thumbnail is
+# indistinguishable from the full image and keeps extraction in the millisecond range.
+PALETTE_SAMPLE_SIZE = (64, 64)
+DEFAULT_PALETTE_SIZE = 5
+# Palettes kept in memory; the least recently used are dropped beyond this.
+PALETTE_CACHE_SIZE = 2048
+
+# LRU cache keyed by (cover_path, mtime, colors) so an updated cover is re-analysed
+# without needing any explicit invalidation from the endpoints. Endpoints run in a threadpool,
+# so every access to the cache holds _palette_lock; extraction itself runs without it.
+_palette_cache: "OrderedDict[Tuple[str, float, int], List[str]]" = OrderedDict()
+_palette_lock = threading.Lock()
+
+
+def extract_palette(cover_path: str, colors: int = DEFAULT_PALETTE_SIZE) -> List[str]:
+    """
+    Extracts the dominant colors of a cover image.
+
+    Args:
+        cover_path: Path to the cover image (as reported by `calibredb list` in the `cover` field).
+        colors: Maximum number of colors to return.
+
+    Returns:
+        A list of hex color strings (e.g. "#1a2b3c"), most dominant first.
+
+    Raises:
+        FileNotFoundError: If the cover image does not exist.
+        ValueError: If `colors` is not positive or the image cannot be decoded.
+    """
+    if colors <= 0:
+        raise ValueError("Number of palette colors must be a positive integer.")
+    if not cover_path or not os.path.exists(cover_path):
+        raise FileNotFoundError(f"Cover image not found: {cover_path}")
+
+    cache_key = (cover_path, os.path.getmtime(cover_path), colors)
+    with _palette_lock:
+        if cache_key in _palette_cache:
+            _palette_cache.move_to_end(cache_key)
+            return _palette_cache[cache_key]
+
+    # Imported lazily so the rest of the API keeps working if Pillow is missing.
+    from PIL import Image, UnidentifiedImageError
+
+    try:
+        with Image.open(cover_path) as img:
+            img = img.convert("RGB")
+            img.thumbnail(PALETTE_SAMPLE_SIZE)
+            quantized = img.quantize(colors=colors)
+            palette = quantized.getpalette() or []
+            # getcolors returns (count, palette_index) pairs; sort by count to rank dominance.
+            color_counts = sorted(quantized.getcolors() or [], reverse=True)
+    except (UnidentifiedImageError, OSError) as e:
+        raise ValueError(f"Could not decode cover image {cover_path}: {e}")
+
+    hex_colors: List[str] = []
+    for _, index in color_counts:
+        r, g, b = palette[index * 3:index * 3 + 3]
+        hex_color = f"#{r:02x}{g:02x}{b:02x}"
+        if hex_color not in hex_colors:
+            hex_colors.append(hex_color)
+
+    with _palette_lock:
+        _palette_cache[cache_key] = hex_colors
+        while len(_palette_cache) > PALETTE_CACHE_SIZE:
+            _palette_cache.popitem(last=False)
+    return hex_colors
+
+
+def try_extract_palette(cover_path: Optional[str], colors: int = DEFAULT_PALETTE_SIZE) -> Optional[List[str]]:
+    """
+    Like `extract_palette`, but returns None instead of raising.
+    Used when decorating book listings, where one unreadable cover must not fail the whole response.
+    """
+    if not cover_path:
+        return None
+    try:
+        return extract_palette(cover_path, colors=colors)
+    except ImportError:
+        logger.warning("Pillow is not installed; cover palette extraction is unavailable.")
+        return None
+    except (FileNotFoundError, ValueError) as e:
+        logger.warning(f"Could not extract palette for cover '{cover_path}': {e}")
+        return None
@@ -1,9 +1,10 @@
+import contextvars
 import json
 import os
 from typing import List, Dict, Optional, Any
 
 # Use the centralized CalibreCLIError and run_calibre_command
-from .calibre_cli import CalibreCLIError, run_calibre_command
+from .calibre_cli import CalibreCLIError, run_calibre_command, resolve_executable
 # We can make CalibredbError a specialized version of CalibreCLIError or just use CalibreCLIError directly.
 # For now, let's define it as a subclass to maintain specificity if desired,
 # but it could also be an alias or replaced by CalibreCLIError.
@@ -17,13 +18,39 @@ class CalibredbError(CalibreCLIError):
         super().__init__(message, stdout=stdout, stderr=stderr, returncode=returncode)
 
 
-def list_books(library_path: Optional[str] = None, search_query: Optional[str] = None) -> List[Dict[str, Any]]:
+def as_list(value: Any, field: str = "tags") -> List[str]:
+    """
+    A list field of a calibredb book entry (authors, tags, formats, languages) as a list of
+    strings. calibredb joins multiple authors with " & ", since names can contain commas
+    ("Herbert, Frank"), and the other fields with ",".
+    """
+    if value is None:
+        return []
+    if isinstance(value, str):
+        return [v.strip() for v in value.split("&" if field == "authors" else ",") if v.strip()]
+    return [str(v) for v in value if v]
+
+
+def escape_search_value(value: str) -> str:
+    """Escapes a value for use inside a double-quoted calibredb search term, e.g. tags:"=<value>"."""
+    return value.replace("\\", "\\\\").replace('"', '\\"')
+
+
+# The tags the signed-in user is restricted to (see accounts), set for each request by auth. While
+# set, list_books only finds books with one of them, and so does every book lookup built on it.
+restricted_tags: contextvars.ContextVar = contextvars.ContextVar("restricted_tags", default=None)
+
+
+def list_books(library_path: Optional[str] = None, search_query: Optional[str] = None,
+               fields: str = "all", sort_by: Optional[str] = None, ascending: bool = False) -> List[Dict[str, Any]]:
     """
     Lists books from a Calibre library using the calibredb command-line tool.
 
     Args:
         library_path: Optional path to the Calibre library.
         search_query: Optional search query to filter books.
+        fields: Comma-separated fields to read (the ID is always included); all by default.
+        sort_by: Optional field to sort by, descending unless `ascending`; calibredb's order otherwise.
 
     Returns:
         A list of dictionaries, where each dictionary represents a book.
@@ -37,13 +64,23 @@ def list_books(library_path: Optional[str] = None, search_query: Optional[str] =
     if library_path:
         cmd.extend(["--with-library", library_path])
 
-    # Add all fields to get comprehensive data.
+    # All fields by default to get comprehensive data.
     # Users of this function can then select which fields they care about.
-    cmd.extend(["--fields", "all"])
+    cmd.extend(["--fields", fields])
+
+    tags = restricted_tags.get()
+    if tags:
+        restriction = "(" + " or ".join(f'tags:"={escape_search_value(tag)}"' for tag in tags) + ")"
+        search_query = f"({search_query}) and {restriction}" if search_query else restriction
 
     if search_query:
         cmd.extend(["--search", search_query])
 
+    if sort_by:
+        cmd.extend(["--sort-by", sort_by])
+        if ascending:
+            cmd.append("--ascending")
+
     # FileNotFoundError and CalibreCLIError (for timeout) are handled by run_calibre_command
     stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
 
@@ -64,6 +101,33 @@ def list_books(library_path: Optional[str] = None, search_query: Optional[str] =
         raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
 
 
+def list_book_ids(library_path: Optional[str] = None, search_query: Optional[str] = None,
+                  sort_by: Optional[str] = None, ascending: bool = False) -> List[int]:
+    """
+    IDs of the matching books, in the order list_books returns them. Much cheaper than
+    list_books for large libraries, since calibredb only reads one short field per book.
+    """
+    return [book["id"] for book in list_books(library_path=library_path, search_query=search_query, fields="uuid",
+                                              sort_by=sort_by, ascending=ascending)]
+
+
+# Books per calibredb call in list_books_by_ids, to keep the search within command-line limits.
+IDS_PER_SEARCH = 500
+
+
+def list_books_by_ids(book_ids: List[int], library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """
+    The books with the given IDs, with all fields, in the order of `book_ids`. IDs of books
+    that don't exist are skipped.
+    """
+    found: Dict[int, Dict[str, Any]] = {}
+    for start in range(0, len(book_ids), IDS_PER_SEARCH):
+        chunk = book_ids[start:start + IDS_PER_SEARCH]
+        for book in list_books(library_path=library_path, search_query=" or ".join(f"id:{i}" for i in chunk)):
+            found[book.get("id")] = book
+    return [found[book_id] for book_id in book_ids if book_id in found]
+
+
 def add_book(
     file_path: str,
     library_path: Optional[str] = None,
@@ -73,6 +137,7 @@ def add_book(
     authors: Optional[str] = None, # Example: "Author One, Author Two"
     title: Optional[str] = None,
     tags: Optional[str] = None, # Example: "tag1, tag2"
+    identifiers: Optional[Dict[str, str]] = None, # Example: {"isbn": "9780441172719"}
     # Add other metadata options as needed, like isbn, series, etc.
 ) -> List[int]:
     """
@@ -87,6 +152,7 @@ def add_book(
         authors: Set authors for the added book.
         title: Set title for the added book.
         tags: Set tags for the added book.
+        identifiers: Set identifiers for the added book, as a mapping of type to value.
 
     Returns:
         A list of Calibre book IDs for the added book(s).
@@ -126,6 +192,9 @@ def add_book(
     if metadata_options:
         cmd.extend(["--metadata", ",".join(metadata_options)])
 
+    for id_type, id_value in (identifiers or {}).items():
+        cmd.extend(["--identifier", f"{id_type}:{id_value}"])
+
 
     # The file path should be the last argument typically, or after --
     cmd.extend(["--", file_path])
@@ -170,13 +239,52 @@ def add_book(
     return added_ids
 
 
-def remove_book(book_id: int, library_path: Optional[str] = None) -> Dict[str, Any]:
+def add_books(file_paths: List[str], library_path: Optional[str] = None, duplicates: bool = False) -> List[int]:
+    """
+    Adds several book files with a single `calibredb add`, which is much faster than one call per
+    file for bulk imports. Each file becomes its own book, with the metadata read from the file.
+
+    Returns:
+        The IDs of the added books.
+
+    Raises:
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If calibredb returns an error.
+        ValueError: If no files are given or a file does not exist.
+    """
+    if not file_paths:
+        raise ValueError("No book files given.")
+    missing = [p for p in file_paths if not os.path.exists(p)]
+    if missing:
+        raise ValueError(f"Book file not found at: {missing[0]}")
+
+    cmd = ["calibredb", "add"]
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+    if duplicates:
+        cmd.append("--duplicates")
+    cmd.extend(["--"] + list(file_paths))
+
+    # Calibre reads every file's metadata; allow for that.
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60 + 2 * len(file_paths))
+    if returncode != 0:
+        raise CalibredbError(f"calibredb add command failed with exit code {returncode}.",
+                             stdout=stdout, stderr=stderr, returncode=returncode)
+    if "Added book IDs:" not in stdout:
+        return []
+    ids_part = stdout.split("Added book IDs:")[1].splitlines()[0]
+    return [int(i.strip()) for i in ids_part.split(",") if i.strip().isdigit()]
+
+
+def remove_book(book_id: int, library_path: Optional[str] = None, permanent: bool = True) -> Dict[str, Any]:
     """
     Removes a book from the Calibre library using the calibredb remove_books command.
 
     Args:
         book_id: The ID of the book to remove.
         library_path: Optional path to the Calibre library.
+        permanent: Delete the book's files. If False, calibredb moves them to the library's
+            trash, from where they can be restored in Calibre.
 
     Returns:
         A dictionary containing the result of the remove operation, typically
@@ -193,7 +301,7 @@ def remove_book(book_id: int, library_path: Optional[str] = None) -> Dict[str, A
     if not isinstance(book_id, int) or book_id <= 0:
         raise ValueError("Book ID must be a positive integer.")
 
-    cmd = ["calibredb", "remove_books", "--permanent", "--for-machine", str(book_id)]
+    cmd = ["calibredb", "remove_books"] + (["--permanent"] if permanent else []) + ["--for-machine", str(book_id)]
 
     if library_path:
         cmd.extend(["--with-library", library_path])
@@ -260,7 +368,7 @@ def set_book_metadata(book_id: int, metadata: 'SetMetadataRequest', library_path
             continue
 
         formatted_value = ""
-        if field == "authors" or field == "tags":
+        if field == "authors" or field == "tags" or field == "languages":
             if isinstance(value, list):
                 formatted_value = ",".join(value)
             else: # Should not happen if Pydantic model is used correctly
@@ -417,7 +525,7 @@ def export_book_file(
     import subprocess
     try:
         process = subprocess.run(
-            cmd,
+            [resolve_executable(cmd[0])] + cmd[1:],
             capture_output=True,
             check=False, # Manually check returncode
             timeout=120  # Exporting might take time
@@ -480,3 +588,265 @@ def export_book_file(
         print(f"Error: {e}")
     except Exception as e:
         print(f"An unexpected error occurred: {e}")
+
+
+def set_book_metadata_from_opf(book_id: int, opf_path: str, library_path: Optional[str] = None) -> None:
+    """
+    Replaces a book's metadata with the contents of an OPF file using `calibredb set_metadata <id> <opf>`.
+
+    Raises:
+        FileNotFoundError: If calibredb command is not found.
+        CalibredbError: If calibredb set_metadata fails.
+        ValueError: If book_id is not positive or the OPF file does not exist.
+    """
+    if not isinstance(book_id, int) or book_id <= 0:
+        raise ValueError("Book ID must be a positive integer.")
+    if not os.path.exists(opf_path):
+        raise ValueError(f"OPF file not found at: {opf_path}")
+
+    cmd = ["calibredb", "set_metadata", str(book_id), opf_path]
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
+    if returncode != 0:
+        error_message = f"calibredb set_metadata (OPF) command failed with exit code {returncode}."
+        raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
+
+
+def set_book_cover(book_id: int, cover_path: str, library_path: Optional[str] = None) -> None:
+    """
+    Sets a book's cover from an image file using `calibredb set_metadata --field cover:<path>`.
+
+    Raises:
+        FileNotFoundError: If calibredb command is not found.
+        CalibredbError: If calibredb set_metadata fails.
+        ValueError: If book_id is not positive or the image does not exist.
+    """
+    if not isinstance(book_id, int) or book_id <= 0:
+        raise ValueError("Book ID must be a positive integer.")
+    if not os.path.exists(cover_path):
+        raise ValueError(f"Cover image not found at: {cover_path}")
+
+    cmd = ["calibredb", "set_metadata", "--field", f"cover:{cover_path}", str(book_id)]
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
+    if returncode != 0:
+        error_message = f"calibredb set_metadata (cover) command failed with exit code {returncode}."
+        raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
+
+
+def add_format(book_id: int, file_path: str, library_path: Optional[str] = None, replace: bool = False) -> None:
+    """
+    Adds a file to an existing book as another format (`calibredb add_format`), e.g. a MOBI to a
+    book that has an EPUB. The format is taken from the file's extension.
+
+    Raises:
+        FileNotFoundError: If calibredb command is not found.
+        CalibredbError: If calibredb add_format fails, e.g. because the book already has the
+            format and replace is False.
+        ValueError: If book_id is not positive or the file does not exist.
+    """
+    if not isinstance(book_id, int) or book_id <= 0:
+        raise ValueError("Book ID must be a positive integer.")
+    if not os.path.exists(file_path):
+        raise ValueError(f"File not found at: {file_path}")
+
+    cmd = ["calibredb", "add_format"]
+    if not replace:
+        cmd.append("--dont-replace")
+    cmd.extend([str(book_id), file_path])
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
+    if returncode != 0:
+        error_message = f"calibredb add_format command failed with exit code {returncode}."
+        raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
+
+
+def add_extra_data_file(book_id: int, file_path: str, library_path: Optional[str] = None) -> None:
+    """
+    Attaches an arbitrary file to a book as an extra data file
+    (`calibredb add_format --as-extra-data-file`, Calibre 7+). Extra data files are stored
+    in the book's `data/` folder and are not treated as e-book formats.
+
+    Raises:
+        FileNotFoundError: If calibredb command is not found.
+        CalibredbError: If calibredb add_format fails.
+        ValueError: If book_id is not positive or the file does not exist.
+    """
+    if not isinstance(book_id, int) or book_id <= 0:
+        raise ValueError("Book ID must be a positive integer.")
+    if not os.path.exists(file_path):
+        raise ValueError(f"File not found at: {file_path}")
+
+    cmd = ["calibredb", "add_format", "--as-extra-data-file", str(book_id), file_path]
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
+    if returncode != 0:
+        error_message = f"calibredb add_format (extra data file) command failed with exit code {returncode}."
+        raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
+
+
+def get_book_opf(book_id: int, library_path: Optional[str] = None) -> str:
+    """
+    Returns a book's metadata as a Calibre OPF document using `calibredb show_metadata --as-opf`.
+
+    Raises:
+        FileNotFoundError: If calibredb command is not found.
+        CalibredbError: If calibredb show_metadata fails (e.g., the book does not exist).
+        ValueError: If book_id is not a positive integer.
+    """
+    if not isinstance(book_id, int) or book_id <= 0:
+        raise ValueError("Book ID must be a positive integer.")
+
+    cmd = ["calibredb", "show_metadata", "--as-opf", str(book_id)]
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
+    if returncode != 0:
+        error_message = f"calibredb show_metadata command failed with exit code {returncode}."
+        raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
+    if not stdout.strip():
+        raise CalibredbError(f"No book with id {book_id} found.", stdout=stdout, stderr=stderr, returncode=returncode)
+    return stdout
+
+
+def set_book_identifiers(book_id: int, identifiers: Dict[str, str], library_path: Optional[str] = None) -> None:
+    """
+    Replaces all identifiers of a book using `calibredb set_metadata --field identifiers:type:value,...`.
+
+    Raises:
+        FileNotFoundError: If calibredb command is not found.
+        CalibredbError: If calibredb set_metadata fails.
+        ValueError: If book_id is not positive.
+    """
+    if not isinstance(book_id, int) or book_id <= 0:
+        raise ValueError("Book ID must be a positive integer.")
+
+    value = ",".join(f"{id_type}:{id_value}" for id_type, id_value in identifiers.items())
+    cmd = ["calibredb", "set_metadata", "--field", f"identifiers:{value}", str(book_id)]
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
+    if returncode != 0:
+        error_message = f"calibredb set_metadata (identifiers) command failed with exit code {returncode}."
+        raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
+
+
+def set_book_field(book_id: int, field: str, value: str, library_path: Optional[str] = None) -> None:
+    """
+    Sets a single field of a book using `calibredb set_metadata --field field:value`.
+    Multi-value fields (tags, authors, languages) take a comma-separated value; an empty value clears the field.
+
+    Raises:
+        FileNotFoundError: If calibredb command is not found.
+        CalibredbError: If calibredb set_metadata fails.
+        ValueError: If book_id is not positive.
+    """
+    if not isinstance(book_id, int) or book_id <= 0:
+        raise ValueError("Book ID must be a positive integer.")
+
+    cmd = ["calibredb", "set_metadata", "--field", f"{field}:{value}", str(book_id)]
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
+    if returncode != 0:
+        error_message = f"calibredb set_metadata ({field}) command failed with exit code {returncode}."
+        raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
+
+
+def list_custom_columns(library_path: Optional[str] = None) -> Dict[str, int]:
+    """
+    Lists the library's custom columns using `calibredb custom_columns`.
+
+    Returns:
+        {label: column number}. Labels are used without the leading '#'.
+
+    Raises:
+        FileNotFoundError: If calibredb command is not found.
+        CalibredbError: If calibredb custom_columns fails.
+    """
+    cmd = ["calibredb", "custom_columns"]
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
+    if returncode != 0:
+        error_message = f"calibredb custom_columns command failed with exit code {returncode}."
+        raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
+
+    columns = {}
+    for line in stdout.splitlines():
+        # Each line is "label (number)".
+        label, sep, number = line.strip().rpartition(" (")
+        if sep and number.endswith(")") and number[:-1].isdigit():
+            columns[label] = int(number[:-1])
+    return columns
+
+
+def add_custom_column(
+    label: str,
+    name: str,
+    datatype: str,
+    library_path: Optional[str] = None,
+    is_multiple: bool = False,
+    display: Optional[Dict[str, Any]] = None,
+) -> None:
+    """
+    Creates a custom column using `calibredb add_custom_column`.
+
+    Args:
+        label: Lookup name without '#' (lowercase letters, digits and underscores).
+        name: Column heading shown in Calibre.
+        datatype: One of Calibre's column types, e.g. "text", "bool", "float", "datetime", "enumeration".
+        display: Calibre display options, e.g. {"enum_values": [...]} for enumerations.
+
+    Raises:
+        FileNotFoundError: If calibredb command is not found.
+        CalibredbError: If calibredb add_custom_column fails (e.g., the label already exists).
+    """
+    cmd = ["calibredb", "add_custom_column"]
+    if is_multiple:
+        cmd.append("--is-multiple")
+    if display:
+        cmd.extend(["--display", json.dumps(display)])
+    cmd.extend([label, name, datatype])
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
+    if returncode != 0:
+        error_message = f"calibredb add_custom_column ({label}) command failed with exit code {returncode}."
+        raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
+
+
+def set_custom_field(book_id: int, label: str, value: str, library_path: Optional[str] = None) -> None:
+    """
+    Sets a custom column of a book using `calibredb set_custom label id value`.
+    An empty value clears the field.
+
+    Raises:
+        FileNotFoundError: If calibredb command is not found.
+        CalibredbError: If calibredb set_custom fails (e.g., unknown column or invalid value).
+        ValueError: If book_id is not positive.
+    """
+    if not isinstance(book_id, int) or book_id <= 0:
+        raise ValueError("Book ID must be a positive integer.")
+
+    cmd = ["calibredb", "set_custom", label, str(book_id), value]
+    if library_path:
+        cmd.extend(["--with-library", library_path])
+
+    stdout, stderr, returncode = run_calibre_command(cmd, timeout=60)
+    if returncode != 0:
+        error_message = f"calibredb set_custom ({label}) command failed with exit code {returncode}."
+        raise CalibredbError(error_message, stdout=stdout, stderr=stderr, returncode=returncode)
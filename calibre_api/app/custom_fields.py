@@ -0,0 +1,104 @@
+"""
+Custom columns the server adds to a library for its own features (physical copies, acquisition
+data). Columns are created on first use, so libraries that never use a feature stay unchanged,
+and they appear in Calibre like any other column: visible in the book list, editable, and
+searchable as `#label:value`.
+"""
+from dataclasses import dataclass, field
+from datetime import date, datetime
+from typing import Any, Dict, List, Optional
+
+from .crud import list_custom_columns, add_custom_column, set_custom_field
+
+
+@dataclass(frozen=True)
+class CustomColumn:
+    label: str
+    name: str
+    datatype: str  # "text", "bool", "float", "datetime" or "enumeration"
+    enum_values: Optional[List[str]] = field(default=None)
+
+    @property
+    def display(self) -> Optional[Dict[str, Any]]:
+        if self.datatype == "enumeration":
+            return {"enum_values": self.enum_values, "enum_colors": []}
+        if self.datatype == "datetime":
+            return {"date_format": "yyyy-MM-dd"}
+        return None
+
+
+def ensure_columns(columns: List[CustomColumn], library_path: Optional[str] = None) -> List[str]:
+    """
+    Creates the columns the library doesn't have yet. An existing column with the same label
+    is used as it is.
+
+    Returns:
+        The labels of the columns that were created.
+    """
+    existing = list_custom_columns(library_path=library_path)
+    created = []
+    for column in columns:
+        if column.label not in existing:
+            add_custom_column(column.label, column.name, column.datatype,
+                              library_path=library_path, display=column.display)
+            created.append(column.label)
+    return created
+
+
+def format_value(column: CustomColumn, value: Any) -> str:
+    """
+    Converts a value to the string `calibredb set_custom` expects; None clears the field.
+
+    Raises:
+        ValueError: If the value doesn't fit the column.
+    """
+    if value is None or value == "":
+        return ""
+    if column.datatype == "bool":
+        return "true" if value else "false"
+    if column.datatype == "datetime":
+        if isinstance(value, str):
+            value = date.fromisoformat(value[:10])
+        # Dates are stored at noon UTC so they show as the same day in every time zone.
+        day = value.date() if isinstance(value, datetime) else value
+        return f"{day.isoformat()}T12:00:00+00:00"
+    if column.datatype == "float":
+        return repr(float(value))
+    if column.datatype == "enumeration" and value not in column.enum_values:
+        raise ValueError(f"'{value}' is not a valid {column.name.lower()}. Use one of: {', '.join(column.enum_values)}.")
+    return str(value)
+
+
+def set_values(book_id: int, columns: List[CustomColumn], values: Dict[str, Any],
+               library_path: Optional[str] = None) -> None:
+    """
+    Sets the given {label: value} pairs on a book, creating the columns first if needed.
+    All values are validated before anything is written.
+
+    Raises:
+        ValueError: If a label is unknown or a value doesn't fit its column.
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If creating a column or setting a value fails.
+    """
+    by_label = {column.label: column for column in columns}
+    unknown = set(values) - set(by_label)
+    if unknown:
+        raise ValueError(f"Unknown field(s): {', '.join(sorted(unknown))}.")
+    formatted = {label: format_value(by_label[label], value) for label, value in values.items()}
+    ensure_columns(columns, library_path=library_path)
+    for label, value in formatted.items():
+        set_custom_field(book_id, label, value, library_path=library_path)
+
+
+def read_values(book: Dict[str, Any], columns: List[CustomColumn]) -> Dict[str, Any]:
+    """
+    Reads the columns from a book dict returned by `calibredb list`, where custom columns
+    appear as "*label". Dates are returned as "YYYY-MM-DD".
+    """
+    values = {}
+    for column in columns:
+        value = book.get(f"*{column.label}")
+        if column.datatype == "datetime" and isinstance(value, str) and value:
+            value = value[:10]
+        values[column.label] = value if value != "" else None
+    return values
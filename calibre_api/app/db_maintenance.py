@@ -0,0 +1,110 @@
+"""
+Keeps the library database fast after heavy import/delete cycles: ANALYZE refreshes the
+statistics SQLite's query planner uses, incremental vacuum returns free pages to the file
+system (libraries created with auto_vacuum=INCREMENTAL only) and a full VACUUM rewrites
+the whole file.
+
+Runs via POST /maintenance/optimize-db, or from cron (run from the calibre_api directory):
+
+    python -m app.db_maintenance [--vacuum] [--library "/root/Calibre Library"]
+
+A full VACUUM briefly needs as much free space again as the database and blocks all other
+access to it, so the endpoint only runs it while maintenance mode is on; from the command
+line, stop the server (or turn on maintenance mode) first.
+"""
+import argparse
+import json
+import os
+import sqlite3
+import sys
+import time
+import logging
+from typing import Any, Dict, List, Optional
+
+from . import library_db
+
+logger = logging.getLogger(__name__)
+
+AUTO_VACUUM_MODES = {0: "none", 1: "full", 2: "incremental"}
+
+
+def database_stats(conn: sqlite3.Connection, db_path: str) -> Dict[str, Any]:
+    page_size = conn.execute("PRAGMA page_size").fetchone()[0]
+    return {
+        "size_bytes": os.path.getsize(db_path),
+        "page_size": page_size,
+        "page_count": conn.execute("PRAGMA page_count").fetchone()[0],
+        "free_pages": conn.execute("PRAGMA freelist_count").fetchone()[0],
+        "auto_vacuum": AUTO_VACUUM_MODES.get(conn.execute("PRAGMA auto_vacuum").fetchone()[0], "unknown"),
+    }
+
+
+def optimize_library_db(library_path: str, analyze: bool = True, vacuum: bool = False) -> Dict[str, Any]:
+    """
+    Runs ANALYZE, an incremental vacuum (if the database supports it) and, if requested, a full VACUUM.
+
+    Returns:
+        {"actions": [...], "skipped": [...], "before": stats, "after": stats,
+         "freed_bytes", "duration_seconds"}; stats as returned by database_stats.
+
+    Raises:
+        ValueError: If the library has no metadata.db.
+        sqlite3.Error: If the database is locked for longer than the timeout or damaged.
+    """
+    db_path = os.path.join(library_db.resolve_library_path(library_path), library_db.LIBRARY_DB_NAME)
+    started = time.monotonic()
+    # isolation_level=None: VACUUM cannot run inside the transaction the sqlite3 module would open.
+    conn = sqlite3.connect(db_path, timeout=30, isolation_level=None)
+    try:
+        before = database_stats(conn, db_path)
+        actions, skipped = [], []
+        if analyze:
+            conn.execute("ANALYZE")
+            actions.append("analyze")
+        if before["auto_vacuum"] == "incremental":
+            conn.execute("PRAGMA incremental_vacuum")
+            actions.append("incremental_vacuum")
+        else:
+            skipped.append("incremental_vacuum: the database was not created with auto_vacuum=INCREMENTAL")
+        if vacuum:
+            conn.execute("VACUUM")
+            actions.append("vacuum")
+        after = database_stats(conn, db_path)
+    finally:
+        conn.close()
+
+    result = {
+        "actions": actions,
+        "skipped": skipped,
+        "before": before,
+        "after": after,
+        "freed_bytes": before["size_bytes"] - after["size_bytes"],
+        "duration_seconds": round(time.monotonic() - started, 3),
+    }
+    logger.info(f"Optimized {db_path}: {', '.join(actions) or 'nothing to do'}; "
+                f"{before['size_bytes']} -> {after['size_bytes']} bytes.")
+    return result
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    parser = argparse.ArgumentParser(
+        prog="python -m app.db_maintenance",
+        description="Run ANALYZE and vacuum on a Calibre library database.",
+    )
+    parser.add_argument("--library", help="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+    parser.add_argument("--vacuum", action="store_true",
+                        help="Also run a full VACUUM. Stop the server or turn on maintenance mode first.")
+    parser.add_argument("--no-analyze", action="store_true", help="Skip ANALYZE.")
+    args = parser.parse_args(argv)
+
+    try:
+        result = optimize_library_db(args.library, analyze=not args.no_analyze, vacuum=args.vacuum)
+    except (ValueError, sqlite3.Error) as e:
+        print(f"Error: {e}", file=sys.stderr)
+        return 1
+    print(json.dumps(result, indent=2))
+    return 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
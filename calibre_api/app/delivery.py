@@ -0,0 +1,214 @@
+"""
+Sending books to e-readers by email (Send to Kindle, PocketBook, Kobo via a mail-in service, ...).
+
+Devices are configured by name in SHELFSTONE_SEND_DEVICES as "name=address[:format]" entries,
+e.g. "kindle=me_1234@kindle.com:epub,pocketbook=me@pbsync.com:epub". A book is converted to the
+device's format if it doesn't have it (through the conversion cache) and mailed with
+`calibre-smtp` using the SHELFSTONE_SMTP_* settings. Sending runs in the background; the most
+recent deliveries and their status are kept in memory, and the user who sent the book gets a
+notification with the result (see notifications).
+"""
+import itertools
+import logging
+import os
+import shutil
+import tempfile
+import threading
+import time
+from collections import deque
+from typing import Any, Callable, Deque, Dict, List, Optional
+
+from . import calibre_cli
+from . import conversion_cache
+from . import features
+from . import lifecycle
+from . import notifications
+from . import processing_log
+from .bundles import safe_name
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_FORMAT = "EPUB"
+DEFAULT_SMTP_PORT = 587
+DEFAULT_ENCRYPTION = "tls"
+RECENT_DELIVERIES_LIMIT = 100
+ENCRYPTION_METHODS = ("tls", "ssl", "none")
+
+QUEUED, CONVERTING, SENDING, SENT, FAILED = "queued", "converting", "sending", "sent", "failed"
+
+
+class SendingNotConfigured(Exception):
+    """SHELFSTONE_SMTP_HOST is not set."""
+
+
+def parse_devices(value: Optional[str]) -> Dict[str, Dict[str, str]]:
+    """
+    Parses "name=address[:format],..." into {name: {"address", "format"}}.
+
+    Raises:
+        ValueError: If an entry is malformed or its format can't be produced.
+    """
+    devices: Dict[str, Dict[str, str]] = {}
+    for entry in (value or "").split(","):
+        entry = entry.strip()
+        if not entry:
+            continue
+        name, sep, target = entry.partition("=")
+        address, _, fmt = target.strip().partition(":")
+        name, address, fmt = name.strip().lower(), address.strip(), (fmt.strip() or DEFAULT_FORMAT).upper()
+        if not sep or not name or "@" not in address:
+            raise ValueError(f"Invalid device entry '{entry}', expected 'name=address[:format]'.")
+        if fmt not in conversion_cache.OUTPUT_FORMATS:
+            raise ValueError(f"Device '{name}' has format '{fmt}', which books can't be converted to.")
+        devices[name] = {"address": address, "format": fmt}
+    return devices
+
+
+def parse_encryption(value: str) -> str:
+    if value.lower() not in ENCRYPTION_METHODS:
+        raise ValueError(f"must be one of {', '.join(ENCRYPTION_METHODS)}")
+    return value.lower()
+
+
+def configured_devices() -> Dict[str, Dict[str, str]]:
+    return parse_devices(os.environ.get("SHELFSTONE_SEND_DEVICES"))
+
+
+def smtp_settings() -> Dict[str, Any]:
+    """
+    Keyword arguments for calibre_cli.send_email_with_calibre_smtp from the SHELFSTONE_SMTP_* settings.
+
+    Raises:
+        SendingNotConfigured: If SHELFSTONE_SMTP_HOST is not set.
+    """
+    env = os.environ
+    if not env.get("SHELFSTONE_SMTP_HOST"):
+        raise SendingNotConfigured("Sending books is not configured. Set SHELFSTONE_SMTP_HOST and SHELFSTONE_SEND_DEVICES.")
+    return {
+        "smtp_server": env["SHELFSTONE_SMTP_HOST"],
+        "smtp_port": int(env.get("SHELFSTONE_SMTP_PORT") or DEFAULT_SMTP_PORT),
+        "smtp_username": env.get("SHELFSTONE_SMTP_USERNAME") or None,
+        "smtp_password": env.get("SHELFSTONE_SMTP_PASSWORD") or None,
+        "smtp_encryption": parse_encryption(env.get("SHELFSTONE_SMTP_ENCRYPTION") or DEFAULT_ENCRYPTION),
+        "sender_email": env.get("SHELFSTONE_SMTP_FROM") or env.get("SHELFSTONE_SMTP_USERNAME") or None,
+    }
+
+
+# --- Delivery tracking ---
+
+_lock = threading.Lock()
+_ids = itertools.count(1)
+_deliveries: Deque[Dict[str, Any]] = deque(maxlen=RECENT_DELIVERIES_LIMIT)
+
+
+def _update(delivery: Dict[str, Any], **changes) -> None:
+    with _lock:
+        delivery.update(changes)
+
+
+def recent_deliveries() -> List[Dict[str, Any]]:
+    """The most recent deliveries, newest first."""
+    with _lock:
+        return [dict(d) for d in reversed(_deliveries)]
+
+
+def get_delivery(delivery_id: int) -> Optional[Dict[str, Any]]:
+    with _lock:
+        return next((dict(d) for d in _deliveries if d["id"] == delivery_id), None)
+
+
+def reset() -> None:
+    """Forgets all deliveries (used by tests)."""
+    with _lock:
+        _deliveries.clear()
+
+
+def attachment_name(book: Dict[str, Any], fmt: str) -> str:
+    # Kindle shows the file name until the document is processed.
+    return f"{safe_name(book.get('title') or 'book_' + str(book.get('id')))}.{fmt.lower()}"
+
+
+def deliver(delivery: Dict[str, Any], book: Dict[str, Any], smtp: Dict[str, Any],
+            send: Callable[..., Any] = calibre_cli.send_email_with_calibre_smtp) -> None:
+    """Converts the book if needed and mails it, recording progress on the delivery."""
+    temp_dir = tempfile.mkdtemp(prefix="shelfstone_server_send_")
+    try:
+        formats = {fmt: path for fmt, path in conversion_cache.book_formats(book).items() if os.path.isfile(path)}
+        if not formats:
+            raise ValueError(f"Book ID {book.get('id')} has no files.")
+        fmt = delivery["format"]
+        path = formats.get(fmt)
+        if path is None:
+            _update(delivery, status=CONVERTING)
+            path = conversion_cache.get_or_convert(book["id"], conversion_cache.pick_source(formats), fmt)["path"]
+        attachment = os.path.join(temp_dir, attachment_name(book, fmt))
+        shutil.copyfile(path, attachment)
+
+        _update(delivery, status=SENDING)
+        success, message = send(recipient_email=delivery["address"], subject=book.get("title") or attachment,
+                                body=f"Sent from Shelfstone: {book.get('title') or attachment}",
+                                attachment_path=attachment, **smtp)
+        if not success:
+            if "password" in message.lower() or "authentication" in message.lower():
+                message = "SMTP authentication failed. Check SHELFSTONE_SMTP_USERNAME and SHELFSTONE_SMTP_PASSWORD."
+            _update(delivery, status=FAILED, error=message, finished_at=time.time())
+            return
+        _update(delivery, status=SENT, finished_at=time.time())
+        logger.info(f"Sent book ID {book.get('id')} as {fmt} to device '{delivery['device']}'.")
+    except Exception as e:
+        logger.error(f"Sending book ID {book.get('id')} to '{delivery['device']}' failed: {e}", exc_info=True)
+        _update(delivery, status=FAILED, error=e.args[0] if e.args else str(e), finished_at=time.time())
+    finally:
+        shutil.rmtree(temp_dir, ignore_errors=True)
+
+
+def _notify(delivery: Dict[str, Any], book: Dict[str, Any], library_path: Optional[str], user_id: Optional[int]) -> None:
+    name = f"'{book['title']}'" if book.get("title") else f"book ID {book['id']}"
+    if delivery["status"] == SENT:
+        notifications.notify(user_id, notifications.DELIVERY_SENT, f"Sent {name} to {delivery['device']}",
+                             book_id=book["id"], library_path=library_path)
+    else:
+        notifications.notify(user_id, notifications.DELIVERY_FAILED, f"Sending {name} to {delivery['device']} failed",
+                             delivery["error"], book_id=book["id"], library_path=library_path)
+
+
+def _deliver_job(delivery: Dict[str, Any], book: Dict[str, Any], smtp: Dict[str, Any],
+                 library_path: Optional[str] = None, user_id: Optional[int] = None) -> None:
+    with lifecycle.job(f"delivery {delivery['id']} to '{delivery['device']}'", user_id=user_id), \
+            processing_log.step(f"send to {delivery['device']}", [book["id"]], library_path) as log:
+        log["detail"] = f"Sent {delivery['format']} to {delivery['address']}."
+        deliver(delivery, book, smtp)
+        if delivery["status"] == FAILED:
+            log.update(status=processing_log.FAILED, error=delivery["error"])
+    _notify(delivery, book, library_path, user_id)
+
+
+def start_delivery(book: Dict[str, Any], device: str, fmt: Optional[str] = None,
+                   library_path: Optional[str] = None, user_id: Optional[int] = None) -> Dict[str, Any]:
+    """
+    Queues sending a book to a configured device and returns the delivery record. `user_id` is
+    who sent it, to be notified of the result.
+
+    Raises:
+        SendingNotConfigured: If SMTP is not configured.
+        ValueError: If the device is unknown or the format can't be produced.
+        FeatureDisabled: If the book would need converting and the conversion feature is off.
+    """
+    smtp = smtp_settings()
+    devices = configured_devices()
+    target = devices.get(device.lower())
+    if target is None:
+        known = ", ".join(sorted(devices)) or "none configured"
+        raise ValueError(f"Unknown device '{device}'. Known devices: {known}.")
+    fmt = (fmt or target["format"]).upper().lstrip(".")
+    if fmt not in conversion_cache.OUTPUT_FORMATS:
+        raise ValueError(f"Cannot send as '{fmt}'. Supported formats: {', '.join(sorted(conversion_cache.OUTPUT_FORMATS))}.")
+    if fmt not in conversion_cache.book_formats(book):
+        features.require("conversion")
+
+    delivery = {"id": next(_ids), "book_id": book["id"], "device": device.lower(), "address": target["address"],
+                "format": fmt, "status": QUEUED, "error": None, "created_at": time.time(), "finished_at": None}
+    with _lock:
+        _deliveries.append(delivery)
+    threading.Thread(target=_deliver_job, args=(delivery, book, smtp, library_path, user_id), name=f"send-{delivery['id']}", daemon=True).start()
+    return dict(delivery)
@@ -0,0 +1,143 @@
+"""
+Compares a Calibre library with an earlier snapshot of its metadata.db.
+
+Also usable from the command line (run from the calibre_api directory):
+
+    python -m app.diff /backups/metadata.db [--library "/root/Calibre Library"]
+"""
+import argparse
+import json
+import os
+import shutil
+import sys
+import tempfile
+from typing import Any, Dict, List, Optional
+
+from .crud import as_list, list_books
+from .filetypes import book_format_names
+
+# Metadata fields compared between the snapshot and the current library.
+DIFF_FIELDS = [
+    "title", "authors", "author_sort", "tags", "publisher", "pubdate", "isbn", "series",
+    "series_index", "rating", "languages", "identifiers", "comments", "formats",
+]
+
+
+def list_snapshot_books(snapshot_db_path: str) -> List[Dict[str, Any]]:
+    """
+    Lists the books in a metadata.db snapshot with `calibredb list`.
+    The snapshot is copied into a scratch library folder first, so it is never modified.
+
+    Raises:
+        ValueError: If the snapshot file does not exist.
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If calibredb cannot read the snapshot.
+    """
+    if not os.path.isfile(snapshot_db_path):
+        raise ValueError(f"Snapshot not found: {snapshot_db_path}")
+    scratch_library = tempfile.mkdtemp(prefix="shelfstone_server_snapshot_")
+    try:
+        shutil.copyfile(snapshot_db_path, os.path.join(scratch_library, "metadata.db"))
+        return list_books(library_path=scratch_library)
+    finally:
+        shutil.rmtree(scratch_library, ignore_errors=True)
+
+
+def _comparable(field: str, book: Dict[str, Any]) -> Any:
+    value = book.get(field)
+    if field == "formats":
+        # Format paths differ between the snapshot's scratch folder and the library; compare names only.
+        return sorted(book_format_names(book))
+    if field in ("authors", "tags", "languages") and isinstance(value, str):
+        value = as_list(value, field)
+    if isinstance(value, list):
+        return sorted(value) if field != "authors" else value
+    if value == "":
+        return None
+    return value
+
+
+def _book_key(book: Dict[str, Any]) -> Any:
+    # The UUID survives ID changes (e.g. a book that was removed and re-added); fall back to the ID.
+    return book.get("uuid") or ("id", book.get("id"))
+
+
+def _summary(book: Dict[str, Any]) -> Dict[str, Any]:
+    return {"id": book.get("id"), "title": book.get("title"), "authors": book.get("authors")}
+
+
+def _sort_key(entry: Dict[str, Any]) -> int:
+    return entry["id"] or 0
+
+
+def diff_books(snapshot_books: List[Dict[str, Any]], current_books: List[Dict[str, Any]]) -> Dict[str, Any]:
+    """
+    Compares two book lists from `calibredb list`.
+
+    Returns:
+        {"added": [...], "removed": [...], "changed": [...]} where added/removed hold
+        {id, title, authors} summaries and changed holds the summary plus
+        "changes": {field: {"before": ..., "after": ...}}.
+    """
+    before = {_book_key(b): b for b in snapshot_books}
+    after = {_book_key(b): b for b in current_books}
+
+    added = [_summary(after[k]) for k in after if k not in before]
+    removed = [_summary(before[k]) for k in before if k not in after]
+    changed = []
+    for key in after:
+        if key not in before:
+            continue
+        changes = {}
+        for field in DIFF_FIELDS:
+            old_value, new_value = _comparable(field, before[key]), _comparable(field, after[key])
+            if old_value != new_value:
+                changes[field] = {"before": old_value, "after": new_value}
+        if changes:
+            changed.append({**_summary(after[key]), "changes": changes})
+
+    return {
+        "added": sorted(added, key=_sort_key),
+        "removed": sorted(removed, key=_sort_key),
+        "changed": sorted(changed, key=_sort_key),
+    }
+
+
+def diff_library(snapshot_db_path: str, library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Compares the current library with a metadata.db snapshot. See diff_books for the result.
+    """
+    snapshot_books = list_snapshot_books(snapshot_db_path)
+    current_books = list_books(library_path=library_path)
+    return diff_books(snapshot_books, current_books)
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    parser = argparse.ArgumentParser(
+        prog="python -m app.diff",
+        description="Compare a Calibre library with an earlier metadata.db snapshot.",
+    )
+    parser.add_argument("snapshot", help="Path to the metadata.db snapshot (backup).")
+    parser.add_argument("--library", help="Path to the Calibre library. Defaults to calibredb's default library.")
+    parser.add_argument("--json", action="store_true", help="Print the full diff as JSON.")
+    args = parser.parse_args(argv)
+
+    result = diff_library(args.snapshot, library_path=args.library)
+    if args.json:
+        print(json.dumps(result, indent=2, default=str))
+        return 0
+
+    for book in result["added"]:
+        print(f"+ [{book['id']}] {book['title']}")
+    for book in result["removed"]:
+        print(f"- [{book['id']}] {book['title']}")
+    for book in result["changed"]:
+        print(f"~ [{book['id']}] {book['title']}")
+        for field, change in book["changes"].items():
+            print(f"    {field}: {change['before']!r} -> {change['after']!r}")
+    print(f"{len(result['added'])} added, {len(result['removed'])} removed, {len(result['changed'])} changed.")
+    return 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
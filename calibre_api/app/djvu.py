@@ -0,0 +1,91 @@
+"""
+DjVu metadata and covers via the DjVuLibre tools (`djvused`, `ddjvu`), which Calibre doesn't
+use: `ebook-meta` reports little more than the file name for DjVu files and Calibre adds them
+without a cover. Both tools are optional; without them DjVu books keep Calibre's defaults.
+"""
+import logging
+import os
+import re
+from typing import Any, Dict, Optional, Tuple
+
+from .calibre_cli import run_calibre_command, CalibreCLIError
+
+logger = logging.getLogger(__name__)
+
+DJVU_EXTENSIONS = (".djvu", ".djv")
+COVER_SIZE = (600, 900)
+
+# print-meta prints one `key "value"` pair per line; values use C-style escapes.
+_META_LINE_RE = re.compile(r'^\s*(\w+)\s+"((?:[^"\\]|\\.)*)"\s*$')
+
+
+def is_djvu_path(path: str) -> bool:
+    return path.lower().endswith(DJVU_EXTENSIONS)
+
+
+def _unescape(value: str) -> str:
+    return re.sub(r"\\(.)", r"\1", value)
+
+
+def parse_meta(output: str) -> Dict[str, Any]:
+    """Maps `djvused -e print-meta` output to Book model field names."""
+    meta = {}
+    for line in output.splitlines():
+        match = _META_LINE_RE.match(line)
+        if match:
+            meta[match.group(1).lower()] = _unescape(match.group(2)).strip()
+    result: Dict[str, Any] = {}
+    if meta.get("title"):
+        result["title"] = meta["title"]
+    if meta.get("author"):
+        result["authors"] = [a.strip() for a in re.split(r"\s*(?:;|&|\band\b)\s*", meta["author"]) if a.strip()]
+    if meta.get("publisher"):
+        result["publisher"] = meta["publisher"]
+    if meta.get("year"):
+        result["pubdate"] = meta["year"]
+    if meta.get("isbn"):
+        result["isbn"] = meta["isbn"]
+    return result
+
+
+def read_metadata(path: str) -> Dict[str, Any]:
+    """
+    Reads the document metadata of a DjVu file.
+
+    Raises:
+        FileNotFoundError: If djvused is not installed.
+        CalibreCLIError: If djvused fails (e.g. not a DjVu file).
+    """
+    stdout, stderr, returncode = run_calibre_command(["djvused", path, "-e", "print-meta"], timeout=30)
+    if returncode != 0:
+        raise CalibreCLIError(f"djvused failed for {os.path.basename(path)}.", stdout=stdout, stderr=stderr, returncode=returncode)
+    return parse_meta(stdout)
+
+
+def render_cover(path: str, output_dir: str, size: Tuple[int, int] = COVER_SIZE) -> Optional[str]:
+    """
+    Renders the first page as the cover image (TIFF, converted to JPEG when Pillow is available)
+    and returns its path, or None if ddjvu is missing or fails.
+    """
+    tiff_path = os.path.join(output_dir, "cover.tiff")
+    command = ["ddjvu", "-format=tiff", "-page=1", f"-size={size[0]}x{size[1]}", "-aspect=yes", path, tiff_path]
+    try:
+        _, stderr, returncode = run_calibre_command(command, timeout=60)
+    except (FileNotFoundError, CalibreCLIError) as e:
+        logger.info(f"No DjVu cover for {path}: {e.args[0]}")
+        return None
+    if returncode != 0 or not os.path.isfile(tiff_path):
+        logger.warning(f"ddjvu could not render the first page of {path}: {stderr}")
+        return None
+    try:
+        from PIL import Image
+    except ImportError:
+        return tiff_path
+    jpeg_path = os.path.join(output_dir, "cover.jpg")
+    try:
+        with Image.open(tiff_path) as img:
+            img.convert("RGB").save(jpeg_path, format="JPEG", quality=90)
+    except OSError as e:
+        logger.warning(f"Could not convert the DjVu cover of {path}: {e}")
+        return tiff_path
+    return jpeg_path
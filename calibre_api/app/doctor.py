@@ -0,0 +1,255 @@
+"""
+Startup self-test. Checks everything the server needs and prints a fix for each problem
+(run from the calibre_api directory):
+
+    python -m app.doctor [--library "/root/Calibre Library"] [--port 6336] [--json]
+
+Exits with 1 if any check failed, so it can also gate container start-up scripts.
+"""
+import argparse
+import errno
+import json
+import os
+import shutil
+import socket
+import sqlite3
+import sys
+import tempfile
+from typing import Any, Callable, Dict, List, Optional
+
+from . import calibre_cli
+from . import config
+from . import fulltext
+from . import library_db
+from . import limits
+from . import state_store
+from . import uploads
+
+OK, WARNING, ERROR = "ok", "warning", "error"
+
+DEFAULT_PORT = 6336
+DEFAULT_MIN_FREE_MB = 1024
+
+REQUIRED_BINARIES = ["calibredb", "ebook-convert", "ebook-meta", "ebook-polish"]
+# Only needed by some endpoints; missing ones make just those endpoints return 503.
+OPTIONAL_BINARIES = ["calibre", "fetch-ebook-metadata", "web2disk", "lrf2lrs", "lrs2lrf", "calibre-debug", "calibre-smtp"]
+
+INSTALL_HINT = ("Install Calibre (https://calibre-ebook.com/download_linux) and make sure its binaries are on PATH "
+                "or in SHELFSTONE_CALIBRE_BIN_DIR.")
+
+
+def _result(check: str, status: str, detail: str, fix: Optional[str] = None) -> Dict[str, Any]:
+    return {"check": check, "status": status, "detail": detail, "fix": fix}
+
+
+def check_binaries(names: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+    results = []
+    for name in REQUIRED_BINARIES + OPTIONAL_BINARIES if names is None else names:
+        path = shutil.which(calibre_cli.resolve_executable(name))
+        if path:
+            results.append(_result(f"binary:{name}", OK, path))
+        elif name in REQUIRED_BINARIES:
+            results.append(_result(f"binary:{name}", ERROR, "Not found.", INSTALL_HINT))
+        else:
+            results.append(_result(f"binary:{name}", WARNING, "Not found; endpoints using it will return 503.",
+                                   INSTALL_HINT))
+    return results
+
+
+def check_calibre_version() -> Dict[str, Any]:
+    try:
+        return _result("calibre_version", OK, calibre_cli.get_calibre_version())
+    except FileNotFoundError:
+        return _result("calibre_version", WARNING, "`calibre` not found, so the version is unknown.",
+                       "Install the full Calibre package, not only the command-line tools.")
+    except calibre_cli.CalibreCLIError as e:
+        return _result("calibre_version", WARNING, f"`calibre --version` failed: {e.args[0]}",
+                       "Run `calibre --version` by hand to see the error; headless hosts may need QT_QPA_PLATFORM=offscreen.")
+
+
+# Fixes for settings whose format needs more than "a valid value".
+_CONFIG_FIXES = {
+    "SHELFSTONE_BODY_LIMITS_MB": "Use comma-separated '/path/prefix=MB' pairs, e.g. '/books/add/=200,/uploads/=64'.",
+    "CALIBRE_LIBRARY_PATH": "Point CALIBRE_LIBRARY_PATH at the folder containing metadata.db, or unset it.",
+    "SHELFSTONE_CALIBRE_BIN_DIR": "Point SHELFSTONE_CALIBRE_BIN_DIR at the folder containing calibredb, or unset it to use PATH.",
+}
+
+
+def check_config(environ: Optional[Dict[str, str]] = None) -> List[Dict[str, Any]]:
+    """Validates the config file and the settings (see README, Configuration)."""
+    environ = dict(os.environ if environ is None else environ)
+    results = []
+    path = config.find_config_file(environ)
+    if path:
+        try:
+            for variable, value in config.read_config_file(path).items():
+                environ.setdefault(variable, value)
+        except config.ConfigError as e:
+            results.append(_result("config:file", ERROR, str(e), "Fix the file or point SHELFSTONE_CONFIG at another one."))
+    for name, problem in config.validate(environ).items():
+        results.append(_result(f"config:{name}", ERROR, f"{problem}. The server won't start.",
+                               _CONFIG_FIXES.get(name, f"Set {name} to a valid value or unset it.")))
+    if not results:
+        results.append(_result("config", OK, f"All settings are valid{f' (config file {path})' if path else ''}."))
+    return results
+
+
+def check_library_integrity(library_path: str, quick: bool = False) -> Dict[str, Any]:
+    pragma = "quick_check" if quick else "integrity_check"
+    try:
+        conn = library_db.connect_read_only(library_path)
+    except (ValueError, sqlite3.Error) as e:
+        return _result("library_db", ERROR, str(e), "Check the library path and the file permissions of metadata.db.")
+    try:
+        rows = [row[0] for row in conn.execute(f"PRAGMA {pragma}").fetchall()]
+    except sqlite3.Error as e:
+        return _result("library_db", ERROR, f"PRAGMA {pragma} failed: {e}",
+                       "Restore metadata.db from a backup or use Calibre's 'Check library' / 'Restore database'.")
+    finally:
+        conn.close()
+    if rows == ["ok"]:
+        return _result("library_db", OK, f"PRAGMA {pragma}: ok")
+    return _result("library_db", ERROR, f"PRAGMA {pragma} reported: {'; '.join(rows[:5])}",
+                   "Stop the server, back up the library and run Calibre's Library maintenance > Restore database.")
+
+
+def check_library_connection(library_path: str) -> Dict[str, Any]:
+    """Opens metadata.db and reads from it; a quick check, unlike check_library_integrity."""
+    try:
+        conn = library_db.connect_read_only(library_path)
+        try:
+            conn.execute("SELECT COUNT(*) FROM books").fetchone()
+        finally:
+            conn.close()
+    except (ValueError, sqlite3.Error) as e:
+        return _result("library_db", ERROR, str(e), "Check the library path and the file permissions of metadata.db.")
+    return _result("library_db", OK, "metadata.db is readable.")
+
+
+def check_readiness(library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """
+    The checks behind GET /readyz, cheap enough to run on every probe: the required Calibre
+    binaries and, when the library path is known, a read from its metadata.db.
+    """
+    results = check_binaries(REQUIRED_BINARIES)
+    library_path = library_path or os.environ.get("CALIBRE_LIBRARY_PATH")
+    if library_path:
+        results.append(check_library_connection(library_path))
+    return results
+
+
+def _writable_dir_result(check: str, path: str, fix: str) -> Dict[str, Any]:
+    # The folder may not exist yet (it is created on first use); then its parent must be writable.
+    existing = path
+    while not os.path.isdir(existing) and os.path.dirname(existing) != existing:
+        existing = os.path.dirname(existing)
+    if os.access(existing, os.W_OK | os.X_OK):
+        return _result(check, OK, f"{path} is writable.")
+    return _result(check, ERROR, f"{existing} is not writable by user id {os.getuid()}.", fix)
+
+
+def check_permissions(library_path: Optional[str]) -> List[Dict[str, Any]]:
+    results = [
+        _writable_dir_result("dir:temp", tempfile.gettempdir(), "Set TMPDIR to a writable folder."),
+        _writable_dir_result("dir:uploads", uploads.UPLOAD_ROOT, "Make the temp folder writable or set TMPDIR."),
+        _writable_dir_result("dir:state", state_store.state_dir(), "Set SHELFSTONE_STATE_DIR to a writable folder."),
+        _writable_dir_result("dir:fulltext", os.path.dirname(os.path.abspath(fulltext.index_db_path())),
+                             "Set SHELFSTONE_FTS_DB to a path in a writable folder."),
+    ]
+    if library_path:
+        fix = f"Give the server's user write access, e.g. `chown -R {os.getuid()} '{library_path}'`."
+        results.append(_writable_dir_result("dir:library", library_path, fix))
+        db = os.path.join(library_path, library_db.LIBRARY_DB_NAME)
+        if os.path.exists(db) and not os.access(db, os.W_OK):
+            results.append(_result("file:metadata.db", ERROR, f"{db} is read-only.", fix))
+    return results
+
+
+def check_disk_space(paths: List[str], min_free_mb: int) -> List[Dict[str, Any]]:
+    results, seen = [], set()
+    for path in paths:
+        try:
+            usage = shutil.disk_usage(path)
+        except OSError as e:
+            results.append(_result(f"disk:{path}", WARNING, f"Could not check free space: {e}"))
+            continue
+        key = (usage.total, usage.free)  # Paths on the same file system are reported once.
+        if key in seen:
+            continue
+        seen.add(key)
+        free_mb = usage.free // (1024 * 1024)
+        if free_mb < min_free_mb:
+            results.append(_result(f"disk:{path}", WARNING, f"Only {free_mb} MB free.",
+                                   "Free up space; conversions and uploads need several times the size of a book. "
+                                   "`python -m app.janitor` removes leftover temporary files."))
+        else:
+            results.append(_result(f"disk:{path}", OK, f"{free_mb} MB free."))
+    return results
+
+
+def check_port(host: str, port: int) -> Dict[str, Any]:
+    sock = socket.socket(socket.AF_INET6 if ":" in host else socket.AF_INET, socket.SOCK_STREAM)
+    try:
+        sock.bind((host, port))
+    except OSError as e:
+        if e.errno == errno.EADDRINUSE:
+            return _result("port", ERROR, f"{host}:{port} is already in use.",
+                           f"Stop the other process (`ss -ltnp 'sport = :{port}'` shows it) or start uvicorn with another --port.")
+        if e.errno == errno.EACCES:
+            return _result("port", ERROR, f"No permission to listen on {host}:{port}.", "Use a port above 1023.")
+        return _result("port", ERROR, f"Cannot listen on {host}:{port}: {e}", "Check the --host address.")
+    finally:
+        sock.close()
+    return _result("port", OK, f"{host}:{port} is free.")
+
+
+def run_checks(library_path: Optional[str] = None, host: str = "0.0.0.0", port: Optional[int] = DEFAULT_PORT,
+               min_free_mb: int = DEFAULT_MIN_FREE_MB, quick: bool = False) -> List[Dict[str, Any]]:
+    """Runs all checks. Library checks are skipped without a library path; the port check when port is None."""
+    library_path = library_path or os.environ.get("CALIBRE_LIBRARY_PATH")
+    checks: List[Callable[[], Any]] = [check_binaries, check_calibre_version, check_config,
+                                       lambda: check_permissions(library_path)]
+    if library_path:
+        checks.append(lambda: check_library_integrity(library_path, quick=quick))
+    checks.append(lambda: check_disk_space([p for p in [library_path, tempfile.gettempdir()] if p], min_free_mb))
+    if port is not None:
+        checks.append(lambda: check_port(host, port))
+
+    results = []
+    for check in checks:
+        result = check()
+        results.extend(result if isinstance(result, list) else [result])
+    return results
+
+
+_LABELS = {OK: "[ OK ]", WARNING: "[WARN]", ERROR: "[FAIL]"}
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    parser = argparse.ArgumentParser(prog="python -m app.doctor", description="Check that Shelfstone Server can run.")
+    parser.add_argument("--library", help="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+    parser.add_argument("--host", default="0.0.0.0", help="Address the server will listen on.")
+    parser.add_argument("--port", type=int, default=DEFAULT_PORT, help="Port the server will listen on.")
+    parser.add_argument("--skip-port", action="store_true", help="Don't check the port (e.g. while the server runs).")
+    parser.add_argument("--min-free-mb", type=int, default=DEFAULT_MIN_FREE_MB, help="Warn below this much free disk space.")
+    parser.add_argument("--quick", action="store_true", help="Use PRAGMA quick_check instead of the slower integrity_check.")
+    parser.add_argument("--json", action="store_true", help="Print the results as JSON.")
+    args = parser.parse_args(argv)
+
+    results = run_checks(library_path=args.library, host=args.host, port=None if args.skip_port else args.port,
+                         min_free_mb=args.min_free_mb, quick=args.quick)
+    if args.json:
+        print(json.dumps(results, indent=2))
+    else:
+        for result in results:
+            print(f"{_LABELS[result['status']]} {result['check']}: {result['detail']}")
+            if result["fix"] and result["status"] != OK:
+                print(f"       Fix: {result['fix']}")
+        failed = sum(r["status"] == ERROR for r in results)
+        warned = sum(r["status"] == WARNING for r in results)
+        print(f"\n{failed} problem(s), {warned} warning(s).")
+    return 1 if any(r["status"] == ERROR for r in results) else 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
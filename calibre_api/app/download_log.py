@@ -0,0 +1,172 @@
+"""
+Download log: who downloaded which book in which format, when, and with what kind of client, for
+libraries shared between several people. Users see their own history (GET /me/downloads);
+admins get totals per user, book, client and format (GET /admin/downloads/report).
+
+The client is classified from the User-Agent (classify_client), since e-readers and reading apps
+name themselves there. Titles and usernames are stored with each download, so the history still
+reads well after a book is deleted. Entries are kept in a small SQLite database
+(SHELFSTONE_DOWNLOAD_LOG_DB, in the state directory by default; see state_store) for
+RETENTION_DAYS days.
+"""
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, List, Optional
+
+from . import state_store
+from .state_store import library_key as _library_key
+
+_lock = threading.Lock()
+
+RETENTION_DAYS = 365
+MAX_USER_AGENT_LENGTH = 500
+
+# (client, what its User-Agent contains), checked in order: KOReader on a Kobo names both.
+CLIENTS = [
+    ("KOReader", "koreader"),
+    ("Kobo", "kobo"),
+    ("Kindle", "kindle"),
+    ("PocketBook", "pocketbook"),
+    ("Calibre", "calibre"),
+    ("Thorium", "thorium"),
+    ("browser", "mozilla/"),
+]
+OTHER = "other"
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: the log.
+    (
+        "CREATE TABLE downloads ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, username TEXT, library TEXT NOT NULL, "
+        "book_id INTEGER NOT NULL, title TEXT, format TEXT NOT NULL, converted INTEGER NOT NULL, "
+        "client TEXT NOT NULL, user_agent TEXT, downloaded_at REAL NOT NULL)",
+        "CREATE INDEX downloads_user ON downloads (user_id, id)",
+        "CREATE INDEX downloads_time ON downloads (downloaded_at)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_DOWNLOAD_LOG_DB", "download_log.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+def classify_client(user_agent: Optional[str]) -> str:
+    """The kind of client a User-Agent belongs to: one of CLIENTS' names, or "other"."""
+    user_agent = (user_agent or "").lower()
+    for client, marker in CLIENTS:
+        if marker in user_agent:
+            return client
+    return OTHER
+
+
+def record(book: Dict[str, Any], fmt: str, user: Optional[Dict[str, Any]] = None, user_agent: Optional[str] = None,
+           converted: bool = False, library_path: Optional[str] = None) -> None:
+    """Logs a download of the book by the user (None for the admin token or a server without accounts)."""
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute(
+                    "INSERT INTO downloads (user_id, username, library, book_id, title, format, converted, client, "
+                    "user_agent, downloaded_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+                    (user["id"] if user else None, user["username"] if user else None, _library_key(library_path),
+                     book["id"], book.get("title"), fmt.upper(), int(converted), classify_client(user_agent),
+                     (user_agent or "")[:MAX_USER_AGENT_LENGTH] or None, now))
+                # Old entries are dropped here rather than by a cleanup job.
+                conn.execute("DELETE FROM downloads WHERE downloaded_at < ?", (now - RETENTION_DAYS * 86400,))
+        finally:
+            conn.close()
+
+
+_FIELDS = ("id", "book_id", "title", "format", "converted", "client", "user_agent", "downloaded_at")
+
+
+def user_downloads(user_id: int, limit: int = 50, offset: int = 0) -> Dict[str, Any]:
+    """The user's downloads in all libraries, newest first: {"total", "downloads"}."""
+    if not os.path.exists(db_path()):
+        return {"total": 0, "downloads": []}
+    with _lock:
+        conn = connect()
+        try:
+            total = conn.execute("SELECT COUNT(*) FROM downloads WHERE user_id = ?", (user_id,)).fetchone()[0]
+            rows = conn.execute(f"SELECT {', '.join(_FIELDS)} FROM downloads WHERE user_id = ? "
+                                "ORDER BY id DESC LIMIT ? OFFSET ?", (user_id, limit, offset)).fetchall()
+        finally:
+            conn.close()
+    downloads = [dict(zip(_FIELDS, row)) for row in rows]
+    for download in downloads:
+        download["converted"] = bool(download["converted"])
+    return {"total": total, "downloads": downloads}
+
+
+def report(since: Optional[float] = None, until: Optional[float] = None, library_path: Optional[str] = None,
+           top: int = 10) -> Dict[str, Any]:
+    """
+    Download totals in the library between since and until (Unix times, both optional): overall,
+    per user, per client and per format, and the `top` most downloaded books.
+    """
+    result: Dict[str, Any] = {"total": 0, "users": [], "clients": [], "formats": [], "books": []}
+    if not os.path.exists(db_path()):
+        return result
+    where, params = "library = ?", (_library_key(library_path),)
+    if since is not None:
+        where, params = where + " AND downloaded_at >= ?", params + (since,)
+    if until is not None:
+        where, params = where + " AND downloaded_at < ?", params + (until,)
+    with _lock:
+        conn = connect()
+        try:
+            result["total"] = conn.execute(f"SELECT COUNT(*) FROM downloads WHERE {where}", params).fetchone()[0]
+            result["users"] = [
+                {"user_id": row[0], "username": row[1], "count": row[2]} for row in conn.execute(
+                    f"SELECT user_id, MAX(username), COUNT(*) FROM downloads WHERE {where} "
+                    "GROUP BY user_id ORDER BY COUNT(*) DESC, MAX(username)", params)]
+            for key in ("client", "format"):
+                # key is one of the two column names above.
+                result[key + "s"] = [{key: row[0], "count": row[1]} for row in conn.execute(
+                    f"SELECT {key}, COUNT(*) FROM downloads WHERE {where} GROUP BY {key} ORDER BY COUNT(*) DESC, {key}", params)]
+            result["books"] = [
+                {"book_id": row[0], "title": row[1], "count": row[2]} for row in conn.execute(
+                    f"SELECT book_id, MAX(title), COUNT(*) FROM downloads WHERE {where} "
+                    "GROUP BY book_id ORDER BY COUNT(*) DESC, book_id LIMIT ?", (*params, top))]
+        finally:
+            conn.close()
+    return result
+
+
+def export_user(user_id: int) -> List[Dict[str, Any]]:
+    """The user's whole download history, oldest first, in all libraries ("library" is "" for the default one)."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT library, {', '.join(_FIELDS)} FROM downloads WHERE user_id = ? ORDER BY id",
+                                (user_id,)).fetchall()
+        finally:
+            conn.close()
+    downloads = [dict(zip(("library", *_FIELDS), row)) for row in rows]
+    for download in downloads:
+        download["converted"] = bool(download["converted"])
+    return downloads
+
+def forget_user(user_id: int) -> None:
+    """Removes a deleted user's download history."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM downloads WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
@@ -0,0 +1,139 @@
+"""
+Duplicate detection beyond calibredb's own check, which only compares exact titles and authors.
+
+Files added through the server are recorded on their book with a hash of their content, as the
+identifier `import:<hash>` (introduced by the folder import, see library_import), so the same file
+is recognized when it arrives again under another name. Books without a recorded hash, e.g. added
+in Calibre itself, are compared by a fingerprint of their normalized title and authors, which
+ignores case, accents, punctuation, leading articles, subtitles and the order of name parts.
+
+Calibre keeps all formats of a work on one book record. A new file whose fingerprint matches a
+book without that format yet (e.g. the MOBI of a book that has an EPUB) is attached to that book
+with attach_as_format instead of becoming a second book.
+"""
+import hashlib
+import logging
+import os
+import re
+import unicodedata
+from typing import Any, Dict, List, Optional
+
+from . import metadata
+from .calibre_cli import CalibreCLIError
+from .crud import add_format, as_list, escape_search_value, list_books
+
+logger = logging.getLogger(__name__)
+
+HASH_IDENTIFIER = "import"
+HASH_CHARS = 32
+SAME_FILE, SAME_TITLE_AUTHOR = "same_file", "same_title_author"
+
+_LEADING_ARTICLE = re.compile(r"^(the|a|an|der|die|das|le|la|les|el|los|las|il)\s+", re.IGNORECASE)
+_SUBTITLE = re.compile(r"\s*[:(\[].*$")
+
+
+def file_hash(path: str) -> str:
+    digest = hashlib.sha256()
+    with open(path, "rb") as f:
+        for chunk in iter(lambda: f.read(1024 * 1024), b""):
+            digest.update(chunk)
+    return digest.hexdigest()[:HASH_CHARS]
+
+
+def _simplify(text: str) -> str:
+    text = unicodedata.normalize("NFKD", text or "")
+    text = "".join(c for c in text if not unicodedata.combining(c)).lower()
+    return " ".join(re.sub(r"[^\w\s]", " ", text).split())
+
+
+def fingerprint(title: Optional[str], authors: Any) -> Optional[str]:
+    """
+    A key equal for "The Hobbit: or There and Back Again" by "Tolkien, J.R.R." and "Hobbit" by
+    "J. R. R. Tolkien". None if the title is empty.
+    """
+    title_key = _LEADING_ARTICLE.sub("", _simplify(_SUBTITLE.sub("", title or "")))
+    if not title_key:
+        return None
+    # Name parts sorted, so "Tolkien, J.R.R." and "J. R. R. Tolkien" match.
+    author_keys = sorted(" ".join(sorted(_simplify(a).split())) for a in as_list(authors, "authors"))
+    return f"{title_key}|{';'.join(author_keys)}"
+
+
+def find_by_hash(digest: str, library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """Books recorded with this content hash."""
+    books = list_books(library_path=library_path, search_query=f'identifiers:"={HASH_IDENTIFIER}:={digest}"')
+    return [b for b in books if (b.get("identifiers") or {}).get(HASH_IDENTIFIER) == digest]
+
+
+def find_duplicates(books: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+    """
+    Groups of suspected duplicates among the books: books with the same content hash, then books
+    with the same title/author fingerprint that aren't already grouped by hash.
+    Returns [{"reason", "key", "books"}], each group with two or more books.
+    """
+    by_hash: Dict[str, List[Dict[str, Any]]] = {}
+    by_fingerprint: Dict[str, List[Dict[str, Any]]] = {}
+    for book in books:
+        digest = (book.get("identifiers") or {}).get(HASH_IDENTIFIER)
+        if digest:
+            by_hash.setdefault(digest, []).append(book)
+        key = fingerprint(book.get("title"), book.get("authors"))
+        if key:
+            by_fingerprint.setdefault(key, []).append(book)
+
+    groups = [{"reason": SAME_FILE, "key": digest, "books": group} for digest, group in by_hash.items() if len(group) > 1]
+    hashed_sets = [{b["id"] for b in g["books"]} for g in groups]
+    for key, group in by_fingerprint.items():
+        ids = {b["id"] for b in group}
+        if len(group) > 1 and not any(ids <= hashed for hashed in hashed_sets):
+            groups.append({"reason": SAME_TITLE_AUTHOR, "key": key, "books": group})
+    return groups
+
+
+def _format_names(book: Dict[str, Any]) -> List[str]:
+    formats = book.get("formats") or []
+    if isinstance(formats, str):
+        formats = formats.split(",")
+    return [os.path.splitext(f.strip())[1][1:].upper() or f.strip().upper() for f in formats if f.strip()]
+
+
+def find_format_target(title: Optional[str], authors: Any, fmt: str,
+                       library_path: Optional[str] = None) -> Optional[Dict[str, Any]]:
+    """The first book with this title/author fingerprint that has no file of the format yet, or None."""
+    key = fingerprint(title, authors)
+    if key is None:
+        return None
+    # calibredb's title search is a case-insensitive substring match; the fingerprint decides.
+    core = _LEADING_ARTICLE.sub("", _SUBTITLE.sub("", title or "").strip())
+    books = list_books(library_path=library_path, search_query=f'title:"{escape_search_value(core)}"')
+    return next((b for b in books
+                 if fingerprint(b.get("title"), b.get("authors")) == key and fmt.upper() not in _format_names(b)), None)
+
+
+def attach_as_format(file_path: str, library_path: Optional[str] = None, title: Optional[str] = None,
+                     authors: Any = None) -> Optional[int]:
+    """
+    Adds the file as a new format of the matching book (see find_format_target). Title and authors
+    are read from the file unless given. Returns the book's ID, or None if no book matches or the
+    file's metadata can't be read.
+
+    Raises:
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If the library can't be searched or calibredb add_format fails.
+    """
+    fmt = os.path.splitext(file_path)[1][1:].upper()
+    if not fmt:
+        return None
+    if not title:
+        try:
+            extracted = metadata.read_file_metadata(file_path)
+        except (FileNotFoundError, CalibreCLIError, ValueError) as e:
+            logger.info(f"Not matching '{file_path}' to existing books: cannot read its metadata: {e}")
+            return None
+        title, authors = extracted.get("title"), authors or extracted.get("authors")
+    book = find_format_target(title, authors, fmt, library_path=library_path)
+    if book is None:
+        return None
+    add_format(book["id"], file_path, library_path=library_path)
+    logger.info(f"Added '{os.path.basename(file_path)}' as the {fmt} format of book ID {book['id']}.")
+    return book["id"]
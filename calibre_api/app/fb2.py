@@ -0,0 +1,164 @@
+"""
+Native reading of FictionBook 2 files (FB2, and FBZ / .fb2.zip archives holding one), a format
+common in Russian and other Eastern European libraries. FB2 is plain XML with the cover embedded
+as base64, so metadata and cover are read directly instead of through `ebook-meta`.
+"""
+import base64
+import binascii
+import html
+import mimetypes
+import os
+import zipfile
+import xml.etree.ElementTree as ET
+from typing import Any, Dict, Optional, Tuple
+
+FB2_EXTENSIONS = (".fb2", ".fbz", ".fb2.zip")
+
+
+def is_fb2_path(path: str) -> bool:
+    return path.lower().endswith(FB2_EXTENSIONS)
+
+
+def read_fb2_bytes(path: str) -> bytes:
+    """The FB2 document of a file, unpacking the first .fb2 member of an FBZ archive."""
+    if zipfile.is_zipfile(path):
+        with zipfile.ZipFile(path) as archive:
+            member = next((n for n in archive.namelist() if n.lower().endswith(".fb2")), None)
+            if member is None:
+                raise ValueError(f"'{os.path.basename(path)}' contains no .fb2 file.")
+            return archive.read(member)
+    with open(path, "rb") as f:
+        return f.read()
+
+
+def _parse(content: bytes) -> ET.Element:
+    try:
+        root = ET.fromstring(content)
+    except ET.ParseError as e:
+        raise ValueError(f"Invalid FB2 document: {e}")
+    # FB2 files use the FictionBook namespace, or none at all; compare local names only.
+    for element in root.iter():
+        if isinstance(element.tag, str):
+            element.tag = element.tag.rsplit("}", 1)[-1]
+    if root.tag != "FictionBook":
+        raise ValueError("Not an FB2 document (the root element is not <FictionBook>).")
+    return root
+
+
+def _text(element: Optional[ET.Element]) -> Optional[str]:
+    if element is None:
+        return None
+    text = " ".join("".join(element.itertext()).split())
+    return text or None
+
+
+def _href(element: ET.Element) -> Optional[str]:
+    # The attribute is xlink:href or l:href, depending on the namespace prefix in use.
+    return next((value for key, value in element.attrib.items() if key.rsplit("}", 1)[-1] == "href"), None)
+
+
+def _author_name(author: ET.Element) -> Optional[str]:
+    parts = [_text(author.find(tag)) for tag in ("first-name", "middle-name", "last-name")]
+    return " ".join(p for p in parts if p) or _text(author.find("nickname"))
+
+
+def _annotation_html(annotation: Optional[ET.Element]) -> Optional[str]:
+    if annotation is None:
+        return None
+    paragraphs = [_text(p) for p in annotation.iter("p")] or [_text(annotation)]
+    return "".join(f"<p>{html.escape(p)}</p>" for p in paragraphs if p) or None
+
+
+def parse_fb2(content: bytes) -> Dict[str, Any]:
+    """
+    Parses an FB2 document's <description> into a dict with the same field names as the Book
+    model. Only fields present in the document are included.
+
+    Raises:
+        ValueError: If the content is not well-formed FB2.
+    """
+    root = _parse(content)
+    result: Dict[str, Any] = {}
+    title_info = root.find("description/title-info")
+    if title_info is None:
+        return result
+
+    title = _text(title_info.find("book-title"))
+    if title:
+        result["title"] = title
+    authors = [name for name in (_author_name(a) for a in title_info.findall("author")) if name]
+    if authors:
+        result["authors"] = authors
+    genres = [g for g in (_text(e) for e in title_info.findall("genre")) if g]
+    if genres:
+        result["tags"] = genres
+    language = _text(title_info.find("lang"))
+    if language:
+        result["languages"] = [language]
+    comments = _annotation_html(title_info.find("annotation"))
+    if comments:
+        result["comments"] = comments
+    sequence = title_info.find("sequence")
+    if sequence is not None and sequence.get("name", "").strip():
+        result["series"] = sequence.get("name").strip()
+        try:
+            result["series_index"] = float(sequence.get("number", ""))
+        except ValueError:
+            pass
+    date = title_info.find("date")
+    if date is not None and (date.get("value") or _text(date)):
+        result["pubdate"] = date.get("value") or _text(date)
+
+    publish_info = root.find("description/publish-info")
+    if publish_info is not None:
+        publisher = _text(publish_info.find("publisher"))
+        if publisher:
+            result["publisher"] = publisher
+        isbn = _text(publish_info.find("isbn"))
+        if isbn:
+            result["isbn"] = isbn
+            result["identifiers"] = {"isbn": isbn}
+        year = _text(publish_info.find("year"))
+        if year and "pubdate" not in result:
+            result["pubdate"] = year
+    return result
+
+
+def extract_cover(content: bytes) -> Optional[Tuple[bytes, str]]:
+    """
+    Returns (image bytes, content type) of the cover referenced by <coverpage>, or None.
+
+    Raises:
+        ValueError: If the content is not well-formed FB2.
+    """
+    root = _parse(content)
+    image = root.find("description/title-info/coverpage/image")
+    href = _href(image) if image is not None else None
+    if not href or not href.startswith("#"):
+        return None
+    for binary in root.findall("binary"):
+        if binary.get("id") == href[1:]:
+            try:
+                data = base64.b64decode("".join((binary.text or "").split()), validate=True)
+            except (binascii.Error, ValueError):
+                return None
+            return data, binary.get("content-type") or mimetypes.guess_type(href[1:])[0] or "image/jpeg"
+    return None
+
+
+def read_metadata(path: str) -> Dict[str, Any]:
+    """parse_fb2 for a file on disk."""
+    return parse_fb2(read_fb2_bytes(path))
+
+
+def write_cover(path: str, output_dir: str) -> Optional[str]:
+    """Writes the book's cover to output_dir and returns its path, or None if it has no cover."""
+    cover = extract_cover(read_fb2_bytes(path))
+    if cover is None:
+        return None
+    data, content_type = cover
+    extension = mimetypes.guess_extension(content_type) or ".jpg"
+    cover_path = os.path.join(output_dir, "cover" + (".jpg" if extension == ".jpe" else extension))
+    with open(cover_path, "wb") as f:
+        f.write(data)
+    return cover_path
@@ -0,0 +1,170 @@
+"""
+Feature flags, so risky subsystems can ship switched off and be toggled per deployment without a
+rebuild.
+
+A flag's value comes from, first match wins: an override set at runtime with
+PUT /admin/features/{name} (stored in the settings table, see settings_store), the
+SHELFSTONE_FEATURES setting (e.g. "fulltext=off,metadata_fetch=on"), and the flag's default.
+Experimental features default to off; SHELFSTONE_EXPERIMENTAL=1 turns them all on by default.
+
+Requests to the routes of a disabled feature get 403 from FeatureFlagMiddleware; features
+without routes of their own are checked where they are used (require()).
+"""
+import json
+import logging
+import os
+from typing import Any, Dict, List, NamedTuple, Optional, Tuple
+
+from . import settings_store
+
+logger = logging.getLogger(__name__)
+
+SETTINGS_PREFIX = "feature."
+TRUE_VALUES = ("1", "true", "yes", "on")
+FALSE_VALUES = ("0", "false", "no", "off")
+
+
+class Feature(NamedTuple):
+    name: str
+    description: str
+    default: bool = True
+    experimental: bool = False
+    # Routes that only exist for this feature.
+    path_prefixes: Tuple[str, ...] = ()
+
+
+FEATURES: List[Feature] = [
+    Feature("fulltext", "Full-text index and search of book contents (/search/fulltext*, text=true in /search/).",
+            path_prefixes=("/search/fulltext",)),
+    Feature("sync", "Sync bundles for mobile apps (/sync/*).", path_prefixes=("/sync/",)),
+    Feature("conversion", "Converting books on the fly for downloads and sending to devices in formats they don't have."),
+    Feature("public_catalogs", "Publishing shelves as public catalogs anyone can read without signing in (/public/*).",
+            default=False, path_prefixes=("/public/",)),
+    Feature("metadata_fetch", "Looking books up on Google Books and Open Library (/books/{id}/metadata/fetch).",
+            default=False, experimental=True),
+]
+_BY_NAME: Dict[str, Feature] = {f.name: f for f in FEATURES}
+
+
+class FeatureDisabled(Exception):
+    """The feature is switched off. args[0] says how to turn it on."""
+
+
+class UnknownFeature(Exception):
+    """No feature has this name."""
+
+
+def _parse_bool(value: str) -> bool:
+    if value.strip().lower() in TRUE_VALUES:
+        return True
+    if value.strip().lower() in FALSE_VALUES:
+        return False
+    raise ValueError(f"'{value}' is not on or off")
+
+
+def parse_flags(value: Optional[str]) -> Dict[str, bool]:
+    """
+    Parses "name=on,other=off" into {name: bool}.
+
+    Raises:
+        ValueError: For unknown features and values other than on/off, true/false, yes/no, 1/0.
+    """
+    flags: Dict[str, bool] = {}
+    for entry in (value or "").split(","):
+        if not entry.strip():
+            continue
+        name, sep, state = entry.partition("=")
+        name = name.strip().lower()
+        if not sep or name not in _BY_NAME:
+            raise ValueError(f"invalid entry '{entry.strip()}'; expected name=on|off with name one of {', '.join(_BY_NAME)}")
+        flags[name] = _parse_bool(state)
+    return flags
+
+
+def parse_experimental(value: str) -> bool:
+    return _parse_bool(value)
+
+
+def get(name: str) -> Feature:
+    if name not in _BY_NAME:
+        raise UnknownFeature(f"Unknown feature '{name}'. Known features: {', '.join(_BY_NAME)}.")
+    return _BY_NAME[name]
+
+
+def statuses() -> List[Dict[str, Any]]:
+    """Every feature with its current state and where the state comes from ("override", "config" or "default")."""
+    configured = parse_flags(os.environ.get("SHELFSTONE_FEATURES"))
+    overrides = settings_store.get_all(SETTINGS_PREFIX)
+    experimental_on = _parse_bool(os.environ.get("SHELFSTONE_EXPERIMENTAL") or "off")
+    result = []
+    for feature in FEATURES:
+        default = feature.default or (feature.experimental and experimental_on)
+        if SETTINGS_PREFIX + feature.name in overrides:
+            enabled, source = bool(overrides[SETTINGS_PREFIX + feature.name]), "override"
+        elif feature.name in configured:
+            enabled, source = configured[feature.name], "config"
+        else:
+            enabled, source = default, "default"
+        result.append({"name": feature.name, "description": feature.description, "enabled": enabled,
+                       "default": default, "experimental": feature.experimental, "source": source})
+    return result
+
+
+def status(name: str) -> Dict[str, Any]:
+    get(name)
+    return next(s for s in statuses() if s["name"] == name)
+
+
+def is_enabled(name: str) -> bool:
+    return status(name)["enabled"]
+
+
+def require(name: str) -> None:
+    """
+    Raises:
+        FeatureDisabled: If the feature is switched off.
+    """
+    if not is_enabled(name):
+        raise FeatureDisabled(f"The '{name}' feature is disabled on this server. Enable it with SHELFSTONE_FEATURES={name}=on "
+                              f"or PUT /admin/features/{name}.")
+
+
+def set_override(name: str, enabled: bool) -> Dict[str, Any]:
+    get(name)
+    settings_store.put(SETTINGS_PREFIX + name, enabled)
+    logger.warning(f"Feature '{name}' turned {'on' if enabled else 'off'} at runtime.")
+    return status(name)
+
+
+def clear_override(name: str) -> Dict[str, Any]:
+    get(name)
+    settings_store.delete(SETTINGS_PREFIX + name)
+    logger.info(f"Runtime override of feature '{name}' removed.")
+    return status(name)
+
+
+def feature_for_path(path: str) -> Optional[str]:
+    return next((f.name for f in FEATURES if f.path_prefixes and path.startswith(f.path_prefixes)), None)
+
+
+class FeatureFlagMiddleware:
+    """ASGI middleware that answers requests to the routes of disabled features with 403."""
+
+    def __init__(self, app):
+        self.app = app
+
+    async def __call__(self, scope, receive, send):
+        name = feature_for_path(scope["path"]) if scope["type"] == "http" else None
+        try:
+            if name is not None:
+                require(name)
+        except FeatureDisabled as e:
+            body = json.dumps({"detail": e.args[0]}).encode()
+            await send({
+                "type": "http.response.start",
+                "status": 403,
+                "headers": [(b"content-type", b"application/json"), (b"content-length", str(len(body)).encode())],
+            })
+            await send({"type": "http.response.body", "body": body})
+            return
+        await self.app(scope, receive, send)
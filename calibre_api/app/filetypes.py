@@ -0,0 +1,131 @@
+import os
+from typing import List, Optional
+
+from . import formats as format_registry
+
+# Number of leading bytes needed by sniff_ebook_format. MOBI-family files carry
+# their signature at offset 60, and FB2/HTML may start with a long XML prolog.
+SNIFF_BYTES = 4096
+
+# (offset, signature, format name). ZIP and plain-text based formats are handled separately.
+_SIGNATURES = [
+    (0, b"%PDF-", "PDF"),
+    (60, b"BOOKMOBI", "MOBI"),
+    (60, b"TEXtREAd", "PDB"),
+    (60, b"PNRdPPrs", "PDB"),
+    (0, b"AT&TFORM", "DJVU"),
+    (0, b"{\\rtf", "RTF"),
+    (0, b"ITOLITLS", "LIT"),
+    (0, b"L\x00R\x00F\x00", "LRF"),
+    (0, b"CONT\x02\x00", "KFX"),
+    (0, b"Rar!\x1a\x07", "CBR"),
+    (0, b"7z\xbc\xaf\x27\x1c", "CB7"),
+    (0, b"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "DOC"),
+]
+
+
+def _sniff_zip(head: bytes) -> str:
+    """
+    Distinguishes ZIP-based formats by the first member name where possible.
+    EPUB/ODT put an uncompressed `mimetype` first; everything else is reported as ZIP
+    (which Calibre handles as CBZ, DOCX, HTMLZ, TXTZ, KFX-ZIP or a zipped e-book).
+    """
+    # The local file header stores the first member's name at offset 30.
+    name_length = int.from_bytes(head[26:28], "little")
+    first_name = head[30:30 + name_length]
+    if first_name == b"mimetype":
+        data_start = 30 + name_length + int.from_bytes(head[28:30], "little")
+        if head[data_start:data_start + 20] == b"application/epub+zip":
+            return "EPUB"
+        if head[data_start:data_start + 39].startswith(b"application/vnd.oasis.opendocument.text"):
+            return "ODT"
+    return "ZIP"
+
+
+def _looks_like_text(head: bytes) -> bool:
+    # Plain text in any 8-bit encoding (UTF-8, cp1252, ...) has no NUL bytes and
+    # hardly any control characters besides tab, newline, carriage return and form feed.
+    if b"\x00" in head:
+        return False
+    control = sum(1 for b in head if b < 0x20 and b not in (0x09, 0x0a, 0x0c, 0x0d, 0x1b))
+    return control <= len(head) // 100
+
+
+def sniff_ebook_format(head: bytes) -> Optional[str]:
+    """
+    Identifies an e-book format from the first SNIFF_BYTES bytes of a file by its magic bytes.
+
+    Returns:
+        A format name such as "EPUB", "PDF", "MOBI", "FB2", "HTML", "TXT" or "ZIP",
+        or None if the bytes don't look like any format Calibre can import.
+    """
+    if not head:
+        return None
+    if head.startswith(b"PK\x03\x04"):
+        return _sniff_zip(head)
+    for offset, signature, name in _SIGNATURES:
+        if head[offset:offset + len(signature)] == signature:
+            return name
+    if _looks_like_text(head):
+        text = head.decode("utf-8", errors="ignore").lstrip("\ufeff \t\r\n").lower()
+        if "<fictionbook" in text:
+            return "FB2"
+        if text.startswith("<!doctype html") or text.startswith("<html") or "<html" in text[:1024]:
+            return "HTML"
+        return "TXT"
+    return None
+
+
+class UnsupportedFileType(ValueError):
+    """Raised when a file's content doesn't match any e-book format Calibre can import."""
+
+
+def check_ebook_bytes(head: bytes, filename: str = "") -> str:
+    """
+    Returns the sniffed format of a file from its leading bytes.
+
+    Raises:
+        UnsupportedFileType: If the content is not a recognised e-book format.
+    """
+    fmt = sniff_ebook_format(head[:SNIFF_BYTES])
+    if fmt is None:
+        raise UnsupportedFileType(f"'{filename}' does not look like a supported e-book file (unrecognised file content).")
+    return fmt
+
+
+def check_ebook_file(path: str) -> str:
+    """
+    Like check_ebook_bytes, for a file on disk.
+    """
+    with open(path, "rb") as f:
+        return check_ebook_bytes(f.read(SNIFF_BYTES), filename=os.path.basename(path))
+
+
+# Extensions under which a sniffed format is recorded correctly by Calibre. KFX books bought from
+# Amazon are often saved as .azw, which Calibre would record (and try to convert) as MOBI; FB2 and
+# DjVu files downloaded from some libraries come as .xml or without an extension.
+_RECORDED_FORMATS = {"KFX", "FB2", "DJVU"}
+
+
+def storage_filename(filename: str, sniffed_format: str) -> str:
+    """The filename to hand to Calibre: with the format's extension for KFX, FB2 or DjVu content saved under another one."""
+    if sniffed_format in _RECORDED_FORMATS:
+        return format_registry.with_extension(filename, sniffed_format)
+    return filename
+
+
+def book_format_names(book_dict: dict) -> List[str]:
+    """
+    Returns the upper-case format names (e.g. ["EPUB", "PDF"]) of a book dict from `calibredb list`.
+    calibredb reports formats as full paths to the format files; plain names are accepted as well.
+    """
+    formats = book_dict.get('formats') or []
+    if isinstance(formats, str):
+        formats = [f.strip() for f in formats.split(',') if f.strip()]
+    names = []
+    for entry in formats:
+        _, ext = os.path.splitext(entry)
+        name = (ext[1:] if ext else entry).upper()
+        if name and name not in names:
+            names.append(name)
+    return names
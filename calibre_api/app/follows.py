@@ -0,0 +1,272 @@
+"""
+Following authors and series. When a new book by a followed author or in a followed series is
+added to a library, the follower gets a notification in their inbox (see notifications) and, for
+follows with `email` set, an email as well, if they gave an email address and sending mail is
+configured (the SMTP settings of delivery). Needs user accounts (see accounts).
+
+Follows span all libraries, but followers only hear of books their account may see (its library
+and tag restrictions), and not of the books they added themselves. Names match case-insensitively;
+a book with several authors matches a follow of any of them. Follows are kept in a small SQLite
+database (SHELFSTONE_FOLLOWS_DB, in the state directory by default; see state_store).
+"""
+import logging
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Callable, Dict, List, Optional
+
+from . import accounts
+from . import calibre_cli
+from . import crud
+from . import delivery
+from . import notifications
+from . import state_store
+from .state_store import library_key as _library_key
+
+logger = logging.getLogger(__name__)
+
+_lock = threading.Lock()
+
+AUTHOR = "author"
+SERIES = "series"
+KINDS = (AUTHOR, SERIES)
+MAX_NAME_LENGTH = 500
+MAX_FOLLOWS_PER_USER = 500
+
+
+class FollowNotFound(Exception):
+    """The user has no follow with this ID."""
+
+
+class FollowExists(Exception):
+    """The user already follows this author or series."""
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: follows; name_key is the case-folded name they match on.
+    (
+        "CREATE TABLE follows ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, kind TEXT NOT NULL, name TEXT NOT NULL, "
+        "name_key TEXT NOT NULL, email INTEGER NOT NULL DEFAULT 0, created_at REAL NOT NULL, "
+        "UNIQUE (user_id, kind, name_key))",
+        "CREATE INDEX follows_name ON follows (kind, name_key)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_FOLLOWS_DB", "follows.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+def _key(name: str) -> str:
+    return " ".join(name.split()).casefold()
+
+
+_COLUMNS = ("id", "kind", "name", "email", "created_at")
+_SELECT = f"SELECT {', '.join(_COLUMNS)} FROM follows"
+
+
+def _row(row: tuple) -> Dict[str, Any]:
+    follow = dict(zip(_COLUMNS, row))
+    follow["email"] = bool(follow["email"])
+    return follow
+
+
+def _get(conn: sqlite3.Connection, user_id: int, follow_id: int) -> Dict[str, Any]:
+    row = conn.execute(f"{_SELECT} WHERE id = ? AND user_id = ?", (follow_id, user_id)).fetchone()
+    if row is None:
+        raise FollowNotFound(f"Follow {follow_id} not found.")
+    return _row(row)
+
+
+def list_follows(user_id: int) -> List[Dict[str, Any]]:
+    """The authors and series the user follows, by kind and name."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"{_SELECT} WHERE user_id = ? ORDER BY kind, name_key", (user_id,)).fetchall()
+        finally:
+            conn.close()
+    return [_row(row) for row in rows]
+
+
+def follow(user_id: int, kind: str, name: str, email: bool = False) -> Dict[str, Any]:
+    """
+    Raises:
+        ValueError: For an unknown kind, an empty or too long name, or too many follows.
+        FollowExists: If the user already follows it.
+    """
+    if kind not in KINDS:
+        raise ValueError(f"Unknown kind '{kind}'; use {' or '.join(KINDS)}.")
+    name = " ".join((name or "").split())
+    if not name:
+        raise ValueError(f"Give the name of the {kind} to follow.")
+    if len(name) > MAX_NAME_LENGTH:
+        raise ValueError(f"The name must be at most {MAX_NAME_LENGTH} characters.")
+    with _lock:
+        conn = connect()
+        try:
+            if conn.execute("SELECT COUNT(*) FROM follows WHERE user_id = ?", (user_id,)).fetchone()[0] >= MAX_FOLLOWS_PER_USER:
+                raise ValueError(f"You can follow at most {MAX_FOLLOWS_PER_USER} authors and series.")
+            try:
+                with conn:
+                    follow_id = conn.execute(
+                        "INSERT INTO follows (user_id, kind, name, name_key, email, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+                        (user_id, kind, name, _key(name), int(email), time.time())).lastrowid
+            except sqlite3.IntegrityError:
+                raise FollowExists(f"You already follow the {kind} '{name}'.")
+            return _get(conn, user_id, follow_id)
+        finally:
+            conn.close()
+
+
+def set_email(user_id: int, follow_id: int, email: bool) -> Dict[str, Any]:
+    """
+    Turns emails for a follow on or off.
+
+    Raises:
+        FollowNotFound: If the user has no such follow.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, user_id, follow_id)
+            with conn:
+                conn.execute("UPDATE follows SET email = ? WHERE id = ?", (int(email), follow_id))
+            return _get(conn, user_id, follow_id)
+        finally:
+            conn.close()
+
+
+def unfollow(user_id: int, follow_id: int) -> None:
+    """
+    Raises:
+        FollowNotFound: If the user has no such follow.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, user_id, follow_id)
+            with conn:
+                conn.execute("DELETE FROM follows WHERE id = ?", (follow_id,))
+        finally:
+            conn.close()
+
+
+def followers(book: Dict[str, Any]) -> Dict[int, List[Dict[str, Any]]]:
+    """The users following an author or the series of a calibredb book entry, with their matching follows."""
+    if not os.path.exists(db_path()):
+        return {}
+    keys = [(AUTHOR, _key(author)) for author in crud.as_list(book.get("authors"), "authors")]
+    if book.get("series"):
+        keys.append((SERIES, _key(book["series"])))
+    if not keys:
+        return {}
+    matches: Dict[int, List[Dict[str, Any]]] = {}
+    with _lock:
+        conn = connect()
+        try:
+            for kind, key in keys:
+                for row in conn.execute(f"SELECT user_id, {', '.join(_COLUMNS)} FROM follows WHERE kind = ? AND name_key = ?",
+                                        (kind, key)).fetchall():
+                    matches.setdefault(row[0], []).append(_row(row[1:]))
+        finally:
+            conn.close()
+    return matches
+
+
+def forget_user(user_id: int) -> None:
+    """Removes a deleted user's follows."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM follows WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
+
+
+def export_user(user_id: int) -> List[Dict[str, Any]]:
+    """The user's follows, for an account export."""
+    return list_follows(user_id)
+
+
+# --- Announcing new books ---
+
+def can_see(user: Dict[str, Any], book: Dict[str, Any], library_path: Optional[str]) -> bool:
+    """Whether the user's library and tag restrictions (see accounts) let them see the book."""
+    if user.get("libraries") is not None and _library_key(library_path) not in user["libraries"]:
+        return False
+    if user.get("tags") is not None:
+        allowed = {tag.casefold() for tag in user["tags"]}
+        return any(tag.casefold() in allowed for tag in crud.as_list(book.get("tags")))
+    return True
+
+
+def _message(book: Dict[str, Any], matched: List[Dict[str, Any]]) -> str:
+    reasons = [f"the {f['kind']} {f['name']}" for f in matched]
+    authors = " & ".join(crud.as_list(book.get("authors"), "authors"))
+    return f"'{book.get('title') or 'Untitled'}'{' by ' + authors if authors else ''} was added to the library. You follow {' and '.join(reasons)}."
+
+
+def _email(user: Dict[str, Any], subject: str, body: str, send: Callable[..., Any]) -> None:
+    try:
+        success, error = send(recipient_email=user["email"], subject=subject, body=body, **delivery.smtp_settings())
+    except delivery.SendingNotConfigured:
+        logger.info(f"Not emailing user {user['id']} about a followed book: sending mail is not configured.")
+        return
+    except Exception as e:
+        success, error = False, str(e)
+    if not success:
+        logger.error(f"Emailing user {user['id']} about a followed book failed: {error}")
+
+
+def _announce(book_ids: List[int], library_path: Optional[str], added_by: Optional[int],
+              send: Callable[..., Any]) -> None:
+    # The thread doesn't run in a request, so the lookup isn't limited to any user's tags.
+    crud.restricted_tags.set(None)
+    try:
+        books = crud.list_books(library_path=library_path, search_query=" or ".join(f"id:{i}" for i in book_ids))
+    except Exception as e:
+        logger.error(f"Could not look up new book(s) {book_ids} to tell their followers: {e}")
+        return
+    for book in books:
+        if book.get("id") not in book_ids:
+            continue
+        for user_id, matched in followers(book).items():
+            if user_id == added_by:
+                continue
+            try:
+                user = accounts.get_user(user_id)
+            except accounts.UserNotFound:
+                continue
+            if user["disabled"] or not can_see(user, book, library_path):
+                continue
+            title = f"New: {book.get('title') or 'Untitled'}"
+            message = _message(book, matched)
+            notifications.notify(user_id, notifications.FOLLOWED_BOOK, title, message,
+                                 book_id=book["id"], library_path=library_path)
+            if user.get("email") and any(f["email"] for f in matched):
+                _email(user, title, message, send)
+
+
+def announce(book_ids: List[int], library_path: Optional[str] = None, added_by: Optional[int] = None,
+             send: Callable[..., Any] = calibre_cli.send_email_with_calibre_smtp) -> None:
+    """
+    Tells the followers of the new books' authors and series about them, in the background.
+    `added_by` is the user who added them, who isn't told.
+    """
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    threading.Thread(target=_announce, args=(list(book_ids), library_path, added_by, send),
+                     name="follows-announce", daemon=True).start()
@@ -0,0 +1,84 @@
+"""
+Registry of the e-book formats the server knows: file extensions, MIME type, display name and
+whether `ebook-convert` can write the format. Downloads, OPDS acquisition links, offline bundles
+and uploads all look formats up here, so a format is labelled the same everywhere.
+"""
+import os
+from typing import Dict, List, NamedTuple, Optional, Set, Tuple
+
+DEFAULT_MIME_TYPE = "application/octet-stream"
+
+
+class Format(NamedTuple):
+    name: str
+    # The first extension is the one files of this format are given.
+    extensions: Tuple[str, ...]
+    mime_type: str
+    display_name: str
+    # ebook-convert can write it and reading apps ask for it.
+    convertible: bool = False
+
+
+FORMATS: List[Format] = [
+    Format("EPUB", (".epub",), "application/epub+zip", "EPUB", True),
+    Format("KEPUB", (".kepub",), "application/kepub+zip", "Kobo EPUB"),
+    Format("AZW3", (".azw3",), "application/x-mobi8-ebook", "Kindle (AZW3)", True),
+    Format("MOBI", (".mobi", ".prc"), "application/x-mobipocket-ebook", "Mobipocket", True),
+    Format("AZW", (".azw",), "application/vnd.amazon.ebook", "Kindle (AZW)"),
+    Format("KFX", (".kfx", ".kfx-zip"), "application/vnd.amazon.ebook", "Kindle (KFX)"),
+    Format("PDF", (".pdf",), "application/pdf", "PDF", True),
+    Format("DJVU", (".djvu", ".djv"), "image/vnd.djvu", "DjVu"),
+    Format("FB2", (".fb2",), "application/x-fictionbook+xml", "FictionBook", True),
+    Format("FBZ", (".fbz", ".fb2.zip"), "application/x-zip-compressed-fb2", "FictionBook (zipped)"),
+    Format("CBZ", (".cbz",), "application/vnd.comicbook+zip", "Comic book (CBZ)"),
+    Format("CBR", (".cbr",), "application/vnd.comicbook-rar", "Comic book (CBR)"),
+    Format("CB7", (".cb7",), "application/x-cb7", "Comic book (CB7)"),
+    Format("DOCX", (".docx",), "application/vnd.openxmlformats-officedocument.wordprocessingml.document", "Word document", True),
+    Format("ODT", (".odt",), "application/vnd.oasis.opendocument.text", "OpenDocument text"),
+    Format("RTF", (".rtf",), "application/rtf", "Rich Text", True),
+    Format("TXT", (".txt",), "text/plain", "Plain text", True),
+    Format("TXTZ", (".txtz",), "application/x-txtz", "Zipped text", True),
+    Format("HTML", (".html", ".htm", ".xhtml"), "text/html", "HTML"),
+    Format("HTMLZ", (".htmlz",), "application/x-htmlz", "Zipped HTML", True),
+    Format("LIT", (".lit",), "application/x-ms-reader", "Microsoft Reader"),
+    Format("LRF", (".lrf",), "application/x-sony-bbeb", "Sony Reader (LRF)", True),
+    Format("PDB", (".pdb",), "application/vnd.palm", "Palm eReader", True),
+    Format("ZIP", (".zip",), "application/zip", "ZIP archive"),
+]
+_BY_NAME: Dict[str, Format] = {f.name: f for f in FORMATS}
+
+
+def get(name: str) -> Optional[Format]:
+    """The format for a name or extension, e.g. "azw3", "AZW3" or ".azw3"."""
+    return _BY_NAME.get((name or "").lstrip(".").upper())
+
+
+def from_filename(filename: str) -> Optional[Format]:
+    """The format of a file name, including double extensions such as .fb2.zip."""
+    lower = (filename or "").lower()
+    matches = [(ext, f) for f in FORMATS for ext in f.extensions if lower.endswith(ext)]
+    return max(matches, key=lambda m: len(m[0]))[1] if matches else None
+
+
+def mime_type(name: str) -> str:
+    """The MIME type for a format name or extension; application/octet-stream if unknown."""
+    fmt = get(name)
+    return fmt.mime_type if fmt else DEFAULT_MIME_TYPE
+
+
+def display_name(name: str) -> str:
+    fmt = get(name)
+    return fmt.display_name if fmt else (name or "").lstrip(".").upper()
+
+
+def output_formats() -> Set[str]:
+    """Names of the formats books can be converted to."""
+    return {f.name for f in FORMATS if f.convertible}
+
+
+def with_extension(filename: str, name: str) -> str:
+    """filename with the format's extension, unless it already has one of the format's extensions."""
+    fmt = get(name)
+    if fmt is None or filename.lower().endswith(fmt.extensions):
+        return filename
+    return os.path.splitext(filename)[0] + fmt.extensions[0]
@@ -0,0 +1,449 @@
+"""
+Optional full-text index of book contents, so searches can find words inside books
+("which of my books mention 'Trisolaris'?") rather than only in their metadata.
+
+The index is a separate SQLite FTS5 database (SHELFSTONE_FTS_DB); the Calibre library is
+never written to. Text is extracted per format: EPUBs are read directly, everything else
+(PDF, MOBI, AZW3, ...) is converted to plain text with `ebook-convert`. Indexing runs in a
+background thread and only re-reads books whose last_modified changed since the last run.
+
+The same database holds a small FTS5 index of titles, authors and series for GET /search.
+It is filled by every indexing run and kept current by explicit update calls after books
+are added, edited or removed through this server (see update_after_change).
+
+Chinese, Japanese and Korean are written without spaces between words, which SQLite's
+unicode61 tokenizer needs to find words. Their characters are therefore indexed one by one
+(see segment_cjk), and a CJK search term matches as a phrase of its characters.
+"""
+import html
+import os
+import posixpath
+import re
+import sqlite3
+import tempfile
+import threading
+import time
+import zipfile
+import logging
+import xml.etree.ElementTree as ET
+from typing import Any, Dict, List, Optional
+
+from . import calibre_cli
+from . import lifecycle
+from . import state_store
+from .crud import as_list, list_books
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_MAX_CHARS = 2_000_000
+# Formats are tried in this order; reflowable formats give the cleanest text.
+PREFERRED_FORMATS = ["EPUB", "AZW3", "MOBI", "FB2", "DOCX", "HTMLZ", "RTF", "TXT", "PDF", "DJVU"]
+
+_TAG_RE = re.compile(r"<[^>]+>")
+_SCRIPT_STYLE_RE = re.compile(r"<(script|style)\b.*?</\1>", re.IGNORECASE | re.DOTALL)
+_SPACE_RE = re.compile(r"\s+")
+_NS = {"c": "urn:oasis:names:tc:opendocument:xmlns:container", "opf": "http://www.idpf.org/2007/opf"}
+
+# Han (incl. extensions and compatibility ideographs), kana, bopomofo and Hangul.
+_CJK = "\u2e80-\u2fdf\u3040-\u30ff\u3100-\u312f\u3400-\u4dbf\u4e00-\u9fff\uac00-\ud7af\uf900-\ufaff\uff66-\uff9f\U00020000-\U0002fa1f"
+_CJK_GAP_RE = re.compile(f"(?<=[{_CJK}])(?=[{_CJK}])")
+# A zero-width space separates tokens for unicode61 but can be removed again without a trace,
+# unlike a normal space, which may have been in the original text.
+_SEGMENT_MARK = "\u200b"
+# Bumped when the way text is stored changes; older indexes are refreshed (see connect).
+SCHEMA_VERSION = 1
+
+
+def index_db_path() -> str:
+    return state_store.state_path("SHELFSTONE_FTS_DB", "fulltext.db")
+
+
+def max_chars() -> int:
+    try:
+        return int(os.environ.get("SHELFSTONE_FTS_MAX_CHARS", DEFAULT_MAX_CHARS))
+    except ValueError:
+        return DEFAULT_MAX_CHARS
+
+
+def connect(db_path: Optional[str] = None) -> sqlite3.Connection:
+    """Opens (and if needed creates) the index database."""
+    db_path = db_path or index_db_path()
+    os.makedirs(os.path.dirname(os.path.abspath(db_path)), exist_ok=True)
+    conn = sqlite3.connect(db_path, timeout=30)
+    conn.execute(
+        "CREATE VIRTUAL TABLE IF NOT EXISTS book_text USING fts5("
+        "library UNINDEXED, book_id UNINDEXED, title, content, tokenize='unicode61 remove_diacritics 2')"
+    )
+    conn.execute(
+        "CREATE VIRTUAL TABLE IF NOT EXISTS book_meta USING fts5("
+        "library UNINDEXED, book_id UNINDEXED, title, authors, series, tokenize='unicode61 remove_diacritics 2')"
+    )
+    conn.execute(
+        "CREATE TABLE IF NOT EXISTS indexed_books ("
+        "library TEXT NOT NULL, book_id INTEGER NOT NULL, last_modified TEXT, format TEXT, "
+        "chars INTEGER, truncated INTEGER, error TEXT, PRIMARY KEY (library, book_id))"
+    )
+    if conn.execute("PRAGMA user_version").fetchone()[0] < SCHEMA_VERSION:
+        # Indexes from before CJK segmentation: the metadata is re-read on the next search,
+        # and the next indexing run re-reads every book's text.
+        with conn:
+            conn.execute("DELETE FROM book_meta")
+            conn.execute("UPDATE indexed_books SET last_modified = NULL")
+            conn.execute(f"PRAGMA user_version = {SCHEMA_VERSION}")
+    return conn
+
+
+def segment_cjk(text: str) -> str:
+    """Separates adjacent CJK characters so each is a token of its own, for indexing and queries."""
+    return _CJK_GAP_RE.sub(_SEGMENT_MARK, text)
+
+
+def unsegment_cjk(text: str) -> str:
+    """Undoes segment_cjk, also joining the per-character highlights of snippets ("[魯][迅]")."""
+    return text.replace("]" + _SEGMENT_MARK + "[", "").replace(_SEGMENT_MARK, "")
+
+
+def html_to_text(markup: str) -> str:
+    text = _TAG_RE.sub(" ", _SCRIPT_STYLE_RE.sub(" ", markup))
+    return _SPACE_RE.sub(" ", html.unescape(text)).strip()
+
+
+def extract_epub_text(path: str) -> str:
+    """
+    Reads the text of an EPUB's content documents in spine (reading) order.
+
+    Raises:
+        ValueError: If the file is not a readable EPUB.
+    """
+    try:
+        with zipfile.ZipFile(path) as epub:
+            container = ET.fromstring(epub.read("META-INF/container.xml"))
+            rootfile = container.find(".//c:rootfile", _NS)
+            opf_path = rootfile.get("full-path")
+            opf = ET.fromstring(epub.read(opf_path))
+            base = posixpath.dirname(opf_path)
+            manifest = {item.get("id"): item.get("href") for item in opf.findall(".//opf:manifest/opf:item", _NS)}
+            parts = []
+            for itemref in opf.findall(".//opf:spine/opf:itemref", _NS):
+                href = manifest.get(itemref.get("idref"))
+                if not href:
+                    continue
+                name = posixpath.normpath(posixpath.join(base, href.split("#")[0]))
+                try:
+                    parts.append(html_to_text(epub.read(name).decode("utf-8", errors="replace")))
+                except KeyError:
+                    continue
+    except (zipfile.BadZipFile, KeyError, ET.ParseError, AttributeError) as e:
+        raise ValueError(f"Could not read EPUB {path}: {e}")
+    return " ".join(p for p in parts if p)
+
+
+def extract_text_with_calibre(path: str) -> str:
+    """Converts any format Calibre can read to plain text with `ebook-convert`."""
+    fd, txt_path = tempfile.mkstemp(prefix="shelfstone_server_fts_", suffix=".txt")
+    os.close(fd)
+    try:
+        calibre_cli.ebook_convert(path, txt_path)
+        with open(txt_path, "r", encoding="utf-8", errors="replace") as f:
+            return _SPACE_RE.sub(" ", f.read()).strip()
+    finally:
+        if os.path.exists(txt_path):
+            os.remove(txt_path)
+
+
+def extract_text(path: str) -> str:
+    if path.lower().endswith(".epub"):
+        try:
+            return extract_epub_text(path)
+        except ValueError as e:
+            # Malformed EPUBs that Calibre can still read are common enough to fall back.
+            logger.info(f"{e}; falling back to ebook-convert.")
+    return extract_text_with_calibre(path)
+
+
+def pick_format_file(book: Dict[str, Any]) -> Optional[str]:
+    """Returns the path of the book file best suited for text extraction, or None."""
+    formats = book.get("formats") or []
+    if isinstance(formats, str):
+        formats = [f.strip() for f in formats.split(",") if f.strip()]
+    by_format = {os.path.splitext(p)[1][1:].upper(): p for p in formats if os.path.isabs(p)}
+    for fmt in PREFERRED_FORMATS:
+        if fmt in by_format and os.path.isfile(by_format[fmt]):
+            return by_format[fmt]
+    return None
+
+
+def index_book(conn: sqlite3.Connection, library: str, book: Dict[str, Any], limit: int) -> Dict[str, Any]:
+    """Extracts and stores one book's text, replacing any earlier entry."""
+    book_id = book["id"]
+    path = pick_format_file(book)
+    text, error, fmt = "", None, None
+    if path is None:
+        error = "No format suitable for text extraction."
+    else:
+        fmt = os.path.splitext(path)[1][1:].upper()
+        try:
+            text = extract_text(path)
+        except (calibre_cli.CalibreCLIError, ValueError, OSError) as e:
+            error = e.args[0] if e.args else str(e)
+    truncated = len(text) > limit
+    text = text[:limit]
+
+    with conn:
+        conn.execute("DELETE FROM book_text WHERE library = ? AND book_id = ?", (library, book_id))
+        if text:
+            conn.execute("INSERT INTO book_text (library, book_id, title, content) VALUES (?, ?, ?, ?)",
+                         (library, book_id, book.get("title") or "", segment_cjk(text)))
+        conn.execute(
+            "INSERT OR REPLACE INTO indexed_books (library, book_id, last_modified, format, chars, truncated, error) "
+            "VALUES (?, ?, ?, ?, ?, ?, ?)",
+            (library, book_id, str(book.get("last_modified") or ""), fmt, len(text), int(truncated), error),
+        )
+    return {"book_id": book_id, "format": fmt, "chars": len(text), "truncated": truncated, "error": error}
+
+
+def _library_key(library_path: Optional[str]) -> str:
+    return os.path.abspath(library_path) if library_path else ""
+
+
+def _as_text(value: Any) -> str:
+    if isinstance(value, list):
+        return " & ".join(str(v) for v in value)
+    return str(value or "")
+
+
+def index_metadata(conn: sqlite3.Connection, library: str, books: List[Dict[str, Any]]) -> None:
+    """Stores the title, authors and series of the books, replacing earlier entries."""
+    with conn:
+        for book in books:
+            conn.execute("DELETE FROM book_meta WHERE library = ? AND book_id = ?", (library, book["id"]))
+            conn.execute("INSERT INTO book_meta (library, book_id, title, authors, series) VALUES (?, ?, ?, ?, ?)",
+                         (library, book["id"], segment_cjk(book.get("title") or ""),
+                          segment_cjk(_as_text(book.get("authors"))), segment_cjk(_as_text(book.get("series")))))
+
+
+def _remove_books(conn: sqlite3.Connection, library: str, book_ids) -> None:
+    with conn:
+        for book_id in book_ids:
+            for table in ("book_text", "book_meta", "indexed_books"):
+                conn.execute(f"DELETE FROM {table} WHERE library = ? AND book_id = ?", (library, book_id))
+
+
+def refresh_metadata(library_path: Optional[str] = None, book_ids: Optional[List[int]] = None,
+                     db_path: Optional[str] = None) -> int:
+    """
+    Re-reads the metadata of the given books (all books if None) into the search index.
+    Given books that no longer exist are removed from the index.
+
+    Returns:
+        The number of books indexed.
+    """
+    library = _library_key(library_path)
+    if book_ids is not None and not book_ids:
+        return 0
+    search_query = " or ".join(f"id:{book_id}" for book_id in book_ids) if book_ids else None
+    books = list_books(library_path=library_path, search_query=search_query)
+    conn = connect(db_path)
+    try:
+        if book_ids is None:
+            with conn:
+                conn.execute("DELETE FROM book_meta WHERE library = ?", (library,))
+        else:
+            _remove_books(conn, library, set(book_ids) - {book["id"] for book in books})
+        index_metadata(conn, library, books)
+    finally:
+        conn.close()
+    return len(books)
+
+
+def update_after_change(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """
+    Called after books were added, edited or removed, so search results stay consistent.
+    Does nothing until an index exists, and never fails: a stale index is better than a
+    failed upload, and the next indexing run corrects it.
+    """
+    if not os.path.exists(index_db_path()):
+        return
+    try:
+        refresh_metadata(library_path=library_path, book_ids=list(book_ids))
+    except Exception as e:
+        logger.warning(f"Could not update the search index for book(s) {list(book_ids)}: {e}")
+
+
+def build_index(library_path: Optional[str] = None, search_query: Optional[str] = None,
+                rebuild: bool = False, db_path: Optional[str] = None, progress=None) -> Dict[str, int]:
+    """
+    Indexes the library's books (or those matching `search_query`). Books whose last_modified
+    is unchanged since they were indexed are skipped unless `rebuild` is set. When indexing the
+    whole library, entries of books that no longer exist are removed.
+
+    Returns:
+        {"total", "indexed", "skipped", "failed", "removed"}
+    """
+    library = _library_key(library_path)
+    books = list_books(library_path=library_path, search_query=search_query)
+    limit = max_chars()
+    stats = {"total": len(books), "indexed": 0, "skipped": 0, "failed": 0, "removed": 0}
+    conn = connect(db_path)
+    try:
+        known = {
+            row[0]: row[1]
+            for row in conn.execute("SELECT book_id, last_modified FROM indexed_books WHERE library = ?", (library,))
+        }
+        index_metadata(conn, library, books)
+        for book in books:
+            if lifecycle.shutting_down():
+                # Books indexed so far are kept; the next run skips them.
+                raise RuntimeError(f"Indexing stopped by server shutdown after {stats['indexed']} book(s).")
+            if not rebuild and known.get(book["id"]) == str(book.get("last_modified") or ""):
+                stats["skipped"] += 1
+            else:
+                result = index_book(conn, library, book, limit)
+                stats["failed" if result["error"] else "indexed"] += 1
+            if progress:
+                progress(stats)
+        if not search_query:
+            gone = set(known) - {book["id"] for book in books}
+            _remove_books(conn, library, gone)
+            stats["removed"] = len(gone)
+    finally:
+        conn.close()
+    return stats
+
+
+def search(query: str, library_path: Optional[str] = None, limit: int = 20,
+           db_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """
+    Searches the index with FTS5 query syntax (words, "exact phrases", OR, NOT, prefix*).
+
+    Returns:
+        [{"book_id", "title", "snippet"}], best matches first.
+
+    Raises:
+        ValueError: If the query is empty or not valid FTS5 syntax.
+    """
+    if not query or not query.strip():
+        raise ValueError("The search query must not be empty.")
+    conn = connect(db_path)
+    try:
+        rows = conn.execute(
+            "SELECT book_id, title, snippet(book_text, 3, '[', ']', '…', 24) FROM book_text "
+            "WHERE library = ? AND book_text MATCH ? ORDER BY rank LIMIT ?",
+            (_library_key(library_path), segment_cjk(query), limit),
+        ).fetchall()
+    except sqlite3.OperationalError as e:
+        raise ValueError(f"Invalid full-text query: {e}")
+    finally:
+        conn.close()
+    return [{"book_id": r[0], "title": r[1], "snippet": unsegment_cjk(r[2])} for r in rows]
+
+
+SEARCH_FIELDS = {"title": "title", "author": "authors", "series": "series"}
+
+
+def search_books(query: str, fields: List[str], include_text: bool = False, library_path: Optional[str] = None,
+                 limit: int = 20, db_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """
+    Searches titles, authors and/or series (`fields`), and optionally the book contents, with
+    FTS5 query syntax. Metadata matches rank before matches found only in the text. The
+    metadata index is filled from the library on the first search.
+
+    Returns:
+        [{"book_id", "title", "authors", "series", "matched": [fields], "snippet"}]
+
+    Raises:
+        ValueError: If the query is empty, not valid FTS5 syntax, or a field is unknown.
+    """
+    if not query or not query.strip():
+        raise ValueError("The search query must not be empty.")
+    unknown = [f for f in fields if f not in SEARCH_FIELDS]
+    if unknown:
+        raise ValueError(f"Unknown search field(s): {', '.join(unknown)}. Use {', '.join(SEARCH_FIELDS)}.")
+    library = _library_key(library_path)
+    query = segment_cjk(query)
+    conn = connect(db_path)
+    try:
+        if fields and conn.execute("SELECT 1 FROM book_meta WHERE library = ? LIMIT 1", (library,)).fetchone() is None:
+            conn.close()
+            refresh_metadata(library_path=library_path, db_path=db_path)
+            conn = connect(db_path)
+        results: Dict[int, Dict[str, Any]] = {}
+        for field in fields:
+            rows = conn.execute(
+                "SELECT book_id, title, authors, series FROM book_meta "
+                "WHERE library = ? AND book_meta MATCH ? ORDER BY rank LIMIT ?",
+                (library, f"{{{SEARCH_FIELDS[field]}}} : ({query})", limit),
+            ).fetchall()
+            for book_id, title, authors, series in rows:
+                title, authors, series = unsegment_cjk(title), unsegment_cjk(authors), unsegment_cjk(series)
+                hit = results.setdefault(book_id, {"book_id": book_id, "title": title, "authors": as_list(authors, "authors"),
+                                                   "series": series or None, "matched": [], "snippet": None})
+                hit["matched"].append(field)
+        if include_text:
+            rows = conn.execute(
+                "SELECT book_id, title, snippet(book_text, 3, '[', ']', '…', 24) FROM book_text "
+                "WHERE library = ? AND book_text MATCH ? ORDER BY rank LIMIT ?",
+                (library, f"{{content}} : ({query})", limit),
+            ).fetchall()
+            for book_id, title, snippet in rows:
+                hit = results.setdefault(book_id, {"book_id": book_id, "title": title, "authors": None,
+                                                   "series": None, "matched": [], "snippet": None})
+                hit["matched"].append("text")
+                hit["snippet"] = unsegment_cjk(snippet)
+                if hit["authors"] is None:
+                    meta = conn.execute("SELECT authors, series FROM book_meta WHERE library = ? AND book_id = ?",
+                                        (library, book_id)).fetchone()
+                    if meta:
+                        hit["authors"], hit["series"] = as_list(unsegment_cjk(meta[0]), "authors"), unsegment_cjk(meta[1]) or None
+    except sqlite3.OperationalError as e:
+        raise ValueError(f"Invalid search query: {e}")
+    finally:
+        conn.close()
+    # Dicts keep insertion order: metadata matches first, in rank order per field.
+    return list(results.values())[:limit]
+
+
+# --- Background indexing ---
+
+_job_lock = threading.Lock()
+_job: Dict[str, Any] = {"state": "idle"}
+
+
+def job_status() -> Dict[str, Any]:
+    with _job_lock:
+        return dict(_job)
+
+
+def start_background_index(library_path: Optional[str] = None, search_query: Optional[str] = None,
+                           rebuild: bool = False) -> Dict[str, Any]:
+    """
+    Starts build_index in a background thread.
+
+    Raises:
+        RuntimeError: If an indexing job is already running.
+    """
+    with _job_lock:
+        if _job.get("state") == "running":
+            raise RuntimeError("An indexing job is already running.")
+        _job.clear()
+        _job.update({"state": "running", "started_at": time.time(), "finished_at": None,
+                     "stats": None, "error": None})
+
+    def progress(stats):
+        with _job_lock:
+            _job["stats"] = dict(stats)
+
+    def run():
+        with lifecycle.job("full-text indexing", lifecycle.BULK):
+            try:
+                stats = build_index(library_path=library_path, search_query=search_query,
+                                    rebuild=rebuild, progress=progress)
+                with _job_lock:
+                    _job.update({"state": "finished", "stats": stats, "finished_at": time.time()})
+            except Exception as e:
+                logger.error(f"Full-text indexing failed: {e}", exc_info=True)
+                with _job_lock:
+                    _job.update({"state": "failed", "error": str(e), "finished_at": time.time()})
+
+    threading.Thread(target=run, name="fulltext-index", daemon=True).start()
+    return job_status()
@@ -0,0 +1,67 @@
+import re
+import threading
+import logging
+from contextlib import contextmanager
+from typing import Optional, Iterator
+
+from .crud import list_books
+
+logger = logging.getLogger(__name__)
+
+# Idempotency keys are stored on the created book as a Calibre identifier of this type,
+# so a retried upload can be matched to the book of the first attempt without any extra storage.
+IDENTIFIER_TYPE = "idempotency"
+KEY_PATTERN = re.compile(r"^[A-Za-z0-9_\-.]{1,128}$")
+
+_in_flight = set()
+_in_flight_lock = threading.Lock()
+
+
+class IdempotencyKeyInUse(Exception):
+    """Raised when a request with the same idempotency key is still being processed."""
+
+
+def validate_key(key: str) -> str:
+    """
+    Raises ValueError unless the key consists of 1-128 letters, digits, '_', '-' or '.'.
+    The character set is restricted because the key ends up in a calibredb identifier and search query.
+    """
+    if not KEY_PATTERN.match(key or ""):
+        raise ValueError("Idempotency-Key must be 1-128 characters of letters, digits, '_', '-' or '.'.")
+    return key
+
+
+def find_book_id(key: str, library_path: Optional[str] = None) -> Optional[int]:
+    """
+    Returns the ID of the book created by an earlier request with this key, or None.
+
+    Raises:
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If the calibredb search fails.
+    """
+    books = list_books(library_path=library_path, search_query=f'identifiers:"={IDENTIFIER_TYPE}:={key}"')
+    for book in books:
+        if (book.get("identifiers") or {}).get(IDENTIFIER_TYPE) == key:
+            return book.get("id")
+    return None
+
+
+@contextmanager
+def claim(key: str, library_path: Optional[str] = None) -> Iterator[None]:
+    """
+    Marks a key as in flight for the duration of the block, so two concurrent retries
+    cannot both pass the "already imported?" check and add the book twice.
+
+    Raises:
+        IdempotencyKeyInUse: If another request currently holds the key.
+    """
+    slot = (library_path or "", key)
+    with _in_flight_lock:
+        if slot in _in_flight:
+            raise IdempotencyKeyInUse(f"A request with Idempotency-Key '{key}' is already in progress.")
+        _in_flight.add(slot)
+    try:
+        yield
+    finally:
+        with _in_flight_lock:
+            _in_flight.discard(slot)
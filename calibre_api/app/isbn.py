@@ -0,0 +1,71 @@
+import re
+from typing import Any, Dict, List, Optional
+
+from .crud import list_books
+
+_SEPARATORS_RE = re.compile(r"[\s\-]")
+
+
+def _isbn10_check_digit(first9: str) -> str:
+    total = sum((10 - i) * int(d) for i, d in enumerate(first9))
+    check = (11 - total % 11) % 11
+    return "X" if check == 10 else str(check)
+
+
+def _isbn13_check_digit(first12: str) -> str:
+    total = sum(int(d) * (3 if i % 2 else 1) for i, d in enumerate(first12))
+    return str((10 - total % 10) % 10)
+
+
+def normalize_isbn(value: str) -> str:
+    """
+    Validates an ISBN-10 or ISBN-13 (hyphens and spaces allowed, as printed on books
+    or decoded from EAN-13 barcodes) and returns it as a bare ISBN-13.
+
+    Raises:
+        ValueError: If the value is not a valid ISBN.
+    """
+    digits = _SEPARATORS_RE.sub("", value or "").upper()
+    if re.fullmatch(r"\d{9}[\dX]", digits):
+        if _isbn10_check_digit(digits[:9]) != digits[9]:
+            raise ValueError(f"Invalid ISBN-10 check digit in '{value}'.")
+        first12 = "978" + digits[:9]
+        return first12 + _isbn13_check_digit(first12)
+    if re.fullmatch(r"97[89]\d{10}", digits):
+        if _isbn13_check_digit(digits[:12]) != digits[12]:
+            raise ValueError(f"Invalid ISBN-13 check digit in '{value}'.")
+        return digits
+    raise ValueError(f"'{value}' is not a valid ISBN-10 or ISBN-13.")
+
+
+def isbn13_to_isbn10(isbn13: str) -> Optional[str]:
+    """Returns the ISBN-10 form of a 978-prefixed ISBN-13, or None (979 ISBNs have no ISBN-10)."""
+    if not isbn13.startswith("978"):
+        return None
+    return isbn13[3:12] + _isbn10_check_digit(isbn13[3:12])
+
+
+def find_books_by_isbn(isbn: str, library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """
+    Returns the library's books with this ISBN. Books are matched on their `isbn` identifier
+    in both the ISBN-13 and ISBN-10 form, since Calibre stores whatever the source provided.
+
+    Raises:
+        ValueError: If the ISBN is invalid.
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If the calibredb search fails.
+    """
+    isbn13 = normalize_isbn(isbn)
+    forms = [isbn13] + [f for f in [isbn13_to_isbn10(isbn13)] if f]
+    search = " or ".join(f'identifiers:"=isbn:={form}"' for form in forms)
+    books = list_books(library_path=library_path, search_query=search)
+
+    matches = []
+    for book in books:
+        stored = (book.get("identifiers") or {}).get("isbn") or book.get("isbn") or ""
+        try:
+            if normalize_isbn(stored) == isbn13:
+                matches.append(book)
+        except ValueError:
+            continue
+    return matches
@@ -0,0 +1,258 @@
+"""
+Removes leftovers that would otherwise accumulate: temporary files of interrupted requests,
+abandoned resumable uploads, unused converted downloads and cover thumbnails and, if
+configured, old news issues.
+
+Runs via POST /maintenance/cleanup, or from cron (run from the calibre_api directory):
+
+    python -m app.janitor [--dry-run] [--library "/root/Calibre Library"]
+
+Retention is configured with environment variables (see README). Each task returns the
+entries it removed, so a dry run reports exactly what a real run would delete.
+"""
+import argparse
+import json
+import os
+import re
+import shutil
+import sys
+import tempfile
+import time
+import logging
+from typing import Any, Dict, List, Optional
+
+from . import conversion_cache
+from . import news
+from . import thumbnails
+from . import uploads
+from .crud import list_books, remove_book
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_TEMP_RETENTION_HOURS = 24
+DEFAULT_UPLOAD_RETENTION_HOURS = 48
+DEFAULT_CONVERSION_CACHE_DAYS = 30
+DEFAULT_THUMBNAIL_CACHE_DAYS = 30
+# Off by default: news issues are normally expired by count when the next issue is fetched.
+DEFAULT_NEWS_RETENTION_DAYS = 0
+
+# Scratch folders created with tempfile.mkdtemp all share this prefix.
+SCRATCH_PREFIX = "shelfstone_server_"
+# Prefixes passed to main.temp_file_path, which appends a UUID. Only names with the UUID
+# are touched, so files of other programs in the temp folder are never matched.
+TEMP_FILE_PREFIXES = (
+    "bundle_", "check_ebook_in_", "convert_in_", "convert_out_", "lrf2lrs_in_", "lrf2lrs_out_",
+    "lrs2lrf_in_", "lrs2lrf_out_", "meta_in_", "meta_set_", "news_", "polish_in_",
+    "polish_out_", "polish_out_nosuffix_", "recipe_", "reextract_", "smtp_attach_", "snapshot_", "sync_",
+)
+_UUID = r"[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}"
+_TEMP_FILE_RE = re.compile(r"^(?:" + "|".join(re.escape(p) for p in TEMP_FILE_PREFIXES) + ")" + _UUID)
+
+
+def _env_number(name: str, default: float) -> float:
+    value = os.environ.get(name)
+    if value is None or value.strip() == "":
+        return default
+    try:
+        return float(value)
+    except ValueError:
+        logger.warning(f"Ignoring invalid {name}={value!r}; using {default}.")
+        return default
+
+
+def retention_settings() -> Dict[str, float]:
+    """
+    Returns the retention periods in seconds; 0 disables a task.
+    """
+    return {
+        "temp_files": _env_number("SHELFSTONE_TEMP_RETENTION_HOURS", DEFAULT_TEMP_RETENTION_HOURS) * 3600,
+        "uploads": _env_number("SHELFSTONE_UPLOAD_RETENTION_HOURS", DEFAULT_UPLOAD_RETENTION_HOURS) * 3600,
+        "conversion_cache": _env_number("SHELFSTONE_CONVERSION_CACHE_DAYS", DEFAULT_CONVERSION_CACHE_DAYS) * 86400,
+        "thumbnail_cache": _env_number("SHELFSTONE_THUMBNAIL_CACHE_DAYS", DEFAULT_THUMBNAIL_CACHE_DAYS) * 86400,
+        "news_issues": _env_number("SHELFSTONE_NEWS_RETENTION_DAYS", DEFAULT_NEWS_RETENTION_DAYS) * 86400,
+    }
+
+
+def _path_size(path: str) -> int:
+    if os.path.isfile(path):
+        return os.path.getsize(path)
+    total = 0
+    for root, _, files in os.walk(path):
+        for name in files:
+            try:
+                total += os.path.getsize(os.path.join(root, name))
+            except OSError:
+                pass
+    return total
+
+
+def _latest_mtime(path: str) -> float:
+    # A folder's own mtime doesn't change when a file inside it is appended to.
+    latest = os.path.getmtime(path)
+    if os.path.isdir(path):
+        for root, _, files in os.walk(path):
+            for name in files:
+                try:
+                    latest = max(latest, os.path.getmtime(os.path.join(root, name)))
+                except OSError:
+                    pass
+    return latest
+
+
+def _remove_path(path: str) -> None:
+    if os.path.isdir(path):
+        shutil.rmtree(path, ignore_errors=True)
+    elif os.path.exists(path):
+        os.remove(path)
+
+
+def is_server_temp_entry(name: str) -> bool:
+    """True for temp folder entries created by this server (other than the uploads folder)."""
+    if name == os.path.basename(uploads.UPLOAD_ROOT):
+        return False
+    return name.startswith(SCRATCH_PREFIX) or bool(_TEMP_FILE_RE.match(name))
+
+
+def clean_temp_files(max_age: float, now: float, dry_run: bool = False, **_) -> Dict[str, Any]:
+    """Removes temporary files and scratch folders older than max_age seconds."""
+    temp_dir = tempfile.gettempdir()
+    removed, freed = [], 0
+    for name in sorted(os.listdir(temp_dir)):
+        path = os.path.join(temp_dir, name)
+        if not is_server_temp_entry(name):
+            continue
+        try:
+            if now - _latest_mtime(path) < max_age:
+                continue
+            size = _path_size(path)
+            if not dry_run:
+                _remove_path(path)
+        except OSError as e:
+            logger.warning(f"Could not clean up {path}: {e}")
+            continue
+        removed.append(name)
+        freed += size
+    return {"removed": removed, "freed_bytes": freed}
+
+
+def clean_uploads(max_age: float, now: float, dry_run: bool = False, **_) -> Dict[str, Any]:
+    """Removes resumable uploads that received no data for max_age seconds."""
+    removed, freed = [], 0
+    if not os.path.isdir(uploads.UPLOAD_ROOT):
+        return {"removed": removed, "freed_bytes": freed}
+    for upload_id in sorted(os.listdir(uploads.UPLOAD_ROOT)):
+        path = os.path.join(uploads.UPLOAD_ROOT, upload_id)
+        try:
+            if now - _latest_mtime(path) < max_age:
+                continue
+            size = _path_size(path)
+            if not dry_run:
+                _remove_path(path)
+        except OSError as e:
+            logger.warning(f"Could not clean up upload {upload_id}: {e}")
+            continue
+        removed.append(upload_id)
+        freed += size
+    return {"removed": removed, "freed_bytes": freed}
+
+
+def _clean_cache_dir(root: str, max_age: float, now: float, dry_run: bool) -> Dict[str, Any]:
+    removed, freed = [], 0
+    if not os.path.isdir(root):
+        return {"removed": removed, "freed_bytes": freed}
+    for name in sorted(os.listdir(root)):
+        path = os.path.join(root, name)
+        try:
+            # Cache hits touch the file, so mtime is the time of the last use.
+            if not os.path.isfile(path) or now - os.path.getmtime(path) < max_age:
+                continue
+            size = os.path.getsize(path)
+            if not dry_run:
+                os.remove(path)
+        except OSError as e:
+            logger.warning(f"Could not clean up cached file {path}: {e}")
+            continue
+        removed.append(name)
+        freed += size
+    return {"removed": removed, "freed_bytes": freed}
+
+
+def clean_conversion_cache(max_age: float, now: float, dry_run: bool = False, **_) -> Dict[str, Any]:
+    """Removes converted downloads (see conversion_cache.py) not requested for max_age seconds."""
+    return _clean_cache_dir(conversion_cache.cache_dir(), max_age, now, dry_run)
+
+
+def clean_thumbnail_cache(max_age: float, now: float, dry_run: bool = False, **_) -> Dict[str, Any]:
+    """Removes cover thumbnails (see thumbnails.py) not requested for max_age seconds."""
+    return _clean_cache_dir(thumbnails.cache_dir(), max_age, now, dry_run)
+
+
+def clean_news_issues(max_age: float, now: float, dry_run: bool = False,
+                      library_path: Optional[str] = None, **_) -> Dict[str, Any]:
+    """Removes news issues (see news.py) added more than max_age seconds ago."""
+    days = max(1, int(max_age // 86400))
+    books = list_books(library_path=library_path, search_query=f'tags:"={news.NEWS_TAG}" and date:<{days}daysago')
+    removed = []
+    for book in books:
+        if news.IDENTIFIER_TYPE not in (book.get("identifiers") or {}):
+            continue  # Tagged "News" by hand, not fetched by the server.
+        if not dry_run:
+            remove_book(book["id"], library_path=library_path)
+        removed.append(str(book["id"]))
+    return {"removed": removed, "freed_bytes": 0}
+
+
+# (name, function). Every task is called with max_age, now, dry_run and library_path.
+CLEANUP_TASKS: List[tuple] = [
+    ("temp_files", clean_temp_files),
+    ("uploads", clean_uploads),
+    ("conversion_cache", clean_conversion_cache),
+    ("thumbnail_cache", clean_thumbnail_cache),
+    ("news_issues", clean_news_issues),
+]
+
+
+def run_cleanup(library_path: Optional[str] = None, dry_run: bool = False,
+                now: Optional[float] = None) -> Dict[str, Any]:
+    """
+    Runs all cleanup tasks whose retention is enabled.
+
+    Returns:
+        {"dry_run": bool, "tasks": [{"name", "removed": [...], "freed_bytes", "error"}]}
+        A failing task is reported with its error and doesn't stop the others.
+    """
+    now = time.time() if now is None else now
+    settings = retention_settings()
+    results = []
+    for name, task in CLEANUP_TASKS:
+        max_age = settings.get(name, 0)
+        if max_age <= 0:
+            continue
+        try:
+            result = task(max_age=max_age, now=now, dry_run=dry_run, library_path=library_path)
+            results.append({"name": name, "error": None, **result})
+        except Exception as e:
+            logger.error(f"Cleanup task '{name}' failed: {e}", exc_info=True)
+            results.append({"name": name, "removed": [], "freed_bytes": 0, "error": str(e)})
+        if results[-1]["removed"]:
+            verb = "Would remove" if dry_run else "Removed"
+            logger.info(f"{verb} {len(results[-1]['removed'])} item(s) in cleanup task '{name}'.")
+    return {"dry_run": dry_run, "tasks": results}
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    parser = argparse.ArgumentParser(
+        prog="python -m app.janitor",
+        description="Remove expired temporary files, abandoned uploads, unused cached files and old news issues.",
+    )
+    parser.add_argument("--dry-run", action="store_true", help="Only report what would be removed.")
+    parser.add_argument("--library", help="Path to the Calibre library. Defaults to calibredb's default library.")
+    args = parser.parse_args(argv)
+
+    result = run_cleanup(library_path=args.library, dry_run=args.dry_run)
+    print(json.dumps(result, indent=2))
+    return 1 if any(task["error"] for task in result["tasks"]) else 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
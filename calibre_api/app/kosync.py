@@ -0,0 +1,240 @@
+"""
+KOReader progress sync ("kosync"), so KOReader devices can sync reading positions against
+Shelfstone instead of a separate koreader-sync-server. Needs user accounts (see accounts).
+
+KOReader signs in with a username and the MD5 of its password. Shelfstone never sees passwords
+that way, so users enter an API token as the password; API tokens carry their MD5 for this
+(accounts.kosync_key). Registering from KOReader isn't possible.
+
+KOReader identifies a document by a hash: by default a partial MD5 of the file's content
+(partial_md5), or the MD5 of its file name. Both are recorded whenever a book file is downloaded
+(GET /books/{id}/download, or /books/{id}/file/{format} from the OPDS catalog),
+so a position synced for a downloaded file is also saved as the user's reading progress of that
+book (see reading). Positions of documents that aren't from the library are kept as well; they
+just aren't linked to a book.
+
+The data is kept in a small SQLite database (SHELFSTONE_KOSYNC_DB, in the state directory by
+default; see state_store).
+"""
+import hashlib
+import io
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, List, Optional, Union
+
+from . import state_store
+from .state_store import library_key as _library_key
+
+_lock = threading.Lock()
+
+MAX_FIELD_LENGTH = 2000
+
+# The errors of koreader-sync-server, which KOReader shows by code: (code, HTTP status, message).
+UNAUTHORIZED = (2001, 401, "Unauthorized")
+USER_EXISTS = (2002, 402, "Username is already registered.")
+INVALID_FIELDS = (2003, 403, "Invalid request")
+DOCUMENT_MISSING = (2004, 403, "Field 'document' not provided.")
+REGISTRATION_DISABLED = (2005, 402, "User registration is disabled.")
+
+
+class InvalidPosition(ValueError):
+    """A position KOReader sent is incomplete; `error` is the kosync error to answer with."""
+
+    def __init__(self, message: str, error=INVALID_FIELDS):
+        super().__init__(message)
+        self.error = error
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: the hashes of downloaded files and the synced positions.
+    (
+        "CREATE TABLE documents ("
+        "digest TEXT NOT NULL, library TEXT NOT NULL, book_id INTEGER NOT NULL, format TEXT NOT NULL, "
+        "recorded_at REAL NOT NULL, PRIMARY KEY (digest, library, book_id, format))",
+        "CREATE INDEX documents_book ON documents (library, book_id)",
+        "CREATE TABLE positions ("
+        "user_id INTEGER NOT NULL, document TEXT NOT NULL, progress TEXT, percentage REAL, "
+        "device TEXT, device_id TEXT, timestamp INTEGER NOT NULL, PRIMARY KEY (user_id, document))",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_KOSYNC_DB", "kosync.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+# --- Document hashes ---
+
+def partial_md5(source: Union[str, bytes]) -> str:
+    """
+    KOReader's default document hash of a file (path) or its content (bytes): the MD5 of 1 KiB
+    samples at offsets 0, 1 KiB, 4 KiB, 16 KiB and on, up to 1 GiB, stopping at the end of the file.
+    """
+    digest = hashlib.md5()
+    with (open(source, "rb") if isinstance(source, str) else io.BytesIO(source)) as f:
+        for i in range(-1, 11):
+            # KOReader computes the first offset as 1024 << -2, which wraps around to 0 in LuaJIT.
+            f.seek(0 if i < 0 else 1024 << (2 * i))
+            sample = f.read(1024)
+            if not sample:
+                break
+            digest.update(sample)
+    return digest.hexdigest()
+
+
+def filename_md5(filename: str) -> str:
+    """KOReader's other document hash: the MD5 of the file name."""
+    return hashlib.md5(filename.encode()).hexdigest()
+
+
+def record_download(source: Union[str, bytes], filename: str, book_id: int, fmt: str,
+                    library_path: Optional[str] = None) -> None:
+    """Remembers the hashes KOReader will know the downloaded file (path or content) by."""
+    library = _library_key(library_path)
+    now = time.time()
+    rows = [(digest, library, book_id, fmt.upper(), now) for digest in (partial_md5(source), filename_md5(filename))]
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("INSERT OR REPLACE INTO documents (digest, library, book_id, format, recorded_at) "
+                                 "VALUES (?, ?, ?, ?, ?)", rows)
+        finally:
+            conn.close()
+
+
+def book_for_document(document: str) -> Optional[Dict[str, Any]]:
+    """
+    The book a document hash was recorded for, as {"library_path", "book_id", "format"}; the most
+    recent download wins if the same file is in several places. None for unknown hashes.
+    """
+    if not os.path.exists(db_path()):
+        return None
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute("SELECT library, book_id, format FROM documents WHERE digest = ? "
+                               "ORDER BY recorded_at DESC LIMIT 1", (document.lower(),)).fetchone()
+        finally:
+            conn.close()
+    if row is None:
+        return None
+    # The default library is stored as "", which reading expects as no library path.
+    return {"library_path": row[0] or None, "book_id": row[1], "format": row[2]}
+
+
+# --- Positions ---
+
+_POSITION_FIELDS = ("document", "progress", "percentage", "device", "device_id", "timestamp")
+
+
+def validate_position(values: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Checks a position as KOReader sends it.
+
+    Raises:
+        InvalidPosition: If the document is missing (DOCUMENT_MISSING) or a field is invalid.
+    """
+    document = values.get("document")
+    if not isinstance(document, str) or not document.strip():
+        raise InvalidPosition("The document is missing.", DOCUMENT_MISSING)
+    percentage = values.get("percentage")
+    if isinstance(percentage, bool) or not isinstance(percentage, (int, float)) or not 0 <= percentage <= 1:
+        raise InvalidPosition("The percentage must be a number between 0 and 1.")
+    position = {"document": document.strip().lower(), "percentage": float(percentage)}
+    for field in ("progress", "device", "device_id"):
+        value = values.get(field)
+        if value is not None and not isinstance(value, (str, int, float)):
+            raise InvalidPosition(f"Invalid {field}.")
+        position[field] = str(value)[:MAX_FIELD_LENGTH] if value is not None else None
+    if not position["progress"]:
+        raise InvalidPosition("The progress is missing.")
+    if len(position["document"]) > 100:
+        raise InvalidPosition("The document hash is too long.")
+    return position
+
+
+def save_position(user_id: int, values: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Stores the user's position in a document, replacing the previous one, and returns it with
+    its timestamp (whole seconds, as KOReader expects).
+
+    Raises:
+        InvalidPosition: As for validate_position.
+    """
+    position = validate_position(values)
+    position["timestamp"] = int(time.time())
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute(
+                    f"INSERT OR REPLACE INTO positions (user_id, {', '.join(_POSITION_FIELDS)}) "
+                    f"VALUES (?, {', '.join('?' * len(_POSITION_FIELDS))})",
+                    (user_id, *(position[field] for field in _POSITION_FIELDS)))
+        finally:
+            conn.close()
+    return position
+
+
+def get_position(user_id: int, document: str) -> Optional[Dict[str, Any]]:
+    """The user's last synced position in the document, or None."""
+    if not os.path.exists(db_path()):
+        return None
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute(f"SELECT {', '.join(_POSITION_FIELDS)} FROM positions WHERE user_id = ? AND document = ?",
+                               (user_id, document.strip().lower())).fetchone()
+        finally:
+            conn.close()
+    return dict(zip(_POSITION_FIELDS, row)) if row else None
+
+
+def export_user(user_id: int) -> List[Dict[str, Any]]:
+    """All of the user's synced positions."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT {', '.join(_POSITION_FIELDS)} FROM positions WHERE user_id = ? ORDER BY timestamp",
+                                (user_id,)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(_POSITION_FIELDS, row)) for row in rows]
+
+# --- Cleanup ---
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Drops the document hashes of deleted books. Synced positions stay, unlinked."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("DELETE FROM documents WHERE library = ? AND book_id = ?",
+                                 [(_library_key(library_path), book_id) for book_id in book_ids])
+        finally:
+            conn.close()
+
+
+def forget_user(user_id: int) -> None:
+    """Removes a deleted user's synced positions."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM positions WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
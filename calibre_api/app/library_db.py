@@ -0,0 +1,154 @@
+import os
+import sqlite3
+import time
+import logging
+from typing import Any, Dict, Optional, Sequence
+
+logger = logging.getLogger(__name__)
+
+LIBRARY_DB_NAME = "metadata.db"
+DEFAULT_MAX_ROWS = 1000
+DEFAULT_QUERY_TIMEOUT = 10.0
+
+# Authorizer actions allowed for read-only queries; everything else (writes, PRAGMA, ATTACH,
+# temp tables, ...) is denied while the statement is being prepared.
+_ALLOWED_ACTIONS = {
+    sqlite3.SQLITE_SELECT,
+    sqlite3.SQLITE_READ,
+    sqlite3.SQLITE_FUNCTION,
+    getattr(sqlite3, "SQLITE_RECURSIVE", 33),  # WITH RECURSIVE
+}
+
+
+def sql_query_enabled() -> bool:
+    """
+    The SQL endpoint exposes the whole library database, including fields the other endpoints
+    don't return, so it is off unless SHELFSTONE_ENABLE_SQL_QUERY is set to 1/true/yes.
+    """
+    return os.environ.get("SHELFSTONE_ENABLE_SQL_QUERY", "").strip().lower() in ("1", "true", "yes")
+
+
+class QueryError(ValueError):
+    """Raised for queries that are not allowed or fail to execute."""
+
+
+def resolve_library_path(library_path: Optional[str] = None) -> str:
+    """
+    Returns the library folder to open directly. Unlike calibredb, SQLite access cannot fall back
+    to Calibre's own default library, so CALIBRE_LIBRARY_PATH is used when no path is given.
+
+    Raises:
+        ValueError: If no library path is known or it has no metadata.db.
+    """
+    path = library_path or os.environ.get("CALIBRE_LIBRARY_PATH")
+    if not path:
+        raise ValueError("No library path given. Pass library_path or set CALIBRE_LIBRARY_PATH.")
+    if not os.path.isfile(os.path.join(path, LIBRARY_DB_NAME)):
+        raise ValueError(f"No Calibre library found at '{path}' (missing {LIBRARY_DB_NAME}).")
+    return path
+
+
+def _read_only_authorizer(action, arg1, arg2, db_name, trigger_name):
+    return sqlite3.SQLITE_OK if action in _ALLOWED_ACTIONS else sqlite3.SQLITE_DENY
+
+
+def connect_read_only(library_path: str) -> sqlite3.Connection:
+    """
+    Opens a library's metadata.db read-only. The file is opened with mode=ro, so even
+    a statement that slipped past the authorizer could not modify the library.
+    """
+    db_path = os.path.join(library_path, LIBRARY_DB_NAME)
+    conn = sqlite3.connect(f"file:{db_path}?mode=ro", uri=True, timeout=5)
+    conn.execute("PRAGMA query_only = ON")
+    return conn
+
+
+def run_read_only_query(
+    library_path: str,
+    sql: str,
+    params: Optional[Sequence[Any]] = None,
+    max_rows: int = DEFAULT_MAX_ROWS,
+    timeout: float = DEFAULT_QUERY_TIMEOUT,
+) -> Dict[str, Any]:
+    """
+    Runs a single read-only SQL statement against the library database.
+
+    Returns:
+        {"columns": [...], "rows": [[...], ...], "truncated": bool}
+
+    Raises:
+        QueryError: If the statement is not read-only, is invalid, or exceeds the timeout.
+    """
+    conn = connect_read_only(library_path)
+    deadline = time.monotonic() + timeout
+    try:
+        conn.set_authorizer(_read_only_authorizer)
+        # Returning non-zero from the progress handler interrupts the running statement.
+        conn.set_progress_handler(lambda: int(time.monotonic() > deadline), 10000)
+        try:
+            cursor = conn.execute(sql, tuple(params or ()))
+            rows = cursor.fetchmany(max_rows + 1)
+        except sqlite3.DatabaseError as e:
+            if time.monotonic() > deadline:
+                raise QueryError(f"Query exceeded the time limit of {timeout:g} seconds.")
+            if "not authorized" in str(e):
+                raise QueryError("Only read-only SELECT statements are allowed.")
+            raise QueryError(f"Query failed: {e}")
+        except sqlite3.Warning as e:  # e.g. several statements in one string
+            raise QueryError(f"Query failed: {e}")
+        columns = [d[0] for d in cursor.description or []]
+    finally:
+        conn.close()
+
+    return {
+        "columns": columns,
+        "rows": [list(r) for r in rows[:max_rows]],
+        "truncated": len(rows) > max_rows,
+    }
+
+
+def _quote_identifier(name: str) -> str:
+    return '"' + name.replace('"', '""') + '"'
+
+
+def describe_schema(library_path: str) -> Dict[str, Any]:
+    """
+    Describes the library database: its tables and views with their columns, Calibre's
+    custom column definitions and the schema version (Calibre stores it in PRAGMA user_version).
+
+    Returns:
+        {"schema_version": int, "tables": [{"name", "type", "columns": [{"name", "type", "not_null", "primary_key"}]}],
+         "custom_columns": [{"id", "label", "name", "datatype", "is_multiple", "table"}]}
+    """
+    conn = connect_read_only(library_path)
+    try:
+        schema_version = conn.execute("PRAGMA user_version").fetchone()[0]
+        tables = []
+        for name, kind in conn.execute(
+            "SELECT name, type FROM sqlite_master WHERE type IN ('table', 'view') AND name NOT LIKE 'sqlite_%' ORDER BY name"
+        ).fetchall():
+            columns = [
+                {"name": col[1], "type": col[2] or None, "not_null": bool(col[3]), "primary_key": bool(col[5])}
+                for col in conn.execute(f"PRAGMA table_info({_quote_identifier(name)})").fetchall()
+            ]
+            tables.append({"name": name, "type": kind, "columns": columns})
+
+        custom_columns = []
+        if any(t["name"] == "custom_columns" for t in tables):
+            for col_id, label, col_name, datatype, is_multiple in conn.execute(
+                "SELECT id, label, name, datatype, is_multiple FROM custom_columns ORDER BY id"
+            ).fetchall():
+                custom_columns.append({
+                    "id": col_id,
+                    "label": label,
+                    "name": col_name,
+                    "datatype": datatype,
+                    "is_multiple": bool(is_multiple),
+                    # Calibre keeps each custom column's values in custom_column_<id>
+                    # (plus books_custom_column_<id>_link for normalized columns).
+                    "table": f"custom_column_{col_id}",
+                })
+    finally:
+        conn.close()
+
+    return {"schema_version": schema_version, "tables": tables, "custom_columns": custom_columns}
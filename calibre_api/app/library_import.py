@@ -0,0 +1,137 @@
+"""
+Import of an existing folder of e-books (e.g. a collection kept before the server was set up).
+
+The folder is walked recursively and every e-book that is not in the library yet is added with
+`calibredb add`. Imported files are recognized by a hash of their content, stored on the book as
+the identifier `import:<hash>` (see duplicates), so the import can be run again after files were added to the
+folder and only adds the new ones. Another format of a book in the library (e.g. the MOBI next to an
+imported EPUB) is added to that book rather than as a new one. The folder itself is never changed.
+
+Also runnable from the calibre_api directory:
+
+    python -m app.library_import /srv/ebooks [--library "/root/Calibre Library"] [--dry-run]
+"""
+import argparse
+import json
+import logging
+import os
+import sys
+from typing import Any, Callable, Dict, List, Optional, Set
+
+from . import duplicates
+from . import filetypes
+from . import metadata
+from . import processing_log
+from . import provenance
+from .crud import add_book, list_books, CalibredbError
+
+logger = logging.getLogger(__name__)
+
+IDENTIFIER_TYPE = duplicates.HASH_IDENTIFIER
+
+ADDED, FORMAT_ADDED, WOULD_ADD, SKIPPED, FAILED = "added", "format_added", "would_add", "skipped", "failed"
+
+
+def find_ebooks(directory: str) -> Dict[str, List[str]]:
+    """
+    Returns {"ebooks": [...], "ignored": [...]}: paths of the files under the directory that
+    are e-books by content, and of the other files (covers, OPF files, notes). Hidden files and
+    folders are left out.
+    """
+    ebooks, ignored = [], []
+    for root, dirs, files in os.walk(directory):
+        dirs[:] = sorted(d for d in dirs if not d.startswith("."))
+        for name in sorted(files):
+            if name.startswith("."):
+                continue
+            path = os.path.join(root, name)
+            try:
+                filetypes.check_ebook_file(path)
+                ebooks.append(path)
+            except (filetypes.UnsupportedFileType, OSError):
+                ignored.append(path)
+    return {"ebooks": ebooks, "ignored": ignored}
+
+
+def imported_hashes(library_path: Optional[str] = None) -> Set[str]:
+    books = list_books(library_path=library_path, search_query=f"identifiers:{IDENTIFIER_TYPE}:")
+    return {(b.get("identifiers") or {}).get(IDENTIFIER_TYPE) for b in books} - {None}
+
+
+def import_directory(directory: str, library_path: Optional[str] = None, dry_run: bool = False,
+                     add: Callable[..., List[int]] = add_book,
+                     attach: Callable[..., Optional[int]] = duplicates.attach_as_format) -> Dict[str, Any]:
+    """
+    Adds the directory's e-books that weren't imported before. Files that are another format of a
+    book in the library are added to that book (format_added). Files calibredb doesn't add
+    (a book with the same title and authors exists) count as skipped, as do files imported
+    before. A failing file is reported and the import continues.
+
+    Raises:
+        ValueError: If the directory doesn't exist.
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If the library can't be searched.
+    """
+    if not os.path.isdir(directory):
+        raise ValueError(f"'{directory}' is not a directory.")
+    found = find_ebooks(directory)
+    known = imported_hashes(library_path)
+    results = []
+    for path in found["ebooks"]:
+        relative = os.path.relpath(path, directory)
+        result: Dict[str, Any] = {"path": relative, "status": SKIPPED, "book_ids": [], "reason": None}
+        results.append(result)
+        try:
+            digest = duplicates.file_hash(path)
+        except OSError as e:
+            result.update(status=FAILED, reason=f"Cannot read file: {e}")
+            continue
+        if digest in known:
+            result["reason"] = "Imported before."
+            continue
+        known.add(digest)  # The same file may exist twice in the folder.
+        if dry_run:
+            result["status"] = WOULD_ADD
+            continue
+        try:
+            with processing_log.step("import", library_path=library_path) as log:
+                log["detail"] = f"Imported from '{os.path.abspath(path)}'."
+                attached_to = attach(path, library_path=library_path)
+                if attached_to is not None:
+                    log.update(book_ids=[attached_to], detail=f"Added as another format from '{os.path.abspath(path)}'.")
+                    result.update(status=FORMAT_ADDED, book_ids=[attached_to])
+                    continue
+                book_ids = add(file_path=path, library_path=library_path, identifiers={IDENTIFIER_TYPE: digest})
+                log["book_ids"] = book_ids
+                if book_ids:
+                    metadata.add_missing_covers(book_ids, path, library_path=library_path)
+        except (CalibredbError, ValueError) as e:
+            logger.warning(f"Import of '{path}' failed: {e}")
+            result.update(status=FAILED, reason=e.args[0])
+            continue
+        if book_ids:
+            result.update(status=ADDED, book_ids=book_ids)
+            provenance.record(book_ids, provenance.IMPORT, detail=os.path.abspath(path), library_path=library_path)
+        else:
+            result["reason"] = "calibredb found a book with the same title and authors."
+    counts = {status: sum(r["status"] == status for r in results) for status in (ADDED, FORMAT_ADDED, WOULD_ADD, SKIPPED, FAILED)}
+    logger.info(f"Import of '{directory}'{' (dry run)' if dry_run else ''}: {counts}, {len(found['ignored'])} other file(s) ignored.")
+    return {"dry_run": dry_run, **counts, "ignored": len(found["ignored"]), "results": results}
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    parser = argparse.ArgumentParser(prog="python -m app.library_import",
+                                     description="Add the e-books of a folder that are not in the library yet.")
+    parser.add_argument("directory", help="Folder to import, searched recursively.")
+    parser.add_argument("--dry-run", action="store_true", help="Only report what would be added.")
+    parser.add_argument("--library", help="Path to the Calibre library. Defaults to calibredb's default library.")
+    args = parser.parse_args(argv)
+
+    result = import_directory(args.directory, library_path=args.library, dry_run=args.dry_run)
+    print(json.dumps(result, indent=2))
+    return 1 if result[FAILED] else 0
+
+
+if __name__ == "__main__":
+    logging.basicConfig(level=logging.INFO)
+    sys.exit(main())
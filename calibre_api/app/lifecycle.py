@@ -0,0 +1,198 @@
+"""
+Graceful shutdown. On SIGTERM/SIGINT uvicorn stops accepting connections and lets running
+requests finish; then the app's lifespan ends, and this module makes it wait for background
+jobs (conversions of added books, deliveries to e-readers, full-text indexing) that run in
+daemon threads and would otherwise be killed in the middle of writing to the library.
+
+The wait is bounded by SHELFSTONE_SHUTDOWN_TIMEOUT (seconds); jobs still running after it are
+logged by name and cancelled: the Calibre command each one is running is killed (see
+calibre_cli.run_calibre_command), rather than left behind when the server exits. Queued jobs
+that haven't started are not started any more.
+
+Jobs have a priority for the Calibre command slots (see calibre_cli.max_concurrent): interactive
+work someone waits for (a download that needs converting) goes before deliveries, which go before
+bulk work (folder imports, conversions on add, full-text indexing). Commands run outside of jobs
+count as interactive: they serve a request. Running jobs are listed by GET /jobs, and a job can be
+cancelled on its own (POST /jobs/{id}/cancel) like on shutdown.
+"""
+import asyncio
+import logging
+import os
+import threading
+import time
+from contextlib import asynccontextmanager, contextmanager
+from typing import Any, AsyncIterator, Dict, Iterator, List, Optional
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_SHUTDOWN_TIMEOUT = 30.0
+# How long cancelled jobs get to notice before the server exits anyway.
+CANCEL_GRACE_SECONDS = 5.0
+
+# Lowest first; see calibre_cli._command_slot.
+BULK = "bulk"
+NORMAL = "normal"
+INTERACTIVE = "interactive"
+PRIORITIES = (BULK, NORMAL, INTERACTIVE)
+
+# Job states: waiting for a free command slot, or running.
+WAITING = "waiting"
+RUNNING = "running"
+
+
+class JobNotFound(Exception):
+    pass
+
+
+_condition = threading.Condition()
+# ID -> {"id", "name", "priority", "user_id", "state", "command", "started_at", "cancel": threading.Event}
+_jobs: Dict[int, Dict[str, Any]] = {}
+_local = threading.local()
+_next_id = 0
+_shutting_down = threading.Event()
+
+
+def shutdown_timeout() -> float:
+    try:
+        return max(0.0, float(os.environ.get("SHELFSTONE_SHUTDOWN_TIMEOUT", DEFAULT_SHUTDOWN_TIMEOUT)))
+    except ValueError:
+        return DEFAULT_SHUTDOWN_TIMEOUT
+
+
+def shutting_down() -> bool:
+    return _shutting_down.is_set()
+
+
+@contextmanager
+def job(name: str, priority: str = NORMAL, user_id: Optional[int] = None) -> Iterator[int]:
+    """
+    Marks a job as running in this thread, so shutdown waits for it, and yields its ID. Calibre
+    commands the job runs wait for a slot by `priority` and can be cancelled through its cancel
+    event (see current_cancel_event). `user_id` is who started it, if anyone.
+    """
+    global _next_id
+    if priority not in PRIORITIES:
+        raise ValueError(f"Unknown job priority '{priority}'.")
+    entry = {"name": name, "priority": priority, "user_id": user_id, "state": RUNNING, "command": None,
+             "started_at": time.time(), "cancel": threading.Event()}
+    with _condition:
+        _next_id += 1
+        entry["id"] = _next_id
+        _jobs[entry["id"]] = entry
+    outer = getattr(_local, "job", None)
+    _local.job = entry
+    try:
+        yield entry["id"]
+    finally:
+        _local.job = outer
+        with _condition:
+            _jobs.pop(entry["id"], None)
+            _condition.notify_all()
+
+
+def current_cancel_event() -> Optional[threading.Event]:
+    """The cancel event of the job running in this thread; None outside of jobs."""
+    entry = getattr(_local, "job", None)
+    return entry["cancel"] if entry else None
+
+
+def current_priority() -> str:
+    """The priority of the job running in this thread; interactive outside of jobs."""
+    entry = getattr(_local, "job", None)
+    return entry["priority"] if entry else INTERACTIVE
+
+
+def set_command(command: Optional[str], state: str = RUNNING) -> None:
+    """Notes the Calibre command the job in this thread runs or waits to run (see list_jobs)."""
+    entry = getattr(_local, "job", None)
+    if entry is not None:
+        with _condition:
+            entry.update(command=command, state=state)
+
+
+def _public(entry: Dict[str, Any]) -> Dict[str, Any]:
+    public = {key: value for key, value in entry.items() if key != "cancel"}
+    public["cancelled"] = entry["cancel"].is_set()
+    return public
+
+
+def list_jobs(user_id: Optional[int] = None) -> List[Dict[str, Any]]:
+    """The running jobs, oldest first; with `user_id`, only those the user started."""
+    with _condition:
+        return [_public(entry) for entry in _jobs.values() if user_id is None or entry["user_id"] == user_id]
+
+
+def get_job(job_id: int) -> Dict[str, Any]:
+    """
+    Raises:
+        JobNotFound: If no job with the ID is running (any more).
+    """
+    with _condition:
+        if job_id not in _jobs:
+            raise JobNotFound(f"Job {job_id} not found; it may have finished.")
+        return _public(_jobs[job_id])
+
+
+def cancel_job(job_id: int) -> Dict[str, Any]:
+    """
+    Asks a running job to stop: the Calibre command it runs is killed, and its later ones fail
+    with CommandCancelled. Returns the job.
+
+    Raises:
+        JobNotFound: If no job with the ID is running (any more).
+    """
+    with _condition:
+        if job_id not in _jobs:
+            raise JobNotFound(f"Job {job_id} not found; it may have finished.")
+        _jobs[job_id]["cancel"].set()
+        logger.warning(f"Cancelling job {job_id} ({_jobs[job_id]['name']}).")
+        return _public(_jobs[job_id])
+
+
+def cancel_jobs() -> None:
+    """Asks all running jobs to stop: their running and later Calibre commands fail with CommandCancelled."""
+    with _condition:
+        for entry in _jobs.values():
+            entry["cancel"].set()
+
+
+def running_jobs() -> List[str]:
+    with _condition:
+        return [entry["name"] for entry in _jobs.values()]
+
+
+def wait_for_jobs(timeout: float) -> List[str]:
+    """Waits up to `timeout` seconds for running jobs to finish. Returns the names of those still running."""
+    with _condition:
+        _condition.wait_for(lambda: not _jobs, timeout=timeout)
+        return [entry["name"] for entry in _jobs.values()]
+
+
+def begin_shutdown() -> None:
+    _shutting_down.set()
+
+
+def reset() -> None:
+    """Clears the shutdown state (used by tests)."""
+    _shutting_down.clear()
+
+
+@asynccontextmanager
+async def lifespan(app) -> AsyncIterator[None]:
+    """FastAPI lifespan: on shutdown, waits for running background jobs."""
+    yield
+    begin_shutdown()
+    running = running_jobs()
+    if not running:
+        return
+    timeout = shutdown_timeout()
+    logger.warning(f"Waiting up to {timeout:g}s for {len(running)} background job(s) to finish: {', '.join(running)}.")
+    left = await asyncio.get_running_loop().run_in_executor(None, wait_for_jobs, timeout)
+    if not left:
+        logger.info("All background jobs finished.")
+        return
+    logger.error(f"Cancelling {len(left)} background job(s) still running: {', '.join(left)}.")
+    cancel_jobs()
+    left = await asyncio.get_running_loop().run_in_executor(None, wait_for_jobs, CANCEL_GRACE_SECONDS)
+    if left:
+        logger.error(f"Shutting down with {len(left)} background job(s) still running: {', '.join(left)}.")
@@ -0,0 +1,136 @@
+import os
+import json
+import logging
+from typing import Dict, Optional
+
+from fastapi import HTTPException
+
+logger = logging.getLogger(__name__)
+
+MB = 1024 * 1024
+
+# Defaults, overridable with SHELFSTONE_MAX_BODY_MB and SHELFSTONE_BODY_LIMITS_MB.
+DEFAULT_MAX_BODY_MB = 512
+# Chunks of resumable uploads are meant to be small enough to pass any proxy.
+DEFAULT_ROUTE_LIMITS_MB = {"/uploads/": 64}
+
+
+def parse_route_limits(value: Optional[str]) -> Dict[str, int]:
+    """
+    Parses "prefix=MB,prefix=MB" (e.g. "/books/add/=200,/uploads/=32") into {prefix: bytes}.
+
+    Raises:
+        ValueError: If an entry is malformed.
+    """
+    limits: Dict[str, int] = {}
+    for entry in (value or "").split(","):
+        entry = entry.strip()
+        if not entry:
+            continue
+        prefix, sep, size = entry.rpartition("=")
+        if not sep or not prefix.startswith("/"):
+            raise ValueError(f"Invalid body size limit entry '{entry}', expected '/path/prefix=MB'.")
+        limits[prefix] = int(float(size) * MB)
+    return limits
+
+
+def load_limits_from_env() -> Dict[str, int]:
+    """
+    Returns the effective limits as {path prefix: bytes}; the "/" entry is the global default.
+    """
+    limits = {"/": int(float(os.environ.get("SHELFSTONE_MAX_BODY_MB", DEFAULT_MAX_BODY_MB)) * MB)}
+    limits.update({prefix: mb * MB for prefix, mb in DEFAULT_ROUTE_LIMITS_MB.items()})
+    limits.update(parse_route_limits(os.environ.get("SHELFSTONE_BODY_LIMITS_MB")))
+    return limits
+
+
+def _limit_settings():
+    return os.environ.get("SHELFSTONE_MAX_BODY_MB"), os.environ.get("SHELFSTONE_BODY_LIMITS_MB")
+
+
+def limit_for_path(path: str, limits: Dict[str, int]) -> Optional[int]:
+    """
+    Returns the limit of the longest matching prefix, or None if no prefix matches.
+    A limit of 0 disables the check for that prefix.
+    """
+    matches = [prefix for prefix in limits if path.startswith(prefix)]
+    if not matches:
+        return None
+    limit = limits[max(matches, key=len)]
+    return limit or None
+
+
+class BodySizeLimitMiddleware:
+    """
+    ASGI middleware that rejects request bodies above the limit configured for the route
+    with 413, before the endpoint (and any Calibre tool) sees them. Requests announcing a
+    too-large Content-Length are rejected up front; bodies without a Content-Length are
+    counted while they are received.
+    """
+
+    def __init__(self, app, limits: Optional[Dict[str, int]] = None):
+        self.app = app
+        # Limits from the environment follow configuration reloads (see config.reload).
+        self._settings = None if limits is not None else _limit_settings()
+        self.limits = limits if limits is not None else load_limits_from_env()
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+
+        if self._settings is not None and self._settings != _limit_settings():
+            self._settings = _limit_settings()
+            self.limits = load_limits_from_env()
+
+        limit = limit_for_path(scope["path"], self.limits)
+        if limit is None:
+            await self.app(scope, receive, send)
+            return
+
+        headers = dict(scope.get("headers") or [])
+        content_length = headers.get(b"content-length")
+        if content_length is not None and content_length.isdigit() and int(content_length) > limit:
+            await self._reject(send, limit)
+            return
+
+        received = 0
+        response_started = False
+
+        async def limited_receive():
+            nonlocal received
+            message = await receive()
+            if message["type"] == "http.request":
+                received += len(message.get("body", b""))
+                if received > limit:
+                    raise _BodyTooLarge(limit)
+            return message
+
+        async def tracking_send(message):
+            nonlocal response_started
+            if message["type"] == "http.response.start":
+                response_started = True
+            await send(message)
+
+        try:
+            await self.app(scope, limited_receive, tracking_send)
+        except _BodyTooLarge:
+            if not response_started:
+                await self._reject(send, limit)
+
+    async def _reject(self, send, limit: int):
+        logger.warning(f"Rejected request body larger than {limit} bytes.")
+        body = json.dumps({"detail": _BodyTooLarge(limit).detail}).encode()
+        await send({
+            "type": "http.response.start",
+            "status": 413,
+            "headers": [(b"content-type", b"application/json"), (b"content-length", str(len(body)).encode())],
+        })
+        await send({"type": "http.response.body", "body": body})
+
+
+class _BodyTooLarge(HTTPException):
+    # An HTTPException, so that FastAPI's body parsing and exception handlers pass it
+    # through as a 413 instead of wrapping it into a generic 400 parse error.
+    def __init__(self, limit: int):
+        super().__init__(status_code=413, detail=f"Request body too large. The limit for this endpoint is {limit // MB} MB.")
@@ -0,0 +1,126 @@
+"""
+Regional formatting for CSV reports and currency conversion for acquisition data, so exports
+paste cleanly into spreadsheets set up for e.g. German (`1234,56` in `;`-separated columns,
+dates as `31.12.2026`) or US conventions.
+
+Exchange rates are not fetched from anywhere: callers pass them in (or set
+SHELFSTONE_EXCHANGE_RATES), so reports are reproducible and work offline.
+
+Also holds sort_key, for sorting names and titles in any script.
+"""
+import os
+import re
+import unicodedata
+from dataclasses import dataclass
+from datetime import date
+from typing import Dict, Optional
+
+
+@dataclass(frozen=True)
+class LocaleFormat:
+    decimal: str
+    delimiter: str  # CSV column separator; ";" wherever "," is the decimal separator
+    date_format: str
+
+
+LOCALES = {
+    "en": LocaleFormat(".", ",", "%Y-%m-%d"),
+    "en-us": LocaleFormat(".", ",", "%m/%d/%Y"),
+    "en-gb": LocaleFormat(".", ",", "%d/%m/%Y"),
+    "de": LocaleFormat(",", ";", "%d.%m.%Y"),
+    "fr": LocaleFormat(",", ";", "%d/%m/%Y"),
+    "es": LocaleFormat(",", ";", "%d/%m/%Y"),
+    "it": LocaleFormat(",", ";", "%d/%m/%Y"),
+    "nl": LocaleFormat(",", ";", "%d-%m-%Y"),
+    "pl": LocaleFormat(",", ";", "%d.%m.%Y"),
+    "sv": LocaleFormat(",", ";", "%Y-%m-%d"),
+    "ja": LocaleFormat(".", ",", "%Y/%m/%d"),
+}
+DEFAULT_LOCALE = "en"
+
+
+def get_locale(name: Optional[str]) -> LocaleFormat:
+    """
+    Looks up a locale by tag ("de", "de-AT", "en_US"), falling back from region to language.
+
+    Raises:
+        ValueError: If neither the tag nor its language is known.
+    """
+    tag = (name or DEFAULT_LOCALE).strip().lower().replace("_", "-")
+    if tag in LOCALES:
+        return LOCALES[tag]
+    language = tag.split("-")[0]
+    if language in LOCALES:
+        return LOCALES[language]
+    raise ValueError(f"Unknown locale '{name}'. Supported: {', '.join(sorted(LOCALES))}.")
+
+
+def format_number(value: Optional[float], fmt: LocaleFormat, places: int = 2) -> str:
+    # No thousands separators: spreadsheets parse "1234,56" reliably but not "1.234,56" in every setup.
+    if value is None:
+        return ""
+    return f"{value:.{places}f}".replace(".", fmt.decimal)
+
+
+def format_date(value: Optional[str], fmt: LocaleFormat) -> str:
+    """Formats a "YYYY-MM-DD" date; empty for None."""
+    if not value:
+        return ""
+    return date.fromisoformat(value[:10]).strftime(fmt.date_format)
+
+
+def parse_rates(text: Optional[str]) -> Dict[str, float]:
+    """
+    Parses "USD=0.92,GBP=1.17": how much one unit of each currency is worth in the target currency.
+
+    Raises:
+        ValueError: For malformed entries or non-positive rates.
+    """
+    rates = {}
+    for entry in (text or "").split(","):
+        if not entry.strip():
+            continue
+        currency, sep, rate = entry.partition("=")
+        currency = currency.strip().upper()
+        try:
+            value = float(rate)
+        except ValueError:
+            value = None
+        if not sep or len(currency) != 3 or not currency.isalpha() or value is None or value <= 0:
+            raise ValueError(f"Invalid exchange rate '{entry.strip()}'. Use CODE=rate, e.g. USD=0.92.")
+        rates[currency] = value
+    return rates
+
+
+def exchange_rates(text: Optional[str] = None) -> Dict[str, float]:
+    """Rates given in the request, else those configured in SHELFSTONE_EXCHANGE_RATES."""
+    return parse_rates(text if text else os.environ.get("SHELFSTONE_EXCHANGE_RATES"))
+
+
+def convert(amount: float, currency: Optional[str], target: str, rates: Dict[str, float]) -> float:
+    """
+    Raises:
+        ValueError: If the currency is unknown or has no rate.
+    """
+    if currency == target:
+        return amount
+    if not currency:
+        raise ValueError(f"Cannot convert an amount without currency to {target}.")
+    if currency not in rates:
+        raise ValueError(f"No exchange rate from {currency} to {target}. Pass e.g. rates={currency}=1.0.")
+    return round(amount * rates[currency], 2)
+
+
+# Directional marks and embeddings (LRM, RLM, LRE..RLO, LRI..PDI) often wrap Arabic and Hebrew
+# names pasted from web pages; invisible, but they would sort such names before everything else.
+_BIDI_CONTROLS_RE = re.compile("[\u200e\u200f\u202a-\u202e\u2066-\u2069]")
+
+
+def sort_key(text: str) -> str:
+    """
+    Sort key for names and titles: case-insensitive in every script (casefold), with
+    full-width Latin and half-width kana folded to their usual forms (NFKC) and directional
+    marks ignored. Scripts sort by code point, i.e. Latin, Greek, Cyrillic, Hebrew, Arabic, kana,
+    Han, Hangul.
+    """
+    return unicodedata.normalize("NFKC", _BIDI_CONTROLS_RE.sub("", text or "")).casefold()
@@ -0,0 +1,109 @@
+"""
+Keeps the most recent log records in memory so operators can read and follow them over
+HTTP (GET /admin/logs) without shell access to the container. Logs can reveal file names,
+addresses and library paths, so the endpoint is off unless SHELFSTONE_ENABLE_ADMIN_LOGS is set.
+"""
+import json
+import logging
+import os
+import threading
+from collections import deque
+from typing import Any, Dict, List, Optional
+
+DEFAULT_BUFFER_SIZE = 1000
+LEVELS = ("DEBUG", "INFO", "WARNING", "ERROR", "CRITICAL")
+
+
+def endpoint_enabled() -> bool:
+    """Whether GET /admin/logs serves the buffer: SHELFSTONE_ENABLE_ADMIN_LOGS set to 1/true/yes."""
+    return os.environ.get("SHELFSTONE_ENABLE_ADMIN_LOGS", "").strip().lower() in ("1", "true", "yes")
+
+
+class RingBufferHandler(logging.Handler):
+    """Logging handler that keeps the last `capacity` records as structured entries."""
+
+    def __init__(self, capacity: int = DEFAULT_BUFFER_SIZE):
+        super().__init__()
+        self._entries = deque(maxlen=capacity)
+        self._seq = 0
+        self._lock = threading.Lock()
+
+    def emit(self, record: logging.LogRecord) -> None:
+        try:
+            message = record.getMessage()
+            if record.exc_info and record.exc_info[0] is not None:
+                message += "\n" + logging.Formatter().formatException(record.exc_info)
+            with self._lock:
+                self._seq += 1
+                self._entries.append({
+                    "seq": self._seq,
+                    "time": record.created,
+                    "level": record.levelname,
+                    "component": record.name,
+                    "message": message,
+                })
+        except Exception:
+            self.handleError(record)
+
+    @property
+    def last_seq(self) -> int:
+        with self._lock:
+            return self._seq
+
+    def entries(self, since: int = 0, level: Optional[str] = None, component: Optional[str] = None,
+                limit: Optional[int] = None) -> List[Dict[str, Any]]:
+        """
+        Returns buffered entries newer than `since`, oldest first, filtered by minimum level and
+        component (see matches_component). With `limit`, only the newest `limit` entries.
+        """
+        min_level = logging.getLevelName(level.upper()) if level else 0
+        with self._lock:
+            selected = [
+                e for e in self._entries
+                if e["seq"] > since
+                and logging.getLevelName(e["level"]) >= min_level
+                and (not component or matches_component(e["component"], component))
+            ]
+        return selected[-limit:] if limit else selected
+
+
+def matches_component(logger_name: str, component: str) -> bool:
+    """
+    True if the logger belongs to the component, given as a module name ("crud") or a dotted
+    prefix ("uvicorn", "calibre_api.app.crud"). Module loggers are named "app.crud" or
+    "calibre_api.app.crud" depending on how the server is started, so both match "crud".
+    """
+    parts = logger_name.split(".")
+    wanted = component.split(".")
+    return any(parts[i:i + len(wanted)] == wanted for i in range(len(parts) - len(wanted) + 1))
+
+
+def validate_level(level: Optional[str]) -> Optional[str]:
+    """
+    Raises:
+        ValueError: If level is not a standard logging level name.
+    """
+    if level is not None and level.upper() not in LEVELS:
+        raise ValueError(f"Unknown log level '{level}'. Use one of: {', '.join(LEVELS)}.")
+    return level
+
+
+def format_sse(entry: Dict[str, Any]) -> str:
+    return f"id: {entry['seq']}\nevent: log\ndata: {json.dumps(entry)}\n\n"
+
+
+_handler: Optional[RingBufferHandler] = None
+
+
+def install(capacity: Optional[int] = None) -> RingBufferHandler:
+    """Attaches the buffer to the root logger (once) and returns it."""
+    global _handler
+    if _handler is None:
+        if capacity is None:
+            try:
+                capacity = int(os.environ.get("SHELFSTONE_LOG_BUFFER_SIZE", DEFAULT_BUFFER_SIZE))
+            except ValueError:
+                capacity = DEFAULT_BUFFER_SIZE
+        _handler = RingBufferHandler(max(1, capacity))
+        logging.getLogger().addHandler(_handler)
+    return _handler
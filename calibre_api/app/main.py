@@ -1,80 +1,266 @@
-from fastapi import FastAPI, HTTPException, Query, File, UploadFile, Form
-from typing import List, Optional, Any
+from fastapi import FastAPI, HTTPException, Query, File, UploadFile, Form, Body, Header, Response, Request
+from fastapi.responses import FileResponse, StreamingResponse, HTMLResponse, PlainTextResponse, JSONResponse
+from starlette.background import BackgroundTask
+from typing import List, Optional, Any, Tuple
+import asyncio
+import csv
+import io
 import logging
+import os
 import shutil
+import sqlite3
 import tempfile
-import os
+import time
+import uuid
+from contextlib import ExitStack
+from io import BytesIO
+from urllib.parse import quote
 
-from .models import Book, AddBookResponse, RemoveBookResponse, SetMetadataRequest, SetMetadataResponse
-from .crud import list_books, add_book, remove_book, set_book_metadata, CalibredbError
+from .models import (
+    Book, BookSource, AddBookResponse, RemoveBookResponse, SetMetadataRequest, SetMetadataResponse,
+    CalibreVersionResponse, EbookConvertRequest, EbookConvertResponse, EbookMetadataGetRequest,
+    EbookMetadataSetRequest, EbookMetadataResponse, EbookPolishRequest, EbookPolishResponse,
+    FetchMetadataQueryRequest, FetchMetadataResponse, WebToDiskRequest, WebToDiskResponse, LrfConversionResponse,
+    PluginListResponse, DebugTestBuildResponse, SmtpSendRequest, SmtpSendResponse, EbookCheckResponse,
+    ReextractRequest, ReextractBookResult, ReextractResponse, LibraryDiffResponse, CleanupResponse,
+    OptimizeDbResponse, AddBookPackageResponse, AttachmentInfo, AttachmentListResponse, CheckOwnedResponse,
+    UploadCreateRequest, UploadStatus, UploadCommitRequest, CommandFailure, CommandFailuresResponse,
+    SqlQueryRequest, SqlQueryResponse, LibrarySchemaResponse, MaintenanceModeRequest, MaintenanceModeStatus,
+    LogEntry, NewsFetchResponse, RenameRequest, MergeTagsRequest, TaxonomyUpdateResponse, UnusedEntriesResponse,
+    TagCount, FullTextIndexStatus, FullTextHit, FullTextSearchResponse, BookSearchHit, BookSearchResponse,
+    PhysicalCopyUpdate, PhysicalCopy, PhysicalBook, AcquisitionUpdate, Acquisition, SpendingReport,
+    LibraryImportResponse, FormatInfo, SendBookRequest, DeviceInfo, DeliveryStatus, MetadataCandidate,
+    MetadataFetchRequest, MetadataFetchResponse, MetadataApplyRequest, MetadataApplyResponse, DuplicateGroup,
+    DuplicatesResponse, FeatureStatus, FeatureOverrideRequest, BookConversionStatus, Job, LibraryStatsResponse,
+    Collection, CollectionDetail, CollectionCreateRequest, CollectionUpdateRequest, CollectionBooksRequest,
+    CollectionShareRequest, CollectionShare, PublicCatalogRequest, PublicCatalog, PublicCatalogBook, PublicCatalogPage,
+    Club, ClubDetail, ClubCreateRequest, ClubUpdateRequest, ClubMember,
+    ClubMemberRequest, ClubReading, ClubReadingRequest, ClubMilestone, ClubMilestoneRequest, ClubMilestoneUpdateRequest,
+    ClubComment, ClubCommentRequest, ClubCommentUpdateRequest,
+    AuthorEntry, AuthorBooksResponse, SeriesEntry, SeriesBooksResponse, ConfigReloadResponse, HealthResponse,
+    ReadinessResponse, ProcessingLogResponse, User, AuthStatus, Credentials, LoginResponse, PasswordChangeRequest,
+    ApiTokenCreateRequest, ApiToken, NewApiToken, UserCreateRequest, UserUpdateRequest,
+    RegistrationRequest, InvitationCreateRequest, Invitation, NewInvitation, InvitationCheck,
+    AccountDeletionRequest, EmailChangeRequest, PasswordResetRequest, PasswordResetCompletion, PasswordResetCheck, PasswordResetEvent,
+    ReadingProgressUpdate, ReadingProgress, BookmarkCreateRequest, BookmarkUpdateRequest, Bookmark,
+    DownloadHistory, DownloadReport, RatingRequest, Rating, BookRatings, Reactions, BookReader, BookReaders, PrivacySettings, PrivacyUpdateRequest, ActivityEvent, WishCreateRequest, WishUpdateRequest, Wish,
+    Preferences, Notification, NotificationList, NotificationCount, NotificationsReadRequest, NotificationUpdateRequest,
+    FollowRequest, FollowUpdateRequest, Follow,
+    BookCommentRequest, BookCommentUpdateRequest, CommentMention, BookComment, BookComments
+)
+from .crud import as_list, list_books, list_book_ids, list_books_by_ids, add_book, remove_book, set_book_metadata, CalibredbError, escape_search_value
+from .filetypes import book_format_names
+from .bundles import safe_name
+from .state_store import library_key
+from .qrcodes import public_base_url
+from .limits import BodySizeLimitMiddleware
+from .maintenance_mode import MaintenanceModeMiddleware
+from .features import FeatureFlagMiddleware
+from .auth import AuthMiddleware
+from .opds_throttle import OpdsThrottleMiddleware
+from . import covers
+from . import idempotency
+from . import filetypes
+from . import logstream
+from . import fulltext
+from . import conversion_cache
+from . import conversion_policy
+from . import thumbnails
+from . import config
+from . import formats as format_registry
+from . import features
+from . import book_collections
+from . import lifecycle
+from . import provenance
+from . import processing_log
+from . import calibre_cli
+from . import crud
+from . import metadata as metadata_utils
+from . import diff as library_diff
+from . import janitor
+from . import db_maintenance
+from . import maintenance_mode
+from . import packages
+from . import attachments
+from . import cards
+from . import qrcodes
+from . import isbn as isbn_utils
+from . import uploads
+from . import metrics
+from . import library_db
+from . import news
+from . import taxonomy
+from . import bundles
+from . import sync
+from . import physical
+from . import acquisitions
+from . import localeformat
+from . import calendar_feed
+from . import opds
+from . import opds_i18n
+from . import public_app
+from . import library_import
+from . import delivery
+from . import metadata_providers
+from . import duplicates as duplicate_detection
+from . import stats
+from . import browse
+from . import doctor
+from . import accounts
+from . import auth
+from . import reading
+from . import kosync
+from . import download_log
+from . import ratings
+from . import wishlist
+from . import preferences
+from . import password_reset
+from . import notifications
+from . import follows
+from . import book_clubs
+from . import book_comments
+from . import reactions
+from . import privacy
+from . import activity
+from . import opds_throttle
+
+# Settings from the config file and environment; invalid settings stop the server here.
+config.load()
 
 # Configure basic logging
-logging.basicConfig(level=logging.INFO)
+logging.basicConfig(level=config.get("SHELFSTONE_LOG_LEVEL"))
 logger = logging.getLogger(__name__)
+# Keep recent log records in memory for GET /admin/logs.
+logstream.install()
+# SIGHUP re-reads the config file without a restart (see config.reload).
+config.install_reload_handler()
 
 app = FastAPI(
     title="Shelfstone Server API",
     description="A FastAPI wrapper for Calibre command-line tools, providing the backend for Shelfstone.",
     version="0.1.0",
+    # On shutdown, waits for running conversions, deliveries and indexing (see lifecycle.py).
+    lifespan=lifecycle.lifespan,
 )
 
+# Reject oversized request bodies (per-route limits, see limits.py) before any endpoint reads them.
+app.add_middleware(BodySizeLimitMiddleware)
+# Reject write requests with 503 while maintenance mode is on (see maintenance_mode.py).
+app.add_middleware(MaintenanceModeMiddleware)
+# Answer requests to the routes of disabled features with 403 (see features.py).
+app.add_middleware(FeatureFlagMiddleware)
+# Requests without the credentials they need (the admin token, or a signed-in user with accounts
+# on) get 401 before the middleware above or any endpoint looks at them (see auth.py).
+app.add_middleware(AuthMiddleware)
+# Added last so it runs first: reading apps crawling the catalog are slowed down before their
+# credentials are checked, which takes a while for passwords (see opds_throttle.py).
+app.add_middleware(OpdsThrottleMiddleware)
+
+# Endpoints are plain `def` so FastAPI runs them in its threadpool: Calibre commands block while
+# they run or wait for a free slot (see calibre_cli), which must not stall the event loop. Only
+# endpoints that await the request body or stream a response, and the health probes, are async.
+
+def book_from_calibredb(book_dict: dict, include_palette: bool = False) -> Book:
+    """
+    Converts one entry of `calibredb list --for-machine` into a Book.
+    Raises HTTPException 500 if the entry doesn't fit the model.
+    """
+    try:
+        # Ensure the list fields are lists if they exist and are strings
+        # (calibredb returns "A & B" for authors and comma-separated strings for the others)
+        for field in ('authors', 'tags', 'formats', 'languages'):
+            if field in book_dict and isinstance(book_dict[field], str):
+                book_dict[field] = as_list(book_dict[field], field)
+
+        if include_palette:
+            book_dict['palette'] = covers.try_extract_palette(book_dict.get('cover'))
+
+        return Book(**book_dict)
+    except Exception as e: # Catch Pydantic validation errors or other issues per book
+        logger.error(f"Error parsing book data: {book_dict}. Error: {e}", exc_info=True)
+        # We are strict and raise an error if any book fails validation.
+        # This could be changed to skip problematic books and return valid ones.
+        raise HTTPException(
+            status_code=500,
+            detail=f"Error processing book data from calibredb. Problematic book: {book_dict.get('title', 'Unknown title')}. Error: {str(e)}"
+        )
+
+
 @app.get("/books/", response_model=List[Book])
-async def get_books_endpoint(
+def get_books_endpoint(
+    request: Request,
+    response: Response,
     library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used."),
-    search: Optional[str] = Query(None, description="Search query for calibredb (e.g., 'title:Dune author:Herbert').")
+    search: Optional[str] = Query(None, description="Search query for calibredb (e.g., 'title:Dune author:Herbert')."),
+    include_palette: bool = Query(False, description="Include the dominant cover colors of each book in the response."),
+    limit: Optional[int] = Query(None, ge=1, description="Maximum number of books to return. Your preferred items per page if not provided, else all books."),
+    offset: int = Query(0, ge=0, description="Number of books to skip, for paging through large libraries."),
+    tag: Optional[List[str]] = Query(None, description="Only books with this tag (exact name, case-insensitive). Repeat for books with all of several tags."),
+    collection: Optional[int] = Query(None, description="Only books in the collection with this ID (see /collections/)."),
+    source: Optional[str] = Query(None, description=f"Only books the server added this way: {', '.join(provenance.SOURCES)}."),
+    sort: Optional[str] = Query(None, description=f"Order of the books: {', '.join(preferences.SORTS)}. Your preferred sort if not provided, else calibredb's order.")
 ):
     """
     Retrieve a list of books from the Calibre library.
     Uses `calibredb list --for-machine --fields all`.
+    If `include_palette` is true, each book carries a `palette` of dominant cover colors
+    so frontends can theme detail pages without analysing images client-side.
+    With `limit`/`offset` only one page is returned, and only that page's books are read in
+    full; the `X-Total-Count` header always carries the number of matching books.
+    `tag`, `collection` and `source` narrow `search` further.
+    Each book carries its `source`, if the server recorded how it was added.
+    Signed-in users' preferences (`GET /me/preferences`) fill in `sort` and `limit`.
     """
     try:
-        logger.info(f"Received request for books. Library path: '{library_path}', Search: '{search}'")
-
-        # Call the CRUD function to get book data
-        books_data = list_books(library_path=library_path, search_query=search)
-
-        # Validate and parse data with Pydantic models
-        # Pydantic will raise validation errors if the data doesn't match the Book model
-        # For example, if 'id' is missing or 'authors' is not a list.
-        # FastAPI handles these Pydantic validation errors automatically and returns a 422 response.
-
-        # However, calibredb --for-machine output is a list of dicts.
-        # We need to ensure each dict can be parsed into a Book model.
-        # If a field is missing but Optional in Pydantic, it's fine.
-        # If a required field (like 'id' or 'title' if not Optional) is missing, Pydantic will error.
-
-        validated_books: List[Book] = []
-        for book_dict in books_data:
-            try:
-                # Ensure 'authors' and 'tags' are lists if they exist and are strings
-                # (calibredb sometimes returns comma-separated strings for these)
-                # This preprocessing step might be better placed in the crud layer or a dedicated parsing function.
-                if 'authors' in book_dict and isinstance(book_dict['authors'], str):
-                    book_dict['authors'] = [a.strip() for a in book_dict['authors'].split(',')] if book_dict['authors'] else []
-
-                if 'tags' in book_dict and isinstance(book_dict['tags'], str):
-                    book_dict['tags'] = [t.strip() for t in book_dict['tags'].split(',')] if book_dict['tags'] else []
-
-                if 'formats' in book_dict and isinstance(book_dict['formats'], str):
-                     book_dict['formats'] = [f.strip() for f in book_dict['formats'].split(',')] if book_dict['formats'] else []
-
-                if 'languages' in book_dict and isinstance(book_dict['languages'], str):
-                     book_dict['languages'] = [lang.strip() for lang in book_dict['languages'].split(',')] if book_dict['languages'] else []
-
-                validated_books.append(Book(**book_dict))
-            except Exception as e: # Catch Pydantic validation errors or other issues per book
-                logger.error(f"Error parsing book data: {book_dict}. Error: {e}", exc_info=True)
-                # Optionally, skip this book or raise an error for the whole request
-                # For now, we'll be strict and raise an error if any book fails validation.
-                # This could be changed to skip problematic books and return valid ones.
-                raise HTTPException(
-                    status_code=500,
-                    detail=f"Error processing book data from calibredb. Problematic book: {book_dict.get('title', 'Unknown title')}. Error: {str(e)}"
-                )
+        prefs = preferences.effective(auth.current_user(request))
+        sort = sort or prefs["default_sort"]
+        limit = limit or prefs["items_per_page"]
+        if sort is not None and sort not in preferences.SORTS:
+            raise HTTPException(status_code=400, detail=f"Unknown sort: {sort}. Use one of: {', '.join(preferences.SORTS)}.")
+        sort_by, ascending = preferences.SORTS[sort] if sort else (None, False)
+        logger.info(f"Received request for books. Library path: '{library_path}', Search: '{search}', Tags: {tag}, "
+                    f"Collection: {collection}, Source: {source}, Sort: {sort}, Limit: {limit}, Offset: {offset}")
+
+        member_ids = None
+        if collection is not None:
+            member_ids = set(collection_for(request, collection, library_path)["book_ids"])
+        if source is not None:
+            from_source = provenance.books_from(source, library_path=library_path)
+            member_ids = from_source if member_ids is None else member_ids & from_source
+        terms = ([f"({search})"] if search else []) + [f'tags:"={escape_search_value(t)}"' for t in tag or []]
+
+        search_query = " and ".join(terms) or None
+        if limit is None and offset == 0:
+            # Everything matching: one calibredb call.
+            page = list_books(library_path=library_path, search_query=search_query, sort_by=sort_by, ascending=ascending)
+            if member_ids is not None:
+                page = [b for b in page if b.get("id") in member_ids]
+            total = len(page)
+        else:
+            # Find the matching IDs cheaply, then read only the page's books with all fields.
+            book_ids = list_book_ids(library_path=library_path, search_query=search_query, sort_by=sort_by, ascending=ascending)
+            if member_ids is not None:
+                book_ids = [i for i in book_ids if i in member_ids]
+            total = len(book_ids)
+            page_ids = book_ids[offset:offset + limit] if limit is not None else book_ids[offset:]
+            page = list_books_by_ids(page_ids, library_path=library_path) if page_ids else []
+        response.headers["X-Total-Count"] = str(total)
+
+        # FastAPI turns Pydantic validation errors of the response into a 500, but we want to
+        # name the book that failed, so each entry is validated here.
+        validated_books: List[Book] = [book_from_calibredb(book_dict, include_palette) for book_dict in page]
+        with_sources(validated_books, library_path)
+        with_reactions(validated_books, library_path)
 
         logger.info(f"Successfully retrieved and validated {len(validated_books)} books.")
         return validated_books
 
+    except HTTPException:
+        raise
+    except book_collections.CollectionNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
     except FileNotFoundError as e:
         logger.error(f"calibredb not found: {e}", exc_info=True)
         raise HTTPException(
@@ -96,50 +282,178 @@ async def get_books_endpoint(
             detail=f"An unexpected server error occurred: {str(e)}"
         )
 
+def with_sources(books: List[Book], library_path: Optional[str] = None) -> List[Book]:
+    """Fills in the recorded source of each book (see provenance.py)."""
+    sources = provenance.sources_of([b.id for b in books], library_path=library_path)
+    for book in books:
+        if book.id in sources:
+            book.source = BookSource(**sources[book.id])
+    return books
+
+def with_reactions(books: List[Book], library_path: Optional[str] = None) -> List[Book]:
+    """Fills in the counts of the users' reactions to each book (see reactions.py)."""
+    counts = reactions.book_counts([b.id for b in books], library_path=library_path)
+    for book in books:
+        book.reactions = counts.get(book.id)
+    return books
+
+def client_address(request: Request) -> Optional[str]:
+    return request.client.host if request.client else None
+
+def request_user_id(request: Request) -> Optional[int]:
+    """ID of the signed-in user of the request; None without accounts or with the admin token."""
+    user = auth.current_user(request)
+    return user["id"] if user else None
+
+def notify_upload_failed(request: Request, filename: Optional[str], error: str) -> None:
+    """Puts a failed upload in the uploader's notification inbox, for uploads they may not be watching."""
+    notifications.notify(request_user_id(request), notifications.UPLOAD_FAILED, f"Adding '{filename or 'upload'}' failed", error)
+
+def added_books(book_ids: List[int], library_path: Optional[str] = None) -> List[Book]:
+    """
+    Looks up the records of newly added books for the add response. Best effort: the books are
+    already in the library, so a failed lookup is logged and returns what was found.
+    """
+    if not book_ids:
+        return []
+    try:
+        books_data = list_books(library_path=library_path, search_query=" or ".join(f"id:{i}" for i in book_ids))
+        return [book_from_calibredb(b) for b in books_data if b.get('id') in book_ids]
+    except Exception as e:
+        logger.warning(f"Could not look up added book(s) {book_ids}: {e}")
+        return []
+
+def same_file_response(book_ids: List[int]) -> AddBookResponse:
+    return AddBookResponse(
+        message="This file is already in the library; no new entries were added.",
+        added_book_ids=[],
+        details=f"Same content as book ID(s) {', '.join(map(str, book_ids))}. Send duplicates=true to add it anyway.",
+        duplicate_of=book_ids
+    )
+
+def format_added_response(book_id: int, library_path: Optional[str], user_id: Optional[int] = None) -> AddBookResponse:
+    fulltext.update_after_change([book_id], library_path=library_path)
+    conversion_policy.enqueue([book_id], library_path=library_path, user_id=user_id)
+    return AddBookResponse(
+        message="File added as another format of an existing book.",
+        added_book_ids=[],
+        details=f"Book ID {book_id} has the same title and authors and didn't have this format. Send merge_formats=false to add a new book instead.",
+        books=added_books([book_id], library_path),
+        format_added_to=book_id
+    )
+
+# /books/upload is the same endpoint under the name web UIs tend to expect.
 @app.post("/books/add/", response_model=AddBookResponse)
-async def add_book_endpoint(
+@app.post("/books/upload", response_model=AddBookResponse)
+def add_book_endpoint(
+    request: Request,
     file: UploadFile = File(...),
     library_path: Optional[str] = Form(None),
     one_book_per_directory: bool = Form(False),
     duplicates: bool = Form(False), # Add new books even if they appear to be duplicates of existing books.
     automerge: bool = Form(False), # If duplicates are found, auto-merge them.
+    merge_formats: bool = Form(True), # Add the file to a matching book that doesn't have its format yet.
     authors: Optional[str] = Form(None), # Comma-separated
     title: Optional[str] = Form(None),
-    tags: Optional[str] = Form(None) # Comma-separated
+    tags: Optional[str] = Form(None), # Comma-separated
+    idempotency_key: Optional[str] = Header(None, alias="Idempotency-Key", description="Client-chosen key that makes retries of this upload safe.")
 ):
     """
     Add a book to the Calibre library.
     The book file is uploaded and then processed by `calibredb add`.
+
+    A file of a format a book with the same title and authors doesn't have yet (e.g. the MOBI of a
+    book that has an EPUB) is added to that book instead of creating a second one, unless
+    `merge_formats` is false or `duplicates` is true.
+
+    If an `Idempotency-Key` header is sent, the key is stored on the new book as an identifier.
+    A retry with the same key returns the book from the first attempt instead of adding it again.
     """
+    if idempotency_key:
+        try:
+            idempotency.validate_key(idempotency_key)
+        except ValueError as e:
+            raise HTTPException(status_code=400, detail=str(e))
+
+    # Reject non-e-book content before it is written anywhere or passed to calibredb.
+    try:
+        sniffed_format = filetypes.check_ebook_bytes(file.file.read(filetypes.SNIFF_BYTES), filename=file.filename)
+    except filetypes.UnsupportedFileType as e:
+        raise HTTPException(status_code=415, detail=str(e))
+    file.file.seek(0)
+
     # Create a temporary directory to store the uploaded file
+    # Each request gets its own directory, so equal file names from concurrent uploads don't clash;
+    # only the base name is kept, so a crafted name can't write outside it.
     temp_dir = tempfile.mkdtemp()
-    temp_file_path = os.path.join(temp_dir, file.filename)
+    temp_file_path = os.path.join(temp_dir, filetypes.storage_filename(os.path.basename(file.filename or "") or "upload", sniffed_format))
+    key_claim = ExitStack()
 
     try:
         logger.info(f"Received request to add book: {file.filename}. Library path: '{library_path}'")
 
+        if idempotency_key:
+            key_claim.enter_context(idempotency.claim(idempotency_key, library_path))
+            replayed_id = idempotency.find_book_id(idempotency_key, library_path)
+            if replayed_id is not None:
+                logger.info(f"Idempotency-Key '{idempotency_key}' already used for book ID {replayed_id}; not adding again.")
+                return AddBookResponse(
+                    message="Book was already added by an earlier request with this Idempotency-Key.",
+                    added_book_ids=[replayed_id],
+                    details="Replayed result; the uploaded file was not imported again.",
+                    books=added_books([replayed_id], library_path)
+                )
+
         # Save the uploaded file to the temporary path
         with open(temp_file_path, "wb") as buffer:
             shutil.copyfileobj(file.file, buffer)
         logger.info(f"Uploaded file '{file.filename}' saved to temporary path: {temp_file_path}")
 
-        # Call the CRUD function to add the book
-        added_ids = add_book(
-            file_path=temp_file_path,
-            library_path=library_path,
-            one_book_per_directory=one_book_per_directory,
-            duplicates=duplicates,
-            automerge=automerge,
-            authors=authors,
-            title=title,
-            tags=tags
-        )
+        # The same file under another name is a duplicate calibredb's title/author check can miss.
+        content_hash = duplicate_detection.file_hash(temp_file_path)
+        same_file = [b["id"] for b in duplicate_detection.find_by_hash(content_hash, library_path)]
+        if same_file and not duplicates:
+            logger.info(f"Book '{file.filename}' not added: same content as book ID(s) {same_file}.")
+            return same_file_response(same_file)
+
+        if merge_formats and not duplicates:
+            book_id = duplicate_detection.attach_as_format(temp_file_path, library_path, title=title, authors=authors)
+            if book_id is not None:
+                return format_added_response(book_id, library_path, request_user_id(request))
+
+        identifiers = {duplicate_detection.HASH_IDENTIFIER: content_hash}
+        if idempotency_key:
+            identifiers[idempotency.IDENTIFIER_TYPE] = idempotency_key
+        with processing_log.step("add", library_path=library_path) as log:
+            log["detail"] = f"Uploaded as '{file.filename}'."
+            # Call the CRUD function to add the book
+            added_ids = add_book(
+                file_path=temp_file_path,
+                library_path=library_path,
+                one_book_per_directory=one_book_per_directory,
+                duplicates=duplicates,
+                automerge=automerge,
+                authors=authors,
+                title=title,
+                tags=tags,
+                identifiers=identifiers
+            )
+            log["book_ids"] = added_ids
+            if added_ids:
+                metadata_utils.add_missing_covers(added_ids, temp_file_path, library_path=library_path)
 
         if added_ids:
             logger.info(f"Book(s) added successfully with ID(s): {added_ids}")
+            provenance.record(added_ids, provenance.UPLOAD, detail=file.filename, client=client_address(request),
+                              library_path=library_path, user_id=request_user_id(request))
+            fulltext.update_after_change(added_ids, library_path=library_path)
+            conversion_policy.enqueue(added_ids, library_path=library_path, user_id=request_user_id(request))
+            follows.announce(added_ids, library_path=library_path, added_by=request_user_id(request))
             return AddBookResponse(
                 message="Book(s) added successfully.",
-                added_book_ids=added_ids
+                added_book_ids=added_ids,
+                books=added_books(added_ids, library_path),
+                duplicate_of=same_file
             )
         else:
             logger.info(f"Book '{file.filename}' was not added (e.g., duplicate ignored, or other reason).")
@@ -149,6 +463,8 @@ async def add_book_endpoint(
                 details="This can happen if the book is a duplicate and duplicate adding is off, or if the file is invalid."
             )
 
+    except idempotency.IdempotencyKeyInUse as e:
+        raise HTTPException(status_code=409, detail=str(e))
     except FileNotFoundError as e: # For calibredb executable not found
         logger.error(f"calibredb not found: {e}", exc_info=True)
         raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
@@ -160,24 +476,47 @@ async def add_book_endpoint(
         detail = f"Error using calibredb add: {e.args[0]}"
         if e.stderr and "No such file or directory" in e.stderr and library_path:
              detail = f"Error with Calibre library path '{library_path}'. Please ensure it is correct. Calibredb: {e.args[0]}"
+        notify_upload_failed(request, file.filename, detail)
         raise HTTPException(status_code=500, detail=detail)
     except Exception as e:
         logger.error(f"An unexpected error occurred in /books/add/ endpoint: {e}", exc_info=True)
+        notify_upload_failed(request, file.filename, str(e))
         raise HTTPException(status_code=500, detail=f"An unexpected server error occurred: {str(e)}")
     finally:
+        key_claim.close()
         # Clean up: remove the temporary directory and its contents
         if os.path.exists(temp_dir):
             shutil.rmtree(temp_dir)
             logger.info(f"Temporary directory '{temp_dir}' cleaned up.")
 
+def forget_removed_book(book_id: int, library_path: Optional[str] = None) -> None:
+    """Drops what the server keeps about a book that was removed from the library."""
+    fulltext.update_after_change([book_id], library_path=library_path)
+    # Cache entries are keyed by book ID, and Calibre may hand the ID out again.
+    conversion_cache.remove_book_entries(book_id)
+    thumbnails.remove_book_entries(book_id)
+    book_collections.forget_books([book_id], library_path=library_path)
+    provenance.forget_books([book_id], library_path=library_path)
+    processing_log.forget_books([book_id], library_path=library_path)
+    reading.forget_books([book_id], library_path=library_path)
+    kosync.forget_books([book_id], library_path=library_path)
+    ratings.forget_books([book_id], library_path=library_path)
+    reactions.forget_books([book_id], library_path=library_path)
+    wishlist.forget_books([book_id], library_path=library_path)
+    notifications.forget_books([book_id], library_path=library_path)
+    book_clubs.forget_books([book_id], library_path=library_path)
+    book_comments.forget_books([book_id], library_path=library_path)
+
 @app.delete("/books/{book_id}/", response_model=RemoveBookResponse)
-async def remove_book_endpoint(
+def remove_book_endpoint(
     book_id: int,
+    delete_file: bool = Query(True, description="Delete the book's files. If false, Calibre moves them to the library's trash, from where they can be restored."),
     library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
 ):
     """
     Remove a book from the Calibre library by its ID.
-    Uses `calibredb remove_books --permanent --for-machine <id>`.
+    Uses `calibredb remove_books [--permanent] --for-machine <id>`. Cached conversions and
+    cover thumbnails of the book are removed as well.
     """
     try:
         logger.info(f"Received request to remove book ID: {book_id}. Library path: '{library_path}'")
@@ -186,10 +525,11 @@ async def remove_book_endpoint(
             raise HTTPException(status_code=400, detail="Book ID must be a positive integer.")
 
         # Call the CRUD function to remove the book
-        remove_result = remove_book(book_id=book_id, library_path=library_path)
+        remove_result = remove_book(book_id=book_id, library_path=library_path, permanent=delete_file)
 
         if remove_result.get("ok") and remove_result.get("num_removed", 0) > 0 and book_id in remove_result.get("removed_ids", []):
             logger.info(f"Book ID: {book_id} removed successfully.")
+            forget_removed_book(book_id, library_path)
             return RemoveBookResponse(
                 message=f"Book ID {book_id} removed successfully.",
                 removed_book_id=book_id
@@ -234,7 +574,7 @@ async def remove_book_endpoint(
 # or python -m uvicorn calibre_api.app.main:app --reload --port 6336
 
 @app.put("/books/{book_id}/metadata/", response_model=SetMetadataResponse)
-async def set_book_metadata_endpoint(
+def set_book_metadata_endpoint(
     book_id: int,
     metadata_update: SetMetadataRequest,
     library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
@@ -306,6 +646,7 @@ async def set_book_metadata_endpoint(
             raise HTTPException(status_code=404, detail=f"Book with ID {book_id} not found, or no metadata was actually changed by calibredb.")
 
         logger.info(f"Metadata for book ID: {book_id} updated successfully. Changes: {update_result}")
+        fulltext.update_after_change([book_id], library_path=library_path)
         return SetMetadataResponse(
             message=f"Metadata for book ID {book_id} updated successfully.",
             book_id=book_id,
@@ -341,22 +682,6 @@ async def set_book_metadata_endpoint(
 # http://localhost:6336/redoc for ReDoc UI
 
 # --- New CLI Endpoints ---
-from fastapi.responses import FileResponse
-from . import calibre_cli # Assuming calibre_cli.py is in the same directory
-from .models import (
-    CalibreVersionResponse, EbookConvertRequest, EbookConvertResponse,
-    EbookMetadataGetRequest, EbookMetadataSetRequest, EbookMetadataResponse,
-    EbookPolishRequest, EbookPolishResponse,
-    FetchMetadataQueryRequest, FetchMetadataResponse,
-    WebToDiskRequest, WebToDiskResponse,
-    LrfConversionResponse, # LrfConversionRequest is empty, handled by file upload + path params
-    PluginListResponse, DebugTestBuildResponse,
-    SmtpSendRequest, SmtpSendResponse,
-    EbookCheckResponse # EbookCheckRequest handled by query param + file upload
-)
-import uuid # For generating unique filenames
-from fastapi.responses import StreamingResponse
-from io import BytesIO
 
 # Helper to create a unique temporary file path
 def temp_file_path(prefix: str = "shelfstone_server_", suffix: str = "") -> str:
@@ -364,7 +689,7 @@ def temp_file_path(prefix: str = "shelfstone_server_", suffix: str = "") -> str:
 
 
 @app.get("/calibre/version/", response_model=CalibreVersionResponse, tags=["Calibre CLI"])
-async def get_calibre_version_endpoint():
+def get_calibre_version_endpoint():
     """
     Get the installed Calibre version.
     Corresponds to `calibre --version`.
@@ -403,7 +728,7 @@ async def get_calibre_version_endpoint():
 
 
 @app.post("/ebook/convert/", response_model=EbookConvertResponse, tags=["Calibre CLI"])
-async def ebook_convert_endpoint(
+def ebook_convert_endpoint(
     request: EbookConvertRequest = Form(...), # Using Form for model with File
     input_file: UploadFile = File(...)
 ):
@@ -536,6 +861,9 @@ async def ebook_convert_endpoint(
     except FileNotFoundError as e: # For ebook-convert or input file (after upload attempt)
         logger.error(f"File not found error during conversion: {e}", exc_info=True)
         raise HTTPException(status_code=404, detail=str(e))
+    except calibre_cli.ConversionUnavailable as e:
+        logger.warning(str(e.args[0]))
+        raise HTTPException(status_code=422, detail=e.args[0])
     except calibre_cli.CalibreCLIError as e:
         logger.error(f"CalibreCLIError during conversion: {e}", exc_info=True)
         raise HTTPException(status_code=500, detail=f"Ebook conversion failed: {e.message} - Stderr: {e.stderr}")
@@ -563,7 +891,7 @@ async def ebook_convert_endpoint(
 
 
 @app.post("/ebook/metadata/get/", response_model=EbookMetadataResponse, tags=["Calibre CLI"])
-async def get_ebook_metadata_endpoint(
+def get_ebook_metadata_endpoint(
     input_file: UploadFile = File(...),
     as_json: bool = Query(True, description="Return metadata as JSON. If false, returns raw OPF string.")
     # output_opf_file query param for server-side save is omitted for API simplicity.
@@ -616,7 +944,7 @@ async def get_ebook_metadata_endpoint(
 
 
 @app.post("/ebook/metadata/set/", response_model=EbookMetadataResponse, tags=["Calibre CLI"])
-async def set_ebook_metadata_endpoint(
+def set_ebook_metadata_endpoint(
     request: EbookMetadataSetRequest = Form(...), # JSON body for metadata options
     input_file: UploadFile = File(...) # The ebook file to modify
 ):
@@ -705,7 +1033,7 @@ async def set_ebook_metadata_endpoint(
 
 
 @app.post("/ebook/polish/", tags=["Calibre CLI"])
-async def ebook_polish_endpoint(
+def ebook_polish_endpoint(
     input_file: UploadFile = File(...),
     output_filename_suffix: Optional[str] = Form("_polished"),
     options: Optional[List[str]] = Form(None) # Example: '["--subset-fonts", "--smarten-punctuation"]'
@@ -802,7 +1130,7 @@ async def ebook_polish_endpoint(
 
 
 @app.get("/ebook/metadata/fetch/", response_model=FetchMetadataResponse, tags=["Calibre CLI"])
-async def fetch_ebook_metadata_endpoint(
+def fetch_ebook_metadata_endpoint(
     title: Optional[str] = Query(None),
     authors: Optional[str] = Query(None, description="Comma-separated string of author names."),
     isbn: Optional[str] = Query(None),
@@ -864,7 +1192,7 @@ async def fetch_ebook_metadata_endpoint(
 
 
 @app.post("/web2disk/generate-recipe/", tags=["Calibre CLI"])
-async def web2disk_generate_recipe_endpoint(
+def web2disk_generate_recipe_endpoint(
     request: WebToDiskRequest # JSON body with url and options
 ):
     """
@@ -927,7 +1255,7 @@ async def web2disk_generate_recipe_endpoint(
 # These are very similar to ebook-convert but for specific formats.
 
 @app.post("/ebook/convert/lrf-to-lrs/", tags=["Calibre CLI"])
-async def lrf_to_lrs_endpoint(input_file: UploadFile = File(...)):
+def lrf_to_lrs_endpoint(input_file: UploadFile = File(...)):
     """Converts an LRF file to LRS format."""
     base_filename, _ = os.path.splitext(input_file.filename)
     output_filename = f"{base_filename}.lrs"
@@ -958,9 +1286,26 @@ async def lrf_to_lrs_endpoint(input_file: UploadFile = File(...)):
         # BackgroundTask needed for temp_output_path cleanup after FileResponse
 
 
+def log_file_download(request: Request, book_id: int, fmt: str, library_path: Optional[str]) -> None:
+    """Logs a download of an exported file; best effort, since the file is already on its way."""
+    try:
+        # The export doesn't return the book's record; the title makes the history readable.
+        found = list_books_by_ids([book_id], library_path=library_path)
+        book = found[0] if found else {"id": book_id}
+    except (FileNotFoundError, CalibredbError) as e:
+        logger.warning(f"Could not look up the title of book ID {book_id} for the download log: {e}")
+        book = {"id": book_id}
+    try:
+        download_log.record(book, fmt, user=auth.current_user(request), user_agent=request.headers.get("user-agent"),
+                            library_path=library_path)
+    except sqlite3.Error as e:
+        logger.warning(f"Could not log the download of book ID {book_id}: {e}")
+
+
 # Endpoint to serve a book file directly
 @app.get("/books/{book_id}/file/{format_extension}", tags=["Books"])
-async def get_book_file_endpoint(
+def get_book_file_endpoint(
+    request: Request,
     book_id: int,
     format_extension: str,
     library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
@@ -984,21 +1329,18 @@ async def get_book_file_endpoint(
             library_path=library_path
         )
 
-        # Determine media type based on format extension
-        media_type = "application/octet-stream" # Default
-        if format_extension.lower() == "epub":
-            media_type = "application/epub+zip"
-        elif format_extension.lower() == "mobi":
-            media_type = "application/x-mobipocket-ebook"
-        elif format_extension.lower() == "pdf":
-            media_type = "application/pdf"
-        elif format_extension.lower() == "txt":
-            media_type = "text/plain"
-        # Add more common types as needed
+        filename = f"book_{book_id}.{format_extension.lower()}"
+        log_file_download(request, book_id, format_extension, library_path)
+        if accounts.enabled():
+            # The OPDS catalog links here; KOReader's sync of the file can then be linked to the book.
+            try:
+                kosync.record_download(file_bytes, filename, book_id, format_extension, library_path=library_path)
+            except sqlite3.Error as e:
+                logger.warning(f"Could not record the KOReader hashes of book ID {book_id}: {e}")
 
         # Use StreamingResponse to send the bytes
-        return StreamingResponse(BytesIO(file_bytes), media_type=media_type, headers={
-            "Content-Disposition": f"attachment; filename=\"book_{book_id}.{format_extension.lower()}\""
+        return StreamingResponse(BytesIO(file_bytes), media_type=format_registry.mime_type(format_extension), headers={
+            "Content-Disposition": f"attachment; filename=\"{filename}\""
         })
 
     except ValueError as e: # From crud validation
@@ -1029,7 +1371,7 @@ async def get_book_file_endpoint(
 
 
 @app.get("/calibre/plugins/", response_model=PluginListResponse, tags=["Calibre CLI"])
-async def list_plugins_endpoint():
+def list_plugins_endpoint():
     """
     List installed Calibre plugins.
     Corresponds to `calibre-customize --list-plugins`.
@@ -1053,7 +1395,7 @@ async def list_plugins_endpoint():
 
 
 @app.post("/calibre/debug/test-build/", response_model=DebugTestBuildResponse, tags=["Calibre CLI"])
-async def debug_test_build_endpoint(timeout: Optional[int] = Query(180, description="Timeout in seconds for the test build command.")):
+def debug_test_build_endpoint(timeout: Optional[int] = Query(180, description="Timeout in seconds for the test build command.")):
     """
     Run Calibre's build and basic startup test.
     Corresponds to `calibre-debug --test-build`. This can take a few minutes.
@@ -1082,7 +1424,7 @@ async def debug_test_build_endpoint(timeout: Optional[int] = Query(180, descript
 
 
 @app.post("/calibre/send-email/", response_model=SmtpSendResponse, tags=["Calibre CLI"])
-async def send_email_endpoint(
+def send_email_endpoint(
     request: SmtpSendRequest = Body(...), # SMTP details in JSON body
     attachment_file: Optional[UploadFile] = File(None) # Optional file attachment
 ):
@@ -1135,7 +1477,7 @@ async def send_email_endpoint(
 
 
 @app.post("/ebook/check/", response_model=EbookCheckResponse, tags=["Calibre CLI"])
-async def check_ebook_endpoint(
+def check_ebook_endpoint(
     input_file: UploadFile = File(...),
     output_format: str = Query("json", description="Report format: 'json' or 'text'.", pattern="^(json|text)$")
 ):
@@ -1179,7 +1521,7 @@ async def check_ebook_endpoint(
             os.remove(temp_input_path)
 
 @app.post("/ebook/convert/lrs-to-lrf/", tags=["Calibre CLI"])
-async def lrs_to_lrf_endpoint(input_file: UploadFile = File(...)):
+def lrs_to_lrf_endpoint(input_file: UploadFile = File(...)):
     """Converts an LRS file to LRF format."""
     base_filename, _ = os.path.splitext(input_file.filename)
     output_filename = f"{base_filename}.lrf"
@@ -1208,3 +1550,4347 @@ async def lrs_to_lrf_endpoint(input_file: UploadFile = File(...)):
     finally:
         if os.path.exists(temp_input_path): os.remove(temp_input_path)
         # BackgroundTask needed for temp_output_path cleanup after FileResponse
+
+
+# --- Maintenance Endpoints ---
+
+@app.post("/maintenance/reextract/", response_model=ReextractResponse, tags=["Maintenance"])
+def reextract_metadata_endpoint(
+    request: ReextractRequest,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Re-run metadata extraction (`ebook-meta`) on books already in the library and fill in
+    fields that are currently empty. Fields that already hold data are never overwritten.
+    Useful after installing a newer Calibre whose metadata readers understand more of the files.
+
+    Books can be filtered by ID, by format and by the date they were added to the library.
+    """
+    search_parts = []
+    if request.ids:
+        search_parts.append("(" + " or ".join(f"id:{book_id}" for book_id in request.ids) + ")")
+    if request.format:
+        search_parts.append(f"formats:\"={escape_search_value(request.format.upper())}\"")
+    if request.imported_before:
+        search_parts.append(f"date:<{request.imported_before.isoformat()}")
+    search_query = " and ".join(search_parts) if search_parts else None
+
+    try:
+        logger.info(f"Re-extracting metadata. Search: '{search_query}', Dry run: {request.dry_run}, Library: '{library_path}'")
+        books_data = list_books(library_path=library_path, search_query=search_query)
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError listing books for re-extraction: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+
+    results: List[ReextractBookResult] = []
+    for book_dict in books_data:
+        book_id = book_dict.get('id')
+        result = ReextractBookResult(book_id=book_id, title=book_dict.get('title'))
+        results.append(result)
+
+        available = book_format_names(book_dict)
+        if request.format:
+            fmt = request.format.upper() if request.format.upper() in available else None
+        else:
+            fmt = available[0] if available else None
+        if not fmt:
+            result.error = "Book has no suitable format to read metadata from."
+            continue
+        result.format = fmt
+
+        temp_book_path = temp_file_path(prefix="reextract_", suffix=f".{fmt.lower()}")
+        try:
+            with open(temp_book_path, "wb") as f:
+                f.write(crud.export_book_file(book_id=book_id, format_extension=fmt, library_path=library_path))
+
+            with processing_log.step("reextract metadata", [book_id], library_path) as log:
+                extracted = metadata_utils.read_file_metadata(temp_book_path)
+                updates = metadata_utils.fields_to_fill(book_dict, extracted)
+                result.updated_fields = list(updates.keys())
+                log["detail"] = (f"{'Would fill' if request.dry_run else 'Filled'} in from {fmt}: {', '.join(updates)}."
+                                 if updates else f"Nothing to fill in from {fmt}.")
+
+                if updates and not request.dry_run:
+                    set_book_metadata(book_id=book_id, metadata=SetMetadataRequest(**updates), library_path=library_path)
+        except FileNotFoundError as e:
+            result.error = str(e)
+        except (calibre_cli.CalibreCLIError, ValueError) as e:
+            logger.warning(f"Re-extraction failed for book ID {book_id}: {e}")
+            result.error = e.args[0] if e.args else str(e)
+        finally:
+            if os.path.exists(temp_book_path):
+                os.remove(temp_book_path)
+
+    updated = sum(1 for r in results if r.updated_fields and not r.error)
+    failed = sum(1 for r in results if r.error)
+    return ReextractResponse(
+        message=f"Re-extraction {'dry run ' if request.dry_run else ''}completed for {len(results)} book(s).",
+        dry_run=request.dry_run,
+        processed=len(results),
+        updated=updated,
+        failed=failed,
+        results=results
+    )
+
+
+
+@app.post("/maintenance/diff/", response_model=LibraryDiffResponse, tags=["Maintenance"])
+def library_diff_endpoint(
+    snapshot: UploadFile = File(..., description="A metadata.db snapshot (backup) of the library."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Compare the current library with an earlier snapshot of its `metadata.db` and report added,
+    removed and changed books, with per-field before/after values for changed ones.
+    Useful after risky bulk operations or migrations. Books are matched by UUID.
+    """
+    snapshot_path = temp_file_path(prefix="snapshot_", suffix=".db")
+    try:
+        with open(snapshot_path, "wb") as buffer:
+            shutil.copyfileobj(snapshot.file, buffer)
+        logger.info(f"Diffing library '{library_path}' against uploaded snapshot '{snapshot.filename}'.")
+        return LibraryDiffResponse(**library_diff.diff_library(snapshot_path, library_path=library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError during library diff: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error reading library or snapshot with calibredb: {e.args[0]}")
+    finally:
+        if os.path.exists(snapshot_path):
+            os.remove(snapshot_path)
+
+@app.post("/maintenance/cleanup", response_model=CleanupResponse, tags=["Maintenance"])
+def cleanup_endpoint(
+    dry_run: bool = Query(False, description="Only report what would be removed."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Remove expired leftovers: temporary files of interrupted requests, abandoned resumable uploads
+    and (if SHELFSTONE_NEWS_RETENTION_DAYS is set) old news issues. Retention periods are configured
+    with environment variables. The same cleanup can be scheduled with `python -m app.janitor`.
+    """
+    logger.info(f"Received cleanup request. Dry run: {dry_run}. Library: {library_path or 'default'}")
+    try:
+        return CleanupResponse(**janitor.run_cleanup(library_path=library_path, dry_run=dry_run))
+    except Exception as e:
+        logger.error(f"Unexpected error during cleanup: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+@app.post("/maintenance/optimize-db", response_model=OptimizeDbResponse, tags=["Maintenance"])
+def optimize_db_endpoint(
+    vacuum: bool = Query(False, description="Also run a full VACUUM. Only allowed while maintenance mode is on."),
+    analyze: bool = Query(True, description="Run ANALYZE to refresh the query planner statistics."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+):
+    """
+    Run ANALYZE and an incremental vacuum on the library's metadata.db, and report the database size
+    before and after. Heavy import/delete cycles leave free pages behind and outdated statistics that
+    degrade query plans. A full VACUUM rewrites the whole database and blocks all access to it, so it
+    requires maintenance mode (`POST /admin/maintenance-mode`). Schedule with `python -m app.db_maintenance`.
+    """
+    logger.info(f"Received database optimization request. Vacuum: {vacuum}. Library: {library_path or 'default'}")
+    if vacuum and not maintenance_mode.status()["enabled"]:
+        raise HTTPException(status_code=409, detail="A full VACUUM blocks the library database. Turn on maintenance mode first (POST /admin/maintenance-mode).")
+    try:
+        return OptimizeDbResponse(**db_maintenance.optimize_library_db(library_path, analyze=analyze, vacuum=vacuum))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except sqlite3.OperationalError as e:
+        raise HTTPException(status_code=503, detail=f"The library database is busy or unavailable: {e}", headers={"Retry-After": "60"})
+    except Exception as e:
+        logger.error(f"Unexpected error optimizing the library database: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+# --- Book Package Import ---
+
+@app.post("/books/add-package/", response_model=AddBookPackageResponse, tags=["Books"])
+def add_book_package_endpoint(
+    request: Request,
+    files: List[UploadFile] = File(..., description="All files of the package: one e-book plus optional metadata.opf, cover image and other sidecar files."),
+    library_path: Optional[str] = Form(None),
+    duplicates: bool = Form(False),
+    idempotency_key: Optional[str] = Header(None, alias="Idempotency-Key", description="Client-chosen key that makes retries of this upload safe.")
+):
+    """
+    Import a "book package" (an e-book plus its sidecar files) as a single book.
+
+    - Metadata from a sidecar `.opf` file takes precedence over metadata extracted from the e-book.
+    - A cover image (`cover.jpg`, `folder.png`, or the only image in the package) becomes the book cover.
+    - Any other files (e.g., `.nfo`) are attached to the book as extra data files.
+
+    The import is all-or-nothing: if applying the OPF, cover or attachments fails, the newly added book is removed again.
+    Supports the `Idempotency-Key` header like `POST /books/add/`.
+    """
+    if idempotency_key:
+        try:
+            idempotency.validate_key(idempotency_key)
+        except ValueError as e:
+            raise HTTPException(status_code=400, detail=str(e))
+
+    temp_dir = tempfile.mkdtemp(prefix="shelfstone_server_package_")
+    key_claim = ExitStack()
+    try:
+        if idempotency_key:
+            key_claim.enter_context(idempotency.claim(idempotency_key, library_path))
+            replayed_id = idempotency.find_book_id(idempotency_key, library_path)
+            if replayed_id is not None:
+                return AddBookPackageResponse(
+                    message="Book package was already imported by an earlier request with this Idempotency-Key.",
+                    book_id=replayed_id,
+                    metadata_source="replayed"
+                )
+
+        filenames = []
+        for upload in files:
+            filename = os.path.basename(upload.filename or "")
+            if not filename or filename in filenames:
+                raise HTTPException(status_code=400, detail=f"Package files must have unique, non-empty names (got '{upload.filename}').")
+            with open(os.path.join(temp_dir, filename), "wb") as buffer:
+                shutil.copyfileobj(upload.file, buffer)
+            filenames.append(filename)
+
+        logger.info(f"Importing book package with files {filenames}. Library path: '{library_path}'")
+        with processing_log.step("add package", library_path=library_path) as log:
+            log["detail"] = f"Package files: {', '.join(filenames)}."
+            result = packages.import_book_package(
+                temp_dir, filenames, library_path=library_path, duplicates=duplicates,
+                identifiers={idempotency.IDENTIFIER_TYPE: idempotency_key} if idempotency_key else None
+            )
+            log["book_ids"] = [result["book_id"]] if result["book_id"] is not None else []
+
+        if result["book_id"] is None:
+            return AddBookPackageResponse(
+                message="Book package was processed but no new entry was added to the library (e.g., duplicate ignored).",
+                **result
+            )
+        provenance.record([result["book_id"]], provenance.PACKAGE, detail=", ".join(filenames),
+                          client=client_address(request), library_path=library_path, user_id=request_user_id(request))
+        fulltext.update_after_change([result["book_id"]], library_path=library_path)
+        conversion_policy.enqueue([result["book_id"]], library_path=library_path, user_id=request_user_id(request))
+        follows.announce([result["book_id"]], library_path=library_path, added_by=request_user_id(request))
+        return AddBookPackageResponse(message="Book package imported successfully.", **result)
+    except HTTPException:
+        raise
+    except filetypes.UnsupportedFileType as e:
+        raise HTTPException(status_code=415, detail=str(e))
+    except packages.BookPackageError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except idempotency.IdempotencyKeyInUse as e:
+        raise HTTPException(status_code=409, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError during package import: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        notify_upload_failed(request, files[0].filename if files else None, e.args[0])
+        raise HTTPException(status_code=500, detail=f"Error importing book package: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"An unexpected error occurred in /books/add-package/ endpoint: {e}", exc_info=True)
+        notify_upload_failed(request, files[0].filename if files else None, str(e))
+        raise HTTPException(status_code=500, detail=f"An unexpected server error occurred: {str(e)}")
+    finally:
+        key_claim.close()
+        shutil.rmtree(temp_dir, ignore_errors=True)
+
+
+# --- Book Attachments ---
+
+def get_book_or_404(book_id: int, library_path: Optional[str] = None) -> dict:
+    """
+    Looks up a single book with `calibredb list --search id:<id>`.
+    Raises HTTPException 404 if the book does not exist; calibredb errors propagate to the caller.
+    """
+    if book_id <= 0:
+        raise HTTPException(status_code=400, detail="Book ID must be a positive integer.")
+    books_data = list_books(library_path=library_path, search_query=f"id:{book_id}")
+    for book_dict in books_data:
+        if book_dict.get('id') == book_id:
+            return book_dict
+    raise HTTPException(status_code=404, detail=f"Book with ID {book_id} not found.")
+
+
+def book_directory_or_409(book_dict: dict) -> str:
+    book_dir = attachments.book_directory(book_dict)
+    if not book_dir:
+        raise HTTPException(status_code=409, detail=f"The folder of book ID {book_dict.get('id')} could not be determined (the book has no files).")
+    return book_dir
+
+
+@app.get("/books/{book_id}/attachments/", response_model=AttachmentListResponse, tags=["Books"])
+def list_attachments_endpoint(
+    book_id: int,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    List the supplementary files (maps, errata, interviews, ...) attached to a book.
+    Attachments are stored as Calibre extra data files and are not treated as readable formats.
+    """
+    try:
+        book_dict = get_book_or_404(book_id, library_path)
+        book_dir = attachments.book_directory(book_dict)
+        items = attachments.list_attachments(book_dir) if book_dir else []
+        return AttachmentListResponse(book_id=book_id, attachments=[AttachmentInfo(**a) for a in items])
+    except HTTPException:
+        raise
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError listing attachments for book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"An unexpected error occurred listing attachments for book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected server error occurred: {str(e)}")
+
+
+@app.post("/books/{book_id}/attachments/", response_model=AttachmentListResponse, tags=["Books"])
+def upload_attachment_endpoint(
+    book_id: int,
+    file: UploadFile = File(..., description="The file to attach to the book."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Attach a supplementary file to a book (`calibredb add_format --as-extra-data-file`, Calibre 7+).
+    An existing attachment with the same name is replaced. Returns the book's attachments after the upload.
+    """
+    filename = os.path.basename(file.filename or "")
+    if not filename:
+        raise HTTPException(status_code=400, detail="Uploaded file must have a name.")
+
+    temp_dir = tempfile.mkdtemp(prefix="shelfstone_server_attachment_")
+    try:
+        book_dict = get_book_or_404(book_id, library_path)
+        temp_path = os.path.join(temp_dir, filename)
+        with open(temp_path, "wb") as buffer:
+            shutil.copyfileobj(file.file, buffer)
+
+        logger.info(f"Attaching '{filename}' to book ID {book_id}. Library: '{library_path}'")
+        crud.add_extra_data_file(book_id, temp_path, library_path=library_path)
+
+        book_dir = attachments.book_directory(book_dict)
+        items = attachments.list_attachments(book_dir) if book_dir else []
+        return AttachmentListResponse(book_id=book_id, attachments=[AttachmentInfo(**a) for a in items])
+    except HTTPException:
+        raise
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except CalibredbError as e:
+        logger.error(f"CalibredbError attaching file to book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error attaching file: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"An unexpected error occurred attaching a file to book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected server error occurred: {str(e)}")
+    finally:
+        shutil.rmtree(temp_dir, ignore_errors=True)
+
+
+def find_book_directory(book_id: int, library_path: Optional[str]) -> str:
+    """
+    Returns the folder of a book for attachment access, mapping lookup failures to HTTP errors.
+    """
+    try:
+        book_dict = get_book_or_404(book_id, library_path)
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError looking up book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    return book_directory_or_409(book_dict)
+
+
+@app.get("/books/{book_id}/attachments/{name:path}", tags=["Books"])
+def download_attachment_endpoint(
+    book_id: int,
+    name: str,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Download a file attached to a book.
+    """
+    book_dir = find_book_directory(book_id, library_path)
+    try:
+        path = attachments.attachment_path(book_dir, name)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+    return FileResponse(path, filename=os.path.basename(path))
+
+
+@app.delete("/books/{book_id}/attachments/{name:path}", response_model=AttachmentListResponse, tags=["Books"])
+def delete_attachment_endpoint(
+    book_id: int,
+    name: str,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Remove a file attached to a book. Returns the book's remaining attachments.
+    """
+    book_dir = find_book_directory(book_id, library_path)
+    try:
+        path = attachments.attachment_path(book_dir, name)
+        os.remove(path)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+    logger.info(f"Removed attachment '{name}' from book ID {book_id}.")
+    items = attachments.list_attachments(book_dir)
+    return AttachmentListResponse(book_id=book_id, attachments=[AttachmentInfo(**a) for a in items])
+
+
+# --- OPF Export ---
+
+@app.get("/books/{book_id}/metadata.opf", tags=["Books"])
+def get_book_opf_endpoint(
+    book_id: int,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Returns the book's metadata as a Calibre-compatible OPF file (`calibredb show_metadata --as-opf`),
+    e.g. for writing sidecar files or moving a book to another tool.
+    """
+    try:
+        logger.info(f"Request for OPF of book ID {book_id}. Library: '{library_path}'")
+        opf = crud.get_book_opf(book_id=book_id, library_path=library_path)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        if "no book with id" in f"{e.args[0]} {e.stderr or ''}".lower():
+            raise HTTPException(status_code=404, detail=f"Book with ID {book_id} not found.")
+        logger.error(f"CalibredbError getting OPF for book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+
+    return Response(content=opf, media_type="application/oebps-package+xml", headers={
+        "Content-Disposition": f"attachment; filename=\"book_{book_id}.opf\""
+    })
+
+
+# --- Book Cards ---
+
+@app.get("/books/{book_id}/card", response_class=HTMLResponse, tags=["Books"])
+def get_book_card_endpoint(
+    book_id: int,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Returns a self-contained HTML card for the book (cover, title, authors, series, short blurb),
+    suitable for digest e-mails, webhook payloads and link previews. The cover is embedded as a
+    data URI and the page head carries OpenGraph/Twitter card tags.
+    """
+    try:
+        logger.info(f"Request for card of book ID {book_id}. Library: '{library_path}'")
+        book_dict = get_book_or_404(book_id, library_path=library_path)
+        return HTMLResponse(cards.render_card_for_book(book_dict))
+    except HTTPException:
+        raise
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError rendering card for book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error rendering card for book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+# --- Shelf Label QR Codes ---
+
+@app.get("/books/qr-sheet", response_class=HTMLResponse, tags=["Books"])
+def book_qr_sheet_endpoint(
+    request: Request,
+    search: Optional[str] = Query(None, description="calibredb search selecting the books, e.g. a shelf's tag ('tags:=ShelfA3'). All books if omitted."),
+    title: str = Query("Shelf labels", description="Heading of the sheet (not printed)."),
+    columns: int = Query(qrcodes.DEFAULT_COLUMNS, ge=1, le=8, description="Labels per row."),
+    max_books: int = Query(200, ge=1, le=2000, description="Refuse sheets with more books than this."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    A printable HTML sheet of shelf labels, one per matching book: a QR code linking to the book's
+    card plus title, authors and book ID. Print it from the browser onto paper or label sheets.
+    """
+    logger.info(f"Received QR label sheet request. Search: '{search}', Library: {library_path or 'default'}")
+    try:
+        books_data = list_books(library_path=library_path, search_query=search)
+        if not books_data:
+            raise HTTPException(status_code=404, detail="No books match the search.")
+        if len(books_data) > max_books:
+            raise HTTPException(status_code=400, detail=f"The search matches {len(books_data)} books, more than max_books ({max_books}).")
+        base_url = qrcodes.public_base_url(str(request.base_url))
+        links = {book["id"]: qrcodes.book_link(book["id"], base_url, library_path) for book in books_data}
+        return HTMLResponse(qrcodes.render_label_sheet_html(books_data, links, title=title, columns=columns))
+    except HTTPException:
+        raise
+    except qrcodes.QrCodeUnavailable as e:
+        raise HTTPException(status_code=503, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError listing books for QR sheet: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error rendering QR sheet: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+@app.get("/books/{book_id}/qr", tags=["Books"])
+def book_qr_endpoint(
+    book_id: int,
+    request: Request,
+    box_size: int = Query(qrcodes.DEFAULT_BOX_SIZE, ge=1, le=40, description="Pixels per QR module; controls the image size."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    A QR code (PNG) linking to the book's card (`/books/{book_id}/card`), for labelling physical copies.
+    Links use SHELFSTONE_PUBLIC_URL if set, otherwise the URL the request was made to.
+    """
+    try:
+        logger.info(f"Request for QR code of book ID {book_id}. Library: '{library_path}'")
+        get_book_or_404(book_id, library_path=library_path)
+        link = qrcodes.book_link(book_id, qrcodes.public_base_url(str(request.base_url)), library_path)
+        return Response(content=qrcodes.qr_png(link, box_size=box_size), media_type="image/png")
+    except HTTPException:
+        raise
+    except qrcodes.QrCodeUnavailable as e:
+        raise HTTPException(status_code=503, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError creating QR code for book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error creating QR code for book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+# --- ISBN Lookup ---
+
+@app.get("/books/check-owned/", response_model=CheckOwnedResponse, tags=["Books"])
+def check_owned_endpoint(
+    isbn: str = Query(..., description="ISBN-10 or ISBN-13, e.g. as decoded from a barcode. Hyphens are allowed."),
+    lookup: bool = Query(False, description="If the book is not owned, fetch its metadata from online sources."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Check whether the library already has a book with this ISBN, e.g. from a barcode-scanner client in a bookstore.
+    Matches the ISBN-10 and ISBN-13 forms. With `lookup=true`, unowned books are resolved with `fetch-ebook-metadata`
+    so the client can show what it scanned.
+    """
+    logger.info(f"Checking ownership of ISBN '{isbn}'. Library: {library_path or 'default'}")
+    try:
+        isbn13 = isbn_utils.normalize_isbn(isbn)
+        books = [book_from_calibredb(b) for b in isbn_utils.find_books_by_isbn(isbn13, library_path=library_path)]
+    except HTTPException:
+        raise
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError checking ISBN {isbn13}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+
+    metadata = None
+    if lookup and not books:
+        try:
+            metadata = calibre_cli.fetch_ebook_metadata(isbn=isbn13, as_json=True)
+        except FileNotFoundError:
+            raise HTTPException(status_code=503, detail="fetch-ebook-metadata command not found.")
+        except calibre_cli.CalibreCLIError as e:
+            # Not finding anything online is a normal answer for this endpoint, not an error.
+            logger.info(f"No online metadata found for ISBN {isbn13}: {e.args[0]}")
+
+    return CheckOwnedResponse(isbn=isbn13, owned=bool(books), books=books, metadata=metadata)
+
+
+# --- Single Book ---
+
+# Registered after fixed paths like /books/check-owned/, which would otherwise be matched
+# as a book ID. Add new fixed /books/<name>/ GET routes above this one.
+
+@app.get("/books/{book_id}/", response_model=Book, tags=["Books"])
+def get_book_endpoint(
+    book_id: int,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used."),
+    include_palette: bool = Query(False, description="Include the dominant cover colors in the response.")
+):
+    """
+    Retrieve a single book by its ID, with the same fields as `GET /books/`.
+    """
+    logger.info(f"Received request for book ID {book_id}. Library path: '{library_path}'")
+    try:
+        book = book_from_calibredb(get_book_or_404(book_id, library_path=library_path), include_palette)
+        return with_reactions(with_sources([book], library_path), library_path)[0]
+    except HTTPException:
+        raise
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError retrieving book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error retrieving book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+# --- Resumable Uploads ---
+
+@app.post("/uploads/", response_model=UploadStatus, status_code=201, tags=["Uploads"])
+def create_upload_endpoint(request: UploadCreateRequest):
+    """
+    Start a resumable upload for files too large to send as a single multipart POST
+    (e.g., through proxies with body-size limits). Send the bytes with `PATCH /uploads/{upload_id}`
+    in as many chunks as needed, then add the file to the library with `POST /uploads/{upload_id}/commit`.
+    """
+    try:
+        return UploadStatus(**uploads.create_upload(request.filename, request.total_size))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+
+@app.get("/uploads/{upload_id}", response_model=UploadStatus, tags=["Uploads"])
+def get_upload_endpoint(upload_id: str):
+    """
+    Get the state of an upload. After an interruption, resume sending from `offset`.
+    """
+    try:
+        return UploadStatus(**uploads.get_upload(upload_id))
+    except uploads.UploadNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.patch("/uploads/{upload_id}", response_model=UploadStatus, tags=["Uploads"])
+async def append_upload_chunk_endpoint(
+    upload_id: str,
+    request: Request,
+    offset: int = Query(..., ge=0, description="Byte offset of this chunk. Must equal the upload's current offset.")
+):
+    """
+    Append a chunk to an upload. The request body is the raw chunk (`Content-Type: application/octet-stream`).
+    A chunk at the wrong offset is rejected with `409 Conflict`; the `Upload-Offset` response header
+    then tells the client where to continue.
+    """
+    data = await request.body()
+    try:
+        return UploadStatus(**uploads.append_chunk(upload_id, offset, data))
+    except uploads.UploadNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except uploads.UploadOffsetMismatch as e:
+        raise HTTPException(status_code=409, detail=str(e), headers={"Upload-Offset": str(e.expected_offset)})
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+
+@app.post("/uploads/{upload_id}/commit", response_model=AddBookResponse, tags=["Uploads"])
+def commit_upload_endpoint(
+    upload_id: str,
+    http_request: Request,
+    request: Optional[UploadCommitRequest] = None,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Add a completely received upload to the library with `calibredb add`.
+    The upload is removed afterwards, whether or not calibredb added a book.
+    On a calibredb failure it is kept so the commit can be retried.
+    """
+    request = request or UploadCommitRequest()
+    try:
+        file_path = uploads.completed_file_path(upload_id)
+        filetypes.check_ebook_file(file_path)
+        logger.info(f"Committing upload {upload_id} ('{os.path.basename(file_path)}'). Library path: '{library_path}'")
+        content_hash = duplicate_detection.file_hash(file_path)
+        same_file = [b["id"] for b in duplicate_detection.find_by_hash(content_hash, library_path)]
+        added_ids, format_added_to = [], None
+        if not same_file and request.merge_formats and not request.duplicates:
+            format_added_to = duplicate_detection.attach_as_format(file_path, library_path, title=request.title,
+                                                                   authors=request.authors)
+        if (not same_file or request.duplicates) and format_added_to is None:
+            with processing_log.step("add", library_path=library_path) as log:
+                log["detail"] = f"Resumable upload of '{os.path.basename(file_path)}'."
+                added_ids = add_book(
+                    file_path=file_path,
+                    library_path=library_path,
+                    duplicates=request.duplicates,
+                    automerge=request.automerge,
+                    authors=request.authors,
+                    title=request.title,
+                    tags=request.tags,
+                    identifiers={duplicate_detection.HASH_IDENTIFIER: content_hash}
+                )
+                log["book_ids"] = added_ids
+                metadata_utils.add_missing_covers(added_ids, file_path, library_path=library_path)
+    except uploads.UploadNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except filetypes.UnsupportedFileType as e:
+        raise HTTPException(status_code=415, detail=str(e))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError committing upload {upload_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        notify_upload_failed(http_request, os.path.basename(file_path), e.args[0])
+        raise HTTPException(status_code=500, detail=f"Error using calibredb add: {e.args[0]}")
+
+    uploads.delete_upload(upload_id)
+    if format_added_to is not None:
+        return format_added_response(format_added_to, library_path, request_user_id(http_request))
+    if added_ids:
+        provenance.record(added_ids, provenance.RESUMABLE_UPLOAD, detail=os.path.basename(file_path),
+                          client=client_address(http_request), library_path=library_path, user_id=request_user_id(http_request))
+        fulltext.update_after_change(added_ids, library_path=library_path)
+        conversion_policy.enqueue(added_ids, library_path=library_path, user_id=request_user_id(http_request))
+        follows.announce(added_ids, library_path=library_path, added_by=request_user_id(http_request))
+        return AddBookResponse(message="Book(s) added successfully.", added_book_ids=added_ids,
+                               books=added_books(added_ids, library_path), duplicate_of=same_file)
+    if same_file and not request.duplicates:
+        return same_file_response(same_file)
+    return AddBookResponse(
+        message="Book was processed but no new entries were added to the library.",
+        added_book_ids=[],
+        details="This can happen if the book is a duplicate and duplicate adding is off, or if the file is invalid."
+    )
+
+
+@app.delete("/uploads/{upload_id}", status_code=204, tags=["Uploads"])
+def delete_upload_endpoint(upload_id: str):
+    """
+    Abort an upload and discard the bytes received so far.
+    """
+    try:
+        uploads.delete_upload(upload_id)
+    except uploads.UploadNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+# --- Monitoring ---
+
+@app.get("/metrics", response_class=PlainTextResponse, tags=["Monitoring"])
+def metrics_endpoint():
+    """
+    Prometheus metrics: Calibre command invocations per tool, and failures per tool and error type
+    (binary_missing, timeout, drm, unsupported_format, corrupt_file, library_locked, unknown).
+    """
+    return PlainTextResponse(metrics.render_prometheus(), media_type="text/plain; version=0.0.4")
+
+
+@app.get("/calibre/failures/", response_model=CommandFailuresResponse, tags=["Monitoring"])
+def recent_failures_endpoint():
+    """
+    The most recent failed Calibre commands (newest first, at most 100) with their error classification,
+    so recurring problems such as DRM-protected or corrupt uploads can be inspected without digging through logs.
+    """
+    return CommandFailuresResponse(failures=[CommandFailure(**f) for f in metrics.recent_failures()])
+
+
+# --- Admin ---
+
+@app.post("/admin/query", response_model=SqlQueryResponse, tags=["Admin"])
+def sql_query_endpoint(
+    request: SqlQueryRequest,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH."),
+    format: str = Query("json", description="Response format: `json` or `csv`.")
+):
+    """
+    Run a read-only SQL query directly against the library's metadata.db, for reports that the
+    regular endpoints can't express. The database is opened read-only and an SQLite authorizer
+    rejects anything but SELECT; queries are stopped after 10 seconds.
+    Disabled unless SHELFSTONE_ENABLE_SQL_QUERY is set; set SHELFSTONE_ADMIN_TOKEN as well to require a token for it.
+    """
+    logger.info(f"Received SQL query request. Library: {library_path or 'default'}")
+    if not library_db.sql_query_enabled():
+        raise HTTPException(status_code=403, detail="The SQL query endpoint is disabled. Set SHELFSTONE_ENABLE_SQL_QUERY=1 to enable it.")
+    if format not in ("json", "csv"):
+        raise HTTPException(status_code=400, detail="format must be 'json' or 'csv'.")
+    try:
+        path = library_db.resolve_library_path(library_path)
+        result = library_db.run_read_only_query(path, request.sql, request.params, max_rows=request.max_rows)
+    except ValueError as e:  # includes QueryError
+        raise HTTPException(status_code=400, detail=str(e))
+    except Exception as e:
+        logger.error(f"Unexpected error running SQL query: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+    if format == "csv":
+        buffer = io.StringIO()
+        writer = csv.writer(buffer)
+        writer.writerow(result["columns"])
+        writer.writerows(result["rows"])
+        headers = {"X-Result-Truncated": "true"} if result["truncated"] else None
+        return Response(content=buffer.getvalue(), media_type="text/csv", headers=headers)
+    return SqlQueryResponse(**result)
+
+
+@app.get("/admin/schema", response_model=LibrarySchemaResponse, tags=["Admin"])
+def library_schema_endpoint(
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+):
+    """
+    Describe the library database for use with `/admin/query` and external reporting tools:
+    tables and views with their columns, custom column definitions and the schema version.
+    Enabled together with `/admin/query` (SHELFSTONE_ENABLE_SQL_QUERY).
+    """
+    logger.info(f"Received request for library schema. Library: {library_path or 'default'}")
+    if not library_db.sql_query_enabled():
+        raise HTTPException(status_code=403, detail="The admin database endpoints are disabled. Set SHELFSTONE_ENABLE_SQL_QUERY=1 to enable them.")
+    try:
+        path = library_db.resolve_library_path(library_path)
+        return LibrarySchemaResponse(**library_db.describe_schema(path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except Exception as e:
+        logger.error(f"Unexpected error describing library schema: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+@app.get("/admin/maintenance-mode", response_model=MaintenanceModeStatus, tags=["Admin"])
+def maintenance_mode_status_endpoint():
+    """
+    Whether maintenance mode is on, and for how long.
+    """
+    return MaintenanceModeStatus(**maintenance_mode.status())
+
+
+@app.post("/admin/maintenance-mode", response_model=MaintenanceModeStatus, tags=["Admin"])
+def maintenance_mode_endpoint(request: MaintenanceModeRequest):
+    """
+    Turn maintenance mode on or off. While it is on, all requests other than GET, HEAD and OPTIONS
+    (except this endpoint and `/admin/query`) are rejected with 503 and a Retry-After header, so
+    backups and migrations can run against an unchanging library. The mode ends by itself after
+    `duration_minutes`; turning it on again while it is on sets a new end time.
+    """
+    logger.info(f"Received maintenance mode request: enabled={request.enabled}, duration={request.duration_minutes} min")
+    if not request.enabled:
+        return MaintenanceModeStatus(**maintenance_mode.disable())
+    try:
+        return MaintenanceModeStatus(**maintenance_mode.enable(request.duration_minutes, reason=request.reason))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+
+@app.get("/admin/logs", response_model=List[LogEntry], tags=["Admin"])
+async def admin_logs_endpoint(
+    request: Request,
+    level: Optional[str] = Query(None, description="Minimum level: DEBUG, INFO, WARNING, ERROR or CRITICAL."),
+    component: Optional[str] = Query(None, description="Only entries of this logger, e.g. `crud`, `calibre_cli` or `uvicorn`."),
+    limit: int = Query(200, ge=1, le=10000, description="Number of most recent entries to return (or to send first when following)."),
+    follow: bool = Query(False, description="Keep the connection open and stream new entries as Server-Sent Events."),
+    last_event_id: Optional[int] = Header(None, alias="Last-Event-ID", description="Sent by EventSource on reconnect; only newer entries are streamed.")
+):
+    """
+    Recent server log entries from an in-memory ring buffer (SHELFSTONE_LOG_BUFFER_SIZE entries),
+    to debug import and conversion problems without shell access to the container.
+    With `follow=true` the response is a `text/event-stream` that sends matching entries as they are logged.
+    Disabled unless SHELFSTONE_ENABLE_ADMIN_LOGS is set; set SHELFSTONE_ADMIN_TOKEN as well to require a token for it.
+    """
+    if not logstream.endpoint_enabled():
+        raise HTTPException(status_code=403, detail="The log endpoint is disabled. Set SHELFSTONE_ENABLE_ADMIN_LOGS=1 to enable it.")
+    try:
+        logstream.validate_level(level)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    handler = logstream.install()
+
+    if not follow:
+        return [LogEntry(**entry) for entry in handler.entries(level=level, component=component, limit=limit)]
+
+    async def event_stream():
+        backlog = handler.entries(since=last_event_id or 0, level=level, component=component, limit=None if last_event_id else limit)
+        since = handler.last_seq
+        for entry in backlog:
+            yield logstream.format_sse(entry)
+        idle = 0.0
+        while not await request.is_disconnected():
+            await asyncio.sleep(0.5)
+            new_entries = handler.entries(since=since, level=level, component=component)
+            since = max([since] + [e["seq"] for e in new_entries])
+            for entry in new_entries:
+                yield logstream.format_sse(entry)
+            idle = 0.0 if new_entries else idle + 0.5
+            if idle >= 15:
+                # Comment line to keep proxies from closing an idle connection.
+                yield ": keep-alive\n\n"
+                idle = 0.0
+
+    return StreamingResponse(event_stream(), media_type="text/event-stream", headers={"Cache-Control": "no-cache"})
+
+
+# --- News ---
+
+@app.post("/news/fetch/", response_model=NewsFetchResponse, tags=["News"])
+def fetch_news_endpoint(
+    recipe: str = Form(..., description="Title of a built-in Calibre recipe (e.g. 'The Guardian'), or a name for the uploaded recipe."),
+    recipe_file: Optional[UploadFile] = File(None, description="A custom .recipe file (e.g. one generated by /web2disk/generate-recipe/)."),
+    keep_issues: int = Form(news.DEFAULT_KEEP_ISSUES, description="Number of issues of this periodical to keep, including the new one."),
+    output_format: str = Form(news.DEFAULT_OUTPUT_FORMAT, description="Format of the downloaded issue: epub, mobi, azw3 or pdf."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Download the current issue of a periodical with Calibre's news recipes (`ebook-convert <recipe>.recipe`),
+    add it to the library tagged "News", and remove the oldest issues beyond `keep_issues`.
+    Downloads can take several minutes. To fetch on a schedule, call this endpoint or `python -m app.news` from cron.
+
+    Uploading a custom recipe, which is Python code ebook-convert runs, is disabled unless
+    SHELFSTONE_ENABLE_CUSTOM_RECIPES is set.
+    """
+    logger.info(f"Received news fetch request for recipe '{recipe}'. Library: {library_path or 'default'}")
+    temp_recipe_path = None
+    try:
+        news.validate_recipe_name(recipe)
+        if recipe_file is not None:
+            if not news.custom_recipes_enabled():
+                raise HTTPException(status_code=403, detail="Custom recipe uploads are disabled. Set SHELFSTONE_ENABLE_CUSTOM_RECIPES=1 to enable them.")
+            if not recipe_file.filename.endswith(".recipe"):
+                raise HTTPException(status_code=400, detail="recipe_file must be a .recipe file.")
+            temp_recipe_path = temp_file_path(prefix="news_", suffix=".recipe")
+            with open(temp_recipe_path, "wb") as buffer:
+                shutil.copyfileobj(recipe_file.file, buffer)
+
+        result = news.fetch_news(
+            recipe,
+            library_path=library_path,
+            keep_issues=keep_issues,
+            output_format=output_format,
+            recipe_file=temp_recipe_path,
+        )
+    except HTTPException:
+        raise
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="Calibre command not found. Ensure Calibre is installed.")
+    except calibre_cli.CalibreCLIError as e:
+        logger.error(f"News download failed for recipe '{recipe}': {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"News download failed: {e.args[0]} - Stderr: {e.stderr}")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError storing news issue for '{recipe}': {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error fetching news for '{recipe}': {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    finally:
+        if temp_recipe_path and os.path.exists(temp_recipe_path):
+            os.remove(temp_recipe_path)
+
+    return NewsFetchResponse(message=f"Fetched {len(result['added_book_ids'])} issue(s) of '{recipe}'.", **result)
+
+
+# --- Taxonomy ---
+
+def _taxonomy_response(action: str, result: dict, dry_run: bool) -> TaxonomyUpdateResponse:
+    count = len(result["updated_book_ids"])
+    verb = "would be updated" if dry_run else "updated"
+    return TaxonomyUpdateResponse(message=f"{action}: {count} book(s) {verb}.", dry_run=dry_run, **result)
+
+
+@app.post("/taxonomy/tags/rename", response_model=TaxonomyUpdateResponse, tags=["Taxonomy"])
+def rename_tag_endpoint(
+    request: RenameRequest,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Rename a tag on every book that has it. Renaming to an existing tag merges the two.
+    """
+    logger.info(f"Renaming tag '{request.old}' to '{request.new}'. Dry run: {request.dry_run}. Library: {library_path or 'default'}")
+    try:
+        result = taxonomy.rename_tag(request.old, request.new, library_path=library_path, dry_run=request.dry_run)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError renaming tag: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    return _taxonomy_response(f"Renamed tag '{request.old}' to '{request.new}'", result, request.dry_run)
+
+
+@app.post("/taxonomy/tags/merge", response_model=TaxonomyUpdateResponse, tags=["Taxonomy"])
+def merge_tags_endpoint(
+    request: MergeTagsRequest,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Replace several tags (e.g. spelling variants) with one tag on every book that has any of them.
+    """
+    logger.info(f"Merging tags {request.sources} into '{request.target}'. Dry run: {request.dry_run}. Library: {library_path or 'default'}")
+    try:
+        result = taxonomy.merge_tags(request.sources, request.target, library_path=library_path, dry_run=request.dry_run)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError merging tags: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    return _taxonomy_response(f"Merged {len(request.sources)} tag(s) into '{request.target}'", result, request.dry_run)
+
+
+@app.post("/taxonomy/series/rename", response_model=TaxonomyUpdateResponse, tags=["Taxonomy"])
+def rename_series_endpoint(
+    request: RenameRequest,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Rename a series on every book in it, keeping each book's series index. Renaming to an existing series merges the two.
+    """
+    logger.info(f"Renaming series '{request.old}' to '{request.new}'. Dry run: {request.dry_run}. Library: {library_path or 'default'}")
+    try:
+        result = taxonomy.rename_series(request.old, request.new, library_path=library_path, dry_run=request.dry_run)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError renaming series: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    if not request.dry_run:
+        fulltext.update_after_change(result["updated_book_ids"], library_path=library_path)
+    return _taxonomy_response(f"Renamed series '{request.old}' to '{request.new}'", result, request.dry_run)
+
+
+@app.get("/taxonomy/tags", response_model=List[TagCount], tags=["Taxonomy"])
+def list_tags_endpoint(
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+):
+    """
+    List all tags with the number of books that have each, e.g. for a tag cloud or the `tag`
+    filter of GET /books/. Reads metadata.db directly, so the library path must be known.
+    """
+    try:
+        return [TagCount(**t) for t in taxonomy.list_tags(library_db.resolve_library_path(library_path))]
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except Exception as e:
+        logger.error(f"Unexpected error listing tags: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+@app.get("/taxonomy/unused", response_model=UnusedEntriesResponse, tags=["Taxonomy"])
+def unused_entries_endpoint(
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+):
+    """
+    List tags, series, authors and publishers that no book uses any more. Calibre normally removes
+    these itself when the last book drops them, so entries here are leftovers (e.g. from older Calibre versions).
+    Reads metadata.db directly, so the library path must be known.
+    """
+    try:
+        path = library_db.resolve_library_path(library_path)
+        return UnusedEntriesResponse(**taxonomy.find_unused_entries(path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except Exception as e:
+        logger.error(f"Unexpected error listing unused entries: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+# --- Offline Bundles ---
+
+@app.get("/bundles/export", tags=["Bundles"])
+def export_bundle_endpoint(
+    search: Optional[str] = Query(None, description="calibredb search selecting the books (e.g. 'tags:=Classroom'). All books if omitted."),
+    formats: Optional[str] = Query(None, description="Comma-separated formats to include (e.g. 'EPUB,PDF'). All formats if omitted."),
+    title: str = Query("Shelfstone Library", description="Title of the bundle's index page and OPDS catalog."),
+    max_books: int = Query(bundles.max_books(), ge=1, le=bundles.max_books(), description="Refuse to build bundles with more books than this. At most SHELFSTONE_BUNDLE_MAX_BOOKS."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Download a search result as a self-contained offline bundle (ZIP): the book files, their covers,
+    an `index.html` to browse them in a web browser and a `catalog.xml` OPDS feed for reading apps.
+    All links are relative, so the unpacked bundle works from a USB stick or a plain file share.
+    """
+    logger.info(f"Received bundle export request. Search: '{search}', Formats: {formats}, Library: {library_path or 'default'}")
+    format_list = [f.strip().upper() for f in formats.split(",") if f.strip()] if formats else None
+    try:
+        books_data = list_books(library_path=library_path, search_query=search)
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError listing books for bundle: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    if not books_data:
+        raise HTTPException(status_code=404, detail="No books match the search.")
+    if len(books_data) > max_books:
+        raise HTTPException(status_code=400, detail=f"The search matches {len(books_data)} books, more than max_books ({max_books}).")
+
+    bundle_path = temp_file_path(prefix="bundle_", suffix=".zip")
+    try:
+        bundles.write_bundle(books_data, bundle_path, title=title, formats=format_list)
+    except ValueError as e:
+        if os.path.exists(bundle_path):
+            os.remove(bundle_path)
+        raise HTTPException(status_code=400, detail=str(e))
+    except Exception as e:
+        if os.path.exists(bundle_path):
+            os.remove(bundle_path)
+        logger.error(f"Unexpected error building bundle: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+    return FileResponse(
+        path=bundle_path,
+        filename=f"{bundles.safe_name(title)}.zip",
+        media_type="application/zip",
+        background=BackgroundTask(os.remove, bundle_path),
+    )
+
+
+# --- Mobile Sync ---
+
+@app.get("/sync/bundle", tags=["Sync"])
+def sync_bundle_endpoint(
+    since: Optional[str] = Query(None, description="The `rev` returned by the previous sync. All books if omitted."),
+    thumbnails: bool = Query(True, description="Include small cover thumbnails of the changed books."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+):
+    """
+    Download everything a mobile app needs to refresh its copy of the library in one request: a ZIP
+    with the metadata of all books changed since `since`, the IDs of all books (to detect deletions)
+    and cover thumbnails. The new revision is in the manifest and in the `X-Sync-Rev` header.
+    """
+    logger.info(f"Received sync bundle request. Since: '{since}', Library: {library_path or 'default'}")
+    bundle_path = temp_file_path(prefix="sync_", suffix=".zip")
+    try:
+        result = sync.write_sync_bundle(library_path, bundle_path, since=since, thumbnails=thumbnails)
+    except ValueError as e:
+        if os.path.exists(bundle_path):
+            os.remove(bundle_path)
+        raise HTTPException(status_code=400, detail=str(e))
+    except Exception as e:
+        if os.path.exists(bundle_path):
+            os.remove(bundle_path)
+        logger.error(f"Unexpected error building sync bundle: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+    return FileResponse(
+        path=bundle_path,
+        filename="sync.zip",
+        media_type="application/zip",
+        headers={"X-Sync-Rev": result["rev"], "X-Sync-Changed": str(result["changed"])},
+        background=BackgroundTask(os.remove, bundle_path),
+    )
+
+
+# --- Full-Text Search ---
+
+@app.post("/search/fulltext/index", response_model=FullTextIndexStatus, status_code=202, tags=["Full-Text Search"])
+def start_fulltext_index_endpoint(
+    search: Optional[str] = Query(None, description="Only index books matching this calibredb search. All books if omitted."),
+    rebuild: bool = Query(False, description="Re-extract all books, not only new or changed ones."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Starts building the full-text index of book contents in the background. Text is extracted from
+    EPUBs directly and from other formats with `ebook-convert`, capped at SHELFSTONE_FTS_MAX_CHARS
+    characters per book. Only new and changed books are read unless `rebuild` is set.
+    Poll `GET /search/fulltext/index` for progress.
+    """
+    logger.info(f"Starting full-text indexing. Search: '{search}', Rebuild: {rebuild}, Library: {library_path or 'default'}")
+    try:
+        return FullTextIndexStatus(**fulltext.start_background_index(library_path=library_path, search_query=search, rebuild=rebuild))
+    except RuntimeError as e:
+        raise HTTPException(status_code=409, detail=str(e))
+
+
+@app.get("/search/fulltext/index", response_model=FullTextIndexStatus, tags=["Full-Text Search"])
+def fulltext_index_status_endpoint():
+    """
+    Status and progress of the current (or last) full-text indexing job.
+    """
+    return FullTextIndexStatus(**fulltext.job_status())
+
+
+@app.get("/search/fulltext", response_model=FullTextSearchResponse, tags=["Full-Text Search"])
+def fulltext_search_endpoint(
+    q: str = Query(..., description="Words to find inside books. Supports \"exact phrases\", OR, NOT and prefix*."),
+    limit: int = Query(20, ge=1, le=200, description="Maximum number of books to return."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Searches inside the contents of indexed books and returns the best matching books with a
+    snippet around the match. Books are only found once indexed with `POST /search/fulltext/index`.
+    """
+    try:
+        hits = fulltext.search(q, library_path=library_path, limit=limit)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except Exception as e:
+        logger.error(f"Unexpected error in full-text search: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    return FullTextSearchResponse(query=q, hits=[FullTextHit(**hit) for hit in hits])
+
+
+@app.get("/search/", response_model=BookSearchResponse, tags=["Full-Text Search"])
+def search_books_endpoint(
+    q: str = Query(..., description="Words to find. Supports \"exact phrases\", OR, NOT and prefix*."),
+    fields: str = Query("title,author,series", description="Comma-separated metadata fields to search: title, author, series. May be empty to search only the text."),
+    text: bool = Query(False, description="Also search inside the contents of books indexed with `POST /search/fulltext/index`."),
+    limit: int = Query(20, ge=1, le=200, description="Maximum number of books to return."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Ranked search over titles, authors and series, optionally including book contents. Matches
+    in the metadata come first. The metadata index is built from the library on the first search
+    and updated whenever books are added, edited or removed through this server.
+    """
+    field_list = [f.strip() for f in fields.split(",") if f.strip()]
+    if not field_list and not text:
+        raise HTTPException(status_code=400, detail="Select at least one field or set text=true.")
+    if text and not features.is_enabled("fulltext"):
+        raise HTTPException(status_code=403, detail="Searching book contents (text=true) needs the 'fulltext' feature, which is disabled on this server.")
+    try:
+        hits = fulltext.search_books(q, field_list, include_text=text, library_path=library_path, limit=limit)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError building the search index: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error in book search: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    return BookSearchResponse(query=q, hits=[BookSearchHit(**hit) for hit in hits])
+
+
+# --- Physical Copies ---
+
+@app.get("/books/{book_id}/physical", response_model=PhysicalCopy, tags=["Physical Copies"])
+def get_physical_copy_endpoint(
+    book_id: int,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The physical copy data of a book: whether it is owned on paper, its shelf, condition and loan.
+    """
+    try:
+        book_dict = get_book_or_404(book_id, library_path=library_path)
+        return PhysicalCopy(**physical.read_physical_copy(book_dict))
+    except HTTPException:
+        raise
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError reading physical copy of book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error reading physical copy of book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+@app.put("/books/{book_id}/physical", response_model=PhysicalCopy, tags=["Physical Copies"])
+def set_physical_copy_endpoint(
+    book_id: int,
+    update: PhysicalCopyUpdate,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Record that the book exists physically and update the given fields; fields left out are kept.
+    The custom columns #physical, #shelf, #condition, #loaned_to and #loaned_on are created in the
+    library on first use, so the data can also be searched and edited in Calibre.
+    """
+    changes = update.model_dump(exclude_unset=True)
+    logger.info(f"Received physical copy update for book ID {book_id}: {changes}. Library: '{library_path}'")
+    try:
+        get_book_or_404(book_id, library_path=library_path)
+        physical.set_physical_copy(book_id, changes, library_path=library_path)
+        return PhysicalCopy(**physical.read_physical_copy(get_book_or_404(book_id, library_path=library_path)))
+    except HTTPException:
+        raise
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError updating physical copy of book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error updating physical copy of book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+@app.delete("/books/{book_id}/physical", response_model=PhysicalCopy, tags=["Physical Copies"])
+def clear_physical_copy_endpoint(
+    book_id: int,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Remove all physical copy data from the book (e.g. after giving the paper copy away).
+    """
+    logger.info(f"Received request to clear physical copy of book ID {book_id}. Library: '{library_path}'")
+    try:
+        get_book_or_404(book_id, library_path=library_path)
+        physical.clear_physical_copy(book_id, library_path=library_path)
+        return PhysicalCopy(physical=False)
+    except HTTPException:
+        raise
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError clearing physical copy of book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error clearing physical copy of book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+@app.get("/physical/", response_model=List[PhysicalBook], tags=["Physical Copies"])
+def list_physical_copies_endpoint(
+    shelf: Optional[str] = Query(None, description="Only books on this shelf (exact match)."),
+    condition: Optional[str] = Query(None, description="Only books in this condition."),
+    loaned: Optional[bool] = Query(None, description="true: only lent books, false: only books at home."),
+    search: Optional[str] = Query(None, description="Additional calibredb search, e.g. 'author:Tolkien'."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    List the books with a physical copy, filtered by shelf, condition and loan status.
+    """
+    logger.info(f"Received physical copy listing. Shelf: '{shelf}', Condition: '{condition}', Loaned: {loaned}, Search: '{search}'")
+    try:
+        books_data = physical.list_physical_copies(shelf=shelf, condition=condition, loaned=loaned,
+                                                   search=search, library_path=library_path)
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError listing physical copies: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error listing physical copies: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    return [
+        PhysicalBook(id=b["id"], title=b.get("title"), authors=b.get("authors"), physical_copy=PhysicalCopy(**b["physical_copy"]))
+        for b in books_data
+    ]
+
+
+# --- Acquisitions ---
+
+@app.get("/books/{book_id}/acquisition", response_model=Acquisition, tags=["Acquisitions"])
+def get_acquisition_endpoint(
+    book_id: int,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Where and when the book was bought, for how much, and with which store account.
+    """
+    try:
+        return Acquisition(**acquisitions.read_acquisition(get_book_or_404(book_id, library_path=library_path)))
+    except HTTPException:
+        raise
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError reading acquisition of book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error reading acquisition of book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+@app.put("/books/{book_id}/acquisition", response_model=Acquisition, tags=["Acquisitions"])
+def set_acquisition_endpoint(
+    book_id: int,
+    update: AcquisitionUpdate,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Update the given acquisition fields; fields left out are kept, null clears a field. The custom
+    columns #store, #price, #currency, #purchase_date and #drm_source are created on first use.
+    """
+    changes = update.model_dump(exclude_unset=True)
+    logger.info(f"Received acquisition update for book ID {book_id}: {changes}. Library: '{library_path}'")
+    try:
+        get_book_or_404(book_id, library_path=library_path)
+        acquisitions.set_acquisition(book_id, changes, library_path=library_path)
+        return Acquisition(**acquisitions.read_acquisition(get_book_or_404(book_id, library_path=library_path)))
+    except HTTPException:
+        raise
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError updating acquisition of book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error updating acquisition of book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+@app.get("/acquisitions/report", response_model=SpendingReport, tags=["Acquisitions"])
+def spending_report_endpoint(
+    year: Optional[int] = Query(None, description="Only books bought in this year."),
+    search: Optional[str] = Query(None, description="Additional calibredb search restricting the books."),
+    convert_to: Optional[str] = Query(None, description="Convert all prices to this currency (ISO 4217 code) before adding them up."),
+    rates: Optional[str] = Query(None, description="Exchange rates into `convert_to`, e.g. 'USD=0.92,GBP=1.17'. Defaults to SHELFSTONE_EXCHANGE_RATES."),
+    format: str = Query("json", description="Response format: `json` or `csv`."),
+    locale: str = Query(localeformat.DEFAULT_LOCALE, description="Number format and column separator of the CSV, e.g. 'de' or 'en-US'."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Total spent per purchase year, per store and overall, separately for each currency
+    unless `convert_to` is given.
+    """
+    logger.info(f"Received spending report request. Year: {year}, Search: '{search}', Convert to: {convert_to}, Format: {format}")
+    if format not in ("json", "csv"):
+        raise HTTPException(status_code=400, detail="format must be 'json' or 'csv'.")
+    try:
+        books_data = acquisitions.list_acquired_books(library_path=library_path, search=search)
+        if convert_to:
+            books_data = acquisitions.convert_prices(books_data, convert_to.upper(), localeformat.exchange_rates(rates))
+        report = acquisitions.spending_report(books_data, year=year)
+        if format == "csv":
+            headers = {"Content-Disposition": 'attachment; filename="spending_report.csv"'}
+            return Response(content=acquisitions.report_csv(report, locale), media_type="text/csv", headers=headers)
+        return SpendingReport(**report)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError building spending report: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error building spending report: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+@app.get("/acquisitions/export", tags=["Acquisitions"])
+def export_acquisitions_endpoint(
+    search: Optional[str] = Query(None, description="Additional calibredb search restricting the books."),
+    locale: str = Query(localeformat.DEFAULT_LOCALE, description="Number and date format and column separator, e.g. 'de' or 'en-US'."),
+    convert_to: Optional[str] = Query(None, description="Add the price converted to this currency (ISO 4217 code)."),
+    rates: Optional[str] = Query(None, description="Exchange rates into `convert_to`, e.g. 'USD=0.92,GBP=1.17'. Defaults to SHELFSTONE_EXCHANGE_RATES."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    CSV of all books with acquisition data, including physical copy condition and shelf,
+    e.g. as documentation for insurance.
+    """
+    logger.info(f"Received acquisition export request. Search: '{search}', Locale: {locale}, Convert to: {convert_to}")
+    try:
+        books_data = acquisitions.list_acquired_books(library_path=library_path, search=search)
+        content = acquisitions.export_csv(books_data, locale=locale, convert_to=convert_to.upper() if convert_to else None,
+                                          rates=localeformat.exchange_rates(rates) if convert_to else None)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError exporting acquisitions: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error exporting acquisitions: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    return Response(
+        content=content,
+        media_type="text/csv",
+        headers={"Content-Disposition": 'attachment; filename="acquisitions.csv"'},
+    )
+
+
+# --- Calendar Feed ---
+
+@app.get("/calendar.ics", tags=["Calendar"])
+def calendar_feed_endpoint(
+    days: int = Query(calendar_feed.DEFAULT_DAYS, ge=1, le=3650, description="Include books added in this many past days."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    iCalendar feed of library events for calendar apps: books added, due dates of lent physical
+    copies (loan date plus SHELFSTONE_LOAN_DAYS) and the current maintenance window.
+    """
+    logger.info(f"Received calendar feed request. Days: {days}, Library: {library_path or 'default'}")
+    try:
+        content = calendar_feed.build_feed(library_path=library_path, days=days)
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError building calendar feed: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error building calendar feed: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    return Response(content=content, media_type="text/calendar; charset=utf-8",
+                    headers={"Content-Disposition": 'inline; filename="library.ics"'})
+
+
+# --- OPDS Catalog ---
+
+def _opds_books(search_query: Optional[str], library_path: Optional[str], prefs: dict) -> List[dict]:
+    """list_books for the catalog, in the user's preferred languages, with calibredb errors turned into HTTP errors."""
+    try:
+        return opds.filter_languages(list_books(library_path=library_path, search_query=search_query), prefs["languages"])
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError building OPDS feed: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+
+
+def _opds_preferences(request: Request) -> dict:
+    """The signed-in user's preferences (see preferences): languages, page size and format of the feeds."""
+    return preferences.effective(auth.current_user(request))
+
+
+def _opds_page_size(request: Request, prefs: dict) -> int:
+    # Reading apps that crawl the whole catalog get bigger pages, so fewer feed requests (see opds_throttle).
+    crawler = opds_throttle.reader_agent(request.headers.get("user-agent"))
+    return prefs["items_per_page"] or (opds_throttle.READER_PAGE_SIZE if crawler else opds.DEFAULT_PAGE_SIZE)
+
+
+def _opds_language(request: Request) -> str:
+    return opds_i18n.negotiate(request.headers.get("accept-language"))
+
+
+def _feed_library(request: Request, library_path: Optional[str]) -> Optional[str]:
+    # The public listener serves one fixed library, so its links don't name it (see public_app.py).
+    return None if public_app.is_public_request(request) else library_path
+
+
+def _opds_response(xml: str, kind: str = opds.ACQUISITION_TYPE, language: str = opds_i18n.DEFAULT_LANGUAGE) -> Response:
+    # Caches must keep the translations apart.
+    return Response(content=xml, media_type=kind, headers={"Content-Language": language, "Vary": "Accept-Language"})
+
+
+@app.get("/opds", tags=["OPDS"])
+def opds_root_endpoint(
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    OPDS 1.2 catalog root for reading apps: recently added books, authors, series and search.
+    Navigation texts follow Accept-Language, else SHELFSTONE_OPDS_LOCALE.
+    """
+    language = _opds_language(request)
+    return _opds_response(opds.root_feed(public_base_url(str(request.base_url)), _feed_library(request, library_path), language=language),
+                          opds.NAVIGATION_TYPE, language)
+
+
+@app.get("/opds/recent", tags=["OPDS"])
+def opds_recent_endpoint(
+    request: Request,
+    page: int = Query(1, ge=1, description="Page of the feed."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The library's books, newest additions first.
+    """
+    language = _opds_language(request)
+    prefs = _opds_preferences(request)
+    books = opds.sort_recent(_opds_books(None, library_path, prefs))
+    return _opds_response(opds.books_feed(books, "urn:shelfstone:recent", opds_i18n.text(language, "recent"),
+                                          public_base_url(str(request.base_url)), "/opds/recent", _feed_library(request, library_path), page,
+                                          _opds_page_size(request, prefs), language, prefs["download_format"]), language=language)
+
+
+@app.get("/opds/authors", tags=["OPDS"])
+def opds_authors_endpoint(
+    request: Request,
+    page: int = Query(1, ge=1, description="Page of the feed."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    All authors, alphabetically, each linking to their books.
+    """
+    language = _opds_language(request)
+    prefs = _opds_preferences(request)
+    books = _opds_books(None, library_path, prefs)
+    return _opds_response(opds.category_feed(books, "authors", public_base_url(str(request.base_url)), _feed_library(request, library_path), page,
+                                             _opds_page_size(request, prefs), language), opds.NAVIGATION_TYPE, language)
+
+
+@app.get("/opds/authors/{name}", tags=["OPDS"])
+def opds_author_books_endpoint(
+    request: Request,
+    name: str,
+    page: int = Query(1, ge=1, description="Page of the feed."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The books of one author, by title.
+    """
+    language = _opds_language(request)
+    prefs = _opds_preferences(request)
+    books = sorted(_opds_books(f'authors:"={escape_search_value(name)}"', library_path, prefs), key=lambda b: localeformat.sort_key(str(b.get("sort") or b.get("title") or "")))
+    return _opds_response(opds.books_feed(books, f"urn:shelfstone:authors:{name}", name,
+                                          public_base_url(str(request.base_url)), f"/opds/authors/{quote(name, safe='')}", _feed_library(request, library_path), page,
+                                          _opds_page_size(request, prefs), language, prefs["download_format"]), language=language)
+
+
+@app.get("/opds/series", tags=["OPDS"])
+def opds_series_endpoint(
+    request: Request,
+    page: int = Query(1, ge=1, description="Page of the feed."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    All series, alphabetically, each linking to its books.
+    """
+    language = _opds_language(request)
+    prefs = _opds_preferences(request)
+    books = _opds_books("series:true", library_path, prefs)
+    return _opds_response(opds.category_feed(books, "series", public_base_url(str(request.base_url)), _feed_library(request, library_path), page,
+                                             _opds_page_size(request, prefs), language), opds.NAVIGATION_TYPE, language)
+
+
+@app.get("/opds/series/{name}", tags=["OPDS"])
+def opds_series_books_endpoint(
+    request: Request,
+    name: str,
+    page: int = Query(1, ge=1, description="Page of the feed."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The books of one series, in series order.
+    """
+    language = _opds_language(request)
+    prefs = _opds_preferences(request)
+    books = opds.sort_series(_opds_books(f'series:"={escape_search_value(name)}"', library_path, prefs))
+    return _opds_response(opds.books_feed(books, f"urn:shelfstone:series:{name}", name,
+                                          public_base_url(str(request.base_url)), f"/opds/series/{quote(name, safe='')}", _feed_library(request, library_path), page,
+                                          _opds_page_size(request, prefs), language, prefs["download_format"]), language=language)
+
+
+@app.get("/opds/search.xml", tags=["OPDS"])
+def opds_opensearch_endpoint(
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    OpenSearch description telling reading apps how to search the catalog.
+    """
+    language = _opds_language(request)
+    return _opds_response(opds.opensearch_description(public_base_url(str(request.base_url)), _feed_library(request, library_path), language),
+                          opds.OPENSEARCH_TYPE, language)
+
+
+@app.get("/opds/search", tags=["OPDS"])
+def opds_search_endpoint(
+    request: Request,
+    q: str = Query(..., min_length=1, description="calibredb search, e.g. plain words or 'author:Herbert'."),
+    page: int = Query(1, ge=1, description="Page of the feed."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Books matching a calibredb search, as an acquisition feed.
+    """
+    language = _opds_language(request)
+    prefs = _opds_preferences(request)
+    books = _opds_books(q, library_path, prefs)
+    return _opds_response(opds.books_feed(books, f"urn:shelfstone:search:{q}", opds_i18n.text(language, "search_results", query=q),
+                                          public_base_url(str(request.base_url)), "/opds/search", _feed_library(request, library_path), page,
+                                          _opds_page_size(request, prefs), language, prefs["download_format"], q=q), language=language)
+
+
+# --- Book Downloads ---
+
+def download_filename(book: dict, fmt: str) -> str:
+    authors = as_list(book.get("authors"), "authors")
+    name = book.get("title") or f"book_{book.get('id')}"
+    if authors:
+        name = f"{name} - {authors[0]}"
+    return f"{safe_name(name)}.{fmt.lower()}"
+
+
+@app.get("/books/{book_id}/download", tags=["Books"])
+def download_book_endpoint(
+    request: Request,
+    book_id: int,
+    format: Optional[str] = Query(None, description="Format to download, e.g. 'epub' or 'azw3'. If the book doesn't have it, a converted copy is served. Defaults to your preferred format if the book has it, else the book's best original format."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Streams a book file straight from the library, named after title and author. When the requested
+    format doesn't exist, the book is converted with `ebook-convert` from its best format; converted
+    copies are cached (SHELFSTONE_CONVERSION_CACHE) so later downloads are immediate. The public
+    listener only converts with SHELFSTONE_PUBLIC_CONVERSION set.
+    The `X-Converted` header tells whether the file is a conversion.
+    """
+    logger.info(f"Download request for book ID {book_id}, Format: {format or 'original'}, Library: '{library_path}'")
+    try:
+        book = get_book_or_404(book_id, library_path=library_path)
+        formats = {fmt: path for fmt, path in conversion_cache.book_formats(book).items() if os.path.isfile(path)}
+        if not formats:
+            raise HTTPException(status_code=404, detail=f"Book ID {book_id} has no files.")
+        wanted = format.upper().lstrip(".") if format else None
+        if wanted is None:
+            preferred = preferences.effective(auth.current_user(request))["download_format"]
+            wanted = preferred if preferred in formats else None
+        converted = False
+        if wanted is None:
+            path = conversion_cache.pick_source(formats)
+            wanted = os.path.splitext(path)[1][1:].upper()
+        elif wanted in formats:
+            path = formats[wanted]
+        else:
+            features.require("conversion")
+            if public_app.is_public_request(request) and not public_app.conversion_enabled():
+                raise HTTPException(status_code=403, detail=f"Book ID {book_id} has no {wanted} file, and the public listener doesn't convert books. Set SHELFSTONE_PUBLIC_CONVERSION=1 to enable it.")
+            user = auth.current_user(request)
+            # A job, so the conversion goes ahead of bulk work and can be cancelled (POST /jobs/{id}/cancel).
+            with lifecycle.job(f"conversion of book ID {book_id} to {wanted} for download", lifecycle.INTERACTIVE,
+                               user["id"] if user else None), \
+                    processing_log.step(f"convert to {wanted} for download", [book_id], library_path) as log:
+                result = conversion_cache.get_or_convert(book_id, conversion_cache.pick_source(formats), wanted)
+                # Only actual conversions are logged, not files served from the cache.
+                log["discard"] = result["cached"]
+            path, converted = result["path"], True
+    except HTTPException:
+        raise
+    except features.FeatureDisabled as e:
+        raise HTTPException(status_code=403, detail=e.args[0])
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb or ebook-convert command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError looking up book ID {book_id} for download: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except calibre_cli.ConversionUnavailable as e:
+        raise HTTPException(status_code=422, detail=e.args[0])
+    except calibre_cli.CommandCancelled:
+        raise HTTPException(status_code=409, detail=f"Conversion of book ID {book_id} to {wanted} was cancelled.")
+    except calibre_cli.CalibreCLIError as e:
+        logger.error(f"Converting book ID {book_id} to {format} failed: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Conversion to {wanted} failed: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error downloading book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+    filename = download_filename(book, wanted)
+    try:
+        download_log.record(book, wanted, user=auth.current_user(request), user_agent=request.headers.get("user-agent"),
+                            converted=converted, library_path=library_path)
+    except sqlite3.Error as e:
+        logger.warning(f"Could not log the download of book ID {book_id}: {e}")
+    if accounts.enabled():
+        # So KOReader's sync of this file can be linked to the book.
+        try:
+            kosync.record_download(path, filename, book_id, wanted, library_path=library_path)
+        except (OSError, sqlite3.Error) as e:
+            logger.warning(f"Could not record the KOReader hashes of book ID {book_id}: {e}")
+    return FileResponse(
+        path,
+        media_type=format_registry.mime_type(wanted),
+        filename=filename,
+        headers={"X-Converted": "true" if converted else "false"},
+    )
+
+
+# --- Covers ---
+
+@app.get("/books/{book_id}/cover", tags=["Books"])
+def book_cover_endpoint(
+    book_id: int,
+    size: Optional[str] = Query(None, description="small (120x180), medium (300x450) or large (600x900). The original cover if omitted."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The book's cover image. With `size`, a JPEG thumbnail scaled to fit the size is served; thumbnails
+    are cached on disk (SHELFSTONE_THUMBNAIL_CACHE). Without Pillow, the original cover is served.
+    """
+    try:
+        book = get_book_or_404(book_id, library_path=library_path)
+        cover = book.get("cover")
+        if not cover or not os.path.isfile(cover):
+            raise HTTPException(status_code=404, detail=f"Book ID {book_id} has no cover.")
+        path = thumbnails.get_thumbnail(book_id, cover, size) if size else None
+    except HTTPException:
+        raise
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError looking up cover of book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error serving cover of book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    # Covers change rarely; let browsers reuse them for a day.
+    return FileResponse(path or cover, media_type="image/jpeg", headers={"Cache-Control": "public, max-age=86400"})
+
+
+# --- Library Import ---
+
+@app.post("/library/scan", response_model=LibraryImportResponse, tags=["Maintenance"])
+def library_scan_endpoint(
+    request: Request,
+    directory: str = Query(..., description="Folder on the server to import, searched recursively."),
+    dry_run: bool = Query(False, description="Only report what would be added."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Import an existing folder of e-books: every e-book in it (recursively) that wasn't imported
+    before is added with `calibredb add`. Imported files are recognized by a content hash, so the
+    scan can be repeated to pick up new files. The folder is not changed. Also available as
+    `python -m app.library_import`. The import is a bulk job: its Calibre commands wait for those
+    of interactive work, and it can be cancelled (see `GET /jobs`).
+    """
+    logger.info(f"Scanning '{directory}' for books to import. Dry run: {dry_run}. Library: {library_path or 'default'}")
+    user = auth.current_user(request)
+    try:
+        with lifecycle.job(f"import of '{directory}'", lifecycle.BULK, user["id"] if user else None):
+            result = library_import.import_directory(directory, library_path=library_path, dry_run=dry_run)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except calibre_cli.CommandCancelled:
+        raise HTTPException(status_code=409, detail=f"Import of '{directory}' was cancelled; books added before are kept.")
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError scanning '{directory}': {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error scanning '{directory}': {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    added_ids = [i for r in result["results"] for i in r["book_ids"]]
+    if added_ids:
+        fulltext.update_after_change(added_ids, library_path=library_path)
+        conversion_policy.enqueue(added_ids, library_path=library_path)
+        follows.announce(added_ids, library_path=library_path)
+    return LibraryImportResponse(**result)
+
+
+# --- Formats ---
+
+@app.get("/formats", response_model=List[FormatInfo], tags=["Books"])
+def list_formats_endpoint():
+    """
+    The e-book formats the server knows, with the MIME type used for downloads and OPDS links
+    and whether books can be converted to the format.
+    """
+    return [FormatInfo(name=f.name, extensions=list(f.extensions), mime_type=f.mime_type,
+                       display_name=f.display_name, convertible=f.convertible)
+            for f in format_registry.FORMATS]
+
+
+# --- Send to Device ---
+
+@app.get("/devices", response_model=List[DeviceInfo], tags=["Send to Device"])
+def list_devices_endpoint():
+    """
+    The e-reader email addresses books can be sent to, configured in SHELFSTONE_SEND_DEVICES.
+    """
+    return [DeviceInfo(name=name, **device) for name, device in sorted(delivery.configured_devices().items())]
+
+
+@app.post("/books/{book_id}/send", response_model=DeliveryStatus, status_code=202, tags=["Send to Device"])
+def send_book_endpoint(
+    book_id: int,
+    request: SendBookRequest,
+    http_request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Emails a book to a configured e-reader address (e.g. Send to Kindle), converted to the device's
+    format first if the book doesn't have it. Sending happens in the background; poll
+    `GET /deliveries/{delivery_id}` for the result.
+    """
+    logger.info(f"Send request for book ID {book_id} to device '{request.device}', Format: {request.format or 'device default'}")
+    try:
+        book = get_book_or_404(book_id, library_path=library_path)
+        return DeliveryStatus(**delivery.start_delivery(book, request.device, request.format, library_path=library_path,
+                                                        user_id=request_user_id(http_request)))
+    except HTTPException:
+        raise
+    except features.FeatureDisabled as e:
+        raise HTTPException(status_code=403, detail=e.args[0])
+    except delivery.SendingNotConfigured as e:
+        raise HTTPException(status_code=503, detail=str(e))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError looking up book ID {book_id} to send: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+
+
+@app.get("/deliveries", response_model=List[DeliveryStatus], tags=["Send to Device"])
+def list_deliveries_endpoint():
+    """
+    The most recent deliveries (up to 100, newest first) since the server started.
+    """
+    return [DeliveryStatus(**d) for d in delivery.recent_deliveries()]
+
+
+@app.get("/deliveries/{delivery_id}", response_model=DeliveryStatus, tags=["Send to Device"])
+def get_delivery_endpoint(delivery_id: int):
+    """
+    Status of a delivery started with `POST /books/{book_id}/send`.
+    """
+    found = delivery.get_delivery(delivery_id)
+    if found is None:
+        raise HTTPException(status_code=404, detail=f"Delivery {delivery_id} not found.")
+    return DeliveryStatus(**found)
+
+
+# --- Online Metadata ---
+
+@app.post("/books/{book_id}/metadata/fetch", response_model=MetadataFetchResponse, tags=["Books"])
+def fetch_book_metadata_endpoint(
+    book_id: int,
+    request: Optional[MetadataFetchRequest] = None,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Look a book up with the online metadata providers (Google Books, Open Library) and return the
+    candidate matches. Searches by the book's ISBN if it has one, else by title and author; the
+    request body can override either. Nothing is changed; apply a candidate with
+    `POST /books/{book_id}/metadata/apply`.
+    """
+    request = request or MetadataFetchRequest()
+    try:
+        features.require("metadata_fetch")
+        book = get_book_or_404(book_id, library_path=library_path)
+        isbn = request.isbn
+        title = request.title
+        if not isbn and not title:
+            isbn = book.get("isbn") or (book.get("identifiers") or {}).get("isbn")
+            title = None if isbn else book.get("title")
+        if isbn:
+            isbn = isbn_utils.normalize_isbn(isbn)
+        authors = request.authors
+        if authors is None:
+            authors = as_list(book.get("authors"), "authors")
+        logger.info(f"Fetching metadata for book ID {book_id}. ISBN: {isbn}, Title: {title}, Providers: {request.providers or 'default'}")
+        candidates, errors = metadata_providers.fetch_candidates(
+            isbn=isbn, title=title, authors=authors, providers=request.providers, limit=request.limit)
+    except HTTPException:
+        raise
+    except features.FeatureDisabled as e:
+        raise HTTPException(status_code=403, detail=e.args[0])
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError looking up book ID {book_id} for metadata fetch: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+
+    if errors and not candidates:
+        raise HTTPException(status_code=502, detail="No metadata provider could be reached: " + "; ".join(f"{k}: {v}" for k, v in errors.items()))
+    return MetadataFetchResponse(
+        book_id=book_id, isbn=isbn or None, title=None if isbn else title,
+        candidates=[MetadataCandidate(**c) for c in candidates], errors=errors,
+    )
+
+
+@app.post("/books/{book_id}/metadata/apply", response_model=MetadataApplyResponse, tags=["Books"])
+def apply_book_metadata_endpoint(
+    book_id: int,
+    request: MetadataApplyRequest,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Merge selected fields of a candidate from `POST /books/{book_id}/metadata/fetch` into the book.
+    Selected fields replace the book's values, except identifiers, which are added to the book's
+    own. `cover` downloads the candidate's cover. With `write_to_file`, the values are also written
+    into the book's files with `ebook-meta`; formats it can't write are reported in `file_errors`.
+    """
+    temp_dir = tempfile.mkdtemp(prefix="shelfstone_server_metadata_")
+    try:
+        book = get_book_or_404(book_id, library_path=library_path)
+        updates = metadata_providers.select_updates(request.candidate.model_dump(), request.fields, book)
+        if not updates:
+            raise HTTPException(status_code=400, detail="The candidate has no values for the selected fields.")
+        logger.info(f"Applying metadata from '{request.candidate.provider}' to book ID {book_id}. Fields: {list(updates)}")
+
+        cover_url = updates.pop("cover", None)
+        cover_path = metadata_providers.download_cover(cover_url, temp_dir) if cover_url else None
+        identifiers = updates.pop("identifiers", None)
+        if updates:
+            set_book_metadata(book_id=book_id, metadata=SetMetadataRequest(**updates), library_path=library_path)
+        if identifiers:
+            crud.set_book_identifiers(book_id, identifiers, library_path=library_path)
+        if cover_path:
+            crud.set_book_cover(book_id, cover_path, library_path=library_path)
+
+        files_updated, file_errors = [], {}
+        if request.write_to_file:
+            options = metadata_providers.file_metadata_options(
+                {**updates, **({"identifiers": identifiers} if identifiers else {})}, cover_path)
+            for fmt, path in conversion_cache.book_formats(book).items():
+                try:
+                    calibre_cli.set_ebook_metadata(ebook_file_path=path, metadata_options=options)
+                    files_updated.append(fmt)
+                except (calibre_cli.CalibreCLIError, FileNotFoundError) as e:
+                    logger.warning(f"Could not write metadata into the {fmt} file of book ID {book_id}: {e}")
+                    file_errors[fmt] = e.args[0] if e.args else str(e)
+        fulltext.update_after_change([book_id], library_path=library_path)
+
+        applied = list(updates) + (["identifiers"] if identifiers else []) + (["cover"] if cover_path else [])
+        return MetadataApplyResponse(
+            message=f"Applied {len(applied)} field(s) from {request.candidate.provider} to book ID {book_id}.",
+            book_id=book_id, applied_fields=applied, files_updated=files_updated, file_errors=file_errors,
+        )
+    except HTTPException:
+        raise
+    except metadata_providers.ProviderError as e:
+        raise HTTPException(status_code=502, detail=f"Could not download the cover: {e}")
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError applying metadata to book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error applying metadata to book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    finally:
+        shutil.rmtree(temp_dir, ignore_errors=True)
+
+
+# --- Duplicates ---
+
+@app.get("/library/duplicates", response_model=DuplicatesResponse, tags=["Maintenance"])
+def library_duplicates_endpoint(
+    search: Optional[str] = Query(None, description="Only compare books matching this Calibre search."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    List groups of suspected duplicate books: books added from the same file (recorded content
+    hash), and books whose titles and authors match after normalization (case, accents,
+    punctuation, leading articles, subtitles, name order). Nothing is changed.
+    """
+    logger.info(f"Looking for duplicates. Search: '{search}'. Library: {library_path or 'default'}")
+    try:
+        books_data = list_books(library_path=library_path, search_query=search)
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError listing books for duplicate detection: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    groups = duplicate_detection.find_duplicates(books_data)
+    return DuplicatesResponse(checked=len(books_data), groups=[
+        DuplicateGroup(reason=g["reason"], key=g["key"], books=[book_from_calibredb(dict(b)) for b in g["books"]])
+        for g in groups
+    ])
+
+
+# --- Feature Flags ---
+
+@app.get("/admin/features", response_model=List[FeatureStatus], tags=["Admin"])
+def list_features_endpoint():
+    """
+    The feature flags and whether each feature is on. Features are switched per deployment with
+    SHELFSTONE_FEATURES, or at runtime with `PUT /admin/features/{name}`.
+    """
+    return [FeatureStatus(**s) for s in features.statuses()]
+
+
+@app.put("/admin/features/{name}", response_model=FeatureStatus, tags=["Admin"])
+def set_feature_endpoint(name: str, request: FeatureOverrideRequest):
+    """
+    Turn a feature on or off at runtime. The override is stored in the settings database
+    (SHELFSTONE_SETTINGS_DB), survives restarts and takes precedence over SHELFSTONE_FEATURES
+    until it is removed with `DELETE /admin/features/{name}`.
+    """
+    try:
+        return FeatureStatus(**features.set_override(name, request.enabled))
+    except features.UnknownFeature as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except sqlite3.Error as e:
+        logger.error(f"Could not store the override of feature '{name}': {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Could not write the settings database: {e}")
+
+
+@app.delete("/admin/features/{name}", response_model=FeatureStatus, tags=["Admin"])
+def clear_feature_endpoint(name: str):
+    """
+    Remove the runtime override of a feature, so SHELFSTONE_FEATURES or the default applies again.
+    """
+    try:
+        return FeatureStatus(**features.clear_override(name))
+    except features.UnknownFeature as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except sqlite3.Error as e:
+        logger.error(f"Could not remove the override of feature '{name}': {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Could not write the settings database: {e}")
+
+
+# --- Conversion Policy ---
+
+@app.get("/conversions", response_model=List[BookConversionStatus], tags=["Books"])
+def list_conversions_endpoint():
+    """
+    The most recent automatic conversions of added books (see SHELFSTONE_CONVERT_ON_ADD), newest
+    first, since the server started.
+    """
+    return [BookConversionStatus(**job) for job in conversion_policy.recent_jobs()]
+
+
+@app.get("/books/{book_id}/conversions", response_model=BookConversionStatus, tags=["Books"])
+def get_book_conversions_endpoint(book_id: int):
+    """
+    Status of the automatic conversion of a book to the formats in SHELFSTONE_CONVERT_ON_ADD,
+    queued when the book (or a new format of it) was added.
+    """
+    job = conversion_policy.get_job(book_id)
+    if job is None:
+        raise HTTPException(status_code=404, detail=f"No conversion of book ID {book_id} was queued since the server started.")
+    return BookConversionStatus(**job)
+
+
+# --- Jobs ---
+
+def visible_job(request: Request, job_id: int) -> dict:
+    """The running job, if the request may see it: admins see all, users those they started."""
+    user = auth.current_user(request)
+    try:
+        job = lifecycle.get_job(job_id)
+    except lifecycle.JobNotFound as e:
+        raise HTTPException(status_code=404, detail=e.args[0])
+    if not auth.is_admin(request) and (user is None or job["user_id"] != user["id"]):
+        raise HTTPException(status_code=404, detail=f"Job {job_id} not found; it may have finished.")
+    return job
+
+
+@app.get("/jobs", response_model=List[Job], tags=["Monitoring"])
+def list_jobs_endpoint(request: Request):
+    """
+    Running jobs, oldest first: conversions for downloads and on add, folder imports, deliveries
+    and full-text indexing. Calibre commands of interactive jobs get free slots before those of
+    bulk jobs; waiting bulk commands move up over time, so they still progress. Admins see all
+    jobs, users those they started.
+    """
+    user = auth.current_user(request)
+    if auth.is_admin(request):
+        return [Job(**job) for job in lifecycle.list_jobs()]
+    return [Job(**job) for job in lifecycle.list_jobs(user["id"])] if user else []
+
+
+@app.get("/jobs/{job_id}", response_model=Job, tags=["Monitoring"])
+def get_job_endpoint(request: Request, job_id: int):
+    """A running job; 404 once it has finished."""
+    return Job(**visible_job(request, job_id))
+
+
+@app.post("/jobs/{job_id}/cancel", response_model=Job, status_code=202, tags=["Monitoring"])
+def cancel_job_endpoint(request: Request, job_id: int):
+    """
+    Cancels a running job: the Calibre command it runs is killed, and it stops instead of running
+    further ones. Returns 202, since the job takes a moment to notice; it is gone from `GET /jobs`
+    once it has stopped.
+    """
+    visible_job(request, job_id)
+    try:
+        return Job(**lifecycle.cancel_job(job_id))
+    except lifecycle.JobNotFound as e:
+        raise HTTPException(status_code=404, detail=e.args[0])
+
+
+# --- Library Statistics ---
+
+@app.get("/stats", response_model=LibraryStatsResponse, tags=["Monitoring"])
+def library_stats_endpoint(
+    months: int = Query(stats.DEFAULT_MONTHS, ge=1, le=120, description="Number of months in added_per_month, ending with the current month."),
+    top_authors: int = Query(stats.DEFAULT_TOP_AUTHORS, ge=1, le=100, description="Number of authors in top_authors."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+):
+    """
+    Library statistics for dashboards: counts of books, authors, series, tags and formats, the size
+    of the book files, books added per month and the authors with the most books. Computed with
+    aggregate queries on metadata.db (read-only), so the library path must be known.
+    """
+    try:
+        path = library_db.resolve_library_path(library_path)
+        return LibraryStatsResponse(**stats.library_stats(path, months=months, top_authors=top_authors))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except sqlite3.Error as e:
+        logger.error(f"Database error computing library statistics: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error reading the library database: {e}")
+    except Exception as e:
+        logger.error(f"Unexpected error computing library statistics: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+# --- Collections ---
+
+def uses_whole_library(user: dict, library_path: Optional[str]) -> bool:
+    """Whether the user may use the library beyond its books: not restricted to other libraries or to some tags (see auth)."""
+    return user["tags"] is None and (user["libraries"] is None or library_key(library_path) in user["libraries"])
+
+
+def collection_viewer(request: Request) -> Optional[int]:
+    """The user whose view of the collections a request gets; None for admins, the admin token and without accounts, who see all."""
+    user = auth.current_user(request)
+    return user["id"] if user and user["role"] != accounts.ADMIN else None
+
+
+def collection_for(request: Request, collection_id: int, library_path: Optional[str] = None,
+                   needed: str = book_collections.READ) -> dict:
+    """
+    The collection, if the request may do what `needed` allows with it (see book_collections.access).
+    Shelves the user can't see are not found; 403 if they may only do less. Collections without an
+    owner are open to everyone, and admins may do everything.
+    """
+    collection = book_collections.get_collection(collection_id, library_path=library_path)
+    user_id = collection_viewer(request)
+    if user_id is None:
+        return collection
+    access = book_collections.access(collection, user_id)
+    if access is None:
+        raise book_collections.CollectionNotFound(f"Collection {collection_id} not found.")
+    collection["access"] = access
+    levels = book_collections.ACCESS_LEVELS
+    if collection.get("owner_id") is not None and levels.index(access) < levels.index(needed):
+        raise HTTPException(status_code=403, detail="Only the owner of this shelf may do this." if needed == book_collections.OWNER
+                            else "This shelf is shared with you read-only.")
+    return collection
+
+
+def notify_shelf_additions(request: Request, collection: dict, books: List[dict], library_path: Optional[str]) -> None:
+    """Tells the owner and the other users a shelf is shared with which books were just added to it."""
+    if not books:
+        return
+    adder = auth.current_user(request)
+    what = f"'{books[0].get('title')}'" if len(books) == 1 else f"{len(books)} books"
+    title = f"{adder['username'] if adder else 'An admin'} added {what} to '{collection['name']}'"
+    body = ", ".join(f"'{b.get('title')}'" for b in books) if len(books) > 1 else None
+    for user_id in book_collections.members(collection):
+        if adder is None or user_id != adder["id"]:
+            notifications.notify(user_id, notifications.SHELF_BOOKS_ADDED, title, body,
+                                 book_id=books[0]["id"] if len(books) == 1 else None, library_path=library_path)
+
+
+@app.get("/collections/", response_model=List[Collection], tags=["Collections"])
+def list_collections_endpoint(
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    List the library's collections (user-created groups of books such as "Currently Reading"), by
+    name: those without an owner, your shelves and the shelves shared with you. Admins see all.
+    """
+    return [Collection(**c) for c in book_collections.list_collections(library_path=library_path,
+                                                                        visible_to=collection_viewer(request))]
+
+
+@app.post("/collections/", response_model=Collection, status_code=201, tags=["Collections"])
+def create_collection_endpoint(
+    request: CollectionCreateRequest,
+    http_request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Create an empty collection. Collections made by a signed-in user are their shelves (see
+    `GET /me/shelves`), private until shared. Names are unique per user, or per library for
+    collections without one (case-insensitive).
+    """
+    logger.info(f"Creating collection '{request.name}'. Library: {library_path or 'default'}")
+    user = auth.current_user(http_request)
+    try:
+        return Collection(**book_collections.create_collection(request.name, request.description, library_path=library_path,
+                                                               owner_id=user["id"] if user else None))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except book_collections.CollectionExists as e:
+        raise HTTPException(status_code=409, detail=str(e))
+
+
+@app.get("/collections/{collection_id}", response_model=CollectionDetail, tags=["Collections"])
+def get_collection_endpoint(
+    collection_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The collection with the IDs of its books. GET /books/?collection={collection_id} returns the books themselves.
+    """
+    try:
+        return CollectionDetail(**collection_for(request, collection_id, library_path))
+    except book_collections.CollectionNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.patch("/collections/{collection_id}", response_model=Collection, tags=["Collections"])
+def update_collection_endpoint(
+    collection_id: int,
+    update: CollectionUpdateRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Rename the collection or change its description; fields left out are kept. Only the owner may change a shelf.
+    """
+    changes = update.model_dump(exclude_unset=True)
+    logger.info(f"Updating collection {collection_id}: {changes}. Library: {library_path or 'default'}")
+    try:
+        collection_for(request, collection_id, library_path, book_collections.OWNER)
+        return Collection(**book_collections.update_collection(collection_id, changes, library_path=library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except book_collections.CollectionNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except book_collections.CollectionExists as e:
+        raise HTTPException(status_code=409, detail=str(e))
+
+
+@app.delete("/collections/{collection_id}", status_code=204, tags=["Collections"])
+def delete_collection_endpoint(
+    collection_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Delete the collection. Its books stay in the library. Only the owner may delete a shelf.
+    """
+    logger.info(f"Deleting collection {collection_id}. Library: {library_path or 'default'}")
+    try:
+        collection_for(request, collection_id, library_path, book_collections.OWNER)
+        book_collections.delete_collection(collection_id, library_path=library_path)
+    except book_collections.CollectionNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.post("/collections/{collection_id}/books", response_model=Collection, tags=["Collections"])
+def add_collection_books_endpoint(
+    collection_id: int,
+    request: CollectionBooksRequest,
+    http_request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Add books to the collection. Books already in it are left as they are; books that are not in the library get 404.
+    On a shared shelf, the owner and collaborators may add books, and the others it is shared with are notified.
+    """
+    logger.info(f"Adding book(s) {request.book_ids} to collection {collection_id}. Library: {library_path or 'default'}")
+    try:
+        collection = collection_for(http_request, collection_id, library_path, book_collections.COLLABORATE)
+        wanted = set(request.book_ids)
+        if any(book_id <= 0 for book_id in wanted):
+            raise HTTPException(status_code=400, detail="Book IDs must be positive integers.")
+        found = {b.get("id"): b for b in list_books_by_ids(sorted(wanted), library_path=library_path)}
+        missing = sorted(wanted - set(found))
+        if missing:
+            raise HTTPException(status_code=404, detail=f"Book(s) not found: {', '.join(map(str, missing))}.")
+        updated = book_collections.add_books(collection_id, request.book_ids, library_path=library_path)
+        added = [found[book_id] for book_id in dict.fromkeys(request.book_ids) if book_id not in collection["book_ids"]]
+        notify_shelf_additions(http_request, collection, added, library_path)
+        return Collection(**updated, access=collection.get("access"))
+    except HTTPException:
+        raise
+    except book_collections.CollectionNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError adding books to collection {collection_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+
+
+@app.delete("/collections/{collection_id}/books/{book_id}", response_model=Collection, tags=["Collections"])
+def remove_collection_book_endpoint(
+    collection_id: int,
+    book_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Take a book out of the collection. The book stays in the library. On a shared shelf, the owner and collaborators may.
+    """
+    logger.info(f"Removing book ID {book_id} from collection {collection_id}. Library: {library_path or 'default'}")
+    try:
+        collection = collection_for(request, collection_id, library_path, book_collections.COLLABORATE)
+        return Collection(**book_collections.remove_books(collection_id, [book_id], library_path=library_path),
+                          access=collection.get("access"))
+    except book_collections.CollectionNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.get("/collections/{collection_id}/shares", response_model=List[CollectionShare], tags=["Collections"])
+def list_collection_shares_endpoint(
+    collection_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The users a shelf is shared with, and what they may do with it.
+    """
+    try:
+        collection_for(request, collection_id, library_path)
+    except book_collections.CollectionNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    usernames = {u["id"]: u["username"] for u in accounts.list_users()}
+    return [CollectionShare(**s, username=usernames.get(s["user_id"])) for s in book_collections.list_shares(collection_id)]
+
+
+@app.put("/collections/{collection_id}/shares/{user_id}", response_model=CollectionShare, tags=["Collections"])
+def share_collection_endpoint(
+    collection_id: int,
+    user_id: int,
+    share: CollectionShareRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Share your shelf with another user, read-only (`read`) or so they can add and remove books too
+    (`collaborate`), or change what they may do. Only the owner may share a shelf.
+    """
+    accounts_required()
+    try:
+        collection_for(request, collection_id, library_path, book_collections.OWNER)
+        user = accounts.get_user(user_id)
+        if not uses_whole_library(user, library_path):
+            raise HTTPException(status_code=400, detail=f"User '{user['username']}' can't use collections in this library.")
+        shared = book_collections.share(collection_id, user_id, share.access, library_path=library_path)
+    except HTTPException:
+        raise
+    except (book_collections.CollectionNotFound, accounts.UserNotFound) as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    logger.info(f"Shared collection {collection_id} with user {user_id} ({share.access}).")
+    return CollectionShare(**shared, username=user["username"])
+
+
+@app.delete("/collections/{collection_id}/shares/{user_id}", status_code=204, tags=["Collections"])
+def unshare_collection_endpoint(
+    collection_id: int,
+    user_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Stop sharing a shelf with a user. The owner may remove anyone; users may leave a shelf shared with them.
+    """
+    try:
+        collection_for(request, collection_id, library_path,
+                       book_collections.READ if user_id == collection_viewer(request) else book_collections.OWNER)
+        book_collections.unshare(collection_id, user_id, library_path=library_path)
+    except (book_collections.CollectionNotFound, book_collections.ShareNotFound) as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+def publishable_collection(request: Request, collection_id: int, library_path: Optional[str]) -> dict:
+    """The collection, if the request may publish it: only the owner may publish a shelf, and only admins a collection without one."""
+    collection = collection_for(request, collection_id, library_path, book_collections.OWNER)
+    if collection.get("owner_id") is None and not auth.is_admin(request):
+        raise HTTPException(status_code=403, detail="Only admins may publish collections without an owner.")
+    return collection
+
+
+def public_catalog(request: Request, collection_id: int, publication: dict) -> PublicCatalog:
+    url = f"{public_base_url(str(request.base_url))}/public/{publication['slug']}"
+    return PublicCatalog(**publication, collection_id=collection_id, url=url, opds_url=f"{url}/opds")
+
+
+@app.get("/collections/{collection_id}/public", response_model=PublicCatalog, tags=["Collections"])
+def get_collection_publication_endpoint(
+    collection_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Where the collection is published as a public catalog; 404 if it isn't.
+    """
+    try:
+        collection_for(request, collection_id, library_path)
+    except book_collections.CollectionNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    publication = book_collections.publication(collection_id)
+    if publication is None:
+        raise HTTPException(status_code=404, detail=f"Collection {collection_id} isn't published.")
+    return public_catalog(request, collection_id, publication)
+
+
+@app.put("/collections/{collection_id}/public", response_model=PublicCatalog, tags=["Collections"])
+def publish_collection_endpoint(
+    collection_id: int,
+    publication: PublicCatalogRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Publish the collection as a public catalog ("little free library"): anyone can browse its books
+    at /public/{slug}, or in a reading app at /public/{slug}/opds, without signing in, and download
+    them if `downloads` is on. Nothing else of the library is reachable from there. Also changes the
+    slug or downloads of a published one. Only the owner may publish a shelf, and only admins a
+    collection without one. Needs the `public_catalogs` feature.
+    """
+    logger.info(f"Publishing collection {collection_id} as '{publication.slug}' (downloads: {publication.downloads}). "
+                f"Library: {library_path or 'default'}")
+    try:
+        features.require("public_catalogs")
+        publishable_collection(request, collection_id, library_path)
+        published = book_collections.publish(collection_id, publication.slug, publication.downloads, library_path=library_path)
+    except features.FeatureDisabled as e:
+        raise HTTPException(status_code=403, detail=e.args[0])
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except book_collections.CollectionNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except book_collections.SlugTaken as e:
+        raise HTTPException(status_code=409, detail=str(e))
+    return public_catalog(request, collection_id, published)
+
+
+@app.delete("/collections/{collection_id}/public", status_code=204, tags=["Collections"])
+def unpublish_collection_endpoint(
+    collection_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Take the collection's public catalog down. The collection stays as it is.
+    """
+    logger.info(f"Unpublishing collection {collection_id}. Library: {library_path or 'default'}")
+    try:
+        publishable_collection(request, collection_id, library_path)
+        book_collections.unpublish(collection_id, library_path=library_path)
+    except (book_collections.CollectionNotFound, book_collections.NotPublished) as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.get("/books/{book_id}/collections", response_model=List[Collection], tags=["Collections"])
+def book_collections_endpoint(
+    book_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The collections the book is in that you can see, by name.
+    """
+    return [Collection(**c) for c in book_collections.collections_of_book(book_id, library_path=library_path,
+                                                                          visible_to=collection_viewer(request))]
+
+
+# --- Public Catalogs ---
+
+def published_shelf(request: Request, slug: str) -> dict:
+    """The collection published under the slug (see book_collections.published); 404 if there is none."""
+    try:
+        shelf = book_collections.published(slug)
+    except book_collections.NotPublished as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    # The public listener serves one library (see public_app.py).
+    if public_app.is_public_request(request) and shelf["library"] != library_key(os.environ.get("CALIBRE_LIBRARY_PATH")):
+        raise HTTPException(status_code=404, detail=f"No shelf is published as '{slug}'.")
+    return shelf
+
+
+def published_books(shelf: dict) -> List[dict]:
+    """The books on a published shelf, in order, with calibredb errors turned into HTTP errors."""
+    try:
+        return list_books_by_ids(shelf["book_ids"], library_path=shelf["library"] or None)
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError listing the books of published shelf {shelf['id']}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+
+
+def published_book(request: Request, slug: str, book_id: int) -> dict:
+    """The shelf published under the slug, if the book is on it; 404 otherwise, whether or not the library has it."""
+    shelf = published_shelf(request, slug)
+    if book_id not in shelf["book_ids"]:
+        raise HTTPException(status_code=404, detail=f"Book ID {book_id} is not in this catalog.")
+    return shelf
+
+
+@app.get("/public/{slug}", response_model=PublicCatalogPage, tags=["Public Catalogs"])
+def public_catalog_endpoint(slug: str, request: Request):
+    """
+    A published shelf, for everyone: its name, description and books, with links to their covers
+    and, if the catalog offers downloads, their files. Needs no account.
+    """
+    shelf = published_shelf(request, slug)
+    downloads = shelf["publication"]["downloads"]
+    url = f"{public_base_url(str(request.base_url))}/public/{shelf['publication']['slug']}"
+    books = [PublicCatalogBook(
+        id=book["id"], title=book.get("title") or "Untitled", authors=as_list(book.get("authors"), "authors"),
+        series=book.get("series"), series_index=book.get("series_index"),
+        cover_url=f"{url}/books/{book['id']}/cover" if book.get("cover") else None,
+        files={fmt.lower(): f"{url}/books/{book['id']}/file/{fmt.lower()}" for fmt in conversion_cache.book_formats(book)} if downloads else {},
+    ) for book in published_books(shelf)]
+    return PublicCatalogPage(slug=shelf["publication"]["slug"], title=shelf["name"], description=shelf.get("description"),
+                             downloads=downloads, opds_url=f"{url}/opds", books=books)
+
+
+@app.get("/public/{slug}/opds", tags=["Public Catalogs"])
+def public_catalog_opds_endpoint(
+    slug: str,
+    request: Request,
+    page: int = Query(1, ge=1, description="Page of the feed.")
+):
+    """
+    A published shelf as an OPDS acquisition feed, for reading apps that can't sign in. It only
+    links to the shelf's own books, covers and (if it offers downloads) files.
+    """
+    shelf = published_shelf(request, slug)
+    language = _opds_language(request)
+    return _opds_response(opds.public_feed(published_books(shelf), shelf["publication"]["slug"], shelf["name"],
+                                           public_base_url(str(request.base_url)), page,
+                                           _opds_page_size(request, preferences.effective(None)), language,
+                                           shelf["publication"]["downloads"]), language=language)
+
+
+@app.get("/public/{slug}/books/{book_id}/cover", tags=["Public Catalogs"])
+def public_catalog_cover_endpoint(
+    slug: str,
+    book_id: int,
+    request: Request,
+    size: Optional[str] = Query(None, description="small (120x180), medium (300x450) or large (600x900). The original cover if omitted.")
+):
+    """
+    The cover of a book on a published shelf, as GET /books/{book_id}/cover.
+    """
+    shelf = published_book(request, slug, book_id)
+    return book_cover_endpoint(book_id, size, library_path=shelf["library"] or None)
+
+
+@app.get("/public/{slug}/books/{book_id}/file/{format_extension}", tags=["Public Catalogs"])
+def public_catalog_file_endpoint(slug: str, book_id: int, format_extension: str, request: Request):
+    """
+    A book file from a published shelf, as GET /books/{book_id}/file/{format_extension}: only formats
+    the book has, never a conversion. 403 unless the catalog offers downloads.
+    """
+    shelf = published_book(request, slug, book_id)
+    if not shelf["publication"]["downloads"]:
+        raise HTTPException(status_code=403, detail="This catalog doesn't offer downloads.")
+    return get_book_file_endpoint(request, book_id, format_extension, library_path=shelf["library"] or None)
+
+
+# --- Activity Feed ---
+
+@app.get("/activity", response_model=List[ActivityEvent], tags=["Activity"])
+def activity_endpoint(
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used."),
+    before: Optional[float] = Query(None, description="Only events before this Unix time; pass the `at` of the last event for the next page."),
+    limit: int = Query(50, ge=1, le=activity.MAX_LIMIT, description="At most this many events.")
+):
+    """
+    What the library's users did lately, newest first: books added, reviews posted, shelves
+    created and books finished. Users who don't share their activity (`PATCH /me/privacy`) are
+    left out, except from their own feed, and so are the reading status, stars and reviews of those
+    who keep them private; shelves only show to those who may see them.
+    """
+    user = signed_in_user(request)
+    events = activity.feed(user["id"], library_path=library_path, before=before, limit=limit)
+    usernames = {u["id"]: u["username"] for u in accounts.list_users()}
+    book_ids = list(dict.fromkeys(e["book_id"] for e in events if e.get("book_id") is not None))
+    titles = {}
+    if book_ids:
+        try:
+            titles = {b["id"]: b.get("title") for b in list_books_by_ids(book_ids, library_path=library_path)}
+        except (CalibredbError, FileNotFoundError) as e:
+            logger.warning(f"Could not look up the titles of the activity feed: {e}")
+    return [ActivityEvent(**e, username=usernames.get(e["user_id"]), title=titles.get(e.get("book_id"))) for e in events]
+
+
+# --- Book Clubs ---
+
+def club_for(request: Request, club_id: int, library_path: Optional[str] = None, organizer: bool = False) -> Tuple[dict, dict]:
+    """
+    The signed-in user and the club, if they are a member (or an organizer, with `organizer`).
+    Clubs they aren't in are not found; admins may do everything.
+    """
+    user = signed_in_user(request)
+    try:
+        club = book_clubs.get_club(club_id, library_path=library_path, user_id=user["id"])
+    except book_clubs.ClubNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    if user["role"] == accounts.ADMIN:
+        return user, club
+    if club["role"] is None:
+        raise HTTPException(status_code=404, detail=f"Club {club_id} not found.")
+    if organizer and club["role"] != book_clubs.ORGANIZER:
+        raise HTTPException(status_code=403, detail="Only the club's organizers may do this.")
+    return user, club
+
+
+def club_comments(comment_list: List[dict], usernames: Optional[dict] = None) -> List[ClubComment]:
+    usernames = usernames if usernames is not None else {u["id"]: u["username"] for u in accounts.list_users()}
+    return [ClubComment(**{**c, "replies": club_comments(c.get("replies", []), usernames)},
+                        username=usernames.get(c["user_id"])) for c in comment_list]
+
+
+@app.get("/clubs/", response_model=List[Club], tags=["Book Clubs"])
+def list_clubs_endpoint(
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The book clubs you are in, by name. Admins get all of the library's clubs.
+    """
+    user = signed_in_user(request)
+    member_id = None if user["role"] == accounts.ADMIN else user["id"]
+    return [Club(**c) for c in book_clubs.list_clubs(library_path=library_path, member_id=member_id, user_id=user["id"])]
+
+
+@app.post("/clubs/", response_model=Club, status_code=201, tags=["Book Clubs"])
+def create_club_endpoint(
+    create: ClubCreateRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Start a book club. You are its first organizer; add the others with `PUT /clubs/{club_id}/members/{user_id}`.
+    """
+    user = signed_in_user(request)
+    try:
+        club = book_clubs.create_club(create.name, create.description, user["id"], library_path=library_path)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except book_clubs.ClubExists as e:
+        raise HTTPException(status_code=409, detail=str(e))
+    logger.info(f"User {user['id']} started book club {club['id']} '{club['name']}'.")
+    return Club(**club)
+
+
+@app.get("/clubs/{club_id}", response_model=ClubDetail, tags=["Book Clubs"])
+def get_club_endpoint(
+    club_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The club with its members and reading schedule: the books it reads, each with its milestones.
+    """
+    _, club = club_for(request, club_id, library_path)
+    usernames = {u["id"]: u["username"] for u in accounts.list_users()}
+    club_members = [ClubMember(**m, username=usernames.get(m["user_id"])) for m in book_clubs.members(club_id)]
+    return ClubDetail(**club, members=club_members, readings=[ClubReading(**r) for r in book_clubs.readings(club_id)])
+
+
+@app.patch("/clubs/{club_id}", response_model=Club, tags=["Book Clubs"])
+def update_club_endpoint(
+    club_id: int,
+    update: ClubUpdateRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Rename the club or change its description; fields left out are kept. Only organizers may.
+    """
+    user, _ = club_for(request, club_id, library_path, organizer=True)
+    try:
+        book_clubs.update_club(club_id, update.model_dump(exclude_unset=True), library_path=library_path)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except book_clubs.ClubExists as e:
+        raise HTTPException(status_code=409, detail=str(e))
+    return Club(**book_clubs.get_club(club_id, library_path=library_path, user_id=user["id"]))
+
+
+@app.delete("/clubs/{club_id}", status_code=204, tags=["Book Clubs"])
+def delete_club_endpoint(
+    club_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Delete the club with its schedule and discussions. Only organizers may.
+    """
+    club_for(request, club_id, library_path, organizer=True)
+    book_clubs.delete_club(club_id, library_path=library_path)
+    return Response(status_code=204)
+
+
+@app.put("/clubs/{club_id}/members/{user_id}", response_model=ClubMember, tags=["Book Clubs"])
+def set_club_member_endpoint(
+    club_id: int,
+    user_id: int,
+    membership: ClubMemberRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Add a user to the club, or change their role (`member` or `organizer`). Only organizers may.
+    """
+    club_for(request, club_id, library_path, organizer=True)
+    try:
+        user = accounts.get_user(user_id)
+        if not uses_whole_library(user, library_path):
+            raise HTTPException(status_code=400, detail=f"User '{user['username']}' can't use book clubs in this library.")
+        member = book_clubs.set_member(club_id, user_id, membership.role, library_path=library_path)
+    except HTTPException:
+        raise
+    except accounts.UserNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    return ClubMember(**member, username=user["username"])
+
+
+@app.delete("/clubs/{club_id}/members/{user_id}", status_code=204, tags=["Book Clubs"])
+def remove_club_member_endpoint(
+    club_id: int,
+    user_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Take a user out of the club; organizers may remove anyone, members may leave. When the last
+    organizer leaves, the longest member becomes one; a club without members is deleted.
+    """
+    user = signed_in_user(request)
+    club_for(request, club_id, library_path, organizer=user_id != user["id"])
+    try:
+        book_clubs.remove_member(club_id, user_id, library_path=library_path)
+    except (book_clubs.ClubNotFound, book_clubs.MemberNotFound) as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.post("/clubs/{club_id}/readings", response_model=ClubReading, status_code=201, tags=["Book Clubs"])
+def add_club_reading_endpoint(
+    club_id: int,
+    reading_request: ClubReadingRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Put a book on the club's schedule, with its milestones in reading order: what to read
+    (e.g. "Chapters 1-5") and, optionally, by when. Each milestone gets its own discussion.
+    Only organizers may.
+    """
+    club_for(request, club_id, library_path, organizer=True)
+    existing_book(reading_request.book_id, library_path)
+    try:
+        return ClubReading(**book_clubs.add_reading(
+            club_id, reading_request.book_id, reading_request.starts_on,
+            [m.model_dump() for m in reading_request.milestones], library_path=library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+
+@app.delete("/clubs/{club_id}/readings/{reading_id}", status_code=204, tags=["Book Clubs"])
+def delete_club_reading_endpoint(
+    club_id: int,
+    reading_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Take a book off the schedule, with its milestones and their discussions. Only organizers may.
+    """
+    club_for(request, club_id, library_path, organizer=True)
+    try:
+        book_clubs.delete_reading(club_id, reading_id)
+    except book_clubs.ReadingNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.post("/clubs/{club_id}/readings/{reading_id}/milestones", response_model=ClubMilestone, status_code=201, tags=["Book Clubs"])
+def add_club_milestone_endpoint(
+    club_id: int,
+    reading_id: int,
+    milestone: ClubMilestoneRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Add a milestone after the reading's others. Only organizers may.
+    """
+    club_for(request, club_id, library_path, organizer=True)
+    try:
+        return ClubMilestone(**book_clubs.add_milestone(club_id, reading_id, milestone.title, milestone.due_on))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except book_clubs.ReadingNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.patch("/clubs/{club_id}/milestones/{milestone_id}", response_model=ClubMilestone, tags=["Book Clubs"])
+def update_club_milestone_endpoint(
+    club_id: int,
+    milestone_id: int,
+    update: ClubMilestoneUpdateRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Change a milestone's title or due date; fields left out are kept. Only organizers may.
+    """
+    club_for(request, club_id, library_path, organizer=True)
+    try:
+        return ClubMilestone(**book_clubs.update_milestone(club_id, milestone_id, update.model_dump(exclude_unset=True)))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except book_clubs.ReadingNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.delete("/clubs/{club_id}/milestones/{milestone_id}", status_code=204, tags=["Book Clubs"])
+def delete_club_milestone_endpoint(
+    club_id: int,
+    milestone_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Delete a milestone with its discussion. Only organizers may.
+    """
+    club_for(request, club_id, library_path, organizer=True)
+    try:
+        book_clubs.delete_milestone(club_id, milestone_id)
+    except book_clubs.ReadingNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.get("/clubs/{club_id}/milestones/{milestone_id}/comments", response_model=List[ClubComment], tags=["Book Clubs"])
+def list_club_comments_endpoint(
+    club_id: int,
+    milestone_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The milestone's discussion as threads, oldest first, each comment with its replies.
+    """
+    club_for(request, club_id, library_path)
+    try:
+        return club_comments(book_clubs.comments(club_id, milestone_id))
+    except book_clubs.ReadingNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.post("/clubs/{club_id}/milestones/{milestone_id}/comments", response_model=ClubComment, status_code=201, tags=["Book Clubs"])
+def add_club_comment_endpoint(
+    club_id: int,
+    milestone_id: int,
+    comment: ClubCommentRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Comment on a milestone, or reply to a comment of it (`parent_id`).
+    """
+    user, _ = club_for(request, club_id, library_path)
+    try:
+        saved = book_clubs.add_comment(club_id, milestone_id, user["id"], comment.body, comment.parent_id)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except (book_clubs.ReadingNotFound, book_clubs.CommentNotFound) as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return ClubComment(**saved, username=user["username"])
+
+
+@app.patch("/clubs/{club_id}/comments/{comment_id}", response_model=ClubComment, tags=["Book Clubs"])
+def edit_club_comment_endpoint(
+    club_id: int,
+    comment_id: int,
+    update: ClubCommentUpdateRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Edit your comment.
+    """
+    user, _ = club_for(request, club_id, library_path)
+    try:
+        if book_clubs.get_comment(club_id, comment_id)["user_id"] != user["id"]:
+            raise HTTPException(status_code=403, detail="You can only edit your own comments.")
+        saved = book_clubs.edit_comment(club_id, comment_id, update.body)
+    except HTTPException:
+        raise
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except book_clubs.CommentNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return ClubComment(**saved, username=user["username"])
+
+
+@app.delete("/clubs/{club_id}/comments/{comment_id}", status_code=204, tags=["Book Clubs"])
+def delete_club_comment_endpoint(
+    club_id: int,
+    comment_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Delete a comment: your own, or any as an organizer of the club or an admin. A comment with
+    replies stays as an empty placeholder, so the thread stays readable.
+    """
+    user, club = club_for(request, club_id, library_path)
+    try:
+        author = book_clubs.get_comment(club_id, comment_id)["user_id"]
+        if author != user["id"] and club["role"] != book_clubs.ORGANIZER and user["role"] != accounts.ADMIN:
+            raise HTTPException(status_code=403, detail="Only the club's organizers may delete other members' comments.")
+        book_clubs.delete_comment(club_id, comment_id)
+    except HTTPException:
+        raise
+    except book_clubs.CommentNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+# --- Browse by Author and Series ---
+
+@app.get("/authors", response_model=List[AuthorEntry], tags=["Browse"])
+def list_authors_endpoint(
+    response: Response,
+    limit: Optional[int] = Query(None, ge=1, description="Maximum number of authors to return. All authors if not provided."),
+    offset: int = Query(0, ge=0, description="Number of authors to skip, for paging."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+):
+    """
+    Authors with at least one book, by sort name, with book counts. Spellings of the same name
+    ("Austen, Jane" and "Jane Austen") are merged into one entry. `X-Total-Count` carries the number of authors.
+    """
+    try:
+        authors = browse.list_authors(library_db.resolve_library_path(library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except Exception as e:
+        logger.error(f"Unexpected error listing authors: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    response.headers["X-Total-Count"] = str(len(authors))
+    page = authors[offset:offset + limit] if limit is not None else authors[offset:]
+    return [AuthorEntry(**a) for a in page]
+
+
+@app.get("/authors/{author_id}/books", response_model=AuthorBooksResponse, tags=["Browse"])
+def author_books_endpoint(
+    author_id: int,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+):
+    """
+    The author's books, including those filed under other spellings of the name: series books in
+    series order first, then the others by title.
+    """
+    try:
+        path = library_db.resolve_library_path(library_path)
+        author = browse.find_author(author_id, path)
+        if author is None:
+            raise HTTPException(status_code=404, detail=f"Author with ID {author_id} not found.")
+        books = sorted(list_books_by_ids(author.pop("book_ids"), library_path=path),
+                       key=lambda b: (not b.get("series"), (b.get("series") or "").casefold(), float(b.get("series_index") or 0),
+                                      (b.get("title") or "").casefold()))
+        return AuthorBooksResponse(author=AuthorEntry(**author), books=[book_from_calibredb(b) for b in books])
+    except HTTPException:
+        raise
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError listing books of author ID {author_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error listing books of author ID {author_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+@app.get("/series", response_model=List[SeriesEntry], tags=["Browse"])
+def list_series_endpoint(
+    response: Response,
+    limit: Optional[int] = Query(None, ge=1, description="Maximum number of series to return. All series if not provided."),
+    offset: int = Query(0, ge=0, description="Number of series to skip, for paging."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+):
+    """
+    Series with at least one book, by name, with book counts and authors. `X-Total-Count` carries the number of series.
+    """
+    try:
+        series = browse.list_series(library_db.resolve_library_path(library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except Exception as e:
+        logger.error(f"Unexpected error listing series: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+    response.headers["X-Total-Count"] = str(len(series))
+    page = series[offset:offset + limit] if limit is not None else series[offset:]
+    return [SeriesEntry(**s) for s in page]
+
+
+@app.get("/series/{series_id}/books", response_model=SeriesBooksResponse, tags=["Browse"])
+def series_books_endpoint(
+    series_id: int,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. Defaults to CALIBRE_LIBRARY_PATH.")
+):
+    """
+    The books of the series, sorted by series index.
+    """
+    try:
+        path = library_db.resolve_library_path(library_path)
+        series = browse.find_series(series_id, path)
+        if series is None:
+            raise HTTPException(status_code=404, detail=f"Series with ID {series_id} not found.")
+        books = [book_from_calibredb(b) for b in list_books_by_ids(series["book_ids"], library_path=path)]
+        return SeriesBooksResponse(id=series["id"], name=series["name"], books=books)
+    except HTTPException:
+        raise
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError listing books of series ID {series_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+    except Exception as e:
+        logger.error(f"Unexpected error listing books of series ID {series_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"An unexpected error occurred: {str(e)}")
+
+
+# --- Configuration Reload ---
+
+@app.post("/admin/config/reload", response_model=ConfigReloadResponse, tags=["Admin"])
+def reload_config_endpoint():
+    """
+    Re-read the config file, like sending SIGHUP to the server, and report which settings changed.
+    Environment variables keep precedence over the file. Running conversions are not interrupted.
+    """
+    try:
+        result = config.reload()
+    except config.ConfigError as e:
+        logger.error(f"Configuration not reloaded: {e}")
+        raise HTTPException(status_code=400, detail=f"{e} The current settings are kept.")
+    logger.warning(f"Configuration reloaded through the API. Changed: {', '.join(result['changed']) or 'nothing'}.")
+    return ConfigReloadResponse(**result)
+
+
+# --- Health Checks ---
+
+@app.get("/healthz", response_model=HealthResponse, tags=["Monitoring"])
+async def healthz_endpoint():
+    """Liveness probe: answers as long as the server is running and handling requests."""
+    return HealthResponse(status="ok")
+
+
+@app.get("/readyz", response_model=ReadinessResponse, tags=["Monitoring"],
+         responses={503: {"model": ReadinessResponse, "description": "Not ready."}})
+async def readyz_endpoint():
+    """
+    Readiness probe: checks that the required Calibre binaries are present and, when
+    CALIBRE_LIBRARY_PATH is set, that the library's metadata.db can be read. Returns 503 with the
+    failed checks if not, and while the server is shutting down.
+    """
+    checks = doctor.check_readiness()
+    if lifecycle.shutting_down():
+        checks.append({"check": "shutdown", "status": doctor.ERROR, "detail": "The server is shutting down.", "fix": None})
+    ready = all(c["status"] == doctor.OK for c in checks)
+    body = ReadinessResponse(ready=ready, checks=checks)
+    if not ready:
+        return JSONResponse(status_code=503, content=body.model_dump())
+    return body
+
+
+# --- Processing Log ---
+
+@app.get("/books/{book_id}/processing-log", response_model=ProcessingLogResponse, tags=["Books"])
+def book_processing_log_endpoint(
+    book_id: int,
+    limit: int = Query(processing_log.MAX_ENTRIES_PER_BOOK, ge=1, le=processing_log.MAX_ENTRIES_PER_BOOK, description="Maximum number of entries, newest first."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    What the server did to the book: adding it, conversions (on add, for downloads, for sending),
+    sending it to devices and metadata re-extraction, each with its duration, result and the end of
+    the output of the Calibre commands it ran. For finding out why a book got odd metadata or a
+    broken conversion. The last 100 steps per book are kept.
+    """
+    try:
+        return ProcessingLogResponse(book_id=book_id, entries=processing_log.entries(book_id, library_path=library_path, limit=limit))
+    except sqlite3.Error as e:
+        logger.error(f"Error reading the processing log of book ID {book_id}: {e}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error reading the processing log: {e}")
+
+
+# --- Accounts ---
+
+def accounts_required() -> None:
+    if not accounts.enabled():
+        raise HTTPException(status_code=403, detail="User accounts are off. Set SHELFSTONE_ACCOUNTS=1 to enable them.")
+
+
+def signed_in_user(request: Request) -> dict:
+    """The signed-in user of the request; 403 without accounts, 401 with the admin token, which is no user's."""
+    accounts_required()
+    user = auth.current_user(request)
+    if user is None:
+        raise HTTPException(status_code=401, detail="This needs a signed-in user; the admin token doesn't belong to one.")
+    return user
+
+
+def request_token(request: Request) -> Optional[str]:
+    """The session or API token the request was sent with."""
+    return auth.bearer_token(request.headers.get("authorization")) or request.cookies.get(auth.SESSION_COOKIE)
+
+
+@app.get("/auth/status", response_model=AuthStatus, tags=["Accounts"])
+def auth_status_endpoint(request: Request):
+    """
+    Whether accounts are on, whether the server still needs its first admin, and who is signed in.
+    Needs no credentials, so clients can decide whether to show a sign-in or first-run screen.
+    """
+    enabled = accounts.enabled()
+    user = auth.current_user(request)
+    return AuthStatus(accounts_enabled=enabled, setup_required=enabled and not accounts.has_users(),
+                      open_registration=enabled and accounts.open_registration(), user=User(**user) if user else None)
+
+
+@app.post("/auth/setup", response_model=User, status_code=201, tags=["Accounts"])
+def setup_endpoint(credentials: Credentials, request: Request):
+    """
+    Create the first account, as an admin. Only works while there are no accounts; when
+    SHELFSTONE_ADMIN_TOKEN is set, it needs the admin token as well, so nobody else can claim a new server.
+    """
+    accounts_required()
+    if auth.admin_token() and not auth.has_admin_token(request):
+        raise HTTPException(status_code=401, detail="Setting up needs the admin token (Authorization: Bearer <SHELFSTONE_ADMIN_TOKEN>).")
+    try:
+        user = accounts.setup_admin(credentials.username, credentials.password)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except accounts.RegistrationClosed as e:
+        raise HTTPException(status_code=409, detail=str(e))
+    logger.info(f"Created the first admin account '{user['username']}'.")
+    return User(**user)
+
+
+@app.post("/auth/register", response_model=User, status_code=201, tags=["Accounts"])
+def register_endpoint(registration: RegistrationRequest):
+    """
+    Create an account. With an `invitation` token, the account gets the invitation's role and
+    restrictions and the invitation is used up. Without one, a regular account, and only with
+    SHELFSTONE_OPEN_REGISTRATION=1; otherwise admins add users with `POST /admin/users`.
+    """
+    accounts_required()
+    try:
+        if registration.invitation:
+            user = accounts.register_with_invitation(registration.invitation, registration.username, registration.password)
+        else:
+            user = accounts.register(registration.username, registration.password)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except (accounts.RegistrationClosed, accounts.InvalidInvitation) as e:
+        raise HTTPException(status_code=403, detail=str(e))
+    except accounts.UserExists as e:
+        raise HTTPException(status_code=409, detail=str(e))
+    logger.info(f"User '{user['username']}' registered{' with an invitation' if registration.invitation else ''}.")
+    return User(**user)
+
+
+@app.get("/auth/invitations/{token}", response_model=InvitationCheck, tags=["Accounts"])
+def check_invitation_endpoint(token: str):
+    """
+    Whether an invitation can still be used, and for which role; what an invitation link opens.
+    Needs no credentials. Register with it with `POST /auth/register`.
+    """
+    accounts_required()
+    try:
+        invitation = accounts.check_invitation(token)
+    except accounts.InvalidInvitation as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return InvitationCheck(role=invitation["role"], expires_at=invitation["expires_at"])
+
+
+@app.post("/auth/login", response_model=LoginResponse, tags=["Accounts"])
+def login_endpoint(credentials: Credentials, request: Request, response: Response):
+    """
+    Sign in. Returns a session token and sets it as the `shelfstone_session` cookie (HttpOnly,
+    SameSite=Lax), which the web UI sends from then on. API clients can send the token as
+    `Authorization: Bearer <token>` instead. Sessions last 30 days.
+    """
+    accounts_required()
+    user = accounts.authenticate(credentials.username, credentials.password)
+    if user is None:
+        logger.info(f"Failed sign-in for '{credentials.username}' from {client_address(request)}.")
+        raise HTTPException(status_code=401, detail="Wrong username or password.")
+    session = accounts.create_session(user["id"])
+    response.set_cookie(auth.SESSION_COOKIE, session["token"], max_age=accounts.SESSION_DAYS * 86400,
+                        httponly=True, samesite="lax", secure=request.url.scheme == "https")
+    return LoginResponse(user=User(**user), token=session["token"], expires_at=session["expires_at"])
+
+
+@app.post("/auth/logout", status_code=204, tags=["Accounts"])
+def logout_endpoint(request: Request):
+    """End the session the request was sent with and clear the cookie."""
+    accounts_required()
+    token = request_token(request)
+    if token:
+        accounts.end_session(token)
+    response = Response(status_code=204)
+    response.delete_cookie(auth.SESSION_COOKIE)
+    return response
+
+
+@app.get("/auth/me", response_model=User, tags=["Accounts"])
+def me_endpoint(request: Request):
+    """The signed-in user."""
+    return User(**signed_in_user(request))
+
+
+@app.post("/auth/password", status_code=204, tags=["Accounts"])
+def change_password_endpoint(change: PasswordChangeRequest, request: Request):
+    """Change your password. Your other sessions end; API tokens keep working until you revoke them."""
+    user = signed_in_user(request)
+    try:
+        accounts.change_password(user["id"], change.current_password, change.new_password, keep_token=request_token(request))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.put("/auth/email", response_model=User, tags=["Accounts"])
+def change_email_endpoint(change: EmailChangeRequest, request: Request):
+    """
+    Set or remove your email address, where password reset links go. Needs your current password,
+    so a stolen session can't redirect resets.
+    """
+    user = signed_in_user(request)
+    try:
+        return User(**accounts.set_email(user["id"], change.email, change.current_password))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except accounts.UserExists as e:
+        raise HTTPException(status_code=409, detail=str(e))
+
+
+@app.post("/auth/password-reset", status_code=202, tags=["Accounts"])
+def request_password_reset_endpoint(reset: PasswordResetRequest, request: Request):
+    """
+    Forgot your password: mails a link for setting a new one, valid for an hour, to the account
+    with this email address. Needs no credentials. Answers 202 whether or not an account has the
+    address. Limited to a few requests per hour per client and per address.
+    """
+    accounts_required()
+    link_base = f"{public_base_url(str(request.base_url))}/auth/password-reset/"
+    try:
+        password_reset.request_reset(reset.email, client_address(request), link_base)
+    except delivery.SendingNotConfigured:
+        raise HTTPException(status_code=503, detail="Password resets need sending email; set SHELFSTONE_SMTP_HOST. Ask an admin to reset your password.")
+    except password_reset.RateLimited as e:
+        raise HTTPException(status_code=429, detail=str(e), headers={"Retry-After": str(e.retry_after)})
+    return Response(status_code=202)
+
+
+@app.get("/auth/password-reset/{token}", response_model=PasswordResetCheck, tags=["Accounts"])
+def check_password_reset_endpoint(token: str):
+    """
+    Whether a reset link still works; what the link in the email opens. Needs no credentials.
+    Set the new password with `POST /auth/password-reset/{token}`.
+    """
+    accounts_required()
+    try:
+        _, _, expires_at = password_reset.check_token(token)
+    except password_reset.InvalidResetToken as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return PasswordResetCheck(expires_at=expires_at)
+
+
+@app.post("/auth/password-reset/{token}", response_model=User, tags=["Accounts"])
+def complete_password_reset_endpoint(token: str, completion: PasswordResetCompletion, request: Request):
+    """
+    Set a new password with a reset link's token. The link works once; all of the account's
+    sessions end, API tokens keep working. Needs no credentials; sign in afterwards.
+    """
+    accounts_required()
+    try:
+        user = password_reset.complete_reset(token, completion.new_password, client_address(request))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except password_reset.InvalidResetToken as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except password_reset.RateLimited as e:
+        raise HTTPException(status_code=429, detail=str(e), headers={"Retry-After": str(e.retry_after)})
+    return User(**user)
+
+
+@app.get("/auth/tokens", response_model=List[ApiToken], tags=["Accounts"])
+def list_tokens_endpoint(request: Request):
+    """Your API tokens, without the tokens themselves."""
+    return [ApiToken(**t) for t in accounts.list_api_tokens(signed_in_user(request)["id"])]
+
+
+@app.post("/auth/tokens", response_model=NewApiToken, status_code=201, tags=["Accounts"])
+def create_token_endpoint(create: ApiTokenCreateRequest, request: Request):
+    """
+    Create an API token for a script or reading app. The response is the only time the token is
+    shown. Send it as `Authorization: Bearer <token>`, or as the password of HTTP Basic (e.g. in an
+    e-reader's OPDS settings). It works until it is revoked.
+    """
+    user = signed_in_user(request)
+    try:
+        return NewApiToken(**accounts.create_api_token(user["id"], create.name))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+
+@app.delete("/auth/tokens/{token_id}", status_code=204, tags=["Accounts"])
+def revoke_token_endpoint(token_id: int, request: Request):
+    """Revoke one of your API tokens."""
+    try:
+        accounts.revoke_api_token(signed_in_user(request)["id"], token_id)
+    except accounts.TokenNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.get("/admin/users", response_model=List[User], tags=["Admin"])
+def list_users_endpoint():
+    """All accounts, by username."""
+    accounts_required()
+    return [User(**u) for u in accounts.list_users()]
+
+
+@app.post("/admin/users", response_model=User, status_code=201, tags=["Admin"])
+def create_user_endpoint(create: UserCreateRequest):
+    """Add an account."""
+    accounts_required()
+    try:
+        user = accounts.create_user(create.username, create.password, role=create.role,
+                                    libraries=create.libraries, tags=create.tags, email=create.email)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except accounts.UserExists as e:
+        raise HTTPException(status_code=409, detail=str(e))
+    logger.info(f"Created the account '{user['username']}' ({user['role']}).")
+    return User(**user)
+
+
+@app.patch("/admin/users/{user_id}", response_model=User, tags=["Admin"])
+def update_user_endpoint(user_id: int, update: UserUpdateRequest):
+    """
+    Change a user's role, restrictions or email address, disable or re-enable the account, or set a
+    new password. Only the given fields change. Disabling an account or setting its password ends its sessions.
+    """
+    accounts_required()
+    try:
+        return User(**accounts.update_user(user_id, update.model_dump(exclude_unset=True)))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except accounts.UserNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except (accounts.UserExists, accounts.LastAdmin) as e:
+        raise HTTPException(status_code=409, detail=str(e))
+
+
+def delete_account(user_id: int, uploads: str, reassign_to: Optional[int] = None) -> None:
+    """
+    Deletes the account with everything kept about the user, and reassigns the books they added
+    to an admin (reassign_to, or the oldest enabled one) or removes them from the libraries
+    (into Calibre's trash), as `uploads` says. Raises what accounts.delete_user raises.
+    """
+    added = provenance.books_added_by(user_id)
+    accounts.delete_user(user_id)
+    reading.forget_user(user_id)
+    kosync.forget_user(user_id)
+    download_log.forget_user(user_id)
+    reactions.forget_reviews([r["id"] for r in ratings.export_user(user_id)])
+    ratings.forget_user(user_id)
+    wishlist.forget_user(user_id)
+    preferences.forget_user(user_id)
+    notifications.forget_user(user_id)
+    follows.forget_user(user_id)
+    book_collections.forget_user(user_id)
+    book_clubs.forget_user(user_id)
+    book_comments.forget_user(user_id)
+    reactions.forget_user(user_id)
+    privacy.forget_user(user_id)
+    if uploads == accounts.REASSIGN:
+        admins = accounts.enabled_admins()
+        reassign_to = reassign_to if reassign_to in admins else (admins[0] if admins else None)
+        provenance.reassign_user(user_id, reassign_to)
+        logger.info(f"Reassigned the {len(added)} book(s) added by user {user_id} to user {reassign_to}.")
+        return
+    for book in added:
+        library_path = book["library"] or None
+        try:
+            result = remove_book(book_id=book["book_id"], library_path=library_path, permanent=False)
+        except (CalibredbError, FileNotFoundError, ValueError) as e:
+            logger.error(f"Could not remove book ID {book['book_id']} added by deleted user {user_id}: {e}")
+            continue
+        if book["book_id"] in result.get("removed_ids", []):
+            forget_removed_book(book["book_id"], library_path)
+    logger.info(f"Removed the {len(added)} book(s) added by deleted user {user_id}.")
+
+
+def account_export(user: dict) -> JSONResponse:
+    """Everything the server keeps about the user, as a JSON download."""
+    user_id = user["id"]
+    reading_data = reading.export_user(user_id)
+    data = {
+        "exported_at": time.time(),
+        "profile": User(**user).model_dump(),
+        "api_tokens": accounts.list_api_tokens(user_id),
+        "preferences": preferences.get_preferences(user_id),
+        "privacy": privacy.get_settings(user_id),
+        "shelves": book_collections.export_user(user_id),
+        "progress": reading_data["progress"],
+        "bookmarks": reading_data["bookmarks"],
+        "kosync_positions": kosync.export_user(user_id),
+        "ratings": ratings.export_user(user_id),
+        "wishlist": wishlist.list_wishes(user_id),
+        "downloads": download_log.export_user(user_id),
+        "uploads": provenance.books_added_by(user_id),
+        "password_resets": password_reset.events(limit=password_reset.MAX_EVENTS, user_id=user_id),
+        "notifications": notifications.export_user(user_id),
+        "follows": follows.export_user(user_id),
+        "book_clubs": book_clubs.export_user(user_id),
+        "book_comments": book_comments.export_user(user_id),
+        "reactions": reactions.export_user(user_id),
+    }
+    filename = f"shelfstone-{safe_name(user['username'])}.json"
+    return JSONResponse(data, headers={"Content-Disposition": f'attachment; filename="{filename}"'})
+
+
+@app.delete("/admin/users/{user_id}", status_code=204, tags=["Admin"])
+def delete_user_endpoint(
+    user_id: int,
+    request: Request,
+    uploads: Optional[str] = Query(None, description="What happens to the books the user added: reassign (to an admin) or delete. Defaults to SHELFSTONE_DELETED_USER_UPLOADS."),
+    reassign_to: Optional[int] = Query(None, description="The admin to reassign them to; by default you, or the oldest enabled admin."),
+):
+    """
+    Delete an account with its sessions, API tokens, shelves, reading progress, bookmarks, KOReader
+    positions, download history, ratings, wishlist, preferences, notifications, follows, book club
+    memberships and comments, comments on books, reactions and privacy settings. The books the
+    user added are reassigned to an admin or removed (into Calibre's trash).
+    """
+    accounts_required()
+    if reassign_to is not None and reassign_to not in accounts.enabled_admins():
+        raise HTTPException(status_code=400, detail=f"User {reassign_to} is not an enabled admin.")
+    try:
+        uploads = accounts.parse_upload_handling(uploads or accounts.deleted_user_uploads())
+        delete_account(user_id, uploads, reassign_to or request_user_id(request))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except accounts.UserNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except accounts.LastAdmin as e:
+        raise HTTPException(status_code=409, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.get("/admin/users/{user_id}/export", tags=["Admin"])
+def export_user_endpoint(user_id: int):
+    """Everything the server keeps about a user, as `GET /me/export` gives it to them."""
+    accounts_required()
+    try:
+        return account_export(accounts.get_user(user_id))
+    except accounts.UserNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.post("/admin/invitations", response_model=NewInvitation, status_code=201, tags=["Admin"])
+def create_invitation_endpoint(create: InvitationCreateRequest, request: Request):
+    """
+    Invite someone: whoever registers with the returned token (`POST /auth/register`) gets an
+    account with the given role and restrictions. Each invitation works once, until it expires.
+    The token is only shown now; share the `link`.
+    """
+    accounts_required()
+    creator = auth.current_user(request)
+    try:
+        invitation = accounts.create_invitation(create.role, create.libraries, create.tags, create.note,
+                                                created_by=creator["id"] if creator else None, days=create.days)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    logger.info(f"Created invitation {invitation['id']} ({invitation['role']}).")
+    link = f"{public_base_url(str(request.base_url))}/auth/invitations/{invitation['token']}"
+    return NewInvitation(**invitation, link=link)
+
+
+@app.get("/admin/invitations", response_model=List[Invitation], tags=["Admin"])
+def list_invitations_endpoint():
+    """All invitations, newest first, with whether and by whom they were used."""
+    accounts_required()
+    return [Invitation(**i) for i in accounts.list_invitations()]
+
+
+@app.delete("/admin/invitations/{invitation_id}", status_code=204, tags=["Admin"])
+def revoke_invitation_endpoint(invitation_id: int):
+    """Revoke an invitation, so its token no longer works."""
+    accounts_required()
+    try:
+        accounts.revoke_invitation(invitation_id)
+    except accounts.InvitationNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.get("/admin/password-resets", response_model=List[PasswordResetEvent], tags=["Admin"])
+def password_reset_log_endpoint(
+    user_id: Optional[int] = Query(None, description="Only this user's events."),
+    limit: int = Query(100, ge=1, le=password_reset.MAX_EVENTS),
+):
+    """
+    The password reset audit log, newest first: requests (also for unknown addresses), rate
+    limited attempts, sent and failed emails, and completed and failed resets, with client addresses.
+    """
+    accounts_required()
+    return [PasswordResetEvent(**e) for e in password_reset.events(limit=limit, user_id=user_id)]
+
+
+# --- Reading Progress and Bookmarks ---
+
+def existing_book(book_id: int, library_path: Optional[str]) -> dict:
+    """get_book_or_404 with calibredb errors turned into HTTP errors."""
+    try:
+        return get_book_or_404(book_id, library_path=library_path)
+    except FileNotFoundError:
+        raise HTTPException(status_code=503, detail="calibredb command not found. Ensure Calibre is installed.")
+    except CalibredbError as e:
+        logger.error(f"CalibredbError looking up book ID {book_id}: {e.args[0]}. Stderr: {e.stderr}", exc_info=True)
+        raise HTTPException(status_code=500, detail=f"Error interacting with calibredb: {e.args[0]}")
+
+
+@app.get("/books/{book_id}/progress", response_model=ReadingProgress, tags=["Reading Progress"])
+def get_progress_endpoint(
+    book_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Where you are in the book, as last saved by any of your devices. 404 if you haven't started it.
+    """
+    user = signed_in_user(request)
+    progress = reading.get_progress(user["id"], book_id, library_path=library_path)
+    if progress is None:
+        raise HTTPException(status_code=404, detail=f"No reading progress for book ID {book_id}.")
+    return ReadingProgress(**progress)
+
+
+@app.put("/books/{book_id}/progress", response_model=ReadingProgress, tags=["Reading Progress"])
+def set_progress_endpoint(
+    book_id: int,
+    update: ReadingProgressUpdate,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Save where you are in the book. Replaces the previous progress, whichever device saved it; give
+    at least one of position, percentage and page.
+    """
+    user = signed_in_user(request)
+    existing_book(book_id, library_path)
+    try:
+        return ReadingProgress(**reading.set_progress(user["id"], book_id, update.model_dump(exclude_unset=True), library_path=library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+
+@app.delete("/books/{book_id}/progress", status_code=204, tags=["Reading Progress"])
+def clear_progress_endpoint(
+    book_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Forget your progress in the book. Bookmarks are kept."""
+    if not reading.clear_progress(signed_in_user(request)["id"], book_id, library_path=library_path):
+        raise HTTPException(status_code=404, detail=f"No reading progress for book ID {book_id}.")
+    return Response(status_code=204)
+
+
+@app.get("/books/{book_id}/bookmarks", response_model=List[Bookmark], tags=["Reading Progress"])
+def list_bookmarks_endpoint(
+    book_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Your bookmarks in the book, in reading order where the percentage is known."""
+    user = signed_in_user(request)
+    return [Bookmark(**b) for b in reading.list_bookmarks(user["id"], book_id, library_path=library_path)]
+
+
+@app.post("/books/{book_id}/bookmarks", response_model=Bookmark, status_code=201, tags=["Reading Progress"])
+def add_bookmark_endpoint(
+    book_id: int,
+    create: BookmarkCreateRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Bookmark a position in the book, optionally with a note."""
+    user = signed_in_user(request)
+    existing_book(book_id, library_path)
+    try:
+        return Bookmark(**reading.add_bookmark(user["id"], book_id, create.model_dump(exclude_unset=True), library_path=library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+
+@app.patch("/books/{book_id}/bookmarks/{bookmark_id}", response_model=Bookmark, tags=["Reading Progress"])
+def update_bookmark_endpoint(
+    book_id: int,
+    bookmark_id: int,
+    update: BookmarkUpdateRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Change a bookmark's note or position; fields left out are kept."""
+    user = signed_in_user(request)
+    try:
+        return Bookmark(**reading.update_bookmark(user["id"], book_id, bookmark_id, update.model_dump(exclude_unset=True),
+                                                  library_path=library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except reading.BookmarkNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.delete("/books/{book_id}/bookmarks/{bookmark_id}", status_code=204, tags=["Reading Progress"])
+def delete_bookmark_endpoint(
+    book_id: int,
+    bookmark_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Delete one of your bookmarks."""
+    try:
+        reading.delete_bookmark(signed_in_user(request)["id"], book_id, bookmark_id, library_path=library_path)
+    except reading.BookmarkNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+# --- KOReader Sync ---
+
+def kosync_error(error) -> JSONResponse:
+    code, status, message = error
+    return JSONResponse(status_code=status, content={"code": code, "message": message})
+
+
+def kosync_user(request: Request) -> Optional[dict]:
+    """The user KOReader's x-auth-user and x-auth-key headers (an API token's MD5) identify, or None."""
+    if not accounts.enabled():
+        return None
+    return accounts.user_for_kosync_key(request.headers.get("x-auth-user", ""), request.headers.get("x-auth-key", ""))
+
+
+@app.post("/users/create", status_code=201, tags=["KOReader Sync"])
+def kosync_register_endpoint(payload: dict = Body(...)):
+    """
+    KOReader's "Register" button. Accounts are created in Shelfstone instead, so this always
+    fails; sign in from KOReader with your username and an API token as the password.
+    """
+    username = str(payload.get("username") or "").strip()
+    if accounts.enabled() and any(u["username"].casefold() == username.casefold() for u in accounts.list_users()):
+        return kosync_error(kosync.USER_EXISTS)
+    return kosync_error(kosync.REGISTRATION_DISABLED)
+
+
+@app.get("/users/auth", tags=["KOReader Sync"])
+def kosync_auth_endpoint(request: Request):
+    """KOReader's "Login": checks the username and API token."""
+    if kosync_user(request) is None:
+        return kosync_error(kosync.UNAUTHORIZED)
+    return {"authorized": "OK"}
+
+
+@app.put("/syncs/progress", tags=["KOReader Sync"])
+def kosync_push_progress_endpoint(request: Request, payload: dict = Body(...)):
+    """
+    Save KOReader's position in a document. When the document is a file downloaded from the
+    library, the position is saved as your reading progress of the book as well.
+    """
+    user = kosync_user(request)
+    if user is None:
+        return kosync_error(kosync.UNAUTHORIZED)
+    try:
+        position = kosync.save_position(user["id"], payload)
+    except kosync.InvalidPosition as e:
+        return kosync_error(e.error)
+    book = kosync.book_for_document(position["document"])
+    if book is not None:
+        try:
+            reading.set_progress(user["id"], book["book_id"], {
+                "position": position["progress"], "percentage": round(position["percentage"] * 100, 2),
+                "format": book["format"], "device": (position["device"] or "KOReader")[:reading.MAX_FIELD_LENGTH],
+            }, library_path=book["library_path"])
+        except ValueError as e:
+            logger.warning(f"KOReader position of book ID {book['book_id']} not saved as reading progress: {e}")
+    return {"document": position["document"], "timestamp": position["timestamp"]}
+
+
+@app.get("/syncs/progress/{document}", tags=["KOReader Sync"])
+def kosync_pull_progress_endpoint(document: str, request: Request):
+    """KOReader's last synced position in the document, from any of your devices; {} if there is none."""
+    user = kosync_user(request)
+    if user is None:
+        return kosync_error(kosync.UNAUTHORIZED)
+    return kosync.get_position(user["id"], document) or {}
+
+
+# --- Download Log ---
+
+@app.get("/me/downloads", response_model=DownloadHistory, tags=["Download Log"])
+def my_downloads_endpoint(
+    request: Request,
+    limit: int = Query(50, ge=1, le=500, description="Number of downloads to return."),
+    offset: int = Query(0, ge=0, description="Number of downloads to skip.")
+):
+    """Your downloads in all libraries, newest first, with the client each was made with."""
+    user = signed_in_user(request)
+    return DownloadHistory(**download_log.user_downloads(user["id"], limit=limit, offset=offset))
+
+
+@app.get("/admin/downloads/report", response_model=DownloadReport, tags=["Admin"])
+def download_report_endpoint(
+    since: Optional[float] = Query(None, description="Only downloads at or after this Unix time."),
+    until: Optional[float] = Query(None, description="Only downloads before this Unix time."),
+    top: int = Query(10, ge=1, le=100, description="Number of most downloaded books to list."),
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Download totals of the library: overall, per user, per client (KOReader, Kobo, browser, ...)
+    and per format, and the most downloaded books. Downloads are kept for a year.
+    """
+    return DownloadReport(**download_log.report(since=since, until=until, library_path=library_path, top=top))
+
+
+# --- My Library ---
+
+@app.get("/me/shelves", response_model=List[Collection], tags=["My Library"])
+def my_shelves_endpoint(
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Your shelves in the library and the shelves shared with you, by name."""
+    user = signed_in_user(request)
+    return [Collection(**c) for c in book_collections.list_collections(library_path=library_path, visible_to=user["id"])
+            if c["owner_id"] is not None]
+
+
+@app.get("/me/progress", response_model=List[ReadingProgress], tags=["My Library"])
+def my_progress_endpoint(
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Your reading progress in all books of the library, most recently read first."""
+    user = signed_in_user(request)
+    return [ReadingProgress(**p) for p in reading.list_progress(user["id"], library_path=library_path)]
+
+
+def with_usernames(rating_list: List[dict]) -> List[Rating]:
+    usernames = {u["id"]: u["username"] for u in accounts.list_users()}
+    counts = reactions.review_counts([r["id"] for r in rating_list])
+    return [Rating(**r, username=usernames.get(r["user_id"]), reactions=counts.get(r["id"])) for r in rating_list]
+
+
+@app.get("/me/ratings", response_model=List[Rating], tags=["My Library"])
+def my_ratings_endpoint(
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Your ratings and reviews in the library, most recently changed first."""
+    user = signed_in_user(request)
+    user_ratings = ratings.user_ratings(user["id"], library_path=library_path)
+    counts = reactions.review_counts([r["id"] for r in user_ratings])
+    return [Rating(**r, username=user["username"], reactions=counts.get(r["id"])) for r in user_ratings]
+
+
+def visible_ratings(book_id: int, viewer_id: int, library_path: Optional[str] = None) -> List[dict]:
+    """
+    The book's ratings as the user may see them (see privacy.py): without the stars or review
+    text of those who keep them private, and without ratings left with neither.
+    """
+    hidden_ratings = privacy.hidden_from(viewer_id, privacy.RATINGS)
+    hidden_reviews = privacy.hidden_from(viewer_id, privacy.REVIEWS)
+    visible = []
+    for r in ratings.book_ratings(book_id, library_path=library_path):
+        r = {**r, "rating": None if r["user_id"] in hidden_ratings else r["rating"],
+             "review": None if r["user_id"] in hidden_reviews else r["review"]}
+        if r["rating"] is not None or r["review"] is not None:
+            visible.append(r)
+    return visible
+
+
+@app.get("/books/{book_id}/ratings", response_model=BookRatings, tags=["My Library"])
+def book_ratings_endpoint(
+    book_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Everyone's ratings and reviews of the book, with their average. These are the users' own
+    ratings, separate from the book's rating in Calibre. Stars and reviews that users keep private
+    (`PATCH /me/privacy`) are left out, also from the count and average.
+    """
+    user = signed_in_user(request)
+    book_ratings = with_usernames(visible_ratings(book_id, user["id"], library_path))
+    stars = [r.rating for r in book_ratings if r.rating is not None]
+    average = round(sum(stars) / len(stars), 2) if stars else None
+    return BookRatings(book_id=book_id, count=len(stars), average=average, ratings=book_ratings)
+
+
+@app.get("/books/{book_id}/readers", response_model=BookReaders, tags=["My Library"])
+def book_readers_endpoint(
+    book_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Who is reading the book and who finished it, from their reading progress. Users who keep their
+    reading status private (`PATCH /me/privacy`) are left out, also from the counts.
+    """
+    user = signed_in_user(request)
+    existing_book(book_id, library_path)
+    hidden = privacy.hidden_from(user["id"], privacy.READING_STATUS)
+    usernames = {u["id"]: u["username"] for u in accounts.list_users()}
+    readers = [BookReader(**r, username=usernames.get(r["user_id"]))
+               for r in reading.book_readers(book_id, library_path=library_path) if r["user_id"] not in hidden]
+    finished = sum(1 for r in readers if r.finished_at is not None)
+    return BookReaders(book_id=book_id, reading=len(readers) - finished, finished=finished, readers=readers)
+
+
+@app.put("/books/{book_id}/rating", response_model=Rating, tags=["My Library"])
+def rate_book_endpoint(
+    book_id: int,
+    rating: RatingRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Rate the book from 1 to 5 stars, optionally with a review. Replaces your previous rating."""
+    user = signed_in_user(request)
+    existing_book(book_id, library_path)
+    try:
+        saved = ratings.set_rating(user["id"], book_id, rating.rating, rating.review, library_path=library_path)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    return Rating(**saved, username=user["username"], reactions=reactions.review_counts([saved["id"]]).get(saved["id"]))
+
+
+@app.delete("/books/{book_id}/rating", status_code=204, tags=["My Library"])
+def clear_book_rating_endpoint(
+    book_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Remove your rating and review of the book, with the reactions to it."""
+    user_id = signed_in_user(request)["id"]
+    rating = ratings.get_rating(user_id, book_id, library_path=library_path)
+    if rating is None or not ratings.clear_rating(user_id, book_id, library_path=library_path):
+        raise HTTPException(status_code=404, detail=f"You haven't rated book ID {book_id}.")
+    reactions.forget_reviews([rating["id"]])
+    return Response(status_code=204)
+
+
+# --- Reactions ---
+
+def reaction_target(request: Request, book_id: int, rating_id: Optional[int], library_path: Optional[str]) -> dict:
+    """The signed-in user, once the book (or its review rating_id) exists."""
+    user = signed_in_user(request)
+    existing_book(book_id, library_path)
+    if rating_id is not None and not any(r["id"] == rating_id for r in visible_ratings(book_id, user["id"], library_path)):
+        raise HTTPException(status_code=404, detail=f"Review {rating_id} not found on book ID {book_id}.")
+    return user
+
+
+def change_reaction(request: Request, book_id: int, reaction: str, rating_id: Optional[int],
+                    library_path: Optional[str], give: bool) -> Reactions:
+    user = reaction_target(request, book_id, rating_id, library_path)
+    try:
+        emoji = reactions.parse(reaction)
+        change = reactions.react if give else reactions.unreact
+        return Reactions(**change(user["id"], book_id, emoji, rating_id=rating_id, library_path=library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except reactions.ReactionNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.get("/books/{book_id}/reactions", response_model=Reactions, tags=["My Library"])
+def book_reactions_endpoint(
+    book_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """The users' reactions to the book, and yours."""
+    user = reaction_target(request, book_id, None, library_path)
+    return Reactions(**reactions.summary(book_id, library_path=library_path, user_id=user["id"]))
+
+
+@app.put("/books/{book_id}/reactions/{reaction}", response_model=Reactions, tags=["My Library"])
+def react_to_book_endpoint(
+    book_id: int,
+    reaction: str,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """React to the book with thumbs_up (👍), heart (❤️) or sleepy (😴); the emoji themselves work too."""
+    return change_reaction(request, book_id, reaction, None, library_path, give=True)
+
+
+@app.delete("/books/{book_id}/reactions/{reaction}", response_model=Reactions, tags=["My Library"])
+def unreact_to_book_endpoint(
+    book_id: int,
+    reaction: str,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Take back your reaction to the book."""
+    return change_reaction(request, book_id, reaction, None, library_path, give=False)
+
+
+@app.get("/books/{book_id}/ratings/{rating_id}/reactions", response_model=Reactions, tags=["My Library"])
+def review_reactions_endpoint(
+    book_id: int,
+    rating_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """The users' reactions to a review of the book (see `GET /books/{book_id}/ratings`), and yours."""
+    user = reaction_target(request, book_id, rating_id, library_path)
+    return Reactions(**reactions.summary(book_id, rating_id, library_path=library_path, user_id=user["id"]))
+
+
+@app.put("/books/{book_id}/ratings/{rating_id}/reactions/{reaction}", response_model=Reactions, tags=["My Library"])
+def react_to_review_endpoint(
+    book_id: int,
+    rating_id: int,
+    reaction: str,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """React to a review of the book, as to the book itself."""
+    return change_reaction(request, book_id, reaction, rating_id, library_path, give=True)
+
+
+@app.delete("/books/{book_id}/ratings/{rating_id}/reactions/{reaction}", response_model=Reactions, tags=["My Library"])
+def unreact_to_review_endpoint(
+    book_id: int,
+    rating_id: int,
+    reaction: str,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """Take back your reaction to a review of the book."""
+    return change_reaction(request, book_id, reaction, rating_id, library_path, give=False)
+
+
+def comment_models(comment_list: List[dict], usernames: Optional[dict] = None) -> List[BookComment]:
+    usernames = usernames if usernames is not None else {u["id"]: u["username"] for u in accounts.list_users()}
+    return [BookComment(**{**c, "mentions": [CommentMention(user_id=m, username=usernames.get(m)) for m in c["mentions"]],
+                           "replies": comment_models(c.get("replies", []), usernames)},
+                        username=usernames.get(c["user_id"])) for c in comment_list]
+
+
+def notify_mentions(author: dict, book: dict, comment: dict, library_path: Optional[str], already: List[int] = ()) -> None:
+    """Tells the users a comment mentions, except those `already` told and those who can't see the book."""
+    for user_id in comment["mentions"]:
+        if user_id == author["id"] or user_id in already:
+            continue
+        try:
+            user = accounts.get_user(user_id)
+        except accounts.UserNotFound:
+            continue
+        if user["disabled"] or not follows.can_see(user, book, library_path):
+            continue
+        notifications.notify(user_id, notifications.MENTIONED, f"{author['username']} mentioned you on '{book.get('title')}'",
+                             comment["body"], book_id=book["id"], library_path=library_path)
+
+
+@app.get("/books/{book_id}/comments", response_model=BookComments, tags=["Comments"])
+def list_book_comments_endpoint(
+    book_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    The book's comment thread: informal discussion among the library's users, separate from
+    ratings and reviews. Threads are oldest first, each comment with its replies.
+    """
+    accounts_required()
+    existing_book(book_id, library_path)
+    threads = comment_models(book_comments.comments(book_id, library_path=library_path))
+    return BookComments(book_id=book_id, count=book_comments.comment_count(book_id, library_path=library_path), comments=threads)
+
+
+@app.post("/books/{book_id}/comments", response_model=BookComment, status_code=201, tags=["Comments"])
+def add_book_comment_endpoint(
+    book_id: int,
+    comment: BookCommentRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Comment on the book, or reply to one of its comments (`parent_id`). Users mentioned as
+    @username get a notification, if they can see the book.
+    """
+    user = signed_in_user(request)
+    book = existing_book(book_id, library_path)
+    try:
+        saved = book_comments.add_comment(book_id, user["id"], comment.body, comment.parent_id, library_path=library_path)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except book_comments.CommentNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    notify_mentions(user, book, saved, library_path)
+    return comment_models([saved])[0]
+
+
+@app.patch("/books/{book_id}/comments/{comment_id}", response_model=BookComment, tags=["Comments"])
+def edit_book_comment_endpoint(
+    book_id: int,
+    comment_id: int,
+    update: BookCommentUpdateRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Edit your comment. Users it newly mentions get a notification.
+    """
+    user = signed_in_user(request)
+    book = existing_book(book_id, library_path)
+    try:
+        previous = book_comments.get_comment(book_id, comment_id, library_path=library_path)
+        if previous["user_id"] != user["id"]:
+            raise HTTPException(status_code=403, detail="You can only edit your own comments.")
+        saved = book_comments.edit_comment(book_id, comment_id, update.body, library_path=library_path)
+    except HTTPException:
+        raise
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except book_comments.CommentNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    notify_mentions(user, book, saved, library_path, already=previous["mentions"])
+    return comment_models([saved])[0]
+
+
+@app.delete("/books/{book_id}/comments/{comment_id}", status_code=204, tags=["Comments"])
+def delete_book_comment_endpoint(
+    book_id: int,
+    comment_id: int,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Path to the Calibre library. If not provided, calibredb's default will be used.")
+):
+    """
+    Delete your comment; admins may delete anyone's. A comment with replies stays as an empty
+    placeholder, so the thread stays readable.
+    """
+    accounts_required()
+    user = auth.current_user(request)
+    try:
+        author = book_comments.get_comment(book_id, comment_id, library_path=library_path)["user_id"]
+        if not auth.is_admin(request) and (user is None or author != user["id"]):
+            raise HTTPException(status_code=403, detail="Only admins may delete other users' comments.")
+        book_comments.delete_comment(book_id, comment_id, library_path=library_path)
+    except HTTPException:
+        raise
+    except book_comments.CommentNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    if user is None or author != user["id"]:
+        logger.info(f"Comment {comment_id} on book ID {book_id} by user {author} deleted by {user['username'] if user else 'the admin token'}.")
+    return Response(status_code=204)
+
+
+@app.get("/me/wishlist", response_model=List[Wish], tags=["My Library"])
+def my_wishlist_endpoint(request: Request):
+    """Your wishlist, newest first."""
+    return [Wish(**w) for w in wishlist.list_wishes(signed_in_user(request)["id"])]
+
+
+@app.post("/me/wishlist", response_model=Wish, status_code=201, tags=["My Library"])
+def add_wish_endpoint(
+    create: WishCreateRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Library of `book_id`. If not provided, calibredb's default will be used.")
+):
+    """Put a book on your wishlist, whether or not the library has it (then give its `book_id`)."""
+    user = signed_in_user(request)
+    if create.book_id is not None:
+        existing_book(create.book_id, library_path)
+    try:
+        return Wish(**wishlist.add_wish(user["id"], create.model_dump(exclude_unset=True), library_path=library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+
+@app.patch("/me/wishlist/{wish_id}", response_model=Wish, tags=["My Library"])
+def update_wish_endpoint(
+    wish_id: int,
+    update: WishUpdateRequest,
+    request: Request,
+    library_path: Optional[str] = Query(None, description="Library of `book_id`. If not provided, calibredb's default will be used.")
+):
+    """Change a wishlist entry, e.g. link it to the book once the library has it; fields left out are kept."""
+    user = signed_in_user(request)
+    if update.book_id is not None:
+        existing_book(update.book_id, library_path)
+    try:
+        return Wish(**wishlist.update_wish(user["id"], wish_id, update.model_dump(exclude_unset=True), library_path=library_path))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except wishlist.WishNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.delete("/me/wishlist/{wish_id}", status_code=204, tags=["My Library"])
+def delete_wish_endpoint(wish_id: int, request: Request):
+    """Take an entry off your wishlist."""
+    try:
+        wishlist.delete_wish(signed_in_user(request)["id"], wish_id)
+    except wishlist.WishNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.get("/me/export", tags=["My Library"])
+def export_me_endpoint(request: Request):
+    """
+    Download everything the server keeps about you, as JSON: your profile, API tokens (without
+    the tokens), preferences, shelves, reading progress, bookmarks, KOReader positions, ratings and
+    reviews, wishlist, download history, the books you added, password reset requests, notifications,
+    follows, your book clubs and comments in them, your comments on books, your reactions and
+    your privacy settings.
+    """
+    return account_export(signed_in_user(request))
+
+
+@app.post("/me/delete", status_code=204, tags=["My Library"])
+def delete_me_endpoint(deletion: AccountDeletionRequest, request: Request):
+    """
+    Delete your account and everything kept about you, as `DELETE /admin/users/{id}` does. Needs
+    your password. The books you added are reassigned to an admin or removed, as the server is
+    configured (SHELFSTONE_DELETED_USER_UPLOADS). The only enabled admin can't delete themselves.
+    """
+    user = signed_in_user(request)
+    if accounts.authenticate(user["username"], deletion.current_password) is None:
+        raise HTTPException(status_code=400, detail="The current password is wrong.")
+    try:
+        delete_account(user["id"], accounts.deleted_user_uploads())
+    except accounts.LastAdmin as e:
+        raise HTTPException(status_code=409, detail=str(e))
+    logger.info(f"User '{user['username']}' deleted their account.")
+    response = Response(status_code=204)
+    response.delete_cookie(auth.SESSION_COOKIE)
+    return response
+
+
+@app.get("/me/notifications", response_model=NotificationList, tags=["My Library"])
+def my_notifications_endpoint(
+    request: Request,
+    unread: bool = Query(False, description="Only unread notifications."),
+    limit: int = Query(50, ge=1, le=notifications.MAX_PER_USER),
+    offset: int = Query(0, ge=0)
+):
+    """
+    Your notifications, newest first: new books by authors you follow, finished conversions and
+    deliveries, failed uploads and books added to shelves you share. Only your newest 500 are kept.
+    """
+    user = signed_in_user(request)
+    return NotificationList(**notifications.list_notifications(user["id"], unread_only=unread, limit=limit, offset=offset))
+
+
+@app.get("/me/notifications/unread-count", response_model=NotificationCount, tags=["My Library"])
+def my_unread_count_endpoint(request: Request):
+    """How many of your notifications are unread, for a badge."""
+    return NotificationCount(unread=notifications.unread_count(signed_in_user(request)["id"]))
+
+
+@app.post("/me/notifications/read", response_model=NotificationCount, tags=["My Library"])
+def mark_notifications_read_endpoint(mark: NotificationsReadRequest, request: Request):
+    """Mark the given notifications, or all of them without `ids`, as read. Returns the unread count left."""
+    user = signed_in_user(request)
+    notifications.mark_read(user["id"], mark.ids)
+    return NotificationCount(unread=notifications.unread_count(user["id"]))
+
+
+@app.patch("/me/notifications/{notification_id}", response_model=Notification, tags=["My Library"])
+def update_notification_endpoint(notification_id: int, update: NotificationUpdateRequest, request: Request):
+    """Mark a notification as read, or as unread again."""
+    try:
+        return Notification(**notifications.set_read(signed_in_user(request)["id"], notification_id, update.read))
+    except notifications.NotificationNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.delete("/me/notifications/{notification_id}", status_code=204, tags=["My Library"])
+def delete_notification_endpoint(notification_id: int, request: Request):
+    """Remove a notification from your inbox."""
+    try:
+        notifications.delete_notification(signed_in_user(request)["id"], notification_id)
+    except notifications.NotificationNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.get("/me/follows", response_model=List[Follow], tags=["My Library"])
+def my_follows_endpoint(request: Request):
+    """The authors and series you follow."""
+    return [Follow(**f) for f in follows.list_follows(signed_in_user(request)["id"])]
+
+
+@app.post("/me/follows", response_model=Follow, status_code=201, tags=["My Library"])
+def follow_endpoint(create: FollowRequest, request: Request):
+    """
+    Follow an author or a series: when a new book by the author or in the series is added to a
+    library you can use, you get a notification, and an email too with `email` set.
+    """
+    user = signed_in_user(request)
+    try:
+        return Follow(**follows.follow(user["id"], create.kind, create.name, create.email))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except follows.FollowExists as e:
+        raise HTTPException(status_code=409, detail=str(e))
+
+
+@app.patch("/me/follows/{follow_id}", response_model=Follow, tags=["My Library"])
+def update_follow_endpoint(follow_id: int, update: FollowUpdateRequest, request: Request):
+    """Turn emails about a followed author or series on or off."""
+    try:
+        return Follow(**follows.set_email(signed_in_user(request)["id"], follow_id, update.email))
+    except follows.FollowNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+
+
+@app.delete("/me/follows/{follow_id}", status_code=204, tags=["My Library"])
+def unfollow_endpoint(follow_id: int, request: Request):
+    """Stop following an author or series."""
+    try:
+        follows.unfollow(signed_in_user(request)["id"], follow_id)
+    except follows.FollowNotFound as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    return Response(status_code=204)
+
+
+@app.get("/me/privacy", response_model=PrivacySettings, tags=["My Library"])
+def my_privacy_endpoint(request: Request):
+    """
+    Your privacy settings: what of yours other users may see. Everything is shared until you turn
+    it off: your activity in the feed, your reading status, your ratings and your reviews.
+    """
+    return PrivacySettings(**privacy.get_settings(signed_in_user(request)["id"]))
+
+
+@app.patch("/me/privacy", response_model=PrivacySettings, tags=["My Library"])
+def update_privacy_endpoint(update: PrivacyUpdateRequest, request: Request):
+    """Change some of your privacy settings; those left out stay as they are."""
+    user = signed_in_user(request)
+    try:
+        return PrivacySettings(**privacy.update_settings(user["id"], update.model_dump(exclude_unset=True)))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+
+@app.get("/me/preferences", response_model=Preferences, tags=["My Library"])
+def my_preferences_endpoint(request: Request):
+    """Your preferences, with defaults for those you haven't set."""
+    return Preferences(**preferences.get_preferences(signed_in_user(request)["id"]))
+
+
+@app.put("/me/preferences", response_model=Preferences, tags=["My Library"])
+def set_preferences_endpoint(update: Preferences, request: Request):
+    """
+    Replace your preferences; those left out or null go back to their defaults. The server applies
+    them where a request leaves the choice open: the sort and page size of `GET /books/`, the
+    format of downloads and OPDS acquisition links, and the page size and languages of OPDS feeds.
+    """
+    user = signed_in_user(request)
+    try:
+        return Preferences(**preferences.set_preferences(user["id"], update.model_dump(exclude_unset=True)))
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
@@ -0,0 +1,112 @@
+"""
+Time-limited maintenance (read-only) mode. While it is on, requests that may change the
+library are rejected with 503 and a Retry-After header, so backups and migrations see a
+library that nobody writes to. The mode always ends after the requested duration, so a
+forgotten toggle can't leave the server stuck.
+"""
+import json
+import math
+import threading
+import time
+import logging
+from typing import Any, Dict, Optional
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_DURATION_MINUTES = 30
+MAX_DURATION_MINUTES = 24 * 60
+
+READ_METHODS = {"GET", "HEAD", "OPTIONS"}
+# Write-method routes that stay available: the toggle itself, read-only queries, configuration
+# reloads, the database maintenance that is meant to run in maintenance mode, and signing in and out.
+EXEMPT_PATHS = ("/admin/maintenance-mode", "/admin/query", "/admin/config/reload", "/maintenance/optimize-db", "/auth/")
+
+_lock = threading.Lock()
+_state: Dict[str, Any] = {"until": None, "reason": None, "started_at": None}
+
+
+def enable(duration_minutes: float = DEFAULT_DURATION_MINUTES, reason: Optional[str] = None,
+           now: Optional[float] = None) -> Dict[str, Any]:
+    """
+    Turns maintenance mode on for `duration_minutes`, or extends/shortens a running one.
+
+    Raises:
+        ValueError: If the duration is not between 0 and MAX_DURATION_MINUTES.
+    """
+    if not 0 < duration_minutes <= MAX_DURATION_MINUTES:
+        raise ValueError(f"duration_minutes must be greater than 0 and at most {MAX_DURATION_MINUTES}.")
+    now = time.time() if now is None else now
+    with _lock:
+        if _state["until"] is None or _state["until"] <= now:
+            _state["started_at"] = now
+        _state["until"] = now + duration_minutes * 60
+        _state["reason"] = reason
+    logger.warning(f"Maintenance mode on for {duration_minutes} minute(s). Reason: {reason or 'none given'}")
+    return status(now)
+
+
+def disable() -> Dict[str, Any]:
+    with _lock:
+        was_on = _state["until"] is not None
+        _state.update({"until": None, "reason": None, "started_at": None})
+    if was_on:
+        logger.warning("Maintenance mode off.")
+    return status()
+
+
+def status(now: Optional[float] = None) -> Dict[str, Any]:
+    """
+    Returns {"enabled", "reason", "started_at", "until", "remaining_seconds"}. An expired
+    mode is reported (and reset) as disabled.
+    """
+    now = time.time() if now is None else now
+    with _lock:
+        if _state["until"] is not None and _state["until"] <= now:
+            logger.warning("Maintenance mode ended after its timeout.")
+            _state.update({"until": None, "reason": None, "started_at": None})
+        until = _state["until"]
+        return {
+            "enabled": until is not None,
+            "reason": _state["reason"],
+            "started_at": _state["started_at"],
+            "until": until,
+            "remaining_seconds": math.ceil(until - now) if until is not None else 0,
+        }
+
+
+def blocks_request(method: str, path: str) -> bool:
+    return method.upper() not in READ_METHODS and not path.startswith(EXEMPT_PATHS)
+
+
+class MaintenanceModeMiddleware:
+    """
+    ASGI middleware that rejects write requests with 503 while maintenance mode is on.
+    Retry-After is the time left until the mode ends by itself.
+    """
+
+    def __init__(self, app):
+        self.app = app
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http" or not blocks_request(scope["method"], scope["path"]):
+            await self.app(scope, receive, send)
+            return
+        current = status()
+        if not current["enabled"]:
+            await self.app(scope, receive, send)
+            return
+
+        detail = "The server is in maintenance mode and does not accept changes right now."
+        if current["reason"]:
+            detail += f" Reason: {current['reason']}"
+        body = json.dumps({"detail": detail}).encode()
+        await send({
+            "type": "http.response.start",
+            "status": 503,
+            "headers": [
+                (b"content-type", b"application/json"),
+                (b"content-length", str(len(body)).encode()),
+                (b"retry-after", str(max(1, current["remaining_seconds"])).encode()),
+            ],
+        })
+        await send({"type": "http.response.body", "body": body})
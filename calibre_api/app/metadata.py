@@ -0,0 +1,252 @@
+import os
+import logging
+import shutil
+import tempfile
+import xml.etree.ElementTree as ET
+from typing import Dict, Any, List, Optional
+
+from . import calibre_cli
+from . import crud
+from .crud import as_list
+from . import djvu
+from . import fb2
+
+logger = logging.getLogger(__name__)
+
+OPF_NS = "http://www.idpf.org/2007/opf"
+DC_NS = "http://purl.org/dc/elements/1.1/"
+NS = {"opf": OPF_NS, "dc": DC_NS}
+
+# Calibre uses these placeholders for "no value"; they count as empty when deciding what to fill in.
+UNDEFINED_TITLE = "Unknown"
+UNDEFINED_AUTHOR = "Unknown"
+UNDEFINED_DATE_PREFIX = "0101-01-01"
+
+# Fields that `reextract` is allowed to fill in. They map 1:1 onto SetMetadataRequest.
+FILLABLE_FIELDS = [
+    "title", "authors", "publisher", "pubdate", "tags", "series",
+    "series_index", "isbn", "comments", "languages",
+]
+
+
+def parse_opf(opf_content: str) -> Dict[str, Any]:
+    """
+    Parses an OPF 2 document (as produced by `ebook-meta --to-opf` or `calibredb show_metadata --as-opf`)
+    into a flat dictionary using the same field names as the Book model.
+
+    Only fields that are present in the OPF are included in the result.
+
+    Raises:
+        ValueError: If the OPF content is not well-formed XML or has no metadata section.
+    """
+    try:
+        root = ET.fromstring(opf_content)
+    except ET.ParseError as e:
+        raise ValueError(f"Invalid OPF document: {e}")
+
+    metadata_node = root.find("opf:metadata", NS)
+    if metadata_node is None:
+        raise ValueError("OPF document has no <metadata> element.")
+
+    result: Dict[str, Any] = {}
+
+    def text_of(tag: str) -> Optional[str]:
+        node = metadata_node.find(tag, NS)
+        if node is not None and node.text and node.text.strip():
+            return node.text.strip()
+        return None
+
+    def texts_of(tag: str) -> List[str]:
+        return [n.text.strip() for n in metadata_node.findall(tag, NS) if n.text and n.text.strip()]
+
+    title = text_of("dc:title")
+    if title:
+        result["title"] = title
+
+    # Only creators with the author role (or no role at all) are authors; editors, illustrators etc. are skipped.
+    authors = []
+    for creator in metadata_node.findall("dc:creator", NS):
+        role = creator.get(f"{{{OPF_NS}}}role") or creator.get("role")
+        if creator.text and creator.text.strip() and role in (None, "aut"):
+            authors.append(creator.text.strip())
+    if authors:
+        result["authors"] = authors
+
+    publisher = text_of("dc:publisher")
+    if publisher:
+        result["publisher"] = publisher
+
+    pubdate = text_of("dc:date")
+    if pubdate:
+        result["pubdate"] = pubdate
+
+    tags = texts_of("dc:subject")
+    if tags:
+        result["tags"] = tags
+
+    languages = texts_of("dc:language")
+    if languages:
+        result["languages"] = languages
+
+    comments = text_of("dc:description")
+    if comments:
+        result["comments"] = comments
+
+    identifiers: Dict[str, str] = {}
+    for ident in metadata_node.findall("dc:identifier", NS):
+        if not ident.text or not ident.text.strip():
+            continue
+        scheme = ident.get(f"{{{OPF_NS}}}scheme") or ident.get("scheme")
+        value = ident.text.strip()
+        if scheme:
+            identifiers[scheme.lower()] = value
+        elif ":" in value and not value.lower().startswith("urn:uuid"):
+            # OPF 3 style: <dc:identifier>isbn:978...</dc:identifier>
+            scheme, _, value = value.partition(":")
+            identifiers[scheme.lower()] = value
+    # calibre and uuid_id identifiers are internal bookkeeping, not bibliographic identifiers.
+    identifiers.pop("calibre", None)
+    identifiers.pop("uuid", None)
+    if identifiers:
+        result["identifiers"] = identifiers
+        if identifiers.get("isbn"):
+            result["isbn"] = identifiers["isbn"]
+
+    for meta in metadata_node.findall("opf:meta", NS):
+        name, content = meta.get("name"), meta.get("content")
+        if not name or content is None:
+            continue
+        if name == "calibre:series" and content.strip():
+            result["series"] = content.strip()
+        elif name == "calibre:series_index":
+            try:
+                result["series_index"] = float(content)
+            except ValueError:
+                pass
+        elif name == "calibre:rating":
+            try:
+                result["rating"] = float(content)
+            except ValueError:
+                pass
+
+    return result
+
+
+def read_file_metadata(ebook_file_path: str) -> Dict[str, Any]:
+    """
+    Reads the embedded metadata of an e-book file with `ebook-meta --to-opf` and parses it.
+
+    FB2 files are parsed natively. ebook-meta only derives a title from the file name for DjVu
+    files, so the document metadata read by `djvused` (when installed) takes precedence there.
+
+    Raises:
+        FileNotFoundError: If ebook-meta or the e-book file is not found.
+        CalibreCLIError: If ebook-meta fails.
+        ValueError: If the generated OPF (or FB2 document) cannot be parsed.
+    """
+    if fb2.is_fb2_path(ebook_file_path):
+        return fb2.read_metadata(ebook_file_path)
+    is_djvu = djvu.is_djvu_path(ebook_file_path)
+
+    fd, opf_path = tempfile.mkstemp(prefix="shelfstone_server_meta_", suffix=".opf")
+    os.close(fd)
+    try:
+        calibre_cli.get_ebook_metadata(ebook_file_path=ebook_file_path, output_opf_file=opf_path)
+        with open(opf_path, "r", encoding="utf-8") as f:
+            result = parse_opf(f.read())
+    except (calibre_cli.CalibreCLIError, ValueError):
+        if not is_djvu:
+            raise
+        return djvu.read_metadata(ebook_file_path)
+    finally:
+        if os.path.exists(opf_path):
+            os.remove(opf_path)
+
+    if is_djvu:
+        try:
+            extracted = djvu.read_metadata(ebook_file_path)
+        except (FileNotFoundError, calibre_cli.CalibreCLIError) as e:
+            logger.info(f"No DjVu metadata for {ebook_file_path}: {e.args[0] if e.args else e}")
+        else:
+            result.update(extracted)
+    return result
+
+
+def extract_cover(ebook_file_path: str, output_dir: str) -> Optional[str]:
+    """
+    Writes the cover of an FB2 file, or a render of a DjVu file's first page, to output_dir.
+    Returns its path, or None for other formats and files without a cover.
+
+    Raises:
+        ValueError: If an FB2 file cannot be parsed.
+    """
+    if fb2.is_fb2_path(ebook_file_path):
+        return fb2.write_cover(ebook_file_path, output_dir)
+    if djvu.is_djvu_path(ebook_file_path):
+        return djvu.render_cover(ebook_file_path, output_dir)
+    return None
+
+
+def add_missing_covers(book_ids: List[int], ebook_file_path: str, library_path: Optional[str] = None) -> None:
+    """
+    Sets the cover of just-added FB2 and DjVu books that Calibre added without one, taken from
+    the file they were added from. Best effort: failures are logged, never raised.
+    """
+    if not book_ids or not (fb2.is_fb2_path(ebook_file_path) or djvu.is_djvu_path(ebook_file_path)):
+        return
+    output_dir = tempfile.mkdtemp(prefix="shelfstone_server_cover_")
+    try:
+        search = " or ".join(f"id:{book_id}" for book_id in book_ids)
+        missing = [b["id"] for b in crud.list_books(library_path=library_path, search_query=search) if not b.get("cover")]
+        if not missing:
+            return
+        cover_path = extract_cover(ebook_file_path, output_dir)
+        if cover_path is None:
+            return
+        for book_id in missing:
+            crud.set_book_cover(book_id, cover_path, library_path=library_path)
+            logger.info(f"Set cover of book ID {book_id} from '{os.path.basename(ebook_file_path)}'.")
+    except Exception as e:
+        logger.warning(f"Could not add a cover for book(s) {book_ids} from '{ebook_file_path}': {e}")
+    finally:
+        shutil.rmtree(output_dir, ignore_errors=True)
+
+
+def is_empty_field(field: str, value: Any) -> bool:
+    """
+    Returns True if `value` is what Calibre stores when `field` has no real data.
+    """
+    if value is None:
+        return True
+    if field == "title":
+        return not str(value).strip() or str(value).strip() == UNDEFINED_TITLE
+    if field == "authors":
+        authors = as_list(value, field)
+        return not authors or authors == [UNDEFINED_AUTHOR]
+    if field in ("tags", "languages"):
+        return not as_list(value, field)
+    if field == "pubdate":
+        return not str(value).strip() or str(value).startswith(UNDEFINED_DATE_PREFIX)
+    if field == "series_index":
+        # A series index only means something together with a series.
+        return False
+    return isinstance(value, str) and not value.strip()
+
+
+def fields_to_fill(current: Dict[str, Any], extracted: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Selects the extracted values for fields that are currently empty in the library.
+    Fields that already hold data are never overwritten.
+    """
+    updates: Dict[str, Any] = {}
+    for field in FILLABLE_FIELDS:
+        if field not in extracted:
+            continue
+        if field == "series_index":
+            continue  # handled together with series below
+        if is_empty_field(field, current.get(field)) and not is_empty_field(field, extracted[field]):
+            updates[field] = extracted[field]
+
+    if "series" in updates and "series_index" in extracted:
+        updates["series_index"] = extracted["series_index"]
+    return updates
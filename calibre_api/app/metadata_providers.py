@@ -0,0 +1,310 @@
+"""
+Online metadata lookup for books whose embedded metadata is incomplete.
+
+A provider looks a book up by ISBN, or by title and author, and returns candidate records with
+the Book model's field names plus `provider` and `cover_url`. Google Books and Open Library are
+built in; SHELFSTONE_METADATA_PROVIDERS picks and orders them, and register_provider() adds
+others. Candidates are only suggestions: select_updates() turns the fields a user picked into
+changes for the library, and file_metadata_options() into `ebook-meta` options for the files.
+"""
+import json
+import logging
+import os
+import re
+import tempfile
+import urllib.error
+import urllib.parse
+import urllib.request
+from typing import Any, Dict, List, Optional, Tuple
+
+from . import isbn as isbn_utils
+from .metadata import FILLABLE_FIELDS, is_empty_field
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_PROVIDERS = "google,openlibrary"
+DEFAULT_TIMEOUT = 15
+DEFAULT_LIMIT = 5
+USER_AGENT = "Shelfstone (+https://github.com/mjryan253/shelfstone-gnu)"
+MAX_COVER_BYTES = 10 * 1024 * 1024
+# Fields a candidate can be applied with, besides the SetMetadataRequest ones.
+APPLICABLE_FIELDS = FILLABLE_FIELDS + ["identifiers", "cover"]
+
+
+class ProviderError(Exception):
+    """A provider could not be reached or sent an unusable answer."""
+
+
+def http_get(url: str, timeout: float = DEFAULT_TIMEOUT, max_bytes: Optional[int] = None) -> Tuple[bytes, str]:
+    """
+    GETs a URL and returns (body, content type).
+
+    Raises:
+        ProviderError: On network and HTTP errors, and bodies over max_bytes.
+    """
+    request = urllib.request.Request(url, headers={"User-Agent": USER_AGENT})
+    try:
+        with urllib.request.urlopen(request, timeout=timeout) as response:
+            body = response.read(max_bytes + 1 if max_bytes else -1)
+            content_type = response.headers.get("Content-Type", "")
+    except urllib.error.HTTPError as e:
+        raise ProviderError(f"{urllib.parse.urlsplit(url).netloc} answered HTTP {e.code}.")
+    except (urllib.error.URLError, OSError) as e:
+        reason = getattr(e, "reason", e)
+        raise ProviderError(f"Could not reach {urllib.parse.urlsplit(url).netloc}: {reason}")
+    if max_bytes and len(body) > max_bytes:
+        raise ProviderError(f"{url} is larger than {max_bytes} bytes.")
+    return body, content_type
+
+
+def http_get_json(url: str, timeout: float = DEFAULT_TIMEOUT) -> Any:
+    body, _ = http_get(url, timeout)
+    try:
+        return json.loads(body)
+    except ValueError:
+        raise ProviderError(f"{urllib.parse.urlsplit(url).netloc} sent a response that is not JSON.")
+
+
+def normalize_date(value: Optional[str]) -> Optional[str]:
+    """Providers give "2005", "2005-08" or "2005-08-01"; the library wants a full date."""
+    match = re.match(r"^(\d{4})(?:-(\d{2}))?(?:-(\d{2}))?", str(value or "").strip())
+    if not match:
+        return None
+    return f"{match.group(1)}-{match.group(2) or '01'}-{match.group(3) or '01'}"
+
+
+def _candidate(provider: str, **fields) -> Dict[str, Any]:
+    candidate = {"provider": provider, "title": None, "authors": [], "publisher": None, "pubdate": None,
+                 "isbn": None, "identifiers": {}, "tags": [], "comments": None, "languages": [],
+                 "series": None, "series_index": None, "cover_url": None}
+    candidate.update({k: v for k, v in fields.items() if v not in (None, "", [], {})})
+    return candidate
+
+
+def _pick_isbn(isbns: List[str], wanted: Optional[str]) -> Optional[str]:
+    """The ISBN-13 of a record: the one searched for if the record has it, else its first valid one."""
+    normalized = []
+    for value in isbns:
+        try:
+            normalized.append(isbn_utils.normalize_isbn(value))
+        except ValueError:
+            continue
+    if wanted and wanted in normalized:
+        return wanted
+    return normalized[0] if normalized else None
+
+
+class Provider:
+    """A metadata source. Subclasses implement search() and return candidates (see _candidate)."""
+
+    name = ""
+    display_name = ""
+
+    def search(self, isbn: Optional[str] = None, title: Optional[str] = None, authors: Optional[List[str]] = None,
+               limit: int = DEFAULT_LIMIT, timeout: float = DEFAULT_TIMEOUT) -> List[Dict[str, Any]]:
+        raise NotImplementedError
+
+
+class GoogleBooksProvider(Provider):
+    name = "google"
+    display_name = "Google Books"
+    API_URL = "https://www.googleapis.com/books/v1/volumes"
+
+    def search(self, isbn=None, title=None, authors=None, limit=DEFAULT_LIMIT, timeout=DEFAULT_TIMEOUT):
+        if isbn:
+            query = f"isbn:{isbn}"
+        else:
+            query = " ".join([f'intitle:"{title}"'] + [f'inauthor:"{a}"' for a in (authors or [])[:1]])
+        params = {"q": query, "maxResults": limit, "printType": "books"}
+        if os.environ.get("SHELFSTONE_GOOGLE_BOOKS_API_KEY"):
+            params["key"] = os.environ["SHELFSTONE_GOOGLE_BOOKS_API_KEY"]
+        data = http_get_json(f"{self.API_URL}?{urllib.parse.urlencode(params)}", timeout)
+        return [self.parse_volume(item, isbn) for item in data.get("items") or []][:limit]
+
+    def parse_volume(self, item: Dict[str, Any], wanted_isbn: Optional[str] = None) -> Dict[str, Any]:
+        info = item.get("volumeInfo") or {}
+        title = info.get("title")
+        if title and info.get("subtitle"):
+            title = f"{title}: {info['subtitle']}"
+        isbn = _pick_isbn([i.get("identifier", "") for i in info.get("industryIdentifiers") or []
+                           if i.get("type") in ("ISBN_13", "ISBN_10")], wanted_isbn)
+        identifiers = {"google": item["id"]} if item.get("id") else {}
+        if isbn:
+            identifiers["isbn"] = isbn
+        images = info.get("imageLinks") or {}
+        cover_url = images.get("extraLarge") or images.get("large") or images.get("thumbnail")
+        if cover_url:
+            cover_url = cover_url.replace("http://", "https://", 1).replace("&edge=curl", "")
+        return _candidate(
+            self.name, title=title, authors=info.get("authors") or [], publisher=info.get("publisher"),
+            pubdate=normalize_date(info.get("publishedDate")), isbn=isbn, identifiers=identifiers,
+            tags=info.get("categories") or [], comments=info.get("description"),
+            languages=[info["language"]] if info.get("language") else [], cover_url=cover_url,
+        )
+
+
+class OpenLibraryProvider(Provider):
+    name = "openlibrary"
+    display_name = "Open Library"
+    SEARCH_URL = "https://openlibrary.org/search.json"
+    COVER_URL = "https://covers.openlibrary.org/b/id/{}-L.jpg"
+    FIELDS = "key,title,subtitle,author_name,publisher,first_publish_year,publish_date,isbn,language,subject,cover_i,cover_edition_key"
+    MAX_TAGS = 10
+
+    def search(self, isbn=None, title=None, authors=None, limit=DEFAULT_LIMIT, timeout=DEFAULT_TIMEOUT):
+        params: Dict[str, Any] = {"fields": self.FIELDS, "limit": limit}
+        if isbn:
+            params["isbn"] = isbn
+        else:
+            params["title"] = title
+            if authors:
+                params["author"] = authors[0]
+        data = http_get_json(f"{self.SEARCH_URL}?{urllib.parse.urlencode(params)}", timeout)
+        return [self.parse_doc(doc, isbn) for doc in data.get("docs") or []][:limit]
+
+    def parse_doc(self, doc: Dict[str, Any], wanted_isbn: Optional[str] = None) -> Dict[str, Any]:
+        title = doc.get("title")
+        if title and doc.get("subtitle"):
+            title = f"{title}: {doc['subtitle']}"
+        isbn = _pick_isbn(doc.get("isbn") or [], wanted_isbn)
+        identifiers = {}
+        if doc.get("cover_edition_key"):
+            identifiers["openlibrary"] = doc["cover_edition_key"]
+        if isbn:
+            identifiers["isbn"] = isbn
+        return _candidate(
+            self.name, title=title, authors=doc.get("author_name") or [],
+            publisher=(doc.get("publisher") or [None])[0],
+            pubdate=normalize_date(doc.get("first_publish_year")), isbn=isbn, identifiers=identifiers,
+            tags=(doc.get("subject") or [])[:self.MAX_TAGS], languages=doc.get("language") or [],
+            cover_url=self.COVER_URL.format(doc["cover_i"]) if doc.get("cover_i") else None,
+        )
+
+
+PROVIDERS: Dict[str, Provider] = {}
+
+
+def register_provider(provider: Provider) -> None:
+    PROVIDERS[provider.name] = provider
+
+
+register_provider(GoogleBooksProvider())
+register_provider(OpenLibraryProvider())
+
+
+def parse_providers(value: Optional[str]) -> List[str]:
+    """
+    Parses a comma-separated list of provider names, in the order they are asked.
+
+    Raises:
+        ValueError: If a name is not a registered provider.
+    """
+    names = [n.strip().lower() for n in (value or "").split(",") if n.strip()]
+    unknown = [n for n in names if n not in PROVIDERS]
+    if unknown:
+        raise ValueError(f"unknown metadata provider(s) {', '.join(unknown)}; known: {', '.join(PROVIDERS)}")
+    return names
+
+
+def enabled_providers() -> List[str]:
+    return parse_providers(os.environ.get("SHELFSTONE_METADATA_PROVIDERS") or DEFAULT_PROVIDERS)
+
+
+def fetch_candidates(isbn: Optional[str] = None, title: Optional[str] = None, authors: Optional[List[str]] = None,
+                     providers: Optional[List[str]] = None, limit: int = DEFAULT_LIMIT) -> Tuple[List[Dict[str, Any]], Dict[str, str]]:
+    """
+    Asks each provider for matches, by ISBN if given, else by title and author.
+    Returns (candidates in provider order, {provider: error} for providers that failed).
+
+    Raises:
+        ValueError: If there is neither an ISBN nor a title, the ISBN is invalid, or a provider is unknown.
+    """
+    if not isbn and not title:
+        raise ValueError("An ISBN or a title is needed to look up metadata.")
+    if isbn:
+        isbn = isbn_utils.normalize_isbn(isbn)
+    names = parse_providers(",".join(providers)) if providers else enabled_providers()
+    timeout = float(os.environ.get("SHELFSTONE_METADATA_TIMEOUT") or DEFAULT_TIMEOUT)
+
+    candidates: List[Dict[str, Any]] = []
+    errors: Dict[str, str] = {}
+    for name in names:
+        try:
+            candidates.extend(PROVIDERS[name].search(isbn=isbn, title=title, authors=authors, limit=limit, timeout=timeout))
+        except ProviderError as e:
+            logger.warning(f"Metadata provider '{name}' failed: {e}")
+            errors[name] = str(e)
+        except Exception as e:
+            logger.error(f"Metadata provider '{name}' failed unexpectedly: {e}", exc_info=True)
+            errors[name] = f"Unexpected error: {e}"
+    return candidates, errors
+
+
+def select_updates(candidate: Dict[str, Any], fields: Optional[List[str]], current: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    The changes applying a candidate makes to a book: the selected fields (all when fields is
+    None) for which the candidate has a value. Identifiers are merged into the book's current
+    ones. "cover" maps to the candidate's cover URL.
+
+    Raises:
+        ValueError: If a selected field can't be applied.
+    """
+    unknown = [f for f in fields or [] if f not in APPLICABLE_FIELDS]
+    if unknown:
+        raise ValueError(f"Cannot apply field(s) {', '.join(unknown)}. Supported: {', '.join(APPLICABLE_FIELDS)}.")
+    updates: Dict[str, Any] = {}
+    for field in (fields if fields is not None else APPLICABLE_FIELDS):
+        if field == "cover":
+            if candidate.get("cover_url"):
+                updates["cover"] = candidate["cover_url"]
+        elif field == "identifiers":
+            if candidate.get("identifiers"):
+                updates["identifiers"] = {**(current.get("identifiers") or {}), **candidate["identifiers"]}
+        elif field == "series_index":
+            if candidate.get("series_index") is not None:
+                updates["series_index"] = candidate["series_index"]
+        elif not is_empty_field(field, candidate.get(field)):
+            updates[field] = candidate[field]
+    return updates
+
+
+def download_cover(url: str, output_dir: str) -> str:
+    """
+    Downloads a cover image into output_dir and returns its path.
+
+    Raises:
+        ValueError: If the URL is not http(s).
+        ProviderError: If the download fails or is not an image.
+    """
+    if urllib.parse.urlsplit(url).scheme not in ("http", "https"):
+        raise ValueError(f"Cover URL must be http or https: {url}")
+    body, content_type = http_get(url, max_bytes=MAX_COVER_BYTES)
+    if not content_type.startswith("image/") or not body:
+        raise ProviderError(f"{url} is not an image.")
+    fd, path = tempfile.mkstemp(prefix="cover_", suffix=".jpg" if "jpeg" in content_type else ".img", dir=output_dir)
+    with os.fdopen(fd, "wb") as f:
+        f.write(body)
+    return path
+
+
+def file_metadata_options(updates: Dict[str, Any], cover_path: Optional[str] = None) -> List[str]:
+    """`ebook-meta` options writing the applied values into a book file."""
+    options: List[str] = []
+    simple = {"title": "--title", "publisher": "--publisher", "pubdate": "--date", "series": "--series",
+              "isbn": "--isbn", "comments": "--comments"}
+    for field, option in simple.items():
+        if field in updates:
+            options.extend([option, str(updates[field])])
+    if "authors" in updates:
+        options.extend(["--authors", " & ".join(updates["authors"])])
+    if "tags" in updates:
+        options.extend(["--tags", ",".join(updates["tags"])])
+    if "series_index" in updates:
+        options.extend(["--index", str(updates["series_index"])])
+    for language in updates.get("languages", []):
+        options.extend(["--language", language])
+    for id_type, value in (updates.get("identifiers") or {}).items():
+        options.extend(["--identifier", f"{id_type}:{value}"])
+    if cover_path:
+        options.extend(["--cover", cover_path])
+    return options
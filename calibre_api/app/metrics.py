@@ -0,0 +1,158 @@
+import os
+import threading
+import time
+from collections import deque
+from typing import Any, Deque, Dict, List, Optional, Tuple
+
+# Error types assigned to failed Calibre commands.
+ERROR_BINARY_MISSING = "binary_missing"
+ERROR_TIMEOUT = "timeout"
+ERROR_DRM = "drm"
+ERROR_UNSUPPORTED_FORMAT = "unsupported_format"
+ERROR_CORRUPT_FILE = "corrupt_file"
+ERROR_LIBRARY_LOCKED = "library_locked"
+ERROR_CRASHED = "crashed"
+ERROR_UNKNOWN = "unknown"
+
+# Failures that are likely to go away when the command is simply run again, and are safe to
+# retry: a locked library means calibredb couldn't open it, so nothing was written. Crashes are
+# not retried, since the command (e.g. calibredb add) may have written before it was killed.
+TRANSIENT_ERROR_TYPES = {ERROR_LIBRARY_LOCKED}
+
+# Checked in order; the first type with a matching (lower-cased) stderr fragment wins.
+# DRM comes first because DRM-protected files also trigger generic read errors.
+_STDERR_PATTERNS: List[Tuple[str, Tuple[str, ...]]] = [
+    (ERROR_DRM, ("drmerror", "drm-protected", "drm protected", "is drm", "has drm", "encrypted with drm")),
+    (ERROR_LIBRARY_LOCKED, ("database is locked", "another calibre program", "library is locked", "is being used by another")),
+    (ERROR_UNSUPPORTED_FORMAT, (
+        "no plugin to handle input format", "unsupported input format", "not a supported",
+        "unknown format", "could not find an ebook inside the archive", "cannot read metadata from",
+        "no metadata reader", "is not a valid ebook",
+    )),
+    (ERROR_CORRUPT_FILE, (
+        "badzipfile", "not a zip file", "zlib.error", "corrupt", "eof marker not found",
+        "struct.error", "unexpected end", "xmlsyntaxerror", "invalid pdf", "truncated",
+        "not a valid mobi", "invalid file",
+    )),
+]
+
+RECENT_FAILURES_LIMIT = 100
+
+_lock = threading.Lock()
+_commands_total: Dict[str, int] = {}
+_failures_total: Dict[Tuple[str, str], int] = {}
+_retries_total: Dict[Tuple[str, str], int] = {}
+_recent_failures: Deque[Dict[str, Any]] = deque(maxlen=RECENT_FAILURES_LIMIT)
+
+
+def classify_failure(stderr: Optional[str], returncode: Optional[int] = None) -> str:
+    """
+    Maps a failed Calibre command to one of the ERROR_* types from its stderr and exit code.
+    run_calibre_command uses -1 as the exit code for timeouts; other negative exit codes
+    mean the process was killed by a signal (e.g. -11 for a segfault).
+    """
+    if returncode == -1:
+        return ERROR_TIMEOUT
+    text = (stderr or "").lower()
+    for error_type, fragments in _STDERR_PATTERNS:
+        if any(fragment in text for fragment in fragments):
+            return error_type
+    if returncode is not None and returncode < -2:
+        return ERROR_CRASHED
+    return ERROR_UNKNOWN
+
+
+def _tool_name(executable: str) -> str:
+    return os.path.basename(executable or "unknown")
+
+
+def record_command(executable: str) -> None:
+    """Counts an attempted Calibre command."""
+    tool = _tool_name(executable)
+    with _lock:
+        _commands_total[tool] = _commands_total.get(tool, 0) + 1
+
+
+def record_retry(executable: str, error_type: str) -> None:
+    """Counts a retry of a transiently failed Calibre command."""
+    tool = _tool_name(executable)
+    with _lock:
+        key = (tool, error_type)
+        _retries_total[key] = _retries_total.get(key, 0) + 1
+
+
+def record_failure(executable: str, error_type: str, returncode: Optional[int] = None,
+                   stderr: Optional[str] = None, target: Optional[str] = None,
+                   attempts: Optional[List[Dict[str, Any]]] = None) -> None:
+    """
+    Counts a failed Calibre command and keeps it in the list of recent failures.
+    `target` is the file or book the command was working on, if known, and `attempts`
+    the history of a retried command (one {"returncode", "error_type"} dict per attempt).
+    """
+    tool = _tool_name(executable)
+    with _lock:
+        key = (tool, error_type)
+        _failures_total[key] = _failures_total.get(key, 0) + 1
+        _recent_failures.append({
+            "timestamp": time.time(),
+            "tool": tool,
+            "error_type": error_type,
+            "returncode": returncode,
+            "target": target,
+            # The tail of stderr holds the actual exception; the head is usually a traceback preamble.
+            "stderr": (stderr or "")[-500:] or None,
+            "attempts": list(attempts or []),
+        })
+
+
+def recent_failures() -> List[Dict[str, Any]]:
+    """Returns the most recent failures, newest first."""
+    with _lock:
+        return list(reversed(_recent_failures))
+
+
+def reset() -> None:
+    """Clears all counters and recent failures (used by tests)."""
+    with _lock:
+        _commands_total.clear()
+        _failures_total.clear()
+        _retries_total.clear()
+        _recent_failures.clear()
+
+
+def _escape_label(value: str) -> str:
+    return value.replace("\\", "\\\\").replace("\"", "\\\"").replace("\n", "\\n")
+
+
+def render_prometheus() -> str:
+    """
+    Renders the counters in the Prometheus text exposition format (version 0.0.4).
+    """
+    with _lock:
+        commands = sorted(_commands_total.items())
+        failures = sorted(_failures_total.items())
+        retries = sorted(_retries_total.items())
+
+    lines = [
+        "# HELP shelfstone_calibre_commands_total Calibre command-line tool invocations.",
+        "# TYPE shelfstone_calibre_commands_total counter",
+    ]
+    for tool, count in commands:
+        lines.append(f'shelfstone_calibre_commands_total{{tool="{_escape_label(tool)}"}} {count}')
+    lines += [
+        "# HELP shelfstone_calibre_command_failures_total Failed Calibre command-line tool invocations by error type.",
+        "# TYPE shelfstone_calibre_command_failures_total counter",
+    ]
+    for (tool, error_type), count in failures:
+        lines.append(
+            f'shelfstone_calibre_command_failures_total{{tool="{_escape_label(tool)}",error_type="{error_type}"}} {count}'
+        )
+    lines += [
+        "# HELP shelfstone_calibre_command_retries_total Retries of transiently failed Calibre command-line tool invocations.",
+        "# TYPE shelfstone_calibre_command_retries_total counter",
+    ]
+    for (tool, error_type), count in retries:
+        lines.append(
+            f'shelfstone_calibre_command_retries_total{{tool="{_escape_label(tool)}",error_type="{error_type}"}} {count}'
+        )
+    return "\n".join(lines) + "\n"
@@ -1,5 +1,13 @@
 from pydantic import BaseModel, Field
-from typing import List, Optional, Union
+from typing import List, Optional, Union, Dict, Any
+from datetime import date
+
+class BookSource(BaseModel):
+    source: str = Field(..., description="How the server added the book: upload, resumable_upload, package, import, news or seed.", example="upload")
+    detail: Optional[str] = Field(None, description="The uploaded file name(s), the imported file's path or the news recipe.", example="dune.epub")
+    client: Optional[str] = Field(None, description="Address of the client that added the book over HTTP.", example="192.168.1.20")
+    user_id: Optional[int] = Field(None, description="The user who added the book, with user accounts on.")
+    added_at: float = Field(..., description="Unix time the book was added.")
 
 class Book(BaseModel):
     id: int
@@ -23,6 +31,9 @@ class Book(BaseModel):
     series_index: Optional[float] = None # Can be float e.g. 1.0, 1.5, 2.0
     size: Optional[int] = None # Size in bytes
     uuid: Optional[str] = None
+    palette: Optional[List[str]] = Field(None, description="Dominant cover colors as hex strings, most dominant first. Only populated when requested.")
+    source: Optional[BookSource] = Field(None, description="How the book entered the library, if the server added it.")
+    reactions: Optional[Dict[str, int]] = Field(None, description="How many users reacted to the book with each emoji; null if nobody did.", example={"👍": 3, "❤️": 1})
 
     class Config:
         # Allows to use field names that are not valid Python identifiers
@@ -34,6 +45,30 @@ class AddBookResponse(BaseModel):
     message: str
     added_book_ids: List[int]
     details: Optional[str] = None
+    books: List[Book] = Field(default_factory=list, description="Records of the added books, as returned by GET /books/{book_id}/.")
+    duplicate_of: List[int] = Field(default_factory=list, description="Books already in the library with the same file content.")
+    format_added_to: Optional[int] = Field(None, description="Book the file was added to as another format, instead of adding a new book.")
+
+class AddBookPackageResponse(BaseModel):
+    message: str
+    book_id: Optional[int] = Field(None, description="ID of the imported book, or null if calibredb did not add it (e.g., a duplicate).")
+    metadata_source: str = Field(..., description="'opf' if the sidecar OPF was applied, 'extracted' if metadata was read from the e-book file, 'replayed' for an idempotent retry.")
+    cover_applied: bool = Field(False, description="Whether a cover image from the package was set as the book cover.")
+    attachments: List[str] = Field(default_factory=list, description="Files attached to the book as extra data files.")
+
+class AttachmentInfo(BaseModel):
+    name: str = Field(..., description="File name, relative to the book's data folder.")
+    size: int = Field(..., description="Size in bytes.")
+
+class AttachmentListResponse(BaseModel):
+    book_id: int
+    attachments: List[AttachmentInfo]
+
+class CheckOwnedResponse(BaseModel):
+    isbn: str = Field(..., description="The ISBN normalized to ISBN-13.", example="9780441172719")
+    owned: bool
+    books: List[Book] = Field(default_factory=list, description="Library books with this ISBN.")
+    metadata: Optional[Dict[str, Any]] = Field(None, description="Metadata from online sources, if `lookup` was requested and the book is not owned.")
 
 class RemoveBookResponse(BaseModel):
     message: str
@@ -51,6 +86,7 @@ class SetMetadataRequest(BaseModel):
     isbn: Optional[str] = None
     comments: Optional[str] = None
     rating: Optional[Union[int, float]] = None # Usually 1-5, or 0-10. Calibre uses half-stars (0-10 scale internally for 0-5 stars)
+    languages: Optional[List[str]] = None # ISO 639 codes, will be comma-separated for CLI
 
     # Ensure no extra fields are allowed if that's the desired behavior
     # class Config:
@@ -186,3 +222,1053 @@ class EbookCheckResponse(BaseModel):
     filename: str = Field(description="Name of the checked file.")
     report_format: str
     report: Union[str, Dict[str, Any]] = Field(description="The error report, either as a text string or a JSON object/dictionary.")
+
+
+# --- Maintenance Models ---
+
+class ReextractRequest(BaseModel):
+    ids: Optional[List[int]] = Field(None, description="Only re-extract these book IDs.", example=[1, 2, 3])
+    format: Optional[str] = Field(None, description="Only re-extract books that have this format, and read metadata from it.", example="EPUB")
+    imported_before: Optional[date] = Field(None, description="Only re-extract books added to the library before this date (YYYY-MM-DD).", example="2024-01-01")
+    dry_run: bool = Field(False, description="Report what would be updated without changing the library.")
+
+class ReextractBookResult(BaseModel):
+    book_id: int
+    title: Optional[str] = None
+    format: Optional[str] = Field(None, description="The format the metadata was read from.")
+    updated_fields: List[str] = Field(default_factory=list, description="Fields that were empty and have been (or, for a dry run, would be) filled in.")
+    error: Optional[str] = None
+
+class ReextractResponse(BaseModel):
+    message: str
+    dry_run: bool
+    processed: int
+    updated: int
+    failed: int
+    results: List[ReextractBookResult]
+
+class DiffBookSummary(BaseModel):
+    id: Optional[int] = None
+    title: Optional[str] = None
+    authors: Optional[List[str]] = None
+
+class DiffChangedBook(DiffBookSummary):
+    changes: Dict[str, Dict[str, Any]] = Field(..., description="Changed fields, each as {\"before\": ..., \"after\": ...}.")
+
+class LibraryDiffResponse(BaseModel):
+    added: List[DiffBookSummary]
+    removed: List[DiffBookSummary]
+    changed: List[DiffChangedBook]
+
+
+class CleanupTaskResult(BaseModel):
+    name: str = Field(..., description="One of: temp_files, uploads, conversion_cache, thumbnail_cache, news_issues.", example="uploads")
+    removed: List[str] = Field(..., description="Removed entries: file names, upload IDs or book IDs.")
+    freed_bytes: int = 0
+    error: Optional[str] = None
+
+class CleanupResponse(BaseModel):
+    dry_run: bool
+    tasks: List[CleanupTaskResult]
+
+class DatabaseStats(BaseModel):
+    size_bytes: int
+    page_size: int
+    page_count: int
+    free_pages: int = Field(..., description="Unused pages that a vacuum would return to the file system.")
+    auto_vacuum: str = Field(..., description="none, full or incremental.")
+
+class OptimizeDbResponse(BaseModel):
+    actions: List[str] = Field(..., description="What was run: analyze, incremental_vacuum, vacuum.")
+    skipped: List[str] = Field(default_factory=list, description="Steps not run, with the reason.")
+    before: DatabaseStats
+    after: DatabaseStats
+    freed_bytes: int
+    duration_seconds: float
+
+# --- Resumable Upload Models ---
+
+class UploadCreateRequest(BaseModel):
+    filename: str = Field(..., description="Name of the file being uploaded. The extension tells calibredb the format.", example="big_atlas.pdf")
+    total_size: Optional[int] = Field(None, description="Total size in bytes, if known. Enables completeness checks on commit.", example=734003200)
+
+class UploadStatus(BaseModel):
+    upload_id: str
+    filename: str
+    total_size: Optional[int] = None
+    offset: int = Field(..., description="Number of bytes received so far; the next chunk must start here.")
+    complete: bool = Field(..., description="True once `offset` equals `total_size`.")
+
+class UploadCommitRequest(BaseModel):
+    title: Optional[str] = None
+    authors: Optional[str] = Field(None, description="Comma-separated list of authors.")
+    tags: Optional[str] = Field(None, description="Comma-separated list of tags.")
+    duplicates: bool = False
+    automerge: bool = False
+    merge_formats: bool = Field(True, description="Add the file to a book with the same title and authors that doesn't have its format yet, instead of adding a new book.")
+
+
+# --- Monitoring Models ---
+
+class CommandFailure(BaseModel):
+    timestamp: float = Field(..., description="Unix timestamp of the failure.")
+    tool: str = Field(..., example="ebook-convert")
+    error_type: str = Field(..., description="One of: binary_missing, timeout, drm, unsupported_format, corrupt_file, library_locked, crashed, unknown.", example="drm")
+    returncode: Optional[int] = None
+    target: Optional[str] = Field(None, description="The file the command was working on, if known.")
+    stderr: Optional[str] = Field(None, description="The last 500 characters of the command's stderr.")
+    attempts: List[Dict[str, Any]] = Field(default_factory=list, description="One {returncode, error_type} entry per attempt, if the command was retried.")
+
+class CommandFailuresResponse(BaseModel):
+    failures: List[CommandFailure]
+
+
+# --- Admin Models ---
+
+class SqlQueryRequest(BaseModel):
+    sql: str = Field(..., description="A single read-only SELECT statement. Use `?` placeholders for values.", example="SELECT id, title FROM books WHERE pubdate > ? ORDER BY title")
+    params: List[Any] = Field(default_factory=list, description="Values for the `?` placeholders.", example=["2020-01-01"])
+    max_rows: int = Field(1000, ge=1, le=100000, description="Maximum number of rows to return.")
+
+class SqlQueryResponse(BaseModel):
+    columns: List[str]
+    rows: List[List[Any]]
+    truncated: bool = Field(..., description="True if the result had more than `max_rows` rows.")
+
+class SchemaColumn(BaseModel):
+    name: str
+    type: Optional[str] = Field(None, description="Declared SQLite type, if any.")
+    not_null: bool = False
+    primary_key: bool = False
+
+class SchemaTable(BaseModel):
+    name: str
+    type: str = Field(..., description="`table` or `view`.")
+    columns: List[SchemaColumn]
+
+class SchemaCustomColumn(BaseModel):
+    id: int
+    label: str = Field(..., description="Lookup name used in searches, e.g. `#read` for label `read`.", example="read")
+    name: str = Field(..., description="Display name.", example="Read")
+    datatype: str = Field(..., example="bool")
+    is_multiple: bool = False
+    table: str = Field(..., description="Table holding the column's values.", example="custom_column_1")
+
+class LibrarySchemaResponse(BaseModel):
+    schema_version: int = Field(..., description="Calibre's database schema version (PRAGMA user_version).")
+    tables: List[SchemaTable]
+    custom_columns: List[SchemaCustomColumn]
+
+class MaintenanceModeRequest(BaseModel):
+    enabled: bool = True
+    duration_minutes: float = Field(30, gt=0, le=1440, description="Minutes until maintenance mode ends by itself (at most 24 hours).")
+    reason: Optional[str] = Field(None, description="Shown in the 503 responses.", example="Nightly backup")
+
+class MaintenanceModeStatus(BaseModel):
+    enabled: bool
+    reason: Optional[str] = None
+    started_at: Optional[float] = None
+    until: Optional[float] = Field(None, description="Unix time at which maintenance mode ends by itself.")
+    remaining_seconds: int = 0
+
+class LogEntry(BaseModel):
+    seq: int = Field(..., description="Increasing sequence number; used as the SSE event ID.")
+    time: float = Field(..., description="Unix time of the log record.")
+    level: str = Field(..., example="WARNING")
+    component: str = Field(..., description="Logger name.", example="calibre_api.app.crud")
+    message: str
+
+
+# --- News Models ---
+
+class NewsFetchResponse(BaseModel):
+    message: str
+    recipe: str = Field(..., description="Identifier of the periodical; stored on each issue as the `news` identifier.", example="the-guardian")
+    added_book_ids: List[int]
+    removed_book_ids: List[int] = Field(default_factory=list, description="Older issues removed because they exceeded `keep_issues`.")
+
+
+# --- Taxonomy Models ---
+
+class RenameRequest(BaseModel):
+    old: str = Field(..., example="Sci-Fi")
+    new: str = Field(..., example="Science Fiction")
+    dry_run: bool = Field(False, description="Report the affected books without changing them.")
+
+class MergeTagsRequest(BaseModel):
+    sources: List[str] = Field(..., description="Tags to replace.", example=["sci-fi", "SF", "scifi"])
+    target: str = Field(..., description="Tag that replaces them (created if it doesn't exist).", example="Science Fiction")
+    dry_run: bool = Field(False, description="Report the affected books without changing them.")
+
+class TaxonomyFailure(BaseModel):
+    book_id: int
+    error: str
+
+class TaxonomyUpdateResponse(BaseModel):
+    message: str
+    dry_run: bool
+    updated_book_ids: List[int] = Field(..., description="Books that were (or, for a dry run, would be) changed.")
+    failed: List[TaxonomyFailure] = Field(default_factory=list)
+
+class UnusedEntriesResponse(BaseModel):
+    tags: List[str]
+    series: List[str]
+    authors: List[str]
+    publishers: List[str]
+
+class TagCount(BaseModel):
+    name: str = Field(..., example="Science Fiction")
+    books: int = Field(..., description="Number of books with the tag.")
+
+
+# --- Statistics Models ---
+
+class FormatStats(BaseModel):
+    format: str = Field(..., example="EPUB")
+    books: int = Field(..., description="Books with a file in this format.")
+    size: int = Field(..., description="Total size of the files in bytes.")
+
+class MonthlyAdditions(BaseModel):
+    month: str = Field(..., example="2026-09")
+    books: int
+
+class AuthorStats(BaseModel):
+    name: str
+    books: int
+
+class LibraryStatsResponse(BaseModel):
+    books: int
+    authors: int = Field(..., description="Authors of at least one book.")
+    series: int
+    tags: int
+    total_size: int = Field(..., description="Total size of all book files in bytes, as recorded by Calibre.")
+    database_size: int = Field(..., description="Size of metadata.db in bytes.")
+    formats: List[FormatStats]
+    added_per_month: List[MonthlyAdditions] = Field(..., description="Books added per month, oldest first, including months without additions.")
+    top_authors: List[AuthorStats]
+
+
+# --- Full-Text Search Models ---
+
+class FullTextIndexStatus(BaseModel):
+    state: str = Field(..., description="idle, running, finished or failed.", example="running")
+    started_at: Optional[float] = None
+    finished_at: Optional[float] = None
+    stats: Optional[Dict[str, int]] = Field(None, description="Counts: total, indexed, skipped (unchanged), failed, removed.")
+    error: Optional[str] = None
+
+class FullTextHit(BaseModel):
+    book_id: int
+    title: Optional[str] = None
+    snippet: str = Field(..., description="Text around the match, with matched words in [brackets].")
+
+class FullTextSearchResponse(BaseModel):
+    query: str
+    hits: List[FullTextHit]
+
+class BookSearchHit(BaseModel):
+    book_id: int
+    title: Optional[str] = None
+    authors: Optional[List[str]] = None
+    series: Optional[str] = None
+    matched: List[str] = Field(..., description="Where the query matched: title, author, series and/or text.", example=["title"])
+    snippet: Optional[str] = Field(None, description="Text around a match inside the book, with matched words in [brackets].")
+
+class BookSearchResponse(BaseModel):
+    query: str
+    hits: List[BookSearchHit]
+
+
+# --- Physical Copy Models ---
+
+class PhysicalCopyUpdate(BaseModel):
+    shelf: Optional[str] = Field(None, description="Location or shelf code.", example="Living room A3")
+    condition: Optional[str] = Field(None, description="New, Fine, Very good, Good, Fair or Poor.", example="Very good")
+    loaned_to: Optional[str] = Field(None, description="Who has borrowed the book. null marks it as returned.", example="Sam")
+    loaned_on: Optional[date] = Field(None, description="Date of the loan. Defaults to today when `loaned_to` is set.")
+
+class PhysicalCopy(BaseModel):
+    physical: bool = Field(..., description="True if the book is recorded as physically owned.")
+    shelf: Optional[str] = None
+    condition: Optional[str] = None
+    loaned_to: Optional[str] = None
+    loaned_on: Optional[str] = Field(None, description="YYYY-MM-DD")
+
+class PhysicalBook(BaseModel):
+    id: int
+    title: Optional[str] = None
+    authors: Optional[List[str]] = None
+    physical_copy: PhysicalCopy
+
+
+# --- Acquisition Models ---
+
+class AcquisitionUpdate(BaseModel):
+    store: Optional[str] = Field(None, example="Kobo")
+    price: Optional[float] = Field(None, ge=0, example=9.99)
+    currency: Optional[str] = Field(None, description="ISO 4217 code.", example="EUR")
+    purchase_date: Optional[date] = Field(None, example="2026-03-14")
+    drm_source: Optional[str] = Field(None, description="Store account the book was bought with (for DRM-protected purchases).", example="kobo:me@example.org")
+
+class Acquisition(BaseModel):
+    store: Optional[str] = None
+    price: Optional[float] = None
+    currency: Optional[str] = None
+    purchase_date: Optional[str] = Field(None, description="YYYY-MM-DD")
+    drm_source: Optional[str] = None
+
+class SpendingTotal(BaseModel):
+    currency: Optional[str] = None
+    total: float
+    books: int
+
+class SpendingByYear(SpendingTotal):
+    year: Optional[int] = Field(None, description="Purchase year; null for books without a purchase date.")
+
+class SpendingByStore(SpendingTotal):
+    store: Optional[str] = None
+
+class SpendingReport(BaseModel):
+    year: Optional[int] = None
+    totals: List[SpendingTotal] = Field(..., description="One row per currency; amounts in different currencies are not added up.")
+    by_year: List[SpendingByYear]
+    by_store: List[SpendingByStore]
+    unpriced_books: int = Field(..., description="Books with acquisition data but no price.")
+
+
+# --- Library Import Models ---
+
+class LibraryImportFileResult(BaseModel):
+    path: str = Field(..., description="Path of the file, relative to the imported folder.")
+    status: str = Field(..., description="'added', 'format_added' (added to an existing book as another format), 'would_add' (dry run), 'skipped' or 'failed'.")
+    book_ids: List[int] = Field(default_factory=list)
+    reason: Optional[str] = Field(None, description="Why the file was skipped or failed.")
+
+class LibraryImportResponse(BaseModel):
+    dry_run: bool
+    added: int
+    format_added: int
+    would_add: int
+    skipped: int
+    failed: int
+    ignored: int = Field(..., description="Files that are not e-books (covers, OPF files, notes).")
+    results: List[LibraryImportFileResult]
+
+
+# --- Format Models ---
+
+class FormatInfo(BaseModel):
+    name: str = Field(..., description="Format name as Calibre records it, e.g. 'AZW3'.")
+    extensions: List[str]
+    mime_type: str
+    display_name: str
+    convertible: bool = Field(..., description="Books can be converted to this format (GET /books/{id}/download?format=...).")
+
+
+# --- Send to Device Models ---
+
+class SendBookRequest(BaseModel):
+    device: str = Field(..., description="Name of a device configured in SHELFSTONE_SEND_DEVICES.", example="kindle")
+    format: Optional[str] = Field(None, description="Format to send. Defaults to the device's configured format.", example="epub")
+
+class DeviceInfo(BaseModel):
+    name: str
+    address: str
+    format: str
+
+class DeliveryStatus(BaseModel):
+    id: int
+    book_id: int
+    device: str
+    address: str
+    format: str
+    status: str = Field(..., description="queued, converting, sending, sent or failed.", example="sent")
+    error: Optional[str] = None
+    created_at: float
+    finished_at: Optional[float] = None
+
+
+# --- Conversion Policy Models ---
+
+class FormatConversionStatus(BaseModel):
+    format: str = Field(..., example="AZW3")
+    status: str = Field(..., description="pending, converted, skipped (the book already had the format) or failed.", example="converted")
+    error: Optional[str] = None
+
+class BookConversionStatus(BaseModel):
+    book_id: int
+    status: str = Field(..., description="queued, running, done or failed.", example="done")
+    error: Optional[str] = None
+    formats: List[FormatConversionStatus]
+    created_at: float
+    started_at: Optional[float] = None
+    finished_at: Optional[float] = None
+
+
+class Job(BaseModel):
+    id: int
+    name: str = Field(..., example="conversion of book ID 5")
+    priority: str = Field(..., description="interactive, normal or bulk; free Calibre command slots go to higher priorities first.", example="bulk")
+    user_id: Optional[int] = Field(None, description="Who started the job, if a user did.")
+    state: str = Field(..., description="running, or waiting for a free Calibre command slot.", example="running")
+    command: Optional[str] = Field(None, description="The Calibre command the job runs or waits to run.", example="ebook-convert")
+    started_at: float
+    cancelled: bool = False
+
+
+# --- Metadata Lookup Models ---
+
+class MetadataCandidate(BaseModel):
+    provider: str = Field(..., description="Provider the record came from, e.g. 'google' or 'openlibrary'.")
+    title: Optional[str] = None
+    authors: List[str] = Field(default_factory=list)
+    publisher: Optional[str] = None
+    pubdate: Optional[str] = Field(None, example="1965-08-01")
+    isbn: Optional[str] = None
+    identifiers: Dict[str, str] = Field(default_factory=dict, example={"google": "B1hSG45JCX4C", "isbn": "9780441172719"})
+    tags: List[str] = Field(default_factory=list)
+    comments: Optional[str] = None
+    languages: List[str] = Field(default_factory=list)
+    series: Optional[str] = None
+    series_index: Optional[float] = None
+    cover_url: Optional[str] = None
+
+class MetadataFetchRequest(BaseModel):
+    isbn: Optional[str] = Field(None, description="Look up by this ISBN. Defaults to the book's ISBN.")
+    title: Optional[str] = Field(None, description="Look up by title (and author) instead. Defaults to the book's title, used when there is no ISBN.")
+    authors: Optional[List[str]] = Field(None, description="Defaults to the book's authors.")
+    providers: Optional[List[str]] = Field(None, description="Providers to ask, in order. Defaults to SHELFSTONE_METADATA_PROVIDERS.", example=["openlibrary"])
+    limit: int = Field(5, ge=1, le=20, description="Maximum candidates per provider.")
+
+class MetadataFetchResponse(BaseModel):
+    book_id: int
+    isbn: Optional[str] = Field(None, description="The ISBN that was looked up, if any.")
+    title: Optional[str] = Field(None, description="The title that was looked up, if there was no ISBN.")
+    candidates: List[MetadataCandidate]
+    errors: Dict[str, str] = Field(default_factory=dict, description="Providers that failed, with the reason.")
+
+class MetadataApplyRequest(BaseModel):
+    candidate: MetadataCandidate
+    fields: Optional[List[str]] = Field(None, description="Fields to take from the candidate (any of the SetMetadataRequest fields, 'identifiers' and 'cover'). Defaults to every field the candidate has.", example=["title", "authors", "comments", "cover"])
+    write_to_file: bool = Field(False, description="Also write the values into the book's files with `ebook-meta`.")
+
+class MetadataApplyResponse(BaseModel):
+    message: str
+    book_id: int
+    applied_fields: List[str]
+    files_updated: List[str] = Field(default_factory=list, description="Formats whose files were updated.")
+    file_errors: Dict[str, str] = Field(default_factory=dict, description="Formats whose files could not be updated, with the reason.")
+
+
+# --- Duplicate Models ---
+
+class DuplicateGroup(BaseModel):
+    reason: str = Field(..., description="'same_file' (identical file content) or 'same_title_author' (matching normalized title and authors).")
+    key: str = Field(..., description="The shared content hash or title/author fingerprint.")
+    books: List[Book]
+
+class DuplicatesResponse(BaseModel):
+    checked: int = Field(..., description="Number of books compared.")
+    groups: List[DuplicateGroup]
+
+
+# --- Feature Flag Models ---
+
+class FeatureStatus(BaseModel):
+    name: str = Field(..., example="fulltext")
+    description: str
+    enabled: bool
+    default: bool = Field(..., description="State without config or override (experimental features follow SHELFSTONE_EXPERIMENTAL).")
+    experimental: bool
+    source: str = Field(..., description="Where the state comes from: 'override' (set at runtime), 'config' (SHELFSTONE_FEATURES) or 'default'.")
+
+class FeatureOverrideRequest(BaseModel):
+    enabled: bool
+
+
+# --- Collection Models ---
+
+class Collection(BaseModel):
+    id: int
+    name: str = Field(..., example="Currently Reading")
+    description: Optional[str] = None
+    owner_id: Optional[int] = Field(None, description="The user whose shelf this is; null for collections made without a signed-in user.")
+    book_count: int
+    created_at: float = Field(..., description="Unix timestamp.")
+    updated_at: float = Field(..., description="Unix timestamp of the last change, including added or removed books.")
+    access: Optional[str] = Field(None, description="What you may do with it: owner, collaborate (add and remove books) or read. null for admins and without accounts.")
+
+class CollectionDetail(Collection):
+    book_ids: List[int] = Field(..., description="Books in the collection, in the order they were added.")
+
+class CollectionCreateRequest(BaseModel):
+    name: str = Field(..., example="Favorites")
+    description: Optional[str] = None
+
+class CollectionUpdateRequest(BaseModel):
+    name: Optional[str] = Field(None, example="All-time favorites")
+    description: Optional[str] = None
+
+class CollectionBooksRequest(BaseModel):
+    book_ids: List[int] = Field(..., example=[12, 57])
+
+class CollectionShareRequest(BaseModel):
+    access: str = Field(..., description="read, or collaborate to let them add and remove books too.", example="collaborate")
+
+class CollectionShare(CollectionShareRequest):
+    user_id: int
+    username: Optional[str] = Field(None, description="null if the account no longer exists.")
+    created_at: float = Field(..., description="Unix timestamp.")
+
+class PublicCatalogRequest(BaseModel):
+    slug: str = Field(..., description="Its URL is /public/{slug}: 3 to 64 lowercase letters, digits and hyphens.", example="little-free-library")
+    downloads: bool = Field(False, description="Whether visitors may download the books, in the formats they have. If not, they can only browse.")
+
+class PublicCatalog(PublicCatalogRequest):
+    collection_id: int
+    url: str = Field(..., description="The public page, JSON.", example="https://books.example.org/public/little-free-library")
+    opds_url: str = Field(..., description="The OPDS feed, for reading apps.")
+    created_at: float = Field(..., description="Unix timestamp.")
+    updated_at: float = Field(..., description="Unix timestamp of the last change to the slug or downloads.")
+
+class PublicCatalogBook(BaseModel):
+    id: int
+    title: str
+    authors: List[str] = Field(default_factory=list)
+    series: Optional[str] = None
+    series_index: Optional[float] = None
+    cover_url: Optional[str] = Field(None, description="null if the book has no cover.")
+    files: Dict[str, str] = Field(default_factory=dict, description="Download URL by format; empty if the catalog doesn't offer downloads.")
+
+class PublicCatalogPage(BaseModel):
+    slug: str
+    title: str = Field(..., description="The shelf's name.")
+    description: Optional[str] = None
+    downloads: bool
+    opds_url: str
+    books: List[PublicCatalogBook] = Field(..., description="In the order they were put on the shelf.")
+
+
+# --- Book Club Models ---
+
+class Club(BaseModel):
+    id: int
+    name: str = Field(..., example="Tuesday readers")
+    description: Optional[str] = None
+    member_count: int
+    role: Optional[str] = Field(None, description="Your role in the club: organizer or member. null for admins who aren't in it.")
+    created_at: float = Field(..., description="Unix timestamp.")
+    updated_at: float = Field(..., description="Unix timestamp of the last change to the club or its schedule.")
+
+class ClubMember(BaseModel):
+    user_id: int
+    username: Optional[str] = Field(None, description="null if the account no longer exists.")
+    role: str = Field(..., example="member")
+    joined_at: float = Field(..., description="Unix timestamp.")
+
+class ClubMilestoneRequest(BaseModel):
+    title: str = Field(..., description="What to read, such as the chapters.", example="Chapters 1-5")
+    due_on: Optional[date] = Field(None, description="Read by this day (YYYY-MM-DD).", example="2026-11-03")
+
+class ClubMilestoneUpdateRequest(BaseModel):
+    title: Optional[str] = Field(None, example="Chapters 1-6")
+    due_on: Optional[date] = Field(None, description="YYYY-MM-DD; null to clear.")
+
+class ClubMilestone(BaseModel):
+    id: int
+    reading_id: int
+    position: int = Field(..., description="Order within the reading, from 1.")
+    title: str
+    due_on: Optional[str] = Field(None, description="YYYY-MM-DD")
+    comment_count: int
+
+class ClubReadingRequest(BaseModel):
+    book_id: int = Field(..., example=57)
+    starts_on: Optional[date] = Field(None, description="YYYY-MM-DD", example="2026-10-27")
+    milestones: List[ClubMilestoneRequest] = Field(default_factory=list, description="In reading order.")
+
+class ClubReading(BaseModel):
+    id: int
+    book_id: Optional[int] = Field(None, description="null once the book was removed from the library.")
+    starts_on: Optional[str] = Field(None, description="YYYY-MM-DD")
+    created_at: float = Field(..., description="Unix timestamp.")
+    milestones: List[ClubMilestone]
+
+class ClubDetail(Club):
+    members: List[ClubMember]
+    readings: List[ClubReading] = Field(..., description="The schedule, latest start first.")
+
+class ClubCreateRequest(BaseModel):
+    name: str = Field(..., example="Tuesday readers")
+    description: Optional[str] = None
+
+class ClubUpdateRequest(BaseModel):
+    name: Optional[str] = Field(None, example="Wednesday readers")
+    description: Optional[str] = None
+
+class ClubMemberRequest(BaseModel):
+    role: str = Field("member", description="member, or organizer to let them manage the club too.", example="member")
+
+class ClubCommentRequest(BaseModel):
+    body: str = Field(..., example="The dinner scene in chapter 3 changes everything.")
+    parent_id: Optional[int] = Field(None, description="The comment this answers, in the same milestone.")
+
+class ClubCommentUpdateRequest(BaseModel):
+    body: str
+
+class ClubComment(BaseModel):
+    id: int
+    milestone_id: int
+    parent_id: Optional[int] = None
+    user_id: Optional[int] = Field(None, description="null for deleted comments.")
+    username: Optional[str] = None
+    body: Optional[str] = Field(None, description="null for deleted comments, kept while they have replies.")
+    deleted: bool
+    created_at: float = Field(..., description="Unix timestamp.")
+    edited_at: Optional[float] = Field(None, description="Unix timestamp of the last edit.")
+    replies: List["ClubComment"] = Field(default_factory=list)
+
+
+# --- Browse Models ---
+
+class AuthorVariant(BaseModel):
+    id: int
+    name: str = Field(..., example="Austen, Jane")
+
+class AuthorEntry(BaseModel):
+    id: int = Field(..., description="ID of the spelling with the most books; the IDs of the variants work as well.")
+    name: str = Field(..., example="Jane Austen")
+    sort: str = Field(..., example="Austen, Jane")
+    book_count: int
+    variants: List[AuthorVariant] = Field(default_factory=list, description="Other spellings of the name merged into this entry.")
+
+class AuthorBooksResponse(BaseModel):
+    author: AuthorEntry
+    books: List[Book] = Field(..., description="By series and series index, then by title.")
+
+class SeriesEntry(BaseModel):
+    id: int
+    name: str = Field(..., example="Dune")
+    book_count: int
+    authors: List[str] = Field(..., description="Authors of the series' books, most books first.")
+
+class SeriesBooksResponse(BaseModel):
+    id: int
+    name: str
+    books: List[Book] = Field(..., description="In series order.")
+
+
+# --- Configuration Models ---
+
+class ConfigReloadResponse(BaseModel):
+    path: Optional[str] = Field(None, description="Config file that was read; null if none exists.")
+    changed: List[str] = Field(..., description="Settings whose value changed.", example=["SHELFSTONE_LOG_LEVEL"])
+    restart_required: List[str] = Field(..., description="Changed settings that are only read at startup and need a restart.")
+
+
+# --- Health Models ---
+
+class HealthResponse(BaseModel):
+    status: str = Field(..., example="ok")
+
+class ReadinessCheck(BaseModel):
+    check: str = Field(..., example="binary:calibredb")
+    status: str = Field(..., description="ok or error.", example="ok")
+    detail: str
+    fix: Optional[str] = None
+
+class ReadinessResponse(BaseModel):
+    ready: bool
+    checks: List[ReadinessCheck]
+
+
+# --- Processing Log Models ---
+
+class ProcessingLogCommand(BaseModel):
+    tool: str = Field(..., example="ebook-convert")
+    returncode: int = Field(..., description="-1 if the command timed out.")
+    duration: float = Field(..., description="Seconds.")
+    stdout: str = Field(..., description="End of the command's output.")
+    stderr: str = Field(..., description="End of the command's error output.")
+
+class ProcessingLogEntry(BaseModel):
+    id: int
+    step: str = Field(..., example="convert to EPUB on add")
+    status: str = Field(..., description="ok or failed.", example="ok")
+    detail: Optional[str] = Field(None, example="Uploaded as 'dune.mobi'.")
+    error: Optional[str] = None
+    started_at: float = Field(..., description="Unix time the step started.")
+    duration: float = Field(..., description="Seconds.")
+    commands: List[ProcessingLogCommand] = Field(..., description="Calibre commands the step ran, in order.")
+
+class ProcessingLogResponse(BaseModel):
+    book_id: int
+    entries: List[ProcessingLogEntry] = Field(..., description="Newest first.")
+
+
+# --- Account Models ---
+
+class User(BaseModel):
+    id: int
+    username: str = Field(..., example="ana")
+    email: Optional[str] = Field(None, description="Where password reset links go; null if the user gave none.", example="ana@example.org")
+    role: str = Field(..., description="user or admin.", example="user")
+    disabled: bool = False
+    created_at: float = Field(..., description="Unix timestamp.")
+    libraries: Optional[List[str]] = Field(None, description="The only libraries the user may use (\"\" for the default one); null for all.")
+    tags: Optional[List[str]] = Field(None, description="The user only sees books with one of these tags; null for all books.")
+
+class AuthStatus(BaseModel):
+    accounts_enabled: bool = Field(..., description="Whether SHELFSTONE_ACCOUNTS is on.")
+    setup_required: bool = Field(..., description="True until the first admin is created with POST /auth/setup.")
+    open_registration: bool = Field(..., description="Whether anyone may create an account with POST /auth/register.")
+    user: Optional[User] = Field(None, description="The signed-in user, if any.")
+
+class Credentials(BaseModel):
+    username: str = Field(..., example="ana")
+    password: str = Field(..., example="correct horse battery staple")
+
+class LoginResponse(BaseModel):
+    user: User
+    token: str = Field(..., description="Session token; also set as the shelfstone_session cookie.")
+    expires_at: float = Field(..., description="Unix time the session ends.")
+
+class PasswordChangeRequest(BaseModel):
+    current_password: str
+    new_password: str
+
+class AccountDeletionRequest(BaseModel):
+    current_password: str
+
+class EmailChangeRequest(BaseModel):
+    email: Optional[str] = Field(None, description="The new address; null or \"\" removes it.", example="ana@example.org")
+    current_password: str
+
+class PasswordResetRequest(BaseModel):
+    email: str = Field(..., example="ana@example.org")
+
+class PasswordResetCompletion(BaseModel):
+    new_password: str
+
+class PasswordResetCheck(BaseModel):
+    expires_at: float = Field(..., description="Unix timestamp.")
+
+class PasswordResetEvent(BaseModel):
+    id: int
+    at: float = Field(..., description="Unix timestamp.")
+    event: str = Field(..., description="requested, unknown_email, rate_limited, sent, send_failed, completed or invalid_token.")
+    user_id: Optional[int] = None
+    email: Optional[str] = Field(None, description="The address asked for, or the account's.")
+    address: Optional[str] = Field(None, description="The client's IP address.")
+    detail: Optional[str] = Field(None, description="E.g. why sending failed.")
+
+class ApiTokenCreateRequest(BaseModel):
+    name: str = Field(..., example="KOReader on the Kobo")
+
+class ApiToken(BaseModel):
+    id: int
+    name: str
+    created_at: float = Field(..., description="Unix timestamp.")
+    last_used_at: Optional[float] = Field(None, description="Unix timestamp, to the minute.")
+
+class NewApiToken(ApiToken):
+    token: str = Field(..., description="The token. It is only shown once; the server keeps a hash.")
+
+class UserCreateRequest(Credentials):
+    role: str = Field("user", description="user or admin.")
+    email: Optional[str] = Field(None, description="For password resets.", example="ana@example.org")
+    libraries: Optional[List[str]] = Field(None, description="Restrict the user to these libraries (\"\" for the default one).")
+    tags: Optional[List[str]] = Field(None, description="Restrict the user to the books with one of these tags.", example=["Kids"])
+
+class UserUpdateRequest(BaseModel):
+    role: Optional[str] = Field(None, description="user or admin.")
+    disabled: Optional[bool] = Field(None, description="Disabled users can't sign in; their sessions end.")
+    password: Optional[str] = Field(None, description="A new password; ends the user's sessions.")
+    email: Optional[str] = Field(None, description="null or \"\" removes it.")
+    libraries: Optional[List[str]] = Field(None, description="null lifts the restriction.")
+    tags: Optional[List[str]] = Field(None, description="null lifts the restriction.")
+
+class RegistrationRequest(Credentials):
+    invitation: Optional[str] = Field(None, description="Token of an invitation (POST /admin/invitations); works without open registration.")
+
+class InvitationCreateRequest(BaseModel):
+    role: str = Field("user", description="Role of the account the invitation creates: user or admin.")
+    libraries: Optional[List[str]] = Field(None, description="Restrict the account to these libraries (\"\" for the default one).")
+    tags: Optional[List[str]] = Field(None, description="Restrict the account to the books with one of these tags.", example=["Kids"])
+    note: Optional[str] = Field(None, description="Who the invitation is for.", example="Sam's kids")
+    days: float = Field(7, gt=0, le=90, description="Days until the invitation expires.")
+
+class Invitation(BaseModel):
+    id: int
+    role: str
+    libraries: Optional[List[str]] = None
+    tags: Optional[List[str]] = None
+    note: Optional[str] = None
+    created_by: Optional[int] = Field(None, description="ID of the admin who created it; null for the admin token.")
+    created_at: float = Field(..., description="Unix timestamp.")
+    expires_at: float = Field(..., description="Unix timestamp.")
+    used_at: Optional[float] = Field(None, description="Unix timestamp; null while unused.")
+    used_by: Optional[int] = Field(None, description="ID of the account registered with it.")
+
+class NewInvitation(Invitation):
+    token: str = Field(..., description="The invitation token. It is only shown once; the server keeps a hash.")
+    link: str = Field(..., description="Link to share; opening it shows whether the invitation can still be used (GET /auth/invitations/{token}).")
+
+class InvitationCheck(BaseModel):
+    role: str
+    expires_at: float = Field(..., description="Unix timestamp.")
+
+
+# --- Reading Progress Models ---
+
+class ReadingProgressUpdate(BaseModel):
+    position: Optional[str] = Field(None, description="Position in the reading app's terms, e.g. an EPUB CFI or a KOReader xpointer.", example="epubcfi(/6/14!/4/2/10:0)")
+    percentage: Optional[float] = Field(None, ge=0, le=100, description="How much of the book has been read, 0 to 100.", example=42.5)
+    page: Optional[int] = Field(None, ge=0, example=153)
+    format: Optional[str] = Field(None, description="The format being read; positions are only meaningful within one format.", example="EPUB")
+    device: Optional[str] = Field(None, description="Name of the reading device or app.", example="Kobo Libra")
+
+class ReadingProgress(ReadingProgressUpdate):
+    book_id: int
+    updated_at: float = Field(..., description="Unix timestamp.")
+    finished_at: Optional[float] = Field(None, description="Unix timestamp of when the percentage first reached 100; null until then.")
+
+class BookmarkCreateRequest(BaseModel):
+    position: str = Field(..., description="Position in the reading app's terms.", example="epubcfi(/6/14!/4/2/10:0)")
+    percentage: Optional[float] = Field(None, ge=0, le=100, example=42.5)
+    page: Optional[int] = Field(None, ge=0, example=153)
+    format: Optional[str] = Field(None, example="EPUB")
+    note: Optional[str] = Field(None, example="The litany against fear")
+
+class BookmarkUpdateRequest(BaseModel):
+    position: Optional[str] = None
+    percentage: Optional[float] = Field(None, ge=0, le=100)
+    page: Optional[int] = Field(None, ge=0)
+    format: Optional[str] = None
+    note: Optional[str] = None
+
+class Bookmark(BookmarkCreateRequest):
+    id: int
+    book_id: int
+    created_at: float = Field(..., description="Unix timestamp.")
+    updated_at: float = Field(..., description="Unix timestamp.")
+
+
+# --- Download Log Models ---
+
+class Download(BaseModel):
+    id: int
+    book_id: int
+    title: Optional[str] = Field(None, description="The title at the time of the download.")
+    format: str = Field(..., example="EPUB")
+    converted: bool = Field(..., description="Whether a converted copy was served.")
+    client: str = Field(..., description="KOReader, Kobo, Kindle, PocketBook, Calibre, Thorium, browser or other, from the User-Agent.", example="KOReader")
+    user_agent: Optional[str] = None
+    downloaded_at: float = Field(..., description="Unix timestamp.")
+
+class DownloadHistory(BaseModel):
+    total: int = Field(..., description="All downloads in the history, not just this page.")
+    downloads: List[Download] = Field(..., description="Newest first.")
+
+class UserDownloadCount(BaseModel):
+    user_id: Optional[int] = Field(None, description="null for downloads with the admin token or before accounts were on.")
+    username: Optional[str] = None
+    count: int
+
+class ClientDownloadCount(BaseModel):
+    client: str
+    count: int
+
+class FormatDownloadCount(BaseModel):
+    format: str
+    count: int
+
+class BookDownloadCount(BaseModel):
+    book_id: int
+    title: Optional[str] = None
+    count: int
+
+class DownloadReport(BaseModel):
+    total: int
+    users: List[UserDownloadCount] = Field(..., description="Most downloads first.")
+    clients: List[ClientDownloadCount]
+    formats: List[FormatDownloadCount]
+    books: List[BookDownloadCount] = Field(..., description="The most downloaded books.")
+
+
+# --- Rating Models ---
+
+class RatingRequest(BaseModel):
+    rating: int = Field(..., ge=1, le=5, description="Stars, 1 to 5.", example=4)
+    review: Optional[str] = Field(None, example="Slow start, great ending.")
+
+class Rating(RatingRequest):
+    rating: Optional[int] = Field(None, description="Stars, 1 to 5; null where the user keeps their ratings private.", example=4)
+    review: Optional[str] = Field(None, description="null without a review, or where the user keeps their reviews private.", example="Slow start, great ending.")
+    id: int
+    user_id: int
+    username: Optional[str] = Field(None, description="null if the account no longer exists.")
+    book_id: int
+    created_at: float = Field(..., description="Unix timestamp.")
+    updated_at: float = Field(..., description="Unix timestamp.")
+    reactions: Optional[Dict[str, int]] = Field(None, description="How many users reacted to the review with each emoji; null if nobody did.", example={"👍": 2})
+
+class BookRatings(BaseModel):
+    book_id: int
+    count: int = Field(..., description="Ratings whose stars you may see.")
+    average: Optional[float] = Field(None, description="Average of those stars; null without any.", example=4.2)
+    ratings: List[Rating] = Field(..., description="Most recently changed first.")
+
+class BookReader(BaseModel):
+    user_id: int
+    username: Optional[str] = None
+    percentage: Optional[float] = Field(None, description="How much of the book they read, 0 to 100, if their app says.", example=42.5)
+    updated_at: float = Field(..., description="Unix timestamp of their last progress.")
+    finished_at: Optional[float] = Field(None, description="Unix timestamp of when they finished the book; null while reading.")
+
+class BookReaders(BaseModel):
+    book_id: int
+    reading: int = Field(..., description="Readers who haven't finished the book yet.")
+    finished: int = Field(..., description="Readers who finished it.")
+    readers: List[BookReader] = Field(..., description="Most recently read first.")
+
+class Reactions(BaseModel):
+    counts: Dict[str, int] = Field(..., description="How many users reacted with each emoji, only those given.", example={"👍": 3, "😴": 1})
+    mine: List[str] = Field(..., description="The emoji you reacted with.", example=["👍"])
+
+
+# --- Book Comment Models ---
+
+class BookCommentRequest(BaseModel):
+    body: str = Field(..., description="Mention users as @username to notify them.", example="@sam you'll love the ending.")
+    parent_id: Optional[int] = Field(None, description="The comment of the same book this answers.")
+
+class BookCommentUpdateRequest(BaseModel):
+    body: str
+
+class CommentMention(BaseModel):
+    user_id: int
+    username: Optional[str] = None
+
+class BookComment(BaseModel):
+    id: int
+    book_id: int
+    parent_id: Optional[int] = None
+    user_id: Optional[int] = Field(None, description="null for deleted comments.")
+    username: Optional[str] = None
+    body: Optional[str] = Field(None, description="null for deleted comments, kept while they have replies.")
+    deleted: bool
+    mentions: List[CommentMention] = Field(default_factory=list, description="The users the comment mentions.")
+    created_at: float = Field(..., description="Unix timestamp.")
+    edited_at: Optional[float] = Field(None, description="Unix timestamp of the last edit.")
+    replies: List["BookComment"] = Field(default_factory=list)
+
+class BookComments(BaseModel):
+    book_id: int
+    count: int = Field(..., description="Comments not deleted, replies included.")
+    comments: List[BookComment] = Field(..., description="Threads, oldest first.")
+
+
+# --- Wishlist Models ---
+
+class WishCreateRequest(BaseModel):
+    title: str = Field(..., example="The Left Hand of Darkness")
+    authors: Optional[str] = Field(None, example="Ursula K. Le Guin")
+    isbn: Optional[str] = Field(None, description="ISBN-10 or ISBN-13; stored as ISBN-13.", example="9780441478125")
+    note: Optional[str] = Field(None, example="Recommended by Sam")
+    book_id: Optional[int] = Field(None, description="The book, once the library has it.")
+
+class WishUpdateRequest(BaseModel):
+    title: Optional[str] = None
+    authors: Optional[str] = None
+    isbn: Optional[str] = None
+    note: Optional[str] = None
+    book_id: Optional[int] = Field(None, description="null unlinks the entry from the book.")
+
+class Wish(WishCreateRequest):
+    id: int
+    created_at: float = Field(..., description="Unix timestamp.")
+    updated_at: float = Field(..., description="Unix timestamp.")
+
+
+# --- Preference Models ---
+
+class Preferences(BaseModel):
+    default_sort: Optional[str] = Field(None, description="Order of GET /books/: title, author, added, published or rating. null for calibredb's order.", example="added")
+    download_format: Optional[str] = Field(None, description="Format offered first in downloads and the OPDS catalog.", example="EPUB")
+    items_per_page: Optional[int] = Field(None, description="Page size of GET /books/ and OPDS feeds. null for all books and 50 per feed page.", example=25)
+    theme: Optional[str] = Field("system", description="system, light or dark; for clients.")
+    digest_frequency: Optional[str] = Field("never", description="never, daily, weekly or monthly; for clients.")
+    languages: Optional[List[str]] = Field(None, description="Only show books in these languages (ISO 639 codes) in the OPDS catalog; books without a language are always shown.", example=["eng", "deu"])
+
+
+# --- Privacy and Activity Models ---
+
+class PrivacySettings(BaseModel):
+    activity: bool = Field(True, description="Show what you do (books you add, reviews, shelves, books finished) in the other users' activity feed.")
+    reading_status: bool = Field(True, description="Show which books you are reading or finished, with the books' readers and in the activity feed.")
+    ratings: bool = Field(True, description="Show your stars with the books' ratings and their average, and with your reviews in the activity feed.")
+    reviews: bool = Field(True, description="Show the text of your reviews with the books' ratings and in the activity feed.")
+
+class PrivacyUpdateRequest(BaseModel):
+    activity: Optional[bool] = None
+    reading_status: Optional[bool] = None
+    ratings: Optional[bool] = None
+    reviews: Optional[bool] = None
+
+class ActivityEvent(BaseModel):
+    kind: str = Field(..., description="book_added, review_posted, shelf_created or book_finished.", example="review_posted")
+    at: float = Field(..., description="Unix timestamp.")
+    user_id: Optional[int] = Field(None, description="Who did it; null for books the server added by itself.")
+    username: Optional[str] = None
+    book_id: Optional[int] = None
+    title: Optional[str] = Field(None, description="The book's title.", example="Dune")
+    source: Optional[str] = Field(None, description="How the book was added (book_added).", example="upload")
+    rating_id: Optional[int] = Field(None, description="The rating with the review (review_posted).")
+    rating: Optional[int] = Field(None, description="Stars (review_posted).", example=4)
+    review: Optional[str] = Field(None, description="The review (review_posted).")
+    collection_id: Optional[int] = Field(None, description="The shelf (shelf_created).")
+    collection_name: Optional[str] = None
+
+
+# --- Notification Models ---
+
+class Notification(BaseModel):
+    id: int
+    kind: str = Field(..., description="followed_book, conversion_done, conversion_failed, delivery_sent, delivery_failed, upload_failed, shelf_books_added or mentioned.", example="conversion_done")
+    title: str = Field(..., example="Converted 'Dune' to EPUB, AZW3")
+    body: Optional[str] = Field(None, description="Details, e.g. the error of a failure.")
+    book_id: Optional[int] = Field(None, description="The book it is about, if any; null once the book is removed.")
+    library: Optional[str] = Field(None, description="Library of `book_id`.")
+    read: bool
+    created_at: float = Field(..., description="Unix timestamp.")
+    read_at: Optional[float] = Field(None, description="Unix timestamp; null while unread.")
+
+class NotificationList(BaseModel):
+    total: int = Field(..., description="Notifications matching the request, across all pages.")
+    unread: int = Field(..., description="All your unread notifications.")
+    notifications: List[Notification] = Field(..., description="Newest first.")
+
+class NotificationCount(BaseModel):
+    unread: int
+
+class NotificationsReadRequest(BaseModel):
+    ids: Optional[List[int]] = Field(None, description="The notifications to mark as read; all of them if left out.")
+
+class NotificationUpdateRequest(BaseModel):
+    read: bool
+
+
+# --- Follow Models ---
+
+class FollowRequest(BaseModel):
+    kind: str = Field(..., description="author or series.", example="author")
+    name: str = Field(..., description="As Calibre has it; matched case-insensitively.", example="Ursula K. Le Guin")
+    email: bool = Field(False, description="Email you about new books too, if you gave an email address.")
+
+class FollowUpdateRequest(BaseModel):
+    email: bool
+
+class Follow(FollowRequest):
+    id: int
+    created_at: float = Field(..., description="Unix timestamp.")
@@ -0,0 +1,179 @@
+"""
+Server-side news downloads, mirroring Calibre's "Fetch news": an issue is downloaded with
+a news recipe, added to the library tagged "News", and issues beyond the configured number
+are removed again, oldest first.
+
+There is no built-in scheduler; run the command-line entry point from cron
+(run from the calibre_api directory):
+
+    python -m app.news "The Guardian" --keep 7 [--library "/root/Calibre Library"]
+"""
+import argparse
+import json
+import os
+import re
+import shutil
+import sys
+import tempfile
+import logging
+from typing import Any, Dict, List, Optional
+
+from . import calibre_cli
+from . import processing_log
+from . import provenance
+from .crud import add_book, list_books, remove_book
+
+logger = logging.getLogger(__name__)
+
+NEWS_TAG = "News"
+# Each issue carries the recipe it came from as an identifier of this type,
+# so expiry only removes older issues of the same periodical.
+IDENTIFIER_TYPE = "news"
+DEFAULT_KEEP_ISSUES = 7
+DEFAULT_OUTPUT_FORMAT = "epub"
+OUTPUT_FORMATS = {"epub", "mobi", "azw3", "pdf"}
+
+
+def custom_recipes_enabled() -> bool:
+    """
+    Custom recipes are Python code that ebook-convert runs, so uploading them to the server is
+    off unless SHELFSTONE_ENABLE_CUSTOM_RECIPES is set to 1/true/yes. Built-in recipes and
+    recipe files given to the command-line entry point are always allowed.
+    """
+    return os.environ.get("SHELFSTONE_ENABLE_CUSTOM_RECIPES", "").strip().lower() in ("1", "true", "yes")
+
+
+def validate_recipe_name(recipe: str) -> str:
+    """
+    Checks the title of a built-in recipe, or the name of an uploaded one: it becomes an
+    ebook-convert argument, so it must not be a path or look like an option.
+
+    Raises:
+        ValueError: If the name is empty, contains a path separator or starts with "-".
+    """
+    name = (recipe or "").strip()
+    if not name or name.startswith("-") or "/" in name or "\\" in name or "\0" in name:
+        raise ValueError(f"Invalid recipe name '{recipe}'. Use the title of a built-in recipe, without path separators.")
+    return name
+
+
+def recipe_slug(recipe: str) -> str:
+    """
+    Returns a stable identifier value for a recipe, e.g. "The Guardian" -> "the-guardian".
+
+    Raises:
+        ValueError: If the name has no letters or digits.
+    """
+    name = os.path.basename(recipe)
+    if name.endswith(".recipe"):
+        name = name[:-len(".recipe")]
+    slug = re.sub(r"[^a-z0-9]+", "-", name.lower()).strip("-")
+    if not slug:
+        raise ValueError(f"Invalid recipe name '{recipe}'.")
+    return slug
+
+
+def list_issues(slug: str, library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """
+    Returns the library's issues of a recipe, newest (highest ID) first.
+    """
+    books = list_books(library_path=library_path, search_query=f'identifiers:"={IDENTIFIER_TYPE}:={slug}"')
+    issues = [b for b in books if (b.get("identifiers") or {}).get(IDENTIFIER_TYPE) == slug]
+    return sorted(issues, key=lambda b: b.get("id") or 0, reverse=True)
+
+
+def expire_issues(slug: str, keep_issues: int, library_path: Optional[str] = None) -> List[int]:
+    """
+    Removes all but the newest `keep_issues` issues of a recipe. Returns the removed book IDs.
+    """
+    if keep_issues < 1:
+        raise ValueError("keep_issues must be at least 1.")
+    removed = []
+    for book in list_issues(slug, library_path=library_path)[keep_issues:]:
+        remove_book(book["id"], library_path=library_path)
+        removed.append(book["id"])
+    if removed:
+        logger.info(f"Expired {len(removed)} old issue(s) of news recipe '{slug}': {removed}")
+    return removed
+
+
+def fetch_news(
+    recipe: str,
+    library_path: Optional[str] = None,
+    keep_issues: int = DEFAULT_KEEP_ISSUES,
+    output_format: str = DEFAULT_OUTPUT_FORMAT,
+    recipe_file: Optional[str] = None,
+    options: Optional[List[str]] = None,
+) -> Dict[str, Any]:
+    """
+    Downloads the current issue of a recipe, adds it to the library and expires old issues.
+
+    Args:
+        recipe: Title of a built-in Calibre recipe, or the name of the custom recipe in `recipe_file`.
+        recipe_file: Path to a custom .recipe file; `recipe` then only names the periodical.
+            Without it, `recipe` must be a valid built-in recipe title (see validate_recipe_name).
+        keep_issues: Number of issues of this recipe to keep, including the new one.
+
+    Returns:
+        {"recipe": slug, "added_book_ids": [...], "removed_book_ids": [...]}
+
+    Raises:
+        ValueError: For invalid arguments.
+        FileNotFoundError: If a Calibre tool is not found.
+        CalibreCLIError: If the download fails.
+        CalibredbError: If adding or removing books fails.
+    """
+    if recipe_file is None:
+        recipe = validate_recipe_name(recipe)
+    slug = recipe_slug(recipe)
+    output_format = output_format.lower().lstrip(".")
+    if output_format not in OUTPUT_FORMATS:
+        raise ValueError(f"Unsupported output format '{output_format}'. Use one of: {', '.join(sorted(OUTPUT_FORMATS))}.")
+    if keep_issues < 1:
+        raise ValueError("keep_issues must be at least 1.")
+
+    work_dir = tempfile.mkdtemp(prefix="shelfstone_server_news_")
+    try:
+        output_file = os.path.join(work_dir, f"{slug}.{output_format}")
+        # The log shows the download's output too, though only once the issue is in the library.
+        with processing_log.step("add news issue", library_path=library_path) as log:
+            log["detail"] = f"Downloaded with recipe '{slug}'."
+            calibre_cli.fetch_news_recipe(recipe_file or recipe, output_file, options=options)
+            # Recipes set their own dated title ("The Guardian [Fri, 16 Oct 2026]"), so it is kept.
+            # Every issue is added, even if it looks like a duplicate of the previous one.
+            added_ids = add_book(
+                output_file,
+                library_path=library_path,
+                duplicates=True,
+                tags=NEWS_TAG,
+                identifiers={IDENTIFIER_TYPE: slug},
+            )
+            log["book_ids"] = added_ids
+        provenance.record(added_ids, provenance.NEWS, detail=slug, library_path=library_path)
+    finally:
+        shutil.rmtree(work_dir, ignore_errors=True)
+
+    removed_ids = expire_issues(slug, keep_issues, library_path=library_path)
+    return {"recipe": slug, "added_book_ids": added_ids, "removed_book_ids": removed_ids}
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    parser = argparse.ArgumentParser(
+        prog="python -m app.news",
+        description="Download a news issue into the Calibre library and expire old issues.",
+    )
+    parser.add_argument("recipe", help="Title of a built-in Calibre recipe, or a path to a .recipe file.")
+    parser.add_argument("--keep", type=int, default=DEFAULT_KEEP_ISSUES, help="Number of issues to keep (default: %(default)s).")
+    parser.add_argument("--format", default=DEFAULT_OUTPUT_FORMAT, help="Output format (default: %(default)s).")
+    parser.add_argument("--library", help="Path to the Calibre library. Defaults to calibredb's default library.")
+    args = parser.parse_args(argv)
+
+    recipe_file = args.recipe if args.recipe.endswith(".recipe") else None
+    result = fetch_news(args.recipe, library_path=args.library, keep_issues=args.keep,
+                        output_format=args.format, recipe_file=recipe_file)
+    print(json.dumps(result))
+    return 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,229 @@
+"""
+Per-user notification inbox: messages the server generates for a user, such as a new book by an
+author they follow, a finished conversion or delivery, a failed upload, books added to a shelf
+shared with them, or a mention in a comment. Needs user accounts (see accounts).
+
+Notifications are only stored here; clients show them from GET /me/notifications and its unread
+count. Sending them elsewhere (email and the like) is up to the feature raising them, so the inbox
+works whether or not any other channel is configured. Each user keeps their newest
+MAX_PER_USER notifications, in a small SQLite database (SHELFSTONE_NOTIFICATIONS_DB, in the
+state directory by default; see state_store).
+"""
+import logging
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, List, Optional
+
+from . import state_store
+from .state_store import library_key as _library_key
+
+logger = logging.getLogger(__name__)
+
+_lock = threading.Lock()
+
+MAX_PER_USER = 500
+MAX_TEXT_LENGTH = 2000
+
+# Kinds of notifications.
+FOLLOWED_BOOK = "followed_book"
+CONVERSION_DONE = "conversion_done"
+CONVERSION_FAILED = "conversion_failed"
+DELIVERY_SENT = "delivery_sent"
+DELIVERY_FAILED = "delivery_failed"
+UPLOAD_FAILED = "upload_failed"
+SHELF_BOOKS_ADDED = "shelf_books_added"
+MENTIONED = "mentioned"
+KINDS = (FOLLOWED_BOOK, CONVERSION_DONE, CONVERSION_FAILED, DELIVERY_SENT, DELIVERY_FAILED, UPLOAD_FAILED, SHELF_BOOKS_ADDED,
+         MENTIONED)
+
+
+class NotificationNotFound(Exception):
+    """The user has no notification with this ID."""
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: notifications; read_at is NULL while unread.
+    (
+        "CREATE TABLE notifications ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, kind TEXT NOT NULL, title TEXT NOT NULL, "
+        "body TEXT, library TEXT, book_id INTEGER, created_at REAL NOT NULL, read_at REAL)",
+        "CREATE INDEX notifications_user ON notifications (user_id, id)",
+        "CREATE INDEX notifications_unread ON notifications (user_id, read_at)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_NOTIFICATIONS_DB", "notifications.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+_COLUMNS = ("id", "kind", "title", "body", "library", "book_id", "created_at", "read_at")
+_SELECT = f"SELECT {', '.join(_COLUMNS)} FROM notifications"
+
+
+def _row(row: tuple) -> Dict[str, Any]:
+    notification = dict(zip(_COLUMNS, row))
+    notification["read"] = notification["read_at"] is not None
+    return notification
+
+
+def _get(conn: sqlite3.Connection, user_id: int, notification_id: int) -> Dict[str, Any]:
+    row = conn.execute(f"{_SELECT} WHERE id = ? AND user_id = ?", (notification_id, user_id)).fetchone()
+    if row is None:
+        raise NotificationNotFound(f"Notification {notification_id} not found.")
+    return _row(row)
+
+
+def notify(user_id: Optional[int], kind: str, title: str, body: Optional[str] = None,
+           book_id: Optional[int] = None, library_path: Optional[str] = None) -> Optional[Dict[str, Any]]:
+    """
+    Puts a notification in the user's inbox and returns it. Best effort, like provenance.record:
+    does nothing without a user (no accounts, or the admin token), and logs instead of raising, so
+    a broken inbox never fails the work that raised the notification.
+    """
+    if user_id is None:
+        return None
+    if kind not in KINDS:
+        raise ValueError(f"Unknown notification kind '{kind}'.")
+    try:
+        with _lock:
+            conn = connect()
+            try:
+                with conn:
+                    notification_id = conn.execute(
+                        "INSERT INTO notifications (user_id, kind, title, body, library, book_id, created_at) "
+                        "VALUES (?, ?, ?, ?, ?, ?, ?)",
+                        (user_id, kind, title[:MAX_TEXT_LENGTH], body[:MAX_TEXT_LENGTH] if body else None,
+                         _library_key(library_path) if book_id is not None else None, book_id, time.time())).lastrowid
+                    conn.execute("DELETE FROM notifications WHERE user_id = ? AND id NOT IN "
+                                 "(SELECT id FROM notifications WHERE user_id = ? ORDER BY id DESC LIMIT ?)",
+                                 (user_id, user_id, MAX_PER_USER))
+                return _get(conn, user_id, notification_id)
+            finally:
+                conn.close()
+    except (sqlite3.Error, OSError) as e:
+        logger.error(f"Could not store a '{kind}' notification for user {user_id}: {e}")
+        return None
+
+
+def unread_count(user_id: int) -> int:
+    if not os.path.exists(db_path()):
+        return 0
+    with _lock:
+        conn = connect()
+        try:
+            return conn.execute("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL",
+                                (user_id,)).fetchone()[0]
+        finally:
+            conn.close()
+
+
+def list_notifications(user_id: int, unread_only: bool = False, limit: int = 50, offset: int = 0) -> Dict[str, Any]:
+    """A page of the user's notifications, newest first, with the total and unread counts."""
+    if not os.path.exists(db_path()):
+        return {"total": 0, "unread": 0, "notifications": []}
+    where = "WHERE user_id = ?" + (" AND read_at IS NULL" if unread_only else "")
+    with _lock:
+        conn = connect()
+        try:
+            total = conn.execute(f"SELECT COUNT(*) FROM notifications {where}", (user_id,)).fetchone()[0]
+            unread = conn.execute("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL",
+                                  (user_id,)).fetchone()[0]
+            rows = conn.execute(f"{_SELECT} {where} ORDER BY id DESC LIMIT ? OFFSET ?",
+                                (user_id, limit, offset)).fetchall()
+        finally:
+            conn.close()
+    return {"total": total, "unread": unread, "notifications": [_row(row) for row in rows]}
+
+
+def mark_read(user_id: int, notification_ids: Optional[List[int]] = None) -> int:
+    """Marks the given notifications, or all of the user's, as read; returns how many were unread."""
+    if not os.path.exists(db_path()):
+        return 0
+    where, params = "WHERE user_id = ? AND read_at IS NULL", [user_id]
+    if notification_ids is not None:
+        if not notification_ids:
+            return 0
+        where += f" AND id IN ({', '.join('?' * len(notification_ids))})"
+        params += notification_ids
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                return conn.execute(f"UPDATE notifications SET read_at = ? {where}", (time.time(), *params)).rowcount
+        finally:
+            conn.close()
+
+
+def set_read(user_id: int, notification_id: int, read: bool) -> Dict[str, Any]:
+    """
+    Marks one notification as read or unread again.
+
+    Raises:
+        NotificationNotFound: If the user has no such notification.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            notification = _get(conn, user_id, notification_id)
+            if notification["read"] != read:
+                with conn:
+                    conn.execute("UPDATE notifications SET read_at = ? WHERE id = ?",
+                                 (time.time() if read else None, notification_id))
+            return _get(conn, user_id, notification_id)
+        finally:
+            conn.close()
+
+
+def delete_notification(user_id: int, notification_id: int) -> None:
+    """
+    Raises:
+        NotificationNotFound: If the user has no such notification.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, user_id, notification_id)
+            with conn:
+                conn.execute("DELETE FROM notifications WHERE id = ?", (notification_id,))
+        finally:
+            conn.close()
+
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Unlinks notifications from deleted books; the messages stay."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("UPDATE notifications SET book_id = NULL, library = NULL WHERE library = ? AND book_id = ?",
+                                 [(_library_key(library_path), book_id) for book_id in book_ids])
+        finally:
+            conn.close()
+
+
+def forget_user(user_id: int) -> None:
+    """Removes a deleted user's notifications."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM notifications WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
+
+
+def export_user(user_id: int) -> List[Dict[str, Any]]:
+    """All of the user's notifications, for an account export."""
+    return list_notifications(user_id, limit=MAX_PER_USER)["notifications"]
@@ -0,0 +1,236 @@
+"""
+OPDS 1.2 catalog for reading apps (KOReader, Moon+ Reader, Thorium, Calibre's own OPDS
+client): navigation feeds for authors and series, acquisition feeds for recent additions,
+search results and the books of an author or series, and an OpenSearch description. Published
+shelves (see book_collections) get a feed of their own that never links into the rest.
+
+Book files are served by GET /books/{id}/file/{format} and covers by GET /books/{id}/cover. All links are absolute, built from
+SHELFSTONE_PUBLIC_URL when set, so the catalog works behind a reverse proxy with a path prefix.
+The catalog's own texts are rendered in the requested language (see opds_i18n).
+"""
+from collections import Counter
+from datetime import datetime, timezone
+from typing import Any, Dict, List, Optional, Tuple
+from urllib.parse import quote, urlencode
+from xml.sax.saxutils import escape as xml_escape, quoteattr
+
+from . import formats as format_registry
+from .crud import as_list
+from .localeformat import sort_key
+from .opds_i18n import DEFAULT_LANGUAGE, text
+
+DEFAULT_PAGE_SIZE = 50
+
+NAVIGATION_TYPE = "application/atom+xml;profile=opds-catalog;kind=navigation"
+ACQUISITION_TYPE = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+OPENSEARCH_TYPE = "application/opensearchdescription+xml"
+
+
+def now_iso() -> str:
+    return datetime.now(timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+
+
+def feed_url(base_url: str, path: str, library_path: Optional[str] = None, **params) -> str:
+    """Absolute URL of a catalog page; library_path is carried along so links stay in the same library."""
+    query = {k: v for k, v in params.items() if v is not None}
+    if library_path:
+        query["library_path"] = library_path
+    url = f"{base_url.rstrip('/')}{path}"
+    return f"{url}?{urlencode(query)}" if query else url
+
+
+def _link(rel: str, href: str, link_type: str, title: Optional[str] = None) -> str:
+    title_attr = f" title={quoteattr(title)}" if title else ""
+    return f"<link rel={quoteattr(rel)} href={quoteattr(href)} type={quoteattr(link_type)}{title_attr}/>"
+
+
+def render_feed(feed_id: str, title: str, updated: str, links: List[str], entries: List[str],
+                language: str = DEFAULT_LANGUAGE) -> str:
+    return "\n".join([
+        '<?xml version="1.0" encoding="utf-8"?>',
+        '<feed xmlns="http://www.w3.org/2005/Atom" xmlns:dc="http://purl.org/dc/terms/" '
+        'xmlns:opds="http://opds-spec.org/2010/catalog" xmlns:opensearch="http://a9.com/-/spec/opensearch/1.1/" '
+        f'xml:lang={quoteattr(language)}>',
+        f"<id>{xml_escape(feed_id)}</id>",
+        f"<title>{xml_escape(title)}</title>",
+        f"<updated>{updated}</updated>",
+        "<author><name>Shelfstone</name></author>",
+        *links,
+        *entries,
+        "</feed>",
+    ]) + "\n"
+
+
+def navigation_entry(entry_id: str, title: str, href: str, content: str, updated: str,
+                     link_type: str = ACQUISITION_TYPE) -> str:
+    return (
+        f"<entry><id>{xml_escape(entry_id)}</id><title>{xml_escape(title)}</title><updated>{updated}</updated>"
+        f'<content type="text">{xml_escape(content)}</content>{_link("subsection", href, link_type)}</entry>'
+    )
+
+
+def book_entry(book: Dict[str, Any], base_url: str, library_path: Optional[str], updated: str,
+               preferred_format: Optional[str] = None, books_path: str = "/books", downloads: bool = True) -> str:
+    """
+    An acquisition entry with one download link per format (unless `downloads` is off) and the
+    cover, served under `books_path`. The preferred format's link comes first, since many reading
+    apps download the first one.
+    """
+    book_id = book["id"]
+    parts = [
+        "<entry>",
+        f"<id>urn:uuid:{xml_escape(str(book.get('uuid') or book_id))}</id>",
+        f"<title>{xml_escape(book.get('title') or 'Untitled')}</title>",
+    ]
+    for author in as_list(book.get("authors"), "authors"):
+        parts.append(f"<author><name>{xml_escape(author)}</name></author>")
+    parts.append(f"<updated>{xml_escape(str(book.get('last_modified') or updated))}</updated>")
+    if book.get("pubdate"):
+        parts.append(f"<dc:issued>{xml_escape(str(book['pubdate'])[:10])}</dc:issued>")
+    for language in as_list(book.get("languages")):
+        parts.append(f"<dc:language>{xml_escape(language)}</dc:language>")
+    if book.get("publisher"):
+        parts.append(f"<dc:publisher>{xml_escape(book['publisher'])}</dc:publisher>")
+    for tag in as_list(book.get("tags")):
+        parts.append(f"<category term={quoteattr(tag)} label={quoteattr(tag)}/>")
+    summary = book.get("series") and f"{book['series']} [{book.get('series_index') or 1}]"
+    if summary:
+        parts.append(f"<summary>{xml_escape(summary)}</summary>")
+    if book.get("cover"):
+        parts.append(_link("http://opds-spec.org/image", feed_url(base_url, f"{books_path}/{book_id}/cover", library_path), "image/jpeg"))
+        thumbnail = feed_url(base_url, f"{books_path}/{book_id}/cover", library_path, size="small")
+        parts.append(_link("http://opds-spec.org/image/thumbnail", thumbnail, "image/jpeg"))
+    book_formats = [path.rsplit(".", 1)[-1].upper() if "." in path else path.upper() for path in as_list(book.get("formats"))]
+    for fmt in sorted(book_formats, key=lambda f: f != preferred_format) if downloads else []:
+        href = feed_url(base_url, f"{books_path}/{book_id}/file/{fmt.lower()}", library_path)
+        parts.append(_link("http://opds-spec.org/acquisition", href, format_registry.mime_type(fmt), format_registry.display_name(fmt)))
+    parts.append("</entry>")
+    return "".join(parts)
+
+
+def paginate(items: List[Any], page: int, per_page: int) -> Tuple[List[Any], bool]:
+    start = (page - 1) * per_page
+    return items[start:start + per_page], len(items) > start + per_page
+
+
+def _page_links(base_url: str, path: str, library_path: Optional[str], kind: str,
+                page: int = 1, has_next: bool = False, **params) -> List[str]:
+    links = []
+    if page > 1:
+        links.append(_link("first", feed_url(base_url, path, library_path, **params), kind))
+        links.append(_link("previous", feed_url(base_url, path, library_path, page=page - 1 if page > 2 else None, **params), kind))
+    if has_next:
+        links.append(_link("next", feed_url(base_url, path, library_path, page=page + 1, **params), kind))
+    return links
+
+
+def _navigation_links(base_url: str, path: str, library_path: Optional[str], kind: str, title: str,
+                      page: int = 1, has_next: bool = False, language: str = DEFAULT_LANGUAGE, **params) -> List[str]:
+    return [
+        _link("self", feed_url(base_url, path, library_path, page=page if page > 1 else None, **params), kind, title),
+        _link("start", feed_url(base_url, "/opds", library_path), NAVIGATION_TYPE, text(language, "home")),
+        _link("search", feed_url(base_url, "/opds/search.xml", library_path), OPENSEARCH_TYPE, text(language, "search")),
+        *_page_links(base_url, path, library_path, kind, page, has_next, **params),
+    ]
+
+
+def root_feed(base_url: str, library_path: Optional[str] = None, title: Optional[str] = None,
+              language: str = DEFAULT_LANGUAGE) -> str:
+    title = title or text(language, "library")
+    updated = now_iso()
+    entries = [
+        navigation_entry("urn:shelfstone:recent", text(language, "recent"), feed_url(base_url, "/opds/recent", library_path),
+                         text(language, "recent_content"), updated),
+        navigation_entry("urn:shelfstone:authors", text(language, "authors"), feed_url(base_url, "/opds/authors", library_path),
+                         text(language, "authors_content"), updated, NAVIGATION_TYPE),
+        navigation_entry("urn:shelfstone:series", text(language, "series"), feed_url(base_url, "/opds/series", library_path),
+                         text(language, "series_content"), updated, NAVIGATION_TYPE),
+    ]
+    links = _navigation_links(base_url, "/opds", library_path, NAVIGATION_TYPE, title, language=language)
+    return render_feed("urn:shelfstone:root", title, updated, links, entries, language)
+
+
+def books_feed(books: List[Dict[str, Any]], feed_id: str, title: str, base_url: str, path: str,
+               library_path: Optional[str] = None, page: int = 1, per_page: int = DEFAULT_PAGE_SIZE,
+               language: str = DEFAULT_LANGUAGE, preferred_format: Optional[str] = None, **params) -> str:
+    """An acquisition feed of one page of `books`, in the given order."""
+    updated = now_iso()
+    page_books, has_next = paginate(books, page, per_page)
+    links = _navigation_links(base_url, path, library_path, ACQUISITION_TYPE, title, page, has_next, language, **params)
+    links.append(f"<opensearch:totalResults>{len(books)}</opensearch:totalResults>")
+    links.append(f"<opensearch:itemsPerPage>{per_page}</opensearch:itemsPerPage>")
+    entries = [book_entry(book, base_url, library_path, updated, preferred_format) for book in page_books]
+    return render_feed(feed_id, title, updated, links, entries, language)
+
+
+def public_feed(books: List[Dict[str, Any]], slug: str, title: str, base_url: str, page: int = 1,
+                per_page: int = DEFAULT_PAGE_SIZE, language: str = DEFAULT_LANGUAGE, downloads: bool = False) -> str:
+    """
+    The acquisition feed of a published shelf: one page of its books, in the given order. It is its
+    own start page and links only to the shelf's covers and, if it offers downloads, files.
+    """
+    updated = now_iso()
+    path = f"/public/{quote(slug, safe='')}"
+    page_books, has_next = paginate(books, page, per_page)
+    links = [
+        _link("self", feed_url(base_url, f"{path}/opds", None, page=page if page > 1 else None), ACQUISITION_TYPE, title),
+        _link("start", feed_url(base_url, f"{path}/opds", None), ACQUISITION_TYPE, title),
+        *_page_links(base_url, f"{path}/opds", None, ACQUISITION_TYPE, page, has_next),
+        f"<opensearch:totalResults>{len(books)}</opensearch:totalResults>",
+        f"<opensearch:itemsPerPage>{per_page}</opensearch:itemsPerPage>",
+    ]
+    entries = [book_entry(book, base_url, None, updated, books_path=f"{path}/books", downloads=downloads) for book in page_books]
+    return render_feed(f"urn:shelfstone:public:{slug}", title, updated, links, entries, language)
+
+
+def category_feed(books: List[Dict[str, Any]], field: str, base_url: str, library_path: Optional[str] = None,
+                  page: int = 1, per_page: int = DEFAULT_PAGE_SIZE, language: str = DEFAULT_LANGUAGE) -> str:
+    """A navigation feed listing the authors or series of the books, with book counts."""
+    counts: Counter = Counter()
+    for book in books:
+        values = as_list(book.get("authors"), "authors") if field == "authors" else [book.get("series")]
+        counts.update(v for v in values if v)
+    names = sorted(counts, key=sort_key)
+    title = text(language, "authors" if field == "authors" else "series")
+    path = f"/opds/{field}"
+    updated = now_iso()
+    page_names, has_next = paginate(names, page, per_page)
+    entries = [
+        navigation_entry(f"urn:shelfstone:{field}:{name}", name,
+                         feed_url(base_url, f"{path}/{quote(name, safe='')}", library_path),
+                         text(language, "book_count", count=counts[name]), updated)
+        for name in page_names
+    ]
+    links = _navigation_links(base_url, path, library_path, NAVIGATION_TYPE, title, page, has_next, language)
+    return render_feed(f"urn:shelfstone:{field}", title, updated, links, entries, language)
+
+
+def opensearch_description(base_url: str, library_path: Optional[str] = None, language: str = DEFAULT_LANGUAGE) -> str:
+    # The template's {searchTerms} must stay unescaped, so it is appended after building the URL.
+    template = feed_url(base_url, "/opds/search", library_path)
+    template += ("&" if "?" in template else "?") + "q={searchTerms}"
+    return (
+        '<?xml version="1.0" encoding="utf-8"?>\n'
+        '<OpenSearchDescription xmlns="http://a9.com/-/spec/opensearch/1.1/">\n'
+        "<ShortName>Shelfstone</ShortName>\n"
+        f"<Description>{xml_escape(text(language, 'search_description'))}</Description>\n"
+        f"<Language>{xml_escape(language)}</Language>\n"
+        "<InputEncoding>UTF-8</InputEncoding>\n<OutputEncoding>UTF-8</OutputEncoding>\n"
+        f"<Url type={quoteattr(ACQUISITION_TYPE)} template={quoteattr(template)}/>\n"
+        "</OpenSearchDescription>\n"
+    )
+
+
+def filter_languages(books: List[Dict[str, Any]], languages: List[str]) -> List[Dict[str, Any]]:
+    """The books in one of the languages (ISO 639 codes), and those without a language; all books if none are given."""
+    if not languages:
+        return books
+    return [b for b in books if not as_list(b.get("languages")) or set(as_list(b.get("languages"))) & set(languages)]
+
+
+def sort_recent(books: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+    return sorted(books, key=lambda b: str(b.get("timestamp") or ""), reverse=True)
+
+
+def sort_series(books: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+    return sorted(books, key=lambda b: float(b.get("series_index") or 0))
@@ -0,0 +1,221 @@
+"""
+Translations of the OPDS catalog's own texts (feed titles, navigation entries, link titles), so
+people browsing the library from an e-reader see them in their language. Book titles, author
+and series names are library data and never translated.
+
+The language is negotiated from the request's Accept-Language header; requests without one (most
+e-reader apps don't send it) or asking only for unsupported languages get SHELFSTONE_OPDS_LOCALE,
+which defaults to English.
+"""
+import os
+from typing import Dict, List, Optional, Tuple
+
+DEFAULT_LANGUAGE = "en"
+
+MESSAGES: Dict[str, Dict[str, str]] = {
+    "en": {
+        "library": "Shelfstone Library",
+        "recent": "Recently added",
+        "recent_content": "The newest books in the library.",
+        "authors": "By author",
+        "authors_content": "Browse books by author.",
+        "series": "By series",
+        "series_content": "Browse books by series.",
+        "home": "Home",
+        "search": "Search",
+        "search_results": "Search: {query}",
+        "book_count": "{count} book(s)",
+        "search_description": "Search the library by title, author, tags and more.",
+    },
+    "de": {
+        "library": "Shelfstone-Bibliothek",
+        "recent": "Neu hinzugefügt",
+        "recent_content": "Die neuesten Bücher der Bibliothek.",
+        "authors": "Nach Autor",
+        "authors_content": "Bücher nach Autor durchsuchen.",
+        "series": "Nach Reihe",
+        "series_content": "Bücher nach Reihe durchsuchen.",
+        "home": "Start",
+        "search": "Suche",
+        "search_results": "Suche: {query}",
+        "book_count": "{count} Buch/Bücher",
+        "search_description": "Die Bibliothek nach Titel, Autor, Schlagwörtern und mehr durchsuchen.",
+    },
+    "fr": {
+        "library": "Bibliothèque Shelfstone",
+        "recent": "Ajouts récents",
+        "recent_content": "Les derniers livres de la bibliothèque.",
+        "authors": "Par auteur",
+        "authors_content": "Parcourir les livres par auteur.",
+        "series": "Par série",
+        "series_content": "Parcourir les livres par série.",
+        "home": "Accueil",
+        "search": "Recherche",
+        "search_results": "Recherche : {query}",
+        "book_count": "{count} livre(s)",
+        "search_description": "Rechercher dans la bibliothèque par titre, auteur, étiquettes et plus.",
+    },
+    "es": {
+        "library": "Biblioteca Shelfstone",
+        "recent": "Añadidos recientemente",
+        "recent_content": "Los libros más nuevos de la biblioteca.",
+        "authors": "Por autor",
+        "authors_content": "Explorar libros por autor.",
+        "series": "Por serie",
+        "series_content": "Explorar libros por serie.",
+        "home": "Inicio",
+        "search": "Buscar",
+        "search_results": "Búsqueda: {query}",
+        "book_count": "{count} libro(s)",
+        "search_description": "Buscar en la biblioteca por título, autor, etiquetas y más.",
+    },
+    "it": {
+        "library": "Biblioteca Shelfstone",
+        "recent": "Aggiunti di recente",
+        "recent_content": "I libri più recenti della biblioteca.",
+        "authors": "Per autore",
+        "authors_content": "Sfoglia i libri per autore.",
+        "series": "Per serie",
+        "series_content": "Sfoglia i libri per serie.",
+        "home": "Home",
+        "search": "Cerca",
+        "search_results": "Ricerca: {query}",
+        "book_count": "{count} libro/i",
+        "search_description": "Cerca nella biblioteca per titolo, autore, etichette e altro.",
+    },
+    "nl": {
+        "library": "Shelfstone-bibliotheek",
+        "recent": "Recent toegevoegd",
+        "recent_content": "De nieuwste boeken in de bibliotheek.",
+        "authors": "Op auteur",
+        "authors_content": "Boeken bladeren op auteur.",
+        "series": "Op reeks",
+        "series_content": "Boeken bladeren op reeks.",
+        "home": "Start",
+        "search": "Zoeken",
+        "search_results": "Zoeken: {query}",
+        "book_count": "{count} boek(en)",
+        "search_description": "Zoek in de bibliotheek op titel, auteur, labels en meer.",
+    },
+    "pt": {
+        "library": "Biblioteca Shelfstone",
+        "recent": "Adicionados recentemente",
+        "recent_content": "Os livros mais recentes da biblioteca.",
+        "authors": "Por autor",
+        "authors_content": "Navegar pelos livros por autor.",
+        "series": "Por série",
+        "series_content": "Navegar pelos livros por série.",
+        "home": "Início",
+        "search": "Pesquisar",
+        "search_results": "Pesquisa: {query}",
+        "book_count": "{count} livro(s)",
+        "search_description": "Pesquisar na biblioteca por título, autor, etiquetas e mais.",
+    },
+    "pl": {
+        "library": "Biblioteka Shelfstone",
+        "recent": "Ostatnio dodane",
+        "recent_content": "Najnowsze książki w bibliotece.",
+        "authors": "Według autora",
+        "authors_content": "Przeglądaj książki według autora.",
+        "series": "Według serii",
+        "series_content": "Przeglądaj książki według serii.",
+        "home": "Start",
+        "search": "Szukaj",
+        "search_results": "Wyszukiwanie: {query}",
+        "book_count": "Książki: {count}",
+        "search_description": "Szukaj w bibliotece według tytułu, autora, tagów i nie tylko.",
+    },
+    "ru": {
+        "library": "Библиотека Shelfstone",
+        "recent": "Недавно добавленные",
+        "recent_content": "Новейшие книги в библиотеке.",
+        "authors": "По автору",
+        "authors_content": "Просмотр книг по автору.",
+        "series": "По серии",
+        "series_content": "Просмотр книг по серии.",
+        "home": "Главная",
+        "search": "Поиск",
+        "search_results": "Поиск: {query}",
+        "book_count": "Книг: {count}",
+        "search_description": "Поиск в библиотеке по названию, автору, тегам и другим полям.",
+    },
+    "ja": {
+        "library": "Shelfstone ライブラリ",
+        "recent": "最近追加された本",
+        "recent_content": "ライブラリの最新の本。",
+        "authors": "著者別",
+        "authors_content": "著者別に本を閲覧します。",
+        "series": "シリーズ別",
+        "series_content": "シリーズ別に本を閲覧します。",
+        "home": "ホーム",
+        "search": "検索",
+        "search_results": "検索: {query}",
+        "book_count": "{count} 冊",
+        "search_description": "タイトル、著者、タグなどでライブラリを検索します。",
+    },
+    "zh": {
+        "library": "Shelfstone 书库",
+        "recent": "最近添加",
+        "recent_content": "书库中最新的图书。",
+        "authors": "按作者",
+        "authors_content": "按作者浏览图书。",
+        "series": "按丛书",
+        "series_content": "按丛书浏览图书。",
+        "home": "首页",
+        "search": "搜索",
+        "search_results": "搜索：{query}",
+        "book_count": "{count} 本书",
+        "search_description": "按书名、作者、标签等搜索书库。",
+    },
+}
+
+
+def _language(tag: str) -> str:
+    return tag.strip().lower().replace("_", "-").split("-")[0]
+
+
+def parse_locale(value: str) -> str:
+    """
+    Raises:
+        ValueError: If the language has no translations.
+    """
+    language = _language(value)
+    if language not in MESSAGES:
+        raise ValueError(f"no OPDS translations for '{value}'; available: {', '.join(sorted(MESSAGES))}")
+    return language
+
+
+def default_language() -> str:
+    value = os.environ.get("SHELFSTONE_OPDS_LOCALE")
+    return parse_locale(value) if value else DEFAULT_LANGUAGE
+
+
+def _accepted(header: str) -> List[Tuple[float, int, str]]:
+    """(quality, position, tag) of the header's entries, e.g. "de-AT,de;q=0.9,en;q=0.5"."""
+    accepted = []
+    for position, part in enumerate(header.split(",")):
+        tag, _, params = part.strip().partition(";")
+        quality = 1.0
+        for param in params.split(";"):
+            name, _, value = param.strip().partition("=")
+            if name == "q":
+                try:
+                    quality = float(value)
+                except ValueError:
+                    quality = 0.0
+        if tag.strip() and quality > 0:
+            accepted.append((quality, position, tag.strip()))
+    return accepted
+
+
+def negotiate(accept_language: Optional[str]) -> str:
+    """The supported language the client prefers most, or the configured default."""
+    for _, _, tag in sorted(_accepted(accept_language or ""), key=lambda a: (-a[0], a[1])):
+        if _language(tag) in MESSAGES:
+            return _language(tag)
+    return default_language()
+
+
+def text(language: str, key: str, **values) -> str:
+    messages = MESSAGES.get(language, MESSAGES[DEFAULT_LANGUAGE])
+    return messages.get(key, MESSAGES[DEFAULT_LANGUAGE][key]).format(**values)
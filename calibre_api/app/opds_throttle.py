@@ -0,0 +1,184 @@
+"""
+Soft rate limiting of catalog crawls. Reading apps page through the whole OPDS catalog and fetch
+a cover for every entry, several at a time; every feed page lists the library with calibredb, so
+a single Kobo can keep a Raspberry Pi busy for minutes. Each client (address and User-Agent; behind
+a reverse proxy that is the User-Agent alone) gets:
+
+  * at most SHELFSTONE_OPDS_CONCURRENCY requests running at a time, and
+  * SHELFSTONE_OPDS_RATE requests per minute, in bursts of up to BURST_SECONDS' worth.
+
+This covers the OPDS feeds and published shelves (/opds*, /public/*) for everyone, and for known
+reading apps (READER_AGENTS) also the covers and files they fetch along. Other clients, such as
+the web app loading covers, aren't limited there.
+
+Many reading apps show a 429 as a broken catalog and don't retry, so known reading apps are slowed
+down instead: their requests wait for their turn, up to MAX_DELAY_SECONDS, and only get 429 (with
+Retry-After) if that isn't enough. Other clients get 429 right away. Known reading apps also get
+pages of READER_PAGE_SIZE in the feeds, unless the user chose a page size (see preferences), so a
+crawl takes fewer feed requests. Responses tell clients their allowance (RateLimit-Policy: requests
+per 60 seconds) and how many more they may send right away (RateLimit-Remaining).
+"""
+import asyncio
+import json
+import logging
+import math
+import os
+import re
+import threading
+import time
+from typing import Dict, Optional, Tuple
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_CONCURRENCY = 2
+DEFAULT_RATE = 120
+BURST_SECONDS = 15
+MAX_DELAY_SECONDS = 10
+READER_PAGE_SIZE = 100
+POLL_SECONDS = 0.05
+# Clients idle this long are forgotten once there are more than MAX_CLIENTS.
+IDLE_SECONDS = 600
+MAX_CLIENTS = 1000
+
+# Name -> User-Agent pattern of the reading apps known to crawl catalogs.
+READER_AGENTS = {
+    "Kobo": re.compile(r"kobo", re.IGNORECASE),
+    "KOReader": re.compile(r"koreader", re.IGNORECASE),
+    "Moon+ Reader": re.compile(r"moon\+? ?reader", re.IGNORECASE),
+    "PocketBook": re.compile(r"pocketbook", re.IGNORECASE),
+    "FBReader": re.compile(r"fbreader", re.IGNORECASE),
+    "Librera": re.compile(r"librera", re.IGNORECASE),
+    "Thorium": re.compile(r"thorium", re.IGNORECASE),
+    "Aldiko": re.compile(r"aldiko", re.IGNORECASE),
+}
+CATALOG_PATHS = re.compile(r"^/opds(/|$)|^/public/")
+READER_PATHS = re.compile(r"^/books/\d+/(cover|download|file/)")
+
+_lock = threading.Lock()
+# (address, User-Agent) -> {"tokens": requests left (below 0 while some wait), "at": when counted, "active": running}
+_clients: Dict[Tuple[str, str], Dict[str, float]] = {}
+
+
+def reader_agent(user_agent: Optional[str]) -> Optional[str]:
+    """The name of the known reading app with this User-Agent, or None."""
+    return next((name for name, pattern in READER_AGENTS.items() if pattern.search(user_agent or "")), None)
+
+
+def applies(path: str, user_agent: Optional[str]) -> bool:
+    return bool(CATALOG_PATHS.match(path) or (READER_PATHS.match(path) and reader_agent(user_agent)))
+
+
+def limits() -> Tuple[int, int]:
+    """(concurrency, rate per minute) per client; 0 turns either off."""
+    return (int(os.environ.get("SHELFSTONE_OPDS_CONCURRENCY") or DEFAULT_CONCURRENCY),
+            int(os.environ.get("SHELFSTONE_OPDS_RATE") or DEFAULT_RATE))
+
+
+def _client(key: Tuple[str, str], burst: float, now: float) -> Dict[str, float]:
+    if key not in _clients and len(_clients) >= MAX_CLIENTS:
+        for idle in [k for k, c in _clients.items() if not c["active"] and now - c["at"] > IDLE_SECONDS]:
+            del _clients[idle]
+    return _clients.setdefault(key, {"tokens": burst, "at": now, "active": 0})
+
+
+def reserve(key: Tuple[str, str], rate: int, max_wait: float, now: Optional[float] = None) -> Tuple[float, int]:
+    """
+    Takes a request from the client's allowance of `rate` per minute. Returns how long it has to
+    wait before it may run (0 for right away), and how many more it may send right away. If it
+    would have to wait longer than max_wait, nothing is taken; the wait is for Retry-After then.
+    """
+    now = time.monotonic() if now is None else now
+    per_second = rate / 60
+    burst = max(1.0, per_second * BURST_SECONDS)
+    with _lock:
+        client = _client(key, burst, now)
+        client["tokens"] = min(burst, client["tokens"] + (now - client["at"]) * per_second)
+        client["at"] = now
+        wait = max(0.0, (1 - client["tokens"]) / per_second)
+        if wait <= max_wait:
+            client["tokens"] -= 1
+        return wait, max(0, math.floor(client["tokens"]))
+
+
+def enter(key: Tuple[str, str], concurrency: int) -> bool:
+    """Counts a request of the client as running, if it has fewer than `concurrency` running."""
+    with _lock:
+        client = _client(key, 1.0, time.monotonic())
+        if client["active"] >= concurrency:
+            return False
+        client["active"] += 1
+        return True
+
+
+def leave(key: Tuple[str, str]) -> None:
+    with _lock:
+        _clients[key]["active"] -= 1
+
+
+def reset() -> None:
+    """Forgets all clients."""
+    with _lock:
+        _clients.clear()
+
+
+async def _too_many(send, retry_after: float, reader: Optional[str]) -> None:
+    detail = "Too many catalog requests; slow down."
+    if reader:
+        detail = f"Too many catalog requests from {reader}; try again in a moment."
+    body = json.dumps({"detail": detail}).encode()
+    await send({
+        "type": "http.response.start",
+        "status": 429,
+        "headers": [
+            (b"content-type", b"application/json"),
+            (b"content-length", str(len(body)).encode()),
+            (b"retry-after", str(max(1, math.ceil(retry_after))).encode()),
+        ],
+    })
+    await send({"type": "http.response.body", "body": body})
+
+
+class OpdsThrottleMiddleware:
+    """ASGI middleware that limits how many catalog requests each client may send (see above)."""
+
+    def __init__(self, app):
+        self.app = app
+
+    async def __call__(self, scope, receive, send):
+        headers = dict(scope.get("headers") or []) if scope["type"] == "http" else {}
+        user_agent = headers.get(b"user-agent", b"").decode("latin-1")
+        concurrency, rate = limits()
+        if scope["type"] != "http" or not (concurrency or rate) or not applies(scope["path"], user_agent):
+            await self.app(scope, receive, send)
+            return
+        key = ((scope.get("client") or ("", 0))[0], user_agent)
+        reader = reader_agent(user_agent)
+        max_wait = MAX_DELAY_SECONDS if reader else 0
+        extra_headers = []
+        if rate:
+            wait, remaining = reserve(key, rate, max_wait)
+            if wait > max_wait:
+                logger.info(f"Catalog requests of {key[0]} ({reader or user_agent or 'no User-Agent'}) rate limited.")
+                await _too_many(send, wait, reader)
+                return
+            if wait:
+                await asyncio.sleep(wait)
+            extra_headers = [(b"ratelimit-policy", f"{rate};w=60".encode()), (b"ratelimit-remaining", str(remaining).encode())]
+        if concurrency:
+            deadline = time.monotonic() + max_wait
+            while not enter(key, concurrency):
+                if time.monotonic() >= deadline:
+                    await _too_many(send, 1, reader)
+                    return
+                await asyncio.sleep(POLL_SECONDS)
+
+        async def send_with_limits(message):
+            if message["type"] == "http.response.start" and extra_headers:
+                message = dict(message, headers=list(message.get("headers") or []) + extra_headers)
+            await send(message)
+
+        try:
+            await self.app(scope, receive, send_with_limits)
+        finally:
+            if concurrency:
+                leave(key)
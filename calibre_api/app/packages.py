@@ -0,0 +1,135 @@
+import os
+import logging
+from typing import Dict, List, Optional, Any
+
+from . import crud
+from . import metadata
+from . import filetypes
+
+logger = logging.getLogger(__name__)
+
+# E-book formats that can be the main file of a package. Anything else that is not
+# a cover or OPF is attached to the book as an extra data file.
+EBOOK_EXTENSIONS = {
+    ".epub", ".azw3", ".azw", ".mobi", ".kfx", ".pdf", ".djvu", ".fb2", ".fbz",
+    ".lit", ".lrf", ".pdb", ".rtf", ".docx", ".odt", ".txt", ".txtz", ".htmlz",
+    ".cbz", ".cbr", ".cb7", ".snb", ".tcr",
+}
+COVER_EXTENSIONS = {".jpg", ".jpeg", ".png", ".webp", ".gif"}
+# Preferred cover file names, checked before falling back to any single image in the package.
+COVER_NAMES = {"cover", "folder", "front"}
+
+
+class BookPackageError(ValueError):
+    """Raised when a set of files does not form a valid book package."""
+
+
+def classify_package_files(filenames: List[str]) -> Dict[str, Any]:
+    """
+    Sorts the files of a book package into the main e-book, the sidecar OPF, the cover and attachments.
+
+    Returns:
+        A dict with keys "ebook", "opf", "cover" (file names or None) and "attachments" (list of file names).
+
+    Raises:
+        BookPackageError: If the package has no e-book, or more than one e-book or OPF file.
+    """
+    ebooks = [f for f in filenames if os.path.splitext(f)[1].lower() in EBOOK_EXTENSIONS]
+    opfs = [f for f in filenames if os.path.splitext(f)[1].lower() == ".opf"]
+    images = [f for f in filenames if os.path.splitext(f)[1].lower() in COVER_EXTENSIONS]
+
+    if not ebooks:
+        raise BookPackageError("Package does not contain an e-book file.")
+    if len(ebooks) > 1:
+        raise BookPackageError(f"Package must contain exactly one e-book file, found {len(ebooks)}: {', '.join(ebooks)}")
+    if len(opfs) > 1:
+        raise BookPackageError(f"Package must contain at most one OPF file, found {len(opfs)}.")
+
+    cover = next((f for f in images if os.path.splitext(f)[0].lower() in COVER_NAMES), None)
+    if cover is None and len(images) == 1:
+        cover = images[0]
+
+    used = {ebooks[0], cover, opfs[0] if opfs else None}
+    return {
+        "ebook": ebooks[0],
+        "opf": opfs[0] if opfs else None,
+        "cover": cover,
+        "attachments": [f for f in filenames if f not in used],
+    }
+
+
+def import_book_package(
+    package_dir: str,
+    filenames: List[str],
+    library_path: Optional[str] = None,
+    duplicates: bool = False,
+    identifiers: Optional[Dict[str, str]] = None,
+) -> Dict[str, Any]:
+    """
+    Imports the files in `package_dir` as a single book.
+
+    The e-book is added with `calibredb add`; the sidecar OPF (if any) then replaces the
+    metadata extracted from the file, the provided cover replaces the extracted cover, and
+    remaining files are attached as extra data files. If any step after the add fails the
+    new book is removed again, so the library never ends up with a half-imported package.
+
+    `identifiers` are set on the new book and kept even when the OPF brings its own identifiers.
+
+    Returns:
+        A dict with "book_id", "metadata_source" ("opf" or "extracted"), "cover_applied" and "attachments".
+        "book_id" is None if calibredb did not add the book (e.g. a duplicate).
+
+    Raises:
+        BookPackageError: If the files do not form a valid package.
+        UnsupportedFileType: If the e-book's content is not a recognised e-book format.
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If a calibredb step fails (after rolling back the added book).
+        Any other error raised after the add is re-raised after the same rollback.
+    """
+    parts = classify_package_files(filenames)
+    result: Dict[str, Any] = {
+        "book_id": None,
+        "metadata_source": "opf" if parts["opf"] else "extracted",
+        "cover_applied": False,
+        "attachments": [],
+    }
+
+    filetypes.check_ebook_file(os.path.join(package_dir, parts["ebook"]))
+
+    added_ids = crud.add_book(
+        file_path=os.path.join(package_dir, parts["ebook"]),
+        library_path=library_path,
+        duplicates=duplicates,
+        identifiers=identifiers,
+    )
+    if not added_ids:
+        return result
+    book_id = added_ids[0]
+
+    try:
+        if parts["opf"]:
+            opf_path = os.path.join(package_dir, parts["opf"])
+            crud.set_book_metadata_from_opf(book_id, opf_path, library_path=library_path)
+            if identifiers:
+                # calibredb replaces all identifiers with the ones from the OPF; merge ours back in.
+                with open(opf_path, "r", encoding="utf-8") as f:
+                    opf_identifiers = metadata.parse_opf(f.read()).get("identifiers", {})
+                crud.set_book_identifiers(book_id, {**opf_identifiers, **identifiers}, library_path=library_path)
+        if parts["cover"]:
+            crud.set_book_cover(book_id, os.path.join(package_dir, parts["cover"]), library_path=library_path)
+            result["cover_applied"] = True
+        for attachment in parts["attachments"]:
+            crud.add_extra_data_file(book_id, os.path.join(package_dir, attachment), library_path=library_path)
+            result["attachments"].append(attachment)
+    except Exception as e:
+        # Any failure counts, not just calibredb errors: a timeout (CalibreCLIError), an unreadable
+        # OPF (OSError) or a bug would otherwise leave a book without its metadata, cover or files.
+        logger.warning(f"Importing package for book {book_id} failed, removing the partially imported book: {e}")
+        try:
+            crud.remove_book(book_id, library_path=library_path)
+        except Exception as rollback_error:
+            logger.error(f"Rollback of book {book_id} failed: {rollback_error}", exc_info=True)
+        raise
+
+    result["book_id"] = book_id
+    return result
@@ -0,0 +1,298 @@
+"""
+Password resets by email, so users who forgot their password don't need an admin. Needs user
+accounts (see accounts) with an email address, and sending mail configured (the SMTP settings of
+delivery).
+
+POST /auth/password-reset mails a link with a reset token to the account with the given address;
+POST /auth/password-reset/{token} sets the new password and ends the account's sessions. The
+answer to the first is the same whether or not an account has the address, so it can't be used to
+find out who has an account.
+
+Tokens aren't stored: they are the user ID and expiry time, signed (HMAC-SHA256) with a secret
+this server generates once, over the user's password_stamp as well. Setting a new password changes
+the stamp, so a token works once, and stops working when the password is changed some other way.
+
+Requests are rate limited per client address and per email address, and failed resets per client
+address. Every request, email and reset is written to an audit log (GET /admin/password-resets),
+kept for AUDIT_RETENTION_DAYS days. All of it is kept in a small SQLite database
+(SHELFSTONE_PASSWORD_RESET_DB, in the state directory by default; see state_store).
+"""
+import base64
+import hashlib
+import hmac
+import logging
+import os
+import secrets
+import sqlite3
+import threading
+import time
+from typing import Any, Callable, Dict, List, Optional, Tuple
+
+from . import accounts
+from . import calibre_cli
+from . import delivery
+from . import state_store
+
+logger = logging.getLogger(__name__)
+
+_lock = threading.Lock()
+
+RESET_MINUTES = 60
+RATE_WINDOW_SECONDS = 3600
+# Within RATE_WINDOW_SECONDS.
+REQUESTS_PER_ADDRESS = 5
+REQUESTS_PER_EMAIL = 3
+FAILED_RESETS_PER_ADDRESS = 10
+AUDIT_RETENTION_DAYS = 365
+MAX_EVENTS = 1000
+
+# Audit log events.
+REQUESTED = "requested"
+UNKNOWN_EMAIL = "unknown_email"
+RATE_LIMITED = "rate_limited"
+SENT = "sent"
+SEND_FAILED = "send_failed"
+COMPLETED = "completed"
+INVALID_TOKEN = "invalid_token"
+
+
+class RateLimited(Exception):
+    """Too many attempts; `retry_after` is how many seconds until the next one is allowed."""
+
+    def __init__(self, message: str, retry_after: int):
+        super().__init__(message)
+        self.retry_after = retry_after
+
+
+class InvalidResetToken(Exception):
+    """The reset token is malformed, forged, expired or already used."""
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: the signing secret, recent attempts for rate limiting, and the audit log.
+    (
+        "CREATE TABLE secret (id INTEGER PRIMARY KEY CHECK (id = 1), key TEXT NOT NULL)",
+        "CREATE TABLE attempts (kind TEXT NOT NULL, key TEXT NOT NULL, at REAL NOT NULL)",
+        "CREATE INDEX attempts_key ON attempts (kind, key, at)",
+        "CREATE TABLE events ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, at REAL NOT NULL, event TEXT NOT NULL, user_id INTEGER, "
+        "email TEXT, address TEXT, detail TEXT)",
+        "CREATE INDEX events_at ON events (at)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_PASSWORD_RESET_DB", "password_reset.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+# --- Tokens ---
+
+def _secret(conn: sqlite3.Connection) -> bytes:
+    row = conn.execute("SELECT key FROM secret WHERE id = 1").fetchone()
+    if row is None:
+        with conn:
+            conn.execute("INSERT OR IGNORE INTO secret (id, key) VALUES (1, ?)", (secrets.token_hex(32),))
+        row = conn.execute("SELECT key FROM secret WHERE id = 1").fetchone()
+    return row[0].encode()
+
+
+def _signature(key: bytes, user_id: int, expires_at: int, stamp: str) -> str:
+    digest = hmac.new(key, f"{user_id}.{expires_at}.{stamp}".encode(), hashlib.sha256).digest()
+    return base64.urlsafe_b64encode(digest).decode().rstrip("=")
+
+
+def make_token(user_id: int, stamp: str, expires_at: int) -> str:
+    """A reset token for the user, valid until `expires_at` (Unix time) while their password_stamp is `stamp`."""
+    with _lock:
+        conn = connect()
+        try:
+            key = _secret(conn)
+        finally:
+            conn.close()
+    return f"{user_id}.{expires_at}.{_signature(key, user_id, expires_at, stamp)}"
+
+
+def check_token(token: str) -> Tuple[int, str, int]:
+    """
+    The (user ID, password stamp, expiry time) a reset token is for.
+
+    Raises:
+        InvalidResetToken: If it is malformed, forged, expired or used.
+    """
+    invalid = InvalidResetToken("This reset link is invalid, expired or already used; ask for a new one.")
+    user_id, _, rest = (token or "").partition(".")
+    expires_at, _, signature = rest.partition(".")
+    if not user_id.isdigit() or not expires_at.isdigit() or not signature or int(expires_at) < time.time():
+        raise invalid
+    stamp = accounts.password_stamp(int(user_id))
+    if stamp is None or not os.path.exists(db_path()):
+        raise invalid
+    with _lock:
+        conn = connect()
+        try:
+            key = _secret(conn)
+        finally:
+            conn.close()
+    if not hmac.compare_digest(_signature(key, int(user_id), int(expires_at), stamp), signature):
+        raise invalid
+    return int(user_id), stamp, int(expires_at)
+
+
+# --- Rate limiting and the audit log ---
+
+def _take_attempt(conn: sqlite3.Connection, kind: str, key: str, limit: int, now: float) -> Optional[int]:
+    """Records an attempt unless `limit` were made in the window; then the seconds until the oldest expires."""
+    rows = conn.execute("SELECT at FROM attempts WHERE kind = ? AND key = ? AND at > ? ORDER BY at",
+                        (kind, key, now - RATE_WINDOW_SECONDS)).fetchall()
+    if len(rows) >= limit:
+        return int(rows[0][0] + RATE_WINDOW_SECONDS - now) + 1
+    conn.execute("INSERT INTO attempts (kind, key, at) VALUES (?, ?, ?)", (kind, key, now))
+    return None
+
+
+def _rate_limit(checks: List[Tuple[str, str, int]]) -> None:
+    """
+    Counts an attempt against each (kind, key, limit) that allows it.
+
+    Raises:
+        RateLimited: If any of them is used up.
+    """
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM attempts WHERE at < ?", (now - RATE_WINDOW_SECONDS,))
+                waits = [_take_attempt(conn, kind, key, limit, now) for kind, key, limit in checks if key]
+        finally:
+            conn.close()
+    waits = [wait for wait in waits if wait is not None]
+    if waits:
+        raise RateLimited("Too many password reset attempts; try again later.", max(waits))
+
+
+def _is_limited(kind: str, key: Optional[str], limit: int) -> bool:
+    if not key or not os.path.exists(db_path()):
+        return False
+    with _lock:
+        conn = connect()
+        try:
+            count = conn.execute("SELECT COUNT(*) FROM attempts WHERE kind = ? AND key = ? AND at > ?",
+                                 (kind, key, time.time() - RATE_WINDOW_SECONDS)).fetchone()[0]
+        finally:
+            conn.close()
+    return count >= limit
+
+
+def audit(event: str, user_id: Optional[int] = None, email: Optional[str] = None,
+          address: Optional[str] = None, detail: Optional[str] = None) -> None:
+    """Writes an event to the audit log, and to the server log."""
+    now = time.time()
+    logger.info(f"Password reset: {event} (user {user_id}, email {email!r}, from {address}){': ' + detail if detail else ''}.")
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM events WHERE at < ?", (now - AUDIT_RETENTION_DAYS * 86400,))
+                conn.execute("INSERT INTO events (at, event, user_id, email, address, detail) VALUES (?, ?, ?, ?, ?, ?)",
+                             (now, event, user_id, email, address, detail))
+        finally:
+            conn.close()
+
+
+_EVENT_FIELDS = ("id", "at", "event", "user_id", "email", "address", "detail")
+
+
+def events(limit: int = 100, user_id: Optional[int] = None) -> List[Dict[str, Any]]:
+    """The audit log, newest first, optionally only one user's events."""
+    if not os.path.exists(db_path()):
+        return []
+    where, params = ("WHERE user_id = ?", (user_id,)) if user_id is not None else ("", ())
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT {', '.join(_EVENT_FIELDS)} FROM events {where} ORDER BY id DESC LIMIT ?",
+                                (*params, limit)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(_EVENT_FIELDS, row)) for row in rows]
+
+
+# --- Requesting and completing resets ---
+
+def _send_link(user: Dict[str, Any], link: str, smtp: Dict[str, Any], address: Optional[str],
+               send: Callable[..., Any]) -> None:
+    body = (f"Someone, hopefully you, asked to reset the password of the Shelfstone account '{user['username']}'.\n\n"
+            f"Set a new password within {RESET_MINUTES} minutes with this link:\n{link}\n\n"
+            "If it wasn't you, ignore this email; your password stays as it is.")
+    try:
+        success, message = send(recipient_email=user["email"], subject="Reset your Shelfstone password", body=body, **smtp)
+    except Exception as e:
+        success, message = False, str(e)
+    if success:
+        audit(SENT, user["id"], user["email"], address)
+    else:
+        logger.error(f"Sending the password reset email to user {user['id']} failed: {message}")
+        audit(SEND_FAILED, user["id"], user["email"], address, message[-500:] if message else None)
+
+
+def request_reset(email: str, address: Optional[str], link_base: str,
+                  send: Callable[..., Any] = calibre_cli.send_email_with_calibre_smtp) -> None:
+    """
+    Mails a reset link (`link_base` followed by the token) to the enabled account with this email
+    address, in the background. Does nothing more for addresses without an account, so callers
+    answer the same either way.
+
+    Raises:
+        SendingNotConfigured: If SMTP is not configured.
+        RateLimited: If the client address or the email address asked too often.
+    """
+    smtp = delivery.smtp_settings()
+    email = (email or "").strip()
+    try:
+        _rate_limit([("request", address, REQUESTS_PER_ADDRESS), ("email", email.lower(), REQUESTS_PER_EMAIL)])
+    except RateLimited:
+        audit(RATE_LIMITED, email=email, address=address)
+        raise
+    user = accounts.user_for_email(email)
+    if user is None:
+        audit(UNKNOWN_EMAIL, email=email, address=address)
+        return
+    stamp = accounts.password_stamp(user["id"])
+    if stamp is None:
+        return
+    token = make_token(user["id"], stamp, int(time.time()) + RESET_MINUTES * 60)
+    audit(REQUESTED, user["id"], user["email"], address)
+    threading.Thread(target=_send_link, args=(user, link_base + token, smtp, address, send),
+                     name=f"password-reset-{user['id']}", daemon=True).start()
+
+
+def complete_reset(token: str, new_password: str, address: Optional[str]) -> Dict[str, Any]:
+    """
+    Sets the new password of the account a reset token is for, and ends its sessions. Returns the user.
+
+    Raises:
+        RateLimited: After too many failed resets from the client address.
+        InvalidResetToken: As for check_token, or if the token was used meanwhile.
+        ValueError: If the new password is invalid.
+    """
+    if _is_limited("failed", address, FAILED_RESETS_PER_ADDRESS):
+        audit(RATE_LIMITED, address=address, detail="too many failed resets")
+        raise RateLimited("Too many failed password resets; try again later.", RATE_WINDOW_SECONDS)
+    try:
+        user_id, stamp, _ = check_token(token)
+        if not accounts.reset_password(user_id, new_password, stamp):
+            raise InvalidResetToken("This reset link is invalid, expired or already used; ask for a new one.")
+    except InvalidResetToken:
+        _rate_limit([("failed", address, FAILED_RESETS_PER_ADDRESS)])
+        audit(INVALID_TOKEN, address=address)
+        raise
+    user = accounts.get_user(user_id)
+    audit(COMPLETED, user_id, user["email"], address)
+    return user
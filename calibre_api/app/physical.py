@@ -0,0 +1,86 @@
+"""
+Physical copy tracking: records that a book also exists on a real shelf, where it is, its
+condition and who borrowed it. The data lives in custom columns of the library (#physical,
+#shelf, #condition, #loaned_to, #loaned_on), so it can be searched and edited in Calibre too.
+"""
+from datetime import date
+from typing import Any, Dict, List, Optional
+
+from .crud import list_books, list_custom_columns, set_custom_field, escape_search_value
+from .custom_fields import CustomColumn, read_values, set_values
+
+# Common bookseller condition grades.
+CONDITIONS = ["New", "Fine", "Very good", "Good", "Fair", "Poor"]
+
+PHYSICAL_COLUMNS = [
+    CustomColumn("physical", "Physical copy", "bool"),
+    CustomColumn("shelf", "Shelf", "text"),
+    CustomColumn("condition", "Condition", "enumeration", CONDITIONS),
+    CustomColumn("loaned_to", "Loaned to", "text"),
+    CustomColumn("loaned_on", "Loaned on", "datetime"),
+]
+
+
+def read_physical_copy(book: Dict[str, Any]) -> Dict[str, Any]:
+    values = read_values(book, PHYSICAL_COLUMNS)
+    values["physical"] = bool(values["physical"])
+    return values
+
+
+def set_physical_copy(book_id: int, changes: Dict[str, Any], library_path: Optional[str] = None,
+                      today: Optional[date] = None) -> None:
+    """
+    Marks a book as physically owned and updates the given fields (shelf, condition, loaned_to,
+    loaned_on). Lending a book without a date records today; clearing loaned_to also clears the date.
+
+    Raises:
+        ValueError: For unknown fields or an invalid condition.
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If calibredb fails.
+    """
+    values = {"physical": True, **changes}
+    if "loaned_to" in changes and "loaned_on" not in changes:
+        values["loaned_on"] = (today or date.today()) if changes["loaned_to"] else None
+    set_values(book_id, PHYSICAL_COLUMNS, values, library_path=library_path)
+
+
+def clear_physical_copy(book_id: int, library_path: Optional[str] = None) -> None:
+    """Removes all physical copy data from a book. Columns that don't exist are skipped."""
+    existing = list_custom_columns(library_path=library_path)
+    for column in PHYSICAL_COLUMNS:
+        if column.label in existing:
+            set_custom_field(book_id, column.label, "", library_path=library_path)
+
+
+def physical_search(shelf: Optional[str] = None, condition: Optional[str] = None,
+                    loaned: Optional[bool] = None, search: Optional[str] = None) -> str:
+    """Builds the calibredb search for physical copies matching the filters."""
+    terms = ["#physical:true"]
+    if shelf:
+        terms.append(f'#shelf:"={escape_search_value(shelf)}"')
+    if condition:
+        terms.append(f'#condition:"={escape_search_value(condition)}"')
+    if loaned is not None:
+        terms.append(f"#loaned_to:{'true' if loaned else 'false'}")
+    if search:
+        terms.append(f"({search})")
+    return " and ".join(terms)
+
+
+def list_physical_copies(shelf: Optional[str] = None, condition: Optional[str] = None,
+                         loaned: Optional[bool] = None, search: Optional[str] = None,
+                         library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """
+    Returns the books with a physical copy matching the filters, each with a "physical_copy" dict.
+
+    Raises:
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If calibredb fails.
+    """
+    if "physical" not in list_custom_columns(library_path=library_path):
+        return []  # No book has been marked yet.
+    books = list_books(library_path=library_path,
+                       search_query=physical_search(shelf, condition, loaned, search))
+    for book in books:
+        book["physical_copy"] = read_physical_copy(book)
+    return books
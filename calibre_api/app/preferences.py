@@ -0,0 +1,157 @@
+"""
+Per-user preferences: how the signed-in user wants books listed and served. Needs user accounts
+(see accounts). The server applies them where a request leaves the choice open (see effective):
+GET /books/ sorts, pages and filters by language by them, downloads and the OPDS catalog offer the
+preferred format first, and OPDS feeds use the page size and language filter. The theme and the
+digest frequency are kept for clients; the server doesn't interpret them.
+
+Each user's preferences are one JSON object in a small SQLite database
+(SHELFSTONE_PREFERENCES_DB, in the state directory by default; see state_store). Stored objects
+only hold what the user set, so new preferences take their defaults for everyone.
+"""
+import json
+import os
+import re
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, Optional
+
+from . import formats as format_registry
+from . import state_store
+
+_lock = threading.Lock()
+
+# Sort orders of GET /books/: (calibredb field, ascending).
+SORTS = {
+    "title": ("title", True),
+    "author": ("author_sort", True),
+    "added": ("timestamp", False),
+    "published": ("pubdate", False),
+    "rating": ("rating", False),
+}
+THEMES = ("system", "light", "dark")
+DIGEST_FREQUENCIES = ("never", "daily", "weekly", "monthly")
+MAX_ITEMS_PER_PAGE = 500
+MAX_LANGUAGES = 20
+
+DEFAULTS: Dict[str, Any] = {
+    "default_sort": None,
+    "download_format": None,
+    "items_per_page": None,
+    "theme": "system",
+    "digest_frequency": "never",
+    "languages": [],
+}
+
+# Calibre stores ISO 639 codes, e.g. "eng" or "deu".
+_LANGUAGE_CODE = re.compile(r"^[a-z]{2,3}$")
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: preferences.
+    (
+        "CREATE TABLE preferences (user_id INTEGER PRIMARY KEY, data TEXT NOT NULL, updated_at REAL NOT NULL)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_PREFERENCES_DB", "preferences.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+def validate(values: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Checks and normalizes preferences; None means the default.
+
+    Raises:
+        ValueError: For unknown preferences or invalid values.
+    """
+    unknown = set(values) - set(DEFAULTS)
+    if unknown:
+        raise ValueError(f"Unknown preference(s): {', '.join(sorted(unknown))}.")
+    values = {key: value for key, value in values.items() if value is not None}
+    if "default_sort" in values and values["default_sort"] not in SORTS:
+        raise ValueError(f"The default sort must be one of: {', '.join(SORTS)}.")
+    if "download_format" in values:
+        fmt = format_registry.get(str(values["download_format"]))
+        if fmt is None:
+            raise ValueError(f"Unknown format: {values['download_format']}.")
+        values["download_format"] = fmt.name
+    if "items_per_page" in values:
+        items = values["items_per_page"]
+        if isinstance(items, bool) or not isinstance(items, int) or not 1 <= items <= MAX_ITEMS_PER_PAGE:
+            raise ValueError(f"Items per page must be a whole number from 1 to {MAX_ITEMS_PER_PAGE}.")
+    if "theme" in values and values["theme"] not in THEMES:
+        raise ValueError(f"The theme must be one of: {', '.join(THEMES)}.")
+    if "digest_frequency" in values and values["digest_frequency"] not in DIGEST_FREQUENCIES:
+        raise ValueError(f"The digest frequency must be one of: {', '.join(DIGEST_FREQUENCIES)}.")
+    if "languages" in values:
+        languages = values["languages"]
+        if not isinstance(languages, list) or not all(isinstance(code, str) for code in languages):
+            raise ValueError("Languages must be a list of language codes.")
+        languages = list(dict.fromkeys(code.strip().lower() for code in languages))
+        if len(languages) > MAX_LANGUAGES or not all(_LANGUAGE_CODE.match(code) for code in languages):
+            raise ValueError(f"Languages must be at most {MAX_LANGUAGES} ISO 639 codes, e.g. 'eng'.")
+        values["languages"] = languages
+    return values
+
+
+def get_preferences(user_id: int) -> Dict[str, Any]:
+    """The user's preferences, with defaults for those they haven't set."""
+    preferences = dict(DEFAULTS)
+    if not os.path.exists(db_path()):
+        return preferences
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute("SELECT data FROM preferences WHERE user_id = ?", (user_id,)).fetchone()
+        finally:
+            conn.close()
+    if row:
+        # Preferences an older server stored but this one dropped are ignored.
+        preferences.update({key: value for key, value in json.loads(row[0]).items() if key in DEFAULTS})
+    return preferences
+
+
+def set_preferences(user_id: int, values: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Replaces the user's preferences; those left out go back to their defaults. Returns the
+    preferences as get_preferences does.
+
+    Raises:
+        ValueError: As for validate.
+    """
+    values = validate(values)
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("INSERT OR REPLACE INTO preferences (user_id, data, updated_at) VALUES (?, ?, ?)",
+                             (user_id, json.dumps(values), time.time()))
+        finally:
+            conn.close()
+    return {**DEFAULTS, **values}
+
+
+def effective(user: Optional[Dict[str, Any]]) -> Dict[str, Any]:
+    """The preferences that apply to a request by the user; the defaults without one."""
+    return get_preferences(user["id"]) if user else dict(DEFAULTS)
+
+
+def forget_user(user_id: int) -> None:
+    """Removes a deleted user's preferences."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM preferences WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
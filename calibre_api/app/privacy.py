@@ -0,0 +1,130 @@
+"""
+Per-user privacy settings: what of a user's doings other users of the library may see. Needs user
+accounts (see accounts). Everything is shared by default, as suits a family or club library; users
+turn off what they want to keep to themselves, and the endpoints leave it out for everyone else.
+A user always sees their own data.
+
+  * activity: what the user does (books they add, reviews, shelves, books finished) shows in the
+    activity feed (see activity).
+  * reading_status: whether the user is reading a book or finished it shows with the book's
+    readers and as books finished in the feed.
+  * ratings: the user's stars show with the book's ratings, count toward their average and show
+    with their reviews in the feed.
+  * reviews: the text of the user's reviews shows with the book's ratings and in the feed.
+
+Each user's settings are one JSON object in a small SQLite database (SHELFSTONE_PRIVACY_DB, in the
+state directory by default; see state_store). Stored objects only hold what the user changed, so
+new settings take their defaults for everyone.
+"""
+import json
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, Optional, Set
+
+from . import state_store
+
+_lock = threading.Lock()
+
+ACTIVITY = "activity"
+READING_STATUS = "reading_status"
+RATINGS = "ratings"
+REVIEWS = "reviews"
+
+DEFAULTS: Dict[str, bool] = {
+    ACTIVITY: True,
+    READING_STATUS: True,
+    RATINGS: True,
+    REVIEWS: True,
+}
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: settings.
+    (
+        "CREATE TABLE privacy (user_id INTEGER PRIMARY KEY, data TEXT NOT NULL, updated_at REAL NOT NULL)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_PRIVACY_DB", "privacy.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+def _stored(conn: sqlite3.Connection, user_id: int) -> Dict[str, bool]:
+    row = conn.execute("SELECT data FROM privacy WHERE user_id = ?", (user_id,)).fetchone()
+    # Settings an older server stored but this one dropped are ignored.
+    return {key: value for key, value in json.loads(row[0]).items() if key in DEFAULTS} if row else {}
+
+
+def get_settings(user_id: int) -> Dict[str, bool]:
+    """The user's settings, with defaults for those they haven't changed."""
+    if not os.path.exists(db_path()):
+        return dict(DEFAULTS)
+    with _lock:
+        conn = connect()
+        try:
+            return {**DEFAULTS, **_stored(conn, user_id)}
+        finally:
+            conn.close()
+
+
+def update_settings(user_id: int, changes: Dict[str, Any]) -> Dict[str, bool]:
+    """
+    Changes some of the user's settings; those left out stay as they are. Returns all of them.
+
+    Raises:
+        ValueError: For unknown settings or values other than true and false.
+    """
+    unknown = set(changes) - set(DEFAULTS)
+    if unknown:
+        raise ValueError(f"Unknown privacy setting(s): {', '.join(sorted(unknown))}.")
+    if not all(isinstance(value, bool) for value in changes.values()):
+        raise ValueError("Privacy settings are true or false.")
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                stored = {**_stored(conn, user_id), **changes}
+                conn.execute("INSERT OR REPLACE INTO privacy (user_id, data, updated_at) VALUES (?, ?, ?)",
+                             (user_id, json.dumps(stored), time.time()))
+        finally:
+            conn.close()
+    return {**DEFAULTS, **stored}
+
+
+def hidden(setting: str) -> Set[int]:
+    """The users who turned the setting off."""
+    if not os.path.exists(db_path()):
+        return set()
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute("SELECT user_id, data FROM privacy").fetchall()
+        finally:
+            conn.close()
+    return {user_id for user_id, data in rows if not json.loads(data).get(setting, DEFAULTS[setting])}
+
+
+def hidden_from(viewer_id: Optional[int], setting: str) -> Set[int]:
+    """The users whose data the setting covers `viewer_id` may not see; all who turned it off but the viewer."""
+    return hidden(setting) - {viewer_id}
+
+
+def forget_user(user_id: int) -> None:
+    """Removes a deleted user's settings."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM privacy WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
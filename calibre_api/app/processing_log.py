@@ -0,0 +1,149 @@
+"""
+Per-book processing log: what the server did to a book (adding it, converting it, re-reading
+its metadata, sending it), when, how long it took, whether it failed, and the output of the
+Calibre commands it ran. Lets users find out themselves why a book got odd metadata or a
+broken conversion.
+
+A step is logged with step(), around the code doing it. Calibre commands run inside a step
+(see calibre_cli.run_calibre_command) have their return code, duration and the end of their
+output attached to it. Entries are kept in a small SQLite database (SHELFSTONE_PROCESSING_LOG_DB,
+in the state directory by default; see state_store), at most MAX_ENTRIES_PER_BOOK per book.
+"""
+import contextvars
+import json
+import logging
+import os
+import sqlite3
+import threading
+import time
+from contextlib import contextmanager
+from typing import Any, Dict, Iterable, Iterator, List, Optional
+
+from . import state_store
+from .state_store import library_key as _library_key
+
+logger = logging.getLogger(__name__)
+
+_lock = threading.Lock()
+
+OK, FAILED = "ok", "failed"
+MAX_ENTRIES_PER_BOOK = 100
+# Only the end of a command's output is kept; that is where Calibre puts errors.
+MAX_OUTPUT_CHARS = 4000
+
+# The steps open in the current thread or task, innermost last.
+_steps: contextvars.ContextVar = contextvars.ContextVar("processing_log_steps", default=())
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: the initial schema. IF NOT EXISTS because databases from before versioning already have it.
+    (
+        "CREATE TABLE IF NOT EXISTS processing_log ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, library TEXT NOT NULL, book_id INTEGER NOT NULL, step TEXT NOT NULL, "
+        "status TEXT NOT NULL, detail TEXT, error TEXT, started_at REAL NOT NULL, duration REAL NOT NULL, "
+        "commands TEXT NOT NULL)",
+        "CREATE INDEX IF NOT EXISTS processing_log_book ON processing_log (library, book_id, id)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_PROCESSING_LOG_DB", "processing_log.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+def _tail(text: Optional[str]) -> str:
+    text = (text or "").strip()
+    return text if len(text) <= MAX_OUTPUT_CHARS else "..." + text[-MAX_OUTPUT_CHARS:]
+
+
+@contextmanager
+def step(name: str, book_ids: Optional[Iterable[int]] = None, library_path: Optional[str] = None) -> Iterator[Dict[str, Any]]:
+    """
+    Logs a processing step of the books. Yields the entry, on which the code can set "book_ids"
+    (e.g. once calibredb has added the book), a "detail" line, or "discard" to log nothing (e.g.
+    when a conversion came from the cache). An exception marks the step failed and is re-raised.
+    Steps without book IDs are not logged.
+    """
+    entry: Dict[str, Any] = {"step": name, "book_ids": list(book_ids or []), "status": OK, "detail": None,
+                             "error": None, "started_at": time.time(), "commands": [], "discard": False}
+    token = _steps.set(_steps.get() + (entry,))
+    started = time.monotonic()
+    try:
+        yield entry
+    except Exception as e:
+        message = e.args[0] if e.args and isinstance(e.args[0], str) else str(e)
+        entry.update(status=FAILED, error=message or type(e).__name__)
+        raise
+    finally:
+        _steps.reset(token)
+        entry["duration"] = time.monotonic() - started
+        if entry["book_ids"] and not entry["discard"]:
+            _write(entry, library_path)
+
+
+def record_command(tool: str, returncode: int, duration: float, stdout: Optional[str], stderr: Optional[str]) -> None:
+    """Attaches a finished Calibre command to the innermost open step, if any."""
+    steps = _steps.get()
+    if steps:
+        steps[-1]["commands"].append({"tool": tool, "returncode": returncode, "duration": round(duration, 3),
+                                      "stdout": _tail(stdout), "stderr": _tail(stderr)})
+
+
+def _write(entry: Dict[str, Any], library_path: Optional[str]) -> None:
+    # Best effort: a full disk must not fail the step itself.
+    library = _library_key(library_path)
+    row = (entry["step"], entry["status"], entry["detail"], entry["error"],
+           entry["started_at"], round(entry["duration"], 3), json.dumps(entry["commands"]))
+    try:
+        with _lock:
+            conn = connect()
+            try:
+                with conn:
+                    for book_id in entry["book_ids"]:
+                        conn.execute(
+                            "INSERT INTO processing_log (library, book_id, step, status, detail, error, started_at, duration, commands) "
+                            "VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", (library, book_id, *row))
+                        conn.execute(
+                            "DELETE FROM processing_log WHERE library = ? AND book_id = ? AND id NOT IN "
+                            "(SELECT id FROM processing_log WHERE library = ? AND book_id = ? ORDER BY id DESC LIMIT ?)",
+                            (library, book_id, library, book_id, MAX_ENTRIES_PER_BOOK))
+            finally:
+                conn.close()
+    except (OSError, sqlite3.Error) as e:
+        logger.warning(f"Could not write the processing log of book(s) {entry['book_ids']}: {e}")
+
+
+def entries(book_id: int, library_path: Optional[str] = None, limit: int = MAX_ENTRIES_PER_BOOK) -> List[Dict[str, Any]]:
+    """The book's logged steps, newest first."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(
+                "SELECT id, step, status, detail, error, started_at, duration, commands FROM processing_log "
+                "WHERE library = ? AND book_id = ? ORDER BY id DESC LIMIT ?",
+                (_library_key(library_path), book_id, limit)).fetchall()
+        finally:
+            conn.close()
+    return [{**dict(zip(("id", "step", "status", "detail", "error", "started_at", "duration"), row[:7])),
+             "commands": json.loads(row[7])} for row in rows]
+
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Removes the log of deleted books, so a later book with a reused ID doesn't inherit it."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("DELETE FROM processing_log WHERE library = ? AND book_id = ?",
+                                 [(_library_key(library_path), book_id) for book_id in book_ids])
+        finally:
+            conn.close()
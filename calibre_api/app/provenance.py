@@ -0,0 +1,204 @@
+"""
+Where each book came from: an upload, a resumable upload, a book package, a directory import,
+a news download or the demo seeder. Recorded when the server adds a book, to answer "where did
+this file come from" later; books added by other means (e.g. Calibre itself) have no source.
+
+Sources are kept in a small SQLite database (SHELFSTONE_PROVENANCE_DB, in the state directory by
+default; see state_store) rather than in the library, like collections. Besides the kind, a source records a detail (the uploaded
+file name, the imported file's path, the news recipe) and, for books added over HTTP, the
+client's address and, with user accounts, the user who added them (their uploads; see
+books_added_by and reassign_user).
+"""
+import logging
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, Iterable, List, Optional, Set
+
+from . import state_store
+from .state_store import library_key as _library_key
+
+logger = logging.getLogger(__name__)
+
+_lock = threading.Lock()
+
+UPLOAD = "upload"
+RESUMABLE_UPLOAD = "resumable_upload"
+PACKAGE = "package"
+IMPORT = "import"
+NEWS = "news"
+SEED = "seed"
+SOURCES = (UPLOAD, RESUMABLE_UPLOAD, PACKAGE, IMPORT, NEWS, SEED)
+
+MAX_DETAIL_LENGTH = 1000
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: the initial schema. IF NOT EXISTS because databases from before versioning already have it.
+    (
+        "CREATE TABLE IF NOT EXISTS book_sources ("
+        "library TEXT NOT NULL, book_id INTEGER NOT NULL, source TEXT NOT NULL, detail TEXT, client TEXT, "
+        "added_at REAL NOT NULL, PRIMARY KEY (library, book_id))",
+        "CREATE INDEX IF NOT EXISTS book_sources_source ON book_sources (library, source)",
+    ),
+    # 2: the user who added the book.
+    (
+        "ALTER TABLE book_sources ADD COLUMN user_id INTEGER",
+        "CREATE INDEX book_sources_user ON book_sources (user_id)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_PROVENANCE_DB", "provenance.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+def validate_source(source: str) -> str:
+    """
+    Raises:
+        ValueError: If the source is not one of SOURCES.
+    """
+    source = (source or "").strip().lower()
+    if source not in SOURCES:
+        raise ValueError(f"Unknown source '{source}'. Use one of: {', '.join(SOURCES)}.")
+    return source
+
+
+def record(book_ids: Iterable[int], source: str, detail: Optional[str] = None, client: Optional[str] = None,
+           library_path: Optional[str] = None, user_id: Optional[int] = None) -> None:
+    """
+    Records the source of newly added books. Best effort: the books are already in the library,
+    so a failure to record is logged rather than raised.
+    """
+    book_ids = list(book_ids)
+    if not book_ids:
+        return
+    source = validate_source(source)
+    detail = detail[:MAX_DETAIL_LENGTH] if detail else None
+    library = _library_key(library_path)
+    now = time.time()
+    try:
+        with _lock:
+            conn = connect()
+            try:
+                with conn:
+                    conn.executemany(
+                        "INSERT OR REPLACE INTO book_sources (library, book_id, source, detail, client, added_at, user_id) "
+                        "VALUES (?, ?, ?, ?, ?, ?, ?)",
+                        [(library, book_id, source, detail, client, now, user_id) for book_id in book_ids])
+            finally:
+                conn.close()
+    except (OSError, sqlite3.Error) as e:
+        logger.warning(f"Could not record the source of book(s) {book_ids}: {e}")
+
+
+def sources_of(book_ids: Iterable[int], library_path: Optional[str] = None) -> Dict[int, Dict[str, Any]]:
+    """The recorded sources of the books as {book_id: {"source", "detail", "client", "added_at", "user_id"}}."""
+    book_ids = list(book_ids)
+    if not book_ids or not os.path.exists(db_path()):
+        return {}
+    with _lock:
+        conn = connect()
+        try:
+            rows = []
+            # Chunked to stay below SQLite's limit on query parameters.
+            for start in range(0, len(book_ids), 500):
+                chunk = book_ids[start:start + 500]
+                rows += conn.execute(
+                    f"SELECT book_id, source, detail, client, added_at, user_id FROM book_sources "
+                    f"WHERE library = ? AND book_id IN ({', '.join('?' * len(chunk))})",
+                    (_library_key(library_path), *chunk)).fetchall()
+        finally:
+            conn.close()
+    return {row[0]: dict(zip(("source", "detail", "client", "added_at", "user_id"), row[1:])) for row in rows}
+
+
+def recently_added(library_path: Optional[str] = None, before: Optional[float] = None, limit: int = 50,
+                   exclude_users: Iterable[int] = ()) -> List[Dict[str, Any]]:
+    """
+    The books the server added to the library before `before` (Unix time), newest first:
+    {"book_id", "source", "user_id", "added_at"}, without those added by exclude_users.
+    """
+    if not os.path.exists(db_path()):
+        return []
+    exclude_users = list(exclude_users)
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(
+                f"SELECT book_id, source, user_id, added_at FROM book_sources WHERE library = ? AND added_at < ? "
+                f"AND IFNULL(user_id, 0) NOT IN ({', '.join('?' * len(exclude_users))}) ORDER BY added_at DESC, book_id DESC LIMIT ?",
+                (_library_key(library_path), before if before is not None else float("inf"), *exclude_users, limit)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(("book_id", "source", "user_id", "added_at"), row)) for row in rows]
+
+
+def books_from(source: str, library_path: Optional[str] = None) -> Set[int]:
+    """
+    IDs of the library's books recorded with the source.
+
+    Raises:
+        ValueError: If the source is not one of SOURCES.
+    """
+    source = validate_source(source)
+    if not os.path.exists(db_path()):
+        return set()
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute("SELECT book_id FROM book_sources WHERE library = ? AND source = ?",
+                                (_library_key(library_path), source)).fetchall()
+        finally:
+            conn.close()
+    return {row[0] for row in rows}
+
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Removes the sources of deleted books, so a later book with a reused ID doesn't inherit them."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("DELETE FROM book_sources WHERE library = ? AND book_id = ?",
+                                 [(_library_key(library_path), book_id) for book_id in book_ids])
+        finally:
+            conn.close()
+
+
+def books_added_by(user_id: int) -> List[Dict[str, Any]]:
+    """
+    The books the user added, in all libraries, oldest first: {"library", "book_id", "source",
+    "detail", "added_at"}, with "library" "" for calibredb's default one.
+    """
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute("SELECT library, book_id, source, detail, added_at FROM book_sources "
+                                "WHERE user_id = ? ORDER BY added_at, book_id", (user_id,)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(("library", "book_id", "source", "detail", "added_at"), row)) for row in rows]
+
+
+def reassign_user(user_id: int, new_user_id: Optional[int]) -> int:
+    """Records the books the user added as added by another user (None for nobody). Returns how many."""
+    if not os.path.exists(db_path()):
+        return 0
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                return conn.execute("UPDATE book_sources SET user_id = ? WHERE user_id = ?", (new_user_id, user_id)).rowcount
+        finally:
+            conn.close()
@@ -0,0 +1,111 @@
+"""
+The public surface of the server: the OPDS catalog, book downloads and covers, and published
+shelves (/public/*, see book_collections), for split-horizon deployments where the rest of the API
+(adding and editing books, maintenance, admin) must only be reachable on an internal interface.
+
+`python -m app.serve` starts it as a second listener when SHELFSTONE_PUBLIC_PORT or
+SHELFSTONE_PUBLIC_SOCKET is set; the main listener (SHELFSTONE_HOST/SHELFSTONE_PORT) keeps
+serving the whole API and should then be bound to an internal address. With uvicorn directly:
+
+    uvicorn --factory app.public_app:create_app --port 8080
+
+The public app shares the main app's endpoints but has its own middleware stack: feature flags,
+the fixed library (below), catalog crawl limits (see opds_throttle) and, if
+SHELFSTONE_PUBLIC_CORS_ORIGINS is set, CORS for web readers.
+Upload size limits and maintenance mode don't apply because none of its routes write to the library.
+
+Clients of the public listener can't pick a library: `library_path` is rejected with 400, and
+every request reads the library at CALIBRE_LIBRARY_PATH (calibredb's default library if unset);
+shelves published in other libraries are not found there.
+Downloads in a format the book doesn't have would start an `ebook-convert` run for anyone who
+can reach the listener, so they are refused with 403 unless SHELFSTONE_PUBLIC_CONVERSION is set.
+"""
+import json
+import os
+import re
+from typing import List, Optional
+from urllib.parse import parse_qsl, urlencode
+
+from fastapi import FastAPI
+from fastapi.middleware.cors import CORSMiddleware
+from fastapi.routing import APIRoute
+
+from .features import FeatureFlagMiddleware
+from .opds_throttle import OpdsThrottleMiddleware
+
+PUBLIC_PATHS = [
+    re.compile(r"^/opds(/.*)?$"),
+    re.compile(r"^/books/\{book_id\}/(download|cover|file/\{format_extension\})$"),
+    re.compile(r"^/public/\{slug\}(/.*)?$"),
+]
+PUBLIC_METHODS = {"GET", "HEAD"}
+
+
+def is_public(route) -> bool:
+    """Whether a route of the main app belongs to the public surface (matched on its path template)."""
+    return (isinstance(route, APIRoute) and bool(route.methods & PUBLIC_METHODS)
+            and any(p.match(route.path) for p in PUBLIC_PATHS))
+
+
+def parse_origins(value: Optional[str]) -> List[str]:
+    """Parses "https://a.example,https://b.example" (or "*") into a list of origins."""
+    return [origin.strip().rstrip("/") for origin in (value or "").split(",") if origin.strip()]
+
+
+def conversion_enabled() -> bool:
+    return os.environ.get("SHELFSTONE_PUBLIC_CONVERSION", "").strip().lower() in ("1", "true", "yes")
+
+
+def is_public_request(request) -> bool:
+    """Whether a request came in through the public app (see FixedLibraryMiddleware)."""
+    return bool(getattr(request.state, "public", False))
+
+
+class FixedLibraryMiddleware:
+    """
+    ASGI middleware that marks requests as public, answers those naming a `library_path` with 400
+    and passes CALIBRE_LIBRARY_PATH to the shared endpoints as their library instead.
+    """
+
+    def __init__(self, app):
+        self.app = app
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+        query = parse_qsl(scope.get("query_string", b"").decode("latin-1"), keep_blank_values=True)
+        if any(key == "library_path" for key, _ in query):
+            body = json.dumps({"detail": "library_path is not accepted here; this listener serves one library."}).encode()
+            await send({
+                "type": "http.response.start",
+                "status": 400,
+                "headers": [(b"content-type", b"application/json"), (b"content-length", str(len(body)).encode())],
+            })
+            await send({"type": "http.response.body", "body": body})
+            return
+        library = os.environ.get("CALIBRE_LIBRARY_PATH")
+        if library:
+            query.append(("library_path", library))
+        scope = dict(scope, query_string=urlencode(query).encode("latin-1"))
+        scope["state"] = dict(scope.get("state") or {}, public=True)
+        await self.app(scope, receive, send)
+
+
+def build(api: FastAPI, cors_origins: Optional[List[str]] = None) -> FastAPI:
+    """A new app with the public routes of `api` and the public middleware stack."""
+    public = FastAPI(title=f"{api.title} (public)", description="OPDS catalog, book downloads, covers and published shelves.",
+                     version=api.version, docs_url=None, redoc_url=None, openapi_url=None)
+    public.router.routes.extend(route for route in api.routes if is_public(route))
+    if cors_origins:
+        public.add_middleware(CORSMiddleware, allow_origins=cors_origins, allow_methods=sorted(PUBLIC_METHODS))
+    public.add_middleware(FeatureFlagMiddleware)
+    public.add_middleware(FixedLibraryMiddleware)
+    public.add_middleware(OpdsThrottleMiddleware)
+    return public
+
+
+def create_app() -> FastAPI:
+    """Factory for uvicorn --factory; imports the main app, which loads the configuration."""
+    from .main import app
+    return build(app, parse_origins(os.environ.get("SHELFSTONE_PUBLIC_CORS_ORIGINS")))
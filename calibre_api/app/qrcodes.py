@@ -0,0 +1,90 @@
+"""
+QR codes for physical shelf labels: each code links to the book's share card
+(GET /books/{id}/card), so scanning a printed label opens the book's page.
+"""
+import base64
+import html
+import io
+import os
+from typing import Any, Dict, List, Optional
+from urllib.parse import urlencode
+
+from .crud import as_list
+
+DEFAULT_BOX_SIZE = 8
+DEFAULT_COLUMNS = 3
+
+
+class QrCodeUnavailable(RuntimeError):
+    """Raised when the optional `qrcode` package is not installed."""
+
+
+def public_base_url(request_base_url: str) -> str:
+    """
+    The server's external URL. Behind a reverse proxy the URL the request arrived at is not the
+    one phones can open, so SHELFSTONE_PUBLIC_URL (e.g. "https://books.example.org/api") wins.
+    """
+    return (os.environ.get("SHELFSTONE_PUBLIC_URL") or request_base_url).rstrip("/")
+
+
+def book_link(book_id: int, base_url: str, library_path: Optional[str] = None) -> str:
+    link = f"{base_url.rstrip('/')}/books/{book_id}/card"
+    if library_path:
+        link += "?" + urlencode({"library_path": library_path})
+    return link
+
+
+def qr_png(data: str, box_size: int = DEFAULT_BOX_SIZE, border: int = 4) -> bytes:
+    """
+    Encodes `data` as a QR code PNG. Medium error correction keeps labels readable when
+    slightly scuffed.
+
+    Raises:
+        QrCodeUnavailable: If the `qrcode` package is not installed.
+    """
+    try:
+        import qrcode
+        from qrcode.constants import ERROR_CORRECT_M
+    except ImportError:
+        raise QrCodeUnavailable("QR code support requires the 'qrcode' package (pip install qrcode).")
+    qr = qrcode.QRCode(error_correction=ERROR_CORRECT_M, box_size=box_size, border=border)
+    qr.add_data(data)
+    qr.make(fit=True)
+    buffer = io.BytesIO()
+    qr.make_image(fill_color="black", back_color="white").save(buffer, format="PNG")
+    return buffer.getvalue()
+
+
+def render_label_sheet_html(books: List[Dict[str, Any]], links: Dict[int, str], title: str,
+                            columns: int = DEFAULT_COLUMNS) -> str:
+    """
+    Renders a printable page of labels (QR code, title, authors, book ID) in a grid of
+    `columns` columns. `links` maps book IDs to the URL each QR code encodes.
+
+    Raises:
+        QrCodeUnavailable: If the `qrcode` package is not installed.
+    """
+    esc = html.escape
+    labels = []
+    for book in books:
+        png = base64.b64encode(qr_png(links[book["id"]], box_size=4, border=2)).decode("ascii")
+        labels.append(
+            '<div class="label">'
+            f'<img src="data:image/png;base64,{png}" alt="QR code">'
+            f'<div class="text"><strong>{esc(book.get("title") or "Untitled")}</strong><br>'
+            f'{esc(", ".join(as_list(book.get("authors"), "authors")))}<br><small>#{book["id"]}</small></div>'
+            "</div>"
+        )
+    return (
+        "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n"
+        f"<title>{esc(title)}</title>\n<style>\n"
+        "@page { margin: 10mm; }\n"
+        "body { font-family: sans-serif; margin: 0; }\n"
+        f".sheet {{ display: grid; grid-template-columns: repeat({columns}, 1fr); gap: 4mm; }}\n"
+        ".label { display: flex; align-items: center; gap: 3mm; border: 1px dashed #bbb; padding: 2mm;"
+        " break-inside: avoid; font-size: 9pt; }\n"
+        ".label img { width: 25mm; height: 25mm; }\n"
+        "@media print { h1 { display: none; } .label { border-color: #eee; } }\n"
+        "</style>\n</head>\n<body>\n"
+        f"<h1>{esc(title)}</h1>\n<div class=\"sheet\">\n" + "\n".join(labels) + "\n</div>\n</body>\n</html>\n"
+    )
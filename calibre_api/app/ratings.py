@@ -0,0 +1,196 @@
+"""
+Per-user ratings and reviews of books. Calibre has a single rating per book; in a shared library
+everyone rates for themselves, from 1 to 5 stars, optionally with a review. Needs user accounts
+(see accounts).
+
+Ratings are kept in a small SQLite database (SHELFSTONE_RATINGS_DB, in the state directory by
+default; see state_store), never in the library. Book IDs refer to the library the rating was
+made in.
+"""
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, Iterable, List, Optional
+
+from . import state_store
+from .state_store import library_key as _library_key
+
+_lock = threading.Lock()
+
+MIN_RATING, MAX_RATING = 1, 5
+MAX_REVIEW_LENGTH = 20000
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: ratings.
+    (
+        "CREATE TABLE ratings ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, library TEXT NOT NULL, "
+        "book_id INTEGER NOT NULL, rating INTEGER NOT NULL, review TEXT, created_at REAL NOT NULL, "
+        "updated_at REAL NOT NULL)",
+        "CREATE UNIQUE INDEX ratings_user_book ON ratings (user_id, library, book_id)",
+        "CREATE INDEX ratings_book ON ratings (library, book_id)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_RATINGS_DB", "ratings.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+_FIELDS = ("id", "user_id", "book_id", "rating", "review", "created_at", "updated_at")
+_SELECT = f"SELECT {', '.join(_FIELDS)} FROM ratings"
+
+
+def _as_dict(row) -> Dict[str, Any]:
+    return dict(zip(_FIELDS, row))
+
+
+def set_rating(user_id: int, book_id: int, rating: int, review: Optional[str] = None,
+               library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Rates the book for the user, replacing their previous rating and review.
+
+    Raises:
+        ValueError: If the rating is out of range or the review too long.
+    """
+    if isinstance(rating, bool) or not isinstance(rating, int) or not MIN_RATING <= rating <= MAX_RATING:
+        raise ValueError(f"The rating must be a whole number from {MIN_RATING} to {MAX_RATING}.")
+    review = (review or "").strip() or None
+    if review and len(review) > MAX_REVIEW_LENGTH:
+        raise ValueError(f"The review must be at most {MAX_REVIEW_LENGTH} characters.")
+    library = _library_key(library_path)
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute(
+                    "INSERT INTO ratings (user_id, library, book_id, rating, review, created_at, updated_at) "
+                    "VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (user_id, library, book_id) "
+                    "DO UPDATE SET rating = excluded.rating, review = excluded.review, updated_at = excluded.updated_at",
+                    (user_id, library, book_id, rating, review, now, now))
+            row = conn.execute(f"{_SELECT} WHERE user_id = ? AND library = ? AND book_id = ?",
+                               (user_id, library, book_id)).fetchone()
+        finally:
+            conn.close()
+    return _as_dict(row)
+
+
+def get_rating(user_id: int, book_id: int, library_path: Optional[str] = None) -> Optional[Dict[str, Any]]:
+    if not os.path.exists(db_path()):
+        return None
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute(f"{_SELECT} WHERE user_id = ? AND library = ? AND book_id = ?",
+                               (user_id, _library_key(library_path), book_id)).fetchone()
+        finally:
+            conn.close()
+    return _as_dict(row) if row else None
+
+
+def clear_rating(user_id: int, book_id: int, library_path: Optional[str] = None) -> bool:
+    """Removes the user's rating and review of the book. Returns whether there was one."""
+    if not os.path.exists(db_path()):
+        return False
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                return conn.execute("DELETE FROM ratings WHERE user_id = ? AND library = ? AND book_id = ?",
+                                    (user_id, _library_key(library_path), book_id)).rowcount > 0
+        finally:
+            conn.close()
+
+
+def book_ratings(book_id: int, library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """Everyone's ratings of the book, most recently changed first."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"{_SELECT} WHERE library = ? AND book_id = ? ORDER BY updated_at DESC",
+                                (_library_key(library_path), book_id)).fetchall()
+        finally:
+            conn.close()
+    return [_as_dict(row) for row in rows]
+
+
+def user_ratings(user_id: int, library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """The user's ratings in the library, most recently changed first."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"{_SELECT} WHERE user_id = ? AND library = ? ORDER BY updated_at DESC",
+                                (user_id, _library_key(library_path))).fetchall()
+        finally:
+            conn.close()
+    return [_as_dict(row) for row in rows]
+
+
+def recent_reviews(library_path: Optional[str] = None, before: Optional[float] = None, limit: int = 50,
+                   exclude_users: Iterable[int] = ()) -> List[Dict[str, Any]]:
+    """The ratings with a review changed before `before` (Unix time), most recent first, except those of exclude_users."""
+    if not os.path.exists(db_path()):
+        return []
+    exclude_users = list(exclude_users)
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(
+                f"{_SELECT} WHERE library = ? AND review IS NOT NULL AND updated_at < ? "
+                f"AND user_id NOT IN ({', '.join('?' * len(exclude_users))}) ORDER BY updated_at DESC LIMIT ?",
+                (_library_key(library_path), before if before is not None else float("inf"), *exclude_users, limit)).fetchall()
+        finally:
+            conn.close()
+    return [_as_dict(row) for row in rows]
+
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Removes the ratings of deleted books."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("DELETE FROM ratings WHERE library = ? AND book_id = ?",
+                                 [(_library_key(library_path), book_id) for book_id in book_ids])
+        finally:
+            conn.close()
+
+
+def export_user(user_id: int) -> List[Dict[str, Any]]:
+    """All of the user's ratings and reviews, in all libraries ("library" is "" for the default one)."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT library, {', '.join(_FIELDS)} FROM ratings WHERE user_id = ? ORDER BY id",
+                                (user_id,)).fetchall()
+        finally:
+            conn.close()
+    return [{"library": row[0], **_as_dict(row[1:])} for row in rows]
+
+def forget_user(user_id: int) -> None:
+    """Removes a deleted user's ratings and reviews."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM ratings WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
@@ -0,0 +1,225 @@
+"""
+Quick emoji reactions on books and on reviews (see ratings): a low-effort way for the users of a
+shared library to say what they thought, without writing anything. Each user can give each
+reaction once per book or review. Needs user accounts (see accounts).
+
+Reactions are named in URLs (thumbs_up, heart, sleepy) and counted by their emoji in responses.
+They are kept in a small SQLite database (SHELFSTONE_REACTIONS_DB, in the state directory by
+default; see state_store). A reaction on a review records its book too, so removing the book
+removes both kinds.
+"""
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, List, Optional
+
+from . import state_store
+from .state_store import library_key as _library_key
+
+_lock = threading.Lock()
+
+# Name -> emoji, in the order counts are listed.
+REACTIONS = {"thumbs_up": "👍", "heart": "❤️", "sleepy": "😴"}
+
+
+class ReactionNotFound(Exception):
+    """The user didn't give this reaction."""
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: reactions; rating_id is NULL for reactions on the book itself.
+    (
+        "CREATE TABLE reactions ("
+        "library TEXT NOT NULL, book_id INTEGER NOT NULL, rating_id INTEGER, user_id INTEGER NOT NULL, "
+        "emoji TEXT NOT NULL, created_at REAL NOT NULL)",
+        "CREATE UNIQUE INDEX reactions_unique ON reactions (library, book_id, IFNULL(rating_id, 0), user_id, emoji)",
+        "CREATE INDEX reactions_rating ON reactions (rating_id)",
+        "CREATE INDEX reactions_user ON reactions (user_id)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_REACTIONS_DB", "reactions.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+def parse(reaction: str) -> str:
+    """
+    The emoji of a reaction given by name or as the emoji itself.
+
+    Raises:
+        ValueError: For anything else.
+    """
+    if reaction in REACTIONS:
+        return REACTIONS[reaction]
+    if reaction in REACTIONS.values():
+        return reaction
+    raise ValueError(f"Unknown reaction '{reaction}'; use {', '.join(REACTIONS)}.")
+
+
+def _counts(rows) -> Dict[str, int]:
+    found = dict(rows)
+    return {emoji: found[emoji] for emoji in REACTIONS.values() if found.get(emoji)}
+
+
+def _target(book_id: int, rating_id: Optional[int], library_path: Optional[str]):
+    return "library = ? AND book_id = ? AND IFNULL(rating_id, 0) = ?", (_library_key(library_path), book_id, rating_id or 0)
+
+
+def summary(book_id: int, rating_id: Optional[int] = None, library_path: Optional[str] = None,
+            user_id: Optional[int] = None) -> Dict[str, Any]:
+    """
+    The reactions on a book, or on its review `rating_id`: their "counts" by emoji (only those
+    given) and the emoji `user_id` gave ("mine").
+    """
+    if not os.path.exists(db_path()):
+        return {"counts": {}, "mine": []}
+    where, params = _target(book_id, rating_id, library_path)
+    with _lock:
+        conn = connect()
+        try:
+            counts = _counts(conn.execute(f"SELECT emoji, COUNT(*) FROM reactions WHERE {where} GROUP BY emoji", params))
+            mine = {row[0] for row in conn.execute(f"SELECT emoji FROM reactions WHERE {where} AND user_id = ?",
+                                                   (*params, user_id))}
+        finally:
+            conn.close()
+    return {"counts": counts, "mine": [emoji for emoji in REACTIONS.values() if emoji in mine]}
+
+
+def react(user_id: int, book_id: int, emoji: str, rating_id: Optional[int] = None,
+          library_path: Optional[str] = None) -> Dict[str, Any]:
+    """Gives the reaction, if the user hasn't yet. Returns the summary."""
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("INSERT OR IGNORE INTO reactions (library, book_id, rating_id, user_id, emoji, created_at) "
+                             "VALUES (?, ?, ?, ?, ?, ?)",
+                             (_library_key(library_path), book_id, rating_id, user_id, emoji, time.time()))
+        finally:
+            conn.close()
+    return summary(book_id, rating_id, library_path, user_id)
+
+
+def unreact(user_id: int, book_id: int, emoji: str, rating_id: Optional[int] = None,
+            library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Takes the reaction back. Returns the summary.
+
+    Raises:
+        ReactionNotFound: If the user didn't give it.
+    """
+    where, params = _target(book_id, rating_id, library_path)
+    deleted = 0
+    if os.path.exists(db_path()):
+        with _lock:
+            conn = connect()
+            try:
+                with conn:
+                    deleted = conn.execute(f"DELETE FROM reactions WHERE {where} AND user_id = ? AND emoji = ?",
+                                           (*params, user_id, emoji)).rowcount
+            finally:
+                conn.close()
+    if not deleted:
+        raise ReactionNotFound(f"You didn't react with {emoji}.")
+    return summary(book_id, rating_id, library_path, user_id)
+
+
+def book_counts(book_ids: List[int], library_path: Optional[str] = None) -> Dict[int, Dict[str, int]]:
+    """The counts of the reactions on each of the books (not on their reviews), for those that have any."""
+    if not book_ids or not os.path.exists(db_path()):
+        return {}
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(
+                f"SELECT book_id, emoji, COUNT(*) FROM reactions WHERE library = ? AND rating_id IS NULL "
+                f"AND book_id IN ({', '.join('?' * len(book_ids))}) GROUP BY book_id, emoji",
+                (_library_key(library_path), *book_ids)).fetchall()
+        finally:
+            conn.close()
+    by_book: Dict[int, list] = {}
+    for book_id, emoji, count in rows:
+        by_book.setdefault(book_id, []).append((emoji, count))
+    return {book_id: _counts(counts) for book_id, counts in by_book.items()}
+
+
+def review_counts(rating_ids: List[int]) -> Dict[int, Dict[str, int]]:
+    """The counts of the reactions on each of the reviews, for those that have any."""
+    if not rating_ids or not os.path.exists(db_path()):
+        return {}
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT rating_id, emoji, COUNT(*) FROM reactions "
+                                f"WHERE rating_id IN ({', '.join('?' * len(rating_ids))}) GROUP BY rating_id, emoji",
+                                rating_ids).fetchall()
+        finally:
+            conn.close()
+    by_review: Dict[int, list] = {}
+    for rating_id, emoji, count in rows:
+        by_review.setdefault(rating_id, []).append((emoji, count))
+    return {rating_id: _counts(counts) for rating_id, counts in by_review.items()}
+
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Removes the reactions on deleted books and their reviews."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("DELETE FROM reactions WHERE library = ? AND book_id = ?",
+                                 [(_library_key(library_path), book_id) for book_id in book_ids])
+        finally:
+            conn.close()
+
+
+def forget_reviews(rating_ids: List[int]) -> None:
+    """Removes the reactions on deleted reviews."""
+    if not rating_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("DELETE FROM reactions WHERE rating_id = ?", [(rating_id,) for rating_id in rating_ids])
+        finally:
+            conn.close()
+
+
+_EXPORT_FIELDS = ("library", "book_id", "rating_id", "emoji", "created_at")
+
+
+def export_user(user_id: int) -> List[Dict[str, Any]]:
+    """The reactions the user gave, in all libraries ("library" is "" for the default one)."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT {', '.join(_EXPORT_FIELDS)} FROM reactions WHERE user_id = ? ORDER BY created_at",
+                                (user_id,)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(_EXPORT_FIELDS, row)) for row in rows]
+
+
+def forget_user(user_id: int) -> None:
+    """Removes the reactions a deleted user gave."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM reactions WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
@@ -0,0 +1,352 @@
+"""
+Per-user reading progress and bookmarks, so a reader can pick a book up on another device where
+they left off. Needs user accounts (see accounts): progress belongs to the signed-in user.
+
+A position is whatever the reading app understands (an EPUB CFI, a KOReader xpointer, a page
+label) plus, where known, the percentage read and the page, which any app can fall back on.
+Each user has one progress record per book, overwritten by every update (the last device wins),
+and any number of bookmarks. The record keeps when the user first got to the end of the book
+(finished_at), for the activity feed (see activity).
+
+The data is kept in a small SQLite database (SHELFSTONE_READING_DB, in the state directory by
+default; see state_store). Book IDs refer to the library the record was made in.
+"""
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, Iterable, List, Optional
+
+from . import state_store
+from .state_store import library_key as _library_key
+
+_lock = threading.Lock()
+
+MAX_POSITION_LENGTH = 2000
+MAX_NOTE_LENGTH = 5000
+MAX_FIELD_LENGTH = 100
+# Progress from here on counts as having finished the book.
+FINISHED_PERCENTAGE = 100
+
+
+class BookmarkNotFound(Exception):
+    """The user has no bookmark with this ID on the book."""
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: progress and bookmarks.
+    (
+        "CREATE TABLE progress ("
+        "user_id INTEGER NOT NULL, library TEXT NOT NULL, book_id INTEGER NOT NULL, format TEXT, "
+        "position TEXT, percentage REAL, page INTEGER, device TEXT, updated_at REAL NOT NULL, "
+        "PRIMARY KEY (user_id, library, book_id))",
+        "CREATE TABLE bookmarks ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, library TEXT NOT NULL, "
+        "book_id INTEGER NOT NULL, format TEXT, position TEXT NOT NULL, percentage REAL, page INTEGER, "
+        "note TEXT, created_at REAL NOT NULL, updated_at REAL NOT NULL)",
+        "CREATE INDEX bookmarks_book ON bookmarks (user_id, library, book_id)",
+    ),
+    # 2: when the book was finished.
+    (
+        "ALTER TABLE progress ADD COLUMN finished_at REAL",
+        "CREATE INDEX progress_finished ON progress (library, finished_at)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_READING_DB", "reading.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+def _validate(values: Dict[str, Any]) -> Dict[str, Any]:
+    """Checks the position fields that are present and normalizes empty strings to None."""
+    values = dict(values)
+    for field in ("position", "note", "format", "device"):
+        if isinstance(values.get(field), str):
+            values[field] = values[field].strip() or None
+    if values.get("format"):
+        values["format"] = values["format"].upper()
+    percentage = values.get("percentage")
+    if percentage is not None and not 0 <= percentage <= 100:
+        raise ValueError("The percentage must be between 0 and 100.")
+    page = values.get("page")
+    if page is not None and page < 0:
+        raise ValueError("The page must not be negative.")
+    if len(values.get("position") or "") > MAX_POSITION_LENGTH:
+        raise ValueError(f"The position must be at most {MAX_POSITION_LENGTH} characters.")
+    if len(values.get("note") or "") > MAX_NOTE_LENGTH:
+        raise ValueError(f"The note must be at most {MAX_NOTE_LENGTH} characters.")
+    for field in ("format", "device"):
+        if len(values.get(field) or "") > MAX_FIELD_LENGTH:
+            raise ValueError(f"The {field} must be at most {MAX_FIELD_LENGTH} characters.")
+    return values
+
+
+# --- Progress ---
+
+_PROGRESS_FIELDS = ("book_id", "format", "position", "percentage", "page", "device", "updated_at", "finished_at")
+
+
+def get_progress(user_id: int, book_id: int, library_path: Optional[str] = None) -> Optional[Dict[str, Any]]:
+    """The user's progress in the book, or None if none was recorded."""
+    if not os.path.exists(db_path()):
+        return None
+    with _lock:
+        conn = connect()
+        try:
+            row = conn.execute(f"SELECT {', '.join(_PROGRESS_FIELDS)} FROM progress "
+                               "WHERE user_id = ? AND library = ? AND book_id = ?",
+                               (user_id, _library_key(library_path), book_id)).fetchone()
+        finally:
+            conn.close()
+    return dict(zip(_PROGRESS_FIELDS, row)) if row else None
+
+
+def set_progress(user_id: int, book_id: int, values: Dict[str, Any], library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Records where the user is in the book, replacing the previous record. At least one of
+    position, percentage and page is needed. Reaching FINISHED_PERCENTAGE the first time sets
+    finished_at, which later updates keep.
+
+    Raises:
+        ValueError: For unknown fields, out-of-range values or no position at all.
+    """
+    unknown = set(values) - {"format", "position", "percentage", "page", "device"}
+    if unknown:
+        raise ValueError(f"Unknown field(s): {', '.join(sorted(unknown))}.")
+    values = _validate(values)
+    if all(values.get(field) is None for field in ("position", "percentage", "page")):
+        raise ValueError("Give at least one of position, percentage and page.")
+    record = {field: values.get(field) for field in _PROGRESS_FIELDS}
+    record.update(book_id=book_id, updated_at=time.time())
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                row = conn.execute("SELECT finished_at FROM progress WHERE user_id = ? AND library = ? AND book_id = ?",
+                                   (user_id, _library_key(library_path), book_id)).fetchone()
+                finished = (record["percentage"] or 0) >= FINISHED_PERCENTAGE
+                record["finished_at"] = row[0] if row and row[0] else (record["updated_at"] if finished else None)
+                conn.execute(
+                    f"INSERT OR REPLACE INTO progress (user_id, library, {', '.join(_PROGRESS_FIELDS)}) "
+                    f"VALUES (?, ?, {', '.join('?' * len(_PROGRESS_FIELDS))})",
+                    (user_id, _library_key(library_path), *(record[field] for field in _PROGRESS_FIELDS)))
+        finally:
+            conn.close()
+    return record
+
+
+def clear_progress(user_id: int, book_id: int, library_path: Optional[str] = None) -> bool:
+    """Forgets the user's progress in the book. Returns whether there was any."""
+    if not os.path.exists(db_path()):
+        return False
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                return conn.execute("DELETE FROM progress WHERE user_id = ? AND library = ? AND book_id = ?",
+                                    (user_id, _library_key(library_path), book_id)).rowcount > 0
+        finally:
+            conn.close()
+
+
+def list_progress(user_id: int, library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """All of the user's progress records in the library, most recently updated first."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"SELECT {', '.join(_PROGRESS_FIELDS)} FROM progress WHERE user_id = ? AND library = ? "
+                                "ORDER BY updated_at DESC", (user_id, _library_key(library_path))).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(_PROGRESS_FIELDS, row)) for row in rows]
+
+
+def book_readers(book_id: int, library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """Everyone's progress in the book: {"user_id", "percentage", "updated_at", "finished_at"}, most recently read first."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute("SELECT user_id, percentage, updated_at, finished_at FROM progress "
+                                "WHERE library = ? AND book_id = ? ORDER BY updated_at DESC",
+                                (_library_key(library_path), book_id)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(("user_id", "percentage", "updated_at", "finished_at"), row)) for row in rows]
+
+
+def recently_finished(library_path: Optional[str] = None, before: Optional[float] = None, limit: int = 50,
+                      exclude_users: Iterable[int] = ()) -> List[Dict[str, Any]]:
+    """The books users of the library finished before `before` (Unix time), newest first, except those of exclude_users."""
+    if not os.path.exists(db_path()):
+        return []
+    exclude_users = list(exclude_users)
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(
+                f"SELECT user_id, book_id, finished_at FROM progress WHERE library = ? AND finished_at < ? "
+                f"AND user_id NOT IN ({', '.join('?' * len(exclude_users))}) ORDER BY finished_at DESC LIMIT ?",
+                (_library_key(library_path), before if before is not None else float("inf"), *exclude_users, limit)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(("user_id", "book_id", "finished_at"), row)) for row in rows]
+
+
+# --- Bookmarks ---
+
+_BOOKMARK_FIELDS = ("id", "book_id", "format", "position", "percentage", "page", "note", "created_at", "updated_at")
+_SELECT_BOOKMARK = f"SELECT {', '.join(_BOOKMARK_FIELDS)} FROM bookmarks"
+
+
+def _get_bookmark(conn: sqlite3.Connection, user_id: int, book_id: int, bookmark_id: int, library: str) -> Dict[str, Any]:
+    row = conn.execute(f"{_SELECT_BOOKMARK} WHERE id = ? AND user_id = ? AND library = ? AND book_id = ?",
+                       (bookmark_id, user_id, library, book_id)).fetchone()
+    if row is None:
+        raise BookmarkNotFound(f"Bookmark {bookmark_id} not found.")
+    return dict(zip(_BOOKMARK_FIELDS, row))
+
+
+def list_bookmarks(user_id: int, book_id: int, library_path: Optional[str] = None) -> List[Dict[str, Any]]:
+    """The user's bookmarks in the book, by percentage (bookmarks without one last), then as added."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"{_SELECT_BOOKMARK} WHERE user_id = ? AND library = ? AND book_id = ? "
+                                "ORDER BY percentage IS NULL, percentage, id",
+                                (user_id, _library_key(library_path), book_id)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(_BOOKMARK_FIELDS, row)) for row in rows]
+
+
+def add_bookmark(user_id: int, book_id: int, values: Dict[str, Any], library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Raises:
+        ValueError: For unknown fields, out-of-range values or a missing position.
+    """
+    unknown = set(values) - {"format", "position", "percentage", "page", "note"}
+    if unknown:
+        raise ValueError(f"Unknown field(s): {', '.join(sorted(unknown))}.")
+    values = _validate(values)
+    if not values.get("position"):
+        raise ValueError("A bookmark needs a position.")
+    library = _library_key(library_path)
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                bookmark_id = conn.execute(
+                    "INSERT INTO bookmarks (user_id, library, book_id, format, position, percentage, page, note, "
+                    "created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+                    (user_id, library, book_id, values.get("format"), values["position"], values.get("percentage"),
+                     values.get("page"), values.get("note"), now, now)).lastrowid
+            return _get_bookmark(conn, user_id, book_id, bookmark_id, library)
+        finally:
+            conn.close()
+
+
+def update_bookmark(user_id: int, book_id: int, bookmark_id: int, changes: Dict[str, Any],
+                    library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Changes the given fields of the bookmark, e.g. its note.
+
+    Raises:
+        ValueError: For unknown fields, out-of-range values or removing the position.
+        BookmarkNotFound: If the user has no such bookmark on the book.
+    """
+    unknown = set(changes) - {"format", "position", "percentage", "page", "note"}
+    if unknown:
+        raise ValueError(f"Unknown field(s): {', '.join(sorted(unknown))}.")
+    changes = _validate(changes)
+    if "position" in changes and not changes["position"]:
+        raise ValueError("A bookmark needs a position.")
+    library = _library_key(library_path)
+    with _lock:
+        conn = connect()
+        try:
+            _get_bookmark(conn, user_id, book_id, bookmark_id, library)
+            if changes:
+                with conn:
+                    # Field names come from the fixed set checked above.
+                    assignments = ", ".join(f"{field} = ?" for field in changes)
+                    conn.execute(f"UPDATE bookmarks SET {assignments}, updated_at = ? WHERE id = ?",
+                                 (*changes.values(), time.time(), bookmark_id))
+            return _get_bookmark(conn, user_id, book_id, bookmark_id, library)
+        finally:
+            conn.close()
+
+
+def delete_bookmark(user_id: int, book_id: int, bookmark_id: int, library_path: Optional[str] = None) -> None:
+    """
+    Raises:
+        BookmarkNotFound: If the user has no such bookmark on the book.
+    """
+    library = _library_key(library_path)
+    with _lock:
+        conn = connect()
+        try:
+            _get_bookmark(conn, user_id, book_id, bookmark_id, library)
+            with conn:
+                conn.execute("DELETE FROM bookmarks WHERE id = ?", (bookmark_id,))
+        finally:
+            conn.close()
+
+
+def export_user(user_id: int) -> Dict[str, List[Dict[str, Any]]]:
+    """All of the user's progress and bookmarks, in all libraries ("library" is "" for the default one)."""
+    if not os.path.exists(db_path()):
+        return {"progress": [], "bookmarks": []}
+    with _lock:
+        conn = connect()
+        try:
+            progress = conn.execute(f"SELECT library, {', '.join(_PROGRESS_FIELDS)} FROM progress WHERE user_id = ? "
+                                    "ORDER BY library, book_id", (user_id,)).fetchall()
+            bookmarks = conn.execute(f"SELECT library, {', '.join(_BOOKMARK_FIELDS)} FROM bookmarks WHERE user_id = ? "
+                                     "ORDER BY id", (user_id,)).fetchall()
+        finally:
+            conn.close()
+    return {"progress": [dict(zip(("library", *_PROGRESS_FIELDS), row)) for row in progress],
+            "bookmarks": [dict(zip(("library", *_BOOKMARK_FIELDS), row)) for row in bookmarks]}
+
+# --- Cleanup ---
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Removes everyone's progress and bookmarks of deleted books."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    params = [(_library_key(library_path), book_id) for book_id in book_ids]
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("DELETE FROM progress WHERE library = ? AND book_id = ?", params)
+                conn.executemany("DELETE FROM bookmarks WHERE library = ? AND book_id = ?", params)
+        finally:
+            conn.close()
+
+
+def forget_user(user_id: int) -> None:
+    """Removes a deleted user's progress and bookmarks in all libraries."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM progress WHERE user_id = ?", (user_id,))
+                conn.execute("DELETE FROM bookmarks WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
@@ -0,0 +1,236 @@
+"""
+Demo data: fills a library with generated books for demos, frontend development and performance
+testing. Every book is a small but valid EPUB with title, authors, tags, series, publisher,
+language, description and ISBN in its OPF, and a generated cover when Pillow is installed.
+The same --seed gives the same books.
+
+Run from the calibre_api directory:
+
+    python -m app.seed --books 500 [--library /tmp/demo-library] [--seed 7]
+
+Without --library, a new library is created in a temporary folder. The library path is printed
+at the end; point the server at it with CALIBRE_LIBRARY_PATH or the library_path parameters.
+"""
+import argparse
+import io
+import logging
+import os
+import random
+import shutil
+import sys
+import tempfile
+import zipfile
+from html import escape
+from typing import Any, Dict, List, Optional
+
+from . import isbn as isbn_utils
+from . import provenance
+from .crud import add_books
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_BOOKS = 50
+BATCH_SIZE = 100
+COVER_SIZE = (600, 900)
+
+FIRST_NAMES = ["Ada", "Amara", "Bram", "Chen", "Dorothy", "Elif", "Farid", "Greta", "Hiro", "Ines", "Jonas", "Kwame",
+               "Leila", "Mateo", "Nadia", "Oskar", "Priya", "Quentin", "Rosa", "Sven", "Tamsin", "Ulla", "Viktor",
+               "Wen", "Yusuf", "Zofia"]
+LAST_NAMES = ["Abernathy", "Bergström", "Castellanos", "Dubois", "Eze", "Fujimoto", "Grünwald", "Hallorann", "Iyer",
+              "Jansen", "Kowalczyk", "Lindqvist", "Moreau", "Nakamura", "Okafor", "Petrov", "Quinlan", "Rahman",
+              "Sørensen", "Takahashi", "Ugarte", "Valdés", "Whitlock", "Xu", "Yilmaz", "Zamora"]
+TITLE_ADJECTIVES = ["Silent", "Crimson", "Last", "Hidden", "Burning", "Forgotten", "Glass", "Hollow", "Iron", "Quiet",
+                    "Distant", "Winter", "Broken", "Golden", "Drowned", "Northern", "Paper", "Wandering"]
+TITLE_NOUNS = ["Garden", "Empire", "Harbor", "Orchard", "Lighthouse", "Archive", "Kingdom", "River", "Machine",
+               "Cartographer", "Winter", "Station", "Library", "Tide", "Comet", "Labyrinth", "Atlas", "Bridge"]
+TITLE_PATTERNS = ["The {adj} {noun}", "{noun} of {noun2}", "A {adj} {noun}", "{adj} {noun}", "The {noun}'s {noun2}",
+                  "Beyond the {adj} {noun}"]
+SERIES_NAMES = ["The Meridian Cycle", "Chronicles of Vey", "The Saltmarsh Mysteries", "Starfall", "The Long Road",
+                "Inspector Halloway", "The Clockwork Court"]
+TAGS = ["Fantasy", "Science Fiction", "Mystery", "Thriller", "Romance", "Historical Fiction", "Horror", "Poetry",
+        "Biography", "History", "Science", "Philosophy", "Travel", "Cooking", "Young Adult", "Classics", "Humor"]
+PUBLISHERS = ["Lantern House", "Northwind Press", "Quill & Ink", "Harborlight Books", "Red Fern Publishing",
+              "Open Sky Editions"]
+LANGUAGES = ["eng"] * 8 + ["deu", "fra", "spa", "ita"]
+SENTENCES = ["A story of {noun} and {noun2}, told across three generations.",
+             "When the {noun} falls silent, only {name} remembers why.",
+             "An unforgettable journey from the {adj} {noun} to the edge of the world.",
+             "Nothing in {name}'s life prepared them for the {noun2}.",
+             "Critics call it the definitive novel about the {adj} {noun}."]
+COVER_COLORS = [(38, 70, 83), (42, 157, 143), (233, 196, 106), (244, 162, 97), (231, 111, 81), (94, 84, 142),
+                (29, 53, 87), (168, 218, 220), (69, 123, 157), (131, 56, 236), (58, 134, 255), (251, 86, 7)]
+
+
+def _name(rng: random.Random) -> str:
+    return f"{rng.choice(FIRST_NAMES)} {rng.choice(LAST_NAMES)}"
+
+
+def _fill(rng: random.Random, pattern: str) -> str:
+    noun, noun2 = rng.sample(TITLE_NOUNS, 2)
+    return pattern.format(adj=rng.choice(TITLE_ADJECTIVES), noun=noun, noun2=noun2, name=rng.choice(FIRST_NAMES))
+
+
+def _isbn13(rng: random.Random) -> str:
+    first12 = "978" + "".join(str(rng.randint(0, 9)) for _ in range(9))
+    return first12 + isbn_utils._isbn13_check_digit(first12)
+
+
+def generate_books(count: int, seed: int = 0) -> List[Dict[str, Any]]:
+    """Metadata of `count` fake books. Authors write several books; about a third are in a series."""
+    rng = random.Random(seed)
+    authors = [_name(rng) for _ in range(max(3, count // 4))]
+    series_progress: Dict[str, int] = {}
+    books = []
+    for index in range(count):
+        book: Dict[str, Any] = {
+            "title": _fill(rng, rng.choice(TITLE_PATTERNS)),
+            "authors": rng.sample(authors, 2 if rng.random() < 0.1 else 1),
+            "tags": rng.sample(TAGS, rng.randint(1, 3)),
+            "publisher": rng.choice(PUBLISHERS),
+            "pubdate": f"{rng.randint(1920, 2025)}-{rng.randint(1, 12):02d}-{rng.randint(1, 28):02d}",
+            "language": rng.choice(LANGUAGES),
+            "isbn": _isbn13(rng),
+            "comments": " ".join(_fill(rng, s) for s in rng.sample(SENTENCES, 2)),
+            "series": None,
+            "series_index": None,
+            "color": rng.choice(COVER_COLORS),
+            "uid": f"shelfstone-seed-{seed}-{index}",
+        }
+        if rng.random() < 0.35:
+            series = rng.choice(SERIES_NAMES)
+            series_progress[series] = series_progress.get(series, 0) + 1
+            book["series"], book["series_index"] = series, float(series_progress[series])
+        books.append(book)
+    return books
+
+
+def render_cover(book: Dict[str, Any]) -> Optional[bytes]:
+    """A JPEG cover with the title and author on a plain background, or None without Pillow."""
+    try:
+        from PIL import Image, ImageDraw, ImageFont
+    except ImportError:
+        return None
+    image = Image.new("RGB", COVER_SIZE, book["color"])
+    draw = ImageDraw.Draw(image)
+    try:
+        font, small = ImageFont.load_default(size=48), ImageFont.load_default(size=30)
+    except TypeError:  # Pillow < 10.1 has a single fixed-size default font.
+        font = small = ImageFont.load_default()
+    text_color = (255, 255, 255) if sum(book["color"]) < 450 else (20, 20, 20)
+    y = 120
+    line: List[str] = []
+    for word in book["title"].split() + [None]:
+        # Wrap the title at roughly 16 characters per line.
+        if word is None or (line and len(" ".join(line + [word])) > 16):
+            draw.text((50, y), " ".join(line), font=font, fill=text_color)
+            y, line = y + 64, []
+        if word:
+            line.append(word)
+    draw.text((50, COVER_SIZE[1] - 120), " & ".join(book["authors"]), font=small, fill=text_color)
+    output = io.BytesIO()
+    image.save(output, format="JPEG", quality=80)
+    return output.getvalue()
+
+
+def build_epub(book: Dict[str, Any], path: str, cover: Optional[bytes] = None) -> str:
+    """Writes a minimal valid EPUB 2 with the book's metadata in its OPF (as Calibre reads it)."""
+    creators = "".join(f'<dc:creator opf:role="aut">{escape(a)}</dc:creator>' for a in book["authors"])
+    subjects = "".join(f"<dc:subject>{escape(t)}</dc:subject>" for t in book["tags"])
+    series = ""
+    if book.get("series"):
+        series = (f'<meta name="calibre:series" content="{escape(book["series"])}"/>'
+                  f'<meta name="calibre:series_index" content="{book["series_index"]}"/>')
+    cover_meta = '<meta name="cover" content="cover-image"/>' if cover else ""
+    cover_item = '<item id="cover-image" href="cover.jpg" media-type="image/jpeg"/>' if cover else ""
+    opf = f"""<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>{escape(book["title"])}</dc:title>{creators}{subjects}
+    <dc:publisher>{escape(book["publisher"])}</dc:publisher>
+    <dc:date>{book["pubdate"]}</dc:date>
+    <dc:language>{book["language"]}</dc:language>
+    <dc:description>{escape(book["comments"])}</dc:description>
+    <dc:identifier id="uid">{book["uid"]}</dc:identifier>
+    <dc:identifier opf:scheme="ISBN">{book["isbn"]}</dc:identifier>
+    {series}{cover_meta}
+  </metadata>
+  <manifest>
+    <item id="chapter1" href="chapter1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>{cover_item}
+  </manifest>
+  <spine toc="ncx"><itemref idref="chapter1"/></spine>
+</package>"""
+    ncx = f"""<?xml version="1.0" encoding="utf-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head><meta name="dtb:uid" content="{book["uid"]}"/></head>
+  <docTitle><text>{escape(book["title"])}</text></docTitle>
+  <navMap><navPoint id="p1" playOrder="1"><navLabel><text>Chapter 1</text></navLabel><content src="chapter1.xhtml"/></navPoint></navMap>
+</ncx>"""
+    chapter = f"""<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>{escape(book["title"])}</title></head>
+<body><h1>{escape(book["title"])}</h1><p>{escape(book["comments"])}</p></body></html>"""
+    with zipfile.ZipFile(path, "w", zipfile.ZIP_DEFLATED) as epub:
+        # The mimetype must be the first entry, uncompressed.
+        epub.writestr("mimetype", "application/epub+zip", compress_type=zipfile.ZIP_STORED)
+        epub.writestr("META-INF/container.xml",
+                      '<?xml version="1.0"?><container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">'
+                      '<rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>')
+        epub.writestr("content.opf", opf)
+        epub.writestr("toc.ncx", ncx)
+        epub.writestr("chapter1.xhtml", chapter)
+        if cover:
+            epub.writestr("cover.jpg", cover)
+    return path
+
+
+def seed_library(count: int, library_path: str, seed: int = 0, batch_size: int = BATCH_SIZE) -> List[int]:
+    """
+    Generates `count` books and adds them to the library in batches. Returns the new book IDs.
+
+    Raises:
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If calibredb fails.
+    """
+    os.makedirs(library_path, exist_ok=True)
+    work_dir = tempfile.mkdtemp(prefix="shelfstone_seed_")
+    added: List[int] = []
+    try:
+        books = generate_books(count, seed)
+        for start in range(0, len(books), batch_size):
+            paths = []
+            for index, book in enumerate(books[start:start + batch_size], start):
+                paths.append(build_epub(book, os.path.join(work_dir, f"book_{index:05d}.epub"), render_cover(book)))
+            # Generated titles can repeat; they are still separate books.
+            batch_ids = add_books(paths, library_path=library_path, duplicates=True)
+            provenance.record(batch_ids, provenance.SEED, library_path=library_path)
+            added.extend(batch_ids)
+            for path in paths:
+                os.remove(path)
+            logger.info(f"Added {len(added)} of {count} generated books to '{library_path}'.")
+    finally:
+        shutil.rmtree(work_dir, ignore_errors=True)
+    return added
+
+
+def main(argv: Optional[List[str]] = None) -> int:
+    parser = argparse.ArgumentParser(prog="python -m app.seed", description="Fill a library with generated demo books.")
+    parser.add_argument("--books", type=int, default=DEFAULT_BOOKS, help=f"Number of books (default {DEFAULT_BOOKS}).")
+    parser.add_argument("--library", help="Library folder. Defaults to a new library in a temporary folder.")
+    parser.add_argument("--seed", type=int, default=0, help="Random seed; the same seed gives the same books.")
+    parser.add_argument("--append", action="store_true", help="Allow adding to a folder that is not empty.")
+    args = parser.parse_args(argv)
+
+    if args.books < 1:
+        parser.error("--books must be at least 1")
+    library = args.library or tempfile.mkdtemp(prefix="shelfstone_demo_library_")
+    if os.path.isdir(library) and os.listdir(library) and not args.append:
+        parser.error(f"'{library}' is not empty; pass --append to add demo books to an existing library")
+
+    added = seed_library(args.books, library, seed=args.seed)
+    print(f"Added {len(added)} books to {library}")
+    return 0 if len(added) == args.books else 1
+
+
+if __name__ == "__main__":
+    logging.basicConfig(level=logging.INFO)
+    sys.exit(main())
@@ -0,0 +1,124 @@
+"""
+Starts the server with the address, port and log level from the configuration (see app.config),
+instead of passing them to uvicorn on the command line (run from the calibre_api directory):
+
+    python -m app.serve
+
+With SHELFSTONE_PUBLIC_PORT or SHELFSTONE_PUBLIC_SOCKET set, a second listener serves only the
+public surface (OPDS, downloads, covers; see public_app) next to the full API.
+
+Instead of a TCP port, the API can listen on a Unix socket (SHELFSTONE_SOCKET), e.g. for a
+reverse proxy on the same host. Under systemd socket activation the server takes the sockets
+systemd passes (sd_listen_fds): the one named "public" (FileDescriptorName=public in the .socket
+unit) for the public listener, the other one for the API. Listener settings are then ignored
+for the sockets systemd provides.
+"""
+import asyncio
+import os
+import sys
+from typing import Any, Dict, List, Optional
+
+import uvicorn
+
+from . import config
+from . import lifecycle
+
+# First file descriptor passed by systemd (SD_LISTEN_FDS_START).
+LISTEN_FDS_START = 3
+API, PUBLIC = "api", "public"
+
+
+def systemd_sockets(environ: Optional[Dict[str, str]] = None, pid: Optional[int] = None) -> Dict[str, int]:
+    """
+    The sockets passed by systemd socket activation as {"api": fd, "public": fd}; empty if the
+    server wasn't socket-activated. The LISTEN_* variables are removed, so Calibre's
+    subprocesses don't take the sockets for theirs.
+
+    Raises:
+        ValueError: If LISTEN_FDS is invalid or more than one socket would serve the same listener.
+    """
+    environ = os.environ if environ is None else environ
+    count = environ.pop("LISTEN_FDS", None)
+    listen_pid = environ.pop("LISTEN_PID", None)
+    names = environ.pop("LISTEN_FDNAMES", None)
+    if not count or listen_pid != str(os.getpid() if pid is None else pid):
+        return {}
+    try:
+        fds = range(LISTEN_FDS_START, LISTEN_FDS_START + int(count))
+    except ValueError:
+        raise ValueError(f"Invalid LISTEN_FDS '{count}' from systemd.")
+    # Unnamed sockets are named after their .socket unit.
+    names = (names or "").split(":")
+    sockets: Dict[str, int] = {}
+    for index, fd in enumerate(fds):
+        role = PUBLIC if index < len(names) and names[index] == PUBLIC else API
+        if role in sockets:
+            raise ValueError(f"systemd passed more than one {role} socket. Name the public one with FileDescriptorName=public; "
+                             "the server uses one socket per listener.")
+        sockets[role] = fd
+    return sockets
+
+
+def api_listener(sockets: Optional[Dict[str, int]] = None) -> Dict[str, Any]:
+    """uvicorn.Config arguments of the API listener."""
+    if sockets and API in sockets:
+        return {"fd": sockets[API]}
+    socket_path = config.get("SHELFSTONE_SOCKET")
+    if socket_path:
+        return {"uds": socket_path}
+    return {"host": config.get("SHELFSTONE_HOST"), "port": int(config.get("SHELFSTONE_PORT"))}
+
+
+def public_listener(sockets: Optional[Dict[str, int]] = None) -> Optional[Dict[str, Any]]:
+    """uvicorn.Config arguments of the public listener, or None if none is configured."""
+    if sockets and PUBLIC in sockets:
+        return {"fd": sockets[PUBLIC]}
+    socket_path = config.get("SHELFSTONE_PUBLIC_SOCKET")
+    if socket_path:
+        return {"uds": socket_path}
+    port = config.get("SHELFSTONE_PUBLIC_PORT")
+    if port:
+        return {"host": config.get("SHELFSTONE_PUBLIC_HOST"), "port": int(port)}
+    return None
+
+
+async def serve_all(servers: List[uvicorn.Server]) -> None:
+    """Runs the servers until one of them stops (e.g. on Ctrl+C), then shuts down the others."""
+    tasks = [asyncio.ensure_future(server.serve()) for server in servers]
+    await asyncio.wait(tasks, return_when=asyncio.FIRST_COMPLETED)
+    for server in servers:
+        server.should_exit = True
+    await asyncio.gather(*tasks)
+
+
+def main() -> int:
+    try:
+        config.load()
+        sockets = systemd_sockets()
+    except (config.ConfigError, ValueError) as e:
+        print(e, file=sys.stderr)
+        return 2
+    log_level = config.get("SHELFSTONE_LOG_LEVEL").lower()
+    # On SIGTERM/SIGINT running requests get this long to finish; background jobs get as long again (see lifecycle).
+    options = {"log_level": log_level, "timeout_graceful_shutdown": lifecycle.shutdown_timeout()}
+    public = public_listener(sockets)
+    if public is None:
+        uvicorn.run("app.main:app", **options, **api_listener(sockets))
+        return 0
+
+    from . import public_app
+    from .main import app
+    servers = [
+        uvicorn.Server(uvicorn.Config(app, **options, **api_listener(sockets))),
+        uvicorn.Server(uvicorn.Config(public_app.build(app, public_app.parse_origins(config.get("SHELFSTONE_PUBLIC_CORS_ORIGINS"))),
+                                      **options, **public)),
+    ]
+    try:
+        asyncio.run(serve_all(servers))
+    except KeyboardInterrupt:
+        pass
+    return 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
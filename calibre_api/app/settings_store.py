@@ -0,0 +1,68 @@
+"""
+Settings changed at runtime through the API (e.g. feature flag overrides), kept in a small SQLite
+database (SHELFSTONE_SETTINGS_DB, in the state directory by default; see state_store) so they
+survive restarts. Deployment settings belong in the
+config file or environment (see config); this table only holds what admins toggle while the
+server runs. The Calibre library is never written to.
+"""
+import json
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, Optional
+
+from . import state_store
+
+_lock = threading.Lock()
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: the initial schema. IF NOT EXISTS because databases from before versioning already have it.
+    ("CREATE TABLE IF NOT EXISTS settings (key TEXT PRIMARY KEY, value TEXT NOT NULL, updated_at REAL NOT NULL)",),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_SETTINGS_DB", "settings.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+def get_all(prefix: str = "") -> Dict[str, Any]:
+    """{key: value} of the stored settings whose key starts with prefix. Empty if none were stored yet."""
+    if not os.path.exists(db_path()):
+        return {}
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute("SELECT key, value FROM settings WHERE substr(key, 1, ?) = ?", (len(prefix), prefix)).fetchall()
+        finally:
+            conn.close()
+    return {key: json.loads(value) for key, value in rows}
+
+
+def put(key: str, value: Any) -> None:
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("INSERT OR REPLACE INTO settings (key, value, updated_at) VALUES (?, ?, ?)",
+                             (key, json.dumps(value), time.time()))
+        finally:
+            conn.close()
+
+
+def delete(key: str) -> None:
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM settings WHERE key = ?", (key,))
+        finally:
+            conn.close()
@@ -0,0 +1,82 @@
+"""
+Where the server keeps its own state: the small SQLite databases for what doesn't belong in the
+Calibre library (collections, book sources, the processing log, runtime settings), the full-text
+index and the thumbnail and conversion caches. All of them default to SHELFSTONE_STATE_DIR
+(~/.shelfstone if unset); each can be moved on its own with its variable, e.g.
+SHELFSTONE_COLLECTIONS_DB. In a container, mount a volume at the state directory, or the state
+is lost with the container.
+
+The schema of each database is a list of migrations, oldest first. `PRAGMA user_version` records
+how many have been applied; connect() applies the missing ones in a single transaction, so a
+database is never left half-migrated. Databases written by a newer server, with more migrations
+than this one knows, are refused instead of being used with a schema the code doesn't expect.
+"""
+import os
+import sqlite3
+from typing import Callable, Optional, Sequence, Union
+
+# A migration is a sequence of SQL statements, or a function for changes SQL alone can't make.
+Migration = Union[Sequence[str], Callable[[sqlite3.Connection], None]]
+
+
+class SchemaTooNew(Exception):
+    """The database was migrated by a newer version of the server."""
+
+
+def state_dir() -> str:
+    return os.environ.get("SHELFSTONE_STATE_DIR") or os.path.join(os.path.expanduser("~"), ".shelfstone")
+
+
+def state_path(variable: str, name: str) -> str:
+    """The file or folder `name` in the state directory, unless the variable points elsewhere."""
+    return os.environ.get(variable) or os.path.join(state_dir(), name)
+
+
+def library_key(library_path: Optional[str]) -> str:
+    """How a library is identified in the state databases: its absolute path, or "" for calibredb's default."""
+    return os.path.abspath(library_path) if library_path else ""
+
+
+def migrate(conn: sqlite3.Connection, migrations: Sequence[Migration]) -> int:
+    """
+    Applies the migrations the database doesn't have yet and returns its schema version.
+
+    Raises:
+        SchemaTooNew: If the database has more migrations than `migrations`.
+    """
+    version = conn.execute("PRAGMA user_version").fetchone()[0]
+    if version == len(migrations):
+        return version
+    # IMMEDIATE takes the write lock now, so two processes starting at once don't both migrate;
+    # the version is read again under the lock.
+    conn.execute("BEGIN IMMEDIATE")
+    try:
+        version = conn.execute("PRAGMA user_version").fetchone()[0]
+        if version > len(migrations):
+            raise SchemaTooNew(
+                f"The database has schema version {version}, this server only knows up to {len(migrations)}. "
+                "Upgrade the server or point it at another state directory.")
+        for migration in migrations[version:]:
+            if callable(migration):
+                migration(conn)
+            else:
+                for statement in migration:
+                    conn.execute(statement)
+        conn.execute(f"PRAGMA user_version = {len(migrations)}")
+        conn.execute("COMMIT")
+    except BaseException:
+        conn.execute("ROLLBACK")
+        raise
+    return len(migrations)
+
+
+def connect(path: str, migrations: Sequence[Migration], timeout: float = 10) -> sqlite3.Connection:
+    """Opens the database at `path`, creating it and its folder if needed, and migrates it."""
+    os.makedirs(os.path.dirname(os.path.abspath(path)), exist_ok=True)
+    conn = sqlite3.connect(path, timeout=timeout)
+    try:
+        migrate(conn, migrations)
+    except BaseException:
+        conn.close()
+        raise
+    return conn
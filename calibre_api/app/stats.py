@@ -0,0 +1,73 @@
+"""
+Library statistics for the web dashboard: counts of books, authors, series, tags and formats, the
+size of the book files, books added per month and the authors with the most books.
+
+Everything is computed with aggregate queries on the library's metadata.db (read-only), so the
+cost doesn't grow with loading every book the way `calibredb list` would. File sizes are those
+Calibre records for each format file (the `data` table); covers and extra data files are not
+included.
+"""
+import os
+import sqlite3
+from datetime import date
+from typing import Any, Dict, List, Optional
+
+from . import library_db
+
+DEFAULT_MONTHS = 12
+DEFAULT_TOP_AUTHORS = 10
+
+
+def _month_range(months: int, today: date) -> List[str]:
+    """The last `months` months as "YYYY-MM", oldest first, ending with the current month."""
+    result = []
+    year, month = today.year, today.month
+    for _ in range(months):
+        result.append(f"{year:04d}-{month:02d}")
+        year, month = (year, month - 1) if month > 1 else (year - 1, 12)
+    return result[::-1]
+
+
+def _scalar(conn: sqlite3.Connection, sql: str) -> int:
+    return conn.execute(sql).fetchone()[0] or 0
+
+
+def library_stats(library_path: str, months: int = DEFAULT_MONTHS, top_authors: int = DEFAULT_TOP_AUTHORS,
+                  today: Optional[date] = None) -> Dict[str, Any]:
+    """
+    Returns {"books", "authors", "series", "tags", "total_size", "database_size", "formats",
+    "added_per_month", "top_authors"}. Months without additions are included with count 0.
+    """
+    month_keys = _month_range(months, today or date.today())
+    conn = library_db.connect_read_only(library_path)
+    try:
+        result: Dict[str, Any] = {
+            "books": _scalar(conn, "SELECT COUNT(*) FROM books"),
+            # Only authors, series and tags some book uses; see /taxonomy/unused for the others.
+            "authors": _scalar(conn, "SELECT COUNT(DISTINCT author) FROM books_authors_link"),
+            "series": _scalar(conn, "SELECT COUNT(DISTINCT series) FROM books_series_link"),
+            "tags": _scalar(conn, "SELECT COUNT(DISTINCT tag) FROM books_tags_link"),
+            "total_size": _scalar(conn, "SELECT SUM(uncompressed_size) FROM data"),
+        }
+        result["formats"] = [
+            {"format": fmt, "books": count, "size": size or 0}
+            for fmt, count, size in conn.execute(
+                "SELECT format, COUNT(DISTINCT book), SUM(uncompressed_size) FROM data "
+                "GROUP BY format ORDER BY COUNT(DISTINCT book) DESC, format")
+        ]
+        # Calibre stores timestamps as "YYYY-MM-DD HH:MM:SS+00:00".
+        added = dict(conn.execute(
+            "SELECT substr(timestamp, 1, 7), COUNT(*) FROM books WHERE substr(timestamp, 1, 7) >= ? GROUP BY 1",
+            (month_keys[0],)).fetchall()) if month_keys else {}
+        result["added_per_month"] = [{"month": m, "books": added.get(m, 0)} for m in month_keys]
+        result["top_authors"] = [
+            {"name": name, "books": count}
+            for name, count in conn.execute(
+                "SELECT authors.name, COUNT(*) FROM books_authors_link "
+                "JOIN authors ON authors.id = books_authors_link.author "
+                "GROUP BY books_authors_link.author ORDER BY COUNT(*) DESC, authors.sort LIMIT ?", (top_authors,))
+        ]
+    finally:
+        conn.close()
+    result["database_size"] = os.path.getsize(os.path.join(library_path, library_db.LIBRARY_DB_NAME))
+    return result
@@ -0,0 +1,153 @@
+"""
+Library-wide clean-up of tags and series: renaming, merging and finding unused entries.
+
+calibredb has no command to rename a tag or series, so renames are applied book by book
+with `calibredb set_metadata`. Calibre drops tags, series, authors and publishers that no
+longer have any books when it writes the last link, so the old names disappear by themselves.
+"""
+import sqlite3
+import logging
+from typing import Any, Dict, List, Optional
+
+from .crud import as_list, list_books, set_book_field, escape_search_value as _search_value
+from .calibre_cli import CalibreCLIError
+from . import library_db
+
+logger = logging.getLogger(__name__)
+
+# (category, item table, link table, link column) of the categories checked for unused entries.
+_LINKED_CATEGORIES = [
+    ("tags", "tags", "books_tags_link", "tag"),
+    ("series", "series", "books_series_link", "series"),
+    ("authors", "authors", "books_authors_link", "author"),
+    ("publishers", "publishers", "books_publishers_link", "publisher"),
+]
+
+
+def _validate_name(name: str, field: str) -> str:
+    name = (name or "").strip()
+    if not name:
+        raise ValueError(f"The new {field} name must not be empty.")
+    if field == "tag" and "," in name:
+        raise ValueError("Tag names cannot contain commas.")
+    return name
+
+
+def _update_books(books: List[Dict[str, Any]], field: str, new_value_for, dry_run: bool,
+                  library_path: Optional[str]) -> Dict[str, Any]:
+    updated, failed = [], []
+    for book in books:
+        value = new_value_for(book)
+        if value is None:
+            continue
+        if not dry_run:
+            try:
+                set_book_field(book["id"], field, value, library_path=library_path)
+            except (CalibreCLIError, ValueError) as e:
+                logger.warning(f"Updating {field} of book ID {book['id']} failed: {e}")
+                failed.append({"book_id": book["id"], "error": e.args[0] if e.args else str(e)})
+                continue
+        updated.append(book["id"])
+    return {"updated_book_ids": updated, "failed": failed}
+
+
+def merge_tags(sources: List[str], target: str, library_path: Optional[str] = None,
+               dry_run: bool = False) -> Dict[str, Any]:
+    """
+    Replaces the tags in `sources` with `target` on every book that has any of them.
+    Renaming a tag is merging a single source tag. Tag names match case-insensitively, as in Calibre.
+
+    Returns:
+        {"updated_book_ids": [...], "failed": [{"book_id", "error"}]}
+
+    Raises:
+        ValueError: If no source tags are given or the target name is invalid.
+        FileNotFoundError: If calibredb is not found.
+        CalibredbError: If listing the books fails. Failures on single books are reported in "failed".
+    """
+    target = _validate_name(target, "tag")
+    sources = [s.strip() for s in sources if s and s.strip()]
+    if not sources:
+        raise ValueError("At least one source tag is required.")
+    source_keys = {s.lower() for s in sources}
+
+    search = " or ".join(f'tags:"={_search_value(s)}"' for s in sources)
+    books = list_books(library_path=library_path, search_query=search)
+
+    def new_tags(book):
+        tags = as_list(book.get("tags"))
+        if not any(t.lower() in source_keys for t in tags):
+            return None
+        result = []
+        for tag in tags:
+            replacement = target if tag.lower() in source_keys else tag
+            if replacement.lower() not in (r.lower() for r in result):
+                result.append(replacement)
+        return ",".join(result)
+
+    return _update_books(books, "tags", new_tags, dry_run, library_path)
+
+
+def rename_tag(old: str, new: str, library_path: Optional[str] = None, dry_run: bool = False) -> Dict[str, Any]:
+    """Renames a tag on all books. See merge_tags."""
+    return merge_tags([old], new, library_path=library_path, dry_run=dry_run)
+
+
+def rename_series(old: str, new: str, library_path: Optional[str] = None, dry_run: bool = False) -> Dict[str, Any]:
+    """
+    Renames a series on all books, keeping their series index. Renaming to an existing
+    series merges the two.
+
+    Returns and raises like merge_tags.
+    """
+    new = _validate_name(new, "series")
+    old = (old or "").strip()
+    if not old:
+        raise ValueError("The series to rename must not be empty.")
+    books = list_books(library_path=library_path, search_query=f'series:"={_search_value(old)}"')
+
+    def new_series(book):
+        return new if (book.get("series") or "").lower() == old.lower() else None
+
+    return _update_books(books, "series", new_series, dry_run, library_path)
+
+
+def find_unused_entries(library_path: str) -> Dict[str, List[str]]:
+    """
+    Lists tags, series, authors and publishers that are not linked to any book,
+    read directly from the library's metadata.db (read-only).
+    """
+    conn = library_db.connect_read_only(library_path)
+    try:
+        unused = {}
+        for category, table, link_table, link_column in _LINKED_CATEGORIES:
+            try:
+                rows = conn.execute(
+                    f"SELECT name FROM {table} WHERE NOT EXISTS "
+                    f"(SELECT 1 FROM {link_table} WHERE {link_table}.{link_column} = {table}.id) ORDER BY name"
+                ).fetchall()
+            except sqlite3.OperationalError as e:
+                # Very old or partial libraries may lack a table; report the others.
+                logger.warning(f"Could not check unused {category}: {e}")
+                rows = []
+            unused[category] = [row[0] for row in rows]
+    finally:
+        conn.close()
+    return unused
+
+
+def list_tags(library_path: str) -> List[Dict[str, Any]]:
+    """
+    All tags with the number of books that have them, by name, read directly from the
+    library's metadata.db (read-only).
+    """
+    conn = library_db.connect_read_only(library_path)
+    try:
+        rows = conn.execute(
+            "SELECT tags.name, COUNT(books_tags_link.book) FROM tags "
+            "LEFT JOIN books_tags_link ON books_tags_link.tag = tags.id "
+            "GROUP BY tags.id ORDER BY tags.name COLLATE NOCASE"
+        ).fetchall()
+    finally:
+        conn.close()
+    return [{"name": name, "books": count} for name, count in rows]
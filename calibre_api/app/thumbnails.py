@@ -0,0 +1,66 @@
+"""
+Resized cover images for grid views and catalog thumbnails, cached on disk so each size is
+scaled only once per cover (SHELFSTONE_THUMBNAIL_CACHE). Cache entries are keyed on the cover
+file's path and modification time, so a new cover gets new thumbnails; outdated ones expire
+through the janitor (SHELFSTONE_THUMBNAIL_CACHE_DAYS).
+"""
+import hashlib
+import os
+import tempfile
+from typing import Optional
+
+from .sync import make_thumbnail
+from .conversion_cache import remove_entries
+from . import state_store
+
+# Bounding boxes (width, height); covers keep their aspect ratio.
+SIZES = {
+    "small": (120, 180),
+    "medium": (300, 450),
+    "large": (600, 900),
+}
+
+
+def cache_dir() -> str:
+    return state_store.state_path("SHELFSTONE_THUMBNAIL_CACHE", "thumbnails")
+
+
+def cache_path(book_id: int, cover_path: str, size: str) -> str:
+    stat = os.stat(cover_path)
+    digest = hashlib.sha256(f"{os.path.abspath(cover_path)}|{stat.st_mtime_ns}".encode("utf-8")).hexdigest()
+    return os.path.join(cache_dir(), f"{book_id}_{size}_{digest[:16]}.jpg")
+
+
+def remove_book_entries(book_id: int) -> int:
+    """Removes all cached thumbnails of a book, e.g. after it was deleted. Returns the number removed."""
+    return remove_entries(cache_dir(), f"{book_id}_")
+
+
+def get_thumbnail(book_id: int, cover_path: str, size: str) -> Optional[str]:
+    """
+    Returns the path of the cached thumbnail, creating it if needed, or None if the cover
+    can't be scaled (Pillow not installed or unreadable image).
+
+    Raises:
+        ValueError: For an unknown size.
+    """
+    if size not in SIZES:
+        raise ValueError(f"Unknown size '{size}'. Use one of: {', '.join(SIZES)}.")
+    path = cache_path(book_id, cover_path, size)
+    if os.path.isfile(path):
+        os.utime(path)  # Recently used entries are kept by the janitor.
+        return path
+    data = make_thumbnail(cover_path, SIZES[size])
+    if data is None:
+        return None
+    os.makedirs(cache_dir(), exist_ok=True)
+    # Write to a temporary file and rename, so concurrent requests never read a partial image.
+    fd, partial = tempfile.mkstemp(prefix=".partial_", suffix=".jpg", dir=cache_dir())
+    try:
+        with os.fdopen(fd, "wb") as f:
+            f.write(data)
+        os.replace(partial, path)
+    finally:
+        if os.path.exists(partial):
+            os.remove(partial)
+    return path
@@ -0,0 +1,139 @@
+import os
+import json
+import uuid
+import shutil
+import tempfile
+import logging
+from typing import Any, Dict, Optional
+
+logger = logging.getLogger(__name__)
+
+# Resumable uploads are assembled on disk in one folder per upload:
+#   <UPLOAD_ROOT>/<upload_id>/upload.json   - filename and expected total size
+#   <UPLOAD_ROOT>/<upload_id>/<filename>     - the bytes received so far
+# The current offset is simply the size of the data file, so an interrupted
+# client can always ask where to resume.
+UPLOAD_ROOT = os.path.join(tempfile.gettempdir(), "shelfstone_server_uploads")
+INFO_FILE = "upload.json"
+
+
+class UploadNotFound(Exception):
+    """Raised when an upload ID is unknown (never created, committed, or aborted)."""
+
+
+class UploadOffsetMismatch(Exception):
+    """Raised when a chunk does not start at the current end of the upload."""
+    def __init__(self, message: str, expected_offset: int):
+        super().__init__(message)
+        self.expected_offset = expected_offset
+
+
+def _upload_dir(upload_id: str) -> str:
+    try:
+        # Only canonical UUIDs are accepted, which also keeps the ID from escaping UPLOAD_ROOT.
+        if str(uuid.UUID(upload_id)) != upload_id:
+            raise ValueError
+    except ValueError:
+        raise UploadNotFound(f"Upload '{upload_id}' not found.")
+    path = os.path.join(UPLOAD_ROOT, upload_id)
+    if not os.path.isdir(path):
+        raise UploadNotFound(f"Upload '{upload_id}' not found.")
+    return path
+
+
+def _read_info(upload_dir: str) -> Dict[str, Any]:
+    with open(os.path.join(upload_dir, INFO_FILE), "r", encoding="utf-8") as f:
+        return json.load(f)
+
+
+def create_upload(filename: str, total_size: Optional[int] = None) -> Dict[str, Any]:
+    """
+    Starts a new resumable upload.
+
+    Raises:
+        ValueError: If the filename is empty or total_size is negative.
+    """
+    filename = os.path.basename(filename or "")
+    if not filename or filename == INFO_FILE:
+        raise ValueError("A valid filename is required to start an upload.")
+    if total_size is not None and total_size < 0:
+        raise ValueError("total_size must not be negative.")
+
+    upload_id = str(uuid.uuid4())
+    upload_dir = os.path.join(UPLOAD_ROOT, upload_id)
+    os.makedirs(upload_dir)
+    with open(os.path.join(upload_dir, INFO_FILE), "w", encoding="utf-8") as f:
+        json.dump({"filename": filename, "total_size": total_size}, f)
+    open(os.path.join(upload_dir, filename), "wb").close()
+    logger.info(f"Started upload {upload_id} for '{filename}' (total size: {total_size}).")
+    return get_upload(upload_id)
+
+
+def get_upload(upload_id: str) -> Dict[str, Any]:
+    """
+    Returns the state of an upload: upload_id, filename, total_size, offset and complete.
+
+    Raises:
+        UploadNotFound: If the upload does not exist.
+    """
+    upload_dir = _upload_dir(upload_id)
+    info = _read_info(upload_dir)
+    offset = os.path.getsize(os.path.join(upload_dir, info["filename"]))
+    return {
+        "upload_id": upload_id,
+        "filename": info["filename"],
+        "total_size": info["total_size"],
+        "offset": offset,
+        "complete": info["total_size"] is not None and offset == info["total_size"],
+    }
+
+
+def append_chunk(upload_id: str, offset: int, data: bytes) -> Dict[str, Any]:
+    """
+    Appends a chunk at `offset`, which must equal the current size of the upload.
+    Re-sending a chunk after a lost response therefore fails with UploadOffsetMismatch,
+    telling the client the offset to continue from, instead of corrupting the file.
+
+    Raises:
+        UploadNotFound: If the upload does not exist.
+        UploadOffsetMismatch: If offset is not the current end of the upload.
+        ValueError: If the chunk would grow the upload beyond its declared total size.
+    """
+    state = get_upload(upload_id)
+    if offset != state["offset"]:
+        raise UploadOffsetMismatch(
+            f"Chunk offset {offset} does not match the current upload offset {state['offset']}.",
+            expected_offset=state["offset"],
+        )
+    if state["total_size"] is not None and offset + len(data) > state["total_size"]:
+        raise ValueError(f"Chunk exceeds the declared total size of {state['total_size']} bytes.")
+
+    with open(os.path.join(UPLOAD_ROOT, upload_id, state["filename"]), "ab") as f:
+        f.write(data)
+    return get_upload(upload_id)
+
+
+def completed_file_path(upload_id: str) -> str:
+    """
+    Returns the path of the assembled file, once all bytes have been received.
+
+    Raises:
+        UploadNotFound: If the upload does not exist.
+        ValueError: If the upload is smaller than its declared total size, or empty.
+    """
+    state = get_upload(upload_id)
+    if state["total_size"] is not None and not state["complete"]:
+        raise ValueError(f"Upload is incomplete: {state['offset']} of {state['total_size']} bytes received.")
+    if state["offset"] == 0:
+        raise ValueError("Upload is empty.")
+    return os.path.join(UPLOAD_ROOT, upload_id, state["filename"])
+
+
+def delete_upload(upload_id: str) -> None:
+    """
+    Removes an upload and its data.
+
+    Raises:
+        UploadNotFound: If the upload does not exist.
+    """
+    shutil.rmtree(_upload_dir(upload_id))
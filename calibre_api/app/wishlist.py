@@ -0,0 +1,184 @@
+"""
+Per-user wishlists: books someone wants to read, whether or not the library has them yet (then
+the entry links to the book). Needs user accounts (see accounts).
+
+Entries are kept in a small SQLite database (SHELFSTONE_WISHLIST_DB, in the state directory by
+default; see state_store). A user's wishlist spans all libraries; book IDs refer to the entry's
+library.
+"""
+import os
+import sqlite3
+import threading
+import time
+from typing import Any, Dict, List, Optional
+
+from . import isbn as isbn_utils
+from . import state_store
+from .state_store import library_key as _library_key
+
+_lock = threading.Lock()
+
+MAX_TEXT_LENGTH = 500
+MAX_NOTE_LENGTH = 5000
+FIELDS = ("title", "authors", "isbn", "note", "book_id")
+
+
+class WishNotFound(Exception):
+    """The user has no wishlist entry with this ID."""
+
+
+# Oldest first; append new migrations, never change applied ones (see state_store).
+MIGRATIONS = [
+    # 1: wishlist entries.
+    (
+        "CREATE TABLE wishes ("
+        "id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, title TEXT NOT NULL, authors TEXT, "
+        "isbn TEXT, note TEXT, library TEXT, book_id INTEGER, created_at REAL NOT NULL, updated_at REAL NOT NULL)",
+        "CREATE INDEX wishes_user ON wishes (user_id, id)",
+    ),
+]
+
+
+def db_path() -> str:
+    return state_store.state_path("SHELFSTONE_WISHLIST_DB", "wishlist.db")
+
+
+def connect(path: Optional[str] = None) -> sqlite3.Connection:
+    return state_store.connect(path or db_path(), MIGRATIONS)
+
+
+def _validate(values: Dict[str, Any]) -> Dict[str, Any]:
+    unknown = set(values) - set(FIELDS)
+    if unknown:
+        raise ValueError(f"Unknown field(s): {', '.join(sorted(unknown))}.")
+    values = dict(values)
+    for field in ("title", "authors", "isbn", "note"):
+        if isinstance(values.get(field), str):
+            values[field] = values[field].strip() or None
+    if "title" in values and not values["title"]:
+        raise ValueError("A wishlist entry needs a title.")
+    for field in ("title", "authors"):
+        if len(values.get(field) or "") > MAX_TEXT_LENGTH:
+            raise ValueError(f"The {field} must be at most {MAX_TEXT_LENGTH} characters.")
+    if len(values.get("note") or "") > MAX_NOTE_LENGTH:
+        raise ValueError(f"The note must be at most {MAX_NOTE_LENGTH} characters.")
+    if values.get("isbn"):
+        values["isbn"] = isbn_utils.normalize_isbn(values["isbn"])
+    if values.get("book_id") is not None and values["book_id"] <= 0:
+        raise ValueError("Book IDs must be positive integers.")
+    return values
+
+
+_COLUMNS = ("id", "title", "authors", "isbn", "note", "book_id", "created_at", "updated_at")
+_SELECT = f"SELECT {', '.join(_COLUMNS)} FROM wishes"
+
+
+def _get(conn: sqlite3.Connection, user_id: int, wish_id: int) -> Dict[str, Any]:
+    row = conn.execute(f"{_SELECT} WHERE id = ? AND user_id = ?", (wish_id, user_id)).fetchone()
+    if row is None:
+        raise WishNotFound(f"Wishlist entry {wish_id} not found.")
+    return dict(zip(_COLUMNS, row))
+
+
+def list_wishes(user_id: int) -> List[Dict[str, Any]]:
+    """The user's wishlist, newest first."""
+    if not os.path.exists(db_path()):
+        return []
+    with _lock:
+        conn = connect()
+        try:
+            rows = conn.execute(f"{_SELECT} WHERE user_id = ? ORDER BY id DESC", (user_id,)).fetchall()
+        finally:
+            conn.close()
+    return [dict(zip(_COLUMNS, row)) for row in rows]
+
+
+def add_wish(user_id: int, values: Dict[str, Any], library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Raises:
+        ValueError: For unknown fields, a missing title or an invalid ISBN.
+    """
+    values = _validate(values)
+    if not values.get("title"):
+        raise ValueError("A wishlist entry needs a title.")
+    now = time.time()
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                wish_id = conn.execute(
+                    "INSERT INTO wishes (user_id, title, authors, isbn, note, library, book_id, created_at, updated_at) "
+                    "VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+                    (user_id, values["title"], values.get("authors"), values.get("isbn"), values.get("note"),
+                     _library_key(library_path) if values.get("book_id") else None, values.get("book_id"), now, now)).lastrowid
+            return _get(conn, user_id, wish_id)
+        finally:
+            conn.close()
+
+
+def update_wish(user_id: int, wish_id: int, changes: Dict[str, Any], library_path: Optional[str] = None) -> Dict[str, Any]:
+    """
+    Changes the given fields of the entry, e.g. links it to a book once the library has it.
+
+    Raises:
+        ValueError: As for add_wish.
+        WishNotFound: If the user has no such entry.
+    """
+    changes = _validate(changes)
+    if "book_id" in changes:
+        changes["library"] = _library_key(library_path) if changes["book_id"] else None
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, user_id, wish_id)
+            if changes:
+                with conn:
+                    # Field names come from the fixed set checked in _validate.
+                    assignments = ", ".join(f"{field} = ?" for field in changes)
+                    conn.execute(f"UPDATE wishes SET {assignments}, updated_at = ? WHERE id = ?",
+                                 (*changes.values(), time.time(), wish_id))
+            return _get(conn, user_id, wish_id)
+        finally:
+            conn.close()
+
+
+def delete_wish(user_id: int, wish_id: int) -> None:
+    """
+    Raises:
+        WishNotFound: If the user has no such entry.
+    """
+    with _lock:
+        conn = connect()
+        try:
+            _get(conn, user_id, wish_id)
+            with conn:
+                conn.execute("DELETE FROM wishes WHERE id = ?", (wish_id,))
+        finally:
+            conn.close()
+
+
+def forget_books(book_ids: List[int], library_path: Optional[str] = None) -> None:
+    """Unlinks entries from deleted books; the wishes themselves stay."""
+    if not book_ids or not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.executemany("UPDATE wishes SET book_id = NULL, library = NULL WHERE library = ? AND book_id = ?",
+                                 [(_library_key(library_path), book_id) for book_id in book_ids])
+        finally:
+            conn.close()
+
+
+def forget_user(user_id: int) -> None:
+    """Removes a deleted user's wishlist."""
+    if not os.path.exists(db_path()):
+        return
+    with _lock:
+        conn = connect()
+        try:
+            with conn:
+                conn.execute("DELETE FROM wishes WHERE user_id = ?", (user_id,))
+        finally:
+            conn.close()
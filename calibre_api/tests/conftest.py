@@ -0,0 +1,39 @@
+import os
+from unittest import mock
+
+import pytest
+
+from calibre_api.app import opds_throttle
+
+# Variables that move single parts of the server's state out of SHELFSTONE_STATE_DIR.
+STATE_VARIABLES = [
+    "SHELFSTONE_COLLECTIONS_DB", "SHELFSTONE_PROVENANCE_DB", "SHELFSTONE_PROCESSING_LOG_DB", "SHELFSTONE_SETTINGS_DB",
+    "SHELFSTONE_FTS_DB", "SHELFSTONE_THUMBNAIL_CACHE", "SHELFSTONE_CONVERSION_CACHE", "SHELFSTONE_ACCOUNTS_DB",
+    "SHELFSTONE_READING_DB", "SHELFSTONE_KOSYNC_DB", "SHELFSTONE_DOWNLOAD_LOG_DB", "SHELFSTONE_RATINGS_DB",
+    "SHELFSTONE_WISHLIST_DB",
+    "SHELFSTONE_PREFERENCES_DB",
+    "SHELFSTONE_PASSWORD_RESET_DB",
+    "SHELFSTONE_NOTIFICATIONS_DB",
+    "SHELFSTONE_FOLLOWS_DB",
+    "SHELFSTONE_BOOK_CLUBS_DB",
+    "SHELFSTONE_BOOK_COMMENTS_DB",
+    "SHELFSTONE_REACTIONS_DB",
+    "SHELFSTONE_PRIVACY_DB",
+]
+
+
+@pytest.fixture(autouse=True)
+def state_dir(tmp_path):
+    """Keeps each test's server state (see app/state_store.py) in its own folder instead of ~/.shelfstone."""
+    # In a hidden folder, which directory imports of tmp_path skip.
+    state = tmp_path / ".state"
+    with mock.patch.dict(os.environ, {"SHELFSTONE_STATE_DIR": str(state)}):
+        for variable in STATE_VARIABLES:
+            os.environ.pop(variable, None)
+        yield state
+
+
+@pytest.fixture(autouse=True)
+def catalog_throttle():
+    """Starts each test without catalog requests counted against the test client (see app/opds_throttle.py)."""
+    opds_throttle.reset()
@@ -0,0 +1,241 @@
+"""
+Deterministic stand-ins for the Calibre command line tools, for the integration tests.
+
+The `calibredb`, `ebook-meta` and `ebook-convert` scripts next to this file call main() with
+their own name. Point SHELFSTONE_CALIBRE_BIN_DIR at this folder and the server runs them instead
+of Calibre. The library is a folder holding `fake_library.json` and one folder per book with its
+files, like a real Calibre library. Only the options the server passes are supported; anything
+else fails loudly so a changed command line shows up as a test failure.
+
+Every invocation is appended to $FAKE_CALIBRE_LOG (one JSON list of arguments per line) if set.
+"""
+import json
+import os
+import re
+import shutil
+import sys
+import uuid
+import zipfile
+import xml.etree.ElementTree as ET
+
+LIBRARY_FILE = "fake_library.json"
+DC = "{http://purl.org/dc/elements/1.1/}"
+
+
+class Usage(Exception):
+    """Unsupported arguments."""
+
+
+# --- E-book files ---
+
+def read_epub_metadata(path):
+    """Title and authors from an EPUB's OPF, or the file name and "Unknown"."""
+    title, authors = os.path.splitext(os.path.basename(path))[0], ["Unknown"]
+    if zipfile.is_zipfile(path):
+        with zipfile.ZipFile(path) as epub:
+            opf_name = next((n for n in epub.namelist() if n.endswith(".opf")), None)
+            if opf_name:
+                root = ET.fromstring(epub.read(opf_name))
+                title = next((e.text for e in root.iter(f"{DC}title") if e.text), title)
+                authors = [e.text for e in root.iter(f"{DC}creator") if e.text] or authors
+    return {"title": title, "authors": authors}
+
+
+def write_opf(path, meta):
+    creators = "".join(f"<dc:creator opf:role=\"aut\">{a}</dc:creator>" for a in meta["authors"])
+    with open(path, "w", encoding="utf-8") as f:
+        f.write('<?xml version="1.0" encoding="utf-8"?>'
+                '<package xmlns="http://www.idpf.org/2007/opf" version="2.0">'
+                '<metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">'
+                f"<dc:title>{meta['title']}</dc:title>{creators}</metadata></package>")
+
+
+# --- Library ---
+
+def library_dir(args):
+    if "--with-library" in args:
+        i = args.index("--with-library")
+        path = args[i + 1]
+        del args[i:i + 2]
+        return path
+    return os.environ["FAKE_CALIBRE_LIBRARY"]
+
+
+def load(library):
+    path = os.path.join(library, LIBRARY_FILE)
+    if not os.path.isfile(path):
+        return {"next_id": 1, "books": []}
+    with open(path, encoding="utf-8") as f:
+        return json.load(f)
+
+
+def save(library, data):
+    os.makedirs(library, exist_ok=True)
+    with open(os.path.join(library, LIBRARY_FILE), "w", encoding="utf-8") as f:
+        json.dump(data, f, indent=1)
+
+
+def find(data, book_id):
+    return next((b for b in data["books"] if b["id"] == int(book_id)), None)
+
+
+def matches(book, term):
+    term = term.strip()
+    if re.fullmatch(r"id:\d+", term):
+        return book["id"] == int(term[3:])
+    if term.startswith("identifiers:"):
+        # identifiers:type:value, or the exact form identifiers:"=type:=value".
+        id_type, _, value = term[len("identifiers:"):].strip('"').lstrip("=").partition(":")
+        value = value.lstrip("=")
+        return id_type in book["identifiers"] and (not value or book["identifiers"][id_type] == value)
+    if term.startswith("title:"):
+        # Substring match ignoring case, like Calibre's default search mode.
+        value = term[len("title:"):].strip('"').replace('\\"', '"').replace("\\\\", "\\")
+        return value.lower() in book["title"].lower()
+    raise Usage(f"unsupported search term {term!r}")
+
+
+def calibredb(args):
+    library = library_dir(args)
+    data = load(library)
+    command, args = args[0], args[1:]
+
+    if command == "add":
+        added = []
+        for file_path in args[args.index("--") + 1:]:
+            meta = read_epub_metadata(file_path)
+            if "--metadata" in args:
+                for item in args[args.index("--metadata") + 1].split(","):
+                    field, _, value = item.partition(":")
+                    meta[field] = [a.strip() for a in value.split("&")] if field == "authors" else value
+            identifiers = dict(args[i + 1].split(":", 1) for i, a in enumerate(args) if a == "--identifier")
+            duplicate = any(b["title"] == meta["title"] and b["authors"] == " & ".join(meta["authors"]) for b in data["books"])
+            if duplicate and "--duplicates" not in args:
+                continue
+            book_id = data["next_id"]
+            data["next_id"] += 1
+            book_dir = os.path.join(library, meta["authors"][0], f"{meta['title']} ({book_id})")
+            os.makedirs(book_dir, exist_ok=True)
+            stored = os.path.join(book_dir, f"{meta['title']} - {meta['authors'][0]}{os.path.splitext(file_path)[1].lower()}")
+            shutil.copyfile(file_path, stored)
+            data["books"].append({
+                "id": book_id, "uuid": str(uuid.UUID(int=book_id)), "title": meta["title"],
+                "authors": " & ".join(meta["authors"]), "tags": [t for t in meta.get("tags", "").split(",") if t],
+                "identifiers": identifiers, "formats": [stored], "cover": None, "series": None, "series_index": 1.0,
+                "publisher": None, "pubdate": None, "languages": [], "comments": None,
+                "timestamp": "2026-01-01T00:00:00+00:00", "last_modified": "2026-01-01T00:00:00+00:00",
+            })
+            added.append(book_id)
+        save(library, data)
+        if not added:
+            print("The following books were not added as they already exist in the database")
+            print("No books added")
+            return 0
+        print(f"Added book IDs: {', '.join(map(str, added))}")
+        return 0
+
+    if command == "list":
+        search = args[args.index("--search") + 1] if "--search" in args else None
+        books = data["books"]
+        if search:
+            books = [b for b in books if any(matches(b, term) for term in search.split(" or "))]
+        print(json.dumps(books))
+        return 0
+
+    if command == "remove_books":
+        # The --for-machine result the server expects.
+        book_id = int(args[-1])
+        book = find(data, book_id)
+        if book is None:
+            print(json.dumps({"ok": False, "num_removed": 0, "removed_ids": [],
+                              "errors": [{"id": book_id, "error": "Book not found"}]}))
+            return 0
+        data["books"].remove(book)
+        shutil.rmtree(os.path.dirname(book["formats"][0]), ignore_errors=True)
+        save(library, data)
+        print(json.dumps({"ok": True, "num_removed": 1, "removed_ids": [book_id], "errors": []}))
+        return 0
+
+    if command == "set_metadata":
+        fields = [args[i + 1] for i, a in enumerate(args) if a == "--field"]
+        positional = [a for i, a in enumerate(args) if not a.startswith("--") and (i == 0 or args[i - 1] != "--field")]
+        book = find(data, positional[0])
+        if book is None:
+            print(f"No book with id {positional[0]} found", file=sys.stderr)
+            return 1
+        for item in fields + positional[1:]:
+            field, _, value = item.partition(":")
+            if field == "identifiers":
+                book["identifiers"] = dict(pair.split(":", 1) for pair in value.split(",") if pair)
+            elif field == "series_index":
+                book[field] = float(value)
+            else:
+                book[field] = value
+        save(library, data)
+        if "--for-machine" in args:
+            print(json.dumps(book))
+        return 0
+
+    if command == "add_format":
+        positional = [a for a in args if not a.startswith("--")]
+        book = find(data, positional[0])
+        if book is None:
+            print(f"No book with id {positional[0]} found", file=sys.stderr)
+            return 1
+        ext = os.path.splitext(positional[1])[1].lower()
+        existing = next((p for p in book["formats"] if p.lower().endswith(ext)), None)
+        if existing and "--dont-replace" in args:
+            print(f"A {ext[1:].upper()} file already exists for book: {book['id']}, not replacing", file=sys.stderr)
+            return 1
+        stored = existing or os.path.splitext(book["formats"][0])[0] + ext
+        shutil.copyfile(positional[1], stored)
+        if not existing:
+            book["formats"].append(stored)
+        save(library, data)
+        return 0
+
+    if command == "export" and "--to-stdout" in args:
+        book = find(data, args[-1])
+        fmt = args[args.index("--format") + 1].lower()
+        path = next((p for p in (book or {}).get("formats", []) if p.lower().endswith("." + fmt)), None)
+        if path is None:
+            print(f"Book has no {fmt.upper()} format", file=sys.stderr)
+            return 1
+        with open(path, "rb") as f:
+            sys.stdout.buffer.write(f.read())
+        return 0
+
+    raise Usage(f"unsupported calibredb command {command!r}")
+
+
+def ebook_meta(args):
+    meta = read_epub_metadata(args[0])
+    if "--to-opf" in args:
+        write_opf(args[args.index("--to-opf") + 1], meta)
+    else:
+        print(f"Title               : {meta['title']}\nAuthor(s)           : {' & '.join(meta['authors'])}")
+    return 0
+
+
+def ebook_convert(args):
+    source, target = args[0], args[1]
+    with open(source, "rb") as f:
+        content = f.read()
+    with open(target, "wb") as f:
+        f.write(f"FAKE {os.path.splitext(target)[1][1:].upper()} OF {os.path.basename(source)}\n".encode("utf-8") + content)
+    print("Output saved to", target)
+    return 0
+
+
+COMMANDS = {"calibredb": calibredb, "ebook-meta": ebook_meta, "ebook-convert": ebook_convert}
+
+
+def main(name, args):
+    if os.environ.get("FAKE_CALIBRE_LOG"):
+        with open(os.environ["FAKE_CALIBRE_LOG"], "a", encoding="utf-8") as f:
+            f.write(json.dumps([name] + args) + "\n")
+    try:
+        return COMMANDS[name](list(args))
+    except (Usage, IndexError, ValueError) as e:
+        print(f"fake {name}: {e or 'unsupported arguments'}: {args}", file=sys.stderr)
+        return 2
@@ -0,0 +1,322 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, book_collections, crud, download_log, kosync, preferences, provenance, ratings, reading, wishlist
+from calibre_api.app.main import app
+
+
+def test_password_hashes():
+    stored = accounts.hash_password("correct horse")
+    assert stored.startswith("scrypt$") and "correct horse" not in stored
+    assert accounts.verify_password("correct horse", stored)
+    assert not accounts.verify_password("wrong horse", stored)
+    assert not accounts.verify_password("correct horse", "md5$abc")
+    assert accounts.hash_password("correct horse") != stored
+
+
+@pytest.mark.parametrize("username", ["", " ", "-ana", "a b", "x" * 65])
+def test_invalid_usernames(username):
+    with pytest.raises(ValueError):
+        accounts.validate_username(username)
+
+
+def test_setup_creates_one_admin():
+    assert not accounts.has_users()
+    admin = accounts.setup_admin("root", "password1")
+    assert admin["role"] == accounts.ADMIN
+    assert accounts.has_users()
+    with pytest.raises(accounts.RegistrationClosed):
+        accounts.setup_admin("other", "password1")
+
+
+def test_register_needs_open_registration(monkeypatch):
+    monkeypatch.delenv("SHELFSTONE_OPEN_REGISTRATION", raising=False)
+    accounts.setup_admin("root", "password1")
+    with pytest.raises(accounts.RegistrationClosed):
+        accounts.register("ana", "password2")
+    monkeypatch.setenv("SHELFSTONE_OPEN_REGISTRATION", "1")
+    assert accounts.register("ana", "password2")["role"] == accounts.USER
+    with pytest.raises(accounts.UserExists):
+        accounts.register("ANA", "password2")
+
+
+def test_authenticate():
+    accounts.setup_admin("root", "password1")
+    assert accounts.authenticate("ROOT", "password1")["username"] == "root"
+    assert accounts.authenticate("root", "password2") is None
+    assert accounts.authenticate("nobody", "password1") is None
+
+
+def test_sessions_and_api_tokens():
+    user = accounts.setup_admin("root", "password1")
+    session = accounts.create_session(user["id"])
+    assert accounts.user_for_token(session["token"])["id"] == user["id"]
+    accounts.end_session(session["token"])
+    assert accounts.user_for_token(session["token"]) is None
+
+    created = accounts.create_api_token(user["id"], "KOReader")
+    assert accounts.user_for_token(created["token"])["id"] == user["id"]
+    assert [t["name"] for t in accounts.list_api_tokens(user["id"])] == ["KOReader"]
+    assert "token" not in accounts.list_api_tokens(user["id"])[0]
+    accounts.revoke_api_token(user["id"], created["id"])
+    assert accounts.user_for_token(created["token"]) is None
+    with pytest.raises(accounts.TokenNotFound):
+        accounts.revoke_api_token(user["id"], created["id"])
+
+
+def test_expired_sessions_are_refused(monkeypatch):
+    user = accounts.setup_admin("root", "password1")
+    session = accounts.create_session(user["id"])
+    monkeypatch.setattr(accounts.time, "time", lambda: session["expires_at"] + 1)
+    assert accounts.user_for_token(session["token"]) is None
+
+
+def test_the_last_admin_stays():
+    admin = accounts.setup_admin("root", "password1")
+    user = accounts.create_user("ana", "password2")
+    with pytest.raises(accounts.LastAdmin):
+        accounts.update_user(admin["id"], {"role": accounts.USER})
+    with pytest.raises(accounts.LastAdmin):
+        accounts.update_user(admin["id"], {"disabled": True})
+    with pytest.raises(accounts.LastAdmin):
+        accounts.delete_user(admin["id"])
+    accounts.update_user(user["id"], {"role": accounts.ADMIN})
+    accounts.delete_user(admin["id"])
+    assert [u["username"] for u in accounts.list_users()] == ["ana"]
+
+
+def test_new_password_ends_other_sessions():
+    user = accounts.setup_admin("root", "password1")
+    kept, other = accounts.create_session(user["id"]), accounts.create_session(user["id"])
+    api_token = accounts.create_api_token(user["id"], "script")
+    with pytest.raises(ValueError):
+        accounts.change_password(user["id"], "wrong", "password3")
+    accounts.change_password(user["id"], "password1", "password3", keep_token=kept["token"])
+    assert accounts.user_for_token(kept["token"]) is not None
+    assert accounts.user_for_token(other["token"]) is None
+    assert accounts.user_for_token(api_token["token"]) is not None
+    assert accounts.authenticate("root", "password3") is not None
+
+
+def test_invitations_are_single_use():
+    admin = accounts.setup_admin("root", "password1")
+    invitation = accounts.create_invitation(tags=["Kids", " Kids", ""], libraries=[""], note="Sam", created_by=admin["id"])
+    assert (invitation["role"], invitation["tags"], invitation["libraries"]) == ("user", ["Kids"], [""])
+    assert accounts.check_invitation(invitation["token"])["id"] == invitation["id"]
+
+    user = accounts.register_with_invitation(invitation["token"], "sam", "password2")
+    assert (user["role"], user["tags"], user["libraries"]) == ("user", ["Kids"], [""])
+    with pytest.raises(accounts.InvalidInvitation):
+        accounts.register_with_invitation(invitation["token"], "sam2", "password2")
+    assert accounts.list_invitations()[0]["used_by"] == user["id"]
+
+    # A taken username doesn't use the invitation up.
+    other = accounts.create_invitation(role=accounts.ADMIN)
+    with pytest.raises(accounts.UserExists):
+        accounts.register_with_invitation(other["token"], "SAM", "password2")
+    accounts.revoke_invitation(other["id"])
+    with pytest.raises(accounts.InvalidInvitation):
+        accounts.check_invitation(other["token"])
+    with pytest.raises(accounts.InvitationNotFound):
+        accounts.revoke_invitation(other["id"])
+
+
+def test_expired_invitations_are_refused(monkeypatch):
+    accounts.setup_admin("root", "password1")
+    invitation = accounts.create_invitation(days=1)
+    monkeypatch.setattr(accounts.time, "time", lambda: invitation["expires_at"] + 1)
+    with pytest.raises(accounts.InvalidInvitation):
+        accounts.register_with_invitation(invitation["token"], "sam", "password2")
+
+
+@pytest.mark.parametrize("kwargs", [
+    {"role": "owner"}, {"role": accounts.ADMIN, "tags": ["Kids"]}, {"tags": []}, {"tags": [" "]},
+    {"note": "x" * 501}, {"days": 0}, {"days": 91},
+])
+def test_invalid_invitations(kwargs):
+    with pytest.raises(ValueError):
+        accounts.create_invitation(**kwargs)
+
+
+def test_restrictions_can_be_changed_and_lifted():
+    accounts.setup_admin("root", "password1")
+    user = accounts.create_user("ana", "password2", tags=["SF"])
+    assert accounts.update_user(user["id"], {"libraries": ["/lib"]})["libraries"] == ["/lib"]
+    assert accounts.get_user(user["id"])["tags"] == ["SF"]
+    with pytest.raises(ValueError):
+        accounts.update_user(user["id"], {"role": accounts.ADMIN})
+    lifted = accounts.update_user(user["id"], {"role": accounts.ADMIN, "libraries": None, "tags": None})
+    assert (lifted["role"], lifted["libraries"], lifted["tags"]) == ("admin", None, None)
+
+
+# --- Tests for the /auth and /admin/users endpoints ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    monkeypatch.delenv("SHELFSTONE_OPEN_REGISTRATION", raising=False)
+    return TestClient(app)
+
+
+def test_endpoints_refused_without_accounts(client, monkeypatch):
+    monkeypatch.delenv("SHELFSTONE_ACCOUNTS")
+    assert client.get("/auth/status").json()["accounts_enabled"] is False
+    response = client.post("/auth/login", json={"username": "root", "password": "password1"})
+    assert response.status_code == 403
+    assert "SHELFSTONE_ACCOUNTS=1" in response.json()["detail"]
+
+
+def test_first_run_login_and_logout(client):
+    assert client.get("/auth/status").json()["setup_required"] is True
+    assert client.get("/books/").status_code == 401
+
+    response = client.post("/auth/setup", json={"username": "root", "password": "password1"})
+    assert response.status_code == 201
+    assert response.json()["role"] == "admin"
+    assert client.post("/auth/setup", json={"username": "evil", "password": "password1"}).status_code == 409
+
+    assert client.post("/auth/login", json={"username": "root", "password": "nope-nope"}).status_code == 401
+    response = client.post("/auth/login", json={"username": "root", "password": "password1"})
+    assert response.status_code == 200
+    assert "HttpOnly" in response.headers["set-cookie"]
+    # The cookie signs the following requests in.
+    assert client.get("/auth/me").json()["username"] == "root"
+    assert client.get("/auth/status").json()["user"]["username"] == "root"
+
+    assert client.post("/auth/logout").status_code == 204
+    assert client.get("/auth/me").status_code == 401
+
+
+def test_setup_needs_the_admin_token_when_one_is_set(client, monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ADMIN_TOKEN", "secret")
+    credentials = {"username": "root", "password": "password1"}
+    assert client.post("/auth/setup", json=credentials).status_code == 401
+    assert client.post("/auth/setup", json=credentials, headers={"Authorization": "Bearer secret"}).status_code == 201
+
+
+def test_api_tokens_and_user_management(client):
+    admin = accounts.setup_admin("root", "password1")
+    admin_headers = {"Authorization": f"Bearer {accounts.create_session(admin['id'])['token']}"}
+
+    response = client.post("/admin/users", json={"username": "ana", "password": "password2"}, headers=admin_headers)
+    assert response.status_code == 201
+    ana = response.json()
+    assert client.post("/admin/users", json={"username": "ana", "password": "password2"}, headers=admin_headers).status_code == 409
+
+    login = client.post("/auth/login", json={"username": "ana", "password": "password2"}).json()
+    ana_headers = {"Authorization": f"Bearer {login['token']}"}
+    created = client.post("/auth/tokens", json={"name": "Kobo"}, headers=ana_headers).json()
+    assert client.get("/auth/me", headers={"Authorization": f"Bearer {created['token']}"}).json()["id"] == ana["id"]
+    assert [t["name"] for t in client.get("/auth/tokens", headers=ana_headers).json()] == ["Kobo"]
+    assert client.get("/admin/users", headers=ana_headers).status_code == 403
+
+    response = client.patch(f"/admin/users/{ana['id']}", json={"disabled": True}, headers=admin_headers)
+    assert response.json()["disabled"] is True
+    assert client.get("/auth/me", headers=ana_headers).status_code == 401
+    assert client.patch(f"/admin/users/{admin['id']}", json={"role": "user"}, headers=admin_headers).status_code == 409
+    assert client.delete(f"/admin/users/{ana['id']}", headers=admin_headers).status_code == 204
+    assert [u["username"] for u in client.get("/admin/users", headers=admin_headers).json()] == ["root"]
+
+
+def test_registering_with_an_invitation(client):
+    admin = accounts.setup_admin("root", "password1")
+    admin_headers = {"Authorization": f"Bearer {accounts.create_session(admin['id'])['token']}"}
+    response = client.post("/admin/invitations", json={"tags": ["Kids"], "note": "Sam"}, headers=admin_headers)
+    assert response.status_code == 201
+    invitation = response.json()
+    assert invitation["link"] == f"http://testserver/auth/invitations/{invitation['token']}"
+    assert invitation["created_by"] == admin["id"]
+    assert client.post("/admin/invitations", json={"role": "admin", "tags": ["Kids"]}, headers=admin_headers).status_code == 400
+
+    # Without open registration, only the invitation works; checking it needs no credentials.
+    assert client.post("/auth/register", json={"username": "sam", "password": "password2"}).status_code == 403
+    assert client.get(f"/auth/invitations/{invitation['token']}").json()["role"] == "user"
+    response = client.post("/auth/register", json={"username": "sam", "password": "password2", "invitation": invitation["token"]})
+    assert response.status_code == 201
+    assert response.json()["tags"] == ["Kids"]
+    assert client.get(f"/auth/invitations/{invitation['token']}").status_code == 404
+    assert client.post("/auth/register", json={"username": "sam2", "password": "password2",
+                                               "invitation": invitation["token"]}).status_code == 403
+
+    assert client.get("/admin/invitations", headers=admin_headers).json()[0]["used_by"] == response.json()["id"]
+    assert client.delete(f"/admin/invitations/{invitation['id']}", headers=admin_headers).status_code == 204
+    assert client.delete(f"/admin/invitations/{invitation['id']}", headers=admin_headers).status_code == 404
+
+
+@patch('calibre_api.app.crud.run_calibre_command', return_value=("[]", "", 0))
+def test_restricted_users(mock_run, client):
+    accounts.setup_admin("root", "password1")
+    user = accounts.create_user("sam", "password2", libraries=["", "/kids"], tags=["Kids"])
+    headers = {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+    assert client.get("/books/", headers=headers).status_code == 200
+    assert mock_run.call_args.args[0][-2:] == ["--search", '(tags:"=Kids")']
+    client.get("/books/?search=Dune&library_path=/kids", headers=headers)
+    assert mock_run.call_args.args[0][-2:] == ["--search", '((Dune)) and (tags:"=Kids")']
+    assert client.get("/books/?library_path=/grown-ups", headers=headers).status_code == 403
+
+    # Only endpoints that apply the restriction, and only their own data can be changed.
+    assert client.get("/authors", headers=headers).status_code == 403
+    assert client.delete("/books/3/", headers=headers).status_code == 403
+    assert client.put("/me/preferences", json={"theme": "dark"}, headers=headers).status_code == 200
+    # The restriction ends with the request.
+    assert crud.restricted_tags.get() is None
+
+
+# --- Tests for exporting and deleting accounts ---
+
+def test_export_and_delete_your_account(client, monkeypatch):
+    monkeypatch.delenv("SHELFSTONE_DELETED_USER_UPLOADS", raising=False)
+    admin = accounts.create_user("root", "password1", role=accounts.ADMIN)
+    ana = accounts.create_user("ana", "password1")
+    reading.set_progress(ana["id"], 3, {"percentage": 42.5})
+    reading.add_bookmark(ana["id"], 3, {"position": "epubcfi(/6/14)", "note": "The litany"}, library_path="/srv/other")
+    ratings.set_rating(ana["id"], 3, 5, review="Spice!")
+    wishlist.add_wish(ana["id"], {"title": "Children of Dune"})
+    preferences.set_preferences(ana["id"], {"theme": "dark"})
+    shelf = book_collections.create_collection("Favourites", owner_id=ana["id"])
+    book_collections.add_books(shelf["id"], [3])
+    download_log.record({"id": 3, "title": "Dune"}, "epub", user=ana, user_agent="KOReader/2024.04")
+    kosync.save_position(ana["id"], {"document": "abc123", "progress": "/body/p[3]", "percentage": 0.4})
+    provenance.record([7], provenance.UPLOAD, detail="dune.epub", user_id=ana["id"])
+    client.headers["Authorization"] = f"Bearer {accounts.create_session(ana['id'])['token']}"
+
+    response = client.get("/me/export")
+    assert response.status_code == 200 and "attachment" in response.headers["content-disposition"]
+    data = response.json()
+    assert data["profile"]["username"] == "ana" and data["preferences"]["theme"] == "dark"
+    assert data["progress"][0]["percentage"] == 42.5
+    assert (data["bookmarks"][0]["library"], data["bookmarks"][0]["note"]) == ("/srv/other", "The litany")
+    assert data["ratings"][0]["review"] == "Spice!" and data["wishlist"][0]["title"] == "Children of Dune"
+    assert data["shelves"][0]["book_ids"] == [3] and data["downloads"][0]["client"] == "KOReader"
+    assert data["kosync_positions"][0]["document"] == "abc123"
+    assert data["uploads"] == [{"library": "", "book_id": 7, "source": "upload", "detail": "dune.epub",
+                                "added_at": data["uploads"][0]["added_at"]}]
+
+    assert client.post("/me/delete", json={"current_password": "wrong password"}).status_code == 400
+    assert client.post("/me/delete", json={"current_password": "password1"}).status_code == 204
+    assert client.get("/auth/me").status_code == 401
+    assert reading.export_user(ana["id"]) == {"progress": [], "bookmarks": []}
+    assert ratings.export_user(ana["id"]) == [] and book_collections.export_user(ana["id"]) == []
+    # Uploads go to the admin by default.
+    assert provenance.sources_of([7])[7]["user_id"] == admin["id"]
+
+
+@patch('calibre_api.app.main.remove_book', return_value={"ok": True, "num_removed": 1, "removed_ids": [7]})
+def test_deleting_a_user_can_remove_their_uploads(mock_remove_book, client):
+    admin = accounts.create_user("root", "password1", role=accounts.ADMIN)
+    ana = accounts.create_user("ana", "password1")
+    provenance.record([7], provenance.UPLOAD, library_path="/srv/other", user_id=ana["id"])
+    provenance.record([8], provenance.UPLOAD, user_id=admin["id"])
+    client.headers["Authorization"] = f"Bearer {accounts.create_session(admin['id'])['token']}"
+
+    assert client.get(f"/admin/users/{ana['id']}/export").json()["uploads"][0]["book_id"] == 7
+    assert client.delete(f"/admin/users/{ana['id']}?uploads=shred").status_code == 400
+    assert client.delete(f"/admin/users/{ana['id']}?reassign_to={ana['id']}").status_code == 400
+    assert client.delete(f"/admin/users/{ana['id']}?uploads=delete").status_code == 204
+    mock_remove_book.assert_called_once_with(book_id=7, library_path="/srv/other", permanent=False)
+    assert provenance.sources_of([7], library_path="/srv/other") == {}
+    assert set(provenance.sources_of([8])) == {8}
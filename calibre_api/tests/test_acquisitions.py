@@ -0,0 +1,113 @@
+import csv
+import io
+import pytest
+from unittest import mock
+
+from calibre_api.app import acquisitions
+
+
+def book(book_id, **acquisition):
+    data = {"store": None, "price": None, "currency": None, "purchase_date": None, "drm_source": None}
+    data.update(acquisition)
+    return {"id": book_id, "title": f"Book {book_id}", "authors": ["A", "B"], "acquisition": data}
+
+
+@mock.patch("calibre_api.app.acquisitions.set_values")
+def test_set_acquisition_normalizes_currency(mock_set_values):
+    acquisitions.set_acquisition(2, {"price": 9.99, "currency": " eur "}, library_path="/lib")
+    mock_set_values.assert_called_once_with(2, acquisitions.ACQUISITION_COLUMNS, {"price": 9.99, "currency": "EUR"}, library_path="/lib")
+
+
+@pytest.mark.parametrize("changes", [{"currency": "euro"}, {"price": -1}])
+@mock.patch("calibre_api.app.acquisitions.set_values")
+def test_set_acquisition_rejects_invalid_values(mock_set_values, changes):
+    with pytest.raises(ValueError):
+        acquisitions.set_acquisition(2, changes)
+    mock_set_values.assert_not_called()
+
+
+@mock.patch("calibre_api.app.acquisitions.list_books", return_value=[{"id": 1, "*price": 5.0, "*store": "Kobo"}])
+@mock.patch("calibre_api.app.acquisitions.list_custom_columns", return_value={"store": 1, "price": 2, "currency": 3})
+def test_list_acquired_books(mock_columns, mock_list_books):
+    books = acquisitions.list_acquired_books(library_path="/lib", search="tags:Comics")
+    mock_list_books.assert_called_once_with(library_path="/lib", search_query="(#store:true or #price:true) and (tags:Comics)")
+    assert books[0]["acquisition"]["price"] == 5.0
+
+
+@mock.patch("calibre_api.app.acquisitions.list_books")
+@mock.patch("calibre_api.app.acquisitions.list_custom_columns", return_value={"shelf": 1})
+def test_list_acquired_books_without_columns(mock_columns, mock_list_books):
+    assert acquisitions.list_acquired_books() == []
+    mock_list_books.assert_not_called()
+
+
+def test_spending_report():
+    books = [
+        book(1, store="Kobo", price=9.99, currency="EUR", purchase_date="2025-02-01"),
+        book(2, store="Kobo", price=5.01, currency="EUR", purchase_date="2025-06-01"),
+        book(3, store="Amazon", price=12.0, currency="USD", purchase_date="2026-01-10"),
+        book(4, store="Flea market", price=2.0, currency="EUR"),
+        book(5, store="Kobo", purchase_date="2025-03-01"),
+    ]
+    report = acquisitions.spending_report(books)
+    assert report["totals"] == [
+        {"currency": "EUR", "total": 17.0, "books": 3},
+        {"currency": "USD", "total": 12.0, "books": 1},
+    ]
+    assert report["by_year"] == [
+        {"year": 2025, "currency": "EUR", "total": 15.0, "books": 2},
+        {"year": 2026, "currency": "USD", "total": 12.0, "books": 1},
+        {"year": None, "currency": "EUR", "total": 2.0, "books": 1},
+    ]
+    assert [(r["store"], r["total"]) for r in report["by_store"]] == [("Amazon", 12.0), ("Flea market", 2.0), ("Kobo", 15.0)]
+    assert report["unpriced_books"] == 1
+
+    report_2025 = acquisitions.spending_report(books, year=2025)
+    assert report_2025["totals"] == [{"currency": "EUR", "total": 15.0, "books": 2}]
+    assert report_2025["unpriced_books"] == 1
+
+
+def test_export_csv_includes_physical_copy():
+    entry = book(7, store="Antiquariat", price=120.0, currency="EUR", purchase_date="2024-11-02")
+    entry.update({"identifiers": {"isbn": "9780261102217"}, "*physical": True, "*condition": "Fine", "*shelf": "Safe"})
+    rows = list(csv.DictReader(io.StringIO(acquisitions.export_csv([entry]))))
+    assert rows == [{
+        "id": "7", "title": "Book 7", "authors": "A & B", "isbn": "9780261102217", "store": "Antiquariat",
+        "purchase_date": "2024-11-02", "price": "120.00", "currency": "EUR", "drm_source": "",
+        "physical": "yes", "condition": "Fine", "shelf": "Safe",
+    }]
+
+
+def test_export_csv_locale_and_conversion():
+    books = [
+        book(1, store="Kobo", price=10.0, currency="USD", purchase_date="2025-12-31"),
+        book(2, store="Thalia", currency="EUR"),
+    ]
+    text = acquisitions.export_csv(books, locale="de-AT", convert_to="EUR", rates={"USD": 0.9})
+    rows = list(csv.DictReader(io.StringIO(text), delimiter=";"))
+    assert rows[0]["price"] == "10,00"
+    assert rows[0]["purchase_date"] == "31.12.2025"
+    assert (rows[0]["converted_price"], rows[0]["converted_currency"]) == ("9,00", "EUR")
+    assert (rows[1]["price"], rows[1]["converted_price"], rows[1]["converted_currency"]) == ("", "", "")
+
+
+def test_convert_prices_names_unconvertible_books():
+    books = [book(1, price=5.0, currency="GBP"), book(2, price=3.0), book(3, price=1.0, currency="EUR")]
+    with pytest.raises(ValueError) as exc:
+        acquisitions.convert_prices(books, "EUR", {"USD": 0.9})
+    assert "book 1" in str(exc.value) and "book 2" in str(exc.value) and "book 3" not in str(exc.value)
+
+
+def test_converted_spending_report_as_csv():
+    books = [
+        book(1, store="Kobo", price=10.0, currency="USD", purchase_date="2025-01-01"),
+        book(2, store="Kobo", price=5.5, currency="EUR", purchase_date="2025-02-01"),
+    ]
+    report = acquisitions.spending_report(acquisitions.convert_prices(books, "EUR", {"USD": 0.9}))
+    assert report["totals"] == [{"currency": "EUR", "total": 14.5, "books": 2}]
+    assert acquisitions.report_csv(report, locale="fr").splitlines() == [
+        "group;key;currency;total;books",
+        "total;;EUR;14,50;2",
+        "year;2025;EUR;14,50;2",
+        "store;Kobo;EUR;14,50;2",
+    ]
@@ -0,0 +1,72 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, activity, book_collections, privacy, provenance, ratings, reading
+from calibre_api.app.main import app
+
+
+def test_feed():
+    provenance.record([5], provenance.UPLOAD, user_id=1)
+    provenance.record([6], provenance.NEWS)
+    reading.set_progress(1, 5, {"percentage": 50})
+    assert reading.get_progress(1, 5)["finished_at"] is None
+    finished = reading.set_progress(1, 5, {"percentage": 100})
+    # Reading the book again keeps when it was finished.
+    assert reading.set_progress(1, 5, {"percentage": 3})["finished_at"] == finished["finished_at"]
+    ratings.set_rating(2, 5, 4)  # No review.
+    ratings.set_rating(1, 5, 5, "Loved it")
+    shelf = book_collections.create_collection("Favourites", owner_id=1)
+    book_collections.create_collection("Secret", owner_id=2)
+    ratings.set_rating(1, 7, 2, "Meh", library_path="/other")
+
+    # Only shelves the viewer may see.
+    assert [e.get("collection_name") for e in activity.feed(2)][:2] == ["Secret", None]
+    book_collections.share(shelf["id"], 2, book_collections.READ)
+    events = activity.feed(2)
+    assert [e["kind"] for e in events] == [activity.SHELF_CREATED, activity.SHELF_CREATED, activity.REVIEW_POSTED,
+                                           activity.BOOK_FINISHED, activity.BOOK_ADDED, activity.BOOK_ADDED]
+    assert activity.feed(2, limit=1) == events[:1]
+    assert activity.feed(2, before=events[2]["at"]) == events[3:]
+
+    # Users who keep their activity to themselves only show in their own feed.
+    privacy.update_settings(1, {"activity": False})
+    assert [(e["kind"], e["user_id"]) for e in activity.feed(2)] == [(activity.SHELF_CREATED, 2), (activity.BOOK_ADDED, None)]
+    assert len(activity.feed(1)) == 5
+
+
+# --- Tests for /activity and /me/privacy ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def sign_in(username, **kwargs):
+    user = accounts.create_user(username, "password1", **kwargs)
+    return user, {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+
+@patch('calibre_api.app.main.list_books_by_ids', return_value=[{"id": 5, "title": "Dune"}])
+def test_activity_endpoints(mock_list_books, client):
+    ana, ana_headers = sign_in("ana")
+    _, sam_headers = sign_in("sam")
+    _, kid_headers = sign_in("kim", tags=["Kids"])
+    ratings.set_rating(ana["id"], 5, 5, "Spice!")
+    provenance.record([9], provenance.NEWS)
+
+    events = client.get("/activity", headers=sam_headers).json()
+    assert [(e["kind"], e["username"], e["title"]) for e in events] == [
+        ("book_added", None, None), ("review_posted", "ana", "Dune")]
+    mock_list_books.assert_called_once_with([9, 5], library_path=None)
+    assert client.get("/activity", params={"limit": 1}, headers=sam_headers).json() == events[:1]
+    assert client.get("/activity", headers=kid_headers).status_code == 403
+
+    assert client.get("/me/privacy", headers=ana_headers).json()["activity"] is True
+    assert client.patch("/me/privacy", json={"activity": None}, headers=ana_headers).status_code == 400
+    assert client.patch("/me/privacy", json={"activity": False}, headers=ana_headers).json()["activity"] is False
+    assert [e["kind"] for e in client.get("/activity", headers=sam_headers).json()] == ["book_added"]
+    assert len(client.get("/activity", headers=ana_headers).json()) == 2
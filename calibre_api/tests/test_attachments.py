@@ -0,0 +1,49 @@
+import pytest
+
+from calibre_api.app.attachments import book_directory, list_attachments, attachment_path
+
+
+def make_book_dir(tmp_path):
+    book_dir = tmp_path / "Frank Herbert" / "Dune (1)"
+    (book_dir / "data" / "maps").mkdir(parents=True)
+    (book_dir / "Dune - Frank Herbert.epub").write_bytes(b"epub")
+    (book_dir / "data" / "errata.pdf").write_bytes(b"12345")
+    (book_dir / "data" / "maps" / "arrakis.png").write_bytes(b"png")
+    return book_dir
+
+
+def test_book_directory_from_formats_or_cover():
+    assert book_directory({"formats": ["/lib/A/B (1)/B - A.epub"]}) == "/lib/A/B (1)"
+    assert book_directory({"formats": [], "cover": "/lib/A/B (1)/cover.jpg"}) == "/lib/A/B (1)"
+    assert book_directory({"formats": [], "cover": None}) is None
+
+
+def test_list_attachments(tmp_path):
+    book_dir = make_book_dir(tmp_path)
+    assert list_attachments(str(book_dir)) == [
+        {"name": "errata.pdf", "size": 5},
+        {"name": "maps/arrakis.png", "size": 3},
+    ]
+
+
+def test_list_attachments_without_data_folder(tmp_path):
+    assert list_attachments(str(tmp_path)) == []
+
+
+def test_attachment_path(tmp_path):
+    book_dir = make_book_dir(tmp_path)
+    path = attachment_path(str(book_dir), "maps/arrakis.png")
+    assert path.endswith("arrakis.png")
+
+
+@pytest.mark.parametrize("name", ["", "../Dune - Frank Herbert.epub", "/etc/passwd", "."])
+def test_attachment_path_rejects_names_outside_data_folder(tmp_path, name):
+    book_dir = make_book_dir(tmp_path)
+    with pytest.raises(ValueError):
+        attachment_path(str(book_dir), name)
+
+
+def test_attachment_path_missing(tmp_path):
+    book_dir = make_book_dir(tmp_path)
+    with pytest.raises(FileNotFoundError):
+        attachment_path(str(book_dir), "interview.mp3")
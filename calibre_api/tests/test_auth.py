@@ -0,0 +1,143 @@
+import asyncio
+import base64
+
+import pytest
+
+from calibre_api.app import accounts, auth
+from calibre_api.app.auth import AuthMiddleware
+
+
+def call(method, path, authorization=None, cookie=None, seen=None):
+    """Sends one request through the middleware and returns (status, headers). `seen` gets the scope state."""
+    sent = []
+
+    async def app(scope, receive, send):
+        if seen is not None:
+            seen.update(scope["state"])
+        await send({"type": "http.response.start", "status": 200, "headers": []})
+        await send({"type": "http.response.body", "body": b"ok"})
+
+    async def receive():
+        return {"type": "http.request", "body": b"", "more_body": False}
+
+    async def send(message):
+        sent.append(message)
+
+    headers = [(b"authorization", authorization.encode())] if authorization else []
+    if cookie:
+        headers.append((b"cookie", cookie.encode()))
+    asyncio.run(AuthMiddleware(app)({"type": "http", "method": method, "path": path, "headers": headers}, receive, send))
+    return sent[0]["status"], dict(sent[0]["headers"])
+
+
+@pytest.mark.parametrize("method,path,expected", [
+    ("GET", "/books/", False),
+    ("HEAD", "/books/1/download", False),
+    ("OPTIONS", "/books/", False),
+    ("POST", "/books/add/", True),
+    ("DELETE", "/books/1/", True),
+    ("get", "/admin/logs", True),
+    ("GET", "/admin", True),
+    ("GET", "/administrators", False),
+])
+def test_requires_token(method, path, expected):
+    assert auth.requires_token(method, path) is expected
+
+
+@pytest.mark.parametrize("header,expected", [
+    ("Bearer secret", "secret"),
+    ("bearer  secret ", "secret"),
+    ("Basic c2VjcmV0", None),
+    ("Bearer", None),
+    ("", None),
+    (None, None),
+])
+def test_bearer_token(header, expected):
+    assert auth.bearer_token(header) == expected
+
+
+def test_everything_allowed_without_token(monkeypatch):
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    monkeypatch.delenv("SHELFSTONE_ACCOUNTS", raising=False)
+    assert auth.is_authorized("POST", "/admin/query", None)
+    assert call("DELETE", "/books/1/")[0] == 200
+
+
+def test_token_required_for_writes_and_admin(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ADMIN_TOKEN", "secret")
+    monkeypatch.delenv("SHELFSTONE_ACCOUNTS", raising=False)
+    assert call("GET", "/books/")[0] == 200
+    status, headers = call("POST", "/books/add/")
+    assert status == 401
+    assert headers[b"www-authenticate"] == b"Bearer"
+    assert call("GET", "/admin/logs", "Bearer wrong")[0] == 401
+    assert call("GET", "/admin/logs", "Bearer secret")[0] == 200
+    assert call("POST", "/books/add/", "Bearer secret")[0] == 200
+
+
+@pytest.mark.parametrize("header,expected", [
+    ("Basic YW5hOnMzY3JldDpwdw==", ("ana", "s3cret:pw")),
+    ("Basic bm9jb2xvbg==", None),
+    ("Basic !!!", None),
+    ("Bearer secret", None),
+])
+def test_basic_credentials(header, expected):
+    assert auth.basic_credentials(header) == expected
+
+
+def test_session_cookie():
+    assert auth.session_cookie("theme=dark; shelfstone_session=abc") == "abc"
+    assert auth.session_cookie("theme=dark") is None
+    assert auth.session_cookie(None) is None
+
+
+@pytest.fixture
+def with_accounts(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    admin = accounts.setup_admin("root", "password1")
+    user = accounts.create_user("ana", "password2")
+    return admin, user
+
+
+def test_accounts_need_a_user_except_to_sign_in(with_accounts):
+    status, headers = call("GET", "/books/")
+    assert status == 401
+    assert headers[b"www-authenticate"] == b"Bearer"
+    assert call("GET", "/opds")[1][b"www-authenticate"] == b'Basic realm="Shelfstone"'
+    assert call("POST", "/auth/login")[0] == 200
+    assert call("GET", "/auth/status")[0] == 200
+    assert call("OPTIONS", "/books/")[0] == 200
+
+
+def test_accounts_accept_tokens_cookies_and_basic(with_accounts):
+    admin, user = with_accounts
+    session = accounts.create_session(user["id"])["token"]
+    api_token = accounts.create_api_token(user["id"], "reader")["token"]
+    seen = {}
+    assert call("GET", "/books/", f"Bearer {session}", seen=seen)[0] == 200
+    assert seen["user"]["username"] == "ana"
+    assert call("GET", "/books/", cookie=f"shelfstone_session={session}")[0] == 200
+    assert call("GET", "/opds", "Basic " + base64.b64encode(b"ana:password2").decode())[0] == 200
+    assert call("GET", "/opds", "Basic " + base64.b64encode(f"ana:{api_token}".encode()).decode())[0] == 200
+    # An API token only signs in its own user.
+    assert call("GET", "/opds", "Basic " + base64.b64encode(f"root:{api_token}".encode()).decode())[0] == 401
+    assert call("GET", "/opds", "Basic " + base64.b64encode(b"ana:wrong-password").decode())[0] == 401
+    assert call("GET", "/books/", "Bearer not-a-token")[0] == 401
+
+
+def test_admin_paths_need_the_admin_role(with_accounts, monkeypatch):
+    admin, user = with_accounts
+    assert call("GET", "/admin/users", f"Bearer {accounts.create_session(user['id'])['token']}")[0] == 403
+    assert call("GET", "/admin/users", f"Bearer {accounts.create_session(admin['id'])['token']}")[0] == 200
+    monkeypatch.setenv("SHELFSTONE_ADMIN_TOKEN", "secret")
+    seen = {}
+    assert call("DELETE", "/admin/users/2", "Bearer secret", seen=seen)[0] == 200
+    assert seen["user"] is None and seen["admin_token"] is True
+
+
+def test_disabled_users_are_signed_out(with_accounts):
+    admin, user = with_accounts
+    session = accounts.create_session(user["id"])["token"]
+    accounts.update_user(user["id"], {"disabled": True})
+    assert call("GET", "/books/", f"Bearer {session}")[0] == 401
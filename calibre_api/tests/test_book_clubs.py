@@ -0,0 +1,149 @@
+from datetime import date
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, book_clubs
+from calibre_api.app.main import app
+
+
+def test_clubs_and_members():
+    club = book_clubs.create_club(" Tuesday readers ", None, organizer_id=1)
+    assert (club["name"], club["member_count"], club["role"]) == ("Tuesday readers", 1, book_clubs.ORGANIZER)
+    with pytest.raises(book_clubs.ClubExists):
+        book_clubs.create_club("tuesday READERS", None, organizer_id=2)
+    book_clubs.create_club("Tuesday readers", None, organizer_id=2, library_path="/other")
+
+    book_clubs.set_member(club["id"], 2)
+    book_clubs.set_member(club["id"], 3)
+    with pytest.raises(ValueError):
+        book_clubs.set_member(club["id"], 1, book_clubs.MEMBER)  # The only organizer.
+    with pytest.raises(ValueError):
+        book_clubs.set_member(club["id"], 2, "chair")
+    assert [c["role"] for c in book_clubs.list_clubs(member_id=3, user_id=3)] == [book_clubs.MEMBER]
+    assert book_clubs.list_clubs(member_id=4) == []
+
+    # The organizer leaves: the member who joined first takes over.
+    book_clubs.remove_member(club["id"], 1)
+    assert [(m["user_id"], m["role"]) for m in book_clubs.members(club["id"])] == [(2, book_clubs.ORGANIZER), (3, book_clubs.MEMBER)]
+    with pytest.raises(book_clubs.MemberNotFound):
+        book_clubs.remove_member(club["id"], 1)
+    book_clubs.forget_user(2)
+    book_clubs.forget_user(3)
+    with pytest.raises(book_clubs.ClubNotFound):
+        book_clubs.get_club(club["id"])
+
+
+def test_schedule():
+    club = book_clubs.create_club("Classics", None, organizer_id=1)
+    reading = book_clubs.add_reading(club["id"], 57, date(2026, 10, 27), [
+        {"title": "Chapters 1-5", "due_on": date(2026, 11, 3)}, {"title": "Chapters 6-10"}])
+    assert reading["starts_on"] == "2026-10-27"
+    assert [(m["position"], m["title"], m["due_on"]) for m in reading["milestones"]] == [
+        (1, "Chapters 1-5", "2026-11-03"), (2, "Chapters 6-10", None)]
+    with pytest.raises(ValueError):
+        book_clubs.add_reading(club["id"], 58, None, [{"title": " "}])
+
+    epilogue = book_clubs.add_milestone(club["id"], reading["id"], "Epilogue")
+    assert epilogue["position"] == 3
+    moved = book_clubs.update_milestone(club["id"], epilogue["id"], {"due_on": date(2026, 11, 17)})
+    assert (moved["title"], moved["due_on"]) == ("Epilogue", "2026-11-17")
+    other = book_clubs.create_club("Other", None, organizer_id=2)
+    with pytest.raises(book_clubs.ReadingNotFound):
+        book_clubs.delete_milestone(other["id"], epilogue["id"])
+    book_clubs.delete_milestone(club["id"], epilogue["id"])
+
+    book_clubs.forget_books([57])
+    assert [r["book_id"] for r in book_clubs.readings(club["id"])] == [None]
+    book_clubs.delete_reading(club["id"], reading["id"])
+    assert book_clubs.readings(club["id"]) == []
+
+
+def test_threaded_comments():
+    club = book_clubs.create_club("Classics", None, organizer_id=1)
+    book_clubs.set_member(club["id"], 2)
+    book_clubs.set_member(club["id"], 3)
+    first, second = book_clubs.add_reading(club["id"], 57, None, [{"title": "Part 1"}, {"title": "Part 2"}])["milestones"]
+    question = book_clubs.add_comment(club["id"], first["id"], 1, "Who is the narrator?")
+    answer = book_clubs.add_comment(club["id"], first["id"], 2, "Nick, I think.", parent_id=question["id"])
+    book_clubs.add_comment(club["id"], first["id"], 1, "Thanks!", parent_id=answer["id"])
+    with pytest.raises(ValueError):
+        book_clubs.add_comment(club["id"], second["id"], 2, "Wrong thread", parent_id=question["id"])
+
+    threads = book_clubs.comments(club["id"], first["id"])
+    assert [c["body"] for c in threads] == ["Who is the narrator?"]
+    assert threads[0]["replies"][0]["replies"][0]["body"] == "Thanks!"
+
+    # With replies, a deleted comment stays as a placeholder.
+    book_clubs.delete_comment(club["id"], question["id"])
+    placeholder = book_clubs.comments(club["id"], first["id"])[0]
+    assert (placeholder["deleted"], placeholder["body"], placeholder["user_id"]) == (True, None, None)
+    assert book_clubs.readings(club["id"])[0]["milestones"][0]["comment_count"] == 2
+    with pytest.raises(ValueError):
+        book_clubs.edit_comment(club["id"], question["id"], "Back again")
+    assert book_clubs.edit_comment(club["id"], answer["id"], "Nick.")["edited_at"] is not None
+
+    # Once the replies are gone, so is the placeholder.
+    assert len(book_clubs.export_user(2)["comments"]) == 1
+    book_clubs.forget_user(1)
+    book_clubs.forget_user(2)
+    assert book_clubs.comments(club["id"], first["id"]) == []
+
+
+# --- Tests for /clubs ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def sign_in(username, **kwargs):
+    user = accounts.create_user(username, "password1", **kwargs)
+    return user, {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+
+@patch('calibre_api.app.main.get_book_or_404', return_value={"id": 57, "title": "The Great Gatsby"})
+def test_club_endpoints(mock_get_book, client):
+    ana, ana_headers = sign_in("ana")
+    sam, sam_headers = sign_in("sam")
+    kim, kim_headers = sign_in("kim")
+    _, kid_headers = sign_in("lee", tags=["Kids"])
+    response = client.post("/clubs/", json={"name": "Tuesday readers"}, headers=ana_headers)
+    assert response.status_code == 201
+    url = f"/clubs/{response.json()['id']}"
+    assert client.get(url, headers=sam_headers).status_code == 404
+
+    assert client.put(f"{url}/members/{sam['id']}", json={}, headers=ana_headers).json()["username"] == "sam"
+    assert client.put(f"{url}/members/{kim['id']}", json={}, headers=sam_headers).status_code == 403
+    assert client.put(f"{url}/members/999", json={}, headers=ana_headers).status_code == 404
+    assert client.get("/clubs/", headers=kid_headers).status_code == 403
+    assert [c["role"] for c in client.get("/clubs/", headers=sam_headers).json()] == ["member"]
+    assert client.get("/clubs/", headers=kim_headers).json() == []
+
+    reading = {"book_id": 57, "starts_on": "2026-10-27", "milestones": [{"title": "Chapters 1-5", "due_on": "2026-11-03"}]}
+    assert client.post(f"{url}/readings", json=reading, headers=sam_headers).status_code == 403
+    response = client.post(f"{url}/readings", json=reading, headers=ana_headers)
+    assert response.status_code == 201
+    milestone = response.json()["milestones"][0]
+    detail = client.get(url, headers=sam_headers).json()
+    assert [m["username"] for m in detail["members"]] == ["ana", "sam"]
+    assert detail["readings"][0]["milestones"][0]["due_on"] == "2026-11-03"
+
+    comments_url = f"{url}/milestones/{milestone['id']}/comments"
+    comment = client.post(comments_url, json={"body": "Green light!"}, headers=sam_headers).json()
+    reply = client.post(comments_url, json={"body": "Symbolism.", "parent_id": comment["id"]}, headers=ana_headers).json()
+    assert client.post(comments_url, json={"body": "Hi"}, headers=kim_headers).status_code == 404
+    thread = client.get(comments_url, headers=ana_headers).json()
+    assert thread[0]["username"] == "sam" and thread[0]["replies"][0]["body"] == "Symbolism."
+    assert client.patch(f"{url}/comments/{reply['id']}", json={"body": "Mine"}, headers=sam_headers).status_code == 403
+    assert client.delete(f"{url}/comments/{reply['id']}", headers=sam_headers).status_code == 403
+    # Organizers moderate.
+    assert client.delete(f"{url}/comments/{comment['id']}", headers=ana_headers).status_code == 204
+    assert client.get(comments_url, headers=sam_headers).json()[0]["deleted"] is True
+
+    assert client.delete(f"{url}/members/{sam['id']}", headers=sam_headers).status_code == 204
+    assert client.get(url, headers=sam_headers).status_code == 404
+    assert client.delete(url, headers=ana_headers).status_code == 204
@@ -0,0 +1,249 @@
+import os
+import pytest
+from unittest import mock
+
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, book_collections, notifications
+from calibre_api.app.main import app
+
+
+def test_create_and_list_collections():
+    reading = book_collections.create_collection(" Currently Reading ")
+    book_collections.create_collection("Favorites", "Books to reread")
+    assert reading["name"] == "Currently Reading"
+    assert reading["book_count"] == 0
+    assert [c["name"] for c in book_collections.list_collections()] == ["Currently Reading", "Favorites"]
+    # Collections belong to one library.
+    assert book_collections.list_collections(library_path="/srv/other") == []
+    with pytest.raises(book_collections.CollectionExists):
+        book_collections.create_collection("favorites")
+    with pytest.raises(ValueError):
+        book_collections.create_collection("  ")
+
+
+def test_membership():
+    favorites = book_collections.create_collection("Favorites")
+    reading = book_collections.create_collection("Currently Reading")
+    book_collections.add_books(favorites["id"], [7, 3])
+    assert book_collections.add_books(favorites["id"], [3, 9])["book_count"] == 3
+    book_collections.add_books(reading["id"], [3])
+    assert book_collections.get_collection(favorites["id"])["book_ids"] == [3, 7, 9]
+    assert [c["name"] for c in book_collections.collections_of_book(3)] == ["Currently Reading", "Favorites"]
+
+    assert book_collections.remove_books(favorites["id"], [7])["book_count"] == 2
+    book_collections.forget_books([3])
+    assert book_collections.get_collection(favorites["id"])["book_ids"] == [9]
+    assert book_collections.collections_of_book(3) == []
+
+
+def test_update_and_delete_collection():
+    favorites = book_collections.create_collection("Favorites")
+    book_collections.create_collection("Classics")
+    book_collections.add_books(favorites["id"], [1])
+    updated = book_collections.update_collection(favorites["id"], {"name": "All-time favorites", "description": "Reread"})
+    assert (updated["name"], updated["description"], updated["book_count"]) == ("All-time favorites", "Reread", 1)
+    with pytest.raises(book_collections.CollectionExists):
+        book_collections.update_collection(favorites["id"], {"name": "classics"})
+    with pytest.raises(ValueError):
+        book_collections.update_collection(favorites["id"], {"position": 1})
+
+    book_collections.delete_collection(favorites["id"])
+    with pytest.raises(book_collections.CollectionNotFound):
+        book_collections.get_collection(favorites["id"])
+    with pytest.raises(book_collections.CollectionNotFound):
+        book_collections.add_books(favorites["id"], [1])
+    # IDs of deleted collections are not reused.
+    assert book_collections.create_collection("Favorites")["id"] > favorites["id"]
+
+
+def test_collections_are_kept_in_the_state_dir(tmp_path):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_STATE_DIR": str(tmp_path)}):
+        os.environ.pop("SHELFSTONE_COLLECTIONS_DB", None)
+        assert book_collections.db_path() == str(tmp_path / "collections.db")
+        conn = book_collections.connect()
+        try:
+            assert conn.execute("PRAGMA user_version").fetchone()[0] == len(book_collections.MIGRATIONS)
+        finally:
+            conn.close()
+
+
+def test_shelves_belong_to_their_user():
+    book_collections.create_collection("Favorites")
+    mine = book_collections.create_collection("Favorites", owner_id=1)
+    # Each user can have a shelf of the same name.
+    book_collections.create_collection("favorites", owner_id=2)
+    with pytest.raises(book_collections.CollectionExists):
+        book_collections.create_collection("FAVORITES", owner_id=1)
+    assert [c["id"] for c in book_collections.list_collections(owner_id=1)] == [mine["id"]]
+    assert len(book_collections.list_collections()) == 3
+
+    book_collections.forget_user(1)
+    assert book_collections.list_collections(owner_id=1) == []
+    assert len(book_collections.list_collections()) == 2
+
+
+def test_sharing_shelves():
+    library_wide = book_collections.create_collection("Classics")
+    shelf = book_collections.create_collection("Family picks", owner_id=1)
+    book_collections.create_collection("Secret", owner_id=1)
+    assert book_collections.access(library_wide, 2) == book_collections.COLLABORATE
+    assert book_collections.access(shelf, 1) == book_collections.OWNER
+    assert book_collections.access(shelf, 2) is None
+    assert [c["name"] for c in book_collections.list_collections(visible_to=2)] == ["Classics"]
+
+    book_collections.share(shelf["id"], 2, book_collections.READ)
+    book_collections.share(shelf["id"], 3, book_collections.READ)
+    book_collections.share(shelf["id"], 2, book_collections.COLLABORATE)
+    assert book_collections.access(shelf, 2) == book_collections.COLLABORATE
+    assert [(s["user_id"], s["access"]) for s in book_collections.list_shares(shelf["id"])] == [(2, "collaborate"), (3, "read")]
+    assert [(c["name"], c["access"]) for c in book_collections.list_collections(visible_to=2)] == [
+        ("Classics", "collaborate"), ("Family picks", "collaborate")]
+    assert book_collections.members(shelf) == [1, 2, 3] and book_collections.members(library_wide) == []
+    book_collections.add_books(shelf["id"], [5])
+    assert [c["access"] for c in book_collections.collections_of_book(5, visible_to=3)] == ["read"]
+    assert book_collections.collections_of_book(5, visible_to=4) == []
+
+    for user_id, access in ((2, "edit"), (1, "read")):
+        with pytest.raises(ValueError):
+            book_collections.share(shelf["id"], user_id, access)
+    with pytest.raises(ValueError):
+        book_collections.share(library_wide["id"], 2, book_collections.READ)
+
+    book_collections.unshare(shelf["id"], 3)
+    with pytest.raises(book_collections.ShareNotFound):
+        book_collections.unshare(shelf["id"], 3)
+    assert book_collections.export_user(1)[0]["shares"][0]["user_id"] == 2
+    book_collections.forget_user(2)
+    assert book_collections.list_shares(shelf["id"]) == []
+
+
+def test_public_catalogs():
+    shelf = book_collections.create_collection("Take one", owner_id=1)
+    other = book_collections.create_collection("Leave one", library_path="/other")
+    book_collections.add_books(shelf["id"], [7, 5])
+    assert book_collections.publication(shelf["id"]) is None
+    for slug in ("x", "Not a slug", "-edge-", "a" * 65):
+        with pytest.raises(ValueError):
+            book_collections.publish(shelf["id"], slug)
+    with pytest.raises(book_collections.CollectionNotFound):
+        book_collections.publish(other["id"], "leave-one")
+
+    assert book_collections.publish(shelf["id"], " Little-Library ")["slug"] == "little-library"
+    book_collections.publish(shelf["id"], "little-library", downloads=True)
+    with pytest.raises(book_collections.SlugTaken):
+        book_collections.publish(other["id"], "little-library", library_path="/other")
+    published = book_collections.published("little-library")
+    assert (published["name"], published["library"], published["book_ids"]) == ("Take one", "", [5, 7])
+    assert published["publication"]["downloads"] is True
+    assert book_collections.export_user(1)[0]["publication"]["slug"] == "little-library"
+
+    book_collections.unpublish(shelf["id"])
+    with pytest.raises(book_collections.NotPublished):
+        book_collections.unpublish(shelf["id"])
+    with pytest.raises(book_collections.NotPublished):
+        book_collections.published("little-library")
+    # Deleting a shelf takes its catalog down.
+    book_collections.publish(other["id"], "little-library", library_path="/other")
+    book_collections.delete_collection(other["id"], library_path="/other")
+    with pytest.raises(book_collections.NotPublished):
+        book_collections.published("little-library")
+
+
+# --- Tests for sharing shelves through the API ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def sign_in(username):
+    user = accounts.create_user(username, "password1")
+    return user, {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+
+@mock.patch('calibre_api.app.main.list_books_by_ids', return_value=[{"id": 5, "title": "Dune"}])
+def test_shared_shelf_endpoints(mock_by_ids, client):
+    ana, ana_headers = sign_in("ana")
+    sam, sam_headers = sign_in("sam")
+    kim, kim_headers = sign_in("kim")
+    shelf = client.post("/collections/", json={"name": "Family picks"}, headers=ana_headers).json()
+    url = f"/collections/{shelf['id']}"
+    assert client.get(url, headers=sam_headers).status_code == 404
+
+    assert client.put(f"{url}/shares/{sam['id']}", json={"access": "read"}, headers=sam_headers).status_code == 404
+    response = client.put(f"{url}/shares/{sam['id']}", json={"access": "read"}, headers=ana_headers)
+    assert response.status_code == 200 and response.json()["username"] == "sam"
+    assert client.put(f"{url}/shares/999", json={"access": "read"}, headers=ana_headers).status_code == 404
+    assert client.get(url, headers=sam_headers).json()["access"] == "read"
+    assert client.post(f"{url}/books", json={"book_ids": [5]}, headers=sam_headers).status_code == 403
+    assert client.patch(url, json={"name": "Mine now"}, headers=sam_headers).status_code == 403
+
+    client.put(f"{url}/shares/{sam['id']}", json={"access": "collaborate"}, headers=ana_headers)
+    client.put(f"{url}/shares/{kim['id']}", json={"access": "read"}, headers=ana_headers)
+    response = client.post(f"{url}/books", json={"book_ids": [5]}, headers=sam_headers)
+    assert response.status_code == 200 and response.json()["book_count"] == 1
+    for user in (ana, kim):
+        notification = notifications.export_user(user["id"])[0]
+        assert (notification["kind"], notification["title"], notification["book_id"]) == (
+            notifications.SHELF_BOOKS_ADDED, "sam added 'Dune' to 'Family picks'", 5)
+    assert notifications.export_user(sam["id"]) == []
+    # Adding it again tells nobody.
+    client.post(f"{url}/books", json={"book_ids": [5]}, headers=sam_headers)
+    assert len(notifications.export_user(ana["id"])) == 1
+
+    assert [c["name"] for c in client.get("/me/shelves", headers=kim_headers).json()] == ["Family picks"]
+    assert [s["username"] for s in client.get(f"{url}/shares", headers=kim_headers).json()] == ["sam", "kim"]
+    assert client.delete(f"{url}/shares/{sam['id']}", headers=kim_headers).status_code == 403
+    assert client.delete(f"{url}/shares/{kim['id']}", headers=kim_headers).status_code == 204
+    assert client.get(url, headers=kim_headers).status_code == 404
+    assert client.delete(url, headers=sam_headers).status_code == 403
+    assert client.delete(url, headers=ana_headers).status_code == 204
+
+
+@mock.patch('calibre_api.app.main.crud.export_book_file', return_value=b"EPUB")
+@mock.patch('calibre_api.app.main.list_books_by_ids', return_value=[
+    {"id": 5, "title": "Dune", "authors": "Frank Herbert", "formats": ["/library/Dune/Dune.epub"]}])
+def test_public_catalog_endpoints(mock_by_ids, mock_export, client, monkeypatch):
+    ana, ana_headers = sign_in("ana")
+    _, sam_headers = sign_in("sam")
+    shelf = client.post("/collections/", json={"name": "Take one"}, headers=ana_headers).json()
+    client.post(f"/collections/{shelf['id']}/books", json={"book_ids": [5]}, headers=ana_headers)
+    url = f"/collections/{shelf['id']}/public"
+    # Off by default.
+    assert client.put(url, json={"slug": "take-one"}, headers=ana_headers).status_code == 403
+    monkeypatch.setenv("SHELFSTONE_FEATURES", "public_catalogs=on")
+    assert client.get(url, headers=ana_headers).status_code == 404
+    assert client.put(url, json={"slug": "take-one"}, headers=sam_headers).status_code == 404
+    assert client.put(url, json={"slug": "?"}, headers=ana_headers).status_code == 400
+    response = client.put(url, json={"slug": "take-one"}, headers=ana_headers)
+    assert response.status_code == 200
+    assert (response.json()["url"], response.json()["downloads"]) == ("http://testserver/public/take-one", False)
+    library_wide = book_collections.create_collection("Classics")
+    assert client.put(f"/collections/{library_wide['id']}/public", json={"slug": "take-one"}, headers=ana_headers).status_code == 403
+
+    # Anyone may read it, without signing in, and nothing else.
+    page = client.get("/public/take-one").json()
+    assert (page["title"], page["books"][0]["authors"], page["books"][0]["files"]) == ("Take one", ["Frank Herbert"], {})
+    assert client.get("/books/5").status_code == 401
+    feed = client.get("/public/take-one/opds").text
+    assert "<title>Dune</title>" in feed
+    assert "http://testserver/opds" not in feed and "opds-spec.org/acquisition" not in feed
+    assert client.get("/public/take-one/books/5/file/epub").status_code == 403
+    assert client.get("/public/take-one/books/6/cover").status_code == 404
+    assert client.get("/public/nothing-here").status_code == 404
+
+    client.put(url, json={"slug": "take-one", "downloads": True}, headers=ana_headers)
+    assert client.get("/public/take-one").json()["books"][0]["files"] == {"epub": "http://testserver/public/take-one/books/5/file/epub"}
+    response = client.get("/public/take-one/books/5/file/epub")
+    assert response.status_code == 200 and response.content == b"EPUB"
+    assert mock_export.call_args.kwargs["library_path"] is None
+
+    monkeypatch.setenv("SHELFSTONE_FEATURES", "public_catalogs=off")
+    assert client.get("/public/take-one").status_code == 403
+    monkeypatch.setenv("SHELFSTONE_FEATURES", "public_catalogs=on")
+    assert client.delete(url, headers=sam_headers).status_code == 404
+    assert client.delete(url, headers=ana_headers).status_code == 204
+    assert client.get("/public/take-one").status_code == 404
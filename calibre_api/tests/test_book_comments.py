@@ -0,0 +1,92 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, book_comments, notifications
+from calibre_api.app.main import app
+
+
+def test_mentions():
+    ana = accounts.create_user("ana", "password1")
+    sam = accounts.create_user("sam.k", "password1")
+    assert book_comments.mentions("@ANA and @sam.k. Not ana@example.org or @nobody, @ana again") == [ana["id"], sam["id"]]
+    assert book_comments.mentions("No mentions here.") == []
+
+
+def test_threads():
+    ana = accounts.create_user("ana", "password1")
+    question = book_comments.add_comment(5, 99, "Is it worth finishing, @ana?")
+    assert question["mentions"] == [ana["id"]]
+    book_comments.add_comment(5, ana["id"], "Yes!", parent_id=question["id"])
+    book_comments.add_comment(6, 99, "Another book")
+    book_comments.add_comment(5, 99, "Elsewhere", library_path="/other")
+    with pytest.raises(book_comments.CommentNotFound):
+        book_comments.add_comment(6, 99, "Wrong book", parent_id=question["id"])
+    with pytest.raises(ValueError):
+        book_comments.add_comment(5, 99, "  ")
+
+    threads = book_comments.comments(5)
+    assert [(c["body"], [r["body"] for r in c["replies"]]) for c in threads] == [("Is it worth finishing, @ana?", ["Yes!"])]
+    edited = book_comments.edit_comment(5, question["id"], "Is it worth finishing?")
+    assert edited["mentions"] == [] and edited["edited_at"] is not None
+
+    # With a reply, a deleted comment stays as a placeholder until the reply goes too.
+    book_comments.delete_comment(5, question["id"])
+    assert book_comments.comments(5)[0]["deleted"] is True and book_comments.comment_count(5) == 1
+    with pytest.raises(ValueError):
+        book_comments.add_comment(5, 99, "Reply to nothing", parent_id=question["id"])
+    assert [c["body"] for c in book_comments.export_user(ana["id"])] == ["Yes!"]
+    book_comments.forget_user(ana["id"])
+    assert book_comments.comments(5) == []
+
+    book_comments.forget_books([6])
+    assert book_comments.comments(6) == [] and book_comments.comment_count(5, library_path="/other") == 1
+
+
+# --- Tests for /books/{book_id}/comments ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def sign_in(username, **kwargs):
+    user = accounts.create_user(username, "password1", **kwargs)
+    return user, {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+
+@patch('calibre_api.app.main.get_book_or_404', return_value={"id": 5, "title": "Dune", "tags": "SF"})
+def test_comment_endpoints(mock_get_book, client):
+    ana, ana_headers = sign_in("ana")
+    sam, sam_headers = sign_in("sam")
+    kid, _ = sign_in("kim", tags=["Kids"])
+    _, fan_headers = sign_in("lee", tags=["SF"])
+    _, admin_headers = sign_in("root", role=accounts.ADMIN)
+
+    response = client.post("/books/5/comments", json={"body": "@sam @kim you'll love the ending."}, headers=ana_headers)
+    assert response.status_code == 201
+    comment = response.json()
+    assert [m["username"] for m in comment["mentions"]] == ["sam", "kim"]
+    # Kim can't see the book, so only Sam hears of it.
+    notification = notifications.export_user(sam["id"])[0]
+    assert (notification["kind"], notification["title"]) == (notifications.MENTIONED, "ana mentioned you on 'Dune'")
+    assert notifications.export_user(kid["id"]) == []
+
+    reply = client.post("/books/5/comments", json={"body": "No spoilers!", "parent_id": comment["id"]}, headers=sam_headers).json()
+    thread = client.get("/books/5/comments", headers=fan_headers).json()
+    assert thread["count"] == 2 and thread["comments"][0]["replies"][0]["username"] == "sam"
+    # Users restricted to some tags may join the threads of the books they can see.
+    assert client.post("/books/5/comments", json={"body": "Me too"}, headers=fan_headers).status_code == 201
+
+    assert client.patch(f"/books/5/comments/{comment['id']}", json={"body": "Edited"}, headers=sam_headers).status_code == 403
+    client.patch(f"/books/5/comments/{reply['id']}", json={"body": "No spoilers, @ana!"}, headers=sam_headers)
+    assert notifications.export_user(ana["id"])[0]["kind"] == notifications.MENTIONED
+    assert client.delete(f"/books/5/comments/{comment['id']}", headers=sam_headers).status_code == 403
+    # Admins moderate.
+    assert client.delete(f"/books/5/comments/{reply['id']}", headers=admin_headers).status_code == 204
+    assert client.delete(f"/books/5/comments/{comment['id']}", headers=ana_headers).status_code == 204
+    assert client.delete(f"/books/5/comments/{comment['id']}", headers=ana_headers).status_code == 404
+    assert client.get("/books/5/comments", headers=ana_headers).json()["count"] == 1
@@ -0,0 +1,385 @@
+import inspect
+import os
+import pytest
+from fastapi.routing import APIRoute
+from fastapi.testclient import TestClient
+from unittest.mock import patch
+
+from calibre_api.app.main import app
+from calibre_api.app.crud import CalibredbError
+from calibre_api.app import book_collections, processing_log
+
+
+@pytest.fixture(scope="module")
+def client():
+    return TestClient(app)
+
+
+SAMPLE_OPF = '<?xml version="1.0" encoding="utf-8"?><package xmlns="http://www.idpf.org/2007/opf" version="2.0"></package>'
+
+
+# --- Tests for GET /books/{book_id}/metadata.opf ---
+
+@patch('calibre_api.app.main.crud.get_book_opf', return_value=SAMPLE_OPF)
+def test_get_book_opf(mock_get_opf, client):
+    response = client.get("/books/1/metadata.opf?library_path=/lib")
+    assert response.status_code == 200
+    assert response.headers["content-type"].startswith("application/oebps-package+xml")
+    assert 'filename="book_1.opf"' in response.headers["content-disposition"]
+    assert response.text == SAMPLE_OPF
+    mock_get_opf.assert_called_once_with(book_id=1, library_path="/lib")
+
+
+@patch('calibre_api.app.main.crud.get_book_opf', side_effect=CalibredbError("No book with id 99 found."))
+def test_get_book_opf_not_found(mock_get_opf, client):
+    response = client.get("/books/99/metadata.opf")
+    assert response.status_code == 404
+
+
+@patch('calibre_api.app.main.crud.get_book_opf', side_effect=FileNotFoundError("calibredb not found"))
+def test_get_book_opf_calibredb_not_found(mock_get_opf, client):
+    response = client.get("/books/1/metadata.opf")
+    assert response.status_code == 503
+
+
+# --- Tests for /books/{book_id}/attachments/ ---
+
+@patch('calibre_api.app.main.list_books')
+def test_list_attachments(mock_list_books, client, tmp_path):
+    (tmp_path / "data").mkdir()
+    (tmp_path / "data" / "errata.pdf").write_bytes(b"12345")
+    mock_list_books.return_value = [{"id": 1, "title": "Dune", "formats": [str(tmp_path / "Dune.epub")]}]
+
+    response = client.get("/books/1/attachments/")
+    assert response.status_code == 200
+    assert response.json() == {"book_id": 1, "attachments": [{"name": "errata.pdf", "size": 5}]}
+    assert mock_list_books.call_args[1]["search_query"] == "id:1"
+
+
+@patch('calibre_api.app.main.list_books', return_value=[])
+def test_attachments_book_not_found(mock_list_books, client):
+    assert client.get("/books/5/attachments/").status_code == 404
+    assert client.get("/books/5/attachments/errata.pdf").status_code == 404
+
+
+# --- Tests for the Idempotency-Key header on POST /books/add/ ---
+
+@patch('calibre_api.app.main.add_book')
+@patch('calibre_api.app.main.idempotency.find_book_id', return_value=42)
+def test_add_book_replays_idempotent_request(mock_find, mock_add_book, client):
+    files = {'file': ('dune.epub', b"epub bytes", 'application/epub+zip')}
+    response = client.post("/books/add/", files=files, headers={"Idempotency-Key": "upload-123"})
+    assert response.status_code == 200
+    assert response.json()["added_book_ids"] == [42]
+    mock_add_book.assert_not_called()
+
+
+@patch('calibre_api.app.main.duplicate_detection.attach_as_format', return_value=None)
+@patch('calibre_api.app.main.duplicate_detection.find_by_hash', return_value=[])
+@patch('calibre_api.app.main.add_book', return_value=[43])
+@patch('calibre_api.app.main.idempotency.find_book_id', return_value=None)
+def test_add_book_stores_idempotency_key(mock_find, mock_add_book, mock_find_hash, mock_attach, client):
+    files = {'file': ('dune.epub', b"epub bytes", 'application/epub+zip')}
+    response = client.post("/books/add/", files=files, headers={"Idempotency-Key": "upload-123"})
+    assert response.status_code == 200
+    assert response.json()["added_book_ids"] == [43]
+    content_hash = mock_find_hash.call_args[0][0]
+    assert mock_add_book.call_args[1]["identifiers"] == {"import": content_hash, "idempotency": "upload-123"}
+
+
+def test_add_book_rejects_invalid_idempotency_key(client):
+    files = {'file': ('dune.epub', b"epub bytes", 'application/epub+zip')}
+    response = client.post("/books/add/", files=files, headers={"Idempotency-Key": "not valid!"})
+    assert response.status_code == 400
+
+
+@patch('calibre_api.app.main.duplicate_detection.attach_as_format', return_value=None)
+@patch('calibre_api.app.main.duplicate_detection.find_by_hash', return_value=[])
+@patch('calibre_api.app.main.list_books', return_value=[{"id": 44, "title": "Dune", "authors": "Frank Herbert"}])
+@patch('calibre_api.app.main.add_book', return_value=[44])
+def test_upload_book_returns_record(mock_add_book, mock_list_books, mock_find_hash, mock_attach, client):
+    files = {'file': ('../../dune.epub', b"epub bytes", 'application/epub+zip')}
+    response = client.post("/books/upload", files=files)
+    assert response.status_code == 200
+    assert response.json()["books"][0]["authors"] == ["Frank Herbert"]
+    assert os.path.basename(mock_add_book.call_args[1]["file_path"]) == "dune.epub"
+    assert "/../" not in mock_add_book.call_args[1]["file_path"]
+    mock_list_books.assert_called_once_with(library_path=None, search_query="id:44")
+
+
+@patch('calibre_api.app.main.duplicate_detection.find_by_hash', return_value=[{"id": 7, "identifiers": {"import": "abc"}}])
+@patch('calibre_api.app.main.add_book')
+def test_add_book_skips_same_file(mock_add_book, mock_find_hash, client):
+    files = {'file': ('dune-copy.epub', b"epub bytes", 'application/epub+zip')}
+    response = client.post("/books/add/", files=files)
+    assert response.status_code == 200
+    assert response.json()["added_book_ids"] == [] and response.json()["duplicate_of"] == [7]
+    mock_add_book.assert_not_called()
+
+    mock_add_book.return_value = [8]
+    response = client.post("/books/add/", files=files, data={"duplicates": "true"})
+    assert response.json()["added_book_ids"] == [8] and response.json()["duplicate_of"] == [7]
+
+
+@patch('calibre_api.app.main.fulltext.update_after_change')
+@patch('calibre_api.app.main.list_books', return_value=[{"id": 9, "title": "Dune", "authors": "Frank Herbert"}])
+@patch('calibre_api.app.main.duplicate_detection.attach_as_format', return_value=9)
+@patch('calibre_api.app.main.duplicate_detection.find_by_hash', return_value=[])
+@patch('calibre_api.app.main.add_book', return_value=[10])
+def test_add_book_adds_format_to_matching_book(mock_add_book, mock_find_hash, mock_attach, mock_list_books, mock_fulltext, client):
+    files = {'file': ('dune.epub', b"epub bytes", 'application/epub+zip')}
+    response = client.post("/books/add/", files=files, data={"title": "Dune"})
+    assert response.status_code == 200
+    assert response.json()["format_added_to"] == 9 and response.json()["added_book_ids"] == []
+    assert mock_attach.call_args[1] == {"title": "Dune", "authors": None}
+    mock_add_book.assert_not_called()
+
+    response = client.post("/books/add/", files=files, data={"merge_formats": "false"})
+    assert response.json()["added_book_ids"] == [10] and response.json()["format_added_to"] is None
+    assert mock_attach.call_count == 1
+
+
+# --- Tests for GET /books/check-owned/ ---
+
+@patch('calibre_api.app.isbn.list_books', return_value=[
+    {"id": 1, "title": "Dune", "authors": "Frank Herbert", "identifiers": {"isbn": "9780441172719"}}
+])
+def test_check_owned(mock_list_books, client):
+    response = client.get("/books/check-owned/?isbn=0-441-17271-7")
+    assert response.status_code == 200
+    data = response.json()
+    assert data["isbn"] == "9780441172719"
+    assert data["owned"] is True
+    assert [b["id"] for b in data["books"]] == [1]
+    assert data["books"][0]["authors"] == ["Frank Herbert"]
+
+
+@patch('calibre_api.app.main.calibre_cli.fetch_ebook_metadata', return_value={"title": "Dune"})
+@patch('calibre_api.app.isbn.list_books', return_value=[])
+def test_check_owned_lookup_when_not_owned(mock_list_books, mock_fetch, client):
+    response = client.get("/books/check-owned/?isbn=9780441172719&lookup=true")
+    assert response.status_code == 200
+    assert response.json()["owned"] is False
+    assert response.json()["metadata"] == {"title": "Dune"}
+    mock_fetch.assert_called_once_with(isbn="9780441172719", as_json=True)
+
+
+def test_check_owned_invalid_isbn(client):
+    response = client.get("/books/check-owned/?isbn=123")
+    assert response.status_code == 400
+
+
+# --- Tests for GET /books/{book_id}/qr and /books/qr-sheet ---
+
+@patch('calibre_api.app.main.qrcodes.qr_png', return_value=b"\x89PNG")
+@patch('calibre_api.app.main.get_book_or_404', return_value={"id": 3, "title": "Dune"})
+def test_book_qr(mock_get_book, mock_qr_png, client):
+    response = client.get("/books/3/qr")
+    assert response.status_code == 200
+    assert response.headers["content-type"] == "image/png"
+    assert response.content == b"\x89PNG"
+    assert mock_qr_png.call_args[0][0] == "http://testserver/books/3/card"
+
+
+@patch('calibre_api.app.main.list_books', return_value=[])
+def test_book_qr_sheet_no_matches(mock_list_books, client):
+    response = client.get("/books/qr-sheet?search=tags:=Empty")
+    assert response.status_code == 404
+
+
+# --- Tests for GET /books/ paging and GET /books/{book_id}/ ---
+
+@patch('calibre_api.app.main.list_books')
+@patch('calibre_api.app.main.list_books_by_ids', side_effect=lambda ids, library_path=None: [
+    {"id": i, "title": f"Book {i}", "authors": "A & B"} for i in ids])
+@patch('calibre_api.app.main.list_book_ids', return_value=[5, 4, 3, 2, 1])
+def test_get_books_paging(mock_ids, mock_by_ids, mock_list_books, client):
+    response = client.get("/books/?limit=2&offset=1")
+    assert response.status_code == 200
+    assert [b["id"] for b in response.json()] == [4, 3]
+    assert response.json()[0]["authors"] == ["A", "B"]
+    assert response.headers["x-total-count"] == "5"
+    # Only the page is read with all fields.
+    mock_by_ids.assert_called_once_with([4, 3], library_path=None)
+    mock_list_books.assert_not_called()
+
+    assert [b["id"] for b in client.get("/books/?offset=4").json()] == [1]
+    assert client.get("/books/?offset=9").json() == []
+    assert client.get("/books/?limit=0").status_code == 422
+
+
+@patch('calibre_api.app.crud.run_calibre_command')
+def test_list_book_ids_and_books_by_ids(mock_run):
+    from calibre_api.app import crud
+    mock_run.return_value = ('[{"id": 3, "uuid": "c"}, {"id": 1, "uuid": "a"}]', "", 0)
+    assert crud.list_book_ids(search_query="tags:SF") == [3, 1]
+    assert mock_run.call_args.args[0] == ["calibredb", "list", "--for-machine", "--fields", "uuid", "--search", "tags:SF"]
+
+    with patch.object(crud, "IDS_PER_SEARCH", 2):
+        mock_run.side_effect = [('[{"id": 1}, {"id": 3}]', "", 0), ('[]', "", 0)]
+        assert [b["id"] for b in crud.list_books_by_ids([3, 1, 7])] == [3, 1]
+    assert mock_run.call_args_list[-2].args[0][-1] == "id:3 or id:1"
+    assert mock_run.call_args_list[-1].args[0][-1] == "id:7"
+
+
+@patch('calibre_api.app.main.book_collections.get_collection', return_value={"id": 4, "book_ids": [2, 5]})
+@patch('calibre_api.app.main.list_books')
+def test_get_books_by_tag_and_collection(mock_list_books, mock_collection, client):
+    mock_list_books.return_value = [{"id": i, "title": f"Book {i}"} for i in range(1, 6)]
+    response = client.get('/books/?search=author:Herbert&tag=SF&tag=Re "read"&collection=4')
+    assert response.status_code == 200
+    assert [b["id"] for b in response.json()] == [2, 5]
+    assert response.headers["x-total-count"] == "2"
+    assert mock_list_books.call_args[1]["search_query"] == '(author:Herbert) and tags:"=SF" and tags:"=Re \\"read\\""'
+    mock_collection.assert_called_once_with(4, library_path=None)
+
+
+@patch('calibre_api.app.main.book_collections.get_collection', side_effect=book_collections.CollectionNotFound("Collection 9 not found."))
+def test_get_books_unknown_collection(mock_collection, client):
+    assert client.get("/books/?collection=9").status_code == 404
+
+
+@patch('calibre_api.app.main.book_collections.add_books')
+@patch('calibre_api.app.main.list_books_by_ids', return_value=[{"id": 2, "title": "Dune"}])
+@patch('calibre_api.app.main.book_collections.get_collection', return_value={"id": 4, "book_ids": []})
+def test_add_collection_books_unknown_book(mock_collection, mock_by_ids, mock_add_books, client):
+    response = client.post("/collections/4/books", json={"book_ids": [7, 2, 2]})
+    assert response.status_code == 404
+    assert response.json()["detail"] == "Book(s) not found: 7."
+    mock_by_ids.assert_called_once_with([2, 7], library_path=None)
+    mock_add_books.assert_not_called()
+
+
+@patch('calibre_api.app.main.provenance.sources_of', return_value={5: {"source": "upload", "detail": "dune.epub", "client": "10.0.0.2", "added_at": 1760000000.0}})
+@patch('calibre_api.app.main.provenance.books_from', return_value={2, 5})
+@patch('calibre_api.app.main.list_books')
+def test_get_books_by_source(mock_list_books, mock_books_from, mock_sources, client):
+    mock_list_books.return_value = [{"id": i, "title": f"Book {i}"} for i in range(1, 6)]
+    response = client.get("/books/?source=upload")
+    assert response.status_code == 200
+    assert [(b["id"], b["source"] and b["source"]["detail"]) for b in response.json()] == [(2, None), (5, "dune.epub")]
+    mock_books_from.assert_called_once_with("upload", library_path=None)
+
+
+def test_get_books_unknown_source(client):
+    assert client.get("/books/?source=carrier-pigeon").status_code == 400
+
+
+@patch('calibre_api.app.main.list_books', return_value=[{"id": 3, "title": "Dune", "tags": "SF, Classic"}])
+def test_get_book(mock_list_books, client):
+    response = client.get("/books/3/")
+    assert response.status_code == 200
+    assert response.json()["title"] == "Dune"
+    assert response.json()["tags"] == ["SF", "Classic"]
+    assert mock_list_books.call_args[1]["search_query"] == "id:3"
+
+
+@patch('calibre_api.app.main.list_books', return_value=[])
+def test_get_book_not_found(mock_list_books, client):
+    assert client.get("/books/3/").status_code == 404
+    assert client.get("/books/0/").status_code == 400
+
+
+# --- Tests for GET /books/{book_id}/download ---
+
+@patch('calibre_api.app.main.list_books')
+def test_download_original_format(mock_list_books, client, tmp_path):
+    epub = tmp_path / "Dune.epub"
+    epub.write_bytes(b"epub data")
+    mock_list_books.return_value = [{"id": 3, "title": "Dune", "authors": ["Frank Herbert"], "formats": [str(epub)]}]
+
+    response = client.get("/books/3/download")
+    assert response.status_code == 200
+    assert response.content == b"epub data"
+    assert response.headers["content-type"] == "application/epub+zip"
+    # Starlette sends names that need quoting as RFC 5987 filename*.
+    assert "filename*=utf-8''Dune%20-%20Frank%20Herbert.epub" in response.headers["content-disposition"]
+    assert response.headers["x-converted"] == "false"
+
+
+@patch('calibre_api.app.main.conversion_cache.get_or_convert')
+@patch('calibre_api.app.main.list_books')
+def test_download_converted_format(mock_list_books, mock_convert, client, tmp_path):
+    epub = tmp_path / "Dune.epub"
+    epub.write_bytes(b"epub data")
+    converted = tmp_path / "3_abc.azw3"
+    converted.write_bytes(b"azw3 data")
+    mock_list_books.return_value = [{"id": 3, "title": "Dune", "authors": [], "formats": [str(epub)]}]
+    mock_convert.return_value = {"path": str(converted), "cached": True}
+
+    response = client.get("/books/3/download?format=azw3")
+    assert response.status_code == 200
+    assert response.content == b"azw3 data"
+    assert response.headers["x-converted"] == "true"
+    mock_convert.assert_called_once_with(3, str(epub), "AZW3")
+
+
+@patch('calibre_api.app.main.list_books', return_value=[{"id": 3, "title": "No files", "formats": []}])
+def test_download_book_without_files(mock_list_books, client):
+    assert client.get("/books/3/download").status_code == 404
+
+
+# --- Tests for GET /books/{book_id}/cover ---
+
+@patch('calibre_api.app.main.thumbnails.get_thumbnail')
+@patch('calibre_api.app.main.list_books')
+def test_book_cover_thumbnail(mock_list_books, mock_thumbnail, client, tmp_path):
+    cover = tmp_path / "cover.jpg"
+    cover.write_bytes(b"original")
+    thumb = tmp_path / "thumb.jpg"
+    thumb.write_bytes(b"small")
+    mock_list_books.return_value = [{"id": 3, "title": "Dune", "cover": str(cover)}]
+    mock_thumbnail.return_value = str(thumb)
+
+    assert client.get("/books/3/cover").content == b"original"
+    response = client.get("/books/3/cover?size=small")
+    assert response.content == b"small"
+    assert response.headers["content-type"] == "image/jpeg"
+    mock_thumbnail.assert_called_once_with(3, str(cover), "small")
+
+
+@patch('calibre_api.app.main.list_books', return_value=[{"id": 3, "title": "Dune", "cover": None}])
+def test_book_cover_missing(mock_list_books, client):
+    assert client.get("/books/3/cover").status_code == 404
+
+
+# --- Tests for DELETE /books/{book_id}/ ---
+
+@patch('calibre_api.app.main.book_collections.forget_books')
+@patch('calibre_api.app.main.thumbnails.remove_book_entries')
+@patch('calibre_api.app.main.conversion_cache.remove_book_entries')
+@patch('calibre_api.app.main.remove_book', return_value={"ok": True, "num_removed": 1, "removed_ids": [3]})
+def test_remove_book_to_trash_clears_caches(mock_remove, mock_conversions, mock_thumbnails, mock_forget, client):
+    response = client.delete("/books/3/?delete_file=false")
+    assert response.status_code == 200
+    mock_remove.assert_called_once_with(book_id=3, library_path=None, permanent=False)
+    mock_conversions.assert_called_once_with(3)
+    mock_thumbnails.assert_called_once_with(3)
+    mock_forget.assert_called_once_with([3], library_path=None)
+
+
+# --- Tests for GET /books/{book_id}/processing-log ---
+
+def test_book_processing_log(client):
+    with processing_log.step("add", [4], "/lib"):
+        processing_log.record_command("calibredb", 0, 0.5, "Added book ids: 4", "")
+    with pytest.raises(RuntimeError):
+        with processing_log.step("convert to EPUB on add", [4], "/lib"):
+            raise RuntimeError("Conversion failed")
+    response = client.get("/books/4/processing-log?library_path=/lib")
+    assert response.status_code == 200
+    body = response.json()
+    assert body["book_id"] == 4
+    assert [(e["step"], e["status"], e["error"]) for e in body["entries"]] == [
+        ("convert to EPUB on add", "failed", "Conversion failed"), ("add", "ok", None)]
+    assert body["entries"][1]["commands"][0]["stdout"] == "Added book ids: 4"
+    assert len(client.get("/books/4/processing-log?library_path=/lib&limit=1").json()["entries"]) == 1
+    assert client.get("/books/4/processing-log").json()["entries"] == []
+    assert client.get("/books/4/processing-log?limit=0").status_code == 422
+
+
+def test_endpoints_run_in_the_threadpool():
+    # Calibre commands block the calling thread; only endpoints that never run one may be async.
+    async_endpoints = {route.endpoint.__name__ for route in app.routes
+                       if isinstance(route, APIRoute) and inspect.iscoroutinefunction(route.endpoint)}
+    assert async_endpoints == {"append_upload_chunk_endpoint", "admin_logs_endpoint", "healthz_endpoint", "readyz_endpoint"}
@@ -0,0 +1,53 @@
+import sqlite3
+
+from calibre_api.app import browse
+
+
+def make_library(tmp_path):
+    conn = sqlite3.connect(str(tmp_path / "metadata.db"))
+    conn.executescript("""
+        CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT, sort TEXT, series_index REAL);
+        CREATE TABLE authors (id INTEGER PRIMARY KEY, name TEXT, sort TEXT);
+        CREATE TABLE series (id INTEGER PRIMARY KEY, name TEXT);
+        CREATE TABLE books_authors_link (id INTEGER PRIMARY KEY, book INTEGER, author INTEGER);
+        CREATE TABLE books_series_link (id INTEGER PRIMARY KEY, book INTEGER, series INTEGER);
+        INSERT INTO books VALUES (1, 'Dune Messiah', 'Dune Messiah', 2), (2, 'Dune', 'Dune', 1), (3, 'Emma', 'Emma', 1),
+                                 (4, 'Persuasion', 'Persuasion', 1), (5, 'Sanditon', 'Sanditon', 1);
+        INSERT INTO authors VALUES (1, 'Frank Herbert', 'Herbert, Frank'), (2, 'Austen, Jane', 'Austen, Jane'),
+                                   (3, 'Jane Austen', 'Austen, Jane'), (4, 'Nobody', 'Nobody');
+        INSERT INTO series VALUES (1, 'Dune'), (2, 'Empty');
+        INSERT INTO books_authors_link (book, author) VALUES (1, 1), (2, 1), (3, 2), (4, 3), (5, 3), (5, 2);
+        INSERT INTO books_series_link (book, series) VALUES (1, 1), (2, 1);
+    """)
+    conn.commit()
+    conn.close()
+    return str(tmp_path)
+
+
+def test_normalize_author():
+    assert browse.normalize_author("Austen, Jane") == browse.normalize_author(" jane  AUSTEN") == "jane austen"
+    assert browse.normalize_author("Tolkien, J.R.R.") == browse.normalize_author("J. R. R. Tolkien")
+    assert browse.normalize_author("Gabriel García Márquez") == "gabriel garcia marquez"
+    assert browse.normalize_author("Martin Luther King, Jr.") == "martin luther king jr"
+
+
+def test_list_authors_merges_name_variants(tmp_path):
+    assert browse.list_authors(make_library(tmp_path)) == [
+        {"id": 3, "name": "Jane Austen", "sort": "Austen, Jane", "book_count": 3, "variants": [{"id": 2, "name": "Austen, Jane"}]},
+        {"id": 1, "name": "Frank Herbert", "sort": "Herbert, Frank", "book_count": 2, "variants": []},
+    ]
+
+
+def test_find_author_by_any_variant(tmp_path):
+    library = make_library(tmp_path)
+    assert browse.find_author(2, library)["book_ids"] == {3, 4, 5}
+    assert browse.find_author(3, library)["id"] == 3
+    assert browse.find_author(4, library) is None  # No books.
+
+
+def test_series(tmp_path):
+    library = make_library(tmp_path)
+    assert browse.list_series(library) == [{"id": 1, "name": "Dune", "book_count": 2, "authors": ["Frank Herbert"]}]
+    assert browse.find_series(1, library) == {"id": 1, "name": "Dune", "book_ids": [2, 1]}
+    assert browse.find_series(2, library) == {"id": 2, "name": "Empty", "book_ids": []}
+    assert browse.find_series(9, library) is None
@@ -0,0 +1,83 @@
+import os
+import zipfile
+import pytest
+from unittest import mock
+
+from calibre_api.app import bundles
+from calibre_api.app.bundles import safe_name, plan_bundle, write_bundle
+
+
+def make_library(tmp_path):
+    book_dir = tmp_path / "library" / "Frank Herbert" / "Dune (1)"
+    book_dir.mkdir(parents=True)
+    (book_dir / "Dune - Frank Herbert.epub").write_bytes(b"epub-bytes")
+    (book_dir / "Dune - Frank Herbert.pdf").write_bytes(b"pdf-bytes")
+    (book_dir / "cover.jpg").write_bytes(b"jpg-bytes")
+    return [
+        {
+            "id": 1, "uuid": "u-1", "title": "Dune: Deluxe <Edition>", "authors": ["Frank Herbert"],
+            "formats": [str(book_dir / "Dune - Frank Herbert.epub"), str(book_dir / "Dune - Frank Herbert.pdf")],
+            "cover": str(book_dir / "cover.jpg"),
+        },
+        {"id": 2, "title": "No Files", "authors": ["Nobody"], "formats": []},
+    ]
+
+
+def test_safe_name():
+    assert safe_name('Dune: Deluxe <Edition>?') == "Dune_ Deluxe _Edition_"
+    assert safe_name("...") == "untitled"
+    assert len(safe_name("x" * 200)) == 80
+
+
+def test_plan_bundle_filters_formats_and_skips_books_without_files(tmp_path):
+    books = make_library(tmp_path)
+    entries = plan_bundle(books, formats=["epub"])
+
+    assert len(entries) == 1
+    assert entries[0]["folder"] == "books/1 - Dune_ Deluxe _Edition_"
+    assert [arcname for _, arcname in entries[0]["files"]] == ["books/1 - Dune_ Deluxe _Edition_/Dune - Frank Herbert.epub"]
+    assert entries[0]["cover"][1] == "covers/1.jpg"
+
+
+def test_write_bundle(tmp_path):
+    books = make_library(tmp_path)
+    output = tmp_path / "bundle.zip"
+
+    result = write_bundle(books, str(output), title="Class 7b")
+
+    assert result == {"books": 1, "files": 2}
+    with zipfile.ZipFile(output) as bundle:
+        names = set(bundle.namelist())
+        assert names == {
+            "books/1 - Dune_ Deluxe _Edition_/Dune - Frank Herbert.epub",
+            "books/1 - Dune_ Deluxe _Edition_/Dune - Frank Herbert.pdf",
+            "covers/1.jpg",
+            "index.html",
+            "catalog.xml",
+        }
+        assert bundle.read("covers/1.jpg") == b"jpg-bytes"
+        index = bundle.read("index.html").decode()
+        catalog = bundle.read("catalog.xml").decode()
+
+    assert "<h1>Class 7b</h1>" in index
+    assert "Dune: Deluxe &lt;Edition&gt;" in index
+    # Links are URL-quoted relative paths into the bundle.
+    assert 'href="books/1%20-%20Dune_%20Deluxe%20_Edition_/Dune%20-%20Frank%20Herbert.epub"' in index
+    assert "<title>Dune: Deluxe &lt;Edition&gt;</title>" in catalog
+    assert 'rel="http://opds-spec.org/acquisition" href="books/1%20-%20Dune_%20Deluxe%20_Edition_/Dune%20-%20Frank%20Herbert.pdf" type="application/pdf"' in catalog
+    assert "<id>urn:uuid:u-1</id>" in catalog
+
+
+def test_write_bundle_without_matching_files(tmp_path):
+    books = make_library(tmp_path)
+    with pytest.raises(ValueError):
+        write_bundle(books, str(tmp_path / "bundle.zip"), formats=["MOBI"])
+
+
+def test_max_books_setting():
+    with mock.patch.dict(os.environ, {}, clear=True):
+        assert bundles.max_books() == bundles.DEFAULT_MAX_BOOKS
+    with mock.patch.dict(os.environ, {"SHELFSTONE_BUNDLE_MAX_BOOKS": "50"}):
+        assert bundles.max_books() == 50
+    with mock.patch.dict(os.environ, {"SHELFSTONE_BUNDLE_MAX_BOOKS": "0"}):
+        assert bundles.max_books() == 1
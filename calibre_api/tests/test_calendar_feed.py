@@ -0,0 +1,62 @@
+from datetime import date
+from unittest import mock
+
+from calibre_api.app import calendar_feed
+
+
+def unfold(text):
+    return text.replace("\r\n ", "")
+
+
+def test_escape_and_fold():
+    assert calendar_feed.escape_text("a,b;c\\d\ne") == "a\\,b\\;c\\\\d\\ne"
+    line = "SUMMARY:" + "é" * 60
+    folded = calendar_feed.fold_line(line)
+    assert all(len(part.encode("utf-8")) <= 75 for part in folded.split("\r\n"))
+    assert unfold(folded) == line
+
+
+def test_book_added_and_loan_events():
+    added = calendar_feed.book_added_events([
+        {"id": 3, "title": "Dune", "authors": ["Frank Herbert"], "timestamp": "2026-10-01T08:30:00+00:00"},
+        {"id": 4, "title": "No date"},
+    ])
+    assert added == [{"uid": "book-added-3", "date": date(2026, 10, 1), "summary": "Added: Dune by Frank Herbert",
+                      "categories": "Books added"}]
+
+    lent = [{"id": 7, "title": "Hyperion", "*physical": True, "*loaned_to": "Sam", "*loaned_on": "2026-10-02T12:00:00+00:00"},
+            {"id": 8, "title": "At home", "*physical": True}]
+    events = calendar_feed.loan_due_events(lent, days=14)
+    assert [(e["uid"], e["date"], e["summary"]) for e in events] == [
+        ("loan-due-7-2026-10-02", date(2026, 10, 16), "Due back: Hyperion (lent to Sam)")]
+
+
+def test_maintenance_events():
+    assert calendar_feed.maintenance_events({"enabled": False}) == []
+    events = calendar_feed.maintenance_events({"enabled": True, "started_at": 1000.0, "until": 2800.0, "reason": "Upgrade"})
+    assert events[0]["uid"] == "maintenance-1000" and events[0]["description"] == "Upgrade"
+
+
+def test_render_calendar():
+    events = [
+        {"uid": "book-added-3", "date": date(2026, 10, 1), "summary": "Added: Dune, Part 1", "categories": "Books added"},
+        {"uid": "maintenance-0", "start": 0.0, "end": 3600.0, "summary": "Maintenance", "description": "Backup"},
+    ]
+    text = calendar_feed.render_calendar(events, now=0.0)
+    assert text.endswith("END:VCALENDAR\r\n")
+    lines = unfold(text).split("\r\n")
+    assert "UID:book-added-3@shelfstone" in lines
+    assert "DTSTART;VALUE=DATE:20261001" in lines and "DTEND;VALUE=DATE:20261002" in lines
+    assert "SUMMARY:Added: Dune\\, Part 1" in lines
+    assert "DTSTART:19700101T000000Z" in lines and "DTEND:19700101T010000Z" in lines
+    assert lines.count("BEGIN:VEVENT") == 2
+
+
+@mock.patch("calibre_api.app.calendar_feed.physical.list_physical_copies", return_value=[])
+@mock.patch("calibre_api.app.calendar_feed.list_books", return_value=[])
+def test_build_feed_queries_recent_books(mock_list_books, mock_list_copies):
+    with mock.patch.dict("os.environ", {"SHELFSTONE_LOAN_DAYS": "21"}):
+        text = calendar_feed.build_feed(library_path="/lib", days=30, today=date(2026, 10, 16), now=0.0)
+    assert "BEGIN:VCALENDAR" in text
+    mock_list_books.assert_called_once_with(library_path="/lib", search_query="date:>=2026-09-16")
+    mock_list_copies.assert_called_once_with(loaned=True, library_path="/lib")
@@ -13,6 +13,7 @@ from calibre_api.app.calibre_cli import (
     set_ebook_metadata,
     ebook_polish,
     fetch_ebook_metadata,
+    fetch_news_recipe,
     web2disk,
     lrf2lrs,
     lrs2lrf,
@@ -20,7 +21,9 @@ from calibre_api.app.calibre_cli import (
     run_calibre_debug_test_build,
     send_email_with_calibre_smtp,
     check_ebook_errors,
+    ConversionUnavailable,
 )
+from calibre_api.app import calibre_cli
 
 # Mock object for subprocess.CompletedProcess
 def mock_completed_process(stdout="", stderr="", returncode=0):
@@ -54,6 +57,17 @@ def test_run_calibre_command_failure_returncode(mock_subproc_run):
     assert retcode == 1
 
 
+
+@mock.patch('subprocess.run')
+def test_run_calibre_command_uses_bin_dir(mock_subproc_run, tmp_path):
+    (tmp_path / "mytool").write_text("")
+    mock_subproc_run.return_value = mock_completed_process(returncode=0)
+    with mock.patch.dict(os.environ, {"SHELFSTONE_CALIBRE_BIN_DIR": str(tmp_path)}):
+        run_calibre_command(['mytool', '--arg'])
+        run_calibre_command(['othertool'])
+    assert mock_subproc_run.call_args_list[0][0][0] == [str(tmp_path / "mytool"), '--arg']
+    assert mock_subproc_run.call_args_list[1][0][0] == ['othertool']
+
 @mock.patch('subprocess.run', side_effect=FileNotFoundError("mytool not found"))
 def test_run_calibre_command_file_not_found(mock_subproc_run):
     with pytest.raises(FileNotFoundError, match="mytool not found"):
@@ -106,6 +120,45 @@ def test_ebook_convert_success(mock_os_exists, mock_run_cmd):
         ['ebook-convert', 'input.epub', 'output.mobi', '--foo', 'bar'], timeout=300
     )
 
+@mock.patch('calibre_api.app.calibre_cli.run_calibre_command')
+def test_ebook_convert_kfx_without_plugin(mock_run_cmd, tmp_path):
+    kfx = tmp_path / "Dune.azw"
+    kfx.write_bytes(b"CONT\x02\x00" + b"\x00" * 64)
+    with mock.patch('calibre_api.app.calibre_cli.installed_plugin_names', return_value={"Kobo Utilities"}):
+        with pytest.raises(ConversionUnavailable, match="Conversion unavailable for KFX: Calibre needs the 'KFX Input' plugin"):
+            ebook_convert(str(kfx), str(tmp_path / "Converted.epub"))
+        epub = tmp_path / "Dune.epub"
+        epub.write_bytes(b"epub")
+        with pytest.raises(ConversionUnavailable, match="'KFX Output' plugin to write KFX files"):
+            ebook_convert(str(epub), str(tmp_path / "Dune.kfx"))
+    mock_run_cmd.assert_not_called()
+
+
+@mock.patch('calibre_api.app.calibre_cli.run_calibre_command')
+def test_ebook_convert_kfx_with_plugin_uses_kfx_extension(mock_run_cmd, tmp_path):
+    kfx = tmp_path / "Dune.azw"
+    kfx.write_bytes(b"CONT\x02\x00" + b"\x00" * 64)
+    output = tmp_path / "Dune.epub"
+
+    def convert(command, timeout):
+        assert command[1].endswith("Dune.kfx") and os.path.realpath(command[1]) == str(kfx)
+        output.write_text("epub")
+        return "", "", 0
+    mock_run_cmd.side_effect = convert
+    with mock.patch('calibre_api.app.calibre_cli.installed_plugin_names', return_value={"KFX Input"}):
+        assert ebook_convert(str(kfx), str(output)) == str(output)
+    # The temporary .kfx link is gone afterwards.
+    assert not os.path.exists(mock_run_cmd.call_args[0][0][1])
+
+
+def test_installed_plugin_names_is_cached():
+    with mock.patch.dict(calibre_cli._plugin_cache, {"checked_at": None, "names": set()}):
+        with mock.patch('calibre_api.app.calibre_cli.list_calibre_plugins', return_value={"KFX Input": {}}) as mock_list:
+            assert calibre_cli.installed_plugin_names() == {"KFX Input"}
+            assert calibre_cli.installed_plugin_names() == {"KFX Input"}
+        assert mock_list.call_count == 1
+
+
 @mock.patch('os.path.exists', return_value=False)
 def test_ebook_convert_input_not_found(mock_os_exists):
     with pytest.raises(FileNotFoundError, match="Input file not found: input.epub"):
@@ -442,6 +495,45 @@ def test_web2disk_invalid_recipe_filename():
     with pytest.raises(ValueError, match="output_recipe_file must end with '.recipe'"):
         web2disk("http://example.com", "out.txt")
 
+@mock.patch('calibre_api.app.calibre_cli.run_calibre_command')
+@mock.patch('os.path.exists', side_effect=lambda p: True)
+def test_fetch_news_recipe_builtin(mock_os_exists, mock_run_cmd):
+    mock_run_cmd.return_value = ("", "", 0)
+    result = fetch_news_recipe("The Guardian", "out.epub")
+    assert result == "out.epub"
+    mock_run_cmd.assert_called_once_with(['ebook-convert', 'The Guardian.recipe', 'out.epub'], timeout=1800)
+
+@mock.patch('calibre_api.app.calibre_cli.run_calibre_command')
+@mock.patch('os.path.exists', side_effect=lambda p: False)
+def test_fetch_news_recipe_no_output(mock_os_exists, mock_run_cmd):
+    mock_run_cmd.return_value = ("", "", 0)
+    with pytest.raises(CalibreCLIError, match="was not created"):
+        fetch_news_recipe("/tmp/feed.recipe", "out.epub")
+    assert mock_run_cmd.call_args.args[0][1] == "/tmp/feed.recipe"
+
+def test_command_line_redacts_secret_options():
+    assert calibre_cli.command_line(["calibre-smtp", "--username", "me", "--password", "s3cret", "to@example.org"]) == \
+        "calibre-smtp --username me --password *** to@example.org"
+    assert calibre_cli.command_line(["ebook-convert", "feed.recipe", "out.epub", "--password=s3cret"]) == \
+        "ebook-convert feed.recipe out.epub --password=***"
+
+
+@mock.patch('calibre_api.app.calibre_cli.subprocess.run')
+def test_run_calibre_command_does_not_log_passwords(mock_run):
+    mock_run.return_value = mock.Mock(returncode=1, stdout="", stderr="boom")
+    with mock.patch.object(calibre_cli, "logger") as mock_logger:
+        run_calibre_command(["calibre-smtp", "--password", "s3cret", "to@example.org"])
+    logged = " ".join(str(c) for c in mock_logger.mock_calls)
+    assert "s3cret" not in logged
+    assert "--password ***" in logged
+
+
+@mock.patch('calibre_api.app.calibre_cli.run_calibre_command')
+def test_fetch_news_recipe_rejects_option_like_recipe(mock_run_cmd):
+    with pytest.raises(ValueError):
+        fetch_news_recipe("--output-profile=kindle", "out.epub")
+    mock_run_cmd.assert_not_called()
+
 # Example for LRF converters (lrf2lrs, lrs2lrf)
 @mock.patch('calibre_api.app.calibre_cli.run_calibre_command')
 @mock.patch('os.path.exists', side_effect=lambda p: True)
@@ -458,3 +550,108 @@ def test_lrs2lrf_success(mock_os_exists, mock_run_cmd):
     result = lrs2lrf("in.lrs", "out.lrf")
     assert result == "out.lrf"
     mock_run_cmd.assert_called_once_with(['lrs2lrf', 'in.lrs', 'out.lrf'], timeout=120)
+
+
+# --- Tests for timeouts, concurrency, cancellation and binary discovery ---
+
+def test_parse_timeouts():
+    assert calibre_cli.parse_timeouts(" ebook-convert=900, calibredb=120 ") == {"ebook-convert": 900.0, "calibredb": 120.0}
+    assert calibre_cli.parse_timeouts(None) == {}
+    for value in ["ebook-convert", "ebook-convert=0", "=10", "calibredb=soon"]:
+        with pytest.raises(ValueError):
+            calibre_cli.parse_timeouts(value)
+
+
+@mock.patch('subprocess.run', return_value=mock_completed_process())
+def test_run_calibre_command_uses_configured_timeout(mock_subproc_run):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_CLI_TIMEOUTS": "ebook-convert=900"}):
+        run_calibre_command(['ebook-convert', 'a.epub', 'b.mobi'], timeout=300)
+        run_calibre_command(['calibredb', 'list'], timeout=60)
+    assert [c.kwargs["timeout"] for c in mock_subproc_run.call_args_list] == [900.0, 60]
+
+
+@mock.patch('subprocess.run', side_effect=FileNotFoundError("No such file"))
+def test_run_calibre_command_binary_missing_is_structured(mock_subproc_run):
+    with pytest.raises(calibre_cli.CalibreBinaryMissing) as excinfo:
+        run_calibre_command(['ebook-meta', 'book.epub'])
+    assert isinstance(excinfo.value, FileNotFoundError)
+    assert excinfo.value.executable == "ebook-meta"
+
+
+def test_cancelled_command_is_killed():
+    import sys
+    import threading
+    import time
+    cancel = threading.Event()
+    threading.Timer(0.3, cancel.set).start()
+    started = time.monotonic()
+    with pytest.raises(calibre_cli.CommandCancelled):
+        run_calibre_command([sys.executable, "-c", "import time; time.sleep(30)"], timeout=30, cancel=cancel)
+    assert time.monotonic() - started < 10
+
+
+def test_cancellable_command_times_out():
+    import sys
+    import threading
+    with pytest.raises(calibre_cli.CalibreTimeout):
+        run_calibre_command([sys.executable, "-c", "import time; time.sleep(30)"], timeout=0.5, cancel=threading.Event())
+
+
+def test_command_slots_limit_concurrency():
+    import threading
+    cancel = threading.Event()
+    cancel.set()
+    with mock.patch.dict(os.environ, {"SHELFSTONE_CLI_MAX_CONCURRENT": "1"}):
+        with calibre_cli._command_slot("calibredb", None):
+            # The only slot is taken: waiting gives up once cancelled.
+            with pytest.raises(calibre_cli.CommandCancelled):
+                with calibre_cli._command_slot("ebook-convert", cancel):
+                    pass
+        with calibre_cli._command_slot("ebook-convert", cancel):
+            pass
+
+
+def test_command_slots_go_by_priority():
+    import threading
+    import time
+    from calibre_api.app import lifecycle
+    order = []
+
+    def run(priority):
+        with calibre_cli._command_slot("calibredb", None, priority):
+            order.append(priority)
+
+    def start(priority):
+        waiting = len(calibre_cli._slots["waiting"])
+        thread = threading.Thread(target=run, args=(priority,))
+        thread.start()
+        while len(calibre_cli._slots["waiting"]) == waiting:
+            time.sleep(0.01)
+        return thread
+
+    def queue(pause):
+        with calibre_cli._command_slot("calibredb", None):
+            threads = [start(lifecycle.BULK)]
+            time.sleep(pause)
+            threads.append(start(lifecycle.INTERACTIVE))
+        for thread in threads:
+            thread.join(5)
+
+    with mock.patch.dict(os.environ, {"SHELFSTONE_CLI_MAX_CONCURRENT": "1"}):
+        queue(0)
+        # Bulk work that waited long enough goes first.
+        with mock.patch.dict(os.environ, {"SHELFSTONE_CLI_AGING_SECONDS": "0.05"}):
+            queue(0.2)
+    assert order == ["interactive", "bulk", "bulk", "interactive"]
+
+
+def test_resolve_executable_searches_default_install_locations(tmp_path):
+    tool = tmp_path / "ebook-convert"
+    tool.write_text("#!/bin/sh\n")
+    tool.chmod(0o755)
+    with mock.patch.dict(os.environ, {}, clear=True), mock.patch.object(calibre_cli.shutil, "which", return_value=None), \
+            mock.patch.object(calibre_cli, "DEFAULT_BIN_DIRS", [str(tmp_path / "missing"), str(tmp_path)]):
+        assert calibre_cli.resolve_executable("ebook-convert") == str(tool)
+        assert calibre_cli.resolve_executable("ebook-meta") == "ebook-meta"
+    with mock.patch.object(calibre_cli.shutil, "which", return_value="/usr/bin/ebook-convert"):
+        assert calibre_cli.resolve_executable("ebook-convert") == "ebook-convert"
@@ -0,0 +1,74 @@
+import pytest
+from unittest import mock
+
+from calibre_api.app import cards
+from calibre_api.app.cards import plain_blurb, render_book_card_html, cover_data_uri
+
+
+BOOK = {
+    "id": 1,
+    "title": "Dune <Special> Edition",
+    "authors": ["Frank Herbert"],
+    "series": "Dune",
+    "series_index": 1.0,
+    "comments": "<div><p>Set on the desert planet <b>Arrakis</b>&hellip;</p></div>",
+}
+
+
+def test_plain_blurb_strips_html():
+    assert plain_blurb(BOOK["comments"]) == "Set on the desert planet Arrakis…"
+    assert plain_blurb(None) == ""
+
+
+def test_plain_blurb_truncates_at_word_boundary():
+    blurb = plain_blurb("word " * 100, max_chars=22)
+    assert blurb == "word word word word…"
+
+
+def test_render_card_escapes_and_includes_fields():
+    page = render_book_card_html(BOOK, cover_uri="data:image/jpeg;base64,AAAA", accent_color="#112233")
+    assert "Dune &lt;Special&gt; Edition" in page
+    assert "<Special>" not in page
+    assert "Frank Herbert" in page
+    assert "Dune #1" in page
+    assert '<img src="data:image/jpeg;base64,AAAA"' in page
+    assert "border-left:4px solid #112233" in page
+    assert '<meta property="og:title" content="Dune &lt;Special&gt; Edition">' in page
+    assert '<meta property="og:description" content="Set on the desert planet Arrakis…">' in page
+
+
+def test_render_card_without_cover():
+    page = render_book_card_html({"id": 2, "title": "Plain", "authors": "A & B"})
+    assert "<img" not in page
+    assert "A, B" in page
+    assert cards.DEFAULT_ACCENT_COLOR in page
+
+
+def test_cover_data_uri_missing_file(tmp_path):
+    assert cover_data_uri(None) is None
+    assert cover_data_uri(str(tmp_path / "cover.jpg")) is None
+
+
+def test_cover_data_uri_without_pillow(tmp_path):
+    cover = tmp_path / "cover.png"
+    cover.write_bytes(b"\x89PNG fake")
+    with mock.patch.dict("sys.modules", {"PIL": None}):
+        assert cover_data_uri(str(cover)) == "data:image/png;base64,iVBORyBmYWtl"
+
+
+def test_plain_blurb_cuts_text_without_spaces():
+    text = "汪淼觉得，来找他的这几个人是一个奇怪的组合。" * 3
+    assert plain_blurb(text, max_chars=10) == "汪淼觉得，来找他的这…"
+    assert plain_blurb("三体 " + "地球往事" * 10, max_chars=20) == "三体 地球往事地球往事地球往事地球往事地…"
+
+
+def test_plain_blurb_keeps_arabic_vowel_marks_together():
+    # "مُحَمَّد": the cut at 3 would fall between a letter and its vowel marks.
+    blurb = plain_blurb("مُحَمَّد شكري كاتب مغربي", max_chars=3)
+    assert blurb == "مُ…"
+
+
+def test_render_card_marks_text_direction():
+    page = render_book_card_html({"title": "الخبز الحافي", "authors": ["محمد شكري"], "comments": "<p>سيرة ذاتية</p>"})
+    assert '<h1 dir="auto"' in page
+    assert '<p dir="auto" style="margin:0;font-size:14px;line-height:1.4;color:#333333;">سيرة ذاتية</p>' in page
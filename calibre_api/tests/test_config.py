@@ -0,0 +1,85 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import config
+
+
+def write_config(tmp_path, text):
+    path = tmp_path / "shelfstone.toml"
+    path.write_text(text)
+    return {"SHELFSTONE_CONFIG": str(path)}
+
+
+def test_file_key():
+    assert config.file_key("SHELFSTONE_LOG_LEVEL") == "log_level"
+    assert config.file_key("CALIBRE_LIBRARY_PATH") == "calibre_library_path"
+
+
+def test_load_applies_file_below_environment(tmp_path):
+    environ = write_config(tmp_path, 'port = 8080\nlog_level = "debug"\nenable_sql_query = true\n')
+    environ["SHELFSTONE_PORT"] = "9000"
+    assert config.load(environ) == str(tmp_path / "shelfstone.toml")
+    assert environ["SHELFSTONE_PORT"] == "9000"
+    assert environ["SHELFSTONE_LOG_LEVEL"] == "debug"
+    assert environ["SHELFSTONE_ENABLE_SQL_QUERY"] == "1"
+    assert config.get("SHELFSTONE_LOG_LEVEL", environ) == "debug"
+    assert config.get("SHELFSTONE_HOST", environ) == "0.0.0.0"
+
+
+def test_load_without_file():
+    with mock.patch.object(config, "DEFAULT_PATHS", []):
+        environ = {}
+        assert config.load(environ) is None
+        assert environ == {}
+
+
+@pytest.mark.parametrize("text, message", [
+    ("port = ", "Invalid TOML"),
+    ("prot = 8080\n", "Unknown setting(s)"),
+    ("body_limits_mb = ['/uploads/=5']\n", "must be a single value"),
+])
+def test_read_config_file_errors(tmp_path, text, message):
+    environ = write_config(tmp_path, text)
+    with pytest.raises(config.ConfigError, match=message.replace("(", r"\(").replace(")", r"\)")):
+        config.load(environ)
+
+
+def test_load_rejects_invalid_values(tmp_path):
+    environ = write_config(tmp_path, 'port = 70000\nlog_level = "loud"\n')
+    environ["SHELFSTONE_CALIBRE_BIN_DIR"] = str(tmp_path / "missing")
+    with pytest.raises(config.ConfigError) as e:
+        config.load(environ)
+    for variable in ("SHELFSTONE_PORT", "SHELFSTONE_LOG_LEVEL", "SHELFSTONE_CALIBRE_BIN_DIR"):
+        assert variable in e.value.args[0]
+
+
+def test_validate_ignores_empty_values():
+    assert config.validate({"SHELFSTONE_PORT": "", "SHELFSTONE_MAX_BODY_MB": "100"}) == {}
+
+
+def test_reload_applies_changed_file_values(tmp_path):
+    environ = write_config(tmp_path, 'log_level = "info"\nport = 8080\nloan_days = 14\n')
+    environ["SHELFSTONE_LOAN_DAYS"] = "21"  # Set in the environment; the file can't override it.
+    config.load(environ)
+    (tmp_path / "shelfstone.toml").write_text('log_level = "debug"\nport = 9090\nloan_days = 7\n')
+    with mock.patch.object(config, "_apply_log_level") as apply_log_level:
+        result = config.reload(environ)
+    assert result == {"path": str(tmp_path / "shelfstone.toml"), "changed": ["SHELFSTONE_LOG_LEVEL", "SHELFSTONE_PORT"],
+                      "restart_required": ["SHELFSTONE_PORT"]}
+    assert (environ["SHELFSTONE_LOG_LEVEL"], environ["SHELFSTONE_PORT"], environ["SHELFSTONE_LOAN_DAYS"]) == ("debug", "9090", "21")
+    apply_log_level.assert_called_once_with("debug")
+
+    # Settings removed from the file go back to their defaults.
+    (tmp_path / "shelfstone.toml").write_text('log_level = "debug"\n')
+    assert config.reload(environ)["changed"] == ["SHELFSTONE_PORT"]
+    assert "SHELFSTONE_PORT" not in environ
+
+
+def test_reload_keeps_settings_when_file_is_invalid(tmp_path):
+    environ = write_config(tmp_path, 'log_level = "info"\n')
+    config.load(environ)
+    (tmp_path / "shelfstone.toml").write_text('log_level = "loud"\n')
+    with pytest.raises(config.ConfigError):
+        config.reload(environ)
+    assert environ["SHELFSTONE_LOG_LEVEL"] == "info"
@@ -0,0 +1,76 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import conversion_cache
+from calibre_api.app.calibre_cli import CalibreCLIError
+
+
+@pytest.fixture
+def cache(tmp_path):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_CONVERSION_CACHE": str(tmp_path / "cache")}):
+        yield tmp_path / "cache"
+
+
+def fake_convert(source, target):
+    with open(target, "w") as f:
+        f.write(f"converted {os.path.basename(source)}")
+
+
+def test_book_formats_and_pick_source():
+    book = {"formats": ["/lib/A/B/b.pdf", "/lib/A/B/b.mobi", "relative.epub"]}
+    formats = conversion_cache.book_formats(book)
+    assert formats == {"PDF": "/lib/A/B/b.pdf", "MOBI": "/lib/A/B/b.mobi"}
+    assert conversion_cache.pick_source(formats) == "/lib/A/B/b.mobi"
+    assert conversion_cache.pick_source({"CBZ": "/lib/c.cbz"}) == "/lib/c.cbz"
+    assert conversion_cache.pick_source({}) is None
+
+
+def test_get_or_convert_caches_result(cache, tmp_path):
+    source = tmp_path / "book.epub"
+    source.write_text("epub")
+    convert = mock.Mock(side_effect=fake_convert)
+
+    first = conversion_cache.get_or_convert(3, str(source), "azw3", convert=convert)
+    second = conversion_cache.get_or_convert(3, str(source), "AZW3", convert=convert)
+
+    assert first == {"path": second["path"], "cached": False}
+    assert second["cached"] is True
+    assert convert.call_count == 1
+    assert os.path.dirname(first["path"]) == str(cache)
+    assert first["path"].endswith(".azw3")
+
+    # A changed source file is converted again.
+    source.write_text("epub, second edition")
+    assert conversion_cache.get_or_convert(3, str(source), "azw3", convert=convert)["cached"] is False
+
+
+def test_get_or_convert_leaves_no_partial_file(cache, tmp_path):
+    source = tmp_path / "book.epub"
+    source.write_text("epub")
+    convert = mock.Mock(side_effect=CalibreCLIError("conversion failed"))
+    with pytest.raises(CalibreCLIError):
+        conversion_cache.get_or_convert(3, str(source), "pdf", convert=convert)
+    assert os.listdir(cache) == []
+
+
+def test_get_or_convert_rejects_unknown_format(cache, tmp_path):
+    source = tmp_path / "book.epub"
+    source.write_text("epub")
+    with pytest.raises(ValueError):
+        conversion_cache.get_or_convert(3, str(source), "exe", convert=fake_convert)
+
+
+def test_remove_book_entries(cache):
+    cache.mkdir()
+    for name in ("3_abc.epub", "3_def.azw3", "33_abc.epub"):
+        (cache / name).write_text("x")
+    assert conversion_cache.remove_book_entries(3) == 2
+    assert os.listdir(cache) == ["33_abc.epub"]
+    assert conversion_cache.remove_book_entries(7) == 0
+
+
+def test_cache_defaults_to_the_state_dir(tmp_path):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_STATE_DIR": str(tmp_path)}):
+        os.environ.pop("SHELFSTONE_CONVERSION_CACHE", None)
+        assert conversion_cache.cache_dir() == str(tmp_path / "conversions")
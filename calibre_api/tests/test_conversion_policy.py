@@ -0,0 +1,79 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import conversion_policy, notifications
+from calibre_api.app.calibre_cli import CalibreCLIError
+
+
+@pytest.fixture(autouse=True)
+def clean_jobs():
+    conversion_policy.reset()
+    yield
+    conversion_policy.reset()
+
+
+def test_parse_formats():
+    assert conversion_policy.parse_formats(" epub, .AZW3,epub ") == ["EPUB", "AZW3"]
+    assert conversion_policy.parse_formats(None) == []
+    with pytest.raises(ValueError):
+        conversion_policy.parse_formats("epub,djvu")
+
+
+def test_enqueue_follows_policy_and_feature_flag(tmp_path):
+    env = {"SHELFSTONE_SETTINGS_DB": str(tmp_path / "settings.db"), "SHELFSTONE_CONVERT_ON_ADD": "epub,azw3"}
+    with mock.patch.dict(os.environ, env), \
+         mock.patch.object(conversion_policy, "threading") as mock_threading, \
+         mock.patch.object(conversion_policy, "_queue") as mock_queue:
+        jobs = conversion_policy.enqueue([4, 5], library_path="/lib")
+        assert [(j["book_id"], j["status"], [f["format"] for f in j["formats"]]) for j in jobs] == [
+            (4, "queued", ["EPUB", "AZW3"]), (5, "queued", ["EPUB", "AZW3"])]
+        assert mock_queue.put.call_count == 2
+        mock_threading.Thread.return_value.start.assert_called_once()
+        assert conversion_policy.enqueue([4]) == []  # Already queued.
+
+        os.environ["SHELFSTONE_FEATURES"] = "conversion=off"
+        assert conversion_policy.enqueue([6]) == []
+        os.environ["SHELFSTONE_FEATURES"] = ""
+        os.environ["SHELFSTONE_CONVERT_ON_ADD"] = ""
+        assert conversion_policy.enqueue([6]) == []
+    assert [j["book_id"] for j in conversion_policy.recent_jobs()] == [5, 4]
+
+
+def test_run_job_converts_missing_formats(tmp_path):
+    epub = tmp_path / "Dune.epub"
+    epub.write_bytes(b"epub")
+    job = {"book_id": 3, "library_path": "/lib", "status": "queued", "error": None, "created_at": 0.0,
+           "started_at": None, "finished_at": None,
+           "formats": [{"format": f, "status": "pending", "error": None} for f in ("EPUB", "AZW3", "PDF")]}
+    convert = mock.Mock(side_effect=[{"path": "/cache/3.azw3"}, CalibreCLIError("ebook-convert failed.")])
+    add = mock.Mock()
+    with mock.patch.object(conversion_policy, "list_books", return_value=[{"id": 3, "formats": [str(epub)]}]):
+        conversion_policy.run_job(job, convert=convert, add=add)
+    assert [(f["format"], f["status"]) for f in job["formats"]] == [("EPUB", "skipped"), ("AZW3", "converted"), ("PDF", "failed")]
+    assert job["formats"][2]["error"] == "ebook-convert failed."
+    assert job["status"] == "failed" and job["finished_at"] is not None
+    convert.assert_any_call(3, str(epub), "AZW3")
+    add.assert_called_once_with(3, "/cache/3.azw3", library_path="/lib")
+
+
+def test_run_job_book_without_files():
+    job = {"book_id": 3, "library_path": None, "status": "queued", "error": None, "formats": []}
+    with mock.patch.object(conversion_policy, "list_books", return_value=[{"id": 3, "formats": []}]):
+        conversion_policy.run_job(job, convert=mock.Mock(), add=mock.Mock())
+    assert job["status"] == "failed" and job["error"] == "Book ID 3 has no files."
+
+
+def test_run_job_notifies_the_user(tmp_path):
+    epub = tmp_path / "Dune.epub"
+    epub.write_bytes(b"epub")
+    job = {"book_id": 3, "library_path": None, "user_id": 7, "status": "queued", "error": None,
+           "formats": [{"format": "AZW3", "status": "pending", "error": None}]}
+    with mock.patch.object(conversion_policy, "list_books", return_value=[{"id": 3, "title": "Dune", "formats": [str(epub)]}]):
+        conversion_policy.run_job(job, convert=mock.Mock(return_value={"path": "/cache/3.azw3"}), add=mock.Mock())
+        job.update(status="queued", formats=[{"format": "PDF", "status": "pending", "error": None}])
+        conversion_policy.run_job(job, convert=mock.Mock(side_effect=CalibreCLIError("ebook-convert failed.")), add=mock.Mock())
+    failed, done = notifications.export_user(7)
+    assert (done["kind"], done["title"], done["book_id"]) == (notifications.CONVERSION_DONE, "Converted 'Dune' to AZW3", 3)
+    assert (failed["kind"], failed["title"], failed["body"]) == (
+        notifications.CONVERSION_FAILED, "Converting 'Dune' failed", "PDF: ebook-convert failed.")
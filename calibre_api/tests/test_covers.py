@@ -0,0 +1,88 @@
+import pytest
+from unittest import mock
+
+from calibre_api.app import covers
+from calibre_api.app.covers import extract_palette, try_extract_palette
+
+PIL = pytest.importorskip("PIL")
+from PIL import Image
+
+
+@pytest.fixture(autouse=True)
+def clear_palette_cache():
+    covers._palette_cache.clear()
+    yield
+    covers._palette_cache.clear()
+
+
+def make_two_tone_cover(path, dominant=(200, 10, 10), accent=(10, 10, 200)):
+    # 3/4 of the image is the dominant color, the bottom quarter is the accent.
+    img = Image.new("RGB", (40, 40), dominant)
+    for x in range(40):
+        for y in range(30, 40):
+            img.putpixel((x, y), accent)
+    img.save(path, "JPEG", quality=100)
+
+
+def test_extract_palette_orders_by_dominance(tmp_path):
+    cover_path = tmp_path / "cover.jpg"
+    make_two_tone_cover(cover_path)
+
+    palette = extract_palette(str(cover_path), colors=2)
+    assert len(palette) == 2
+    assert all(c.startswith("#") and len(c) == 7 for c in palette)
+    # The dominant color should be reddish, the second bluish (JPEG makes exact values fuzzy).
+    r, g, b = (int(palette[0][i:i + 2], 16) for i in (1, 3, 5))
+    assert r > b
+    r, g, b = (int(palette[1][i:i + 2], 16) for i in (1, 3, 5))
+    assert b > r
+
+
+def test_extract_palette_uses_cache(tmp_path):
+    cover_path = tmp_path / "cover.jpg"
+    make_two_tone_cover(cover_path)
+
+    first = extract_palette(str(cover_path))
+    with mock.patch("PIL.Image.open") as mock_open:
+        second = extract_palette(str(cover_path))
+        mock_open.assert_not_called()
+    assert first == second
+
+
+def test_palette_cache_is_bounded(tmp_path):
+    paths = []
+    for n in range(3):
+        paths.append(str(tmp_path / f"cover{n}.jpg"))
+        make_two_tone_cover(paths[-1])
+    with mock.patch.object(covers, "PALETTE_CACHE_SIZE", 2):
+        extract_palette(paths[0])
+        extract_palette(paths[1])
+        extract_palette(paths[0])
+        extract_palette(paths[2])
+    # The least recently used cover was dropped.
+    assert sorted(key[0] for key in covers._palette_cache) == [paths[0], paths[2]]
+
+
+def test_extract_palette_missing_file():
+    with pytest.raises(FileNotFoundError):
+        extract_palette("/nonexistent/cover.jpg")
+
+
+def test_extract_palette_invalid_color_count(tmp_path):
+    with pytest.raises(ValueError):
+        extract_palette(str(tmp_path / "cover.jpg"), colors=0)
+
+
+def test_extract_palette_undecodable_image(tmp_path):
+    cover_path = tmp_path / "cover.jpg"
+    cover_path.write_bytes(b"not an image")
+    with pytest.raises(ValueError):
+        extract_palette(str(cover_path))
+
+
+def test_try_extract_palette_returns_none_on_errors(tmp_path):
+    assert try_extract_palette(None) is None
+    assert try_extract_palette("/nonexistent/cover.jpg") is None
+    bad = tmp_path / "bad.jpg"
+    bad.write_bytes(b"garbage")
+    assert try_extract_palette(str(bad)) is None
@@ -0,0 +1,75 @@
+import pytest
+from datetime import date, datetime
+from unittest import mock
+
+from calibre_api.app import custom_fields
+from calibre_api.app.custom_fields import CustomColumn
+
+COLUMNS = [
+    CustomColumn("physical", "Physical copy", "bool"),
+    CustomColumn("price", "Price", "float"),
+    CustomColumn("bought", "Bought", "datetime"),
+    CustomColumn("condition", "Condition", "enumeration", ["Good", "Poor"]),
+]
+BY_LABEL = {c.label: c for c in COLUMNS}
+
+
+@pytest.mark.parametrize("label,value,expected", [
+    ("physical", True, "true"),
+    ("physical", False, "false"),
+    ("physical", None, ""),
+    ("price", 12, "12.0"),
+    ("bought", date(2024, 5, 1), "2024-05-01T12:00:00+00:00"),
+    ("bought", datetime(2024, 5, 1, 23, 30), "2024-05-01T12:00:00+00:00"),
+    ("bought", "2024-05-01", "2024-05-01T12:00:00+00:00"),
+    ("condition", "Good", "Good"),
+])
+def test_format_value(label, value, expected):
+    assert custom_fields.format_value(BY_LABEL[label], value) == expected
+
+
+def test_format_value_rejects_unknown_enum_value():
+    with pytest.raises(ValueError):
+        custom_fields.format_value(BY_LABEL["condition"], "Mint")
+
+
+def test_display_options():
+    assert BY_LABEL["condition"].display == {"enum_values": ["Good", "Poor"], "enum_colors": []}
+    assert BY_LABEL["physical"].display is None
+
+
+@mock.patch("calibre_api.app.custom_fields.add_custom_column")
+@mock.patch("calibre_api.app.custom_fields.list_custom_columns", return_value={"physical": 1})
+def test_ensure_columns_creates_missing(mock_list, mock_add):
+    assert custom_fields.ensure_columns(COLUMNS[:2], library_path="/lib") == ["price"]
+    mock_add.assert_called_once_with("price", "Price", "float", library_path="/lib", display=None)
+
+
+@mock.patch("calibre_api.app.custom_fields.set_custom_field")
+@mock.patch("calibre_api.app.custom_fields.ensure_columns")
+def test_set_values(mock_ensure, mock_set):
+    custom_fields.set_values(3, COLUMNS, {"physical": True, "price": 9.5}, library_path="/lib")
+    mock_ensure.assert_called_once_with(COLUMNS, library_path="/lib")
+    assert mock_set.call_args_list == [
+        mock.call(3, "physical", "true", library_path="/lib"),
+        mock.call(3, "price", "9.5", library_path="/lib"),
+    ]
+
+
+@mock.patch("calibre_api.app.custom_fields.set_custom_field")
+@mock.patch("calibre_api.app.custom_fields.ensure_columns")
+def test_set_values_validates_before_writing(mock_ensure, mock_set):
+    with pytest.raises(ValueError):
+        custom_fields.set_values(3, COLUMNS, {"physical": True, "condition": "Mint"})
+    with pytest.raises(ValueError):
+        custom_fields.set_values(3, COLUMNS, {"colour": "red"})
+    mock_ensure.assert_not_called()
+    mock_set.assert_not_called()
+
+
+def test_read_values():
+    book = {"*physical": True, "*price": 12.0, "*bought": "2024-05-01T12:00:00+00:00", "*condition": ""}
+    assert custom_fields.read_values(book, COLUMNS) == {
+        "physical": True, "price": 12.0, "bought": "2024-05-01", "condition": None,
+    }
+    assert custom_fields.read_values({}, COLUMNS[:1]) == {"physical": None}
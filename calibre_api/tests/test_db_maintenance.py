@@ -0,0 +1,52 @@
+import sqlite3
+import pytest
+
+from calibre_api.app import db_maintenance
+
+
+def make_library(path, auto_vacuum=0):
+    conn = sqlite3.connect(str(path / "metadata.db"))
+    conn.execute(f"PRAGMA auto_vacuum = {auto_vacuum}")
+    conn.execute("CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT)")
+    conn.execute("CREATE INDEX books_title ON books (title)")
+    conn.executemany("INSERT INTO books (title) VALUES (?)", [("x" * 500,) for _ in range(2000)])
+    conn.commit()
+    # Deleting most rows leaves free pages behind, as after a large import was undone.
+    conn.execute("DELETE FROM books WHERE id > 100")
+    conn.commit()
+    conn.close()
+
+
+def test_analyze_without_vacuum_keeps_size(tmp_path):
+    make_library(tmp_path)
+    result = db_maintenance.optimize_library_db(str(tmp_path))
+    assert result["actions"] == ["analyze"]
+    assert result["skipped"][0].startswith("incremental_vacuum")
+    assert result["before"]["free_pages"] > 0
+    assert result["after"]["page_count"] >= result["before"]["page_count"]
+    conn = sqlite3.connect(str(tmp_path / "metadata.db"))
+    assert conn.execute("SELECT count(*) FROM sqlite_stat1").fetchone()[0] > 0
+    conn.close()
+
+
+def test_full_vacuum_reports_freed_space(tmp_path):
+    make_library(tmp_path)
+    result = db_maintenance.optimize_library_db(str(tmp_path), analyze=False, vacuum=True)
+    assert result["actions"] == ["vacuum"]
+    assert result["after"]["free_pages"] == 0
+    assert result["freed_bytes"] > 0
+    assert result["freed_bytes"] == result["before"]["size_bytes"] - result["after"]["size_bytes"]
+
+
+def test_incremental_vacuum_when_supported(tmp_path):
+    make_library(tmp_path, auto_vacuum=2)
+    result = db_maintenance.optimize_library_db(str(tmp_path), analyze=False)
+    assert result["before"]["auto_vacuum"] == "incremental"
+    assert result["actions"] == ["incremental_vacuum"]
+    assert result["freed_bytes"] > 0
+
+
+def test_missing_library(tmp_path):
+    with pytest.raises(ValueError):
+        db_maintenance.optimize_library_db(str(tmp_path))
+    assert db_maintenance.main(["--library", str(tmp_path)]) == 1
@@ -0,0 +1,111 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import delivery, notifications
+
+SMTP_ENV = {
+    "SHELFSTONE_SMTP_HOST": "smtp.example.org",
+    "SHELFSTONE_SMTP_USERNAME": "me@example.org",
+    "SHELFSTONE_SMTP_PASSWORD": "secret",
+    "SHELFSTONE_SEND_DEVICES": "kindle=me_1234@kindle.com:azw3, pocketbook=me@pbsync.com",
+}
+
+
+@pytest.fixture(autouse=True)
+def clear_deliveries():
+    delivery.reset()
+    yield
+    delivery.reset()
+
+
+def test_parse_devices():
+    assert delivery.parse_devices(SMTP_ENV["SHELFSTONE_SEND_DEVICES"]) == {
+        "kindle": {"address": "me_1234@kindle.com", "format": "AZW3"},
+        "pocketbook": {"address": "me@pbsync.com", "format": "EPUB"},
+    }
+    assert delivery.parse_devices(None) == {}
+    with pytest.raises(ValueError):
+        delivery.parse_devices("kindle")
+    with pytest.raises(ValueError):
+        delivery.parse_devices("kindle=not-an-address")
+    with pytest.raises(ValueError):
+        delivery.parse_devices("kindle=me@kindle.com:cbz")
+
+
+def test_smtp_settings():
+    with mock.patch.dict(os.environ, SMTP_ENV, clear=True):
+        assert delivery.smtp_settings() == {
+            "smtp_server": "smtp.example.org", "smtp_port": 587, "smtp_username": "me@example.org",
+            "smtp_password": "secret", "smtp_encryption": "tls", "sender_email": "me@example.org",
+        }
+    with mock.patch.dict(os.environ, {}, clear=True):
+        with pytest.raises(delivery.SendingNotConfigured):
+            delivery.smtp_settings()
+
+
+def test_start_delivery_validates_device_and_format():
+    book = {"id": 3, "title": "Dune"}
+    with mock.patch.dict(os.environ, SMTP_ENV, clear=True), mock.patch.object(delivery.threading, "Thread") as mock_thread:
+        with pytest.raises(ValueError, match="Known devices: kindle, pocketbook"):
+            delivery.start_delivery(book, "kobo")
+        with pytest.raises(ValueError):
+            delivery.start_delivery(book, "kindle", "cbz")
+        record = delivery.start_delivery(book, "Kindle")
+    assert record["device"] == "kindle" and record["format"] == "AZW3" and record["status"] == delivery.QUEUED
+    mock_thread.return_value.start.assert_called_once()
+    assert delivery.get_delivery(record["id"]) == record
+    assert delivery.recent_deliveries() == [record]
+
+
+def _record(fmt="EPUB"):
+    return {"id": 1, "book_id": 3, "device": "kindle", "address": "me@kindle.com", "format": fmt,
+            "status": delivery.QUEUED, "error": None, "created_at": 0, "finished_at": None}
+
+
+def test_deliver_sends_existing_format(tmp_path):
+    book_file = tmp_path / "Dune.epub"
+    book_file.write_bytes(b"epub")
+    book = {"id": 3, "title": "Dune: Deluxe", "formats": [str(book_file)]}
+    sent = {}
+
+    def send(**kwargs):
+        sent.update(kwargs, data=open(kwargs["attachment_path"], "rb").read())
+        return True, "ok"
+
+    record = _record()
+    delivery.deliver(record, book, {"smtp_server": "smtp.example.org"}, send=send)
+    assert record["status"] == delivery.SENT and record["finished_at"]
+    assert sent["recipient_email"] == "me@kindle.com"
+    assert os.path.basename(sent["attachment_path"]) == "Dune_ Deluxe.epub"
+    assert sent["data"] == b"epub"
+    assert not os.path.exists(sent["attachment_path"])
+
+
+def test_deliver_converts_and_records_failure(tmp_path):
+    book_file = tmp_path / "Dune.epub"
+    book_file.write_bytes(b"epub")
+    converted = tmp_path / "converted.azw3"
+    converted.write_bytes(b"azw3")
+    book = {"id": 3, "title": "Dune", "formats": [str(book_file)]}
+
+    record = _record("AZW3")
+    with mock.patch.object(delivery.conversion_cache, "get_or_convert", return_value={"path": str(converted)}) as mock_convert:
+        delivery.deliver(record, book, {}, send=lambda **kwargs: (False, "Authentication failed: 535"))
+    mock_convert.assert_called_once_with(3, str(book_file), "AZW3")
+    assert record["status"] == delivery.FAILED
+    assert "SHELFSTONE_SMTP_PASSWORD" in record["error"]
+
+    record = _record()
+    delivery.deliver(record, {"id": 3, "formats": []}, {}, send=mock.Mock())
+    assert record["status"] == delivery.FAILED and record["error"] == "Book ID 3 has no files."
+
+
+def test_delivery_job_notifies_the_sender():
+    book = {"id": 3, "title": "Dune", "formats": []}
+    delivery._deliver_job(_record(), book, {}, user_id=7)
+    with mock.patch.object(delivery, "deliver", side_effect=lambda record, *args: record.update(status=delivery.SENT)):
+        delivery._deliver_job(_record(), book, {}, user_id=7)
+    sent, failed = notifications.export_user(7)
+    assert (sent["kind"], sent["title"]) == (notifications.DELIVERY_SENT, "Sent 'Dune' to kindle")
+    assert (failed["kind"], failed["body"]) == (notifications.DELIVERY_FAILED, "Book ID 3 has no files.")
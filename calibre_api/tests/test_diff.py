@@ -0,0 +1,69 @@
+import pytest
+from unittest import mock
+
+from calibre_api.app import diff
+from calibre_api.app.diff import diff_books, list_snapshot_books
+
+
+SNAPSHOT = [
+    {"id": 1, "uuid": "u1", "title": "Dune", "authors": ["Frank Herbert"], "tags": ["SF", "Classic"],
+     "formats": ["/tmp/scratch/Frank Herbert/Dune (1)/Dune.epub"], "series": None},
+    {"id": 2, "uuid": "u2", "title": "Gone Book", "authors": ["Someone"], "formats": []},
+    {"id": 3, "uuid": "u3", "title": "Unchanged", "authors": ["A"], "comments": ""},
+]
+CURRENT = [
+    {"id": 1, "uuid": "u1", "title": "Dune", "authors": ["Frank Herbert"], "tags": ["Classic", "SF"],
+     "formats": ["/library/Frank Herbert/Dune (1)/Dune.epub", "/library/Frank Herbert/Dune (1)/Dune.pdf"],
+     "series": "Dune Saga"},
+    {"id": 3, "uuid": "u3", "title": "Unchanged", "authors": ["A"], "comments": None},
+    {"id": 4, "uuid": "u4", "title": "New Book", "authors": ["B"]},
+]
+
+
+def test_diff_books():
+    result = diff_books(SNAPSHOT, CURRENT)
+
+    assert result["added"] == [{"id": 4, "title": "New Book", "authors": ["B"]}]
+    assert result["removed"] == [{"id": 2, "title": "Gone Book", "authors": ["Someone"]}]
+    assert len(result["changed"]) == 1
+    changes = result["changed"][0]["changes"]
+    # Tag order and format paths don't count as changes; series and the new PDF do.
+    assert changes == {
+        "series": {"before": None, "after": "Dune Saga"},
+        "formats": {"before": ["EPUB"], "after": ["EPUB", "PDF"]},
+    }
+
+
+def test_diff_books_matches_by_uuid_not_id():
+    snapshot = [{"id": 5, "uuid": "same", "title": "T"}]
+    current = [{"id": 9, "uuid": "same", "title": "T"}]
+    assert diff_books(snapshot, current) == {"added": [], "removed": [], "changed": []}
+
+
+@mock.patch.object(diff, 'list_books', return_value=[])
+def test_list_snapshot_books_uses_scratch_library(mock_list_books, tmp_path):
+    snapshot = tmp_path / "metadata.db"
+    snapshot.write_bytes(b"sqlite")
+
+    list_snapshot_books(str(snapshot))
+
+    scratch = mock_list_books.call_args[1]["library_path"]
+    assert scratch != str(tmp_path)
+    assert snapshot.read_bytes() == b"sqlite"
+
+
+def test_list_snapshot_books_missing_file():
+    with pytest.raises(ValueError):
+        list_snapshot_books("/nonexistent/metadata.db")
+
+
+@mock.patch.object(diff, 'list_snapshot_books', return_value=SNAPSHOT)
+@mock.patch.object(diff, 'list_books', return_value=CURRENT)
+def test_cli_summary(mock_list_books, mock_snapshot, capsys):
+    assert diff.main(["/backups/metadata.db", "--library", "/library"]) == 0
+    out = capsys.readouterr().out
+    assert "+ [4] New Book" in out
+    assert "- [2] Gone Book" in out
+    assert "~ [1] Dune" in out
+    assert "1 added, 1 removed, 1 changed." in out
+    mock_list_books.assert_called_once_with(library_path="/library")
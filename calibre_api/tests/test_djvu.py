@@ -0,0 +1,59 @@
+import os
+from unittest import mock
+
+import pytest
+
+from calibre_api.app.calibre_cli import CalibreCLIError
+from calibre_api.app.djvu import parse_meta, read_metadata, render_cover, is_djvu_path
+
+PRINT_META = '''title\t"Handbook of \\"Mathematical\\" Functions"
+author\t"Abramowitz, Milton; Stegun, Irene"
+publisher\t"Dover"
+year\t"1964"
+'''
+
+
+def test_parse_meta():
+    assert parse_meta(PRINT_META) == {
+        "title": 'Handbook of "Mathematical" Functions',
+        "authors": ["Abramowitz, Milton", "Stegun, Irene"],
+        "publisher": "Dover",
+        "pubdate": "1964",
+    }
+    assert parse_meta("") == {}
+
+
+@mock.patch("calibre_api.app.djvu.run_calibre_command")
+def test_read_metadata(mock_run):
+    mock_run.return_value = (PRINT_META, "", 0)
+    assert read_metadata("/books/scan.djvu")["publisher"] == "Dover"
+    assert mock_run.call_args[0][0] == ["djvused", "/books/scan.djvu", "-e", "print-meta"]
+
+    mock_run.return_value = ("", "not a DjVu file", 10)
+    with pytest.raises(CalibreCLIError):
+        read_metadata("/books/scan.djvu")
+
+
+@mock.patch("calibre_api.app.djvu.run_calibre_command")
+def test_render_cover(mock_run, tmp_path):
+    def ddjvu(command, timeout):
+        with open(command[-1], "wb") as f:
+            f.write(b"II*\x00")  # Not a full TIFF: converting it fails and the TIFF is used.
+        return "", "", 0
+    mock_run.side_effect = ddjvu
+
+    cover_path = render_cover("/books/scan.djvu", str(tmp_path))
+    assert os.path.dirname(cover_path) == str(tmp_path)
+    command = mock_run.call_args[0][0]
+    assert command[0] == "ddjvu" and "-page=1" in command and command[-2] == "/books/scan.djvu"
+
+
+@mock.patch("calibre_api.app.djvu.run_calibre_command", side_effect=FileNotFoundError("ddjvu not found"))
+def test_render_cover_without_ddjvu(mock_run, tmp_path):
+    assert render_cover("/books/scan.djvu", str(tmp_path)) is None
+
+
+def test_is_djvu_path():
+    assert is_djvu_path("scan.DJVU")
+    assert is_djvu_path("scan.djv")
+    assert not is_djvu_path("scan.pdf")
@@ -0,0 +1,119 @@
+import os
+import socket
+import sqlite3
+import pytest
+from unittest import mock
+
+from calibre_api.app import doctor
+from calibre_api.app.calibre_cli import CalibreCLIError
+
+
+def make_library(path):
+    conn = sqlite3.connect(str(path / "metadata.db"))
+    conn.execute("CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT)")
+    conn.commit()
+    conn.close()
+
+
+def statuses(results):
+    return {r["check"]: r["status"] for r in results}
+
+
+def test_check_binaries_required_and_optional():
+    with mock.patch("shutil.which", side_effect=lambda name: "/usr/bin/calibredb" if name == "calibredb" else None):
+        results = statuses(doctor.check_binaries())
+    assert results["binary:calibredb"] == doctor.OK
+    assert results["binary:ebook-convert"] == doctor.ERROR
+    assert results["binary:web2disk"] == doctor.WARNING
+
+
+def test_check_calibre_version():
+    with mock.patch.object(doctor.calibre_cli, "get_calibre_version", return_value="7.10.0"):
+        assert doctor.check_calibre_version()["detail"] == "7.10.0"
+    with mock.patch.object(doctor.calibre_cli, "get_calibre_version", side_effect=CalibreCLIError("boom")):
+        assert doctor.check_calibre_version()["status"] == doctor.WARNING
+
+
+def test_check_config_valid_and_invalid(tmp_path):
+    assert statuses(doctor.check_config({})) == {"config": doctor.OK}
+    results = statuses(doctor.check_config({
+        "SHELFSTONE_CLI_MAX_ATTEMPTS": "three",
+        "SHELFSTONE_TEMP_RETENTION_HOURS": "-1",
+        "SHELFSTONE_BODY_LIMITS_MB": "uploads=5",
+        "CALIBRE_LIBRARY_PATH": str(tmp_path),
+    }))
+    assert results == {
+        "config:SHELFSTONE_CLI_MAX_ATTEMPTS": doctor.ERROR,
+        "config:SHELFSTONE_TEMP_RETENTION_HOURS": doctor.ERROR,
+        "config:SHELFSTONE_BODY_LIMITS_MB": doctor.ERROR,
+        "config:CALIBRE_LIBRARY_PATH": doctor.ERROR,
+    }
+
+
+def test_check_library_integrity(tmp_path):
+    make_library(tmp_path)
+    assert doctor.check_library_integrity(str(tmp_path))["status"] == doctor.OK
+    assert doctor.check_library_integrity(str(tmp_path), quick=True)["detail"] == "PRAGMA quick_check: ok"
+
+
+def test_check_library_integrity_missing_or_corrupt(tmp_path):
+    assert doctor.check_library_integrity(str(tmp_path / "missing"))["status"] == doctor.ERROR
+    (tmp_path / "metadata.db").write_bytes(b"this is not a database" * 100)
+    result = doctor.check_library_integrity(str(tmp_path))
+    assert result["status"] == doctor.ERROR
+    assert result["fix"]
+
+
+def test_check_readiness(tmp_path):
+    make_library(tmp_path)
+    with mock.patch("shutil.which", return_value="/usr/bin/tool"):
+        results = statuses(doctor.check_readiness(str(tmp_path)))
+    assert results == {**{f"binary:{name}": doctor.OK for name in doctor.REQUIRED_BINARIES}, "library_db": doctor.OK}
+    with mock.patch("shutil.which", return_value=None), mock.patch.dict(os.environ, {"CALIBRE_LIBRARY_PATH": str(tmp_path / "missing")}):
+        results = statuses(doctor.check_readiness())
+    assert results["binary:calibredb"] == doctor.ERROR
+    assert results["library_db"] == doctor.ERROR
+
+
+def test_writable_dir_uses_existing_parent(tmp_path):
+    assert doctor._writable_dir_result("dir:x", str(tmp_path / "not" / "yet"), "fix")["status"] == doctor.OK
+
+
+def test_check_disk_space_threshold(tmp_path):
+    assert statuses(doctor.check_disk_space([str(tmp_path)], min_free_mb=0))[f"disk:{tmp_path}"] == doctor.OK
+    low = doctor.check_disk_space([str(tmp_path)], min_free_mb=10 ** 12)
+    assert low[0]["status"] == doctor.WARNING
+    # The same file system is only reported once.
+    assert len(doctor.check_disk_space([str(tmp_path), str(tmp_path)], min_free_mb=0)) == 1
+
+
+def test_check_port_in_use():
+    sock = socket.socket()
+    sock.bind(("127.0.0.1", 0))
+    sock.listen(1)
+    port = sock.getsockname()[1]
+    try:
+        result = doctor.check_port("127.0.0.1", port)
+    finally:
+        sock.close()
+    assert result["status"] == doctor.ERROR
+    assert "in use" in result["detail"]
+    assert doctor.check_port("127.0.0.1", port)["status"] == doctor.OK
+
+
+def test_main_exit_code(tmp_path):
+    make_library(tmp_path)
+    ok = [doctor._result("config", doctor.OK, "fine")]
+    with mock.patch.object(doctor, "run_checks", return_value=ok):
+        assert doctor.main(["--library", str(tmp_path), "--json"]) == 0
+    with mock.patch.object(doctor, "run_checks", return_value=ok + [doctor._result("port", doctor.ERROR, "busy", "fix")]):
+        assert doctor.main(["--skip-port"]) == 1
+
+
+def test_check_config_reports_file_errors(tmp_path):
+    path = tmp_path / "shelfstone.toml"
+    path.write_text("prot = 8080\n")
+    results = statuses(doctor.check_config({"SHELFSTONE_CONFIG": str(path)}))
+    assert results == {"config:file": doctor.ERROR}
+    path.write_text("port = 0\n")
+    assert statuses(doctor.check_config({"SHELFSTONE_CONFIG": str(path)})) == {"config:SHELFSTONE_PORT": doctor.ERROR}
@@ -0,0 +1,99 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, download_log
+from calibre_api.app.main import app
+
+ANA = {"id": 1, "username": "ana"}
+SAM = {"id": 2, "username": "sam"}
+
+
+@pytest.mark.parametrize("user_agent, client", [
+    ("KOReader/2024.11 (https://koreader.rocks/) LuaSocket/3.0", "KOReader"),
+    ("Mozilla/5.0 (Linux; U; Android 2.0; en-us;) AppleWebKit/538.1 (KHTML, like Gecko) Version/4.0 Mobile Safari/538.1 (Kobo Touch 0377/4.38.21908)", "Kobo"),
+    ("Mozilla/5.0 (X11; U; Linux armv7l like Android; en-us) AppleWebKit/531.2+ (KHTML, like Gecko) Version/5.0 Safari/533.2+ Kindle/3.0+", "Kindle"),
+    ("Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0", "browser"),
+    ("curl/8.5.0", "other"),
+    (None, "other"),
+])
+def test_classify_client(user_agent, client):
+    assert download_log.classify_client(user_agent) == client
+
+
+def test_user_history():
+    assert download_log.user_downloads(1) == {"total": 0, "downloads": []}
+    download_log.record({"id": 3, "title": "Dune"}, "epub", user=ANA, user_agent="KOReader/2024.11")
+    download_log.record({"id": 4, "title": "Emma"}, "azw3", user=ANA, converted=True)
+    download_log.record({"id": 3, "title": "Dune"}, "epub", user=SAM)
+    history = download_log.user_downloads(1, limit=1)
+    assert history["total"] == 2
+    assert [(d["title"], d["format"], d["converted"], d["client"]) for d in history["downloads"]] == [("Emma", "AZW3", True, "other")]
+    download_log.forget_user(1)
+    assert download_log.user_downloads(1)["total"] == 0
+    assert download_log.user_downloads(2)["total"] == 1
+
+
+def test_report():
+    download_log.record({"id": 3, "title": "Dune"}, "epub", user=ANA, user_agent="KOReader/2024.11")
+    download_log.record({"id": 3, "title": "Dune"}, "epub", user=SAM, user_agent="Kobo Touch")
+    download_log.record({"id": 4, "title": "Emma"}, "pdf", user=ANA, user_agent="Firefox Mozilla/5.0")
+    download_log.record({"id": 4, "title": "Emma"}, "pdf", user=ANA, library_path="/other")
+    report = download_log.report()
+    assert report["total"] == 3
+    assert report["users"] == [{"user_id": 1, "username": "ana", "count": 2}, {"user_id": 2, "username": "sam", "count": 1}]
+    assert {c["client"]: c["count"] for c in report["clients"]} == {"KOReader": 1, "Kobo": 1, "browser": 1}
+    assert report["formats"][0] == {"format": "EPUB", "count": 2}
+    assert report["books"][0] == {"book_id": 3, "title": "Dune", "count": 2}
+    assert download_log.report(since=download_log.time.time() + 1)["total"] == 0
+    assert download_log.report(library_path="/other")["total"] == 1
+
+
+def test_old_downloads_are_dropped(monkeypatch):
+    download_log.record({"id": 3, "title": "Dune"}, "epub", user=ANA)
+    later = download_log.time.time() + (download_log.RETENTION_DAYS + 1) * 86400
+    monkeypatch.setattr(download_log.time, "time", lambda: later)
+    download_log.record({"id": 4, "title": "Emma"}, "epub", user=ANA)
+    assert [d["book_id"] for d in download_log.user_downloads(1)["downloads"]] == [4]
+
+
+# --- Tests for GET /me/downloads and /admin/downloads/report ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def sign_in(username, role=accounts.USER):
+    user = accounts.create_user(username, "password1", role=role)
+    return {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+
+@patch('calibre_api.app.main.list_books')
+def test_downloads_are_logged_per_user(mock_list_books, client, tmp_path):
+    epub = tmp_path / "Dune.epub"
+    epub.write_bytes(b"epub data")
+    mock_list_books.return_value = [{"id": 3, "title": "Dune", "authors": ["Frank Herbert"], "formats": [str(epub)]}]
+    admin, ana = sign_in("root", role=accounts.ADMIN), sign_in("ana")
+
+    assert client.get("/books/3/download", headers={**ana, "User-Agent": "KOReader/2024.11"}).status_code == 200
+    history = client.get("/me/downloads", headers=ana).json()
+    assert history["total"] == 1
+    assert (history["downloads"][0]["title"], history["downloads"][0]["client"]) == ("Dune", "KOReader")
+    assert client.get("/me/downloads", headers=admin).json()["total"] == 0
+
+    assert client.get("/admin/downloads/report", headers=ana).status_code == 403
+    report = client.get("/admin/downloads/report", headers=admin).json()
+    assert [(u["username"], u["count"]) for u in report["users"]] == [("ana", 1)]
+
+
+@patch('calibre_api.app.main.list_books_by_ids', return_value=[{"id": 3, "title": "Dune"}])
+@patch('calibre_api.app.main.crud.export_book_file', return_value=b"epub data")
+def test_opds_downloads_are_logged(mock_export, mock_books, client):
+    ana = sign_in("ana")
+    assert client.get("/books/3/file/epub", headers={**ana, "User-Agent": "Kobo Touch"}).status_code == 200
+    downloads = client.get("/me/downloads", headers=ana).json()["downloads"]
+    assert [(d["title"], d["format"], d["client"]) for d in downloads] == [("Dune", "EPUB", "Kobo")]
@@ -0,0 +1,73 @@
+from unittest import mock
+
+from calibre_api.app import duplicates
+
+
+def test_file_hash_depends_on_content_only(tmp_path):
+    (tmp_path / "Dune.epub").write_bytes(b"epub bytes")
+    (tmp_path / "copy of dune.epub").write_bytes(b"epub bytes")
+    (tmp_path / "Messiah.epub").write_bytes(b"other bytes")
+    digest = duplicates.file_hash(str(tmp_path / "Dune.epub"))
+    assert len(digest) == duplicates.HASH_CHARS
+    assert duplicates.file_hash(str(tmp_path / "copy of dune.epub")) == digest
+    assert duplicates.file_hash(str(tmp_path / "Messiah.epub")) != digest
+
+
+def test_fingerprint_normalizes_title_and_authors():
+    key = duplicates.fingerprint("The Hobbit: or There and Back Again", "Tolkien, J.R.R.")
+    assert key == duplicates.fingerprint("Hobbit", ["J. R. R. Tolkien"])
+    assert duplicates.fingerprint("Les Misérables", "Victor Hugo") == duplicates.fingerprint("les miserables", "Hugo, Victor")
+    assert duplicates.fingerprint("Good Omens", "Terry Pratchett & Neil Gaiman") == duplicates.fingerprint("Good Omens", ["Neil Gaiman", "Terry Pratchett"])
+    assert duplicates.fingerprint("Dune", "Frank Herbert") != duplicates.fingerprint("Dune Messiah", "Frank Herbert")
+    assert duplicates.fingerprint("", "Frank Herbert") is None
+
+
+def test_find_by_hash_checks_exact_identifier():
+    books = [{"id": 1, "identifiers": {"import": "abc"}}, {"id": 2, "identifiers": {"import": "abcd"}}]
+    with mock.patch.object(duplicates, "list_books", return_value=books) as mock_list:
+        assert [b["id"] for b in duplicates.find_by_hash("abc", library_path="/lib")] == [1]
+    mock_list.assert_called_once_with(library_path="/lib", search_query='identifiers:"=import:=abc"')
+
+
+def test_find_duplicates_groups_by_hash_then_fingerprint():
+    books = [
+        {"id": 1, "title": "Dune", "authors": "Frank Herbert", "identifiers": {"import": "h1"}},
+        {"id": 2, "title": "dune (1965)", "authors": "Herbert, Frank", "identifiers": {"import": "h1"}},
+        {"id": 3, "title": "The Hobbit", "authors": "J.R.R. Tolkien", "identifiers": {}},
+        {"id": 4, "title": "Hobbit", "authors": "Tolkien, J. R. R.", "identifiers": {"isbn": "9780261102217"}},
+        {"id": 5, "title": "Dune Messiah", "authors": "Frank Herbert", "identifiers": {"import": "h2"}},
+    ]
+    groups = duplicates.find_duplicates(books)
+    assert [(g["reason"], [b["id"] for b in g["books"]]) for g in groups] == [
+        (duplicates.SAME_FILE, [1, 2]),
+        (duplicates.SAME_TITLE_AUTHOR, [3, 4]),
+    ]
+
+
+def test_find_format_target_skips_books_with_the_format():
+    books = [
+        {"id": 1, "title": "Dune Messiah", "authors": "Frank Herbert", "formats": ["/lib/1/Dune Messiah.mobi"]},
+        {"id": 2, "title": "Dune", "authors": "Frank Herbert", "formats": ["/lib/2/Dune.epub"]},
+        {"id": 3, "title": "Dune", "authors": "Frank Herbert", "formats": ["/lib/3/Dune.pdf"]},
+    ]
+    with mock.patch.object(duplicates, "list_books", return_value=books) as mock_list:
+        assert duplicates.find_format_target("The Dune: Deluxe", "Herbert, Frank", "mobi", library_path="/lib")["id"] == 2
+        assert duplicates.find_format_target("Dune", ["Frank Herbert"], "EPUB")["id"] == 3
+        assert duplicates.find_format_target("Dune", "Brian Herbert", "MOBI") is None
+    assert mock_list.call_args_list[0] == mock.call(library_path="/lib", search_query='title:"Dune"')
+
+
+def test_attach_as_format(tmp_path):
+    path = tmp_path / "dune.azw3"
+    path.write_bytes(b"azw3 bytes")
+    with mock.patch.object(duplicates.metadata, "read_file_metadata", return_value={"title": "Dune", "authors": ["Frank Herbert"]}), \
+         mock.patch.object(duplicates, "find_format_target", return_value={"id": 2}) as mock_find, \
+         mock.patch.object(duplicates, "add_format") as mock_add_format:
+        assert duplicates.attach_as_format(str(path), library_path="/lib") == 2
+    mock_find.assert_called_once_with("Dune", ["Frank Herbert"], "AZW3", library_path="/lib")
+    mock_add_format.assert_called_once_with(2, str(path), library_path="/lib")
+
+    with mock.patch.object(duplicates.metadata, "read_file_metadata", side_effect=FileNotFoundError("ebook-meta")), \
+         mock.patch.object(duplicates, "add_format") as mock_add_format:
+        assert duplicates.attach_as_format(str(path)) is None
+    mock_add_format.assert_not_called()
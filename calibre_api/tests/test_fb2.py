@@ -0,0 +1,84 @@
+import base64
+import zipfile
+
+import pytest
+
+from calibre_api.app.fb2 import parse_fb2, extract_cover, read_metadata, write_cover, is_fb2_path
+
+COVER_BYTES = b"\x89PNG\r\n\x1a\nnot really a png"
+
+SAMPLE_FB2 = f"""<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+  <description>
+    <title-info>
+      <genre>sf_social</genre>
+      <genre>prose_classic</genre>
+      <author><first-name>Михаил</first-name><middle-name>Афанасьевич</middle-name><last-name>Булгаков</last-name></author>
+      <author><nickname>Anonymous</nickname></author>
+      <book-title>Мастер и Маргарита</book-title>
+      <annotation><p>Роман о дьяволе &amp; Москве.</p><p>Второй абзац.</p></annotation>
+      <date value="1967-01-01">1967</date>
+      <coverpage><image l:href="#cover.png"/></coverpage>
+      <lang>ru</lang>
+      <sequence name="Собрание сочинений" number="3"/>
+    </title-info>
+    <publish-info>
+      <publisher>Художественная литература</publisher>
+      <year>1988</year>
+      <isbn>5-280-00523-3</isbn>
+    </publish-info>
+  </description>
+  <body><section><p>Text</p></section></body>
+  <binary id="cover.png" content-type="image/png">{base64.b64encode(COVER_BYTES).decode()}</binary>
+</FictionBook>
+""".encode("utf-8")
+
+
+def test_parse_fb2():
+    parsed = parse_fb2(SAMPLE_FB2)
+    assert parsed["title"] == "Мастер и Маргарита"
+    assert parsed["authors"] == ["Михаил Афанасьевич Булгаков", "Anonymous"]
+    assert parsed["tags"] == ["sf_social", "prose_classic"]
+    assert parsed["languages"] == ["ru"]
+    assert parsed["comments"] == "<p>Роман о дьяволе &amp; Москве.</p><p>Второй абзац.</p>"
+    assert parsed["series"] == "Собрание сочинений"
+    assert parsed["series_index"] == 3.0
+    assert parsed["pubdate"] == "1967-01-01"
+    assert parsed["publisher"] == "Художественная литература"
+    assert parsed["isbn"] == "5-280-00523-3"
+
+
+def test_parse_fb2_without_namespace_or_optional_fields():
+    content = b"<FictionBook><description><title-info><book-title>Plain</book-title></title-info>" \
+              b"<publish-info><year>2001</year></publish-info></description></FictionBook>"
+    assert parse_fb2(content) == {"title": "Plain", "pubdate": "2001"}
+
+
+def test_parse_fb2_rejects_other_documents():
+    with pytest.raises(ValueError):
+        parse_fb2(b"<html><body/></html>")
+    with pytest.raises(ValueError):
+        parse_fb2(b"<FictionBook><unclosed>")
+
+
+def test_extract_cover():
+    assert extract_cover(SAMPLE_FB2) == (COVER_BYTES, "image/png")
+    assert extract_cover(b"<FictionBook><description><title-info/></description></FictionBook>") is None
+
+
+def test_read_metadata_and_cover_from_fbz(tmp_path):
+    fbz_path = tmp_path / "master.fbz"
+    with zipfile.ZipFile(fbz_path, "w") as archive:
+        archive.writestr("master.fb2", SAMPLE_FB2)
+    assert read_metadata(str(fbz_path))["title"] == "Мастер и Маргарита"
+
+    cover_path = write_cover(str(fbz_path), str(tmp_path))
+    assert cover_path.endswith("cover.png")
+    with open(cover_path, "rb") as f:
+        assert f.read() == COVER_BYTES
+
+
+def test_is_fb2_path():
+    assert is_fb2_path("/books/Master.FB2")
+    assert is_fb2_path("master.fb2.zip")
+    assert not is_fb2_path("master.zip")
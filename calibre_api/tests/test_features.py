@@ -0,0 +1,88 @@
+import asyncio
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import features, settings_store
+from calibre_api.app.features import FeatureFlagMiddleware
+
+
+@pytest.fixture(autouse=True)
+def feature_settings():
+    with mock.patch.dict(os.environ):
+        os.environ.pop("SHELFSTONE_FEATURES", None)
+        os.environ.pop("SHELFSTONE_EXPERIMENTAL", None)
+        yield
+
+
+def call(path):
+    """Sends one GET request through the middleware and returns its status."""
+    sent = []
+
+    async def app(scope, receive, send):
+        await send({"type": "http.response.start", "status": 200, "headers": []})
+        await send({"type": "http.response.body", "body": b"ok"})
+
+    async def receive():
+        return {"type": "http.request", "body": b"", "more_body": False}
+
+    async def send(message):
+        sent.append(message)
+
+    asyncio.run(FeatureFlagMiddleware(app)({"type": "http", "method": "GET", "path": path, "headers": []}, receive, send))
+    return sent[0]["status"]
+
+
+def test_parse_flags():
+    assert features.parse_flags(" fulltext=off, Sync=ON ") == {"fulltext": False, "sync": True}
+    assert features.parse_flags(None) == {}
+    for value in ["fulltext", "kobo=on", "sync=maybe"]:
+        with pytest.raises(ValueError):
+            features.parse_flags(value)
+
+
+def test_state_from_default_config_and_override():
+    assert features.status("fulltext") == {
+        "name": "fulltext", "description": features.get("fulltext").description, "enabled": True,
+        "default": True, "experimental": False, "source": "default",
+    }
+    assert not features.is_enabled("metadata_fetch")
+
+    os.environ["SHELFSTONE_EXPERIMENTAL"] = "1"
+    assert features.status("metadata_fetch")["enabled"] is True
+    os.environ["SHELFSTONE_FEATURES"] = "metadata_fetch=off,fulltext=off"
+    assert features.status("metadata_fetch")["source"] == "config"
+    assert not features.is_enabled("metadata_fetch") and not features.is_enabled("fulltext")
+
+    assert features.set_override("fulltext", True)["source"] == "override"
+    assert features.is_enabled("fulltext")
+    assert features.clear_override("fulltext") == dict(features.status("fulltext"), enabled=False, source="config")
+
+    with pytest.raises(features.UnknownFeature):
+        features.set_override("kobo", True)
+
+
+def test_require():
+    features.require("conversion")
+    features.set_override("conversion", False)
+    with pytest.raises(features.FeatureDisabled, match="SHELFSTONE_FEATURES=conversion=on"):
+        features.require("conversion")
+
+
+def test_middleware_blocks_routes_of_disabled_features():
+    assert call("/search/fulltext") == 200
+    os.environ["SHELFSTONE_FEATURES"] = "fulltext=off"
+    assert call("/search/fulltext/index") == 403
+    assert call("/search/") == 200
+    assert call("/sync/bundle") == 200
+
+
+def test_overrides_are_kept_in_the_state_dir(tmp_path):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_STATE_DIR": str(tmp_path)}):
+        os.environ.pop("SHELFSTONE_SETTINGS_DB", None)
+        assert settings_store.db_path() == str(tmp_path / "settings.db")
+        conn = settings_store.connect()
+        try:
+            assert conn.execute("PRAGMA user_version").fetchone()[0] == len(settings_store.MIGRATIONS)
+        finally:
+            conn.close()
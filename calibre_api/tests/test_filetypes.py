@@ -0,0 +1,66 @@
+import io
+import zipfile
+import pytest
+
+from calibre_api.app.filetypes import sniff_ebook_format, check_ebook_bytes, check_ebook_file, storage_filename, UnsupportedFileType
+
+
+def make_zip(first_name, first_content):
+    buffer = io.BytesIO()
+    with zipfile.ZipFile(buffer, "w") as zf:
+        zf.writestr(zipfile.ZipInfo(first_name), first_content)
+        zf.writestr("content.opf", "<package/>")
+    return buffer.getvalue()
+
+
+def test_sniff_epub_and_odt():
+    assert sniff_ebook_format(make_zip("mimetype", "application/epub+zip")) == "EPUB"
+    assert sniff_ebook_format(make_zip("mimetype", "application/vnd.oasis.opendocument.text")) == "ODT"
+    assert sniff_ebook_format(make_zip("page001.jpg", b"\xff\xd8")) == "ZIP"
+
+
+@pytest.mark.parametrize("head,expected", [
+    (b"%PDF-1.7\n%\xe2\xe3\xcf\xd3", "PDF"),
+    (b"\x00" * 60 + b"BOOKMOBI" + b"\x00" * 8, "MOBI"),
+    (b"\x00" * 60 + b"TEXtREAd", "PDB"),
+    (b"AT&TFORM\x00\x00", "DJVU"),
+    (b"{\\rtf1\\ansi", "RTF"),
+    (b"Rar!\x1a\x07\x00", "CBR"),
+    (b'<?xml version="1.0"?>\n<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">', "FB2"),
+    (b"<!DOCTYPE html><html><body>Hi</body></html>", "HTML"),
+    (b"Chapter 1\r\nIt was a dark and stormy night.", "TXT"),
+    ("Café au lait".encode("cp1252"), "TXT"),
+    ("\ufeffUTF-8 text with BOM".encode("utf-8"), "TXT"),
+])
+def test_sniff_known_formats(head, expected):
+    assert sniff_ebook_format(head) == expected
+
+
+@pytest.mark.parametrize("head", [
+    b"",
+    b"MZ\x90\x00\x03\x00\x00\x00\x04\x00",  # Windows executable
+    b"\x7fELF\x02\x01\x01\x00",  # ELF binary
+    b"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR",  # image
+])
+def test_sniff_rejects_non_ebooks(head):
+    assert sniff_ebook_format(head) is None
+    with pytest.raises(UnsupportedFileType):
+        check_ebook_bytes(head, filename="upload.epub")
+
+
+def test_check_ebook_file(tmp_path):
+    path = tmp_path / "book.pdf"
+    path.write_bytes(b"%PDF-1.4 rest of file")
+    assert check_ebook_file(str(path)) == "PDF"
+
+
+def test_storage_filename_records_kfx():
+    assert storage_filename("Dune.azw", "KFX") == "Dune.kfx"
+    assert storage_filename("Dune.kfx-zip", "KFX") == "Dune.kfx-zip"
+    assert storage_filename("Dune.azw", "MOBI") == "Dune.azw"
+
+
+def test_storage_filename_records_fb2_and_djvu():
+    assert storage_filename("Master.xml", "FB2") == "Master.fb2"
+    assert storage_filename("scan", "DJVU") == "scan.djvu"
+    assert storage_filename("scan.djv", "DJVU") == "scan.djv"
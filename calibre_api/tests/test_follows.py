@@ -0,0 +1,102 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, follows, notifications
+from calibre_api.app.main import app
+
+DUNE = {"id": 5, "title": "Dune Messiah", "authors": "Frank Herbert & Brian Herbert", "series": "Dune", "tags": "SF"}
+
+
+def test_follows():
+    author = follows.follow(1, follows.AUTHOR, "  frank   HERBERT ")
+    series = follows.follow(1, follows.SERIES, "Dune", email=True)
+    assert (author["name"], author["email"], series["email"]) == ("frank HERBERT", False, True)
+    with pytest.raises(follows.FollowExists):
+        follows.follow(1, follows.AUTHOR, "Frank Herbert")
+    for kind, name in ((follows.AUTHOR, " "), ("publisher", "Ace")):
+        with pytest.raises(ValueError):
+            follows.follow(1, kind, name)
+    follows.follow(2, follows.AUTHOR, "Brian Herbert")
+    follows.follow(3, follows.AUTHOR, "Ursula K. Le Guin")
+
+    matches = follows.followers(DUNE)
+    assert sorted(matches) == [1, 2]
+    assert [f["kind"] for f in matches[1]] == [follows.AUTHOR, follows.SERIES]
+
+    assert follows.set_email(1, author["id"], True)["email"] is True
+    with pytest.raises(follows.FollowNotFound):
+        follows.unfollow(2, author["id"])
+    follows.unfollow(1, author["id"])
+    assert [f["name"] for f in follows.list_follows(1)] == ["Dune"]
+    follows.forget_user(1)
+    assert follows.export_user(1) == []
+
+
+def test_can_see():
+    book = {"tags": "SF, Classics"}
+    assert follows.can_see({"libraries": None, "tags": None}, book, "/lib")
+    assert not follows.can_see({"libraries": ["/other"], "tags": None}, book, "/lib")
+    assert follows.can_see({"libraries": None, "tags": ["classics"]}, book, None)
+    assert not follows.can_see({"libraries": None, "tags": ["Kids"]}, book, None)
+
+
+@patch('calibre_api.app.follows.crud.list_books', return_value=[DUNE])
+def test_new_books_are_announced(mock_list_books, monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_SMTP_HOST", "smtp.example.org")
+    ana = accounts.create_user("ana", "password1", email="ana@example.org")
+    sam = accounts.create_user("sam", "password1", email="sam@example.org")
+    kim = accounts.create_user("kim", "password1", tags=["Kids"])
+    uploader = accounts.create_user("lee", "password1")
+    follows.follow(ana["id"], follows.SERIES, "Dune", email=True)
+    follows.follow(sam["id"], follows.AUTHOR, "Brian Herbert")
+    follows.follow(kim["id"], follows.AUTHOR, "Frank Herbert")
+    follows.follow(uploader["id"], follows.AUTHOR, "Frank Herbert")
+
+    sent = []
+    follows._announce([5], None, uploader["id"], lambda **kwargs: sent.append(kwargs) or (True, ""))
+    notification = notifications.export_user(ana["id"])[0]
+    assert (notification["kind"], notification["title"], notification["book_id"]) == (
+        notifications.FOLLOWED_BOOK, "New: Dune Messiah", 5)
+    assert "You follow the series Dune." in notification["body"]
+    assert len(notifications.export_user(sam["id"])) == 1
+    # Kim can't see the book, and the uploader added it.
+    assert notifications.export_user(kim["id"]) == [] and notifications.export_user(uploader["id"]) == []
+    # Only Ana asked for emails.
+    assert [s["recipient_email"] for s in sent] == ["ana@example.org"]
+    assert sent[0]["smtp_server"] == "smtp.example.org"
+
+
+@patch('calibre_api.app.follows.threading.Thread')
+def test_announce_runs_in_the_background(mock_thread):
+    follows.announce([5])
+    mock_thread.assert_not_called()  # Nobody follows anything yet.
+    follows.follow(1, follows.AUTHOR, "Frank Herbert")
+    follows.announce([5], "/lib", added_by=2)
+    assert mock_thread.call_args[1]["args"][:3] == ([5], "/lib", 2)
+    mock_thread.return_value.start.assert_called_once()
+
+
+# --- Tests for /me/follows ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    user = accounts.create_user("ana", "password1")
+    client = TestClient(app)
+    client.headers["Authorization"] = f"Bearer {accounts.create_session(user['id'])['token']}"
+    return client
+
+
+def test_follow_endpoints(client):
+    response = client.post("/me/follows", json={"kind": "author", "name": "Ursula K. Le Guin"})
+    assert response.status_code == 201
+    followed = response.json()
+    assert client.post("/me/follows", json={"kind": "author", "name": "ursula k. le guin"}).status_code == 409
+    assert client.post("/me/follows", json={"kind": "tag", "name": "SF"}).status_code == 400
+    assert client.patch(f"/me/follows/{followed['id']}", json={"email": True}).json()["email"] is True
+    assert [f["name"] for f in client.get("/me/follows").json()] == ["Ursula K. Le Guin"]
+    assert client.delete(f"/me/follows/{followed['id']}").status_code == 204
+    assert client.delete(f"/me/follows/{followed['id']}").status_code == 404
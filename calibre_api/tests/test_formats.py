@@ -0,0 +1,32 @@
+from calibre_api.app import formats
+
+
+def test_mime_types():
+    assert formats.mime_type("epub") == "application/epub+zip"
+    assert formats.mime_type(".AZW3") == "application/x-mobi8-ebook"
+    assert formats.mime_type("CBZ") == "application/vnd.comicbook+zip"
+    assert formats.mime_type("xyz") == formats.DEFAULT_MIME_TYPE
+    assert formats.mime_type("") == formats.DEFAULT_MIME_TYPE
+
+
+def test_from_filename_prefers_longest_extension():
+    assert formats.from_filename("Master.fb2.zip").name == "FBZ"
+    assert formats.from_filename("archive.zip").name == "ZIP"
+    assert formats.from_filename("Dune.MOBI").name == "MOBI"
+    assert formats.from_filename("notes") is None
+
+
+def test_output_formats():
+    assert formats.output_formats() == {"EPUB", "AZW3", "MOBI", "PDF", "DOCX", "FB2", "HTMLZ", "TXT", "TXTZ", "RTF", "PDB", "LRF"}
+
+
+def test_with_extension():
+    assert formats.with_extension("Dune.azw", "KFX") == "Dune.kfx"
+    assert formats.with_extension("Dune.kfx-zip", "KFX") == "Dune.kfx-zip"
+    assert formats.with_extension("Dune.azw", "UNKNOWN") == "Dune.azw"
+
+
+def test_names_are_unique():
+    names = [f.name for f in formats.FORMATS]
+    assert len(names) == len(set(names))
+    assert all(f.extensions and f.extensions[0].startswith(".") for f in formats.FORMATS)
@@ -0,0 +1,228 @@
+import os
+import zipfile
+import pytest
+from unittest import mock
+
+from calibre_api.app import fulltext
+
+
+CONTAINER = """<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>"""
+
+OPF = """<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+  <manifest>
+    <item id="c2" href="Text/ch2.xhtml" media-type="application/xhtml+xml"/>
+    <item id="c1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="c1"/><itemref idref="c2"/></spine>
+</package>"""
+
+
+def make_epub(path, chapters):
+    with zipfile.ZipFile(path, "w") as epub:
+        epub.writestr("mimetype", "application/epub+zip")
+        epub.writestr("META-INF/container.xml", CONTAINER)
+        epub.writestr("OEBPS/content.opf", OPF)
+        for name, body in chapters.items():
+            epub.writestr(f"OEBPS/Text/{name}", f"<html><head><style>p {{}}</style></head><body>{body}</body></html>")
+
+
+def test_extract_epub_text_in_spine_order(tmp_path):
+    path = tmp_path / "book.epub"
+    make_epub(path, {"ch1.xhtml": "<p>The signal came from Trisolaris&hellip;</p>", "ch2.xhtml": "<p>Second chapter.</p>"})
+    assert fulltext.extract_epub_text(str(path)) == "The signal came from Trisolaris… Second chapter."
+
+
+def test_extract_text_falls_back_to_calibre_for_broken_epub(tmp_path):
+    path = tmp_path / "broken.epub"
+    path.write_bytes(b"not a zip")
+    with mock.patch.object(fulltext, "extract_text_with_calibre", return_value="converted") as mock_convert:
+        assert fulltext.extract_text(str(path)) == "converted"
+    mock_convert.assert_called_once_with(str(path))
+
+
+def test_pick_format_file_prefers_reflowable_formats(tmp_path):
+    for name in ("b.pdf", "b.epub"):
+        (tmp_path / name).write_bytes(b"x")
+    book = {"formats": [str(tmp_path / "b.pdf"), str(tmp_path / "b.epub"), str(tmp_path / "missing.mobi")]}
+    assert fulltext.pick_format_file(book) == str(tmp_path / "b.epub")
+    assert fulltext.pick_format_file({"formats": []}) is None
+
+
+def test_build_index_and_search(tmp_path):
+    db = str(tmp_path / "fts.db")
+    epub = tmp_path / "three-body.epub"
+    make_epub(epub, {"ch1.xhtml": "<p>Ye Wenjie answered the message from Trisolaris.</p>", "ch2.xhtml": ""})
+    books = [
+        {"id": 1, "title": "The Three-Body Problem", "formats": [str(epub)], "last_modified": "2024-01-01"},
+        {"id": 2, "title": "No Files", "formats": [], "last_modified": "2024-01-01"},
+    ]
+    with mock.patch.object(fulltext, "list_books", return_value=books):
+        stats = fulltext.build_index(library_path="/lib", db_path=db)
+        assert stats == {"total": 2, "indexed": 1, "skipped": 0, "failed": 1, "removed": 0}
+        # Unchanged books are not read again.
+        assert fulltext.build_index(library_path="/lib", db_path=db)["skipped"] == 2
+
+    hits = fulltext.search("trisolaris", library_path="/lib", db_path=db)
+    assert [h["book_id"] for h in hits] == [1]
+    assert "[Trisolaris]" in hits[0]["snippet"]
+    # Each library has its own entries.
+    assert fulltext.search("trisolaris", library_path="/other", db_path=db) == []
+
+    with mock.patch.object(fulltext, "list_books", return_value=[]):
+        assert fulltext.build_index(library_path="/lib", db_path=db)["removed"] == 2
+    assert fulltext.search("trisolaris", library_path="/lib", db_path=db) == []
+
+
+def test_index_book_truncates_to_limit(tmp_path):
+    conn = fulltext.connect(str(tmp_path / "fts.db"))
+    epub = tmp_path / "long.epub"
+    make_epub(epub, {"ch1.xhtml": "word " * 100, "ch2.xhtml": ""})
+    result = fulltext.index_book(conn, "", {"id": 5, "title": "Long", "formats": [str(epub)]}, limit=50)
+    conn.close()
+    assert result["chars"] == 50
+    assert result["truncated"] is True
+
+
+def test_search_rejects_invalid_queries(tmp_path):
+    db = str(tmp_path / "fts.db")
+    with pytest.raises(ValueError):
+        fulltext.search("   ", db_path=db)
+    with pytest.raises(ValueError):
+        fulltext.search('"unbalanced', db_path=db)
+
+
+def test_index_db_path_from_env(tmp_path):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_FTS_DB": str(tmp_path / "x.db")}):
+        assert fulltext.index_db_path() == str(tmp_path / "x.db")
+    with mock.patch.dict(os.environ, {"SHELFSTONE_STATE_DIR": str(tmp_path)}):
+        os.environ.pop("SHELFSTONE_FTS_DB", None)
+        assert fulltext.index_db_path() == str(tmp_path / "fulltext.db")
+
+
+LIBRARY = [
+    {"id": 1, "title": "Dune Messiah", "authors": ["Frank Herbert"], "series": "Dune"},
+    {"id": 2, "title": "Children of Time", "authors": ["Adrian Tchaikovsky"], "series": None},
+    {"id": 3, "title": "Hyperion", "authors": ["Dan Simmons"], "series": "Hyperion Cantos"},
+]
+
+
+def test_search_books_by_field(tmp_path):
+    db = str(tmp_path / "fts.db")
+    with mock.patch.object(fulltext, "list_books", return_value=LIBRARY) as mock_list_books:
+        # The first search fills the metadata index from the library.
+        hits = fulltext.search_books("dune", ["title", "author", "series"], library_path="/lib", db_path=db)
+        assert mock_list_books.call_count == 1
+        assert fulltext.search_books("dune", ["series"], library_path="/lib", db_path=db)[0]["book_id"] == 1
+        assert mock_list_books.call_count == 1
+    assert hits == [{"book_id": 1, "title": "Dune Messiah", "authors": ["Frank Herbert"], "series": "Dune",
+                     "matched": ["title", "series"], "snippet": None}]
+    assert [h["book_id"] for h in fulltext.search_books("tchaik*", ["author"], library_path="/lib", db_path=db)] == [2]
+    assert fulltext.search_books("tchaikovsky", ["title"], library_path="/lib", db_path=db) == []
+    with pytest.raises(ValueError):
+        fulltext.search_books("dune", ["publisher"], library_path="/lib", db_path=db)
+
+
+def test_search_books_includes_text(tmp_path):
+    db = str(tmp_path / "fts.db")
+    epub = tmp_path / "hyperion.epub"
+    make_epub(epub, {"ch1.xhtml": "<p>The Shrike waited at the Time Tombs.</p>", "ch2.xhtml": ""})
+    books = [dict(book, formats=[str(epub)] if book["id"] == 3 else [], last_modified="2024") for book in LIBRARY]
+    with mock.patch.object(fulltext, "list_books", return_value=books):
+        fulltext.build_index(library_path="/lib", db_path=db)
+
+    hits = fulltext.search_books("time", ["title"], include_text=True, library_path="/lib", db_path=db)
+    assert [(h["book_id"], h["matched"]) for h in hits] == [(2, ["title"]), (3, ["text"])]
+    assert hits[1]["authors"] == ["Dan Simmons"]
+    assert "[Time]" in hits[1]["snippet"]
+
+
+def test_refresh_metadata_for_changed_books(tmp_path):
+    db = str(tmp_path / "fts.db")
+    with mock.patch.object(fulltext, "list_books", return_value=LIBRARY):
+        fulltext.refresh_metadata(library_path="/lib", db_path=db)
+    renamed = [{"id": 1, "title": "Dune Messiah", "authors": ["Frank Herbert"], "series": "Arrakis"}]
+    with mock.patch.object(fulltext, "list_books", return_value=renamed) as mock_list_books:
+        # Book 2 was removed from the library.
+        assert fulltext.refresh_metadata(library_path="/lib", book_ids=[1, 2], db_path=db) == 1
+        assert mock_list_books.call_args[1]["search_query"] == "id:1 or id:2"
+    assert [h["book_id"] for h in fulltext.search_books("arrakis", ["series"], library_path="/lib", db_path=db)] == [1]
+    assert fulltext.search_books("children", ["title"], library_path="/lib", db_path=db) == []
+
+
+def test_update_after_change_never_fails(tmp_path):
+    db = tmp_path / "fts.db"
+    with mock.patch.dict(os.environ, {"SHELFSTONE_FTS_DB": str(db)}):
+        with mock.patch.object(fulltext, "refresh_metadata") as mock_refresh:
+            # No index yet: nothing to update.
+            fulltext.update_after_change([1], library_path="/lib")
+            mock_refresh.assert_not_called()
+        db.touch()
+        with mock.patch.object(fulltext, "refresh_metadata", side_effect=RuntimeError("calibredb failed")) as mock_refresh:
+            fulltext.update_after_change([1], library_path="/lib")
+            mock_refresh.assert_called_once_with(library_path="/lib", book_ids=[1])
+
+
+CJK_LIBRARY = [
+    {"id": 11, "title": "三体", "authors": ["刘慈欣"], "series": "地球往事"},
+    {"id": 12, "title": "ノルウェイの森", "authors": ["村上春樹"], "series": None},
+    {"id": 13, "title": "채식주의자", "authors": ["한강"], "series": None},
+    {"id": 14, "title": "الخبز الحافي", "authors": ["محمد شكري"], "series": None},
+]
+
+
+def test_segment_cjk_round_trip():
+    assert fulltext.segment_cjk("三体 and Dune") == "三​体 and Dune"
+    assert fulltext.unsegment_cjk(fulltext.segment_cjk("ノルウェイの森")) == "ノルウェイの森"
+    assert fulltext.unsegment_cjk("[三]​[体]​人") == "[三体]人"
+
+
+@pytest.mark.parametrize("query, field, book_id", [
+    ("三体", "title", 11),
+    ("慈欣", "author", 11),
+    ("地球", "series", 11),
+    ("ノルウェイ", "title", 12),
+    ("村上", "author", 12),
+    ("채식", "title", 13),
+    ("한강", "author", 13),
+    ("الخبز", "title", 14),
+    ("شكري", "author", 14),
+])
+def test_search_books_in_each_script(tmp_path, query, field, book_id):
+    db = str(tmp_path / "fts.db")
+    with mock.patch.object(fulltext, "list_books", return_value=CJK_LIBRARY):
+        hits = fulltext.search_books(query, [field], library_path="/lib", db_path=db)
+    assert [h["book_id"] for h in hits] == [book_id]
+    # Results carry the metadata as written, without segmentation marks.
+    assert hits[0]["title"] == next(b["title"] for b in CJK_LIBRARY if b["id"] == book_id)
+
+
+def test_search_cjk_text_snippet(tmp_path):
+    db = str(tmp_path / "fts.db")
+    epub = tmp_path / "santi.epub"
+    make_epub(epub, {"ch1.xhtml": "<p>汪淼觉得，来找他的这几个人是一个奇怪的组合。</p>", "ch2.xhtml": ""})
+    books = [dict(CJK_LIBRARY[0], formats=[str(epub)], last_modified="2024")]
+    with mock.patch.object(fulltext, "list_books", return_value=books):
+        fulltext.build_index(library_path="/lib", db_path=db)
+    hits = fulltext.search("奇怪", library_path="/lib", db_path=db)
+    assert [h["book_id"] for h in hits] == [11]
+    assert "[奇怪]" in hits[0]["snippet"]
+    # Both characters must appear next to each other, not just somewhere in the text.
+    assert fulltext.search("怪奇", library_path="/lib", db_path=db) == []
+
+
+def test_connect_refreshes_index_from_before_segmentation(tmp_path):
+    db = str(tmp_path / "fts.db")
+    conn = fulltext.connect(db)
+    with conn:
+        conn.execute("INSERT INTO book_meta (library, book_id, title, authors, series) VALUES ('', 1, '三体', '', '')")
+        conn.execute("INSERT INTO indexed_books (library, book_id, last_modified) VALUES ('', 1, '2024')")
+        conn.execute("PRAGMA user_version = 0")
+    conn.close()
+    conn = fulltext.connect(db)
+    assert conn.execute("SELECT COUNT(*) FROM book_meta").fetchone()[0] == 0
+    assert conn.execute("SELECT last_modified FROM indexed_books").fetchone()[0] is None
+    conn.close()
@@ -0,0 +1,46 @@
+import pytest
+from unittest import mock
+
+from calibre_api.app import idempotency
+from calibre_api.app.idempotency import validate_key, find_book_id, claim, IdempotencyKeyInUse
+
+
+@pytest.mark.parametrize("key", ["abc", "upload-2024-01-01.1", "A_b-C.d", "x" * 128])
+def test_validate_key_accepts(key):
+    assert validate_key(key) == key
+
+
+@pytest.mark.parametrize("key", ["", "has space", "quote\"", "colon:key", "x" * 129])
+def test_validate_key_rejects(key):
+    with pytest.raises(ValueError):
+        validate_key(key)
+
+
+@mock.patch.object(idempotency, 'list_books')
+def test_find_book_id(mock_list_books):
+    mock_list_books.return_value = [
+        {"id": 3, "identifiers": {"idempotency": "abc-longer"}},
+        {"id": 4, "identifiers": {"isbn": "123", "idempotency": "abc"}},
+    ]
+    assert find_book_id("abc", library_path="/lib") == 4
+    mock_list_books.assert_called_once_with(library_path="/lib", search_query='identifiers:"=idempotency:=abc"')
+
+
+@mock.patch.object(idempotency, 'list_books', return_value=[])
+def test_find_book_id_unknown_key(mock_list_books):
+    assert find_book_id("abc") is None
+
+
+def test_claim_rejects_concurrent_use_of_same_key():
+    with claim("abc"):
+        with pytest.raises(IdempotencyKeyInUse):
+            with claim("abc"):
+                pass
+        # Different key or different library is independent.
+        with claim("other"):
+            pass
+        with claim("abc", library_path="/other/lib"):
+            pass
+    # Released after the block.
+    with claim("abc"):
+        pass
@@ -0,0 +1,136 @@
+"""
+End-to-end tests of the import -> API -> download pipeline against the fake Calibre tools in
+tests/fake_calibre (see fakecalibre.py). Nothing is mocked inside the server: commands run as
+real subprocesses, and the library and caches live in a temporary folder.
+"""
+import json
+import os
+import zipfile
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import crud, library_import, seed
+from calibre_api.app.main import app
+
+FAKE_BIN_DIR = os.path.join(os.path.dirname(os.path.abspath(__file__)), "fake_calibre")
+
+
+def make_epub(path, title, author):
+    """A minimal EPUB with title and author in its OPF, as fixture for the fake tools."""
+    with zipfile.ZipFile(path, "w") as epub:
+        epub.writestr("mimetype", "application/epub+zip", compress_type=zipfile.ZIP_STORED)
+        epub.writestr("META-INF/container.xml",
+                      '<?xml version="1.0"?><container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">'
+                      '<rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>')
+        epub.writestr("content.opf",
+                      '<?xml version="1.0"?><package xmlns="http://www.idpf.org/2007/opf" version="2.0">'
+                      '<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">'
+                      f"<dc:title>{title}</dc:title><dc:creator>{author}</dc:creator></metadata></package>")
+        epub.writestr("chapter1.xhtml", f"<html><body><p>{title} by {author}</p></body></html>")
+    return str(path)
+
+
+@pytest.fixture
+def fake_calibre(tmp_path, monkeypatch):
+    """Runs the server against the fake tools with an empty library; returns the library path."""
+    library = tmp_path / "library"
+    library.mkdir()
+    monkeypatch.setenv("SHELFSTONE_CALIBRE_BIN_DIR", FAKE_BIN_DIR)
+    monkeypatch.setenv("FAKE_CALIBRE_LIBRARY", str(library))
+    monkeypatch.setenv("FAKE_CALIBRE_LOG", str(tmp_path / "calls.log"))
+    monkeypatch.setenv("SHELFSTONE_CONVERSION_CACHE", str(tmp_path / "conversions"))
+    monkeypatch.setenv("SHELFSTONE_THUMBNAIL_CACHE", str(tmp_path / "thumbnails"))
+    monkeypatch.setenv("SHELFSTONE_FTS_DB", str(tmp_path / "fulltext.db"))
+    return str(library)
+
+
+def calls(tmp_path, tool):
+    log = tmp_path / "calls.log"
+    if not log.exists():
+        return []
+    return [c for c in (json.loads(line) for line in log.read_text().splitlines()) if c[0] == tool]
+
+
+def test_add_list_and_remove_through_crud(fake_calibre, tmp_path):
+    epub = make_epub(tmp_path / "dune.epub", "Dune", "Frank Herbert")
+    assert crud.add_book(file_path=epub, library_path=fake_calibre, identifiers={"isbn": "9780441172719"}) == [1]
+    assert crud.add_book(file_path=epub, library_path=fake_calibre) == []  # Duplicate title and author.
+
+    books = crud.list_books(library_path=fake_calibre, search_query="id:1")
+    assert [(b["title"], b["authors"], b["identifiers"]) for b in books] == [("Dune", "Frank Herbert", {"isbn": "9780441172719"})]
+    with open(books[0]["formats"][0], "rb") as stored, open(epub, "rb") as original:
+        assert stored.read() == original.read()
+
+    crud.remove_book(1, library_path=fake_calibre)
+    assert crud.list_books(library_path=fake_calibre) == []
+
+
+def test_library_import_is_repeatable(fake_calibre, tmp_path):
+    folder = tmp_path / "ebooks"
+    (folder / "Simmons").mkdir(parents=True)
+    make_epub(folder / "dune.epub", "Dune", "Frank Herbert")
+    make_epub(folder / "Simmons" / "hyperion.epub", "Hyperion", "Dan Simmons")
+    (folder / "notes.txt.png").write_bytes(b"\x89PNG\r\n\x1a\n")
+
+    first = library_import.import_directory(str(folder), library_path=fake_calibre)
+    assert (first["added"], first["skipped"], first["ignored"]) == (2, 0, 1)
+    second = library_import.import_directory(str(folder), library_path=fake_calibre)
+    assert (second["added"], second["skipped"]) == (0, 2)
+    # Each new file is first matched against the library's titles, in case it's another format.
+    assert [c[1] for c in calls(tmp_path, "calibredb")] == ["list", "list", "add", "list", "add", "list"]
+
+
+def test_library_import_adds_other_formats_to_existing_books(fake_calibre, tmp_path):
+    folder = tmp_path / "ebooks"
+    folder.mkdir()
+    make_epub(folder / "dune.epub", "Dune", "Frank Herbert")
+    make_epub(folder / "dune_deluxe.azw3", "Dune: Deluxe Edition", "Herbert, Frank")
+
+    result = library_import.import_directory(str(folder), library_path=fake_calibre)
+    assert [(r["status"], r["book_ids"]) for r in result["results"]] == [("added", [1]), ("format_added", [1])]
+    books = crud.list_books(library_path=fake_calibre)
+    assert [sorted(os.path.splitext(p)[1] for p in b["formats"]) for b in books] == [[".azw3", ".epub"]]
+
+
+def test_seed_fills_library_with_one_calibredb_call_per_batch(fake_calibre, tmp_path):
+    added = seed.seed_library(5, fake_calibre, seed=3, batch_size=4)
+    assert added == [1, 2, 3, 4, 5]
+    titles = [b["title"] for b in seed.generate_books(5, seed=3)]
+    assert [b["title"] for b in crud.list_books(library_path=fake_calibre)] == titles
+    assert len(calls(tmp_path, "calibredb")) == 3  # Two adds, one list.
+
+
+def test_upload_download_and_delete_through_api(fake_calibre, tmp_path):
+    client = TestClient(app)
+    epub = make_epub(tmp_path / "dune.epub", "Dune", "Frank Herbert")
+    with open(epub, "rb") as f:
+        epub_bytes = f.read()
+
+    response = client.post("/books/add/", data={"library_path": fake_calibre},
+                           files={"file": ("dune.epub", epub_bytes, "application/epub+zip")})
+    assert response.status_code == 200, response.text
+    assert response.json()["added_book_ids"] == [1]
+    assert response.json()["books"][0]["title"] == "Dune"
+
+    response = client.get("/books/", params={"library_path": fake_calibre})
+    assert [b["title"] for b in response.json()] == ["Dune"]
+
+    response = client.get("/books/1/download", params={"library_path": fake_calibre})
+    assert response.status_code == 200
+    assert response.headers["content-type"] == "application/epub+zip"
+    assert response.headers["x-converted"] == "false"
+    assert response.content == epub_bytes
+
+    for _ in range(2):
+        response = client.get("/books/1/download", params={"library_path": fake_calibre, "format": "azw3"})
+        assert response.status_code == 200
+        assert response.headers["content-type"] == "application/x-mobi8-ebook"
+        assert response.headers["x-converted"] == "true"
+        assert response.content.startswith(b"FAKE AZW3 OF ")
+    assert len(calls(tmp_path, "ebook-convert")) == 1  # The second download came from the cache.
+
+    response = client.delete("/books/1/", params={"library_path": fake_calibre})
+    assert response.status_code == 200
+    assert client.get("/books/1/", params={"library_path": fake_calibre}).status_code == 404
+    assert os.listdir(tmp_path / "conversions") == []
@@ -0,0 +1,45 @@
+import pytest
+from unittest import mock
+
+from calibre_api.app.isbn import normalize_isbn, isbn13_to_isbn10, find_books_by_isbn
+
+
+@pytest.mark.parametrize("value, expected", [
+    ("9780441172719", "9780441172719"),
+    ("978-0-441-17271-9", "9780441172719"),
+    ("0441172717", "9780441172719"),
+    ("0-8044-2957-X", "9780804429573"),
+    ("080442957x", "9780804429573"),
+    ("9791032305690", "9791032305690"),
+])
+def test_normalize_isbn(value, expected):
+    assert normalize_isbn(value) == expected
+
+
+@pytest.mark.parametrize("value", ["9780441172718", "0441172718", "12345", "", "978044117271X"])
+def test_normalize_isbn_rejects_invalid(value):
+    with pytest.raises(ValueError):
+        normalize_isbn(value)
+
+
+def test_isbn13_to_isbn10():
+    assert isbn13_to_isbn10("9780441172719") == "0441172717"
+    assert isbn13_to_isbn10("9780804429573") == "080442957X"
+    assert isbn13_to_isbn10("9791032305690") is None
+
+
+@mock.patch("calibre_api.app.isbn.list_books")
+def test_find_books_by_isbn_matches_both_forms(mock_list):
+    mock_list.return_value = [
+        {"id": 1, "title": "Dune", "identifiers": {"isbn": "0441172717"}},
+        {"id": 2, "title": "Other", "identifiers": {"isbn": "9780441172726"}},
+        {"id": 3, "title": "Broken", "identifiers": {"isbn": "n/a"}},
+    ]
+
+    books = find_books_by_isbn("978-0-441-17271-9", library_path="/lib")
+
+    assert [b["id"] for b in books] == [1]
+    mock_list.assert_called_once_with(
+        library_path="/lib",
+        search_query='identifiers:"=isbn:=9780441172719" or identifiers:"=isbn:=0441172717"',
+    )
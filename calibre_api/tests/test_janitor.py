@@ -0,0 +1,136 @@
+import os
+import time
+import pytest
+from unittest import mock
+
+from calibre_api.app import janitor
+
+UUID = "0f8fad5b-d9cb-469f-a165-70867728950e"
+HOUR = 3600
+
+
+def age(path, seconds):
+    stamp = time.time() - seconds
+    os.utime(path, (stamp, stamp))
+
+
+@pytest.fixture
+def temp_dir(tmp_path):
+    with mock.patch("calibre_api.app.janitor.tempfile.gettempdir", return_value=str(tmp_path)), \
+         mock.patch("calibre_api.app.janitor.uploads.UPLOAD_ROOT", str(tmp_path / "shelfstone_server_uploads")):
+        yield tmp_path
+
+
+def test_is_server_temp_entry():
+    assert janitor.is_server_temp_entry(f"convert_in_{UUID}_book.epub")
+    assert janitor.is_server_temp_entry("shelfstone_server_news_ab12cd34")
+    # Generic prefixes only match with the UUID that temp_file_path appends.
+    assert not janitor.is_server_temp_entry("convert_in_notes.txt")
+    assert not janitor.is_server_temp_entry("systemd-private-123")
+    assert not janitor.is_server_temp_entry("shelfstone_server_uploads")
+
+
+def test_clean_temp_files_removes_only_old_server_files(temp_dir):
+    old_file = temp_dir / f"polish_out_{UUID}.epub"
+    old_file.write_bytes(b"x" * 10)
+    age(old_file, 30 * HOUR)
+    fresh_file = temp_dir / f"convert_in_{UUID}.epub"
+    fresh_file.write_bytes(b"x")
+    foreign = temp_dir / "other_program.tmp"
+    foreign.write_bytes(b"x")
+    age(foreign, 30 * HOUR)
+    scratch = temp_dir / "shelfstone_server_snapshot_abc"
+    scratch.mkdir()
+    (scratch / "metadata.db").write_bytes(b"y" * 5)
+    age(scratch / "metadata.db", 30 * HOUR)
+    age(scratch, 30 * HOUR)
+
+    result = janitor.clean_temp_files(max_age=24 * HOUR, now=time.time())
+
+    assert sorted(result["removed"]) == sorted([old_file.name, scratch.name])
+    assert result["freed_bytes"] == 15
+    assert not old_file.exists() and not scratch.exists()
+    assert fresh_file.exists() and foreign.exists()
+
+
+def test_clean_temp_files_dry_run(temp_dir):
+    old_file = temp_dir / f"recipe_{UUID}.recipe"
+    old_file.write_bytes(b"x")
+    age(old_file, 30 * HOUR)
+
+    result = janitor.clean_temp_files(max_age=24 * HOUR, now=time.time(), dry_run=True)
+
+    assert result["removed"] == [old_file.name]
+    assert old_file.exists()
+
+
+def test_clean_uploads_uses_last_chunk_time(temp_dir):
+    root = temp_dir / "shelfstone_server_uploads"
+    stale = root / "stale-upload"
+    active = root / "active-upload"
+    for folder in (stale, active):
+        folder.mkdir(parents=True)
+        (folder / "upload.json").write_text("{}")
+        (folder / "big.pdf").write_bytes(b"z" * 4)
+        age(folder / "upload.json", 100 * HOUR)
+        age(folder, 100 * HOUR)
+    age(stale / "big.pdf", 100 * HOUR)  # The active upload's data file was just written.
+
+    result = janitor.clean_uploads(max_age=48 * HOUR, now=time.time())
+
+    assert result["removed"] == ["stale-upload"]
+    assert not stale.exists() and active.exists()
+
+
+@mock.patch("calibre_api.app.janitor.remove_book")
+@mock.patch("calibre_api.app.janitor.list_books")
+def test_clean_news_issues_skips_manually_tagged_books(mock_list, mock_remove):
+    mock_list.return_value = [
+        {"id": 4, "identifiers": {"news": "the-guardian"}},
+        {"id": 5, "identifiers": {}},
+    ]
+
+    result = janitor.clean_news_issues(max_age=30 * 86400, now=time.time())
+
+    assert result["removed"] == ["4"]
+    mock_remove.assert_called_once_with(4, library_path=None)
+    assert mock_list.call_args.kwargs["search_query"] == 'tags:"=News" and date:<30daysago'
+
+
+def test_run_cleanup_skips_disabled_tasks_and_reports_errors():
+    failing = mock.Mock(side_effect=RuntimeError("disk gone"))
+    working = mock.Mock(return_value={"removed": ["a"], "freed_bytes": 3})
+    tasks = [("temp_files", failing), ("uploads", working), ("news_issues", mock.Mock())]
+    env = {"SHELFSTONE_NEWS_RETENTION_DAYS": "0", "SHELFSTONE_UPLOAD_RETENTION_HOURS": "1"}
+    with mock.patch.object(janitor, "CLEANUP_TASKS", tasks), mock.patch.dict(os.environ, env):
+        result = janitor.run_cleanup(dry_run=True, now=1000.0)
+
+    assert result == {"dry_run": True, "tasks": [
+        {"name": "temp_files", "removed": [], "freed_bytes": 0, "error": "disk gone"},
+        {"name": "uploads", "removed": ["a"], "freed_bytes": 3, "error": None},
+    ]}
+    working.assert_called_once_with(max_age=3600.0, now=1000.0, dry_run=True, library_path=None)
+    tasks[2][1].assert_not_called()
+
+
+def test_clean_conversion_cache_uses_last_download_time(tmp_path):
+    cache = tmp_path / "conversions"
+    cache.mkdir()
+    (cache / "3_old.azw3").write_bytes(b"x" * 5)
+    (cache / "4_recent.epub").write_bytes(b"y")
+    age(cache / "3_old.azw3", 40 * 86400)
+    with mock.patch.dict(os.environ, {"SHELFSTONE_CONVERSION_CACHE": str(cache)}):
+        result = janitor.clean_conversion_cache(max_age=30 * 86400, now=time.time())
+
+    assert result == {"removed": ["3_old.azw3"], "freed_bytes": 5}
+    assert not (cache / "3_old.azw3").exists() and (cache / "4_recent.epub").exists()
+
+
+def test_clean_thumbnail_cache(tmp_path):
+    cache = tmp_path / "thumbs"
+    cache.mkdir()
+    (cache / "3_small_old.jpg").write_bytes(b"x")
+    age(cache / "3_small_old.jpg", 40 * 86400)
+    with mock.patch.dict(os.environ, {"SHELFSTONE_THUMBNAIL_CACHE": str(cache)}):
+        assert janitor.clean_thumbnail_cache(max_age=30 * 86400, now=time.time(), dry_run=True)["removed"] == ["3_small_old.jpg"]
+    assert (cache / "3_small_old.jpg").exists()
@@ -0,0 +1,137 @@
+import hashlib
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, kosync, reading
+from calibre_api.app.main import app
+
+
+def test_partial_md5_samples_like_koreader(tmp_path):
+    data = bytes(range(256)) * 40  # 10240 bytes: samples at 0, 1 KiB and 4 KiB, then the end.
+    path = tmp_path / "book.epub"
+    path.write_bytes(data)
+    expected = hashlib.md5(data[0:1024] + data[1024:2048] + data[4096:5120]).hexdigest()
+    assert kosync.partial_md5(str(path)) == expected
+    assert kosync.partial_md5(data) == expected
+
+
+def test_downloads_link_documents_to_books(tmp_path):
+    path = tmp_path / "book.epub"
+    path.write_bytes(b"epub data")
+    assert kosync.book_for_document(kosync.partial_md5(str(path))) is None
+    kosync.record_download(str(path), "Dune - Frank Herbert.epub", 3, "epub", library_path=str(tmp_path))
+    book = kosync.book_for_document(kosync.partial_md5(str(path)).upper())
+    assert book == {"library_path": str(tmp_path), "book_id": 3, "format": "EPUB"}
+    assert kosync.book_for_document(kosync.filename_md5("Dune - Frank Herbert.epub"))["book_id"] == 3
+
+    kosync.forget_books([3], library_path=str(tmp_path))
+    assert kosync.book_for_document(kosync.filename_md5("Dune - Frank Herbert.epub")) is None
+
+
+@pytest.mark.parametrize("values, error", [
+    ({"progress": "/body/p[1]", "percentage": 0.5}, kosync.DOCUMENT_MISSING),
+    ({"document": "abc", "progress": "/body/p[1]", "percentage": 1.5}, kosync.INVALID_FIELDS),
+    ({"document": "abc", "progress": "/body/p[1]", "percentage": "half"}, kosync.INVALID_FIELDS),
+    ({"document": "abc", "percentage": 0.5}, kosync.INVALID_FIELDS),
+])
+def test_invalid_positions(values, error):
+    with pytest.raises(kosync.InvalidPosition) as raised:
+        kosync.save_position(1, values)
+    assert raised.value.error == error
+
+
+def test_positions_are_per_user():
+    saved = kosync.save_position(1, {"document": "ABC", "progress": "42", "percentage": 0.25, "device": "Kobo"})
+    assert isinstance(saved["timestamp"], int)
+    assert kosync.get_position(1, "abc")["progress"] == "42"
+    assert kosync.get_position(2, "abc") is None
+    kosync.forget_user(1)
+    assert kosync.get_position(1, "abc") is None
+
+
+def test_api_tokens_answer_to_their_md5():
+    user = accounts.create_user("ana", "password1")
+    token = accounts.create_api_token(user["id"], "KOReader")["token"]
+    assert accounts.user_for_kosync_key("ANA", accounts.kosync_key(token))["id"] == user["id"]
+    assert accounts.user_for_kosync_key("sam", accounts.kosync_key(token)) is None
+    # Sessions can't be used from KOReader.
+    session = accounts.create_session(user["id"])["token"]
+    assert accounts.user_for_kosync_key("ana", accounts.kosync_key(session)) is None
+
+
+# --- Tests for the kosync endpoints ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+@pytest.fixture
+def koreader():
+    """KOReader's headers for the user 'ana' who entered an API token as the password."""
+    user = accounts.create_user("ana", "password1")
+    token = accounts.create_api_token(user["id"], "KOReader")["token"]
+    return user, {"x-auth-user": "ana", "x-auth-key": hashlib.md5(token.encode()).hexdigest(),
+                  "accept": "application/vnd.koreader.v1+json"}
+
+
+def test_login(client, koreader):
+    _, headers = koreader
+    assert client.get("/users/auth", headers=headers).json() == {"authorized": "OK"}
+    response = client.get("/users/auth", headers={**headers, "x-auth-key": hashlib.md5(b"password1").hexdigest()})
+    assert response.status_code == 401
+    assert response.json()["code"] == 2001
+
+
+def test_registration_is_refused(client, koreader):
+    response = client.post("/users/create", json={"username": "sam", "password": "x"})
+    assert (response.status_code, response.json()["code"]) == (402, 2005)
+    assert client.post("/users/create", json={"username": "Ana", "password": "x"}).json()["code"] == 2002
+
+
+def test_sync_without_accounts_is_unauthorized(client, monkeypatch):
+    monkeypatch.delenv("SHELFSTONE_ACCOUNTS")
+    response = client.put("/syncs/progress", json={"document": "abc", "progress": "1", "percentage": 0.1})
+    assert response.json()["code"] == 2001
+
+
+def test_push_and_pull_progress(client, koreader):
+    _, headers = koreader
+    position = {"document": "abc", "progress": "/body/DocFragment[12]/body/p[3]", "percentage": 0.4,
+                "device": "Kobo", "device_id": "K1"}
+    assert client.get("/syncs/progress/abc", headers=headers).json() == {}
+    response = client.put("/syncs/progress", json=position, headers=headers)
+    assert response.status_code == 200
+    assert response.json()["document"] == "abc"
+    pulled = client.get("/syncs/progress/abc", headers=headers).json()
+    assert (pulled["progress"], pulled["percentage"], pulled["device_id"]) == (position["progress"], 0.4, "K1")
+
+    response = client.put("/syncs/progress", json={"progress": "1", "percentage": 0.1}, headers=headers)
+    assert (response.status_code, response.json()["code"]) == (403, 2004)
+
+
+@patch('calibre_api.app.main.list_books')
+def test_downloaded_books_get_reading_progress(mock_list_books, client, koreader, tmp_path):
+    user, headers = koreader
+    epub = tmp_path / "Dune.epub"
+    epub.write_bytes(b"epub data")
+    mock_list_books.return_value = [{"id": 3, "title": "Dune", "authors": ["Frank Herbert"], "formats": [str(epub)]}]
+    session = accounts.create_session(user["id"])["token"]
+    assert client.get("/books/3/download", headers={"Authorization": f"Bearer {session}"}).status_code == 200
+
+    position = {"document": kosync.partial_md5(str(epub)), "progress": "/body/p[9]", "percentage": 0.5, "device": "Kobo"}
+    assert client.put("/syncs/progress", json=position, headers=headers).status_code == 200
+    progress = reading.get_progress(user["id"], 3)
+    assert (progress["percentage"], progress["position"], progress["format"], progress["device"]) == (50, "/body/p[9]", "EPUB", "Kobo")
+
+
+@patch('calibre_api.app.main.crud.export_book_file', return_value=b"exported epub data")
+def test_opds_downloads_are_linked_too(mock_export, client, koreader):
+    user, headers = koreader
+    session = accounts.create_session(user["id"])["token"]
+    assert client.get("/books/3/file/epub", headers={"Authorization": f"Bearer {session}"}).status_code == 200
+    assert kosync.book_for_document(kosync.partial_md5(b"exported epub data"))["book_id"] == 3
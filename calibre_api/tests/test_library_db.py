@@ -0,0 +1,114 @@
+import os
+import sqlite3
+import pytest
+from unittest import mock
+
+from calibre_api.app import library_db
+from calibre_api.app.library_db import QueryError, resolve_library_path, run_read_only_query
+
+
+def make_library(tmp_path):
+    conn = sqlite3.connect(str(tmp_path / "metadata.db"))
+    conn.execute("CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT, pubdate TEXT)")
+    conn.executemany("INSERT INTO books (title, pubdate) VALUES (?, ?)",
+                     [("Dune", "1965-08-01"), ("Emma", "1815-12-23"), ("Neuromancer", "1984-07-01")])
+    conn.commit()
+    conn.close()
+    return str(tmp_path)
+
+
+def test_select_returns_columns_and_rows(tmp_path):
+    library = make_library(tmp_path)
+    result = run_read_only_query(library, "SELECT id, title FROM books WHERE pubdate > ? ORDER BY title", ["1900"])
+    assert result == {"columns": ["id", "title"], "rows": [[1, "Dune"], [3, "Neuromancer"]], "truncated": False}
+
+
+def test_max_rows_truncates(tmp_path):
+    library = make_library(tmp_path)
+    result = run_read_only_query(library, "SELECT title FROM books ORDER BY id", max_rows=2)
+    assert result["rows"] == [["Dune"], ["Emma"]]
+    assert result["truncated"] is True
+
+
+@pytest.mark.parametrize("sql", [
+    "DELETE FROM books",
+    "UPDATE books SET title = 'x'",
+    "INSERT INTO books (title) VALUES ('x')",
+    "DROP TABLE books",
+    "PRAGMA journal_mode = WAL",
+    "ATTACH DATABASE '/tmp/other.db' AS other",
+    "CREATE TEMP TABLE t (x)",
+])
+def test_writes_and_pragmas_are_rejected(tmp_path, sql):
+    library = make_library(tmp_path)
+    with pytest.raises(QueryError):
+        run_read_only_query(library, sql)
+    # The library is untouched.
+    assert run_read_only_query(library, "SELECT COUNT(*) FROM books")["rows"] == [[3]]
+
+
+def test_multiple_statements_are_rejected(tmp_path):
+    library = make_library(tmp_path)
+    with pytest.raises(QueryError):
+        run_read_only_query(library, "SELECT 1; DELETE FROM books")
+
+
+def test_recursive_cte_is_allowed(tmp_path):
+    library = make_library(tmp_path)
+    sql = "WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n WHERE x < 3) SELECT x FROM n"
+    assert run_read_only_query(library, sql)["rows"] == [[1], [2], [3]]
+
+
+def test_long_running_query_times_out(tmp_path):
+    library = make_library(tmp_path)
+    sql = "WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n) SELECT COUNT(*) FROM n"
+    with pytest.raises(QueryError, match="time limit"):
+        run_read_only_query(library, sql, timeout=0.2)
+
+
+def test_resolve_library_path_falls_back_to_env(tmp_path):
+    library = make_library(tmp_path)
+    with mock.patch.dict(os.environ, {"CALIBRE_LIBRARY_PATH": library}):
+        assert resolve_library_path(None) == library
+
+
+def test_resolve_library_path_requires_metadata_db(tmp_path):
+    with pytest.raises(ValueError, match="metadata.db"):
+        resolve_library_path(str(tmp_path))
+    with mock.patch.dict(os.environ, {}, clear=True):
+        with pytest.raises(ValueError, match="CALIBRE_LIBRARY_PATH"):
+            resolve_library_path(None)
+
+
+def test_sql_query_enabled():
+    with mock.patch.dict(os.environ, {"SHELFSTONE_ENABLE_SQL_QUERY": "1"}):
+        assert library_db.sql_query_enabled()
+    with mock.patch.dict(os.environ, {}, clear=True):
+        assert not library_db.sql_query_enabled()
+
+
+def test_describe_schema(tmp_path):
+    library = make_library(tmp_path)
+    conn = sqlite3.connect(str(tmp_path / "metadata.db"))
+    conn.execute("CREATE TABLE custom_columns (id INTEGER PRIMARY KEY, label TEXT, name TEXT, datatype TEXT, is_multiple BOOL)")
+    conn.execute("INSERT INTO custom_columns VALUES (1, 'read', 'Read', 'bool', 0)")
+    conn.execute("CREATE VIEW titles AS SELECT title FROM books")
+    conn.execute("PRAGMA user_version = 26")
+    conn.commit()
+    conn.close()
+
+    schema = library_db.describe_schema(library)
+
+    assert schema["schema_version"] == 26
+    tables = {t["name"]: t for t in schema["tables"]}
+    assert set(tables) == {"books", "custom_columns", "titles"}
+    assert tables["titles"]["type"] == "view"
+    assert tables["books"]["columns"][0] == {"name": "id", "type": "INTEGER", "not_null": False, "primary_key": True}
+    assert schema["custom_columns"] == [
+        {"id": 1, "label": "read", "name": "Read", "datatype": "bool", "is_multiple": False, "table": "custom_column_1"}
+    ]
+
+
+def test_describe_schema_without_custom_columns(tmp_path):
+    library = make_library(tmp_path)
+    assert library_db.describe_schema(library)["custom_columns"] == []
@@ -0,0 +1,67 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import duplicates, library_import, provenance
+from calibre_api.app.crud import CalibredbError
+
+EPUB = b"PK\x03\x04" + b"\x00" * 22 + b"\x08\x00\x00\x00" + b"mimetype" + b"application/epub+zip"
+
+
+@pytest.fixture
+def folder(tmp_path):
+    (tmp_path / "Herbert").mkdir()
+    (tmp_path / "Herbert" / "Dune.epub").write_bytes(EPUB + b"dune")
+    (tmp_path / "Herbert" / "Messiah.epub").write_bytes(EPUB + b"messiah")
+    (tmp_path / "Herbert" / "cover.png").write_bytes(b"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+    (tmp_path / ".hidden").mkdir()
+    (tmp_path / ".hidden" / "Old.epub").write_bytes(EPUB + b"old")
+    return tmp_path
+
+
+def test_find_ebooks(folder):
+    found = library_import.find_ebooks(str(folder))
+    assert [os.path.basename(p) for p in found["ebooks"]] == ["Dune.epub", "Messiah.epub"]
+    assert [os.path.basename(p) for p in found["ignored"]] == ["cover.png"]
+
+
+def test_import_directory_adds_new_files(folder):
+    messiah_hash = duplicates.file_hash(str(folder / "Herbert" / "Messiah.epub"))
+    add = mock.Mock(return_value=[57])
+    with mock.patch.object(library_import, "list_books", return_value=[{"id": 3, "identifiers": {"import": messiah_hash}}]):
+        result = library_import.import_directory(str(folder), add=add, attach=mock.Mock(return_value=None))
+    assert (result["added"], result["skipped"], result["failed"], result["ignored"]) == (1, 1, 0, 1)
+    assert result["results"][0] == {"path": os.path.join("Herbert", "Dune.epub"), "status": "added", "book_ids": [57], "reason": None}
+    assert result["results"][1]["reason"] == "Imported before."
+    identifiers = add.call_args[1]["identifiers"]
+    assert identifiers == {"import": duplicates.file_hash(str(folder / "Herbert" / "Dune.epub"))}
+    source = provenance.sources_of([57])[57]
+    assert (source["source"], source["detail"]) == ("import", str(folder / "Herbert" / "Dune.epub"))
+
+
+def test_import_directory_dry_run_and_failures(folder):
+    with mock.patch.object(library_import, "list_books", return_value=[]):
+        add = mock.Mock()
+        result = library_import.import_directory(str(folder), dry_run=True, add=add)
+        add.assert_not_called()
+        assert result["would_add"] == 2
+
+        add = mock.Mock(side_effect=[CalibredbError("calibredb add failed."), []])
+        result = library_import.import_directory(str(folder), add=add, attach=mock.Mock(return_value=None))
+    assert [r["status"] for r in result["results"]] == ["failed", "skipped"]
+    assert result["results"][0]["reason"] == "calibredb add failed."
+
+
+def test_import_directory_adds_other_formats_to_existing_books(folder):
+    add = mock.Mock(return_value=[58])
+    attach = mock.Mock(side_effect=[12, None])
+    with mock.patch.object(library_import, "list_books", return_value=[]):
+        result = library_import.import_directory(str(folder), add=add, attach=attach)
+    assert [(r["status"], r["book_ids"]) for r in result["results"]] == [("format_added", [12]), ("added", [58])]
+    assert (result["format_added"], result["added"]) == (1, 1)
+    assert add.call_args[1]["file_path"].endswith("Messiah.epub")
+
+
+def test_import_directory_missing(tmp_path):
+    with pytest.raises(ValueError):
+        library_import.import_directory(str(tmp_path / "missing"))
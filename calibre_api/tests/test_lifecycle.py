@@ -0,0 +1,121 @@
+import asyncio
+import os
+import threading
+import pytest
+from unittest import mock
+
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, lifecycle
+from calibre_api.app.main import app
+
+
+@pytest.fixture(autouse=True)
+def clean_state():
+    lifecycle.reset()
+    yield
+    lifecycle.reset()
+
+
+def test_job_is_tracked_while_running():
+    with lifecycle.job("conversion of book ID 3"):
+        assert lifecycle.running_jobs() == ["conversion of book ID 3"]
+    assert lifecycle.running_jobs() == []
+
+
+def test_wait_for_jobs_returns_when_jobs_finish():
+    started, release = threading.Event(), threading.Event()
+
+    def work():
+        with lifecycle.job("full-text indexing"):
+            started.set()
+            release.wait(5)
+
+    thread = threading.Thread(target=work)
+    thread.start()
+    started.wait(5)
+    assert lifecycle.wait_for_jobs(0.05) == ["full-text indexing"]
+    release.set()
+    assert lifecycle.wait_for_jobs(5) == []
+    thread.join()
+
+
+def test_lifespan_marks_shutdown_and_waits():
+    async def run():
+        async with lifecycle.lifespan(None):
+            assert not lifecycle.shutting_down()
+        assert lifecycle.shutting_down()
+
+    with mock.patch.object(lifecycle, "wait_for_jobs", return_value=[]) as wait, \
+         mock.patch.dict(os.environ, {"SHELFSTONE_SHUTDOWN_TIMEOUT": "7"}), \
+         lifecycle.job("delivery 1 to 'kindle'"):
+        asyncio.run(run())
+    wait.assert_called_once_with(7.0)
+
+
+def test_shutdown_timeout():
+    with mock.patch.dict(os.environ, {"SHELFSTONE_SHUTDOWN_TIMEOUT": "bad"}):
+        assert lifecycle.shutdown_timeout() == lifecycle.DEFAULT_SHUTDOWN_TIMEOUT
+    with mock.patch.dict(os.environ, {"SHELFSTONE_SHUTDOWN_TIMEOUT": "-5"}):
+        assert lifecycle.shutdown_timeout() == 0.0
+
+
+def test_cancel_jobs_sets_the_job_cancel_event():
+    assert lifecycle.current_cancel_event() is None
+    with lifecycle.job("full-text indexing"):
+        cancel = lifecycle.current_cancel_event()
+        assert not cancel.is_set()
+        lifecycle.cancel_jobs()
+        assert cancel.is_set()
+    assert lifecycle.current_cancel_event() is None
+
+
+def test_jobs_can_be_listed_and_cancelled_one_by_one():
+    with pytest.raises(ValueError):
+        with lifecycle.job("full-text indexing", "urgent"):
+            pass
+    assert lifecycle.current_priority() == lifecycle.INTERACTIVE
+    with lifecycle.job("full-text indexing", lifecycle.BULK) as indexing, \
+         lifecycle.job("delivery 1 to 'kindle'", user_id=7) as delivery:
+        assert lifecycle.current_priority() == lifecycle.NORMAL
+        lifecycle.set_command("calibre-smtp", lifecycle.WAITING)
+        job = lifecycle.list_jobs(user_id=7)[0]
+        assert (job["id"], job["state"], job["command"], job["cancelled"]) == (delivery, "waiting", "calibre-smtp", False)
+        assert [j["priority"] for j in lifecycle.list_jobs()] == ["bulk", "normal"]
+
+        assert lifecycle.cancel_job(indexing)["cancelled"]
+        assert not lifecycle.current_cancel_event().is_set()
+        assert lifecycle.get_job(indexing)["cancelled"]
+    with pytest.raises(lifecycle.JobNotFound):
+        lifecycle.cancel_job(indexing)
+
+
+# --- Tests for /jobs ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def sign_in(username, **kwargs):
+    user = accounts.create_user(username, "password1", **kwargs)
+    return user, {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+
+def test_job_endpoints(client):
+    _, admin_headers = sign_in("admin", role=accounts.ADMIN)
+    ana, ana_headers = sign_in("ana")
+    _, lee_headers = sign_in("lee")
+    with lifecycle.job("import of '/srv/ebooks'", lifecycle.BULK, ana["id"]) as job_id, \
+         lifecycle.job("full-text indexing", lifecycle.BULK):
+        assert [j["name"] for j in client.get("/jobs", headers=ana_headers).json()] == ["import of '/srv/ebooks'"]
+        assert len(client.get("/jobs", headers=admin_headers).json()) == 2
+        # Users only see and cancel the jobs they started.
+        assert client.get("/jobs", headers=lee_headers).json() == []
+        assert client.post(f"/jobs/{job_id}/cancel", headers=lee_headers).status_code == 404
+        response = client.post(f"/jobs/{job_id}/cancel", headers=ana_headers)
+        assert response.status_code == 202 and response.json()["cancelled"]
+        assert client.get(f"/jobs/{job_id}", headers=admin_headers).json()["cancelled"]
+    assert client.post(f"/jobs/{job_id}/cancel", headers=admin_headers).status_code == 404
@@ -0,0 +1,80 @@
+import os
+import pytest
+from unittest import mock
+from fastapi import FastAPI, Request
+from fastapi.testclient import TestClient
+
+from calibre_api.app.limits import BodySizeLimitMiddleware, parse_route_limits, load_limits_from_env, limit_for_path, MB
+
+
+def test_parse_route_limits():
+    assert parse_route_limits("/books/add/=200, /uploads/=0.5") == {"/books/add/": 200 * MB, "/uploads/": MB // 2}
+    assert parse_route_limits("") == {}
+
+
+@pytest.mark.parametrize("value", ["books=5", "/books/", "/books/=lots"])
+def test_parse_route_limits_invalid(value):
+    with pytest.raises(ValueError):
+        parse_route_limits(value)
+
+
+def test_load_limits_from_env():
+    with mock.patch.dict("os.environ", {"SHELFSTONE_MAX_BODY_MB": "10", "SHELFSTONE_BODY_LIMITS_MB": "/uploads/=1"}):
+        limits = load_limits_from_env()
+    assert limits == {"/": 10 * MB, "/uploads/": 1 * MB}
+
+
+def test_limit_for_path_uses_longest_prefix():
+    limits = {"/": 100, "/uploads/": 10, "/uploads/big/": 0}
+    assert limit_for_path("/books/add/", limits) == 100
+    assert limit_for_path("/uploads/abc", limits) == 10
+    assert limit_for_path("/uploads/big/abc", limits) is None  # 0 disables the check
+    assert limit_for_path("/books/", {"/uploads/": 10}) is None
+
+
+@pytest.fixture(scope="module")
+def client():
+    app = FastAPI()
+    app.add_middleware(BodySizeLimitMiddleware, limits={"/": 1000, "/small/": 10})
+
+    @app.post("/small/")
+    async def small(request: Request):
+        return {"size": len(await request.body())}
+
+    @app.post("/large/")
+    async def large(request: Request):
+        return {"size": len(await request.body())}
+
+    return TestClient(app)
+
+
+def test_body_within_limit(client):
+    assert client.post("/small/", content=b"x" * 10).json() == {"size": 10}
+
+
+def test_body_over_route_limit(client):
+    response = client.post("/small/", content=b"x" * 11)
+    assert response.status_code == 413
+    assert client.post("/large/", content=b"x" * 11).status_code == 200
+
+
+def test_streamed_body_over_limit(client):
+    def chunks():
+        for _ in range(5):
+            yield b"x" * 5
+    assert client.post("/small/", content=chunks()).status_code == 413
+
+
+def test_limits_from_env_follow_reloads():
+    app = FastAPI()
+
+    @app.post("/books/add/")
+    async def add(request: Request):
+        return {"size": len(await request.body())}
+
+    with mock.patch.dict("os.environ", {"SHELFSTONE_MAX_BODY_MB": "1", "SHELFSTONE_BODY_LIMITS_MB": ""}):
+        app.add_middleware(BodySizeLimitMiddleware)
+        client = TestClient(app)
+        assert client.post("/books/add/", content=b"x" * 100).status_code == 200
+        os.environ["SHELFSTONE_BODY_LIMITS_MB"] = "/books/add/=0.00001"
+        assert client.post("/books/add/", content=b"x" * 100).status_code == 413
@@ -0,0 +1,50 @@
+import pytest
+from unittest import mock
+
+from calibre_api.app import localeformat
+
+
+def test_get_locale_falls_back_to_language():
+    assert localeformat.get_locale("de_CH") is localeformat.LOCALES["de"]
+    assert localeformat.get_locale("en-US").date_format == "%m/%d/%Y"
+    assert localeformat.get_locale(None) is localeformat.LOCALES["en"]
+    with pytest.raises(ValueError):
+        localeformat.get_locale("xx")
+
+
+def test_format_number_and_date():
+    de = localeformat.get_locale("de")
+    assert localeformat.format_number(1234.5, de) == "1234,50"
+    assert localeformat.format_number(None, de) == ""
+    assert localeformat.format_date("2026-03-04", de) == "04.03.2026"
+    assert localeformat.format_date(None, de) == ""
+
+
+def test_parse_rates():
+    assert localeformat.parse_rates(" usd=0.92, GBP=1.17 ") == {"USD": 0.92, "GBP": 1.17}
+    assert localeformat.parse_rates(None) == {}
+    for bad in ("USD", "USD=abc", "USD=-1", "DOLLAR=1"):
+        with pytest.raises(ValueError):
+            localeformat.parse_rates(bad)
+
+
+def test_exchange_rates_default_from_environment():
+    with mock.patch.dict("os.environ", {"SHELFSTONE_EXCHANGE_RATES": "USD=0.5"}):
+        assert localeformat.exchange_rates() == {"USD": 0.5}
+        assert localeformat.exchange_rates("USD=0.9") == {"USD": 0.9}
+
+
+def test_convert():
+    assert localeformat.convert(10.0, "EUR", "EUR", {}) == 10.0
+    assert localeformat.convert(10.0, "USD", "EUR", {"USD": 0.923}) == 9.23
+    with pytest.raises(ValueError):
+        localeformat.convert(10.0, "GBP", "EUR", {"USD": 0.9})
+    with pytest.raises(ValueError):
+        localeformat.convert(10.0, None, "EUR", {})
+
+
+def test_sort_key_across_scripts():
+    names = ["‏محمد شكري", "zola", "Ｄｕｎｅ", "村上春樹", "Émile", "ﾉﾙｳｪｲ", "한강", "adams"]
+    assert sorted(names, key=localeformat.sort_key) == [
+        "adams", "Ｄｕｎｅ", "zola", "Émile", "‏محمد شكري", "ﾉﾙｳｪｲ", "村上春樹", "한강"]
+    assert localeformat.sort_key("STRASSE") == localeformat.sort_key("straße")
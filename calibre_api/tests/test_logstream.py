@@ -0,0 +1,80 @@
+import logging
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import logstream
+from calibre_api.app.logstream import RingBufferHandler, matches_component
+
+
+@pytest.fixture
+def buffer_logger():
+    handler = RingBufferHandler(capacity=3)
+    log = logging.getLogger("calibre_api.app.crud")
+    log.addHandler(handler)
+    log.setLevel(logging.DEBUG)
+    yield handler, log
+    log.removeHandler(handler)
+
+
+def test_ring_buffer_keeps_newest_entries(buffer_logger):
+    handler, log = buffer_logger
+    for i in range(5):
+        log.info(f"message {i}")
+    entries = handler.entries()
+    assert [e["message"] for e in entries] == ["message 2", "message 3", "message 4"]
+    assert [e["seq"] for e in entries] == [3, 4, 5]
+    assert handler.last_seq == 5
+    assert entries[0]["component"] == "calibre_api.app.crud"
+
+
+def test_entries_filters(buffer_logger):
+    handler, log = buffer_logger
+    log.debug("details")
+    log.warning("careful")
+    log.error("failed")
+    assert [e["message"] for e in handler.entries(level="warning")] == ["careful", "failed"]
+    assert [e["message"] for e in handler.entries(since=2)] == ["failed"]
+    assert [e["message"] for e in handler.entries(limit=1)] == ["failed"]
+    assert handler.entries(component="uvicorn") == []
+
+
+def test_exceptions_are_included(buffer_logger):
+    handler, log = buffer_logger
+    try:
+        raise RuntimeError("boom")
+    except RuntimeError:
+        log.error("Import failed", exc_info=True)
+    assert "RuntimeError: boom" in handler.entries()[-1]["message"]
+
+
+@pytest.mark.parametrize("name,component,expected", [
+    ("calibre_api.app.crud", "crud", True),
+    ("app.crud", "crud", True),
+    ("app.crud", "app.crud", True),
+    ("uvicorn.error", "uvicorn", True),
+    ("calibre_api.app.crud_extra", "crud", False),
+    ("calibre_api.app.calibre_cli", "crud", False),
+])
+def test_matches_component(name, component, expected):
+    assert matches_component(name, component) is expected
+
+
+def test_validate_level():
+    assert logstream.validate_level("info") == "info"
+    assert logstream.validate_level(None) is None
+    with pytest.raises(ValueError):
+        logstream.validate_level("LOUD")
+
+
+def test_format_sse():
+    entry = {"seq": 7, "time": 1.0, "level": "INFO", "component": "app.crud", "message": "hi"}
+    assert logstream.format_sse(entry).startswith("id: 7\nevent: log\ndata: {")
+    assert logstream.format_sse(entry).endswith("\n\n")
+
+
+def test_endpoint_is_disabled_by_default():
+    with mock.patch.dict(os.environ, {}, clear=True):
+        assert not logstream.endpoint_enabled()
+    with mock.patch.dict(os.environ, {"SHELFSTONE_ENABLE_ADMIN_LOGS": "1"}):
+        assert logstream.endpoint_enabled()
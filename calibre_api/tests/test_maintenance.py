@@ -0,0 +1,110 @@
+import pytest
+from fastapi.testclient import TestClient
+from unittest.mock import patch
+
+from calibre_api.app.main import app
+from calibre_api.app.calibre_cli import CalibreCLIError
+
+
+@pytest.fixture(scope="module")
+def client():
+    return TestClient(app)
+
+
+LIBRARY_BOOKS = [
+    {
+        "id": 1,
+        "title": "Dune",
+        "authors": ["Frank Herbert"],
+        "publisher": None,
+        "tags": [],
+        "formats": ["/library/Frank Herbert/Dune (1)/Dune - Frank Herbert.epub"],
+    },
+    {
+        "id": 2,
+        "title": "No Files",
+        "authors": ["Someone"],
+        "formats": [],
+    },
+]
+
+
+# --- Tests for POST /maintenance/reextract/ ---
+
+@patch('calibre_api.app.main.set_book_metadata')
+@patch('calibre_api.app.main.metadata_utils.read_file_metadata')
+@patch('calibre_api.app.main.crud.export_book_file', return_value=b"epub bytes")
+@patch('calibre_api.app.main.list_books')
+def test_reextract_fills_empty_fields(mock_list_books, mock_export, mock_read_meta, mock_set_meta, client):
+    mock_list_books.return_value = [dict(b) for b in LIBRARY_BOOKS]
+    mock_read_meta.return_value = {"title": "Dune (File Title)", "publisher": "Chilton Books", "tags": ["Classic"]}
+    mock_set_meta.return_value = {"publisher": "Chilton Books", "tags": ["Classic"]}
+
+    response = client.post("/maintenance/reextract/", json={"ids": [1, 2], "imported_before": "2024-01-01"})
+    assert response.status_code == 200
+    data = response.json()
+    assert data["processed"] == 2
+    assert data["updated"] == 1
+    assert data["failed"] == 1
+
+    first, second = data["results"]
+    assert first["format"] == "EPUB"
+    assert sorted(first["updated_fields"]) == ["publisher", "tags"]  # title already set, not overwritten
+    assert second["error"] == "Book has no suitable format to read metadata from."
+
+    search_query = mock_list_books.call_args[1]["search_query"]
+    assert search_query == "(id:1 or id:2) and date:<2024-01-01"
+
+    mock_export.assert_called_once_with(book_id=1, format_extension="EPUB", library_path=None)
+    applied = mock_set_meta.call_args[1]["metadata"].model_dump(exclude_unset=True)
+    assert applied == {"publisher": "Chilton Books", "tags": ["Classic"]}
+
+
+@patch('calibre_api.app.main.list_books')
+def test_reextract_rejects_invalid_date(mock_list_books, client):
+    response = client.post("/maintenance/reextract/", json={"imported_before": "2024-01-01 or title:x"})
+    assert response.status_code == 422
+    mock_list_books.assert_not_called()
+
+
+@patch('calibre_api.app.main.set_book_metadata')
+@patch('calibre_api.app.main.metadata_utils.read_file_metadata', return_value={"publisher": "Chilton Books"})
+@patch('calibre_api.app.main.crud.export_book_file', return_value=b"epub bytes")
+@patch('calibre_api.app.main.list_books')
+def test_reextract_dry_run_does_not_write(mock_list_books, mock_export, mock_read_meta, mock_set_meta, client):
+    mock_list_books.return_value = [dict(LIBRARY_BOOKS[0])]
+
+    response = client.post("/maintenance/reextract/", json={"format": "epub", "dry_run": True})
+    assert response.status_code == 200
+    data = response.json()
+    assert data["dry_run"] is True
+    assert data["results"][0]["updated_fields"] == ["publisher"]
+    mock_set_meta.assert_not_called()
+    assert mock_list_books.call_args[1]["search_query"] == 'formats:"=EPUB"'
+
+
+@patch('calibre_api.app.main.list_books', return_value=[])
+def test_reextract_escapes_format(mock_list_books, client):
+    response = client.post("/maintenance/reextract/", json={"format": 'epub" or title:"x'})
+    assert response.status_code == 200
+    assert mock_list_books.call_args[1]["search_query"] == 'formats:"=EPUB\\" OR TITLE:\\"X"'
+
+
+@patch('calibre_api.app.main.metadata_utils.read_file_metadata', side_effect=CalibreCLIError("ebook-meta failed to read metadata"))
+@patch('calibre_api.app.main.crud.export_book_file', return_value=b"epub bytes")
+@patch('calibre_api.app.main.list_books')
+def test_reextract_reports_per_book_errors(mock_list_books, mock_export, mock_read_meta, client):
+    mock_list_books.return_value = [dict(LIBRARY_BOOKS[0])]
+
+    response = client.post("/maintenance/reextract/", json={})
+    assert response.status_code == 200
+    data = response.json()
+    assert data["failed"] == 1
+    assert "ebook-meta failed" in data["results"][0]["error"]
+    assert mock_list_books.call_args[1]["search_query"] is None
+
+
+@patch('calibre_api.app.main.list_books', side_effect=FileNotFoundError("calibredb not found"))
+def test_reextract_calibredb_not_found(mock_list_books, client):
+    response = client.post("/maintenance/reextract/", json={})
+    assert response.status_code == 503
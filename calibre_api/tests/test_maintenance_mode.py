@@ -0,0 +1,74 @@
+import asyncio
+import pytest
+
+from calibre_api.app import maintenance_mode
+from calibre_api.app.maintenance_mode import MaintenanceModeMiddleware
+
+
+@pytest.fixture(autouse=True)
+def reset_mode():
+    maintenance_mode.disable()
+    yield
+    maintenance_mode.disable()
+
+
+def call(method, path):
+    """Sends one request through the middleware and returns (status, headers)."""
+    sent = []
+
+    async def app(scope, receive, send):
+        await send({"type": "http.response.start", "status": 200, "headers": []})
+        await send({"type": "http.response.body", "body": b"ok"})
+
+    async def receive():
+        return {"type": "http.request", "body": b"", "more_body": False}
+
+    async def send(message):
+        sent.append(message)
+
+    asyncio.run(MaintenanceModeMiddleware(app)({"type": "http", "method": method, "path": path, "headers": []}, receive, send))
+    return sent[0]["status"], dict(sent[0]["headers"])
+
+
+def test_enable_and_expire():
+    status = maintenance_mode.enable(10, reason="Backup", now=1000.0)
+    assert status["enabled"] is True
+    assert status["remaining_seconds"] == 600
+    assert maintenance_mode.status(now=1599.5)["remaining_seconds"] == 1
+    expired = maintenance_mode.status(now=1600.0)
+    assert expired["enabled"] is False
+    assert expired["reason"] is None
+
+
+def test_enable_again_keeps_start_time():
+    maintenance_mode.enable(10, now=1000.0)
+    status = maintenance_mode.enable(5, now=1100.0)
+    assert status["started_at"] == 1000.0
+    assert status["until"] == 1400.0
+
+
+@pytest.mark.parametrize("minutes", [0, -1, maintenance_mode.MAX_DURATION_MINUTES + 1])
+def test_enable_rejects_invalid_duration(minutes):
+    with pytest.raises(ValueError):
+        maintenance_mode.enable(minutes)
+
+
+def test_blocks_request():
+    assert maintenance_mode.blocks_request("POST", "/books/add/")
+    assert maintenance_mode.blocks_request("delete", "/books/3/")
+    assert not maintenance_mode.blocks_request("GET", "/books/")
+    assert not maintenance_mode.blocks_request("POST", "/admin/maintenance-mode")
+    assert not maintenance_mode.blocks_request("POST", "/admin/query")
+
+
+def test_middleware_passes_writes_when_off():
+    assert call("POST", "/books/add/")[0] == 200
+
+
+def test_middleware_rejects_writes_when_on():
+    maintenance_mode.enable(2, reason="Migration")
+    status, headers = call("POST", "/books/add/")
+    assert status == 503
+    assert 1 <= int(headers[b"retry-after"]) <= 120
+    assert call("GET", "/books/")[0] == 200
+    assert call("POST", "/admin/maintenance-mode")[0] == 200
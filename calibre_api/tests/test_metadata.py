@@ -0,0 +1,160 @@
+import pytest
+from unittest import mock
+
+from calibre_api.app.metadata import parse_opf, fields_to_fill, is_empty_field, read_file_metadata, add_missing_covers
+from calibre_api.app.calibre_cli import CalibreCLIError
+
+SAMPLE_OPF = """<?xml version='1.0' encoding='utf-8'?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="uuid_id" version="2.0">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+        <dc:identifier opf:scheme="calibre" id="calibre_id">42</dc:identifier>
+        <dc:identifier opf:scheme="uuid" id="uuid_id">0b8c1c4e-1111-2222-3333-444455556666</dc:identifier>
+        <dc:title>Dune</dc:title>
+        <dc:creator opf:file-as="Herbert, Frank" opf:role="aut">Frank Herbert</dc:creator>
+        <dc:creator opf:role="ill">John Schoenherr</dc:creator>
+        <dc:publisher>Chilton Books</dc:publisher>
+        <dc:date>1965-08-01T00:00:00+00:00</dc:date>
+        <dc:language>eng</dc:language>
+        <dc:subject>Science Fiction</dc:subject>
+        <dc:subject>Classic</dc:subject>
+        <dc:description>A masterpiece of science fiction.</dc:description>
+        <dc:identifier opf:scheme="ISBN">9780441172719</dc:identifier>
+        <meta name="calibre:series" content="Dune Saga"/>
+        <meta name="calibre:series_index" content="1.0"/>
+        <meta name="calibre:rating" content="10"/>
+    </metadata>
+</package>
+"""
+
+
+def test_parse_opf_full():
+    parsed = parse_opf(SAMPLE_OPF)
+    assert parsed["title"] == "Dune"
+    assert parsed["authors"] == ["Frank Herbert"]  # illustrator skipped
+    assert parsed["publisher"] == "Chilton Books"
+    assert parsed["pubdate"] == "1965-08-01T00:00:00+00:00"
+    assert parsed["languages"] == ["eng"]
+    assert parsed["tags"] == ["Science Fiction", "Classic"]
+    assert parsed["comments"] == "A masterpiece of science fiction."
+    assert parsed["isbn"] == "9780441172719"
+    assert parsed["identifiers"] == {"isbn": "9780441172719"}  # calibre/uuid identifiers dropped
+    assert parsed["series"] == "Dune Saga"
+    assert parsed["series_index"] == 1.0
+    assert parsed["rating"] == 10.0
+
+
+def test_parse_opf_minimal_omits_missing_fields():
+    opf = """<package xmlns="http://www.idpf.org/2007/opf"><metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <dc:title>Only a title</dc:title></metadata></package>"""
+    assert parse_opf(opf) == {"title": "Only a title"}
+
+
+def test_parse_opf_invalid_xml():
+    with pytest.raises(ValueError):
+        parse_opf("<package><metadata>")
+
+
+def test_parse_opf_without_metadata():
+    with pytest.raises(ValueError):
+        parse_opf('<package xmlns="http://www.idpf.org/2007/opf"></package>')
+
+
+@pytest.mark.parametrize("field,value,expected", [
+    ("title", "Unknown", True),
+    ("title", "Dune", False),
+    ("authors", ["Unknown"], True),
+    ("authors", "Frank Herbert", False),
+    ("tags", [], True),
+    ("tags", "", True),
+    ("pubdate", "0101-01-01T00:00:00+00:00", True),
+    ("pubdate", "1965-08-01T00:00:00+00:00", False),
+    ("publisher", None, True),
+    ("publisher", "  ", True),
+    ("publisher", "Ace", False),
+])
+def test_is_empty_field(field, value, expected):
+    assert is_empty_field(field, value) is expected
+
+
+def test_fields_to_fill_never_overwrites_existing_data():
+    current = {
+        "title": "Dune (Curated Title)",
+        "authors": ["Frank Herbert"],
+        "publisher": None,
+        "pubdate": "0101-01-01T00:00:00+00:00",
+        "tags": [],
+        "series": None,
+        "comments": "Hand-written blurb.",
+    }
+    extracted = parse_opf(SAMPLE_OPF)
+    updates = fields_to_fill(current, extracted)
+
+    assert "title" not in updates
+    assert "authors" not in updates
+    assert "comments" not in updates
+    assert updates["publisher"] == "Chilton Books"
+    assert updates["pubdate"] == "1965-08-01T00:00:00+00:00"
+    assert updates["tags"] == ["Science Fiction", "Classic"]
+    assert updates["series"] == "Dune Saga"
+    assert updates["series_index"] == 1.0
+
+
+def test_fields_to_fill_series_index_only_with_series():
+    current = {"series": "Existing Series", "series_index": 3.0}
+    updates = fields_to_fill(current, {"series": "Other", "series_index": 1.0})
+    assert updates == {}
+
+
+@mock.patch('calibre_api.app.metadata.calibre_cli.get_ebook_metadata')
+def test_read_file_metadata(mock_get_meta):
+    def write_opf(ebook_file_path, output_opf_file):
+        with open(output_opf_file, "w", encoding="utf-8") as f:
+            f.write(SAMPLE_OPF)
+        return output_opf_file
+    mock_get_meta.side_effect = write_opf
+
+    parsed = read_file_metadata("/books/dune.epub")
+    assert parsed["title"] == "Dune"
+    assert mock_get_meta.call_args[1]["ebook_file_path"] == "/books/dune.epub"
+
+
+@mock.patch('calibre_api.app.metadata.calibre_cli.get_ebook_metadata')
+@mock.patch('calibre_api.app.metadata.fb2.read_metadata', return_value={"title": "Мастер и Маргарита"})
+def test_read_file_metadata_parses_fb2_natively(mock_fb2, mock_get_meta):
+    assert read_file_metadata("/books/master.fb2.zip") == {"title": "Мастер и Маргарита"}
+    mock_get_meta.assert_not_called()
+
+
+@mock.patch('calibre_api.app.metadata.djvu.read_metadata', return_value={"title": "Handbook", "publisher": "Dover"})
+@mock.patch('calibre_api.app.metadata.calibre_cli.get_ebook_metadata')
+def test_read_file_metadata_prefers_djvused_for_djvu(mock_get_meta, mock_djvu):
+    def write_opf(ebook_file_path, output_opf_file):
+        with open(output_opf_file, "w", encoding="utf-8") as f:
+            f.write(SAMPLE_OPF.replace("<dc:title>Dune</dc:title>", "<dc:title>scan</dc:title>"))
+    mock_get_meta.side_effect = write_opf
+    parsed = read_file_metadata("/books/scan.djvu")
+    assert parsed["title"] == "Handbook"
+    assert parsed["publisher"] == "Dover"
+    assert parsed["authors"] == ["Frank Herbert"]
+
+    mock_get_meta.side_effect = CalibreCLIError("ebook-meta failed")
+    assert read_file_metadata("/books/scan.djvu") == {"title": "Handbook", "publisher": "Dover"}
+    with pytest.raises(CalibreCLIError):
+        read_file_metadata("/books/dune.epub")
+
+
+@mock.patch('calibre_api.app.metadata.crud.set_book_cover')
+@mock.patch('calibre_api.app.metadata.crud.list_books')
+@mock.patch('calibre_api.app.metadata.djvu.render_cover', return_value="/tmp/cover.jpg")
+def test_add_missing_covers(mock_render, mock_list, mock_set_cover):
+    mock_list.return_value = [{"id": 4, "cover": None}, {"id": 5, "cover": "/lib/5/cover.jpg"}]
+    add_missing_covers([4, 5], "/books/scan.djvu", library_path="/lib")
+    assert mock_list.call_args[1]["search_query"] == "id:4 or id:5"
+    mock_set_cover.assert_called_once_with(4, "/tmp/cover.jpg", library_path="/lib")
+
+    mock_list.reset_mock()
+    add_missing_covers([6], "/books/dune.epub")
+    mock_list.assert_not_called()
+
+    mock_list.side_effect = CalibreCLIError("calibredb failed")
+    add_missing_covers([4], "/books/scan.djvu")  # Logged, not raised.
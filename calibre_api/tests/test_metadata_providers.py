@@ -0,0 +1,108 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import metadata_providers
+from calibre_api.app.metadata_providers import ProviderError
+
+GOOGLE_VOLUMES = {
+    "items": [{
+        "id": "B1hSG45JCX4C",
+        "volumeInfo": {
+            "title": "Dune", "subtitle": "Deluxe Edition", "authors": ["Frank Herbert"], "publisher": "Penguin",
+            "publishedDate": "1990-09", "description": "Set on the desert planet Arrakis.",
+            "categories": ["Fiction"], "language": "en",
+            "industryIdentifiers": [{"type": "ISBN_10", "identifier": "0441172717"}, {"type": "OTHER", "identifier": "X"}],
+            "imageLinks": {"thumbnail": "http://books.google.com/books/content?id=B1hSG45JCX4C&img=1&edge=curl"},
+        },
+    }],
+}
+
+OPEN_LIBRARY_SEARCH = {
+    "docs": [{
+        "key": "/works/OL893415W", "title": "Dune", "author_name": ["Frank Herbert"], "publisher": ["Ace", "Chilton"],
+        "first_publish_year": 1965, "isbn": ["9780340960196", "9780441172719"], "language": ["eng"],
+        "subject": [f"Subject {i}" for i in range(15)], "cover_i": 11481354, "cover_edition_key": "OL26242482M",
+    }],
+}
+
+
+def test_google_books_parses_volume():
+    with mock.patch.object(metadata_providers, "http_get_json", return_value=GOOGLE_VOLUMES) as mock_get, \
+            mock.patch.dict(os.environ, {"SHELFSTONE_GOOGLE_BOOKS_API_KEY": "k"}):
+        [candidate] = metadata_providers.PROVIDERS["google"].search(isbn="9780441172719")
+    assert "q=isbn%3A9780441172719" in mock_get.call_args[0][0] and "key=k" in mock_get.call_args[0][0]
+    assert candidate == {
+        "provider": "google", "title": "Dune: Deluxe Edition", "authors": ["Frank Herbert"], "publisher": "Penguin",
+        "pubdate": "1990-09-01", "isbn": "9780441172719",
+        "identifiers": {"google": "B1hSG45JCX4C", "isbn": "9780441172719"}, "tags": ["Fiction"],
+        "comments": "Set on the desert planet Arrakis.", "languages": ["en"], "series": None, "series_index": None,
+        "cover_url": "https://books.google.com/books/content?id=B1hSG45JCX4C&img=1",
+    }
+
+
+def test_open_library_parses_search_doc():
+    with mock.patch.object(metadata_providers, "http_get_json", return_value=OPEN_LIBRARY_SEARCH) as mock_get:
+        [candidate] = metadata_providers.PROVIDERS["openlibrary"].search(title="Dune", authors=["Frank Herbert"])
+    assert "title=Dune" in mock_get.call_args[0][0] and "author=Frank+Herbert" in mock_get.call_args[0][0]
+    assert candidate["publisher"] == "Ace" and candidate["pubdate"] == "1965-01-01"
+    assert candidate["isbn"] == "9780340960196"
+    assert candidate["identifiers"] == {"openlibrary": "OL26242482M", "isbn": "9780340960196"}
+    assert len(candidate["tags"]) == 10 and candidate["languages"] == ["eng"]
+    assert candidate["cover_url"] == "https://covers.openlibrary.org/b/id/11481354-L.jpg"
+
+
+def test_fetch_candidates_collects_provider_errors():
+    def fake_get(url, timeout):
+        if "googleapis" in url:
+            raise ProviderError("Could not reach www.googleapis.com: timed out")
+        return OPEN_LIBRARY_SEARCH
+
+    with mock.patch.object(metadata_providers, "http_get_json", side_effect=fake_get):
+        candidates, errors = metadata_providers.fetch_candidates(isbn="0-441-17271-7")
+    assert [c["provider"] for c in candidates] == ["openlibrary"]
+    assert candidates[0]["isbn"] == "9780441172719"  # The ISBN searched for wins.
+    assert errors == {"google": "Could not reach www.googleapis.com: timed out"}
+
+    with pytest.raises(ValueError):
+        metadata_providers.fetch_candidates(authors=["Frank Herbert"])
+    with pytest.raises(ValueError):
+        metadata_providers.fetch_candidates(title="Dune", providers=["goodreads"])
+
+
+def test_parse_providers():
+    assert metadata_providers.parse_providers(" OpenLibrary, google ") == ["openlibrary", "google"]
+    with pytest.raises(ValueError, match="goodreads"):
+        metadata_providers.parse_providers("google,goodreads")
+
+
+def test_select_updates_merges_identifiers_and_skips_empty_fields():
+    candidate = {"provider": "google", "title": "Dune", "authors": ["Frank Herbert"], "publisher": None, "tags": [],
+                 "identifiers": {"google": "B1hSG45JCX4C"}, "series_index": None, "cover_url": "https://example.org/c.jpg"}
+    current = {"identifiers": {"isbn": "9780441172719"}}
+    assert metadata_providers.select_updates(candidate, None, current) == {
+        "title": "Dune", "authors": ["Frank Herbert"], "cover": "https://example.org/c.jpg",
+        "identifiers": {"isbn": "9780441172719", "google": "B1hSG45JCX4C"},
+    }
+    assert metadata_providers.select_updates(candidate, ["title", "publisher"], current) == {"title": "Dune"}
+    with pytest.raises(ValueError, match="rating"):
+        metadata_providers.select_updates(candidate, ["rating"], current)
+
+
+def test_file_metadata_options():
+    options = metadata_providers.file_metadata_options(
+        {"title": "Dune", "authors": ["Frank Herbert", "Brian Herbert"], "languages": ["eng"],
+         "identifiers": {"isbn": "9780441172719"}}, cover_path="/tmp/cover.jpg")
+    assert options == ["--title", "Dune", "--authors", "Frank Herbert & Brian Herbert", "--language", "eng",
+                       "--identifier", "isbn:9780441172719", "--cover", "/tmp/cover.jpg"]
+
+
+def test_download_cover_checks_url_and_content_type(tmp_path):
+    with pytest.raises(ValueError):
+        metadata_providers.download_cover("file:///etc/passwd", str(tmp_path))
+    with mock.patch.object(metadata_providers, "http_get", return_value=(b"<html>", "text/html")):
+        with pytest.raises(ProviderError):
+            metadata_providers.download_cover("https://example.org/c.jpg", str(tmp_path))
+    with mock.patch.object(metadata_providers, "http_get", return_value=(b"\xff\xd8jpeg", "image/jpeg")):
+        path = metadata_providers.download_cover("https://example.org/c.jpg", str(tmp_path))
+    assert path.endswith(".jpg") and open(path, "rb").read() == b"\xff\xd8jpeg"
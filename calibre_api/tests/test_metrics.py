@@ -0,0 +1,72 @@
+import pytest
+import subprocess
+from unittest import mock
+
+from calibre_api.app import metrics
+from calibre_api.app.calibre_cli import run_calibre_command, CalibreCLIError
+
+
+@pytest.fixture(autouse=True)
+def reset_metrics():
+    metrics.reset()
+    yield
+    metrics.reset()
+
+
+@pytest.mark.parametrize("stderr,returncode,expected", [
+    ("calibre.ebooks.DRMError: This file is locked with DRM", 1, metrics.ERROR_DRM),
+    ("ValueError: No plugin to handle input format: xyz", 1, metrics.ERROR_UNSUPPORTED_FORMAT),
+    ("zipfile.BadZipFile: File is not a zip file", 1, metrics.ERROR_CORRUPT_FILE),
+    ("apsw.BusyError: database is locked", 1, metrics.ERROR_LIBRARY_LOCKED),
+    ("Timeout after 60 seconds.", -1, metrics.ERROR_TIMEOUT),
+    ("Something odd happened", 1, metrics.ERROR_UNKNOWN),
+    (None, 2, metrics.ERROR_UNKNOWN),
+])
+def test_classify_failure(stderr, returncode, expected):
+    assert metrics.classify_failure(stderr, returncode) == expected
+
+
+def test_cli_error_exposes_error_type():
+    assert CalibreCLIError("failed", stderr="DRMError", returncode=1).error_type == metrics.ERROR_DRM
+
+
+@mock.patch('calibre_api.app.calibre_cli.subprocess.run')
+def test_run_calibre_command_records_failures(mock_run, tmp_path):
+    book = tmp_path / "broken.epub"
+    book.write_bytes(b"garbage")
+    mock_run.return_value = mock.Mock(returncode=1, stdout="", stderr="zipfile.BadZipFile: File is not a zip file")
+
+    run_calibre_command(["ebook-convert", str(book), str(tmp_path / "out.mobi")])
+
+    failures = metrics.recent_failures()
+    assert len(failures) == 1
+    assert failures[0]["tool"] == "ebook-convert"
+    assert failures[0]["error_type"] == metrics.ERROR_CORRUPT_FILE
+    assert failures[0]["target"] == str(book)
+
+    text = metrics.render_prometheus()
+    assert 'shelfstone_calibre_commands_total{tool="ebook-convert"} 1' in text
+    assert 'shelfstone_calibre_command_failures_total{tool="ebook-convert",error_type="corrupt_file"} 1' in text
+
+
+@mock.patch('calibre_api.app.calibre_cli.subprocess.run', side_effect=FileNotFoundError())
+def test_run_calibre_command_records_missing_binary(mock_run):
+    with pytest.raises(FileNotFoundError):
+        run_calibre_command(["ebook-meta", "book.epub"])
+    assert metrics.recent_failures()[0]["error_type"] == metrics.ERROR_BINARY_MISSING
+
+
+@mock.patch('calibre_api.app.calibre_cli.subprocess.run', side_effect=subprocess.TimeoutExpired(cmd="ebook-convert", timeout=1))
+def test_run_calibre_command_records_timeout(mock_run):
+    with pytest.raises(CalibreCLIError) as excinfo:
+        run_calibre_command(["ebook-convert", "a.epub", "b.mobi"], timeout=1)
+    assert excinfo.value.error_type == metrics.ERROR_TIMEOUT
+    assert 'error_type="timeout"} 1' in metrics.render_prometheus()
+
+
+@mock.patch('calibre_api.app.calibre_cli.subprocess.run')
+def test_successful_command_is_not_a_failure(mock_run):
+    mock_run.return_value = mock.Mock(returncode=0, stdout="ok", stderr="")
+    run_calibre_command(["calibredb", "list"])
+    assert metrics.recent_failures() == []
+    assert 'shelfstone_calibre_commands_total{tool="calibredb"} 1' in metrics.render_prometheus()
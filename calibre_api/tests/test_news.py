@@ -0,0 +1,88 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import news
+from calibre_api.app.news import recipe_slug, expire_issues, fetch_news
+
+
+def issue(book_id, slug="the-guardian"):
+    return {"id": book_id, "title": f"Issue {book_id}", "identifiers": {"news": slug}}
+
+
+def test_recipe_slug():
+    assert recipe_slug("The Guardian") == "the-guardian"
+    assert recipe_slug("/tmp/my_feed.recipe") == "my-feed"
+    with pytest.raises(ValueError):
+        recipe_slug("!!!")
+
+
+@mock.patch("calibre_api.app.news.remove_book")
+@mock.patch("calibre_api.app.news.list_books")
+def test_expire_issues_keeps_newest(mock_list, mock_remove):
+    # The search may also match other recipes' identifiers by prefix; those are ignored.
+    mock_list.return_value = [issue(3), issue(10), issue(7), issue(5, slug="the-guardian-weekly")]
+
+    removed = expire_issues("the-guardian", keep_issues=2)
+
+    assert removed == [3]
+    mock_remove.assert_called_once_with(3, library_path=None)
+    assert mock_list.call_args.kwargs["search_query"] == 'identifiers:"=news:=the-guardian"'
+
+
+def test_expire_issues_validates_keep():
+    with pytest.raises(ValueError):
+        expire_issues("x", keep_issues=0)
+
+
+@mock.patch("calibre_api.app.news.expire_issues", return_value=[2])
+@mock.patch("calibre_api.app.news.add_book", return_value=[12])
+@mock.patch("calibre_api.app.news.calibre_cli.fetch_news_recipe")
+def test_fetch_news(mock_fetch, mock_add, mock_expire):
+    result = fetch_news("The Guardian", library_path="/lib", keep_issues=3)
+
+    assert result == {"recipe": "the-guardian", "added_book_ids": [12], "removed_book_ids": [2]}
+    assert mock_fetch.call_args.args[0] == "The Guardian"
+    assert mock_fetch.call_args.args[1].endswith("the-guardian.epub")
+    assert mock_add.call_args.kwargs == {
+        "library_path": "/lib", "duplicates": True, "tags": "News", "identifiers": {"news": "the-guardian"},
+    }
+    mock_expire.assert_called_once_with("the-guardian", 3, library_path="/lib")
+
+
+@mock.patch("calibre_api.app.news.add_book")
+@mock.patch("calibre_api.app.news.calibre_cli.fetch_news_recipe")
+def test_fetch_news_uses_recipe_file(mock_fetch, mock_add):
+    with mock.patch("calibre_api.app.news.expire_issues", return_value=[]):
+        fetch_news("My Feed", recipe_file="/tmp/uploaded.recipe")
+    assert mock_fetch.call_args.args[0] == "/tmp/uploaded.recipe"
+
+
+def test_fetch_news_rejects_bad_arguments():
+    with pytest.raises(ValueError):
+        fetch_news("The Guardian", output_format="docx")
+    with pytest.raises(ValueError):
+        fetch_news("The Guardian", keep_issues=0)
+
+
+@mock.patch("calibre_api.app.news.calibre_cli.fetch_news_recipe")
+def test_fetch_news_rejects_paths_and_options_as_recipe(mock_fetch):
+    for recipe in ("--output-profile=kindle", "../../tmp/evil", "C:\\recipes\\evil", ""):
+        with pytest.raises(ValueError):
+            fetch_news(recipe)
+    mock_fetch.assert_not_called()
+
+
+def test_custom_recipes_are_disabled_by_default():
+    with mock.patch.dict(os.environ, {}, clear=True):
+        assert not news.custom_recipes_enabled()
+    with mock.patch.dict(os.environ, {"SHELFSTONE_ENABLE_CUSTOM_RECIPES": "true"}):
+        assert news.custom_recipes_enabled()
+
+
+@mock.patch("calibre_api.app.news.add_book")
+@mock.patch("calibre_api.app.news.calibre_cli.fetch_news_recipe", side_effect=news.calibre_cli.CalibreCLIError("boom"))
+def test_fetch_news_download_failure_adds_nothing(mock_fetch, mock_add):
+    with pytest.raises(news.calibre_cli.CalibreCLIError):
+        fetch_news("The Guardian")
+    mock_add.assert_not_called()
@@ -0,0 +1,92 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, notifications
+from calibre_api.app.crud import CalibredbError
+from calibre_api.app.main import app
+
+
+def test_inbox():
+    first = notifications.notify(1, notifications.CONVERSION_DONE, "Converted 'Dune' to EPUB", book_id=5)
+    second = notifications.notify(1, notifications.UPLOAD_FAILED, "Adding 'emma.epub' failed", "calibredb add failed.")
+    notifications.notify(2, notifications.DELIVERY_SENT, "Sent 'Dune' to kindle")
+    assert notifications.notify(None, notifications.DELIVERY_SENT, "Nobody to tell") is None
+    with pytest.raises(ValueError):
+        notifications.notify(1, "gossip", "Unknown kind")
+
+    inbox = notifications.list_notifications(1)
+    assert (inbox["total"], inbox["unread"]) == (2, 2)
+    assert [n["id"] for n in inbox["notifications"]] == [second["id"], first["id"]]
+    assert (first["book_id"], first["read"], first["library"]) == (5, False, "")
+
+    assert notifications.mark_read(1, [first["id"], 999]) == 1
+    assert notifications.unread_count(1) == 1
+    assert [n["id"] for n in notifications.list_notifications(1, unread_only=True)["notifications"]] == [second["id"]]
+    assert notifications.mark_read(1) == 1 and notifications.unread_count(1) == 0
+    assert notifications.unread_count(2) == 1
+
+    unread = notifications.set_read(1, first["id"], False)
+    assert unread["read"] is False and unread["read_at"] is None
+    with pytest.raises(notifications.NotificationNotFound):
+        notifications.set_read(2, first["id"], True)
+
+    notifications.forget_books([5])
+    assert notifications.export_user(1)[1]["book_id"] is None
+    notifications.delete_notification(1, second["id"])
+    with pytest.raises(notifications.NotificationNotFound):
+        notifications.delete_notification(1, second["id"])
+    notifications.forget_user(1)
+    assert notifications.list_notifications(1)["total"] == 0
+
+
+def test_inbox_keeps_the_newest(monkeypatch):
+    monkeypatch.setattr(notifications, "MAX_PER_USER", 3)
+    for i in range(5):
+        notifications.notify(1, notifications.CONVERSION_DONE, f"Converted book {i}")
+    assert [n["title"] for n in notifications.export_user(1)] == ["Converted book 4", "Converted book 3", "Converted book 2"]
+
+
+# --- Tests for /me/notifications ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    user = accounts.create_user("ana", "password1")
+    client = TestClient(app)
+    client.user = user
+    client.headers["Authorization"] = f"Bearer {accounts.create_session(user['id'])['token']}"
+    return client
+
+
+def test_notification_endpoints(client):
+    user_id = client.user["id"]
+    first = notifications.notify(user_id, notifications.CONVERSION_DONE, "Converted 'Dune' to EPUB")
+    second = notifications.notify(user_id, notifications.DELIVERY_FAILED, "Sending 'Dune' to kindle failed")
+    notifications.notify(user_id + 1, notifications.DELIVERY_SENT, "Someone else's")
+
+    inbox = client.get("/me/notifications", params={"limit": 1}).json()
+    assert (inbox["total"], inbox["unread"], [n["id"] for n in inbox["notifications"]]) == (2, 2, [second["id"]])
+    assert client.get("/me/notifications/unread-count").json() == {"unread": 2}
+
+    assert client.post("/me/notifications/read", json={"ids": [first["id"]]}).json() == {"unread": 1}
+    assert [n["id"] for n in client.get("/me/notifications", params={"unread": True}).json()["notifications"]] == [second["id"]]
+    assert client.post("/me/notifications/read", json={}).json() == {"unread": 0}
+    response = client.patch(f"/me/notifications/{first['id']}", json={"read": False})
+    assert response.status_code == 200 and response.json()["read"] is False
+    assert client.delete(f"/me/notifications/{second['id']}").status_code == 204
+    assert client.delete(f"/me/notifications/{second['id']}").status_code == 404
+    assert client.patch(f"/me/notifications/{second['id']}", json={"read": True}).status_code == 404
+
+
+@patch('calibre_api.app.main.add_book', side_effect=CalibredbError("calibredb add failed.", stderr="Corrupt file"))
+@patch('calibre_api.app.main.duplicate_detection.find_by_hash', return_value=[])
+def test_failed_upload_is_notified(mock_find, mock_add, client):
+    response = client.post("/books/add/", data={"merge_formats": "false"},
+                           files={"file": ("emma.epub", b"epub bytes", "application/epub+zip")})
+    assert response.status_code == 500
+    notification = notifications.export_user(client.user["id"])[0]
+    assert notification["kind"] == notifications.UPLOAD_FAILED and notification["title"] == "Adding 'emma.epub' failed"
+    assert "calibredb add failed." in notification["body"]
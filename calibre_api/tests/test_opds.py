@@ -0,0 +1,118 @@
+import xml.etree.ElementTree as ET
+
+from calibre_api.app import opds
+
+ATOM = "{http://www.w3.org/2005/Atom}"
+BASE = "https://books.example.org/api/"
+
+BOOKS = [
+    {"id": 1, "uuid": "u-1", "title": "Dune", "authors": ["Frank Herbert"], "series": "Dune", "series_index": 1.0,
+     "timestamp": "2026-01-01", "formats": ["/lib/Frank Herbert/Dune (1)/Dune.epub", "/lib/Frank Herbert/Dune (1)/Dune.pdf"],
+     "cover": "/lib/Frank Herbert/Dune (1)/cover.jpg", "tags": ["SF"], "languages": ["eng"]},
+    {"id": 2, "title": "Dune Messiah", "authors": ["Frank Herbert"], "series": "Dune", "series_index": 2.0,
+     "timestamp": "2026-03-01", "formats": []},
+    {"id": 3, "title": "Hyperion", "authors": ["Dan Simmons"], "timestamp": "2026-02-01", "formats": []},
+]
+
+
+def links(feed, rel=None):
+    return [(l.get("rel"), l.get("href"), l.get("type")) for l in feed.iter(f"{ATOM}link") if rel is None or l.get("rel") == rel]
+
+
+def test_feed_url_carries_library_path():
+    assert opds.feed_url(BASE, "/opds/recent") == "https://books.example.org/api/opds/recent"
+    assert opds.feed_url(BASE, "/opds/search", "/lib a", page=2, q="x&y") == \
+        "https://books.example.org/api/opds/search?page=2&q=x%26y&library_path=%2Flib+a"
+
+
+def test_root_feed():
+    feed = ET.fromstring(opds.root_feed(BASE))
+    titles = [e.find(f"{ATOM}title").text for e in feed.iter(f"{ATOM}entry")]
+    assert titles == ["Recently added", "By author", "By series"]
+    assert ("search", BASE.rstrip("/") + "/opds/search.xml", opds.OPENSEARCH_TYPE) in links(feed)
+
+
+def test_books_feed_entries_and_paging():
+    feed = ET.fromstring(opds.books_feed(opds.sort_recent(BOOKS), "urn:x", "Recent", BASE, "/opds/recent",
+                                         library_path="/lib", page=1, per_page=2))
+    entries = list(feed.iter(f"{ATOM}entry"))
+    assert [e.find(f"{ATOM}title").text for e in entries] == ["Dune Messiah", "Hyperion"]
+    assert links(feed, "next") == [("next", BASE.rstrip("/") + "/opds/recent?page=2&library_path=%2Flib", opds.ACQUISITION_TYPE)]
+    assert links(feed, "previous") == []
+
+    feed = ET.fromstring(opds.books_feed(opds.sort_recent(BOOKS), "urn:x", "Recent", BASE, "/opds/recent", page=2, per_page=2))
+    entry = next(feed.iter(f"{ATOM}entry"))
+    assert entry.find(f"{ATOM}id").text == "urn:uuid:u-1"
+    acquisitions = links(entry, "http://opds-spec.org/acquisition")
+    assert acquisitions == [
+        ("http://opds-spec.org/acquisition", BASE.rstrip("/") + "/books/1/file/epub", "application/epub+zip"),
+        ("http://opds-spec.org/acquisition", BASE.rstrip("/") + "/books/1/file/pdf", "application/pdf"),
+    ]
+    assert links(entry, "http://opds-spec.org/image")[0][1] == BASE.rstrip("/") + "/books/1/cover"
+    assert links(entry, "http://opds-spec.org/image/thumbnail")[0][1] == BASE.rstrip("/") + "/books/1/cover?size=small"
+    assert links(feed, "next") == []
+    assert links(feed, "previous")[0][1] == BASE.rstrip("/") + "/opds/recent"
+
+
+def test_public_feed_stays_in_the_catalog():
+    api = BASE.rstrip("/")
+    feed = ET.fromstring(opds.public_feed(BOOKS, "take-one", "Take one", BASE, page=1, per_page=2))
+    assert [l[1] for l in links(feed) if l[0] in ("self", "start", "next")] == [
+        f"{api}/public/take-one/opds", f"{api}/public/take-one/opds", f"{api}/public/take-one/opds?page=2"]
+    assert links(feed, "search") == []
+    entry = next(feed.iter(f"{ATOM}entry"))
+    assert links(entry, "http://opds-spec.org/image")[0][1] == f"{api}/public/take-one/books/1/cover"
+    assert links(entry, "http://opds-spec.org/acquisition") == []
+
+    feed = ET.fromstring(opds.public_feed(BOOKS, "take-one", "Take one", BASE, downloads=True))
+    entry = next(feed.iter(f"{ATOM}entry"))
+    assert links(entry, "http://opds-spec.org/acquisition")[0][1] == f"{api}/public/take-one/books/1/file/epub"
+
+
+def test_book_entry_acquisition_types():
+    book = {"id": 4, "title": "Watchmen", "formats": ["/lib/w/Watchmen.azw3", "/lib/w/Watchmen.cbz"]}
+    entry = ET.fromstring(f'<feed xmlns="http://www.w3.org/2005/Atom">{opds.book_entry(book, BASE, None, "2026-01-01")}</feed>')
+    acquisitions = [(l.get("type"), l.get("title")) for l in entry.iter(f"{ATOM}link")
+                    if l.get("rel") == "http://opds-spec.org/acquisition"]
+    assert acquisitions == [("application/x-mobi8-ebook", "Kindle (AZW3)"), ("application/vnd.comicbook+zip", "Comic book (CBZ)")]
+
+
+def test_category_feed():
+    feed = ET.fromstring(opds.category_feed(BOOKS, "authors", BASE))
+    entries = [(e.find(f"{ATOM}title").text, e.find(f"{ATOM}content").text) for e in feed.iter(f"{ATOM}entry")]
+    assert entries == [("Dan Simmons", "1 book(s)"), ("Frank Herbert", "2 book(s)")]
+    assert links(next(feed.iter(f"{ATOM}entry")))[0][1] == BASE.rstrip("/") + "/opds/authors/Dan%20Simmons"
+
+    feed = ET.fromstring(opds.category_feed(BOOKS, "series", BASE))
+    assert [e.find(f"{ATOM}title").text for e in feed.iter(f"{ATOM}entry")] == ["Dune"]
+
+
+def test_authors_as_calibredb_lists_them():
+    # calibredb joins several authors with " & "; names themselves may contain commas.
+    books = [{"id": 4, "title": "Dune: House Atreides", "authors": "Frank Herbert & Brian Herbert", "formats": []},
+             {"id": 5, "title": "Emma", "authors": "Austen, Jane", "tags": "Classic, Romance", "formats": []}]
+    entry = ET.fromstring(f'<feed xmlns="http://www.w3.org/2005/Atom">{opds.book_entry(books[0], BASE, None, "2026-01-01")}</feed>')
+    assert [a.find(f"{ATOM}name").text for a in entry.iter(f"{ATOM}author")] == ["Frank Herbert", "Brian Herbert"]
+    feed = ET.fromstring(opds.category_feed(books, "authors", BASE))
+    assert [e.find(f"{ATOM}title").text for e in feed.iter(f"{ATOM}entry")] == ["Austen, Jane", "Brian Herbert", "Frank Herbert"]
+    entry = ET.fromstring(f'<feed xmlns="http://www.w3.org/2005/Atom">{opds.book_entry(books[1], BASE, None, "2026-01-01")}</feed>')
+    assert [c.get("term") for c in entry.iter(f"{ATOM}category")] == ["Classic", "Romance"]
+
+
+def test_sort_series_and_opensearch():
+    assert [b["id"] for b in opds.sort_series([BOOKS[1], BOOKS[0]])] == [1, 2]
+    description = ET.fromstring(opds.opensearch_description(BASE, library_path="/lib"))
+    url = description.find("{http://a9.com/-/spec/opensearch/1.1/}Url")
+    assert url.get("template") == BASE.rstrip("/") + "/opds/search?library_path=%2Flib&q={searchTerms}"
+
+
+def test_feeds_in_other_languages():
+    feed = ET.fromstring(opds.root_feed(BASE, language="de"))
+    assert feed.get("{http://www.w3.org/XML/1998/namespace}lang") == "de"
+    assert feed.find(f"{ATOM}title").text == "Shelfstone-Bibliothek"
+    assert [e.find(f"{ATOM}title").text for e in feed.iter(f"{ATOM}entry")] == ["Neu hinzugefügt", "Nach Autor", "Nach Reihe"]
+    assert [l.get("title") for l in feed.iter(f"{ATOM}link") if l.get("rel") in ("start", "search")] == ["Start", "Suche"]
+
+    feed = ET.fromstring(opds.category_feed(BOOKS, "authors", BASE, language="fr"))
+    assert feed.find(f"{ATOM}title").text == "Par auteur"
+    assert [e.find(f"{ATOM}content").text for e in feed.iter(f"{ATOM}entry")] == ["1 livre(s)", "2 livre(s)"]
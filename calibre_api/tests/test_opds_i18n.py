@@ -0,0 +1,33 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import opds_i18n
+
+
+def test_negotiate_prefers_highest_quality_supported_language():
+    with mock.patch.dict(os.environ, {}, clear=False):
+        os.environ.pop("SHELFSTONE_OPDS_LOCALE", None)
+        assert opds_i18n.negotiate("de-AT,de;q=0.9,en;q=0.5") == "de"
+        assert opds_i18n.negotiate("gsw;q=1.0, fr-CH;q=0.8, en;q=0.9") == "en"
+        assert opds_i18n.negotiate("pt_BR") == "pt"
+        assert opds_i18n.negotiate("fr;q=0, es") == "es"
+        assert opds_i18n.negotiate("tlh, *") == "en"
+        assert opds_i18n.negotiate(None) == "en"
+
+
+def test_configured_locale_is_the_fallback():
+    with mock.patch.dict(os.environ, {"SHELFSTONE_OPDS_LOCALE": "ru_RU"}):
+        assert opds_i18n.negotiate(None) == "ru"
+        assert opds_i18n.negotiate("tlh") == "ru"
+        assert opds_i18n.negotiate("ja") == "ja"
+
+
+def test_parse_locale_and_text():
+    assert opds_i18n.parse_locale("zh-Hans-CN") == "zh"
+    with pytest.raises(ValueError):
+        opds_i18n.parse_locale("tlh")
+    assert opds_i18n.text("es", "search_results", query="Dune") == "Búsqueda: Dune"
+    assert opds_i18n.text("xx", "book_count", count=2) == "2 book(s)"
+    # Every language translates every text.
+    assert all(set(messages) == set(opds_i18n.MESSAGES["en"]) for messages in opds_i18n.MESSAGES.values())
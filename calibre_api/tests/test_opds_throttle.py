@@ -0,0 +1,111 @@
+import asyncio
+
+from fastapi.testclient import TestClient
+
+from calibre_api.app import opds_throttle
+from calibre_api.app.main import app
+from calibre_api.app.opds_throttle import OpdsThrottleMiddleware
+
+KOBO = "Mozilla/5.0 (Linux; U; Android 2.0; en-us;) AppleWebKit/538.1 (KHTML, like Gecko) (Kobo Touch 0377/4.20.14622)"
+BROWSER = "Mozilla/5.0 (X11; Linux x86_64; rv:130.0) Gecko/20100101 Firefox/130.0"
+
+
+def call(path, user_agent, inner=None):
+    """A request through the middleware from 10.0.0.7: (scope, receive, send, sent messages, middleware)."""
+    sent = []
+
+    async def ok(scope, receive, send):
+        await send({"type": "http.response.start", "status": 200, "headers": []})
+        await send({"type": "http.response.body", "body": b"ok"})
+
+    async def receive():
+        return {"type": "http.request", "body": b"", "more_body": False}
+
+    async def send(message):
+        sent.append(message)
+
+    scope = {"type": "http", "method": "GET", "path": path, "client": ("10.0.0.7", 5000),
+             "headers": [(b"user-agent", user_agent.encode())]}
+    return scope, receive, send, sent, OpdsThrottleMiddleware(inner or ok)
+
+
+def run(path, user_agent):
+    """Sends one request through the middleware and returns (status, headers)."""
+    scope, receive, send, sent, middleware = call(path, user_agent)
+    asyncio.run(middleware(scope, receive, send))
+    return sent[0]["status"], dict(sent[0]["headers"])
+
+
+def test_reader_agents_and_paths():
+    assert opds_throttle.reader_agent(KOBO) == "Kobo"
+    assert opds_throttle.reader_agent("KOReader/2024.11 (https://koreader.rocks/)") == "KOReader"
+    assert opds_throttle.reader_agent(BROWSER) is None and opds_throttle.reader_agent(None) is None
+    assert opds_throttle.applies("/opds/recent", BROWSER) and opds_throttle.applies("/public/take-one/opds", BROWSER)
+    assert opds_throttle.applies("/books/5/cover", KOBO) and not opds_throttle.applies("/books/5/cover", BROWSER)
+    assert not opds_throttle.applies("/books/", KOBO) and not opds_throttle.applies("/opdsx", BROWSER)
+
+
+def test_reserve():
+    key = ("10.0.0.7", KOBO)
+    # 60 a minute: bursts of 15, then one a second.
+    for _ in range(15):
+        assert opds_throttle.reserve(key, 60, 0, now=100.0)[0] == 0
+    assert opds_throttle.reserve(key, 60, 0, now=100.0) == (1.0, 0)
+    # Waiting is a reservation: the next one waits longer.
+    assert opds_throttle.reserve(key, 60, 5, now=100.0)[0] == 1.0
+    assert opds_throttle.reserve(key, 60, 5, now=100.0)[0] == 2.0
+    assert opds_throttle.reserve(key, 60, 5, now=110.0) == (0, 7)
+
+
+def test_enter_and_leave():
+    key = ("10.0.0.7", BROWSER)
+    assert opds_throttle.enter(key, 2) and opds_throttle.enter(key, 2)
+    assert not opds_throttle.enter(key, 2)
+    opds_throttle.leave(key)
+    assert opds_throttle.enter(key, 2)
+
+
+def test_rate_limit(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_OPDS_RATE", "4")
+    monkeypatch.setattr(opds_throttle, "MAX_DELAY_SECONDS", 0.01)
+    assert run("/books/5/cover", BROWSER)[0] == 200
+    status, headers = run("/opds", BROWSER)
+    assert status == 200 and headers[b"ratelimit-policy"] == b"4;w=60" and headers[b"ratelimit-remaining"] == b"0"
+    status, headers = run("/opds", BROWSER)
+    assert status == 429 and headers[b"retry-after"] == b"15"
+    # Reading apps count separately, and wait for their turn if it comes soon enough.
+    assert run("/opds", KOBO)[0] == 200
+    assert run("/books/5/cover", KOBO)[0] == 429
+
+    monkeypatch.setenv("SHELFSTONE_OPDS_RATE", "0")
+    assert run("/opds", BROWSER)[0] == 200
+
+
+def test_concurrency_limit(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_OPDS_CONCURRENCY", "1")
+    monkeypatch.setattr(opds_throttle, "MAX_DELAY_SECONDS", 0.5)
+    statuses = []
+
+    async def slow(scope, receive, send):
+        await asyncio.sleep(0.1)
+        await send({"type": "http.response.start", "status": 200, "headers": []})
+        await send({"type": "http.response.body", "body": b"ok"})
+
+    async def both(user_agent):
+        requests = [call("/opds", user_agent, slow) for _ in range(2)]
+        await asyncio.gather(*(middleware(scope, receive, send) for scope, receive, send, _, middleware in requests))
+        statuses.append(sorted(sent[0]["status"] for *_, sent, _ in requests))
+
+    # Browsers get 429 for the second request at a time; reading apps wait for the first to finish.
+    asyncio.run(both(BROWSER))
+    asyncio.run(both(KOBO))
+    assert statuses == [[200, 429], [200, 200]]
+
+
+def test_throttle_in_front_of_the_app(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_OPDS_RATE", "4")
+    client = TestClient(app)
+    # 4 a minute comes in bursts of one.
+    assert client.get("/opds/search.xml").status_code == 200
+    assert client.get("/opds/search.xml").status_code == 429
+    assert client.get("/healthz").status_code == 200
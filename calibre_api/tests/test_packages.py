@@ -0,0 +1,145 @@
+import pytest
+from unittest import mock
+
+from calibre_api.app import packages
+from calibre_api.app.crud import CalibredbError
+from calibre_api.app.calibre_cli import CalibreCLIError
+from calibre_api.app.packages import classify_package_files, import_book_package, BookPackageError
+from calibre_api.app.filetypes import UnsupportedFileType
+
+
+@pytest.fixture(autouse=True)
+def skip_content_sniffing():
+    # The package files in these tests don't exist on disk; sniffing is covered in test_filetypes.py.
+    with mock.patch.object(packages.filetypes, 'check_ebook_file', return_value="EPUB"):
+        yield
+
+
+def test_classify_package_files():
+    parts = classify_package_files(["Dune.epub", "metadata.opf", "cover.jpg", "release.nfo", "map.png"])
+    assert parts == {
+        "ebook": "Dune.epub",
+        "opf": "metadata.opf",
+        "cover": "cover.jpg",
+        "attachments": ["release.nfo", "map.png"],
+    }
+
+
+def test_classify_single_image_is_cover():
+    parts = classify_package_files(["Dune.pdf", "scan.PNG"])
+    assert parts["cover"] == "scan.PNG"
+    assert parts["opf"] is None
+    assert parts["attachments"] == []
+
+
+def test_classify_ambiguous_images_are_attachments():
+    parts = classify_package_files(["Dune.epub", "a.jpg", "b.jpg"])
+    assert parts["cover"] is None
+    assert parts["attachments"] == ["a.jpg", "b.jpg"]
+
+
+@pytest.mark.parametrize("filenames", [
+    ["metadata.opf", "cover.jpg"],
+    ["Dune.epub", "Dune.mobi"],
+    ["Dune.epub", "a.opf", "b.opf"],
+])
+def test_classify_invalid_packages(filenames):
+    with pytest.raises(BookPackageError):
+        classify_package_files(filenames)
+
+
+@mock.patch.object(packages.crud, 'add_extra_data_file')
+@mock.patch.object(packages.crud, 'set_book_cover')
+@mock.patch.object(packages.crud, 'set_book_metadata_from_opf')
+@mock.patch.object(packages.crud, 'add_book', return_value=[7])
+def test_import_book_package(mock_add, mock_opf, mock_cover, mock_extra):
+    result = import_book_package("/tmp/pkg", ["Dune.epub", "metadata.opf", "cover.jpg", "release.nfo"], library_path="/lib")
+
+    assert result == {"book_id": 7, "metadata_source": "opf", "cover_applied": True, "attachments": ["release.nfo"]}
+    mock_add.assert_called_once_with(file_path="/tmp/pkg/Dune.epub", library_path="/lib", duplicates=False, identifiers=None)
+    mock_opf.assert_called_once_with(7, "/tmp/pkg/metadata.opf", library_path="/lib")
+    mock_cover.assert_called_once_with(7, "/tmp/pkg/cover.jpg", library_path="/lib")
+    mock_extra.assert_called_once_with(7, "/tmp/pkg/release.nfo", library_path="/lib")
+
+
+@mock.patch.object(packages.crud, 'set_book_metadata_from_opf')
+@mock.patch.object(packages.crud, 'add_book', return_value=[])
+def test_import_book_package_not_added(mock_add, mock_opf):
+    result = import_book_package("/tmp/pkg", ["Dune.epub", "metadata.opf"])
+    assert result["book_id"] is None
+    mock_opf.assert_not_called()
+
+
+@mock.patch.object(packages.crud, 'remove_book')
+@mock.patch.object(packages.crud, 'add_extra_data_file', side_effect=CalibredbError("add_format failed"))
+@mock.patch.object(packages.crud, 'set_book_cover')
+@mock.patch.object(packages.crud, 'add_book', return_value=[7])
+def test_import_book_package_rolls_back_on_failure(mock_add, mock_cover, mock_extra, mock_remove):
+    with pytest.raises(CalibredbError):
+        import_book_package("/tmp/pkg", ["Dune.epub", "cover.jpg", "release.nfo"])
+    mock_remove.assert_called_once_with(7, library_path=None)
+
+
+@mock.patch.object(packages.crud, 'set_book_identifiers')
+@mock.patch.object(packages.crud, 'set_book_metadata_from_opf')
+@mock.patch.object(packages.crud, 'add_book', return_value=[7])
+def test_import_book_package_keeps_identifiers_after_opf(mock_add, mock_opf, mock_set_ids, tmp_path):
+    (tmp_path / "metadata.opf").write_text(
+        '<package xmlns="http://www.idpf.org/2007/opf"><metadata xmlns:dc="http://purl.org/dc/elements/1.1/" '
+        'xmlns:opf="http://www.idpf.org/2007/opf"><dc:identifier opf:scheme="ISBN">9780441172719</dc:identifier>'
+        '</metadata></package>'
+    )
+    import_book_package(str(tmp_path), ["Dune.epub", "metadata.opf"], identifiers={"idempotency": "abc"})
+
+    assert mock_add.call_args[1]["identifiers"] == {"idempotency": "abc"}
+    mock_set_ids.assert_called_once_with(7, {"isbn": "9780441172719", "idempotency": "abc"}, library_path=None)
+
+
+@mock.patch.object(packages.crud, 'add_book')
+def test_import_book_package_rejects_unsupported_content(mock_add):
+    with mock.patch.object(packages.filetypes, 'check_ebook_file', side_effect=UnsupportedFileType("not an e-book")):
+        with pytest.raises(UnsupportedFileType):
+            import_book_package("/tmp/pkg", ["Dune.epub"])
+    mock_add.assert_not_called()
+
+
+# Every step after `calibredb add` is a failure point; each must remove the new book again.
+FAILURE_POINTS = [
+    ("set_book_metadata_from_opf", CalibredbError("set_metadata failed")),
+    ("set_book_metadata_from_opf", CalibreCLIError("calibredb timed out", returncode=-1)),
+    ("set_book_identifiers", CalibredbError("identifiers failed")),
+    ("set_book_cover", CalibredbError("cover failed")),
+    ("set_book_cover", OSError("disk full")),
+    ("add_extra_data_file", CalibredbError("add_format failed")),
+]
+
+
+@pytest.mark.parametrize("failing_step, error", FAILURE_POINTS)
+def test_import_book_package_rolls_back_at_every_failure_point(failing_step, error, tmp_path):
+    (tmp_path / "metadata.opf").write_text('<package xmlns="http://www.idpf.org/2007/opf"><metadata/></package>')
+    steps = ["set_book_metadata_from_opf", "set_book_identifiers", "set_book_cover", "add_extra_data_file"]
+    patches = {step: mock.patch.object(packages.crud, step) for step in steps}
+    mocks = {step: p.start() for step, p in patches.items()}
+    try:
+        mocks[failing_step].side_effect = error
+        with mock.patch.object(packages.crud, 'add_book', return_value=[7]), \
+             mock.patch.object(packages.crud, 'remove_book') as mock_remove:
+            with pytest.raises(type(error)):
+                import_book_package(str(tmp_path), ["Dune.epub", "metadata.opf", "cover.jpg", "release.nfo"],
+                                    library_path="/lib", identifiers={"idempotency": "k"})
+            mock_remove.assert_called_once_with(7, library_path="/lib")
+        # Steps after the failing one never ran.
+        for step in steps[steps.index(failing_step) + 1:]:
+            mocks[step].assert_not_called()
+    finally:
+        for p in patches.values():
+            p.stop()
+
+
+@mock.patch.object(packages.crud, 'remove_book', side_effect=CalibredbError("library locked"))
+@mock.patch.object(packages.crud, 'set_book_cover', side_effect=CalibredbError("cover failed"))
+@mock.patch.object(packages.crud, 'add_book', return_value=[7])
+def test_import_book_package_reports_original_error_if_rollback_fails(mock_add, mock_cover, mock_remove):
+    with pytest.raises(CalibredbError, match="cover failed"):
+        import_book_package("/tmp/pkg", ["Dune.epub", "cover.jpg"])
+    mock_remove.assert_called_once_with(7, library_path=None)
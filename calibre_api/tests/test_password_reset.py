@@ -0,0 +1,170 @@
+import threading
+import time
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, password_reset
+from calibre_api.app.main import app
+
+
+@pytest.fixture
+def smtp(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_SMTP_HOST", "smtp.example.org")
+    monkeypatch.setenv("SHELFSTONE_SMTP_FROM", "books@example.org")
+
+
+def sent_link(mock_thread, send):
+    """Runs the email thread request_reset started with `send` and returns the link it mailed."""
+    kwargs = mock_thread.call_args[1]
+    user, link, smtp, address, _ = kwargs["args"]
+    kwargs["target"](user, link, smtp, address, send)
+    return link
+
+
+def test_email_addresses():
+    user = accounts.create_user("ana", "password1", email=" Ana@Example.org ")
+    assert user["email"] == "Ana@Example.org"
+    assert accounts.user_for_email("ana@example.ORG")["id"] == user["id"]
+    with pytest.raises(accounts.UserExists, match="email"):
+        accounts.create_user("sam", "password1", email="ana@example.org")
+    sam = accounts.create_user("sam", "password1")
+    with pytest.raises(accounts.UserExists):
+        accounts.update_user(sam["id"], {"email": "ANA@example.org"})
+    with pytest.raises(ValueError):
+        accounts.update_user(sam["id"], {"email": "not an address"})
+    with pytest.raises(ValueError, match="password"):
+        accounts.set_email(sam["id"], "sam@example.org", "wrong password")
+    assert accounts.set_email(sam["id"], "sam@example.org", "password1")["email"] == "sam@example.org"
+    assert accounts.set_email(sam["id"], "", "password1")["email"] is None
+
+    accounts.update_user(user["id"], {"disabled": True})
+    assert accounts.user_for_email("ana@example.org") is None
+
+
+def test_tokens_are_signed_and_single_use():
+    user = accounts.create_user("ana", "password1", email="ana@example.org")
+    stamp = accounts.password_stamp(user["id"])
+    token = password_reset.make_token(user["id"], stamp, int(time.time()) + 60)
+    assert password_reset.check_token(token)[0] == user["id"]
+
+    user_id, expires_at, signature = token.split(".")
+    for forged in (f"{int(user_id) + 1}.{expires_at}.{signature}", f"{user_id}.{int(expires_at) + 3600}.{signature}",
+                   f"{user_id}.{expires_at}.{signature[:-2]}", "garbage", ""):
+        with pytest.raises(password_reset.InvalidResetToken):
+            password_reset.check_token(forged)
+    with pytest.raises(password_reset.InvalidResetToken):
+        password_reset.check_token(password_reset.make_token(user["id"], stamp, int(time.time()) - 1))
+
+    session = accounts.create_session(user["id"])["token"]
+    password_reset.complete_reset(token, "password2", "10.0.0.1")
+    assert accounts.authenticate("ana", "password2") and accounts.user_for_token(session) is None
+    with pytest.raises(password_reset.InvalidResetToken):
+        password_reset.complete_reset(token, "password3", "10.0.0.1")
+
+
+@patch('calibre_api.app.password_reset.threading.Thread')
+def test_request_mails_a_link(mock_thread, smtp):
+    user = accounts.create_user("ana", "password1", email="ana@example.org")
+    password_reset.request_reset("nobody@example.org", "10.0.0.1", "https://books.example.org/auth/password-reset/")
+    mock_thread.assert_not_called()
+
+    password_reset.request_reset("ANA@example.org", "10.0.0.1", "https://books.example.org/auth/password-reset/")
+    send_calls = []
+    link = sent_link(mock_thread, lambda **kwargs: send_calls.append(kwargs) or (True, ""))
+    assert link.startswith("https://books.example.org/auth/password-reset/")
+    assert send_calls[0]["recipient_email"] == "ana@example.org" and link in send_calls[0]["body"]
+    assert send_calls[0]["smtp_server"] == "smtp.example.org"
+    assert password_reset.check_token(link.rsplit("/", 1)[1])[0] == user["id"]
+
+    sent_link(mock_thread, lambda **kwargs: (False, "Authentication failed: 535"))
+    assert [e["event"] for e in password_reset.events()] == [
+        password_reset.SEND_FAILED, password_reset.SENT, password_reset.REQUESTED, password_reset.UNKNOWN_EMAIL]
+    assert password_reset.events(user_id=user["id"])[0]["detail"] == "Authentication failed: 535"
+
+
+@patch('calibre_api.app.password_reset.threading.Thread')
+def test_requests_are_rate_limited(mock_thread, smtp):
+    for _ in range(password_reset.REQUESTS_PER_EMAIL):
+        password_reset.request_reset("ana@example.org", "10.0.0.1", "/")
+    with pytest.raises(password_reset.RateLimited) as limited:
+        password_reset.request_reset("ana@example.org", "10.0.0.2", "/")
+    assert 0 < limited.value.retry_after <= password_reset.RATE_WINDOW_SECONDS + 1
+
+    for i in range(password_reset.REQUESTS_PER_ADDRESS - password_reset.REQUESTS_PER_EMAIL):
+        password_reset.request_reset(f"user{i}@example.org", "10.0.0.1", "/")
+    with pytest.raises(password_reset.RateLimited):
+        password_reset.request_reset("someone@example.org", "10.0.0.1", "/")
+    assert password_reset.events()[0]["event"] == password_reset.RATE_LIMITED
+
+
+def test_failed_resets_are_rate_limited():
+    accounts.create_user("ana", "password1")
+    for _ in range(password_reset.FAILED_RESETS_PER_ADDRESS):
+        with pytest.raises(password_reset.InvalidResetToken):
+            password_reset.complete_reset("1.9999999999.forged", "password2", "10.0.0.1")
+    with pytest.raises(password_reset.RateLimited):
+        password_reset.complete_reset("1.9999999999.forged", "password2", "10.0.0.1")
+    with pytest.raises(password_reset.InvalidResetToken):
+        password_reset.complete_reset("1.9999999999.forged", "password2", "10.0.0.2")
+
+
+# --- Tests for the password reset endpoints ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def mailed_link(mock_send_link):
+    """The link of the reset email sent in the background, once it is."""
+    for thread in threading.enumerate():
+        if thread.name.startswith("password-reset-"):
+            thread.join()
+    return mock_send_link.call_args[0][1]
+
+
+@patch('calibre_api.app.password_reset._send_link')
+def test_reset_endpoints(mock_send_link, client, smtp):
+    admin = accounts.create_user("root", "password1", role=accounts.ADMIN)
+    user = accounts.create_user("ana", "password1")
+    session = accounts.create_session(user["id"])["token"]
+    response = client.put("/auth/email", json={"email": "ana@example.org", "current_password": "password1"},
+                          headers={"Authorization": f"Bearer {session}"})
+    assert response.status_code == 200 and response.json()["email"] == "ana@example.org"
+
+    # Signed out, and the same answer for unknown addresses.
+    assert client.post("/auth/password-reset", json={"email": "nobody@example.org"}).status_code == 202
+    assert client.post("/auth/password-reset", json={"email": "ana@example.org"}).status_code == 202
+    assert mock_send_link.call_count == 1
+    token = mailed_link(mock_send_link).rsplit("/", 1)[1]
+    password_reset.audit(password_reset.SENT, user["id"])
+
+    assert client.get(f"/auth/password-reset/{token}").status_code == 200
+    assert client.post(f"/auth/password-reset/{token}", json={"new_password": "short"}).status_code == 400
+    response = client.post(f"/auth/password-reset/{token}", json={"new_password": "password2"})
+    assert response.status_code == 200 and response.json()["username"] == "ana"
+    assert client.get(f"/auth/password-reset/{token}").status_code == 404
+    assert client.post(f"/auth/password-reset/{token}", json={"new_password": "password3"}).status_code == 404
+    assert client.post("/auth/login", json={"username": "ana", "password": "password2"}).status_code == 200
+
+    admin_headers = {"Authorization": f"Bearer {accounts.create_session(admin['id'])['token']}"}
+    log = client.get("/admin/password-resets", headers=admin_headers).json()
+    assert [e["event"] for e in log][:3] == [password_reset.INVALID_TOKEN, password_reset.COMPLETED, password_reset.SENT]
+    # The reset ended the user's sessions.
+    assert client.get("/auth/me", headers={"Authorization": f"Bearer {session}"}).status_code == 401
+    user_headers = {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+    assert client.get("/admin/password-resets", headers=user_headers).status_code == 403
+
+
+def test_reset_request_limits_and_configuration(client, smtp, monkeypatch):
+    for _ in range(password_reset.REQUESTS_PER_EMAIL):
+        client.post("/auth/password-reset", json={"email": "ana@example.org"})
+    response = client.post("/auth/password-reset", json={"email": "ana@example.org"})
+    assert response.status_code == 429 and int(response.headers["retry-after"]) > 0
+
+    monkeypatch.delenv("SHELFSTONE_SMTP_HOST")
+    assert client.post("/auth/password-reset", json={"email": "sam@example.org"}).status_code == 503
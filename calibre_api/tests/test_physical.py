@@ -0,0 +1,51 @@
+from datetime import date
+from unittest import mock
+
+from calibre_api.app import physical
+
+
+@mock.patch("calibre_api.app.physical.set_values")
+def test_set_physical_copy_marks_book_as_physical(mock_set_values):
+    physical.set_physical_copy(4, {"shelf": "A3"}, library_path="/lib")
+    mock_set_values.assert_called_once_with(4, physical.PHYSICAL_COLUMNS, {"physical": True, "shelf": "A3"}, library_path="/lib")
+
+
+@mock.patch("calibre_api.app.physical.set_values")
+def test_lending_records_date(mock_set_values):
+    physical.set_physical_copy(4, {"loaned_to": "Sam"}, today=date(2026, 10, 16))
+    assert mock_set_values.call_args[0][2] == {"physical": True, "loaned_to": "Sam", "loaned_on": date(2026, 10, 16)}
+    physical.set_physical_copy(4, {"loaned_to": None})
+    assert mock_set_values.call_args[0][2] == {"physical": True, "loaned_to": None, "loaned_on": None}
+
+
+@mock.patch("calibre_api.app.physical.set_custom_field")
+@mock.patch("calibre_api.app.physical.list_custom_columns", return_value={"physical": 1, "shelf": 2})
+def test_clear_physical_copy_only_existing_columns(mock_list, mock_set):
+    physical.clear_physical_copy(4)
+    assert [c[0][1] for c in mock_set.call_args_list] == ["physical", "shelf"]
+
+
+def test_physical_search():
+    assert physical.physical_search() == "#physical:true"
+    assert physical.physical_search(shelf='Room "B"', loaned=True, search="author:Tolkien") == \
+        '#physical:true and #shelf:"=Room \\"B\\"" and #loaned_to:true and (author:Tolkien)'
+    assert physical.physical_search(condition="Good", loaned=False) == '#physical:true and #condition:"=Good" and #loaned_to:false'
+
+
+@mock.patch("calibre_api.app.physical.list_books")
+@mock.patch("calibre_api.app.physical.list_custom_columns", return_value={})
+def test_list_physical_copies_without_columns(mock_list_columns, mock_list_books):
+    assert physical.list_physical_copies() == []
+    mock_list_books.assert_not_called()
+
+
+@mock.patch("calibre_api.app.physical.list_books", return_value=[
+    {"id": 1, "title": "Dune", "*physical": True, "*shelf": "A3", "*loaned_on": "2026-10-01T12:00:00+00:00"},
+])
+@mock.patch("calibre_api.app.physical.list_custom_columns", return_value={"physical": 1})
+def test_list_physical_copies(mock_list_columns, mock_list_books):
+    books = physical.list_physical_copies(shelf="A3", library_path="/lib")
+    mock_list_books.assert_called_once_with(library_path="/lib", search_query='#physical:true and #shelf:"=A3"')
+    assert books[0]["physical_copy"] == {
+        "physical": True, "shelf": "A3", "condition": None, "loaned_to": None, "loaned_on": "2026-10-01",
+    }
@@ -0,0 +1,104 @@
+import xml.etree.ElementTree as ET
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, preferences
+from calibre_api.app.main import app
+
+ATOM = "{http://www.w3.org/2005/Atom}"
+
+
+def test_preferences_store():
+    assert preferences.get_preferences(1) == preferences.DEFAULTS
+    saved = preferences.set_preferences(1, {"download_format": "azw3", "items_per_page": 20, "languages": ["ENG", "eng", " deu"]})
+    assert (saved["download_format"], saved["items_per_page"], saved["languages"]) == ("AZW3", 20, ["eng", "deu"])
+    assert preferences.get_preferences(1) == saved
+    assert preferences.get_preferences(2) == preferences.DEFAULTS
+
+    # Replacing resets what's left out.
+    assert preferences.set_preferences(1, {"theme": "dark"}) == {**preferences.DEFAULTS, "theme": "dark"}
+    preferences.forget_user(1)
+    assert preferences.get_preferences(1) == preferences.DEFAULTS
+    assert preferences.effective(None) == preferences.DEFAULTS
+
+
+@pytest.mark.parametrize("values", [
+    {"font": "serif"}, {"default_sort": "color"}, {"download_format": "scroll"}, {"items_per_page": 0},
+    {"items_per_page": True}, {"theme": "neon"}, {"digest_frequency": "hourly"}, {"languages": "eng"},
+    {"languages": ["english"]},
+])
+def test_invalid_preferences(values):
+    with pytest.raises(ValueError):
+        preferences.set_preferences(1, values)
+
+
+# --- Tests for /me/preferences and where they apply ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    user = accounts.create_user("ana", "password1")
+    client = TestClient(app)
+    client.headers["Authorization"] = f"Bearer {accounts.create_session(user['id'])['token']}"
+    return client
+
+
+def test_preferences_endpoints(client):
+    assert client.get("/me/preferences").json()["theme"] == "system"
+    response = client.put("/me/preferences", json={"default_sort": "added", "download_format": "epub", "digest_frequency": "weekly"})
+    assert response.status_code == 200
+    assert (response.json()["download_format"], response.json()["digest_frequency"]) == ("EPUB", "weekly")
+    assert client.get("/me/preferences").json() == response.json()
+    assert client.put("/me/preferences", json={"theme": "neon"}).status_code == 400
+    assert client.put("/me/preferences", json={"items_per_page": 1000}).status_code == 400
+
+
+@patch('calibre_api.app.main.list_books_by_ids', side_effect=lambda ids, library_path=None: [{"id": i, "title": f"Book {i}"} for i in ids])
+@patch('calibre_api.app.main.list_book_ids', return_value=[5, 4, 3, 2, 1])
+def test_books_follow_preferred_sort_and_page_size(mock_ids, mock_by_ids, client):
+    client.put("/me/preferences", json={"default_sort": "added", "items_per_page": 2})
+    response = client.get("/books/")
+    assert [b["id"] for b in response.json()] == [5, 4]
+    assert response.headers["x-total-count"] == "5"
+    assert mock_ids.call_args[1]["sort_by"] == "timestamp" and mock_ids.call_args[1]["ascending"] is False
+
+    # The request's own choice wins.
+    assert len(client.get("/books/?sort=title&limit=3").json()) == 3
+    assert mock_ids.call_args[1]["sort_by"] == "title" and mock_ids.call_args[1]["ascending"] is True
+    assert client.get("/books/?sort=color").status_code == 400
+
+
+@patch('calibre_api.app.main.list_books')
+def test_download_serves_preferred_format(mock_list_books, client, tmp_path):
+    epub, azw3 = tmp_path / "Dune.epub", tmp_path / "Dune.azw3"
+    epub.write_bytes(b"epub data")
+    azw3.write_bytes(b"azw3 data")
+    mock_list_books.return_value = [{"id": 3, "title": "Dune", "authors": [], "formats": [str(epub), str(azw3)]}]
+
+    assert client.get("/books/3/download").content == b"epub data"
+    client.put("/me/preferences", json={"download_format": "azw3"})
+    assert client.get("/books/3/download").content == b"azw3 data"
+    assert client.get("/books/3/download?format=epub").content == b"epub data"
+    # Books without the preferred format get their best one, not a conversion.
+    client.put("/me/preferences", json={"download_format": "pdf"})
+    assert client.get("/books/3/download").headers["x-converted"] == "false"
+
+
+@patch('calibre_api.app.main.list_books', return_value=[
+    {"id": 1, "title": "Dune", "timestamp": "2026-01-01", "languages": ["eng"], "formats": ["/lib/Dune.epub", "/lib/Dune.azw3"]},
+    {"id": 2, "title": "Der Schwarm", "timestamp": "2026-02-01", "languages": ["deu"], "formats": []},
+    {"id": 3, "title": "Untitled notes", "timestamp": "2026-03-01", "formats": []},
+])
+def test_opds_follows_preferences(mock_list_books, client):
+    client.put("/me/preferences", json={"download_format": "azw3", "items_per_page": 1, "languages": ["eng"]})
+    feed = ET.fromstring(client.get("/opds/recent").text)
+    assert [e.find(f"{ATOM}title").text for e in feed.iter(f"{ATOM}entry")] == ["Untitled notes"]
+    assert feed.find("{http://a9.com/-/spec/opensearch/1.1/}totalResults").text == "2"
+
+    feed = ET.fromstring(client.get("/opds/recent?page=2").text)
+    entry = next(feed.iter(f"{ATOM}entry"))
+    hrefs = [l.get("href") for l in entry.iter(f"{ATOM}link") if l.get("rel") == "http://opds-spec.org/acquisition"]
+    assert hrefs == ["http://testserver/books/1/file/azw3", "http://testserver/books/1/file/epub"]
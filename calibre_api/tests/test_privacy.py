@@ -0,0 +1,78 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, activity, privacy, ratings, reading
+from calibre_api.app.main import app
+
+
+def test_settings():
+    assert privacy.get_settings(1) == {"activity": True, "reading_status": True, "ratings": True, "reviews": True}
+    assert privacy.hidden(privacy.ACTIVITY) == set()
+    assert privacy.update_settings(1, {"activity": False})["activity"] is False
+    # Leaving a setting out keeps it.
+    assert privacy.update_settings(1, {"reviews": False}) == {"activity": False, "reading_status": True, "ratings": True, "reviews": False}
+    privacy.update_settings(2, {"activity": True})
+    assert privacy.hidden(privacy.ACTIVITY) == {1}
+    assert privacy.hidden_from(1, privacy.ACTIVITY) == set()
+    with pytest.raises(ValueError):
+        privacy.update_settings(1, {"activity": "no"})
+    with pytest.raises(ValueError):
+        privacy.update_settings(1, {"email": False})
+
+    privacy.forget_user(1)
+    assert privacy.get_settings(1) == privacy.DEFAULTS
+
+
+def test_feed_privacy():
+    reading.set_progress(1, 5, {"percentage": 100})
+    ratings.set_rating(1, 5, 2, "Too long")
+    privacy.update_settings(1, {"reading_status": False, "ratings": False})
+    review, = activity.feed(2)
+    assert (review["kind"], review["rating"], review["review"]) == (activity.REVIEW_POSTED, None, "Too long")
+    privacy.update_settings(1, {"reviews": False})
+    assert activity.feed(2) == []
+    assert [e["kind"] for e in activity.feed(1)] == [activity.REVIEW_POSTED, activity.BOOK_FINISHED]
+
+
+# --- Tests for /me/privacy and the endpoints that apply it ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def sign_in(username, **kwargs):
+    user = accounts.create_user(username, "password1", **kwargs)
+    return user, {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+
+@patch('calibre_api.app.main.get_book_or_404', return_value={"id": 5, "title": "Dune"})
+def test_book_endpoints_apply_privacy(mock_get_book, client):
+    ana, ana_headers = sign_in("ana")
+    sam, sam_headers = sign_in("sam")
+    kim, kim_headers = sign_in("kim")
+    ratings.set_rating(ana["id"], 5, 5, "Spice!")
+    ratings.set_rating(sam["id"], 5, 3)
+    ratings.set_rating(kim["id"], 5, 1)
+    reading.set_progress(ana["id"], 5, {"percentage": 100})
+    reading.set_progress(sam["id"], 5, {"percentage": 40})
+
+    book_ratings = client.get("/books/5/ratings", headers=sam_headers).json()
+    assert (book_ratings["count"], book_ratings["average"]) == (3, 3.0)
+    assert client.get("/books/5/readers", headers=sam_headers).json()["finished"] == 1
+
+    assert client.patch("/me/privacy", json={"ratings": False, "reading_status": False}, headers=ana_headers).status_code == 200
+    client.patch("/me/privacy", json={"ratings": False}, headers=kim_headers)
+    book_ratings = client.get("/books/5/ratings", headers=sam_headers).json()
+    # Ana's review still shows, without the stars; Kim's rating had nothing else to show.
+    assert (book_ratings["count"], book_ratings["average"]) == (1, 3.0)
+    assert [(r["username"], r["rating"], r["review"]) for r in book_ratings["ratings"]] == [("sam", 3, None), ("ana", None, "Spice!")]
+    readers = client.get("/books/5/readers", headers=sam_headers).json()
+    assert (readers["reading"], readers["finished"], [r["username"] for r in readers["readers"]]) == (1, 0, ["sam"])
+    # Users always see their own.
+    assert client.get("/books/5/ratings", headers=ana_headers).json()["count"] == 2
+    assert client.get("/books/5/readers", headers=ana_headers).json()["finished"] == 1
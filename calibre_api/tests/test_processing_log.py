@@ -0,0 +1,93 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import processing_log
+
+
+def test_step_with_commands():
+    assert processing_log.entries(1) == []
+    with processing_log.step("add") as entry:
+        processing_log.record_command("calibredb", 0, 1.23456, "Added book ids: 1, 2\n", "")
+        entry["book_ids"] = [1, 2]
+        entry["detail"] = "Uploaded as 'dune.epub'."
+    # Commands outside of steps aren't logged.
+    processing_log.record_command("ebook-meta", 0, 0.1, "", "")
+    [logged] = processing_log.entries(2)
+    assert (logged["step"], logged["status"], logged["detail"], logged["error"]) == ("add", "ok", "Uploaded as 'dune.epub'.", None)
+    assert logged["commands"] == [{"tool": "calibredb", "returncode": 0, "duration": 1.235, "stdout": "Added book ids: 1, 2", "stderr": ""}]
+    assert len(processing_log.entries(1)) == 1
+    # The log belongs to one library.
+    assert processing_log.entries(1, library_path="/srv/other") == []
+
+
+def test_nested_steps_get_their_own_commands():
+    with processing_log.step("reextract metadata", [3]):
+        with processing_log.step("convert to EPUB on add", [3]):
+            processing_log.record_command("ebook-convert", 0, 2.0, "", "")
+        processing_log.record_command("ebook-meta", 0, 0.2, "", "")
+    inner, outer = processing_log.entries(3)[1], processing_log.entries(3)[0]
+    assert [c["tool"] for c in inner["commands"]] == ["ebook-convert"]
+    assert [c["tool"] for c in outer["commands"]] == ["ebook-meta"]
+
+
+def test_failed_step_is_logged_and_reraised():
+    with pytest.raises(RuntimeError):
+        with processing_log.step("convert to AZW3 for download", [4]):
+            processing_log.record_command("ebook-convert", 1, 0.5, "", "Traceback...\nValueError: No cover")
+            raise RuntimeError("Conversion to AZW3 failed.")
+    [logged] = processing_log.entries(4)
+    assert (logged["status"], logged["error"]) == ("failed", "Conversion to AZW3 failed.")
+    assert logged["commands"][0]["stderr"].endswith("No cover")
+
+
+def test_steps_without_books_or_discarded_are_not_logged():
+    with pytest.raises(ValueError):
+        with processing_log.step("add"):
+            raise ValueError("Not an e-book.")
+    with processing_log.step("convert to EPUB for download", [5]) as entry:
+        entry["discard"] = True
+    assert not os.path.exists(processing_log.db_path())
+
+
+def test_long_output_is_trimmed():
+    with processing_log.step("add", [6]):
+        processing_log.record_command("calibredb", 0, 1.0, "x" * 10 + "y" * processing_log.MAX_OUTPUT_CHARS, None)
+    command = processing_log.entries(6)[0]["commands"][0]
+    assert command["stdout"] == "..." + "y" * processing_log.MAX_OUTPUT_CHARS
+    assert command["stderr"] == ""
+
+
+def test_log_is_capped_per_book():
+    with mock.patch.object(processing_log, "MAX_ENTRIES_PER_BOOK", 3):
+        for n in range(5):
+            with processing_log.step(f"step {n}", [7]):
+                pass
+    assert [e["step"] for e in processing_log.entries(7)] == ["step 4", "step 3", "step 2"]
+    assert len(processing_log.entries(7, limit=1)) == 1
+
+
+def test_write_failure_is_only_logged():
+    with mock.patch.object(processing_log, "connect", side_effect=OSError("read-only file system")):
+        with processing_log.step("add", [8]):
+            pass
+
+
+def test_forget_books():
+    for book_id in (1, 2):
+        with processing_log.step("add", [book_id]):
+            pass
+    processing_log.forget_books([1])
+    assert processing_log.entries(1) == []
+    assert len(processing_log.entries(2)) == 1
+
+
+def test_log_is_kept_in_the_state_dir(tmp_path):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_STATE_DIR": str(tmp_path)}):
+        os.environ.pop("SHELFSTONE_PROCESSING_LOG_DB", None)
+        assert processing_log.db_path() == str(tmp_path / "processing_log.db")
+        conn = processing_log.connect()
+        try:
+            assert conn.execute("PRAGMA user_version").fetchone()[0] == len(processing_log.MIGRATIONS)
+        finally:
+            conn.close()
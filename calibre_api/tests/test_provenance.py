@@ -0,0 +1,55 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import provenance
+
+
+def test_record_and_look_up_sources():
+    assert provenance.sources_of([1]) == {}
+    provenance.record([1, 2], "Upload", detail="dune.epub", client="10.0.0.2")
+    provenance.record([3], provenance.NEWS, detail="the-guardian")
+    sources = provenance.sources_of([1, 3, 4])
+    assert set(sources) == {1, 3}
+    assert (sources[1]["source"], sources[1]["detail"], sources[1]["client"]) == ("upload", "dune.epub", "10.0.0.2")
+    assert provenance.books_from("upload") == {1, 2}
+    # Sources belong to one library.
+    assert provenance.books_from("upload", library_path="/srv/other") == set()
+
+
+def test_unknown_source_is_rejected():
+    with pytest.raises(ValueError):
+        provenance.record([1], "email")
+    with pytest.raises(ValueError):
+        provenance.books_from("watcher")
+
+
+def test_record_failure_is_only_logged():
+    with mock.patch.object(provenance, "connect", side_effect=OSError("read-only file system")):
+        provenance.record([1], provenance.UPLOAD)
+
+
+def test_forget_books():
+    provenance.record([1, 2], provenance.IMPORT, detail="/srv/inbox/a.epub")
+    provenance.forget_books([1])
+    assert set(provenance.sources_of([1, 2])) == {2}
+
+
+def test_books_added_by_a_user():
+    provenance.record([1, 2], provenance.UPLOAD, user_id=5)
+    provenance.record([1], provenance.PACKAGE, library_path="/srv/other", user_id=5)
+    provenance.record([3], provenance.UPLOAD, user_id=6)
+    assert [(b["library"], b["book_id"]) for b in provenance.books_added_by(5)] == [("", 1), ("", 2), ("/srv/other", 1)]
+    assert provenance.sources_of([1])[1]["user_id"] == 5
+    assert provenance.reassign_user(5, 1) == 3
+    assert provenance.books_added_by(5) == [] and len(provenance.books_added_by(1)) == 3
+
+def test_sources_are_kept_in_the_state_dir(tmp_path):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_STATE_DIR": str(tmp_path)}):
+        os.environ.pop("SHELFSTONE_PROVENANCE_DB", None)
+        assert provenance.db_path() == str(tmp_path / "provenance.db")
+        conn = provenance.connect()
+        try:
+            assert conn.execute("PRAGMA user_version").fetchone()[0] == len(provenance.MIGRATIONS)
+        finally:
+            conn.close()
@@ -0,0 +1,98 @@
+import os
+from unittest import mock
+
+from fastapi import FastAPI, Request
+from fastapi.testclient import TestClient
+
+from calibre_api.app import public_app, serve
+
+
+def make_api():
+    api = FastAPI(title="Test API", version="1.0")
+
+    @api.get("/opds")
+    def opds_root():
+        return {"feed": "root"}
+
+    @api.get("/opds/authors/{name}")
+    def opds_author(name: str):
+        return {"author": name}
+
+    @api.get("/books/{book_id}/download")
+    def download(request: Request, book_id: int, library_path: str = None):
+        return {"download": book_id, "library_path": library_path, "public": public_app.is_public_request(request)}
+
+    @api.get("/books/{book_id}/file/{format_extension}")
+    def book_file(book_id: int, format_extension: str):
+        return {"file": format_extension}
+
+    @api.get("/books/{book_id}/cover")
+    def cover(book_id: int):
+        return {"cover": book_id}
+
+    @api.get("/books/{book_id}/")
+    def book(book_id: int):
+        return {"book": book_id}
+
+    @api.post("/books/add/")
+    def add():
+        return {}
+
+    @api.get("/admin/logs")
+    def logs():
+        return []
+
+    return api
+
+
+def test_public_app_serves_only_public_routes():
+    client = TestClient(public_app.build(make_api()))
+    assert client.get("/opds").json() == {"feed": "root"}
+    assert client.get("/opds/authors/Jane Austen").json() == {"author": "Jane Austen"}
+    assert client.get("/books/3/download").json()["download"] == 3
+    assert client.get("/books/3/file/epub").json() == {"file": "epub"}
+    assert client.get("/books/3/cover").json() == {"cover": 3}
+    for path in ["/books/3/", "/admin/logs", "/docs", "/openapi.json"]:
+        assert client.get(path).status_code == 404
+    assert client.post("/books/add/").status_code == 404
+
+
+def test_public_app_has_its_own_middleware():
+    api = make_api()
+    client = TestClient(public_app.build(api, ["https://read.example.org"]))
+    response = client.get("/opds", headers={"Origin": "https://read.example.org"})
+    assert response.headers["access-control-allow-origin"] == "https://read.example.org"
+    assert "access-control-allow-origin" not in TestClient(api).get("/opds", headers={"Origin": "https://read.example.org"}).headers
+
+
+def test_parse_origins():
+    assert public_app.parse_origins(" https://a.example/, https://b.example ") == ["https://a.example", "https://b.example"]
+    assert public_app.parse_origins(None) == []
+
+
+def test_public_listener():
+    with mock.patch.dict(os.environ, clear=True):
+        assert serve.public_listener() is None
+    with mock.patch.dict(os.environ, {"SHELFSTONE_PUBLIC_PORT": "8080"}, clear=True):
+        assert serve.public_listener() == {"host": "0.0.0.0", "port": 8080}
+    with mock.patch.dict(os.environ, {"SHELFSTONE_PUBLIC_PORT": "8080", "SHELFSTONE_PUBLIC_SOCKET": "/run/shelfstone.sock"}, clear=True):
+        assert serve.public_listener() == {"uds": "/run/shelfstone.sock"}
+
+
+def test_public_app_serves_the_configured_library():
+    api = make_api()
+    with mock.patch.dict(os.environ, {"CALIBRE_LIBRARY_PATH": "/srv/library"}):
+        client = TestClient(public_app.build(api))
+        assert client.get("/books/3/download").json() == {"download": 3, "library_path": "/srv/library", "public": True}
+        response = client.get("/books/3/download", params={"library_path": "/home/someone/secret"})
+        assert response.status_code == 400
+        # The main app is unaffected.
+        assert TestClient(api).get("/books/3/download", params={"library_path": "/other"}).json() == {
+            "download": 3, "library_path": "/other", "public": False}
+
+
+def test_conversion_enabled():
+    with mock.patch.dict(os.environ, clear=True):
+        assert public_app.conversion_enabled() is False
+    with mock.patch.dict(os.environ, {"SHELFSTONE_PUBLIC_CONVERSION": "1"}):
+        assert public_app.conversion_enabled() is True
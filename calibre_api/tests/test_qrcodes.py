@@ -0,0 +1,73 @@
+import os
+import sys
+import types
+import pytest
+from unittest import mock
+
+from calibre_api.app import qrcodes
+
+
+@pytest.fixture
+def fake_qrcode():
+    """A stand-in for the qrcode package that records the encoded data."""
+    encoded = []
+
+    class FakeImage:
+        def save(self, buffer, format):
+            buffer.write(b"PNG:" + encoded[-1].encode())
+
+    class FakeQRCode:
+        def __init__(self, error_correction, box_size, border):
+            self.data = None
+
+        def add_data(self, data):
+            encoded.append(data)
+
+        def make(self, fit):
+            pass
+
+        def make_image(self, fill_color, back_color):
+            return FakeImage()
+
+    module = types.ModuleType("qrcode")
+    module.QRCode = FakeQRCode
+    constants = types.ModuleType("qrcode.constants")
+    constants.ERROR_CORRECT_M = 0
+    with mock.patch.dict(sys.modules, {"qrcode": module, "qrcode.constants": constants}):
+        yield encoded
+
+
+def test_book_link():
+    assert qrcodes.book_link(7, "http://host:6336/") == "http://host:6336/books/7/card"
+    assert qrcodes.book_link(7, "http://host", "/srv/My Library") == "http://host/books/7/card?library_path=%2Fsrv%2FMy+Library"
+
+
+def test_public_base_url_prefers_env():
+    with mock.patch.dict(os.environ, {"SHELFSTONE_PUBLIC_URL": "https://books.example.org/api/"}):
+        assert qrcodes.public_base_url("http://127.0.0.1:6336/") == "https://books.example.org/api"
+    with mock.patch.dict(os.environ, {}, clear=True):
+        assert qrcodes.public_base_url("http://127.0.0.1:6336/") == "http://127.0.0.1:6336"
+
+
+def test_qr_png(fake_qrcode):
+    assert qrcodes.qr_png("http://host/books/7/card") == b"PNG:http://host/books/7/card"
+
+
+def test_qr_png_without_package():
+    with mock.patch.dict(sys.modules, {"qrcode": None}):
+        with pytest.raises(qrcodes.QrCodeUnavailable):
+            qrcodes.qr_png("x")
+
+
+def test_render_label_sheet_html(fake_qrcode):
+    books = [
+        {"id": 1, "title": "Dune <1965>", "authors": ["Frank Herbert"]},
+        {"id": 2, "title": "Emma", "authors": "Jane Austen"},
+    ]
+    links = {1: "http://host/books/1/card", 2: "http://host/books/2/card"}
+    page = qrcodes.render_label_sheet_html(books, links, title="Shelf A3", columns=4)
+    assert fake_qrcode == [links[1], links[2]]
+    assert page.count('class="label"') == 2
+    assert "Dune &lt;1965&gt;" in page
+    assert "Jane Austen" in page
+    assert "repeat(4, 1fr)" in page
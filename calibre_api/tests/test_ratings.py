@@ -0,0 +1,90 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, ratings
+from calibre_api.app.main import app
+
+
+def test_one_rating_per_user_and_book():
+    first = ratings.set_rating(1, 5, 3, " Slow start ")
+    assert (first["rating"], first["review"]) == (3, "Slow start")
+    second = ratings.set_rating(1, 5, 5)
+    assert (second["id"], second["rating"], second["review"]) == (first["id"], 5, None)
+    assert second["created_at"] == first["created_at"]
+    ratings.set_rating(2, 5, 4)
+    ratings.set_rating(1, 6, 2, library_path="/other")
+    assert [r["user_id"] for r in ratings.book_ratings(5)] == [2, 1]
+    assert [r["book_id"] for r in ratings.user_ratings(1)] == [5]
+
+    assert ratings.clear_rating(1, 5)
+    assert not ratings.clear_rating(1, 5)
+    assert ratings.get_rating(1, 5) is None
+
+
+@pytest.mark.parametrize("rating", [0, 6, 2.5, True])
+def test_invalid_ratings(rating):
+    with pytest.raises(ValueError):
+        ratings.set_rating(1, 5, rating)
+
+
+def test_forget_books_and_users():
+    ratings.set_rating(1, 5, 3)
+    ratings.set_rating(2, 6, 3)
+    ratings.forget_books([5])
+    assert ratings.book_ratings(5) == []
+    ratings.forget_user(2)
+    assert ratings.user_ratings(2) == []
+
+
+# --- Tests for the rating and /me endpoints ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def sign_in(username):
+    user = accounts.create_user(username, "password1")
+    return {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+
+@patch('calibre_api.app.main.get_book_or_404', return_value={"id": 5, "title": "Dune"})
+def test_rating_endpoints(mock_get_book, client):
+    ana, sam = sign_in("ana"), sign_in("sam")
+    response = client.put("/books/5/rating", json={"rating": 5, "review": "A classic."}, headers=ana)
+    assert response.status_code == 200
+    assert response.json()["username"] == "ana"
+    client.put("/books/5/rating", json={"rating": 2}, headers=sam)
+    assert client.put("/books/5/rating", json={"rating": 9}, headers=sam).status_code == 422
+
+    summary = client.get("/books/5/ratings", headers=sam).json()
+    assert (summary["count"], summary["average"]) == (2, 3.5)
+    assert {r["username"]: r["review"] for r in summary["ratings"]} == {"ana": "A classic.", "sam": None}
+
+    # /me/ratings only shows your own.
+    assert [r["rating"] for r in client.get("/me/ratings", headers=sam).json()] == [2]
+    assert client.delete("/books/5/rating", headers=sam).status_code == 204
+    assert client.get("/me/ratings", headers=sam).json() == []
+    assert client.delete("/books/5/rating", headers=sam).status_code == 404
+
+
+@patch('calibre_api.app.main.get_book_or_404', return_value={"id": 5, "title": "Dune"})
+def test_my_library_is_per_user(mock_get_book, client):
+    ana, sam = sign_in("ana"), sign_in("sam")
+    client.post("/collections/", json={"name": "Favorites"}, headers=ana)
+    client.post("/collections/", json={"name": "Favorites"}, headers=sam)
+    client.put("/books/5/progress", json={"percentage": 10}, headers=ana)
+    client.post("/me/wishlist", json={"title": "Emma"}, headers=ana)
+
+    assert [c["name"] for c in client.get("/me/shelves", headers=ana).json()] == ["Favorites"]
+    # Sam's shelf is private until it is shared.
+    assert len(client.get("/collections/", headers=ana).json()) == 1
+    assert [p["book_id"] for p in client.get("/me/progress", headers=ana).json()] == [5]
+    for path in ("/me/progress", "/me/ratings", "/me/wishlist", "/me/downloads"):
+        response = client.get(path, headers=sam).json()
+        assert response in ([], {"total": 0, "downloads": []}), path
+    assert client.get("/me/shelves").status_code == 401
@@ -0,0 +1,73 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, ratings, reactions
+from calibre_api.app.main import app
+
+
+def test_reactions():
+    assert reactions.parse("heart") == reactions.parse("❤️") == "❤️"
+    with pytest.raises(ValueError):
+        reactions.parse("angry")
+
+    reactions.react(1, 5, "😴")
+    reactions.react(1, 5, "👍")
+    assert reactions.react(1, 5, "👍") == {"counts": {"👍": 1, "😴": 1}, "mine": ["👍", "😴"]}
+    reactions.react(2, 5, "👍")
+    reactions.react(2, 5, "❤️", rating_id=8)
+    reactions.react(2, 5, "👍", library_path="/other")
+    assert reactions.summary(5, user_id=3) == {"counts": {"👍": 2, "😴": 1}, "mine": []}
+    assert reactions.book_counts([5, 6]) == {5: {"👍": 2, "😴": 1}}
+    assert reactions.review_counts([8]) == {8: {"❤️": 1}}
+
+    assert reactions.unreact(1, 5, "😴")["counts"] == {"👍": 2}
+    with pytest.raises(reactions.ReactionNotFound):
+        reactions.unreact(1, 5, "😴")
+    assert [r["rating_id"] for r in reactions.export_user(2)] == [None, 8, None]
+    reactions.forget_user(1)
+    assert reactions.book_counts([5]) == {5: {"👍": 1}}
+
+    reactions.forget_books([5])
+    assert reactions.book_counts([5]) == {} and reactions.review_counts([8]) == {}
+    assert reactions.book_counts([5], library_path="/other") == {5: {"👍": 1}}
+
+
+# --- Tests for /books/{book_id}/reactions ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def sign_in(username, **kwargs):
+    user = accounts.create_user(username, "password1", **kwargs)
+    return user, {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+
+@patch('calibre_api.app.main.get_book_or_404', return_value={"id": 5, "title": "Dune", "tags": "SF"})
+def test_reaction_endpoints(mock_get_book, client):
+    ana, ana_headers = sign_in("ana")
+    _, fan_headers = sign_in("lee", tags=["SF"])
+    response = client.put("/books/5/reactions/thumbs_up", headers=ana_headers)
+    assert response.json() == {"counts": {"👍": 1}, "mine": ["👍"]}
+    # Users restricted to some tags may react to the books they can see.
+    assert client.put("/books/5/reactions/%F0%9F%91%8D", headers=fan_headers).json()["counts"] == {"👍": 2}
+    assert client.put("/books/5/reactions/angry", headers=ana_headers).status_code == 400
+    assert client.delete("/books/5/reactions/sleepy", headers=ana_headers).status_code == 404
+    assert client.get("/books/5/reactions", headers=fan_headers).json()["mine"] == ["👍"]
+
+    rating = ratings.set_rating(ana["id"], 5, 4, "Spice!")
+    url = f"/books/5/ratings/{rating['id']}/reactions"
+    assert client.put(f"{url}/heart", headers=fan_headers).json() == {"counts": {"❤️": 1}, "mine": ["❤️"]}
+    assert client.put(f"/books/6/ratings/{rating['id']}/reactions/heart", headers=fan_headers).status_code == 404
+    assert client.get("/books/5/ratings", headers=ana_headers).json()["ratings"][0]["reactions"] == {"❤️": 1}
+    assert client.get("/me/ratings", headers=ana_headers).json()[0]["reactions"] == {"❤️": 1}
+
+    # Removing the rating takes its reactions along.
+    assert client.delete("/books/5/rating", headers=ana_headers).status_code == 204
+    assert reactions.review_counts([rating["id"]]) == {}
+    assert client.delete("/books/5/reactions/thumbs_up", headers=ana_headers).json() == {"counts": {"👍": 1}, "mine": []}
@@ -0,0 +1,114 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, reading
+from calibre_api.app.main import app
+
+
+def test_progress_is_per_user_and_library():
+    assert reading.get_progress(1, 5) is None
+    saved = reading.set_progress(1, 5, {"position": " epubcfi(/6/4) ", "percentage": 12.5, "format": "epub"})
+    assert saved["position"] == "epubcfi(/6/4)" and saved["format"] == "EPUB"
+    assert reading.get_progress(1, 5)["percentage"] == 12.5
+    assert reading.get_progress(2, 5) is None
+    assert reading.get_progress(1, 5, library_path="/other") is None
+
+    # The last update replaces the record, fields it leaves out included.
+    reading.set_progress(1, 5, {"page": 40, "device": "Kobo"})
+    progress = reading.get_progress(1, 5)
+    assert (progress["page"], progress["position"], progress["device"]) == (40, None, "Kobo")
+    assert [p["book_id"] for p in reading.list_progress(1)] == [5]
+
+    assert reading.clear_progress(1, 5)
+    assert not reading.clear_progress(1, 5)
+
+
+@pytest.mark.parametrize("values", [{}, {"device": "Kobo"}, {"percentage": 101}, {"page": -1}, {"color": "red", "page": 1}])
+def test_invalid_progress(values):
+    with pytest.raises(ValueError):
+        reading.set_progress(1, 5, values)
+
+
+def test_bookmarks():
+    later = reading.add_bookmark(1, 5, {"position": "b", "percentage": 80})
+    earlier = reading.add_bookmark(1, 5, {"position": "a", "percentage": 10, "note": "Start"})
+    unplaced = reading.add_bookmark(1, 5, {"position": "c"})
+    assert [b["id"] for b in reading.list_bookmarks(1, 5)] == [earlier["id"], later["id"], unplaced["id"]]
+    assert reading.list_bookmarks(2, 5) == []
+
+    updated = reading.update_bookmark(1, 5, earlier["id"], {"note": "The beginning"})
+    assert (updated["note"], updated["position"]) == ("The beginning", "a")
+    with pytest.raises(ValueError):
+        reading.update_bookmark(1, 5, earlier["id"], {"position": ""})
+    with pytest.raises(reading.BookmarkNotFound):
+        reading.update_bookmark(2, 5, earlier["id"], {"note": "Not mine"})
+    with pytest.raises(ValueError):
+        reading.add_bookmark(1, 5, {"note": "Nowhere"})
+
+    reading.delete_bookmark(1, 5, later["id"])
+    with pytest.raises(reading.BookmarkNotFound):
+        reading.delete_bookmark(1, 5, later["id"])
+
+
+def test_forget_books_and_users():
+    reading.set_progress(1, 5, {"page": 1})
+    reading.set_progress(2, 6, {"page": 1})
+    reading.add_bookmark(1, 5, {"position": "a"})
+    reading.forget_books([5])
+    assert reading.get_progress(1, 5) is None and reading.list_bookmarks(1, 5) == []
+    reading.forget_user(2)
+    assert reading.get_progress(2, 6) is None
+
+
+# --- Tests for the /books/{book_id}/progress and /bookmarks endpoints ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    return TestClient(app)
+
+
+def sign_in(username, role=accounts.USER):
+    user = accounts.create_user(username, "password1", role=role)
+    return {"Authorization": f"Bearer {accounts.create_session(user['id'])['token']}"}
+
+
+@patch('calibre_api.app.main.get_book_or_404', return_value={"id": 5, "title": "Dune"})
+def test_progress_endpoints(mock_get_book, client):
+    ana, sam = sign_in("ana"), sign_in("sam")
+    assert client.get("/books/5/progress", headers=ana).status_code == 404
+
+    response = client.put("/books/5/progress", json={"position": "epubcfi(/6/4)", "percentage": 30}, headers=ana)
+    assert response.status_code == 200
+    assert response.json()["book_id"] == 5
+    assert client.get("/books/5/progress", headers=ana).json()["percentage"] == 30
+    assert client.get("/books/5/progress", headers=sam).status_code == 404
+    assert client.put("/books/5/progress", json={"device": "Kobo"}, headers=ana).status_code == 400
+    assert client.put("/books/5/progress", json={"percentage": 130}, headers=ana).status_code == 422
+
+    assert client.delete("/books/5/progress", headers=ana).status_code == 204
+    assert client.delete("/books/5/progress", headers=ana).status_code == 404
+
+
+@patch('calibre_api.app.main.get_book_or_404', return_value={"id": 5, "title": "Dune"})
+def test_bookmark_endpoints(mock_get_book, client):
+    ana, sam = sign_in("ana"), sign_in("sam")
+    response = client.post("/books/5/bookmarks", json={"position": "epubcfi(/6/8)", "note": "Litany"}, headers=ana)
+    assert response.status_code == 201
+    bookmark = response.json()
+    assert [b["note"] for b in client.get("/books/5/bookmarks", headers=ana).json()] == ["Litany"]
+    assert client.get("/books/5/bookmarks", headers=sam).json() == []
+
+    response = client.patch(f"/books/5/bookmarks/{bookmark['id']}", json={"note": "Fear"}, headers=ana)
+    assert response.json()["note"] == "Fear"
+    assert client.patch(f"/books/5/bookmarks/{bookmark['id']}", json={"note": "x"}, headers=sam).status_code == 404
+    assert client.delete(f"/books/5/bookmarks/{bookmark['id']}", headers=sam).status_code == 404
+    assert client.delete(f"/books/5/bookmarks/{bookmark['id']}", headers=ana).status_code == 204
+
+
+def test_progress_needs_accounts(client, monkeypatch):
+    monkeypatch.delenv("SHELFSTONE_ACCOUNTS")
+    assert client.get("/books/5/progress").status_code == 403
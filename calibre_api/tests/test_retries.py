@@ -0,0 +1,71 @@
+import pytest
+from unittest import mock
+
+from calibre_api.app import metrics
+from calibre_api.app.calibre_cli import run_calibre_command
+
+
+@pytest.fixture(autouse=True)
+def reset_metrics():
+    metrics.reset()
+    yield
+    metrics.reset()
+
+
+def result(returncode, stderr=""):
+    return mock.Mock(returncode=returncode, stdout="out", stderr=stderr)
+
+
+@mock.patch('calibre_api.app.calibre_cli.time.sleep')
+@mock.patch('calibre_api.app.calibre_cli.subprocess.run')
+def test_transient_failure_is_retried_with_backoff(mock_run, mock_sleep):
+    mock_run.side_effect = [
+        result(1, "apsw.BusyError: database is locked"),
+        result(1, "database is locked"),
+        result(0),
+    ]
+    stdout, stderr, returncode = run_calibre_command(["calibredb", "add", "book.epub"])
+
+    assert returncode == 0
+    assert mock_run.call_count == 3
+    assert [c.args[0] for c in mock_sleep.call_args_list] == [0.5, 1.0]
+    assert metrics.recent_failures() == []
+    text = metrics.render_prometheus()
+    assert 'shelfstone_calibre_command_retries_total{tool="calibredb",error_type="library_locked"} 2' in text
+
+
+@mock.patch('calibre_api.app.calibre_cli.time.sleep')
+@mock.patch('calibre_api.app.calibre_cli.subprocess.run', return_value=result(-9))
+def test_crash_is_not_retried(mock_run, mock_sleep):
+    # The killed command may already have written to the library; running it again could add the book twice.
+    run_calibre_command(["calibredb", "add", "book.epub"])
+    assert mock_run.call_count == 1
+    assert metrics.recent_failures()[0]["error_type"] == metrics.ERROR_CRASHED
+
+
+@mock.patch('calibre_api.app.calibre_cli.time.sleep')
+@mock.patch('calibre_api.app.calibre_cli.subprocess.run', return_value=result(1, "database is locked"))
+def test_retries_stop_at_max_attempts(mock_run, mock_sleep):
+    stdout, stderr, returncode = run_calibre_command(["calibredb", "list"])
+
+    assert returncode == 1
+    assert mock_run.call_count == 3
+    failure = metrics.recent_failures()[0]
+    assert failure["error_type"] == metrics.ERROR_LIBRARY_LOCKED
+    assert [a["error_type"] for a in failure["attempts"]] == ["library_locked"] * 3
+
+
+@mock.patch('calibre_api.app.calibre_cli.time.sleep')
+@mock.patch('calibre_api.app.calibre_cli.subprocess.run', return_value=result(1, "calibre.ebooks.DRMError"))
+def test_permanent_failure_is_not_retried(mock_run, mock_sleep):
+    run_calibre_command(["ebook-convert", "a.azw", "b.epub"])
+    assert mock_run.call_count == 1
+    mock_sleep.assert_not_called()
+
+
+@mock.patch.dict("os.environ", {"SHELFSTONE_CLI_MAX_ATTEMPTS": "1"})
+@mock.patch('calibre_api.app.calibre_cli.time.sleep')
+@mock.patch('calibre_api.app.calibre_cli.subprocess.run', return_value=result(1, "database is locked"))
+def test_retries_can_be_disabled(mock_run, mock_sleep):
+    run_calibre_command(["calibredb", "list"])
+    assert mock_run.call_count == 1
@@ -0,0 +1,52 @@
+import zipfile
+import xml.etree.ElementTree as ET
+from unittest import mock
+
+import pytest
+
+from calibre_api.app import seed
+from calibre_api.app.isbn import normalize_isbn
+
+OPF = "{http://www.idpf.org/2007/opf}"
+DC = "{http://purl.org/dc/elements/1.1/}"
+
+
+def test_generate_books_is_deterministic_and_varied():
+    books = seed.generate_books(60, seed=7)
+    assert books == seed.generate_books(60, seed=7)
+    assert books != seed.generate_books(60, seed=8)
+    assert len({tuple(b["authors"]) for b in books}) > 5
+    assert all(normalize_isbn(b["isbn"]) == b["isbn"] for b in books)
+    series_books = [b for b in books if b["series"]]
+    assert series_books
+    for name in {b["series"] for b in series_books}:
+        indexes = [b["series_index"] for b in series_books if b["series"] == name]
+        assert indexes == [float(i) for i in range(1, len(indexes) + 1)]
+
+
+def test_build_epub_writes_calibre_readable_opf(tmp_path):
+    book = dict(seed.generate_books(1)[0], title="Tea & Sympathy", series="Starfall", series_index=2.0)
+    path = seed.build_epub(book, str(tmp_path / "book.epub"), cover=b"\xff\xd8jpeg")
+    with zipfile.ZipFile(path) as epub:
+        assert epub.namelist()[0] == "mimetype" and epub.getinfo("mimetype").compress_type == zipfile.ZIP_STORED
+        assert epub.read("cover.jpg") == b"\xff\xd8jpeg"
+        metadata = ET.fromstring(epub.read("content.opf")).find(f"{OPF}metadata")
+    assert metadata.find(f"{DC}title").text == "Tea & Sympathy"
+    assert [c.text for c in metadata.findall(f"{DC}creator")] == book["authors"]
+    meta = {m.get("name"): m.get("content") for m in metadata.findall(f"{OPF}meta")}
+    assert meta == {"calibre:series": "Starfall", "calibre:series_index": "2.0", "cover": "cover-image"}
+
+
+def test_seed_library_adds_in_batches(tmp_path):
+    with mock.patch.object(seed, "add_books", side_effect=lambda paths, **kw: list(range(len(paths)))) as mock_add, \
+            mock.patch.object(seed, "render_cover", return_value=None):
+        added = seed.seed_library(5, str(tmp_path / "library"), batch_size=2)
+    assert len(added) == 5
+    assert [len(c[0][0]) for c in mock_add.call_args_list] == [2, 2, 1]
+    assert mock_add.call_args[1] == {"library_path": str(tmp_path / "library"), "duplicates": True}
+
+
+def test_main_refuses_non_empty_folder(tmp_path):
+    (tmp_path / "metadata.db").write_bytes(b"")
+    with pytest.raises(SystemExit):
+        seed.main(["--books", "3", "--library", str(tmp_path)])
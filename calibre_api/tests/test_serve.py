@@ -0,0 +1,42 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import serve
+
+
+def test_systemd_sockets():
+    environ = {"LISTEN_FDS": "2", "LISTEN_PID": "42", "LISTEN_FDNAMES": "shelfstone.socket:public", "HOME": "/root"}
+    assert serve.systemd_sockets(environ, pid=42) == {"api": 3, "public": 4}
+    # The variables are consumed, so subprocesses don't inherit them.
+    assert environ == {"HOME": "/root"}
+
+
+def test_systemd_sockets_without_names():
+    assert serve.systemd_sockets({"LISTEN_FDS": "1", "LISTEN_PID": "42"}, pid=42) == {"api": 3}
+
+
+def test_systemd_sockets_for_another_process():
+    environ = {"LISTEN_FDS": "1", "LISTEN_PID": "7"}
+    assert serve.systemd_sockets(environ, pid=42) == {}
+    assert environ == {}
+    assert serve.systemd_sockets({}, pid=42) == {}
+
+
+@pytest.mark.parametrize("environ", [
+    {"LISTEN_FDS": "two", "LISTEN_PID": "42"},
+    {"LISTEN_FDS": "2", "LISTEN_PID": "42", "LISTEN_FDNAMES": "a.socket:b.socket"},
+])
+def test_systemd_sockets_invalid(environ):
+    with pytest.raises(ValueError):
+        serve.systemd_sockets(environ, pid=42)
+
+
+def test_api_listener():
+    with mock.patch.dict(os.environ, clear=True):
+        assert serve.api_listener() == {"host": "0.0.0.0", "port": 6336}
+        assert serve.api_listener({"api": 3}) == {"fd": 3}
+    with mock.patch.dict(os.environ, {"SHELFSTONE_SOCKET": "/run/shelfstone/api.sock", "SHELFSTONE_PORT": "8000"}, clear=True):
+        assert serve.api_listener() == {"uds": "/run/shelfstone/api.sock"}
+        assert serve.api_listener({"public": 3}) == {"uds": "/run/shelfstone/api.sock"}
+        assert serve.public_listener({"public": 4}) == {"fd": 4}
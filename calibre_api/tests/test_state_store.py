@@ -0,0 +1,88 @@
+import os
+import sqlite3
+from unittest import mock
+
+import pytest
+
+from calibre_api.app import state_store
+
+
+def test_state_dir_default():
+    with mock.patch.dict(os.environ, clear=True):
+        assert state_store.state_dir() == os.path.join(os.path.expanduser("~"), ".shelfstone")
+
+
+def test_state_path(tmp_path):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_STATE_DIR": str(tmp_path)}):
+        os.environ.pop("SHELFSTONE_TEST_DB", None)
+        assert state_store.state_path("SHELFSTONE_TEST_DB", "test.db") == str(tmp_path / "test.db")
+        # A file's own variable wins over the state directory.
+        os.environ["SHELFSTONE_TEST_DB"] = "/data/test.db"
+        assert state_store.state_path("SHELFSTONE_TEST_DB", "test.db") == "/data/test.db"
+
+
+def test_library_key():
+    assert state_store.library_key(None) == ""
+    assert state_store.library_key("lib") == os.path.abspath("lib")
+
+
+def test_connect_creates_folder_and_versions_database(tmp_path):
+    path = str(tmp_path / "state" / "s.db")
+    conn = state_store.connect(path, [("CREATE TABLE a (x)",)])
+    try:
+        assert conn.execute("PRAGMA user_version").fetchone()[0] == 1
+        assert conn.execute("SELECT * FROM a").fetchall() == []
+    finally:
+        conn.close()
+
+
+def test_migrations_run_once_in_order(tmp_path):
+    path = str(tmp_path / "s.db")
+    calls = []
+    migrations = [("CREATE TABLE a (x)",), lambda conn: calls.append("data")]
+    state_store.connect(path, migrations).close()
+    state_store.connect(path, migrations).close()
+    assert calls == ["data"]
+    migrations.append(("ALTER TABLE a ADD COLUMN y",))
+    conn = state_store.connect(path, migrations)
+    try:
+        assert conn.execute("PRAGMA user_version").fetchone()[0] == 3
+        assert [row[1] for row in conn.execute("PRAGMA table_info(a)")] == ["x", "y"]
+    finally:
+        conn.close()
+    assert calls == ["data"]
+
+
+def test_database_from_before_versioning_is_adopted(tmp_path):
+    # Databases created before versioning have the initial tables but user_version 0.
+    path = str(tmp_path / "s.db")
+    conn = sqlite3.connect(path)
+    conn.execute("CREATE TABLE a (x)")
+    conn.execute("INSERT INTO a VALUES ('kept')")
+    conn.commit()
+    conn.close()
+    conn = state_store.connect(path, [("CREATE TABLE IF NOT EXISTS a (x)",)])
+    try:
+        assert conn.execute("PRAGMA user_version").fetchone()[0] == 1
+        assert conn.execute("SELECT x FROM a").fetchall() == [("kept",)]
+    finally:
+        conn.close()
+
+
+def test_failed_migration_is_rolled_back(tmp_path):
+    path = str(tmp_path / "s.db")
+    with pytest.raises(sqlite3.OperationalError):
+        state_store.connect(path, [("CREATE TABLE a (x)", "INSERT INTO missing VALUES (1)")])
+    conn = sqlite3.connect(path)
+    try:
+        assert conn.execute("PRAGMA user_version").fetchone()[0] == 0
+        assert conn.execute("SELECT name FROM sqlite_master WHERE name = 'a'").fetchall() == []
+    finally:
+        conn.close()
+
+
+def test_newer_database_is_refused(tmp_path):
+    path = str(tmp_path / "s.db")
+    state_store.connect(path, [("CREATE TABLE a (x)",), ("CREATE TABLE b (x)",)]).close()
+    with pytest.raises(state_store.SchemaTooNew):
+        state_store.connect(path, [("CREATE TABLE a (x)",)])
@@ -0,0 +1,44 @@
+import sqlite3
+from datetime import date
+
+from calibre_api.app import stats
+
+
+def make_library(tmp_path):
+    conn = sqlite3.connect(str(tmp_path / "metadata.db"))
+    conn.executescript("""
+        CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT, timestamp TEXT);
+        CREATE TABLE authors (id INTEGER PRIMARY KEY, name TEXT, sort TEXT);
+        CREATE TABLE books_authors_link (id INTEGER PRIMARY KEY, book INTEGER, author INTEGER);
+        CREATE TABLE books_series_link (id INTEGER PRIMARY KEY, book INTEGER, series INTEGER);
+        CREATE TABLE books_tags_link (id INTEGER PRIMARY KEY, book INTEGER, tag INTEGER);
+        CREATE TABLE data (id INTEGER PRIMARY KEY, book INTEGER, format TEXT, uncompressed_size INTEGER, name TEXT);
+        INSERT INTO books VALUES (1, 'Dune', '2026-07-03 10:00:00+00:00'), (2, 'Dune Messiah', '2026-09-20 10:00:00+00:00'),
+                                 (3, 'Hyperion', '2026-09-21 10:00:00+00:00'), (4, 'Emma', '2024-01-01 10:00:00+00:00');
+        INSERT INTO authors VALUES (1, 'Frank Herbert', 'Herbert, Frank'), (2, 'Dan Simmons', 'Simmons, Dan'),
+                                   (3, 'Jane Austen', 'Austen, Jane'), (4, 'Unused Author', 'Author, Unused');
+        INSERT INTO books_authors_link (book, author) VALUES (1, 1), (2, 1), (3, 2), (4, 3);
+        INSERT INTO books_series_link (book, series) VALUES (1, 1), (2, 1), (3, 2);
+        INSERT INTO books_tags_link (book, tag) VALUES (1, 1), (2, 1), (3, 1), (4, 2);
+        INSERT INTO data (book, format, uncompressed_size) VALUES (1, 'EPUB', 1000), (1, 'MOBI', 1500), (2, 'EPUB', 800),
+                                                                 (3, 'EPUB', 700), (4, 'PDF', 5000);
+    """)
+    conn.commit()
+    conn.close()
+    return str(tmp_path)
+
+
+def test_library_stats(tmp_path):
+    result = stats.library_stats(make_library(tmp_path), months=3, top_authors=2, today=date(2026, 10, 16))
+    assert (result["books"], result["authors"], result["series"], result["tags"]) == (4, 3, 2, 2)
+    assert result["total_size"] == 9000
+    assert result["database_size"] == (tmp_path / "metadata.db").stat().st_size
+    assert result["formats"] == [{"format": "EPUB", "books": 3, "size": 2500}, {"format": "MOBI", "books": 1, "size": 1500},
+                                 {"format": "PDF", "books": 1, "size": 5000}]
+    assert result["added_per_month"] == [{"month": "2026-08", "books": 0}, {"month": "2026-09", "books": 2},
+                                         {"month": "2026-10", "books": 0}]
+    assert result["top_authors"] == [{"name": "Frank Herbert", "books": 2}, {"name": "Jane Austen", "books": 1}]  # Ties by sort name.
+
+
+def test_month_range_crosses_year():
+    assert stats._month_range(3, date(2026, 2, 1)) == ["2025-12", "2026-01", "2026-02"]
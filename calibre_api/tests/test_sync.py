@@ -0,0 +1,106 @@
+import json
+import os
+import sqlite3
+import zipfile
+import pytest
+from unittest import mock
+
+from calibre_api.app import sync
+
+SCHEMA = """
+CREATE TABLE books (id INTEGER PRIMARY KEY, uuid TEXT, title TEXT, sort TEXT, author_sort TEXT,
+    timestamp TEXT, pubdate TEXT, series_index REAL, path TEXT, has_cover BOOL, last_modified TEXT);
+CREATE TABLE authors (id INTEGER PRIMARY KEY, name TEXT);
+CREATE TABLE books_authors_link (id INTEGER PRIMARY KEY, book INTEGER, author INTEGER);
+CREATE TABLE tags (id INTEGER PRIMARY KEY, name TEXT);
+CREATE TABLE books_tags_link (id INTEGER PRIMARY KEY, book INTEGER, tag INTEGER);
+CREATE TABLE series (id INTEGER PRIMARY KEY, name TEXT);
+CREATE TABLE books_series_link (id INTEGER PRIMARY KEY, book INTEGER, series INTEGER);
+CREATE TABLE publishers (id INTEGER PRIMARY KEY, name TEXT);
+CREATE TABLE books_publishers_link (id INTEGER PRIMARY KEY, book INTEGER, publisher INTEGER);
+CREATE TABLE languages (id INTEGER PRIMARY KEY, lang_code TEXT);
+CREATE TABLE books_languages_link (id INTEGER PRIMARY KEY, book INTEGER, lang_code INTEGER);
+CREATE TABLE ratings (id INTEGER PRIMARY KEY, rating INTEGER);
+CREATE TABLE books_ratings_link (id INTEGER PRIMARY KEY, book INTEGER, rating INTEGER);
+CREATE TABLE data (id INTEGER PRIMARY KEY, book INTEGER, format TEXT, name TEXT);
+CREATE TABLE comments (id INTEGER PRIMARY KEY, book INTEGER, text TEXT);
+CREATE TABLE identifiers (id INTEGER PRIMARY KEY, book INTEGER, type TEXT, val TEXT);
+
+INSERT INTO books VALUES (1, 'u1', 'Dune', 'Dune', 'Herbert, Frank', '2024-01-01', '1965-08-01', 1.0,
+    'Frank Herbert/Dune (1)', 1, '2024-01-01 10:00:00.000000+00:00');
+INSERT INTO books VALUES (2, 'u2', 'Emma', 'Emma', 'Austen, Jane', '2024-01-02', '1815-12-23', 1.0,
+    'Jane Austen/Emma (2)', 0, '2024-03-05 08:30:00.000000+00:00');
+INSERT INTO authors VALUES (1, 'Frank Herbert'), (2, 'Jane Austen');
+INSERT INTO books_authors_link VALUES (1, 1, 1), (2, 2, 2);
+INSERT INTO tags VALUES (1, 'Science Fiction'), (2, 'Classic');
+INSERT INTO books_tags_link VALUES (1, 1, 1), (2, 1, 2), (3, 2, 2);
+INSERT INTO series VALUES (1, 'Dune');
+INSERT INTO books_series_link VALUES (1, 1, 1);
+INSERT INTO languages VALUES (1, 'eng');
+INSERT INTO books_languages_link VALUES (1, 1, 1), (2, 2, 1);
+INSERT INTO data VALUES (1, 1, 'EPUB', 'Dune'), (2, 1, 'AZW3', 'Dune'), (3, 2, 'PDF', 'Emma');
+INSERT INTO comments VALUES (1, 2, '<p>A novel of manners.</p>');
+INSERT INTO identifiers VALUES (1, 1, 'isbn', '9780441013593');
+"""
+
+
+@pytest.fixture
+def library(tmp_path):
+    conn = sqlite3.connect(str(tmp_path / "metadata.db"))
+    conn.executescript(SCHEMA)
+    conn.close()
+    os.makedirs(tmp_path / "Frank Herbert" / "Dune (1)")
+    (tmp_path / "Frank Herbert" / "Dune (1)" / "cover.jpg").write_bytes(b"jpeg")
+    return str(tmp_path)
+
+
+def test_read_all_books(library):
+    data = sync.read_changed_books(library)
+    assert data["rev"] == "2024-03-05 08:30:00.000000+00:00"
+    assert data["book_ids"] == [1, 2]
+    dune, emma = data["books"]
+    assert dune["authors"] == ["Frank Herbert"]
+    assert dune["tags"] == ["Science Fiction", "Classic"]
+    assert dune["series"] == "Dune"
+    assert dune["formats"] == ["AZW3", "EPUB"]
+    assert dune["identifiers"] == {"isbn": "9780441013593"}
+    assert dune["has_cover"] is True
+    assert emma["series"] is None
+    assert emma["comments"] == "<p>A novel of manners.</p>"
+
+
+def test_read_changed_books_since_rev(library):
+    data = sync.read_changed_books(library, since="2024-02-01")
+    assert [b["id"] for b in data["books"]] == [2]
+    assert data["books"][0]["tags"] == ["Classic"]
+    assert data["book_ids"] == [1, 2]
+    assert sync.read_changed_books(library, since=data["rev"])["books"] == []
+
+
+def test_write_sync_bundle(library, tmp_path):
+    output = str(tmp_path / "sync.zip")
+    with mock.patch.object(sync, "make_thumbnail", return_value=b"thumb") as mock_thumb:
+        result = sync.write_sync_bundle(library, output)
+    assert result == {"rev": "2024-03-05 08:30:00.000000+00:00", "changed": 2, "total": 2, "thumbnails": 1}
+    mock_thumb.assert_called_once_with(os.path.join(library, "Frank Herbert/Dune (1)", "cover.jpg"))
+    with zipfile.ZipFile(output) as bundle:
+        manifest = json.loads(bundle.read("manifest.json"))
+        assert bundle.read("thumbnails/1.jpg") == b"thumb"
+    assert manifest["since"] is None
+    assert manifest["books"][0]["thumbnail"] == "thumbnails/1.jpg"
+    assert "thumbnail" not in manifest["books"][1]
+
+
+def test_write_sync_bundle_without_thumbnails(library, tmp_path):
+    output = str(tmp_path / "sync.zip")
+    with mock.patch.object(sync, "make_thumbnail") as mock_thumb:
+        result = sync.write_sync_bundle(library, output, since="2024-01-01 10:00:00.000000+00:00", thumbnails=False)
+    mock_thumb.assert_not_called()
+    assert result["changed"] == 1
+    with zipfile.ZipFile(output) as bundle:
+        assert bundle.namelist() == ["manifest.json"]
+
+
+def test_write_sync_bundle_requires_library(tmp_path):
+    with pytest.raises(ValueError):
+        sync.write_sync_bundle(str(tmp_path / "missing"), str(tmp_path / "sync.zip"))
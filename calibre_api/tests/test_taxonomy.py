@@ -0,0 +1,95 @@
+import sqlite3
+import pytest
+from unittest import mock
+
+from calibre_api.app import taxonomy
+from calibre_api.app.crud import CalibredbError
+
+
+BOOKS = [
+    {"id": 1, "tags": ["SF", "Classic"], "series": "Dune"},
+    {"id": 2, "tags": ["sci-fi", "Science Fiction"], "series": "dune"},
+    {"id": 3, "tags": ["Fantasy"], "series": "Other"},
+]
+
+
+@mock.patch("calibre_api.app.taxonomy.set_book_field")
+@mock.patch("calibre_api.app.taxonomy.list_books", return_value=BOOKS)
+def test_merge_tags(mock_list, mock_set):
+    result = taxonomy.merge_tags(["SF", "sci-fi"], "Science Fiction", library_path="/lib")
+
+    assert result == {"updated_book_ids": [1, 2], "failed": []}
+    mock_list.assert_called_once_with(library_path="/lib", search_query='tags:"=SF" or tags:"=sci-fi"')
+    mock_set.assert_has_calls([
+        mock.call(1, "tags", "Science Fiction,Classic", library_path="/lib"),
+        # The book already had the target tag; it is not duplicated.
+        mock.call(2, "tags", "Science Fiction", library_path="/lib"),
+    ])
+    assert mock_set.call_count == 2
+
+
+@mock.patch("calibre_api.app.taxonomy.set_book_field")
+@mock.patch("calibre_api.app.taxonomy.list_books", return_value=BOOKS)
+def test_rename_tag_dry_run(mock_list, mock_set):
+    result = taxonomy.rename_tag("Fantasy", "High Fantasy", dry_run=True)
+    assert result["updated_book_ids"] == [3]
+    mock_set.assert_not_called()
+
+
+@mock.patch("calibre_api.app.taxonomy.set_book_field", side_effect=[CalibredbError("locked"), None])
+@mock.patch("calibre_api.app.taxonomy.list_books", return_value=BOOKS)
+def test_merge_tags_reports_per_book_failures(mock_list, mock_set):
+    result = taxonomy.merge_tags(["SF", "sci-fi"], "Science Fiction")
+    assert result == {"updated_book_ids": [2], "failed": [{"book_id": 1, "error": "locked"}]}
+
+
+@pytest.mark.parametrize("sources, target", [([], "X"), (["A"], ""), (["A"], "a,b")])
+def test_merge_tags_validates(sources, target):
+    with pytest.raises(ValueError):
+        taxonomy.merge_tags(sources, target)
+
+
+@mock.patch("calibre_api.app.taxonomy.set_book_field")
+@mock.patch("calibre_api.app.taxonomy.list_books", return_value=BOOKS)
+def test_rename_series(mock_list, mock_set):
+    result = taxonomy.rename_series('Dune', 'Dune "Saga"')
+
+    assert result["updated_book_ids"] == [1, 2]
+    mock_set.assert_any_call(1, "series", 'Dune "Saga"', library_path=None)
+    assert mock_list.call_args.kwargs["search_query"] == 'series:"=Dune"'
+
+
+def test_search_value_escapes_quotes():
+    assert taxonomy._search_value('say "hi"\\') == 'say \\"hi\\"\\\\'
+
+
+def test_find_unused_entries(tmp_path):
+    conn = sqlite3.connect(str(tmp_path / "metadata.db"))
+    for table, link_table, column in [("tags", "books_tags_link", "tag"), ("series", "books_series_link", "series"),
+                                      ("authors", "books_authors_link", "author")]:
+        conn.execute(f"CREATE TABLE {table} (id INTEGER PRIMARY KEY, name TEXT)")
+        conn.execute(f"CREATE TABLE {link_table} (id INTEGER PRIMARY KEY, book INTEGER, {column} INTEGER)")
+    conn.executemany("INSERT INTO tags (id, name) VALUES (?, ?)", [(1, "Used"), (2, "Lonely"), (3, "Also Lonely")])
+    conn.execute("INSERT INTO books_tags_link (book, tag) VALUES (1, 1)")
+    conn.execute("INSERT INTO authors (id, name) VALUES (1, 'Ghost')")
+    conn.commit()
+    conn.close()
+
+    unused = taxonomy.find_unused_entries(str(tmp_path))
+
+    # The publishers table is missing in this library; the other categories are still reported.
+    assert unused == {"tags": ["Also Lonely", "Lonely"], "series": [], "authors": ["Ghost"], "publishers": []}
+
+
+def test_list_tags(tmp_path):
+    conn = sqlite3.connect(str(tmp_path / "metadata.db"))
+    conn.execute("CREATE TABLE tags (id INTEGER PRIMARY KEY, name TEXT)")
+    conn.execute("CREATE TABLE books_tags_link (id INTEGER PRIMARY KEY, book INTEGER, tag INTEGER)")
+    conn.executemany("INSERT INTO tags (id, name) VALUES (?, ?)", [(1, "scifi"), (2, "Classics"), (3, "Unused")])
+    conn.executemany("INSERT INTO books_tags_link (book, tag) VALUES (?, ?)", [(1, 1), (2, 1), (2, 2)])
+    conn.commit()
+    conn.close()
+
+    assert taxonomy.list_tags(str(tmp_path)) == [
+        {"name": "Classics", "books": 1}, {"name": "scifi", "books": 2}, {"name": "Unused", "books": 0},
+    ]
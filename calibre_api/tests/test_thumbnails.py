@@ -0,0 +1,50 @@
+import os
+import pytest
+from unittest import mock
+
+from calibre_api.app import thumbnails
+
+
+@pytest.fixture
+def cache(tmp_path):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_THUMBNAIL_CACHE": str(tmp_path / "thumbs")}):
+        yield tmp_path / "thumbs"
+
+
+def test_get_thumbnail_is_cached(cache, tmp_path):
+    cover = tmp_path / "cover.jpg"
+    cover.write_bytes(b"original")
+    with mock.patch.object(thumbnails, "make_thumbnail", return_value=b"small jpeg") as mock_make:
+        path = thumbnails.get_thumbnail(3, str(cover), "small")
+        assert thumbnails.get_thumbnail(3, str(cover), "small") == path
+    mock_make.assert_called_once_with(str(cover), (120, 180))
+    assert open(path, "rb").read() == b"small jpeg"
+    assert os.listdir(cache) == [os.path.basename(path)]
+
+
+def test_get_thumbnail_changes_with_cover(cache, tmp_path):
+    cover = tmp_path / "cover.jpg"
+    cover.write_bytes(b"original")
+    with mock.patch.object(thumbnails, "make_thumbnail", return_value=b"jpeg"):
+        first = thumbnails.get_thumbnail(3, str(cover), "medium")
+        os.utime(cover, (1, 1))
+        assert thumbnails.get_thumbnail(3, str(cover), "medium") != first
+
+
+def test_get_thumbnail_without_pillow(cache, tmp_path):
+    cover = tmp_path / "cover.jpg"
+    cover.write_bytes(b"original")
+    with mock.patch.object(thumbnails, "make_thumbnail", return_value=None):
+        assert thumbnails.get_thumbnail(3, str(cover), "large") is None
+    assert not cache.exists()
+
+
+def test_get_thumbnail_unknown_size(cache, tmp_path):
+    with pytest.raises(ValueError):
+        thumbnails.get_thumbnail(3, str(tmp_path / "cover.jpg"), "huge")
+
+
+def test_cache_defaults_to_the_state_dir(tmp_path):
+    with mock.patch.dict(os.environ, {"SHELFSTONE_STATE_DIR": str(tmp_path)}):
+        os.environ.pop("SHELFSTONE_THUMBNAIL_CACHE", None)
+        assert thumbnails.cache_dir() == str(tmp_path / "thumbnails")
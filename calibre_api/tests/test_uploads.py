@@ -0,0 +1,76 @@
+import pytest
+from unittest import mock
+
+from calibre_api.app import uploads
+from calibre_api.app.uploads import (
+    create_upload, get_upload, append_chunk, completed_file_path, delete_upload,
+    UploadNotFound, UploadOffsetMismatch,
+)
+
+
+@pytest.fixture(autouse=True)
+def upload_root(tmp_path):
+    with mock.patch.object(uploads, 'UPLOAD_ROOT', str(tmp_path)):
+        yield tmp_path
+
+
+def test_chunked_upload_roundtrip():
+    state = create_upload("atlas.pdf", total_size=6)
+    upload_id = state["upload_id"]
+    assert state["offset"] == 0 and not state["complete"]
+
+    append_chunk(upload_id, 0, b"abc")
+    state = append_chunk(upload_id, 3, b"def")
+    assert state["offset"] == 6 and state["complete"]
+
+    path = completed_file_path(upload_id)
+    assert path.endswith("atlas.pdf")
+    with open(path, "rb") as f:
+        assert f.read() == b"abcdef"
+
+    delete_upload(upload_id)
+    with pytest.raises(UploadNotFound):
+        get_upload(upload_id)
+
+
+def test_resent_chunk_reports_expected_offset():
+    upload_id = create_upload("atlas.pdf")["upload_id"]
+    append_chunk(upload_id, 0, b"abc")
+    with pytest.raises(UploadOffsetMismatch) as excinfo:
+        append_chunk(upload_id, 0, b"abc")
+    assert excinfo.value.expected_offset == 3
+
+
+def test_chunk_beyond_total_size_rejected():
+    upload_id = create_upload("atlas.pdf", total_size=2)["upload_id"]
+    with pytest.raises(ValueError):
+        append_chunk(upload_id, 0, b"abc")
+
+
+def test_incomplete_upload_cannot_be_committed():
+    upload_id = create_upload("atlas.pdf", total_size=10)["upload_id"]
+    append_chunk(upload_id, 0, b"abc")
+    with pytest.raises(ValueError):
+        completed_file_path(upload_id)
+
+
+def test_empty_upload_cannot_be_committed():
+    upload_id = create_upload("atlas.pdf")["upload_id"]
+    with pytest.raises(ValueError):
+        completed_file_path(upload_id)
+
+
+@pytest.mark.parametrize("upload_id", ["../etc", "not-a-uuid", "00000000-0000-0000-0000-000000000000"])
+def test_unknown_upload_ids(upload_id):
+    with pytest.raises(UploadNotFound):
+        get_upload(upload_id)
+
+
+@pytest.mark.parametrize("filename", ["", "upload.json", "/"])
+def test_create_upload_requires_filename(filename):
+    with pytest.raises(ValueError):
+        create_upload(filename)
+
+
+def test_create_upload_strips_directories():
+    assert create_upload("../../evil/atlas.pdf")["filename"] == "atlas.pdf"
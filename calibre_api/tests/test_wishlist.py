@@ -0,0 +1,58 @@
+from unittest.mock import patch
+
+import pytest
+from fastapi.testclient import TestClient
+
+from calibre_api.app import accounts, wishlist
+from calibre_api.app.main import app
+
+
+def test_wishlist_entries():
+    emma = wishlist.add_wish(1, {"title": " Emma ", "isbn": "0-441-47812-3"})
+    assert (emma["title"], emma["isbn"], emma["book_id"]) == ("Emma", "9780441478125", None)
+    dune = wishlist.add_wish(1, {"title": "Dune", "book_id": 5})
+    assert [w["id"] for w in wishlist.list_wishes(1)] == [dune["id"], emma["id"]]
+    assert wishlist.list_wishes(2) == []
+
+    linked = wishlist.update_wish(1, emma["id"], {"book_id": 7, "note": "Now in the library"})
+    assert (linked["book_id"], linked["note"], linked["title"]) == (7, "Now in the library", "Emma")
+    with pytest.raises(wishlist.WishNotFound):
+        wishlist.update_wish(2, emma["id"], {"note": "Not mine"})
+    wishlist.forget_books([7])
+    assert wishlist.list_wishes(1)[1]["book_id"] is None
+
+    wishlist.delete_wish(1, dune["id"])
+    with pytest.raises(wishlist.WishNotFound):
+        wishlist.delete_wish(1, dune["id"])
+    wishlist.forget_user(1)
+    assert wishlist.list_wishes(1) == []
+
+
+@pytest.mark.parametrize("values", [{}, {"title": " "}, {"title": "Emma", "isbn": "123"}, {"title": "Emma", "shelf": "A"}])
+def test_invalid_entries(values):
+    with pytest.raises(ValueError):
+        wishlist.add_wish(1, values)
+
+
+# --- Tests for /me/wishlist ---
+
+@pytest.fixture
+def client(monkeypatch):
+    monkeypatch.setenv("SHELFSTONE_ACCOUNTS", "1")
+    monkeypatch.delenv("SHELFSTONE_ADMIN_TOKEN", raising=False)
+    user = accounts.create_user("ana", "password1")
+    client = TestClient(app)
+    client.headers["Authorization"] = f"Bearer {accounts.create_session(user['id'])['token']}"
+    return client
+
+
+@patch('calibre_api.app.main.get_book_or_404', return_value={"id": 5, "title": "Dune"})
+def test_wishlist_endpoints(mock_get_book, client):
+    response = client.post("/me/wishlist", json={"title": "Dune", "book_id": 5})
+    assert response.status_code == 201
+    wish = response.json()
+    assert client.post("/me/wishlist", json={"title": "Emma", "isbn": "12"}).status_code == 400
+    assert client.patch(f"/me/wishlist/{wish['id']}", json={"note": "Soon"}).json()["note"] == "Soon"
+    assert [w["title"] for w in client.get("/me/wishlist").json()] == ["Dune"]
+    assert client.delete(f"/me/wishlist/{wish['id']}").status_code == 204
+    assert client.delete(f"/me/wishlist/{wish['id']}").status_code == 404